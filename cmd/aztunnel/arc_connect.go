@@ -4,6 +4,7 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"log/slog"
 	"net/http"
 	"os"
 	"os/signal"
@@ -23,17 +24,25 @@ func (c *ArcConnectCmd) Run(globals *Globals, arcCmd *ArcCmd) error {
 	if err != nil {
 		return err
 	}
-	logger := newLogger(globals.LogLevel)
+	if err := arcCmd.resolveService(); err != nil {
+		return err
+	}
+	proxy, err := parseProxy(arcCmd.Proxy)
+	if err != nil {
+		return err
+	}
+	logger := newLogger(globals.LogLevel, globals.LogFormat)
+	printConfig(globals, logger, "arc connect", arcCmd.snapshot(globals, resourceID, ""))
 
 	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
 	defer stop()
 
-	m, err := resolveMetrics(ctx, globals.MetricsAddr, globals.MetricsMaxTargets, logger)
+	m, err := resolveMetrics(ctx, globals, logger)
 	if err != nil {
 		return err
 	}
 
-	client, err := arc.NewClient(logger, nil)
+	client, err := arc.NewClient(logger, arcCmd.clientOptions())
 	if err != nil {
 		return err
 	}
@@ -60,8 +69,9 @@ func (c *ArcConnectCmd) Run(globals *Globals, arcCmd *ArcCmd) error {
 
 	target := fmt.Sprintf("%s:%d", resourceID, arcCmd.Port)
 
+	ctx = arcCmd.dialContext(ctx)
 	dialStart := time.Now()
-	ws, err := arc.DialWithOptions(ctx, info, arcCmd.Port, logger, arc.DialOptions{ExplainSetup: setupRan})
+	ws, err := arc.DialWithOptions(ctx, info, arcCmd.Port, logger, arc.DialOptions{ExplainSetup: setupRan, Proxy: proxy, Compression: arcCmd.Compress})
 	m.ObserveDialDuration("sender", time.Since(dialStart).Seconds())
 	if err != nil {
 		m.ConnectionError("sender", metrics.DialReason(err, metrics.ReasonRelayFailed))
@@ -70,9 +80,10 @@ func (c *ArcConnectCmd) Run(globals *Globals, arcCmd *ArcCmd) error {
 	defer func() { _ = ws.CloseNow() }()
 
 	logger.Debug("connected to arc relay", "resource", resourceID)
+	logArcCompression(ctx, logger)
 
 	stdio := &arcStdioConn{in: os.Stdin, out: os.Stdout}
-	result, bridgeErr := m.TrackedBridge(ctx, ws, stdio, "sender", target)
+	result, bridgeErr := m.TrackedBridge(relay.WithBridgeLogger(ctx, logger), ws, stdio, "sender", target)
 	attrs := []any{
 		"target", target,
 		"cause", result.EndCause,
@@ -95,6 +106,15 @@ func (c *ArcConnectCmd) Run(globals *Globals, arcCmd *ArcCmd) error {
 	return bridgeErr
 }
 
+// logArcCompression logs whether a --compress arc dial negotiated
+// permessage-deflate. The Arc agent's own hop is outside aztunnel's
+// control, so only the hop to Azure Relay is reported.
+func logArcCompression(ctx context.Context, logger *slog.Logger) {
+	if wire := relay.WireCounterFrom(ctx); wire != nil {
+		logger.Debug("compression negotiated", "sender_hop", wire.Deflate())
+	}
+}
+
 // isHybridConnectivitySetupErr reports whether err is an ARM error that
 // indicates the HybridConnectivity endpoint or service configuration needs
 // to be created. We treat 404 (ResourceNotFound) and 412 (PreconditionFailed
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+
+	"github.com/philsphicas/aztunnel/internal/arc"
+)
+
+// ArcListCmd prints the Arc-connected machines in a subscription, so
+// their resource IDs can be copied into --resource-id.
+type ArcListCmd struct {
+	Subscription  string `help:"Subscription ID to list machines in (default: AZURE_SUBSCRIPTION_ID)."`
+	ResourceGroup string `name:"resource-group" short:"g" help:"Only list machines in this resource group."`
+	Output        string `short:"o" help:"Output format (text, json)." enum:"text,json" default:"text"`
+}
+
+// Run executes the arc list command.
+func (l *ArcListCmd) Run(globals *Globals, arcCmd *ArcCmd) error {
+	subscription := l.Subscription
+	if subscription == "" {
+		subscription = os.Getenv("AZURE_SUBSCRIPTION_ID")
+	}
+	if subscription == "" {
+		return errors.New("subscription is required: use --subscription or set AZURE_SUBSCRIPTION_ID")
+	}
+	logger := newLogger(globals.LogLevel, globals.LogFormat)
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	client, err := arc.NewClient(logger, arcCmd.clientOptions())
+	if err != nil {
+		return err
+	}
+	machines, err := client.ListMachines(ctx, subscription, l.ResourceGroup)
+	if err != nil {
+		return err
+	}
+	if l.Output == "json" {
+		return writeMachinesJSON(os.Stdout, machines)
+	}
+	return writeMachines(os.Stdout, machines)
+}
+
+// writeMachines prints one tab-separated line per machine under a
+// header, so the output greps and cuts cleanly, or a note when there
+// are none.
+func writeMachines(w io.Writer, machines []arc.Machine) error {
+	if len(machines) == 0 {
+		_, err := fmt.Fprintln(w, "no Arc machines")
+		return err
+	}
+	if _, err := fmt.Fprintln(w, "NAME\tRESOURCE GROUP\tSTATUS\tRESOURCE ID"); err != nil {
+		return err
+	}
+	for _, m := range machines {
+		if _, err := fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", m.Name, m.ResourceGroup, m.Status, m.ID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeMachinesJSON prints machines as an indented JSON array; an
+// empty list is [] rather than null.
+func writeMachinesJSON(w io.Writer, machines []arc.Machine) error {
+	if machines == nil {
+		machines = []arc.Machine{}
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(machines)
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/signal"
+	"text/tabwriter"
+
+	"github.com/philsphicas/aztunnel/internal/arc"
+)
+
+// ArcListServicesCmd prints the service configurations on an Arc
+// machine's HybridConnectivity endpoint.
+type ArcListServicesCmd struct{}
+
+// Run executes the arc list-services command.
+func (l *ArcListServicesCmd) Run(globals *Globals, arcCmd *ArcCmd) error {
+	resourceID, err := resolveResourceID(arcCmd.ResourceID)
+	if err != nil {
+		return err
+	}
+	logger := newLogger(globals.LogLevel, globals.LogFormat)
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	client, err := arc.NewClient(logger, arcCmd.clientOptions())
+	if err != nil {
+		return err
+	}
+	services, err := client.ListServiceConfigurations(ctx, resourceID)
+	var armErr *arc.ARMError
+	if errors.As(err, &armErr) && armErr.StatusCode == http.StatusNotFound {
+		// No HybridConnectivity endpoint yet: nothing is configured.
+		services, err = nil, nil
+	}
+	if err != nil {
+		return err
+	}
+	return writeServices(os.Stdout, services)
+}
+
+// writeServices prints services as a SERVICE/PORT table, or a note
+// when there are none.
+func writeServices(w io.Writer, services []arc.ServiceConfiguration) error {
+	if len(services) == 0 {
+		_, err := fmt.Fprintln(w, "no service configurations")
+		return err
+	}
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "SERVICE\tPORT")
+	for _, s := range services {
+		fmt.Fprintf(tw, "%s\t%d\n", s.ServiceName, s.Port)
+	}
+	return tw.Flush()
+}
@@ -0,0 +1,27 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/philsphicas/aztunnel/internal/arc"
+)
+
+func TestWriteServices(t *testing.T) {
+	var buf bytes.Buffer
+	if err := writeServices(&buf, []arc.ServiceConfiguration{{ServiceName: "SSH", Port: 22}, {ServiceName: "WAC", Port: 6516}}); err != nil {
+		t.Fatalf("writeServices: %v", err)
+	}
+	want := "SERVICE  PORT\nSSH      22\nWAC      6516\n"
+	if buf.String() != want {
+		t.Errorf("output = %q, want %q", buf.String(), want)
+	}
+
+	buf.Reset()
+	if err := writeServices(&buf, nil); err != nil {
+		t.Fatalf("writeServices: %v", err)
+	}
+	if buf.String() != "no service configurations\n" {
+		t.Errorf("empty output = %q", buf.String())
+	}
+}
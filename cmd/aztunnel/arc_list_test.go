@@ -0,0 +1,57 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+
+	"github.com/philsphicas/aztunnel/internal/arc"
+)
+
+var testMachines = []arc.Machine{
+	{Name: "vm1", ResourceGroup: "rg1", Location: "eastus", Status: "Connected", ID: "/subscriptions/s/resourceGroups/rg1/providers/Microsoft.HybridCompute/machines/vm1"},
+	{Name: "vm2", ResourceGroup: "rg2", Location: "westus", Status: "Disconnected", ID: "/subscriptions/s/resourceGroups/rg2/providers/Microsoft.HybridCompute/machines/vm2"},
+}
+
+func TestWriteMachines(t *testing.T) {
+	var buf bytes.Buffer
+	if err := writeMachines(&buf, testMachines); err != nil {
+		t.Fatalf("writeMachines: %v", err)
+	}
+	want := "NAME\tRESOURCE GROUP\tSTATUS\tRESOURCE ID\n" +
+		"vm1\trg1\tConnected\t/subscriptions/s/resourceGroups/rg1/providers/Microsoft.HybridCompute/machines/vm1\n" +
+		"vm2\trg2\tDisconnected\t/subscriptions/s/resourceGroups/rg2/providers/Microsoft.HybridCompute/machines/vm2\n"
+	if buf.String() != want {
+		t.Errorf("output = %q, want %q", buf.String(), want)
+	}
+
+	buf.Reset()
+	if err := writeMachines(&buf, nil); err != nil {
+		t.Fatalf("writeMachines: %v", err)
+	}
+	if buf.String() != "no Arc machines\n" {
+		t.Errorf("empty output = %q", buf.String())
+	}
+}
+
+func TestWriteMachinesJSON(t *testing.T) {
+	var buf bytes.Buffer
+	if err := writeMachinesJSON(&buf, testMachines); err != nil {
+		t.Fatalf("writeMachinesJSON: %v", err)
+	}
+	var got []map[string]string
+	if err := json.Unmarshal(buf.Bytes(), &got); err != nil {
+		t.Fatalf("parse %q: %v", buf.String(), err)
+	}
+	if len(got) != 2 || got[0]["name"] != "vm1" || got[1]["resourceGroup"] != "rg2" || got[0]["id"] != testMachines[0].ID {
+		t.Errorf("json = %v", got)
+	}
+
+	buf.Reset()
+	if err := writeMachinesJSON(&buf, nil); err != nil {
+		t.Fatalf("writeMachinesJSON: %v", err)
+	}
+	if buf.String() != "[]\n" {
+		t.Errorf("empty json = %q, want []", buf.String())
+	}
+}
@@ -2,10 +2,12 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"net"
 	"os"
 	"os/signal"
+	"strings"
 	"sync/atomic"
 	"time"
 
@@ -25,28 +27,36 @@ func (p *ArcPortForwardCmd) Run(globals *Globals, arcCmd *ArcCmd) error {
 	if err != nil {
 		return err
 	}
-	bind := p.Bind
-	if p.Gateway {
-		_, port, err := net.SplitHostPort(bind)
-		if err != nil {
-			return fmt.Errorf("invalid --bind address %q: %w", bind, err)
-		}
-		if port == "" {
-			port = "0"
-		}
-		bind = "0.0.0.0:" + port
+	bind, err := p.resolve()
+	if err != nil {
+		return err
+	}
+	if strings.HasPrefix(bind, "unix:") {
+		return errors.New("arc port-forward does not support a unix: --bind")
+	}
+	if err := arcCmd.resolveService(); err != nil {
+		return err
 	}
-	logger := newLogger(globals.LogLevel)
+	proxy, err := parseProxy(arcCmd.Proxy)
+	if err != nil {
+		return err
+	}
+	logger := newLogger(globals.LogLevel, globals.LogFormat)
+	printConfig(globals, logger, "arc port-forward", arcCmd.snapshot(globals, resourceID, bind))
 
 	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
 	defer stop()
 
-	m, err := resolveMetrics(ctx, globals.MetricsAddr, globals.MetricsMaxTargets, logger)
+	m, err := resolveMetrics(ctx, globals, logger)
+	if err != nil {
+		return err
+	}
+	readiness, err := resolveHealth(ctx, globals.HealthAddr, logger)
 	if err != nil {
 		return err
 	}
 
-	client, err := arc.NewClient(logger, nil)
+	client, err := arc.NewClient(logger, arcCmd.clientOptions())
 	if err != nil {
 		return err
 	}
@@ -60,7 +70,7 @@ func (p *ArcPortForwardCmd) Run(globals *Globals, arcCmd *ArcCmd) error {
 	// dial can emit an INFO message explaining that the Arc agent may need
 	// time to register a listener. Subsequent dials run quietly.
 	var explainOnFirstDial atomic.Bool
-	if _, err := client.GetRelayCredentials(ctx, resourceID, arcCmd.Service); err != nil {
+	if _, err := client.CachedRelayCredentials(ctx, resourceID, arcCmd.Service); err != nil {
 		if isHybridConnectivitySetupErr(err) {
 			logger.Info("creating Arc HybridConnectivity configuration; the first forwarded connection may wait while the Arc agent registers a relay listener")
 			explainOnFirstDial.Store(true)
@@ -72,12 +82,13 @@ func (p *ArcPortForwardCmd) Run(globals *Globals, arcCmd *ArcCmd) error {
 		}
 	}
 
-	ln, err := net.Listen("tcp", bind)
+	ln, err := net.Listen(p.LocalFamily, bind)
 	if err != nil {
 		return fmt.Errorf("listen %s: %w", bind, err)
 	}
 	defer func() { _ = ln.Close() }()
 	logger.Info("arc port-forward listening", "bind", ln.Addr(), "resource", resourceID, "port", arcCmd.Port)
+	readiness.SetReady(true)
 
 	go func() {
 		<-ctx.Done()
@@ -100,17 +111,19 @@ func (p *ArcPortForwardCmd) Run(globals *Globals, arcCmd *ArcCmd) error {
 			defer func() { _ = conn.Close() }()
 			relay.SetTCPKeepAlive(conn, p.TCPKeepAlive)
 
-			// Get fresh credentials for each connection to avoid SAS expiry.
-			info, err := client.GetRelayCredentials(ctx, resourceID, arcCmd.Service)
+			// Reuse the SAS across connections; the client refetches
+			// it shortly before it expires.
+			info, err := client.CachedRelayCredentials(ctx, resourceID, arcCmd.Service)
 			if err != nil {
 				logger.Warn("get relay credentials failed", "error", err)
 				m.ConnectionError("sender", metrics.ReasonAuthFailed)
 				return
 			}
 
-			opts := arc.DialOptions{ExplainSetup: consumeExplainOnFirstDial(&explainOnFirstDial)}
+			opts := arc.DialOptions{ExplainSetup: consumeExplainOnFirstDial(&explainOnFirstDial), Proxy: proxy, Compression: arcCmd.Compress}
+			cctx := arcCmd.dialContext(ctx)
 			dialStart := time.Now()
-			ws, err := arc.DialWithOptions(ctx, info, arcCmd.Port, logger, opts)
+			ws, err := arc.DialWithOptions(cctx, info, arcCmd.Port, logger, opts)
 			m.ObserveDialDuration("sender", time.Since(dialStart).Seconds())
 			if err != nil {
 				logger.Warn("arc relay dial failed", "error", err)
@@ -119,7 +132,10 @@ func (p *ArcPortForwardCmd) Run(globals *Globals, arcCmd *ArcCmd) error {
 			}
 			defer func() { _ = ws.CloseNow() }()
 
-			result, bridgeErr := m.TrackedBridge(ctx, ws, conn, "sender", target)
+			logArcCompression(cctx, logger)
+
+			bctx := metrics.WithClientAddr(relay.WithBridgeLogger(cctx, logger), conn.RemoteAddr().String())
+			result, bridgeErr := m.TrackedBridge(bctx, ws, conn, "sender", target)
 			attrs := []any{
 				"target", target,
 				"cause", result.EndCause,
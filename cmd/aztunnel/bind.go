@@ -0,0 +1,138 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"strings"
+)
+
+// resolve returns the local listen address selected by the bind flags.
+// --gateway rewrites the host to 0.0.0.0 and --bind-interface to the
+// named interface's address; in both cases the port still comes from
+// --bind. A unix:/path --bind names a Unix domain socket and is
+// returned as is.
+//
+// A --local-family of tcp4 or tcp6 decides the address family: it
+// overrides --bind-family, makes --gateway bind :: for tcp6, and an
+// IP literal --bind or an interface without an address of that family
+// is an error rather than a listen that fails later.
+func (b BindFlags) resolve() (string, error) {
+	if b.Gateway && b.BindInterface != "" {
+		return "", errors.New("--gateway and --bind-interface are mutually exclusive")
+	}
+	if path, ok := strings.CutPrefix(b.Bind, "unix:"); ok {
+		switch {
+		case path == "":
+			return "", errors.New("--bind unix: needs a socket path")
+		case b.Gateway || b.BindInterface != "":
+			return "", errors.New("--gateway and --bind-interface do not apply to a unix: --bind")
+		}
+		return b.Bind, nil
+	}
+	if !b.Gateway && b.BindInterface == "" {
+		if host, _, err := net.SplitHostPort(b.Bind); err == nil && !familyMatches(host, b.LocalFamily) {
+			return "", fmt.Errorf("--bind %s is not an %s address, as --local-family %s requires", host, familyName(b.LocalFamily), b.LocalFamily)
+		}
+		return b.Bind, nil
+	}
+	_, port, err := net.SplitHostPort(b.Bind)
+	if err != nil {
+		return "", fmt.Errorf("invalid --bind address %q: %w", b.Bind, err)
+	}
+	if port == "" {
+		port = "0"
+	}
+	if b.Gateway {
+		if b.LocalFamily == "tcp6" {
+			return net.JoinHostPort("::", port), nil
+		}
+		return "0.0.0.0:" + port, nil
+	}
+	ifi, err := net.InterfaceByName(b.BindInterface)
+	if err != nil {
+		return "", fmt.Errorf("--bind-interface %q: %w", b.BindInterface, err)
+	}
+	addrs, err := ifi.Addrs()
+	if err != nil {
+		return "", fmt.Errorf("--bind-interface %q: list addresses: %w", b.BindInterface, err)
+	}
+	family := b.BindFamily
+	switch b.LocalFamily {
+	case "tcp4":
+		family = "ip4"
+	case "tcp6":
+		family = "ip6"
+	}
+	host, err := pickInterfaceAddr(addrs, family)
+	if err != nil {
+		return "", fmt.Errorf("--bind-interface %q: %w", b.BindInterface, err)
+	}
+	if !familyMatches(host, b.LocalFamily) {
+		return "", fmt.Errorf("--bind-interface %q has no %s address for --local-family %s", b.BindInterface, familyName(b.LocalFamily), b.LocalFamily)
+	}
+	return net.JoinHostPort(host, port), nil
+}
+
+// familyMatches reports whether host can be listened on with network
+// ("tcp", "tcp4", or "tcp6"). Only IP literals are checked; a hostname
+// or empty host is left to the listen itself.
+func familyMatches(host, network string) bool {
+	ip, err := netip.ParseAddr(host)
+	if err != nil {
+		return true
+	}
+	switch network {
+	case "tcp4":
+		return ip.Unmap().Is4()
+	case "tcp6":
+		return !ip.Is4()
+	}
+	return true
+}
+
+// familyName names the address family of a tcp4 or tcp6 network for
+// error messages.
+func familyName(network string) string {
+	if network == "tcp6" {
+		return "IPv6"
+	}
+	return "IPv4"
+}
+
+// pickInterfaceAddr chooses the address to bind from an interface's
+// addresses: the first usable address of the preferred family ("ip4"
+// or "ip6"), falling back to the first usable address of the other
+// family. IPv6 link-local addresses are skipped because binding them
+// requires a zone and they are rarely what an operator means.
+func pickInterfaceAddr(addrs []net.Addr, family string) (string, error) {
+	var v4, v6 []net.IP
+	for _, a := range addrs {
+		var ip net.IP
+		switch a := a.(type) {
+		case *net.IPNet:
+			ip = a.IP
+		case *net.IPAddr:
+			ip = a.IP
+		default:
+			continue
+		}
+		if ip4 := ip.To4(); ip4 != nil {
+			v4 = append(v4, ip4)
+		} else if !ip.IsLinkLocalUnicast() {
+			v6 = append(v6, ip)
+		}
+	}
+	preferred, fallback := v4, v6
+	if family == "ip6" {
+		preferred, fallback = v6, v4
+	}
+	if len(preferred) > 0 {
+		return preferred[0].String(), nil
+	}
+	if len(fallback) > 0 {
+		return fallback[0].String(), nil
+	}
+	return "", errors.New("interface has no usable IP address")
+}
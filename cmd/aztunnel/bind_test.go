@@ -0,0 +1,164 @@
+package main
+
+import (
+	"net"
+	"strings"
+	"testing"
+)
+
+func loopbackInterface(t *testing.T) string {
+	t.Helper()
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		t.Fatalf("net.Interfaces: %v", err)
+	}
+	for _, ifi := range ifaces {
+		if ifi.Flags&net.FlagLoopback != 0 && ifi.Flags&net.FlagUp != 0 {
+			return ifi.Name
+		}
+	}
+	t.Skip("no loopback interface available")
+	return ""
+}
+
+func TestBindFlagsResolve_Interface(t *testing.T) {
+	name := loopbackInterface(t)
+	addr, err := BindFlags{Bind: "127.0.0.1:0", BindInterface: name, BindFamily: "ip4"}.resolve()
+	if err != nil {
+		t.Fatalf("resolve: %v", err)
+	}
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		t.Fatalf("SplitHostPort(%q): %v", addr, err)
+	}
+	if ip := net.ParseIP(host); ip == nil || !ip.IsLoopback() {
+		t.Errorf("host = %q, want a loopback address", host)
+	}
+	if port != "0" {
+		t.Errorf("port = %q, want %q", port, "0")
+	}
+
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		t.Fatalf("listen on %s: %v", addr, err)
+	}
+	ln.Close()
+}
+
+func TestBindFlagsResolve_InterfaceLocalFamily(t *testing.T) {
+	name := loopbackInterface(t)
+	ifi, err := net.InterfaceByName(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	addrs, err := ifi.Addrs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var has6 bool
+	for _, a := range addrs {
+		if n, ok := a.(*net.IPNet); ok && n.IP.To4() == nil && !n.IP.IsLinkLocalUnicast() {
+			has6 = true
+		}
+	}
+
+	// tcp6 overrides the default --bind-family ip4: it must pick the
+	// IPv6 address, or refuse rather than fall back to IPv4.
+	addr, err := BindFlags{Bind: "127.0.0.1:0", BindInterface: name, BindFamily: "ip4", LocalFamily: "tcp6"}.resolve()
+	if !has6 {
+		if err == nil || !strings.Contains(err.Error(), "no IPv6 address for --local-family tcp6") {
+			t.Fatalf("resolve = %q, %v; want a --local-family conflict error", addr, err)
+		}
+		return
+	}
+	if err != nil {
+		t.Fatalf("resolve: %v", err)
+	}
+	host, _, _ := net.SplitHostPort(addr)
+	if ip := net.ParseIP(host); ip == nil || ip.To4() != nil {
+		t.Errorf("host = %q, want an IPv6 address", host)
+	}
+}
+
+func TestBindFlagsResolve(t *testing.T) {
+	tests := []struct {
+		name    string
+		flags   BindFlags
+		want    string
+		wantErr string
+	}{
+		{"plain", BindFlags{Bind: "127.0.0.1:8080"}, "127.0.0.1:8080", ""},
+		{"gateway", BindFlags{Bind: "127.0.0.1:8080", Gateway: true}, "0.0.0.0:8080", ""},
+		{"gateway empty port", BindFlags{Bind: "127.0.0.1:", Gateway: true}, "0.0.0.0:0", ""},
+		{"gateway bad bind", BindFlags{Bind: "nope", Gateway: true}, "", "invalid --bind address"},
+		{"gateway and interface", BindFlags{Bind: "127.0.0.1:0", Gateway: true, BindInterface: "lo"}, "", "mutually exclusive"},
+		{"unknown interface", BindFlags{Bind: "127.0.0.1:0", BindInterface: "aztunnel-no-such-if0"}, "", "aztunnel-no-such-if0"},
+		{"unix socket", BindFlags{Bind: "unix:/run/aztunnel/db.sock"}, "unix:/run/aztunnel/db.sock", ""},
+		{"unix empty path", BindFlags{Bind: "unix:"}, "", "needs a socket path"},
+		{"unix with gateway", BindFlags{Bind: "unix:/tmp/x.sock", Gateway: true}, "", "do not apply"},
+		{"tcp4 bind", BindFlags{Bind: "127.0.0.1:8080", LocalFamily: "tcp4"}, "127.0.0.1:8080", ""},
+		{"tcp6 bind", BindFlags{Bind: "[::1]:8080", LocalFamily: "tcp6"}, "[::1]:8080", ""},
+		{"tcp6 hostname bind", BindFlags{Bind: "localhost:8080", LocalFamily: "tcp6"}, "localhost:8080", ""},
+		{"tcp6 gateway", BindFlags{Bind: "127.0.0.1:8080", Gateway: true, LocalFamily: "tcp6"}, "[::]:8080", ""},
+		{"tcp6 with ip4 bind", BindFlags{Bind: "127.0.0.1:8080", LocalFamily: "tcp6"}, "", "not an IPv6 address"},
+		{"tcp4 with ip6 bind", BindFlags{Bind: "[::1]:8080", LocalFamily: "tcp4"}, "", "not an IPv4 address"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.flags.resolve()
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("err = %v, want containing %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("resolve: %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("resolve = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPickInterfaceAddr(t *testing.T) {
+	ipnet := func(s string) net.Addr {
+		ip, n, err := net.ParseCIDR(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return &net.IPNet{IP: ip, Mask: n.Mask}
+	}
+	multi := []net.Addr{ipnet("fe80::1/64"), ipnet("2001:db8::5/64"), ipnet("192.0.2.7/24"), ipnet("192.0.2.8/24")}
+
+	tests := []struct {
+		name   string
+		addrs  []net.Addr
+		family string
+		want   string
+	}{
+		{"prefer ip4", multi, "ip4", "192.0.2.7"},
+		{"prefer ip6 skips link-local", multi, "ip6", "2001:db8::5"},
+		{"fall back to ip4", []net.Addr{ipnet("fe80::1/64"), ipnet("192.0.2.7/24")}, "ip6", "192.0.2.7"},
+		{"fall back to ip6", []net.Addr{ipnet("2001:db8::5/64")}, "ip4", "2001:db8::5"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := pickInterfaceAddr(tt.addrs, tt.family)
+			if err != nil {
+				t.Fatalf("pickInterfaceAddr: %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("pickInterfaceAddr = %q, want %q", got, tt.want)
+			}
+		})
+	}
+
+	if _, err := pickInterfaceAddr(nil, "ip4"); err == nil {
+		t.Error("no addresses: want error")
+	}
+	if _, err := pickInterfaceAddr([]net.Addr{ipnet("fe80::1/64")}, "ip6"); err == nil {
+		t.Error("link-local only: want error")
+	}
+}
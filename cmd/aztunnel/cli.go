@@ -1,29 +1,66 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"log/slog"
 	"time"
 
 	"github.com/alecthomas/kong"
+	"github.com/philsphicas/aztunnel/internal/arc"
+	"github.com/philsphicas/aztunnel/internal/metrics"
+	"github.com/philsphicas/aztunnel/internal/relay"
+	"github.com/philsphicas/aztunnel/internal/tracing"
 	"github.com/willabides/kongplete"
 )
 
-// CLI defines the top-level command structure.
-var CLI struct {
+// cli defines the top-level command structure.
+type cli struct {
 	Globals
 
 	RelayListener RelayListenerCmd             `cmd:"" name:"relay-listener" help:"Listen on Azure Relay and forward connections to local targets."`
 	RelaySender   RelaySenderCmd               `cmd:"" name:"relay-sender" help:"Send connections through Azure Relay."`
 	Arc           ArcCmd                       `cmd:"" help:"Connect through Azure Arc managed relays."`
 	Version       VersionFlag                  `name:"version" help:"Print version and exit."`
-	Completion    kongplete.InstallCompletions `cmd:"" help:"Output shell completion script." hidden:""`
+	Completion    kongplete.InstallCompletions `cmd:"" help:"Output shell completion script."`
 }
 
+// CLI holds the parsed command line.
+var CLI cli
+
 // Globals holds flags inherited by all commands.
 type Globals struct {
-	LogLevel          string `name:"log-level" help:"Log level (debug, info, warn, error)." default:"info"`
-	MetricsAddr       string `name:"metrics-addr" help:"Address for Prometheus metrics server (e.g. :9090); disabled if empty."`
-	MetricsMaxTargets int    `name:"metrics-max-targets" help:"Max unique target labels in metrics (0 = unlimited)." default:"500"`
+	Config              kong.ConfigFlag   `name:"config" help:"Read flag values from this YAML file (keys are flag names); flags and env vars take precedence."`
+	LogLevel            string            `name:"log-level" help:"Log level (debug, info, warn, error)." default:"info"`
+	LogFormat           string            `name:"log-format" help:"Log format (text, json)." enum:"text,json" default:"text"`
+	MetricsAddr         string            `name:"metrics-addr" help:"Address for Prometheus metrics server (e.g. :9090); disabled if empty."`
+	MetricsMaxTargets   int               `name:"metrics-max-targets" help:"Max unique target labels in metrics (0 = unlimited)." default:"500"`
+	MetricsDetailed     bool              `name:"metrics-detailed-labels" help:"Also track active connections by local address and relay host (capped by --metrics-max-targets)."`
+	MetricsAdmin        bool              `name:"metrics-admin" help:"Serve /connections, POST /connections/{id}/close, and POST /quiesce and /resume (relay-listener) on the metrics server. Requires --metrics-token."`
+	Pprof               bool              `name:"pprof" help:"Serve net/http/pprof under /debug/pprof/ on the metrics server; keep --metrics-addr on localhost."`
+	MetricsLabel        map[string]string `name:"metrics-label" help:"Constant label (key=value) added to every metric (repeatable)."`
+	MetricsNoRuntime    bool              `name:"metrics-no-runtime" help:"Omit the Go runtime and process metrics (go_*, process_*)."`
+	MetricsTLSCert      string            `name:"metrics-tls-cert" help:"PEM certificate to serve the metrics server over HTTPS (with --metrics-tls-key)."`
+	MetricsTLSKey       string            `name:"metrics-tls-key" help:"PEM private key for --metrics-tls-cert."`
+	MetricsToken        string            `name:"metrics-token" help:"Require this bearer token on the metrics server (all but /healthz and /readyz); disabled if empty."`
+	SLOThreshold        time.Duration     `name:"slo-threshold" help:"Apdex target for dial latency; counts dials as satisfied, tolerating, or frustrated (0 = disabled)."`
+	AccessLog           string            `name:"access-log" help:"Write one line per finished connection to this file (- for stderr), whatever the log level; disabled if empty."`
+	HealthAddr          string            `name:"health-addr" help:"Address for a standalone /healthz and /readyz server (e.g. :8081); disabled if empty."`
+	MetricsPush         string            `name:"metrics-push" help:"Prometheus Pushgateway URL to push metrics to on exit; disabled if empty."`
+	MetricsPushJob      string            `name:"metrics-push-job" help:"Job name for --metrics-push." default:"aztunnel"`
+	MetricsPushInterval time.Duration     `name:"metrics-push-interval" help:"Also push every interval while running (0 = only on exit)."`
+	OTelEndpoint        string            `name:"otel-endpoint" help:"OTLP/HTTP collector URL (e.g. http://localhost:4318) to export connection traces to; disabled if empty."`
+	PrintConfig         bool              `name:"print-config" help:"Log the effective configuration (secrets redacted) at startup."`
+	RedactPatterns      []string          `name:"redact-pattern" sep:"none" help:"Extra secret regex to scrub from logs and errors (repeatable)."`
+
+	// pusher, when set by resolveMetrics, receives the final
+	// pushgateway push after the command returns; tracer, when set by
+	// resolveTracer, is flushed then too. exitLogger reports failures
+	// of either.
+	pusher     *metrics.Pusher
+	tracer     *tracing.Tracer
+	exitLogger *slog.Logger
 }
 
 // VersionFlag prints the version and exits when used as --version.
@@ -38,18 +75,59 @@ func (v VersionFlag) BeforeApply(app *kong.Kong) error {
 
 // AuthFlags holds Azure Relay authentication flags shared across relay commands.
 type AuthFlags struct {
-	Relay            string `help:"Azure Relay namespace name, FQDN, or URI."`
-	Namespace        string `name:"namespace" help:"Azure Relay namespace name (alias for --relay)." hidden:""`
-	Hyco             string `help:"Hybrid connection name."`
-	RelaySuffix      string `name:"relay-suffix" help:"Namespace suffix for sovereign clouds." default:""`
-	RelayInsecureTLS bool   `name:"relay-insecure-tls" help:"Skip TLS certificate verification (mock/self-hosted only)."`
+	Relay            string        `help:"Azure Relay namespace name, FQDN, or URI." predictor:"relay"`
+	Namespace        string        `name:"namespace" help:"Azure Relay namespace name (alias for --relay)." hidden:""`
+	Hyco             []string      `help:"Hybrid connection name; relay-listener takes several (repeat or comma-separate) and serves them all." predictor:"hyco"`
+	RelaySuffix      string        `name:"relay-suffix" help:"Namespace suffix for sovereign clouds." default:""`
+	RelayInsecureTLS bool          `name:"relay-insecure-tls" help:"Skip TLS certificate verification (mock/self-hosted only)."`
+	StrictCloud      bool          `name:"strict-cloud" help:"Fail instead of warn when the relay suffix and Entra authority are for different clouds."`
+	DNSServer        []string      `name:"dns-server" help:"DNS server (host[:port]) for relay and target lookups instead of the system resolver (repeatable)."`
+	DNSDoH           string        `name:"dns-doh" help:"DNS-over-HTTPS URL for relay and target lookups (overrides --dns-server)."`
+	RelayIP          string        `name:"relay-ip" help:"Connect to this IP for the relay endpoint, keeping the real host name for TLS and auth."`
+	Proxy            string        `name:"proxy" help:"HTTP(S) or SOCKS5 proxy URL for relay connections, instead of HTTPS_PROXY."`
+	CAFile           string        `name:"ca-file" help:"Also trust the PEM CA certificates in this file for relay TLS, e.g. a TLS-inspecting proxy's CA."`
+	ClientID         string        `name:"client-id" help:"Client ID of the user-assigned managed identity to use for Entra auth (env: AZTUNNEL_CLIENT_ID)."`
+	KeyFile          string        `name:"key-file" help:"Read SAS credentials (keyName=/key= lines, JSON, or a bare key) from this file instead of AZTUNNEL_KEY (env: AZTUNNEL_KEY_FILE)."`
+	SASExpiry        time.Duration `name:"sas-expiry" help:"Lifetime of each SAS token signed with the key." default:"1h"`
 }
 
-// BindFlags holds local bind flags shared across port-forward and socks5 commands.
+// BindFlags holds local bind flags shared across port-forward and proxy commands.
 type BindFlags struct {
-	Bind         string        `short:"b" help:"Local bind address:port." default:"127.0.0.1:0"`
-	Gateway      bool          `help:"Bind to 0.0.0.0 instead of 127.0.0.1."`
-	TCPKeepAlive time.Duration `name:"tcp-keepalive" help:"TCP keepalive interval." default:"30s"`
+	Bind          string        `short:"b" help:"Local bind address:port, or unix:/path for a Unix domain socket (relay-sender only)." default:"127.0.0.1:0"`
+	Gateway       bool          `help:"Bind to 0.0.0.0 instead of 127.0.0.1."`
+	BindInterface string        `name:"bind-interface" help:"Bind to the address of this network interface (port from --bind)."`
+	BindFamily    string        `name:"bind-family" help:"Address family preferred with --bind-interface (ip4, ip6); a tcp4 or tcp6 --local-family overrides it." enum:"ip4,ip6" default:"ip4"`
+	LocalFamily   string        `name:"local-family" help:"Network for the local listener (tcp, tcp4, tcp6); tcp4 and tcp6 also fix the --bind-interface and --gateway address family." enum:"tcp,tcp4,tcp6" default:"tcp"`
+	TCPKeepAlive  time.Duration `name:"tcp-keepalive" help:"TCP keepalive interval." default:"30s"`
+}
+
+// BridgeFlags holds data-path tuning flags shared by commands that
+// bridge relay connections.
+type BridgeFlags struct {
+	BufferSize       int           `name:"buffer-size" help:"Copy buffer size in bytes for each bridge direction (1024-1048576)." default:"32768"`
+	IdleTimeout      time.Duration `name:"idle-timeout" help:"Close a bridged connection after this long with no data in either direction (0 = never)." default:"0"`
+	RateLimit        int64         `name:"rate-limit" help:"Cap each direction of every bridged connection at this many bytes/sec (0 = unlimited)." default:"0"`
+	DataPingInterval time.Duration `name:"data-ping-interval" help:"Ping a bridged connection's WebSocket once it has sent nothing for this long (0 = never)." default:"30s"`
+}
+
+// bufferSize returns --buffer-size after checking it is in range.
+func (b BridgeFlags) bufferSize() (int, error) {
+	if b.BufferSize < relay.MinBufferSize || b.BufferSize > relay.MaxBufferSize {
+		return 0, fmt.Errorf("--buffer-size must be between %d and %d bytes, got %d", relay.MinBufferSize, relay.MaxBufferSize, b.BufferSize)
+	}
+	return b.BufferSize, nil
+}
+
+// dataPingInterval returns --data-ping-interval as a
+// relay.BridgeOptions.PingInterval, where 0 (never) becomes negative.
+func (b BridgeFlags) dataPingInterval() (time.Duration, error) {
+	switch {
+	case b.DataPingInterval < 0:
+		return 0, errors.New("--data-ping-interval must not be negative")
+	case b.DataPingInterval == 0:
+		return -1, nil
+	}
+	return b.DataPingInterval, nil
 }
 
 // RelaySenderCmd is a grouping command for relay sender subcommands.
@@ -57,14 +135,55 @@ type RelaySenderCmd struct {
 	PortForward PortForwardCmd `cmd:"" name:"port-forward" help:"Forward a local port through the relay to a specific target."`
 	Connect     ConnectCmd     `cmd:"" help:"One-shot stdin/stdout connection through the relay."`
 	Socks5Proxy Socks5ProxyCmd `cmd:"" name:"socks5-proxy" help:"Run a local SOCKS5 proxy that forwards through the relay."`
+	HTTPProxy   HTTPProxyCmd   `cmd:"" name:"http-proxy" help:"Run a local HTTP CONNECT proxy that forwards through the relay."`
 }
 
 // ArcCmd is the parent command for Azure Arc subcommands.
 type ArcCmd struct {
 	ResourceID string `name:"resource-id" help:"ARM resource ID of the Arc-connected machine."`
-	Port       int    `help:"Remote port the service listens on." default:"22"`
+	Port       int    `help:"Remote port the service listens on (default 22 for SSH, 6516 for WAC)."`
 	Service    string `help:"Service name (SSH or WAC)." default:"SSH"`
 
-	Connect     ArcConnectCmd     `cmd:"" help:"One-shot stdin/stdout connection through an Arc relay."`
-	PortForward ArcPortForwardCmd `cmd:"" name:"port-forward" help:"Forward a local port through an Arc relay."`
+	UserAgent     string `name:"arm-user-agent" help:"Suffix appended to the User-Agent of ARM requests."`
+	CorrelationID string `name:"arm-correlation-id" help:"Correlation ID sent on ARM requests (x-ms-correlation-request-id)."`
+	Proxy         string `name:"proxy" help:"HTTP(S) or SOCKS5 proxy URL for the relay connection, instead of HTTPS_PROXY."`
+	Compress      bool   `help:"Offer permessage-deflate compression on the relay WebSocket (arc connect and port-forward)."`
+
+	Connect      ArcConnectCmd      `cmd:"" help:"One-shot stdin/stdout connection through an Arc relay."`
+	PortForward  ArcPortForwardCmd  `cmd:"" name:"port-forward" help:"Forward a local port through an Arc relay."`
+	ListServices ArcListServicesCmd `cmd:"" name:"list-services" help:"List the service configurations on an Arc machine."`
+	List         ArcListCmd         `cmd:"" help:"List the Arc-connected machines in a subscription."`
+}
+
+// resolveService validates --service and fills in its default --port
+// when none was given.
+func (a *ArcCmd) resolveService() error {
+	service, port, err := arc.ResolveService(a.Service, a.Port)
+	if err != nil {
+		return fmt.Errorf("--service: %w", err)
+	}
+	a.Service, a.Port = service, port
+	return nil
+}
+
+// dialContext returns ctx with a fresh relay.WireCounter when --compress
+// is set, so the arc relay dial records whether permessage-deflate was
+// negotiated and the bridge metrics can report what it saved.
+func (a *ArcCmd) dialContext(ctx context.Context) context.Context {
+	if !a.Compress {
+		return ctx
+	}
+	return relay.WithWireCounter(ctx, new(relay.WireCounter))
+}
+
+// clientOptions returns the arc.ClientOptions for the ARM request
+// tagging flags, or nil when none are set.
+func (a *ArcCmd) clientOptions() *arc.ClientOptions {
+	if a.UserAgent == "" && a.CorrelationID == "" {
+		return nil
+	}
+	return &arc.ClientOptions{
+		UserAgentSuffix: a.UserAgent,
+		CorrelationID:   a.CorrelationID,
+	}
 }
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/philsphicas/aztunnel/internal/arc"
+	"github.com/philsphicas/aztunnel/internal/relay"
+	"github.com/posener/complete"
+	"github.com/willabides/kongplete"
+)
+
+// completionTimeout bounds the ARM lookups behind one completion, so a
+// shell waiting on <TAB> stays responsive when Azure is slow or
+// unreachable.
+const completionTimeout = 3 * time.Second
+
+// relayLister is the part of arc.Client the completion predictors use.
+type relayLister interface {
+	ListRelayNamespaces(ctx context.Context, subscriptionID string) ([]arc.RelayNamespace, error)
+	ListHybridConnections(ctx context.Context, namespaceID string) ([]string, error)
+}
+
+// newRelayLister returns the ARM client completions query; tests
+// replace it.
+var newRelayLister = func() (relayLister, error) {
+	return arc.NewClient(slog.New(slog.NewTextHandler(io.Discard, nil)), nil)
+}
+
+// completionPredictors returns the kongplete options that complete
+// --relay with the Relay namespaces in AZURE_SUBSCRIPTION_ID and --hyco
+// with the hybrid connections of the namespace given by --relay (or
+// AZTUNNEL_RELAY_NAME). Without a subscription or Azure credentials, or
+// when ARM does not answer within completionTimeout, they suggest
+// nothing.
+func completionPredictors() []kongplete.Option {
+	return []kongplete.Option{
+		kongplete.WithPredictor("relay", complete.PredictFunc(predictRelays)),
+		kongplete.WithPredictor("hyco", complete.PredictFunc(predictHycos)),
+	}
+}
+
+func predictRelays(complete.Args) []string {
+	ctx, cancel := context.WithTimeout(context.Background(), completionTimeout)
+	defer cancel()
+	_, namespaces := completionNamespaces(ctx)
+	var names []string
+	for _, ns := range namespaces {
+		names = append(names, ns.Name)
+	}
+	return names
+}
+
+func predictHycos(args complete.Args) []string {
+	name := namespaceName(completionRelay(args.Completed))
+	if name == "" {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), completionTimeout)
+	defer cancel()
+	lister, namespaces := completionNamespaces(ctx)
+	for _, ns := range namespaces {
+		if strings.EqualFold(ns.Name, name) {
+			hycos, _ := lister.ListHybridConnections(ctx, ns.ID)
+			return hycos
+		}
+	}
+	return nil
+}
+
+// completionNamespaces lists the Relay namespaces in
+// AZURE_SUBSCRIPTION_ID, returning the client for any follow-up
+// lookup, or returns none on any failure.
+func completionNamespaces(ctx context.Context) (relayLister, []arc.RelayNamespace) {
+	subscription := os.Getenv("AZURE_SUBSCRIPTION_ID")
+	if subscription == "" {
+		return nil, nil
+	}
+	lister, err := newRelayLister()
+	if err != nil {
+		return nil, nil
+	}
+	namespaces, err := lister.ListRelayNamespaces(ctx, subscription)
+	if err != nil {
+		return nil, nil
+	}
+	return lister, namespaces
+}
+
+// completionRelay returns the --relay (or --namespace) value among the
+// completed words, falling back to AZTUNNEL_RELAY_NAME.
+func completionRelay(words []string) string {
+	for i, w := range words {
+		for _, flag := range []string{"--relay", "--namespace"} {
+			if v, ok := strings.CutPrefix(w, flag+"="); ok {
+				return v
+			}
+			if w == flag && i+1 < len(words) {
+				return words[i+1]
+			}
+		}
+	}
+	return os.Getenv("AZTUNNEL_RELAY_NAME")
+}
+
+// namespaceName reduces a --relay value (name, FQDN, or URI) to the
+// namespace name ARM knows it by: the first label of its host.
+func namespaceName(v string) string {
+	host := relay.ParseRelay(v, relay.DefaultRelaySuffix)
+	name, _, _ := strings.Cut(host, ".")
+	name, _, _ = strings.Cut(name, ":")
+	return name
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/philsphicas/aztunnel/internal/arc"
+	"github.com/posener/complete"
+)
+
+// fakeRelayLister serves a fixed set of namespaces and hybrid
+// connections, or blocks until ctx is done when hang is set.
+type fakeRelayLister struct {
+	namespaces []arc.RelayNamespace
+	hycos      map[string][]string
+	hang       bool
+}
+
+func (f *fakeRelayLister) ListRelayNamespaces(ctx context.Context, _ string) ([]arc.RelayNamespace, error) {
+	if f.hang {
+		<-ctx.Done()
+		return nil, ctx.Err()
+	}
+	return f.namespaces, nil
+}
+
+func (f *fakeRelayLister) ListHybridConnections(_ context.Context, namespaceID string) ([]string, error) {
+	return f.hycos[namespaceID], nil
+}
+
+func useRelayLister(t *testing.T, l relayLister, err error) {
+	t.Helper()
+	prev := newRelayLister
+	newRelayLister = func() (relayLister, error) { return l, err }
+	t.Cleanup(func() { newRelayLister = prev })
+}
+
+func TestCompletionPredictors(t *testing.T) {
+	const nsID = "/subscriptions/sub1/resourceGroups/rg1/providers/Microsoft.Relay/namespaces/ProdRelay"
+	useRelayLister(t, &fakeRelayLister{
+		namespaces: []arc.RelayNamespace{{Name: "ProdRelay", ID: nsID}, {Name: "dev-relay", ID: "/subscriptions/sub1/x"}},
+		hycos:      map[string][]string{nsID: {"ssh", "rdp"}},
+	}, nil)
+	t.Setenv("AZURE_SUBSCRIPTION_ID", "sub1")
+	t.Setenv("AZTUNNEL_RELAY_NAME", "")
+
+	if got, want := predictRelays(complete.Args{}), []string{"ProdRelay", "dev-relay"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("relays = %v, want %v", got, want)
+	}
+	for _, words := range [][]string{
+		{"port-forward", "--relay", "prodrelay"},
+		{"port-forward", "--relay=prodrelay.servicebus.windows.net"},
+		{"port-forward", "--relay", "sb://ProdRelay.servicebus.windows.net/"},
+	} {
+		got := predictHycos(complete.Args{Completed: append(words, "--hyco")})
+		if want := []string{"ssh", "rdp"}; !reflect.DeepEqual(got, want) {
+			t.Errorf("hycos after %v = %v, want %v", words, got, want)
+		}
+	}
+	if got := predictHycos(complete.Args{Completed: []string{"--relay", "other", "--hyco"}}); got != nil {
+		t.Errorf("hycos for an unknown namespace = %v, want none", got)
+	}
+	t.Setenv("AZTUNNEL_RELAY_NAME", "ProdRelay")
+	if got := predictHycos(complete.Args{Completed: []string{"--hyco"}}); len(got) != 2 {
+		t.Errorf("hycos from AZTUNNEL_RELAY_NAME = %v, want 2", got)
+	}
+}
+
+func TestCompletionPredictors_Offline(t *testing.T) {
+	t.Setenv("AZTUNNEL_RELAY_NAME", "")
+
+	// No subscription: ARM is never asked.
+	t.Setenv("AZURE_SUBSCRIPTION_ID", "")
+	useRelayLister(t, nil, errors.New("must not be called"))
+	if got := predictRelays(complete.Args{}); got != nil {
+		t.Errorf("relays without a subscription = %v, want none", got)
+	}
+
+	// No credentials.
+	t.Setenv("AZURE_SUBSCRIPTION_ID", "sub1")
+	if got := predictRelays(complete.Args{}); got != nil {
+		t.Errorf("relays without credentials = %v, want none", got)
+	}
+
+	// ARM never answers: the lookup gives up after completionTimeout.
+	useRelayLister(t, &fakeRelayLister{hang: true}, nil)
+	start := time.Now()
+	if got := predictRelays(complete.Args{}); got != nil {
+		t.Errorf("relays from a hung ARM = %v, want none", got)
+	}
+	if elapsed := time.Since(start); elapsed > completionTimeout+time.Second {
+		t.Errorf("completion took %s, want at most about %s", elapsed, completionTimeout)
+	}
+}
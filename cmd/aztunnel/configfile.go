@@ -0,0 +1,113 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"strings"
+
+	"github.com/alecthomas/kong"
+	"go.yaml.in/yaml/v2"
+)
+
+// configEnv maps flags that fall back to an environment variable to
+// that variable. A config file value for one of these flags is
+// ignored while the variable is set, so precedence stays flag > env >
+// config file > default even though the env fallback itself happens
+// after parsing.
+var configEnv = map[string]string{
+	"relay":              "AZTUNNEL_RELAY_NAME",
+	"hyco":               "AZTUNNEL_HYCO_NAME",
+	"relay-suffix":       "AZTUNNEL_RELAY_SUFFIX",
+	"relay-insecure-tls": "AZTUNNEL_RELAY_INSECURE_TLS",
+	"client-id":          "AZTUNNEL_CLIENT_ID",
+	"key-file":           "AZTUNNEL_KEY_FILE",
+	"metrics-addr":       "AZTUNNEL_METRICS_ADDR",
+	"metrics-token":      "AZTUNNEL_METRICS_TOKEN",
+	"health-addr":        "AZTUNNEL_HEALTH_ADDR",
+	"resource-id":        "AZTUNNEL_ARC_RESOURCE_ID",
+	"subscription":       "AZURE_SUBSCRIPTION_ID",
+}
+
+// configResolver supplies flag values from a --config file. Keys are
+// flag names without the leading dashes; underscores may stand in for
+// hyphens.
+type configResolver map[string]any
+
+// loadConfigFile is the kong.ConfigurationLoader behind --config. The
+// file is YAML: a single mapping from flag names to values, with
+// sequences for repeatable flags and a nested mapping for key=value
+// flags such as metrics-label.
+func loadConfigFile(r io.Reader) (kong.Resolver, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	raw := map[string]any{}
+	if err := yaml.Unmarshal(data, &raw); err != nil {
+		return nil, fmt.Errorf("parse config file: %w", err)
+	}
+	values := make(configResolver, len(raw))
+	for k, v := range raw {
+		values[strings.ReplaceAll(k, "_", "-")] = normalizeYAML(v)
+	}
+	return values, nil
+}
+
+// normalizeYAML converts the map[any]any values yaml.v2 produces for
+// nested mappings into the map[string]any kong decodes map flags from.
+func normalizeYAML(v any) any {
+	switch v := v.(type) {
+	case map[any]any:
+		m := make(map[string]any, len(v))
+		for k, e := range v {
+			m[fmt.Sprint(k)] = normalizeYAML(e)
+		}
+		return m
+	case []any:
+		for i, e := range v {
+			v[i] = normalizeYAML(e)
+		}
+	}
+	return v
+}
+
+// Validate rejects keys that name no flag of any command, so a typo
+// in the file fails loudly instead of being ignored.
+func (c configResolver) Validate(app *kong.Application) error {
+	known := map[string]bool{}
+	var walk func(n *kong.Node)
+	walk = func(n *kong.Node) {
+		for _, f := range n.Flags {
+			known[f.Name] = true
+		}
+		for _, child := range n.Children {
+			walk(child)
+		}
+	}
+	walk(app.Node)
+	var unknown []string
+	for k := range c {
+		if !known[k] {
+			unknown = append(unknown, k)
+		}
+	}
+	if len(unknown) == 0 {
+		return nil
+	}
+	slices.Sort(unknown)
+	return fmt.Errorf("config file: unknown flag(s) %s", strings.Join(unknown, ", "))
+}
+
+// Resolve returns the file's value for flag, or nil to leave the flag
+// to its default. The config flag itself is never taken from a file.
+func (c configResolver) Resolve(_ *kong.Context, _ *kong.Path, flag *kong.Flag) (any, error) {
+	if flag.Name == "config" {
+		return nil, nil
+	}
+	if env, ok := configEnv[flag.Name]; ok && os.Getenv(env) != "" {
+		return nil, nil
+	}
+	return c[flag.Name], nil
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alecthomas/kong"
+)
+
+// configCLI is a cut-down CLI for exercising --config without running
+// a command.
+type configCLI struct {
+	Globals
+	RelayListener RelayListenerCmd `cmd:"" name:"relay-listener"`
+}
+
+// parseWithConfig writes data to a config file and parses args with
+// --config pointing at it.
+func parseWithConfig(t *testing.T, data string, args ...string) (*configCLI, error) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "aztunnel.yaml")
+	if err := os.WriteFile(path, []byte(data), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	var cli configCLI
+	parser, err := kong.New(&cli, kong.Configuration(loadConfigFile))
+	if err != nil {
+		t.Fatalf("kong.New: %v", err)
+	}
+	_, err = parser.Parse(append([]string{"--config", path}, args...))
+	return &cli, err
+}
+
+const testConfigFile = `
+relay: file-ns
+hyco: file-hyco
+metrics-addr: ":9090"
+metrics_label:
+  region: westus
+relay-insecure-tls: true
+allow:
+  - 10.0.0.0/8:22
+  - db.internal:5432
+max-connections: 5
+connect-timeout: 10s
+`
+
+func TestConfigFile_FillsUnsetFlags(t *testing.T) {
+	for _, env := range configEnv {
+		t.Setenv(env, "")
+	}
+	cli, err := parseWithConfig(t, testConfigFile, "relay-listener")
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+	l := cli.RelayListener
+	if l.Relay != "file-ns" || !slices.Equal(l.Hyco, []string{"file-hyco"}) || !l.RelayInsecureTLS {
+		t.Errorf("relay/hyco/insecure = %q/%q/%v, want file values", l.Relay, l.Hyco, l.RelayInsecureTLS)
+	}
+	if want := []string{"10.0.0.0/8:22", "db.internal:5432"}; !slices.Equal(l.Allow, want) {
+		t.Errorf("allow = %q, want %q", l.Allow, want)
+	}
+	if l.MaxConnections != 5 || l.ConnectTimeout != 10*time.Second {
+		t.Errorf("max-connections/connect-timeout = %d/%v, want 5/10s", l.MaxConnections, l.ConnectTimeout)
+	}
+	if l.TCPKeepAlive != 30*time.Second {
+		t.Errorf("tcp-keepalive = %v, want the 30s default", l.TCPKeepAlive)
+	}
+	if cli.MetricsAddr != ":9090" || cli.MetricsLabel["region"] != "westus" {
+		t.Errorf("metrics-addr/label = %q/%v, want :9090 and region=westus", cli.MetricsAddr, cli.MetricsLabel)
+	}
+}
+
+func TestConfigFile_Precedence(t *testing.T) {
+	for _, env := range configEnv {
+		t.Setenv(env, "")
+	}
+	t.Setenv("AZTUNNEL_RELAY_NAME", "env-ns")
+	cli, err := parseWithConfig(t, testConfigFile, "relay-listener", "--max-connections", "7")
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+	l := cli.RelayListener
+	if l.MaxConnections != 7 {
+		t.Errorf("max-connections = %d, want the command-line 7", l.MaxConnections)
+	}
+	// The file must not fill --relay while AZTUNNEL_RELAY_NAME is set,
+	// so resolveAuth falls back to the env value.
+	if l.Relay != "" {
+		t.Errorf("relay = %q, want empty so AZTUNNEL_RELAY_NAME applies", l.Relay)
+	}
+	if !slices.Equal(l.Hyco, []string{"file-hyco"}) {
+		t.Errorf("hyco = %q, want the file value with no env set", l.Hyco)
+	}
+}
+
+func TestConfigFile_Errors(t *testing.T) {
+	_, err := parseWithConfig(t, "max-conections: 5\n", "relay-listener")
+	if err == nil || !strings.Contains(err.Error(), "max-conections") {
+		t.Errorf("unknown key: err = %v, want one naming max-conections", err)
+	}
+	if _, err := parseWithConfig(t, "allow: [unclosed\n", "relay-listener"); err == nil {
+		t.Error("malformed YAML parsed without error")
+	}
+	if _, err := parseWithConfig(t, "max-connections: lots\n", "relay-listener"); err == nil {
+		t.Error("non-numeric max-connections parsed without error")
+	}
+}
@@ -2,8 +2,11 @@ package main
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"os"
 	"os/signal"
+	"time"
 
 	"github.com/philsphicas/aztunnel/internal/sender"
 )
@@ -11,11 +14,25 @@ import (
 // ConnectCmd connects stdin/stdout through the relay.
 type ConnectCmd struct {
 	AuthFlags
-	Target string `arg:"" required:"" help:"Target host:port."`
+	BridgeFlags
+	Target          string        `arg:"" optional:"" help:"Target host:port, or route:<name> for a route the listener maps. Omit with --dynamic."`
+	EnvelopeTimeout time.Duration `name:"envelope-timeout" help:"Give up on a rendezvous the listener has not answered within this long." default:"45s"`
+	Dynamic         bool          `help:"Read the target host:port from the first line of stdin."`
+	Allow           []string      `help:"Allowed --dynamic targets (host:port, *.domain:port, CIDR:port, CIDR:*)."`
+	Compress        bool          `help:"Offer permessage-deflate compression on the relay WebSocket and ask the listener to do the same."`
 }
 
 // Run executes the connect command.
 func (c *ConnectCmd) Run(globals *Globals) error {
+	switch {
+	case c.Dynamic && c.Target != "":
+		return fmt.Errorf("target %q cannot be combined with --dynamic", c.Target)
+	case !c.Dynamic && c.Target == "":
+		return errors.New(`expected "<target>" argument or --dynamic`)
+	case !c.Dynamic && len(c.Allow) > 0:
+		return errors.New("--allow requires --dynamic")
+	}
+
 	hyco, err := resolveHyco(c.Hyco)
 	if err != nil {
 		return err
@@ -25,27 +42,61 @@ func (c *ConnectCmd) Run(globals *Globals) error {
 	if err != nil {
 		return err
 	}
+	opts.Compression = c.Compress
+	bufferSize, err := c.bufferSize()
+	if err != nil {
+		return err
+	}
+	dataPingInterval, err := c.dataPingInterval()
+	if err != nil {
+		return err
+	}
 
-	logger := newLogger(globals.LogLevel)
+	logger := newLogger(globals.LogLevel, globals.LogFormat)
 	warnInsecureTLS(opts, logger)
+	warnKeyFile(c.AuthFlags, logger)
+	if err := checkCloud(c.AuthFlags, endpoint, providerName, logger); err != nil {
+		return err
+	}
+	printConfig(globals, logger, "relay-sender connect", senderSnapshot{
+		relaySnapshot:    newRelaySnapshot(globals, endpoint, hyco, opts, tp, providerName),
+		Target:           c.Target,
+		EnvelopeTimeout:  c.EnvelopeTimeout,
+		BufferSize:       bufferSize,
+		IdleTimeout:      c.IdleTimeout,
+		RateLimit:        c.RateLimit,
+		DataPingInterval: c.DataPingInterval,
+		Compress:         c.Compress,
+	})
 
 	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
 	defer stop()
+	defer notifySASReload(ctx, tp, keyFilePath(c.AuthFlags), logger)()
 
 	cfg := sender.ConnectConfig{
-		Endpoint:      endpoint,
-		EntityPath:    hyco,
-		TokenProvider: tp,
-		ClientOptions: opts,
-		Target:        c.Target,
-		Stdin:         os.Stdin,
-		Stdout:        os.Stdout,
-		Logger:        logger,
-	}
-	if cfg.Metrics, err = resolveMetrics(ctx, globals.MetricsAddr, globals.MetricsMaxTargets, logger); err != nil {
+		Endpoint:         endpoint,
+		EntityPath:       hyco,
+		TokenProvider:    tp,
+		ClientOptions:    opts,
+		Target:           c.Target,
+		Stdin:            os.Stdin,
+		Stdout:           os.Stdout,
+		Logger:           logger,
+		EnvelopeTimeout:  c.EnvelopeTimeout,
+		Dynamic:          c.Dynamic,
+		AllowList:        c.Allow,
+		BufferSize:       bufferSize,
+		IdleTimeout:      c.IdleTimeout,
+		RateLimit:        c.RateLimit,
+		DataPingInterval: dataPingInterval,
+	}
+	if cfg.Metrics, err = resolveMetrics(ctx, globals, logger); err != nil {
 		return err
 	}
 	cfg.TokenProvider = observeTokenFetch(tp, cfg.Metrics, providerName)
+	if cfg.Tracer, err = resolveTracer(globals, logger); err != nil {
+		return err
+	}
 
 	return sender.Connect(ctx, cfg)
 }
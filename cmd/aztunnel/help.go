@@ -31,14 +31,38 @@ Usage:
   aztunnel relay-listener [flags]
   aztunnel relay-sender port-forward <host:port> [flags]
   aztunnel relay-sender socks5-proxy [flags]
+  aztunnel relay-sender http-proxy [flags]
   aztunnel relay-sender connect <host:port> [flags]
+  aztunnel relay-sender connect --dynamic [flags]
   aztunnel arc connect [flags]
   aztunnel arc port-forward [flags]
+  aztunnel arc list-services [flags]
+  aztunnel arc list [flags]
+  aztunnel completion
 
 Global Options:
+      --config path                 Read flag values from this YAML file; flags and env vars win
       --log-level string            Log level: debug, info, warn, error (default "info")
+      --log-format string           Log format: text, json (default "text")
       --metrics-addr string         Prometheus metrics server address (e.g. :9090); disabled if empty
       --metrics-max-targets int     Max unique target labels in metrics; 0 = unlimited (default 500)
+      --metrics-detailed-labels     Add local_addr and relay_host labels to active connections (capped)
+      --metrics-admin               Serve /connections (list, close), /quiesce, /resume on the metrics server (needs --metrics-token)
+      --metrics-label key=value     Constant label added to every metric (repeatable)
+      --metrics-no-runtime          Omit the go_* and process_* runtime metrics
+      --metrics-token string        Bearer token required on the metrics server (not the probes)
+      --metrics-tls-cert path       PEM certificate to serve metrics over HTTPS (with --metrics-tls-key)
+      --metrics-tls-key path        PEM private key for --metrics-tls-cert
+      --pprof                       Serve /debug/pprof/ on the metrics server (keep it on localhost)
+      --slo-threshold duration      Apdex target for dial latency (aztunnel_dial_slo_total); 0 = disabled
+      --metrics-push url            Prometheus Pushgateway to push metrics to on exit; disabled if empty
+      --metrics-push-job string     Job name for --metrics-push (default "aztunnel")
+      --metrics-push-interval duration Also push periodically while running; 0 = only on exit
+      --access-log path             Log one line per finished connection here (- for stderr)
+      --health-addr string          Standalone /healthz and /readyz server address (e.g. :8081); disabled if empty
+      --otel-endpoint url           OTLP/HTTP collector to export connection traces to; disabled if empty
+      --print-config                Log the effective configuration at startup (secrets redacted)
+      --redact-pattern regex        Extra secret pattern to scrub from logs (repeatable)
       --help, -h                    Show this help message
       --version                     Print version and exit
 
@@ -48,12 +72,57 @@ Relay Listener:
   connect envelopes. Optionally restrict allowed targets with --allow.
 
       --relay string                Azure Relay namespace name, FQDN, or URI
-      --hyco string                 Hybrid connection name
+      --hyco strings                Hybrid connection name (repeatable to serve several)
       --relay-suffix string         Namespace suffix for sovereign clouds
-      --allow strings               Allowed targets (host:port, CIDR:port, CIDR:*)
+      --strict-cloud                Fail if --relay-suffix and AZURE_AUTHORITY_HOST disagree on cloud
+      --dns-server host[:port]      DNS server for relay and target lookups (repeatable)
+      --dns-doh url                 DNS-over-HTTPS URL for relay and target lookups
+      --relay-ip ip                 Connect to this IP for the relay host (keeps SNI/Host)
+      --ca-file path                Also trust these PEM CA certificates for relay TLS
+      --proxy url                   Proxy for relay connections (default: HTTPS_PROXY)
+      --key-file path               Read SAS credentials from this file (env: AZTUNNEL_KEY_FILE)
+      --sas-expiry duration         Lifetime of each signed SAS token (default 1h)
+      --client-id string            Managed identity client ID for Entra auth (env: AZTUNNEL_CLIENT_ID)
+      --allow strings               Allowed targets (host:port, *.domain:port, CIDR:port, CIDR:*)
+      --allow-file path             More allowed targets, one per line; re-read on SIGHUP
+      --deny strings                Denied targets, same syntax as --allow; override it
+      --deny-file path              More denied targets, one per line; re-read on SIGHUP
+      --map alias=host:port         Expose a target under an alias (repeatable)
+      --map-file path               More alias=host:port mappings; re-read on SIGHUP
+      --allow-resolve               Allow hostnames whose resolved IPs match; dial those IPs
       --max-connections int         Max concurrent connections; 0 = unlimited (default 0)
+      --accept-overflow string      At --max-connections: drop or queue accepts (default drop)
+      --accept-queue-timeout duration  Wait for a free slot with --accept-overflow=queue (default 5s)
+      --accept-workers int          Rendezvous dial workers; 0 = one per accept (default 0)
+      --listen-backlog int          Accepts queued for a free worker (default accept-workers)
+      --max-metadata-entries int    Max connect-envelope metadata entries (default 32)
+      --max-metadata-size int       Max connect-envelope metadata bytes (default 8192)
       --connect-timeout duration    Timeout for dialing targets (default 30s)
       --tcp-keepalive duration      TCP keepalive interval (default 30s)
+      --pipeline-idle-timeout duration  Close a pipelined rendezvous idle this long (default 60s)
+      --echo                        Diagnostic: echo data back instead of dialing targets
+      --allow-bind                  Accept bind requests (listen and relay one inbound connection)
+      --allow-udp                   Accept UDP sessions and relay datagrams to allowed destinations
+      --allow-mux                   Accept mux sessions; each stream counts against --max-connections
+      --probe-target                Reject targets that close or reset right after accepting
+      --proxy-protocol              Send a PROXY v2 header with the client address to targets
+      --target-dial-retries int     Retry refused or unreachable target dials (default 0)
+      --target-dial-backoff duration First target dial retry wait; doubles (default 200ms)
+      --dial-source string          Dial targets from this local IP or interface
+      --dial-family string          Target dial family: auto, ipv4, ipv6 (default auto)
+      --upstream-socks string       Dial targets through this SOCKS5 proxy (host:port)
+      --chain-relay string          Forward connections to this relay namespace instead of dialing
+      --chain-hyco string           Hybrid connection on --chain-relay
+      --control-idle-reconnect duration Reconnect a control channel quiet this long; 0 = never (default 0)
+      --max-message-size int        Largest WebSocket message read from the relay (default 1048576)
+      --ping-interval duration      Control-channel ping interval (default 30s)
+      --token-renew-interval duration  Renew the relay token this often (default 45m)
+      --min-throughput int          End bridges whose target sends under this many bytes/sec; 0 = off (default 0)
+      --min-throughput-window duration Sliding window for --min-throughput (default 30s)
+      --buffer-size bytes           Copy buffer size per bridge direction (default 32768)
+      --idle-timeout duration       Close a connection idle this long (default 0, never)
+      --rate-limit bytes/sec        Cap each direction per connection (default 0, unlimited)
+      --data-ping-interval duration Ping a connection's WebSocket idle this long (default 30s, 0 never)
 
 Relay Sender - Port Forward:
   Start a local TCP listener and forward each connection through the
@@ -62,18 +131,57 @@ Relay Sender - Port Forward:
       --relay string                Azure Relay namespace name, FQDN, or URI
       --hyco string                 Hybrid connection name
       --relay-suffix string         Namespace suffix for sovereign clouds
-  -b, --bind string                 Local bind address:port (default "127.0.0.1:0")
+      --strict-cloud                Fail if --relay-suffix and AZURE_AUTHORITY_HOST disagree on cloud
+      --dns-server host[:port]      DNS server for relay and target lookups (repeatable)
+      --dns-doh url                 DNS-over-HTTPS URL for relay and target lookups
+      --relay-ip ip                 Connect to this IP for the relay host (keeps SNI/Host)
+      --ca-file path                Also trust these PEM CA certificates for relay TLS
+      --proxy url                   Proxy for relay connections (default: HTTPS_PROXY)
+      --key-file path               Read SAS credentials from this file (env: AZTUNNEL_KEY_FILE)
+      --sas-expiry duration         Lifetime of each signed SAS token (default 1h)
+      --client-id string            Managed identity client ID for Entra auth (env: AZTUNNEL_CLIENT_ID)
+  -b, --bind string                 Local bind address:port or unix:/path (default "127.0.0.1:0")
       --gateway                     Bind to 0.0.0.0 instead of 127.0.0.1
+      --bind-interface string       Bind to this interface's address (port from --bind)
+      --bind-family string          Family preferred with --bind-interface: ip4 or ip6 (default "ip4")
+      --local-family string         Local listener network: tcp, tcp4, or tcp6 (default "tcp")
       --tcp-keepalive duration      TCP keepalive interval (default 30s)
+      --pipelining                  Reuse one idle rendezvous for back-to-back connections
+      --half-close                  Keep receiving after the local client shuts down its write side
+      --mux                         Carry every connection over one shared rendezvous
+      --envelope-timeout duration   Give up if the listener has not answered within this long (default 45s)
+      --compress                    Offer permessage-deflate on the relay WebSocket
+      --buffer-size bytes           Copy buffer size per bridge direction (default 32768)
+      --idle-timeout duration       Close a connection idle this long (default 0, never)
+      --rate-limit bytes/sec        Cap each direction per connection (default 0, unlimited)
+      --data-ping-interval duration Ping a connection's WebSocket idle this long (default 30s, 0 never)
 
 Relay Sender - Connect:
   Connect to the relay, tell the listener to dial host:port, then bridge
   stdin/stdout with the tunnel. Exits when the connection closes.
-  Designed for use as an SSH ProxyCommand.
+  Designed for use as an SSH ProxyCommand. With --dynamic the target
+  is read from the first line of stdin instead of the command line.
 
       --relay string                Azure Relay namespace name, FQDN, or URI
       --hyco string                 Hybrid connection name
       --relay-suffix string         Namespace suffix for sovereign clouds
+      --strict-cloud                Fail if --relay-suffix and AZURE_AUTHORITY_HOST disagree on cloud
+      --dns-server host[:port]      DNS server for relay and target lookups (repeatable)
+      --dns-doh url                 DNS-over-HTTPS URL for relay and target lookups
+      --relay-ip ip                 Connect to this IP for the relay host (keeps SNI/Host)
+      --ca-file path                Also trust these PEM CA certificates for relay TLS
+      --proxy url                   Proxy for relay connections (default: HTTPS_PROXY)
+      --key-file path               Read SAS credentials from this file (env: AZTUNNEL_KEY_FILE)
+      --sas-expiry duration         Lifetime of each signed SAS token (default 1h)
+      --client-id string            Managed identity client ID for Entra auth (env: AZTUNNEL_CLIENT_ID)
+      --envelope-timeout duration   Give up if the listener has not answered within this long (default 45s)
+      --compress                    Offer permessage-deflate on the relay WebSocket
+      --buffer-size bytes           Copy buffer size per bridge direction (default 32768)
+      --idle-timeout duration       Close a connection idle this long (default 0, never)
+      --rate-limit bytes/sec        Cap each direction per connection (default 0, unlimited)
+      --data-ping-interval duration Ping a connection's WebSocket idle this long (default 30s, 0 never)
+      --dynamic                     Read the target host:port from the first line of stdin
+      --allow strings               Allowed --dynamic targets (host:port, *.domain:port, CIDR:port, CIDR:*)
 
 Relay Sender - SOCKS5 Proxy:
   Start a local SOCKS5 proxy server. The target for each connection is
@@ -82,9 +190,63 @@ Relay Sender - SOCKS5 Proxy:
       --relay string                Azure Relay namespace name, FQDN, or URI
       --hyco string                 Hybrid connection name
       --relay-suffix string         Namespace suffix for sovereign clouds
-  -b, --bind string                 Local bind address:port (default "127.0.0.1:0")
+      --strict-cloud                Fail if --relay-suffix and AZURE_AUTHORITY_HOST disagree on cloud
+      --dns-server host[:port]      DNS server for relay and target lookups (repeatable)
+      --dns-doh url                 DNS-over-HTTPS URL for relay and target lookups
+      --relay-ip ip                 Connect to this IP for the relay host (keeps SNI/Host)
+      --ca-file path                Also trust these PEM CA certificates for relay TLS
+      --proxy url                   Proxy for relay connections (default: HTTPS_PROXY)
+      --key-file path               Read SAS credentials from this file (env: AZTUNNEL_KEY_FILE)
+      --sas-expiry duration         Lifetime of each signed SAS token (default 1h)
+      --client-id string            Managed identity client ID for Entra auth (env: AZTUNNEL_CLIENT_ID)
+  -b, --bind string                 Local bind address:port or unix:/path (default "127.0.0.1:0")
       --gateway                     Bind to 0.0.0.0 instead of 127.0.0.1
+      --bind-interface string       Bind to this interface's address (port from --bind)
+      --bind-family string          Family preferred with --bind-interface: ip4 or ip6 (default "ip4")
+      --local-family string         Local listener network: tcp, tcp4, or tcp6 (default "tcp")
       --tcp-keepalive duration      TCP keepalive interval (default 30s)
+      --allow strings               Allowed targets (host:port, *.domain:port, CIDR:port, CIDR:*)
+      --envelope-timeout duration   Give up if the listener has not answered within this long (default 45s)
+      --compress                    Offer permessage-deflate on the relay WebSocket
+      --buffer-size bytes           Copy buffer size per bridge direction (default 32768)
+      --idle-timeout duration       Close a connection idle this long (default 0, never)
+      --rate-limit bytes/sec        Cap each direction per connection (default 0, unlimited)
+      --data-ping-interval duration Ping a connection's WebSocket idle this long (default 30s, 0 never)
+      --dial-timeout duration       Retry a failed relay dial for up to this long per connection (default 30s)
+      --socks-user string           Require SOCKS5 username/password auth (with --socks-pass)
+      --socks-pass string           Password for --socks-user
+      --socks-auth-file path        Require SOCKS5 auth against user:password lines in this file
+
+Relay Sender - HTTP Proxy:
+  Start a local HTTP CONNECT proxy server. The target for each connection
+  is the CONNECT request's host:port; other methods get 405.
+
+      --relay string                Azure Relay namespace name, FQDN, or URI
+      --hyco string                 Hybrid connection name
+      --relay-suffix string         Namespace suffix for sovereign clouds
+      --strict-cloud                Fail if --relay-suffix and AZURE_AUTHORITY_HOST disagree on cloud
+      --dns-server host[:port]      DNS server for relay and target lookups (repeatable)
+      --dns-doh url                 DNS-over-HTTPS URL for relay and target lookups
+      --relay-ip ip                 Connect to this IP for the relay host (keeps SNI/Host)
+      --ca-file path                Also trust these PEM CA certificates for relay TLS
+      --proxy url                   Proxy for relay connections (default: HTTPS_PROXY)
+      --key-file path               Read SAS credentials from this file (env: AZTUNNEL_KEY_FILE)
+      --sas-expiry duration         Lifetime of each signed SAS token (default 1h)
+      --client-id string            Managed identity client ID for Entra auth (env: AZTUNNEL_CLIENT_ID)
+  -b, --bind string                 Local bind address:port or unix:/path (default "127.0.0.1:0")
+      --gateway                     Bind to 0.0.0.0 instead of 127.0.0.1
+      --bind-interface string       Bind to this interface's address (port from --bind)
+      --bind-family string          Family preferred with --bind-interface: ip4 or ip6 (default "ip4")
+      --local-family string         Local listener network: tcp, tcp4, or tcp6 (default "tcp")
+      --tcp-keepalive duration      TCP keepalive interval (default 30s)
+      --allow strings               Allowed targets (host:port, *.domain:port, CIDR:port, CIDR:*)
+      --envelope-timeout duration   Give up if the listener has not answered within this long (default 45s)
+      --compress                    Offer permessage-deflate on the relay WebSocket
+      --buffer-size bytes           Copy buffer size per bridge direction (default 32768)
+      --idle-timeout duration       Close a connection idle this long (default 0, never)
+      --rate-limit bytes/sec        Cap each direction per connection (default 0, unlimited)
+      --data-ping-interval duration Ping a connection's WebSocket idle this long (default 30s, 0 never)
+      --dial-timeout duration       Retry a failed relay dial for up to this long per connection (default 30s)
 
 Arc Connect:
   Connect to an Azure Arc-enrolled machine through the automatically
@@ -93,28 +255,58 @@ Arc Connect:
   ProxyCommand.
 
       --resource-id string          ARM resource ID of the Arc-connected machine
-      --port int                    Remote port the service listens on (default 22)
+      --port int                    Remote port the service listens on (default 22 for SSH, 6516 for WAC)
       --service string              Service name: SSH or WAC (default "SSH")
+      --arm-user-agent string       Suffix appended to the ARM request User-Agent
+      --arm-correlation-id string   Correlation ID sent on ARM requests
+      --proxy url                   Proxy for the relay connection (default: HTTPS_PROXY)
+      --compress                    Offer permessage-deflate on the relay WebSocket
 
 Arc Port Forward:
   Start a local TCP listener and forward each connection through the
   Azure Arc managed relay to the remote service.
 
       --resource-id string          ARM resource ID of the Arc-connected machine
-      --port int                    Remote port the service listens on (default 22)
+      --port int                    Remote port the service listens on (default 22 for SSH, 6516 for WAC)
       --service string              Service name: SSH or WAC (default "SSH")
+      --arm-user-agent string       Suffix appended to the ARM request User-Agent
+      --arm-correlation-id string   Correlation ID sent on ARM requests
+      --proxy url                   Proxy for the relay connection (default: HTTPS_PROXY)
+      --compress                    Offer permessage-deflate on the relay WebSocket
   -b, --bind string                 Local bind address:port (default "127.0.0.1:0")
       --gateway                     Bind to 0.0.0.0 instead of 127.0.0.1
+      --bind-interface string       Bind to this interface's address (port from --bind)
+      --bind-family string          Family preferred with --bind-interface: ip4 or ip6 (default "ip4")
+      --local-family string         Local listener network: tcp, tcp4, or tcp6 (default "tcp")
       --tcp-keepalive duration      TCP keepalive interval (default 30s)
 
+Arc List Services:
+  Print the service configurations (service name and port) on the Arc
+  machine's HybridConnectivity endpoint.
+
+      --resource-id string          ARM resource ID of the Arc-connected machine
+      --arm-user-agent string       Suffix appended to the ARM request User-Agent
+      --arm-correlation-id string   Correlation ID sent on ARM requests
+
+Arc List:
+  Print the Arc-connected machines in a subscription (name, resource
+  group, status, and resource ID, tab-separated) to find --resource-id.
+
+      --subscription string         Subscription ID (default: AZURE_SUBSCRIPTION_ID)
+  -g, --resource-group string       Only list machines in this resource group
+  -o, --output string               Output format: text, json (default "text")
+      --arm-user-agent string       Suffix appended to the ARM request User-Agent
+      --arm-correlation-id string   Correlation ID sent on ARM requests
+
 Authentication:
   Relay commands authenticate to the Azure Relay namespace:
 
   1. Entra ID (default): Uses DefaultAzureCredential automatically
                          (az login, managed identity, workload identity).
   2. SAS credentials:    Override by setting both AZTUNNEL_KEY_NAME and
-                         AZTUNNEL_KEY env vars. Only needed when Entra ID
-                         is unavailable.
+                         AZTUNNEL_KEY env vars, or with --key-file. Only
+                         needed when Entra ID is unavailable. SIGHUP
+                         re-reads the key after a rotation.
 
   Arc commands authenticate via DefaultAzureCredential to the Azure
   Resource Manager API. No relay credentials are needed — Azure provides
@@ -126,8 +318,14 @@ Environment Variables:
   AZTUNNEL_HYCO_NAME         Hybrid connection name (fallback for --hyco)
   AZTUNNEL_KEY_NAME          SAS authorization rule name (optional, overrides Entra)
   AZTUNNEL_KEY               SAS key value (optional, overrides Entra)
+  AZTUNNEL_KEY_FILE          SAS credentials file (fallback for --key-file)
+  AZTUNNEL_CLIENT_ID         Managed identity client ID (fallback for --client-id)
   AZTUNNEL_ARC_RESOURCE_ID   Arc resource ID (fallback for --resource-id)
+  AZURE_SUBSCRIPTION_ID      Subscription for arc list (fallback for --subscription)
   AZTUNNEL_METRICS_ADDR      Metrics server address (fallback for --metrics-addr)
+  AZTUNNEL_METRICS_TOKEN     Metrics bearer token (fallback for --metrics-token)
+  AZTUNNEL_HEALTH_ADDR       Health server address (fallback for --health-addr)
+  AZTUNNEL_SYSTEMD_SOCKET    Set to 1 to use a systemd-passed socket for port-forward and the proxies
 
 Examples:
   # Start a relay listener allowing only SSH and HTTPS targets
@@ -156,5 +354,9 @@ Examples:
   aztunnel relay-sender socks5-proxy --relay my-ns --hyco tunnel -b 127.0.0.1:1080
   curl --proxy socks5h://127.0.0.1:1080 http://internal-service:8080
 
+  # Run an HTTP CONNECT proxy for tools that honor HTTPS_PROXY
+  aztunnel relay-sender http-proxy --relay my-ns --hyco tunnel -b 127.0.0.1:3128
+  HTTPS_PROXY=http://127.0.0.1:3128 curl https://internal-service:8443
+
 Run "aztunnel <command> --help" for full flag details.
 `
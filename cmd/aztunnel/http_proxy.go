@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"net"
+	"os"
+	"os/signal"
+	"time"
+
+	"github.com/philsphicas/aztunnel/internal/sender"
+)
+
+// HTTPProxyCmd runs a local HTTP CONNECT proxy through the relay.
+type HTTPProxyCmd struct {
+	AuthFlags
+	BindFlags
+	BridgeFlags
+	Allow           []string      `help:"Allowed targets (host:port, *.domain:port, CIDR:port, CIDR:*)."`
+	EnvelopeTimeout time.Duration `name:"envelope-timeout" help:"Give up on a rendezvous the listener has not answered within this long." default:"45s"`
+	DialTimeout     time.Duration `name:"dial-timeout" help:"Retry a failed relay dial for up to this long per connection before replying with a failure." default:"30s"`
+	Compress        bool          `help:"Offer permessage-deflate compression on the relay WebSocket and ask the listener to do the same."`
+}
+
+// Run executes the http-proxy command.
+func (h *HTTPProxyCmd) Run(globals *Globals) error {
+	hyco, err := resolveHyco(h.Hyco)
+	if err != nil {
+		return err
+	}
+
+	endpoint, opts, tp, providerName, err := resolveAuth(h.AuthFlags)
+	if err != nil {
+		return err
+	}
+	opts.Compression = h.Compress
+
+	bind, err := h.resolve()
+	if err != nil {
+		return err
+	}
+	bufferSize, err := h.bufferSize()
+	if err != nil {
+		return err
+	}
+	dataPingInterval, err := h.dataPingInterval()
+	if err != nil {
+		return err
+	}
+	logger := newLogger(globals.LogLevel, globals.LogFormat)
+	warnInsecureTLS(opts, logger)
+	warnKeyFile(h.AuthFlags, logger)
+	if err := checkCloud(h.AuthFlags, endpoint, providerName, logger); err != nil {
+		return err
+	}
+	printConfig(globals, logger, "relay-sender http-proxy", senderSnapshot{
+		relaySnapshot:    newRelaySnapshot(globals, endpoint, hyco, opts, tp, providerName),
+		Bind:             bind,
+		TCPKeepAlive:     h.TCPKeepAlive,
+		EnvelopeTimeout:  h.EnvelopeTimeout,
+		DialTimeout:      h.DialTimeout,
+		BufferSize:       bufferSize,
+		IdleTimeout:      h.IdleTimeout,
+		RateLimit:        h.RateLimit,
+		DataPingInterval: h.DataPingInterval,
+		Compress:         h.Compress,
+	})
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	defer notifySASReload(ctx, tp, keyFilePath(h.AuthFlags), logger)()
+
+	cfg := sender.HTTPProxyConfig{
+		Endpoint:         endpoint,
+		EntityPath:       hyco,
+		TokenProvider:    tp,
+		ClientOptions:    opts,
+		BindAddress:      bind,
+		Network:          h.LocalFamily,
+		TCPKeepAlive:     h.TCPKeepAlive,
+		AllowList:        h.Allow,
+		Logger:           logger,
+		EnvelopeTimeout:  h.EnvelopeTimeout,
+		DialBudget:       h.DialTimeout,
+		BufferSize:       bufferSize,
+		IdleTimeout:      h.IdleTimeout,
+		RateLimit:        h.RateLimit,
+		DataPingInterval: dataPingInterval,
+	}
+	if cfg.Metrics, err = resolveMetrics(ctx, globals, logger); err != nil {
+		return err
+	}
+	cfg.TokenProvider = observeTokenFetch(tp, cfg.Metrics, providerName)
+	if cfg.Tracer, err = resolveTracer(globals, logger); err != nil {
+		return err
+	}
+	readiness, err := resolveHealth(ctx, globals.HealthAddr, logger)
+	if err != nil {
+		return err
+	}
+	cfg.Ready = func(net.Addr) { readiness.SetReady(true) }
+
+	return sender.HTTPProxy(ctx, cfg)
+}
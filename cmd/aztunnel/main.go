@@ -3,11 +3,16 @@ package main
 import (
 	"context"
 	"crypto/tls"
+	"crypto/x509"
+	"errors"
 	"fmt"
 	"log/slog"
 	"net"
+	"net/url"
 	"os"
+	"os/signal"
 	"strings"
+	"time"
 
 	// Automatically set GOMEMLIMIT based on cgroup memory limits (container
 	// or systemd MemoryMax=). If no cgroup limit is detected, GOMEMLIMIT is
@@ -17,6 +22,7 @@ import (
 	"github.com/alecthomas/kong"
 	"github.com/philsphicas/aztunnel/internal/metrics"
 	"github.com/philsphicas/aztunnel/internal/relay"
+	"github.com/philsphicas/aztunnel/internal/tracing"
 	"github.com/willabides/kongplete"
 )
 
@@ -33,37 +39,122 @@ func main() {
 		kong.UsageOnError(),
 		kong.ConfigureHelp(kong.HelpOptions{Compact: true}),
 		kong.Help(customHelpPrinter),
+		kong.Configuration(loadConfigFile),
 	)
 
-	kongplete.Complete(parser)
+	kongplete.Complete(parser, completionPredictors()...)
 
 	ctx, err := parser.Parse(os.Args[1:])
 	parser.FatalIfErrorf(err)
+	parser.FatalIfErrorf(relay.SetRedactPatterns(CLI.RedactPatterns))
 
-	parser.FatalIfErrorf(ctx.Run(&CLI.Globals))
+	interrupts := make(chan os.Signal, 1)
+	signal.Notify(interrupts, os.Interrupt)
+
+	err = ctx.Run(&CLI.Globals)
+	CLI.Globals.flushMetricsPush()
+	CLI.Globals.flushTraces()
+	if interruptedShutdown(err, interrupts) {
+		return
+	}
+	parser.FatalIfErrorf(err)
 }
 
-// resolveMetrics creates a Metrics instance and starts the HTTP server if
-// metricsAddr or AZTUNNEL_METRICS_ADDR is set. Returns nil if metrics are
-// disabled. The provided context controls the server's lifetime — when
-// cancelled the server shuts down gracefully.
-func resolveMetrics(ctx context.Context, metricsAddr string, maxTargets int, logger *slog.Logger) (*metrics.Metrics, error) {
-	addr := metricsAddr
-	if addr == "" {
-		addr = os.Getenv("AZTUNNEL_METRICS_ADDR")
+// interruptGrace bounds how long interruptedShutdown waits for the
+// SIGINT notification. The signal package delivers to each Notify
+// channel in turn, so the command's own handler may have cancelled
+// its context a moment before interrupts receives the signal.
+const interruptGrace = 100 * time.Millisecond
+
+// interruptedShutdown reports whether err is the context.Canceled a
+// command returns after SIGINT cancelled it, which is a clean shutdown
+// and exits 0. A cancellation with no SIGINT behind it is still an
+// error.
+func interruptedShutdown(err error, interrupts <-chan os.Signal) bool {
+	if !errors.Is(err, context.Canceled) {
+		return false
 	}
-	if addr == "" {
+	select {
+	case <-interrupts:
+		return true
+	case <-time.After(interruptGrace):
+		return false
+	}
+}
+
+// resolveMetrics creates a Metrics instance if --metrics-addr (or
+// AZTUNNEL_METRICS_ADDR) or --metrics-push is set, starting the HTTP
+// server and/or the pushgateway pusher as requested. Returns nil if
+// metrics are disabled. The provided context controls the server's
+// lifetime — when cancelled the server shuts down gracefully. The
+// final push happens in flushMetricsPush once the command returns.
+func resolveMetrics(ctx context.Context, globals *Globals, logger *slog.Logger) (*metrics.Metrics, error) {
+	addr := resolveMetricsAddr(globals.MetricsAddr)
+	if addr == "" && globals.MetricsPush == "" && globals.AccessLog == "" {
 		return nil, nil
 	}
-	if maxTargets < 0 {
-		return nil, fmt.Errorf("--metrics-max-targets must be >= 0, got %d", maxTargets)
+	if globals.MetricsMaxTargets < 0 {
+		return nil, fmt.Errorf("--metrics-max-targets must be >= 0, got %d", globals.MetricsMaxTargets)
+	}
+	if (globals.MetricsTLSCert == "") != (globals.MetricsTLSKey == "") {
+		return nil, errors.New("--metrics-tls-cert and --metrics-tls-key must be set together")
+	}
+	if globals.MetricsAdmin && addr != "" && resolveMetricsToken(globals.MetricsToken) == "" {
+		// The admin endpoints end connections; never serve them to
+		// anyone who can reach the address, or to a forged browser
+		// request, which cannot carry a bearer token.
+		return nil, errors.New("--metrics-admin requires --metrics-token (or AZTUNNEL_METRICS_TOKEN)")
+	}
+	if globals.MetricsTLSCert != "" {
+		// Loaded once here only to fail at startup rather than on the
+		// first scrape's handshake.
+		if _, err := tls.LoadX509KeyPair(globals.MetricsTLSCert, globals.MetricsTLSKey); err != nil {
+			return nil, fmt.Errorf("--metrics-tls-cert/--metrics-tls-key: %w", err)
+		}
+	}
+	m, err := metrics.NewWithOptions(metrics.Options{
+		Labels:                globals.MetricsLabel,
+		DisableRuntimeMetrics: globals.MetricsNoRuntime,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("--metrics-label: %w", err)
+	}
+	m.MaxTargets = globals.MetricsMaxTargets
+	m.DetailedLabels = globals.MetricsDetailed
+	m.Admin = globals.MetricsAdmin
+	m.Pprof = globals.Pprof
+	m.Token = resolveMetricsToken(globals.MetricsToken)
+	m.TLSCertFile, m.TLSKeyFile = globals.MetricsTLSCert, globals.MetricsTLSKey
+	m.SLOThreshold = globals.SLOThreshold
+	if m.AccessLog, err = openAccessLog(globals.AccessLog, globals.LogFormat); err != nil {
+		return nil, err
+	}
+	if globals.MetricsPush != "" {
+		p, err := m.NewPusher(globals.MetricsPush, globals.MetricsPushJob)
+		if err != nil {
+			return nil, err
+		}
+		globals.pusher, globals.exitLogger = p, logger
+		if globals.MetricsPushInterval > 0 {
+			go p.Run(ctx, globals.MetricsPushInterval, logger)
+		}
+	}
+	if addr == "" {
+		if globals.Pprof {
+			logger.Warn("--pprof has no effect without --metrics-addr")
+		}
+		if globals.MetricsTLSCert != "" {
+			logger.Warn("--metrics-tls-cert has no effect without --metrics-addr")
+		}
+		return m, nil
+	}
+	if globals.Pprof && !loopbackAddr(addr) {
+		logger.Warn("pprof endpoints are reachable beyond localhost; bind --metrics-addr to 127.0.0.1", "addr", addr)
 	}
 	ln, err := net.Listen("tcp", addr)
 	if err != nil {
 		return nil, fmt.Errorf("metrics listen on %s: %w", addr, err)
 	}
-	m := metrics.New()
-	m.MaxTargets = maxTargets
 	go func() {
 		if err := m.Serve(ctx, ln, logger); err != nil {
 			logger.Error("metrics server failed", "error", err)
@@ -72,15 +163,190 @@ func resolveMetrics(ctx context.Context, metricsAddr string, maxTargets int, log
 	return m, nil
 }
 
-// resolveHyco returns the hybrid connection name from flag or env var.
-func resolveHyco(hycoFlag string) (string, error) {
-	if hycoFlag != "" {
-		return hycoFlag, nil
+// openAccessLog returns the --access-log logger: nil when path is
+// empty, stderr for "-", or else path opened for appending. The file
+// stays open for the life of the process.
+func openAccessLog(path, format string) (*slog.Logger, error) {
+	switch path {
+	case "":
+		return nil, nil
+	case "-":
+		return metrics.NewAccessLogger(os.Stderr, format), nil
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600) //nolint:gosec // operator-supplied log path
+	if err != nil {
+		return nil, fmt.Errorf("--access-log: %w", err)
+	}
+	return metrics.NewAccessLogger(f, format), nil
+}
+
+// metricsPushTimeout bounds the final push on exit so an unreachable
+// gateway cannot hold the process open.
+const metricsPushTimeout = 10 * time.Second
+
+// flushMetricsPush performs the final pushgateway push after the
+// command has returned. It is a no-op unless resolveMetrics set up a
+// pusher.
+func (g *Globals) flushMetricsPush() {
+	if g.pusher == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), metricsPushTimeout)
+	defer cancel()
+	if err := g.pusher.Push(ctx); err != nil {
+		g.exitLogger.Warn("metrics push failed", "error", err)
+	}
+}
+
+// resolveTracer creates the OTLP span exporter if --otel-endpoint is
+// set. A nil Tracer disables tracing.
+func resolveTracer(globals *Globals, logger *slog.Logger) (*tracing.Tracer, error) {
+	if globals.OTelEndpoint == "" {
+		return nil, nil
+	}
+	t, err := tracing.New(tracing.Config{
+		Endpoint:       globals.OTelEndpoint,
+		ServiceName:    "aztunnel",
+		ServiceVersion: version,
+		Logger:         logger,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("--otel-endpoint: %w", err)
+	}
+	globals.tracer, globals.exitLogger = t, logger
+	return t, nil
+}
+
+// traceFlushTimeout bounds the final span export on exit.
+const traceFlushTimeout = 10 * time.Second
+
+// flushTraces exports the spans still queued after the command has
+// returned. It is a no-op unless resolveTracer set up a tracer.
+func (g *Globals) flushTraces() {
+	if g.tracer == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), traceFlushTimeout)
+	defer cancel()
+	if err := g.tracer.Close(ctx); err != nil {
+		g.exitLogger.Warn("trace flush failed", "error", err)
+	}
+}
+
+// resolveMetricsAddr returns the metrics address from flag or the
+// AZTUNNEL_METRICS_ADDR env var; empty means metrics are disabled.
+func resolveMetricsAddr(metricsAddr string) string {
+	if metricsAddr != "" {
+		return metricsAddr
+	}
+	return os.Getenv("AZTUNNEL_METRICS_ADDR")
+}
+
+// resolveMetricsToken returns the metrics bearer token from the flag or
+// the AZTUNNEL_METRICS_TOKEN env var; empty means no auth.
+func resolveMetricsToken(metricsToken string) string {
+	if metricsToken != "" {
+		return metricsToken
+	}
+	return os.Getenv("AZTUNNEL_METRICS_TOKEN")
+}
+
+// loopbackAddr reports whether the listen address addr binds only a
+// loopback interface. An empty host (":9090") binds every interface.
+func loopbackAddr(addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// resolveHealth starts the standalone /healthz and /readyz server if
+// healthAddr or AZTUNNEL_HEALTH_ADDR is set, independent of the metrics
+// server. It returns the Readiness the command should update, or nil if
+// the health server is disabled. The provided context controls the
+// server's lifetime.
+func resolveHealth(ctx context.Context, healthAddr string, logger *slog.Logger) (*metrics.Readiness, error) {
+	addr := resolveHealthAddr(healthAddr)
+	if addr == "" {
+		return nil, nil
 	}
-	if hyco := os.Getenv("AZTUNNEL_HYCO_NAME"); hyco != "" {
-		return hyco, nil
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("health listen on %s: %w", addr, err)
 	}
-	return "", fmt.Errorf("hybrid connection name is required: use --hyco or set AZTUNNEL_HYCO_NAME")
+	r := &metrics.Readiness{}
+	go func() {
+		if err := metrics.ServeHealth(ctx, ln, r, logger); err != nil {
+			logger.Error("health server failed", "error", err)
+		}
+	}()
+	return r, nil
+}
+
+// resolveHealthAddr returns the health address from flag or the
+// AZTUNNEL_HEALTH_ADDR env var; empty means the health server is
+// disabled.
+func resolveHealthAddr(healthAddr string) string {
+	if healthAddr != "" {
+		return healthAddr
+	}
+	return os.Getenv("AZTUNNEL_HEALTH_ADDR")
+}
+
+// resolveHyco returns the single hybrid connection name a sender
+// uses, from flag or env var.
+func resolveHyco(hycoFlag []string) (string, error) {
+	hycos, err := resolveHycos(hycoFlag)
+	if err != nil {
+		return "", err
+	}
+	if len(hycos) > 1 {
+		return "", fmt.Errorf("--hyco takes one hybrid connection here, got %d", len(hycos))
+	}
+	return hycos[0], nil
+}
+
+// resolveHycos returns the hybrid connection names from the
+// repeatable --hyco flag or the comma-separated AZTUNNEL_HYCO_NAME env
+// var, rejecting empty and duplicate names.
+func resolveHycos(hycoFlag []string) ([]string, error) {
+	hycos := hycoFlag
+	if len(hycos) == 0 {
+		if env := os.Getenv("AZTUNNEL_HYCO_NAME"); env != "" {
+			hycos = strings.Split(env, ",")
+		}
+	}
+	if len(hycos) == 0 {
+		return nil, fmt.Errorf("hybrid connection name is required: use --hyco or set AZTUNNEL_HYCO_NAME")
+	}
+	seen := make(map[string]bool, len(hycos))
+	for _, h := range hycos {
+		switch {
+		case h == "":
+			return nil, errors.New("--hyco: empty hybrid connection name")
+		case seen[h]:
+			return nil, fmt.Errorf("--hyco: %q given more than once", h)
+		}
+		seen[h] = true
+	}
+	return hycos, nil
+}
+
+// relaySuffix returns the namespace suffix from --relay-suffix,
+// AZTUNNEL_RELAY_SUFFIX, or the public-cloud default.
+func relaySuffix(af AuthFlags) string {
+	if af.RelaySuffix != "" {
+		return af.RelaySuffix
+	}
+	if s := os.Getenv("AZTUNNEL_RELAY_SUFFIX"); s != "" {
+		return s
+	}
+	return relay.DefaultRelaySuffix
 }
 
 // resolveAuth determines the endpoint, transport options, and token
@@ -103,6 +369,12 @@ func resolveHyco(hycoFlag string) (string, error) {
 // --relay-insecure-tls (or AZTUNNEL_RELAY_INSECURE_TLS=1) populates
 // opts.TLSConfig with InsecureSkipVerify. Callers are expected to log
 // a warning when this is set.
+//
+// --ca-file adds its certificates to the system roots in
+// opts.TLSConfig.RootCAs. --proxy populates opts.Proxy.
+//
+// --dns-server / --dns-doh populate opts.Resolver; nil keeps the
+// system resolver. --relay-ip populates opts.RelayIP.
 func resolveAuth(af AuthFlags) (endpoint string, opts relay.ClientOptions, tp relay.TokenProvider, providerName string, err error) {
 	ns := af.Relay
 	if ns == "" {
@@ -114,15 +386,7 @@ func resolveAuth(af AuthFlags) (endpoint string, opts relay.ClientOptions, tp re
 	if ns == "" {
 		return "", relay.ClientOptions{}, nil, "", fmt.Errorf("relay namespace is required: use --relay or set AZTUNNEL_RELAY_NAME")
 	}
-	suffix := af.RelaySuffix
-	if suffix == "" {
-		suffix = os.Getenv("AZTUNNEL_RELAY_SUFFIX")
-	}
-	if suffix == "" {
-		suffix = relay.DefaultRelaySuffix
-	}
-
-	endpoint = relay.ParseRelay(ns, suffix)
+	endpoint = relay.ParseRelay(ns, relaySuffix(af))
 	if endpoint == "" {
 		return "", relay.ClientOptions{}, nil, "", fmt.Errorf("invalid relay endpoint: %q", ns)
 	}
@@ -130,20 +394,102 @@ func resolveAuth(af AuthFlags) (endpoint string, opts relay.ClientOptions, tp re
 	if af.RelayInsecureTLS || os.Getenv("AZTUNNEL_RELAY_INSECURE_TLS") == "1" {
 		opts.TLSConfig = &tls.Config{InsecureSkipVerify: true} //nolint:gosec // opt-in by user for mock/self-hosted
 	}
+	if af.CAFile != "" {
+		roots, err := relayRootCAs(af.CAFile)
+		if err != nil {
+			return "", relay.ClientOptions{}, nil, "", err
+		}
+		if opts.TLSConfig == nil {
+			opts.TLSConfig = &tls.Config{} //nolint:gosec // relay dials raise MinVersion to TLS 1.3
+		}
+		opts.TLSConfig.RootCAs = roots
+	}
 
-	keyName := os.Getenv("AZTUNNEL_KEY_NAME")
-	key := os.Getenv("AZTUNNEL_KEY")
+	opts.Resolver, err = relay.NewResolver(relay.ResolverOptions{Servers: af.DNSServer, DoH: af.DNSDoH})
+	if err != nil {
+		return "", relay.ClientOptions{}, nil, "", err
+	}
+	if af.RelayIP != "" {
+		if opts.RelayIP = net.ParseIP(af.RelayIP); opts.RelayIP == nil {
+			return "", relay.ClientOptions{}, nil, "", fmt.Errorf("invalid --relay-ip %q: must be an IP address", af.RelayIP)
+		}
+	}
+	if opts.Proxy, err = parseProxy(af.Proxy); err != nil {
+		return "", relay.ClientOptions{}, nil, "", err
+	}
+
+	keyFile := keyFilePath(af)
+	keyName, key, err := sasCredentials(keyFile)
+	if err != nil {
+		return "", relay.ClientOptions{}, nil, "", err
+	}
+	if keyFile != "" && keyName == "" {
+		return "", relay.ClientOptions{}, nil, "", errors.New("key file has no keyName and AZTUNNEL_KEY_NAME is not set")
+	}
 	if keyName != "" && key != "" {
-		return endpoint, opts, &relay.SASTokenProvider{KeyName: keyName, Key: key}, relay.ProviderSAS, nil
+		if err := relay.ValidateSASKey(key); err != nil {
+			return "", relay.ClientOptions{}, nil, "", err
+		}
+		if af.SASExpiry < 0 {
+			return "", relay.ClientOptions{}, nil, "", errors.New("--sas-expiry must not be negative")
+		}
+		return endpoint, opts, &relay.SASTokenProvider{KeyName: keyName, Key: key, Expiry: af.SASExpiry}, relay.ProviderSAS, nil
 	}
 
-	entra, err := relay.NewEntraTokenProvider()
+	entra, err := relay.NewEntraTokenProviderWithOptions(relay.EntraOptions{ManagedIdentityClientID: entraClientID(af)})
 	if err != nil {
-		return "", relay.ClientOptions{}, nil, "", fmt.Errorf("no SAS credentials found (AZTUNNEL_KEY_NAME/AZTUNNEL_KEY) and Entra auth failed: %w", err)
+		return "", relay.ClientOptions{}, nil, "", fmt.Errorf("no SAS credentials found (AZTUNNEL_KEY_NAME with AZTUNNEL_KEY, or --key-file) and Entra auth failed: %w", err)
 	}
 	return endpoint, opts, entra, relay.ProviderEntra, nil
 }
 
+// parseProxy parses --proxy. Empty means no override: relay dials then
+// follow HTTPS_PROXY and NO_PROXY.
+func parseProxy(raw string) (*url.URL, error) {
+	if raw == "" {
+		return nil, nil
+	}
+	u, err := url.Parse(raw)
+	if err != nil {
+		return nil, fmt.Errorf("invalid --proxy: %w", err)
+	}
+	switch u.Scheme {
+	case "http", "https", "socks5", "socks5h":
+	default:
+		return nil, fmt.Errorf("invalid --proxy %q: scheme must be http, https, socks5, or socks5h", u.Redacted())
+	}
+	if u.Host == "" {
+		return nil, fmt.Errorf("invalid --proxy %q: no host", u.Redacted())
+	}
+	return u, nil
+}
+
+// relayRootCAs returns the system root pool with the PEM certificates
+// in path added, so a corporate TLS-inspecting proxy's CA is trusted
+// without dropping the public roots Azure Relay itself chains to.
+func relayRootCAs(path string) (*x509.CertPool, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("--ca-file: %w", err)
+	}
+	roots, err := x509.SystemCertPool()
+	if err != nil {
+		roots = x509.NewCertPool()
+	}
+	if !roots.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("--ca-file %s: no PEM certificates found", path)
+	}
+	return roots, nil
+}
+
+// entraClientID returns --client-id, falling back to AZTUNNEL_CLIENT_ID.
+func entraClientID(af AuthFlags) string {
+	if af.ClientID != "" {
+		return af.ClientID
+	}
+	return os.Getenv("AZTUNNEL_CLIENT_ID")
+}
+
 // observeTokenFetch wraps tp with relay.WithMetrics when m is a live
 // (non-nil) *metrics.Metrics. m can be nil (when --metrics-addr is not
 // set), in which case tp is returned unchanged. The explicit nil check
@@ -167,6 +513,25 @@ func warnInsecureTLS(opts relay.ClientOptions, logger *slog.Logger) {
 	}
 }
 
+// checkCloud warns when the relay endpoint's cloud (from its suffix)
+// differs from the cloud of the Entra authority in AZURE_AUTHORITY_HOST
+// (public when unset), or fails with --strict-cloud. SAS auth is not
+// tied to an authority, so only Entra is checked.
+func checkCloud(af AuthFlags, endpoint, providerName string, logger *slog.Logger) error {
+	if providerName != relay.ProviderEntra {
+		return nil
+	}
+	err := relay.CheckCloud(endpoint, os.Getenv("AZURE_AUTHORITY_HOST"))
+	if err == nil {
+		return nil
+	}
+	if af.StrictCloud {
+		return err
+	}
+	logger.Warn("relay endpoint and Entra authority are for different clouds", "error", err)
+	return nil
+}
+
 // resolveResourceID returns the resource ID from flag or AZTUNNEL_ARC_RESOURCE_ID env var.
 func resolveResourceID(resourceID string) (string, error) {
 	if resourceID != "" {
@@ -178,7 +543,9 @@ func resolveResourceID(resourceID string) (string, error) {
 	return "", fmt.Errorf("resource ID is required: use --resource-id or set AZTUNNEL_ARC_RESOURCE_ID")
 }
 
-func newLogger(level string) *slog.Logger {
+// newLogger returns the stderr logger for level and format ("text" or
+// "json"; anything else is text), with token redaction applied.
+func newLogger(level, format string) *slog.Logger {
 	var lvl slog.Level
 	switch strings.ToLower(level) {
 	case "debug":
@@ -190,5 +557,10 @@ func newLogger(level string) *slog.Logger {
 	default:
 		lvl = slog.LevelInfo
 	}
-	return slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: lvl}))
+	opts := &slog.HandlerOptions{Level: lvl}
+	var h slog.Handler = slog.NewTextHandler(os.Stderr, opts)
+	if format == "json" {
+		h = slog.NewJSONHandler(os.Stderr, opts)
+	}
+	return slog.New(relay.NewRedactingHandler(h))
 }
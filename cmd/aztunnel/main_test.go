@@ -1,19 +1,31 @@
 package main
 
 import (
+	"bufio"
 	"bytes"
 	"context"
+	"crypto/tls"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
 	"io"
 	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
 	"os"
 	"os/exec"
 	"path/filepath"
 	"runtime"
 	"runtime/debug"
+	"slices"
 	"strings"
 	"testing"
 	"time"
 
+	"github.com/alecthomas/kong"
 	"github.com/philsphicas/aztunnel/internal/relay"
 )
 
@@ -51,7 +63,7 @@ func TestNewLogger(t *testing.T) {
 
 	for _, tt := range tests {
 		t.Run(tt.input, func(t *testing.T) {
-			logger := newLogger(tt.input)
+			logger := newLogger(tt.input, "text")
 			if logger == nil {
 				t.Fatal("newLogger returned nil")
 			}
@@ -120,6 +132,37 @@ func TestResolveAuth_SASCredentials(t *testing.T) {
 	}
 }
 
+func TestResolveAuth_MalformedSASKey(t *testing.T) {
+	t.Setenv("AZTUNNEL_RELAY_NAME", "myns")
+	t.Setenv("AZTUNNEL_KEY_NAME", "send-rule")
+	t.Setenv("AZTUNNEL_KEY", "my secret key")
+
+	_, _, _, _, err := resolveAuth(AuthFlags{})
+	if err == nil || !strings.Contains(err.Error(), "invalid SAS key format") {
+		t.Fatalf("resolveAuth = %v, want an invalid SAS key format error", err)
+	}
+	if strings.Contains(err.Error(), "my secret key") {
+		t.Errorf("error leaked the key: %v", err)
+	}
+}
+
+func TestResolveAuth_SASExpiry(t *testing.T) {
+	t.Setenv("AZTUNNEL_RELAY_NAME", "myns")
+	t.Setenv("AZTUNNEL_KEY_NAME", "send-rule")
+	t.Setenv("AZTUNNEL_KEY", "dGVzdGtleQ==")
+
+	_, _, tp, _, err := resolveAuth(AuthFlags{SASExpiry: 10 * time.Minute})
+	if err != nil {
+		t.Fatalf("resolveAuth: %v", err)
+	}
+	if sas := tp.(*relay.SASTokenProvider); sas.Expiry != 10*time.Minute {
+		t.Errorf("Expiry = %s, want 10m", sas.Expiry)
+	}
+	if _, _, _, _, err := resolveAuth(AuthFlags{SASExpiry: -time.Minute}); err == nil {
+		t.Error("resolveAuth accepted a negative --sas-expiry")
+	}
+}
+
 func TestResolveAuth_MissingNamespace(t *testing.T) {
 	t.Setenv("AZTUNNEL_RELAY_NAME", "")
 	t.Setenv("AZTUNNEL_KEY_NAME", "")
@@ -267,7 +310,7 @@ func TestResolveAuth_OnlyKeyNameNoKey(t *testing.T) {
 func TestResolveAuth_InsecureTLSFlag(t *testing.T) {
 	t.Setenv("AZTUNNEL_RELAY_INSECURE_TLS", "")
 	t.Setenv("AZTUNNEL_KEY_NAME", "k")
-	t.Setenv("AZTUNNEL_KEY", "v")
+	t.Setenv("AZTUNNEL_KEY", "dGVzdGtleQ==")
 
 	_, opts, _, _, err := resolveAuth(AuthFlags{
 		Relay:            "wss://localhost:8443",
@@ -281,13 +324,151 @@ func TestResolveAuth_InsecureTLSFlag(t *testing.T) {
 	}
 }
 
+func TestResolveAuth_CAFile(t *testing.T) {
+	t.Setenv("AZTUNNEL_RELAY_INSECURE_TLS", "")
+	t.Setenv("AZTUNNEL_KEY_NAME", "k")
+	t.Setenv("AZTUNNEL_KEY", "dGVzdGtleQ==")
+
+	// Stand-in for a TLS-inspecting proxy with a private CA.
+	srv := httptest.NewTLSServer(http.NotFoundHandler())
+	defer srv.Close()
+	dir := t.TempDir()
+	caFile := filepath.Join(dir, "ca.pem")
+	if err := os.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: srv.Certificate().Raw}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	_, opts, _, _, err := resolveAuth(AuthFlags{Relay: "myns", CAFile: caFile})
+	if err != nil {
+		t.Fatalf("resolveAuth: %v", err)
+	}
+	if opts.TLSConfig == nil || opts.TLSConfig.RootCAs == nil || opts.TLSConfig.InsecureSkipVerify {
+		t.Fatalf("TLSConfig = %+v, want verifying RootCAs", opts.TLSConfig)
+	}
+	cfg := opts.TLSConfig.Clone()
+	cfg.ServerName = "example.com" // a name in httptest's certificate
+	conn, err := tls.Dial("tcp", srv.Listener.Addr().String(), cfg)
+	if err != nil {
+		t.Fatalf("handshake with --ca-file roots: %v", err)
+	}
+	_ = conn.Close()
+
+	notPEM := filepath.Join(dir, "not.pem")
+	if err := os.WriteFile(notPEM, []byte("hello"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	for _, path := range []string{filepath.Join(dir, "missing.pem"), notPEM} {
+		if _, _, _, _, err := resolveAuth(AuthFlags{Relay: "myns", CAFile: path}); err == nil || !strings.Contains(err.Error(), "--ca-file") {
+			t.Errorf("resolveAuth(CAFile=%s) = %v, want a --ca-file error", filepath.Base(path), err)
+		}
+	}
+}
+
+func TestParseProxy(t *testing.T) {
+	for _, tc := range []struct {
+		raw  string
+		want string // "" = no proxy; "error" = rejected
+	}{
+		{"", ""},
+		{"http://proxy.corp:3128", "http://proxy.corp:3128"},
+		{"socks5://127.0.0.1:1080", "socks5://127.0.0.1:1080"},
+		{"ftp://proxy.corp", "error"},
+		{"proxy.corp:3128", "error"},
+		{"http://", "error"},
+	} {
+		u, err := parseProxy(tc.raw)
+		switch {
+		case tc.want == "error":
+			if err == nil {
+				t.Errorf("parseProxy(%q) = %v, want error", tc.raw, u)
+			}
+		case err != nil:
+			t.Errorf("parseProxy(%q): %v", tc.raw, err)
+		case proxyString(u) != tc.want:
+			t.Errorf("parseProxy(%q) = %q, want %q", tc.raw, proxyString(u), tc.want)
+		}
+	}
+}
+
+func TestResolveAuth_ClientID(t *testing.T) {
+	t.Setenv("AZTUNNEL_RELAY_NAME", "test")
+	t.Setenv("AZTUNNEL_KEY_NAME", "")
+	t.Setenv("AZTUNNEL_KEY", "")
+	t.Setenv("AZTUNNEL_KEY_FILE", "")
+	t.Setenv("AZTUNNEL_CLIENT_ID", "00000000-0000-0000-0000-00000000000e")
+
+	for _, tc := range []struct {
+		name string
+		af   AuthFlags
+		want string
+	}{
+		{"env", AuthFlags{}, "00000000-0000-0000-0000-00000000000e"},
+		{"flag over env", AuthFlags{ClientID: "00000000-0000-0000-0000-00000000000f"}, "00000000-0000-0000-0000-00000000000f"},
+	} {
+		_, _, tp, providerName, err := resolveAuth(tc.af)
+		if err != nil {
+			t.Fatalf("%s: resolveAuth: %v", tc.name, err)
+		}
+		entra, ok := tp.(*relay.EntraTokenProvider)
+		if !ok || providerName != relay.ProviderEntra {
+			t.Fatalf("%s: got %T (%s), want Entra provider", tc.name, tp, providerName)
+		}
+		if got := entra.ClientID(); got != tc.want {
+			t.Errorf("%s: ClientID = %q, want %q", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestCheckCloud(t *testing.T) {
+	const chinaEndpoint = "ns.servicebus.chinacloudapi.cn"
+
+	t.Run("mismatch warns", func(t *testing.T) {
+		t.Setenv("AZURE_AUTHORITY_HOST", "")
+		var buf bytes.Buffer
+		logger := slog.New(slog.NewTextHandler(&buf, nil))
+		if err := checkCloud(AuthFlags{}, chinaEndpoint, relay.ProviderEntra, logger); err != nil {
+			t.Fatalf("checkCloud: %v", err)
+		}
+		if !strings.Contains(buf.String(), "different clouds") {
+			t.Errorf("missing mismatch warning in %q", buf.String())
+		}
+	})
+
+	t.Run("mismatch fails with --strict-cloud", func(t *testing.T) {
+		t.Setenv("AZURE_AUTHORITY_HOST", "")
+		err := checkCloud(AuthFlags{StrictCloud: true}, chinaEndpoint, relay.ProviderEntra, slog.New(slog.NewTextHandler(io.Discard, nil)))
+		if err == nil || !strings.Contains(err.Error(), "AzureChina") {
+			t.Fatalf("err = %v, want cloud mismatch naming AzureChina", err)
+		}
+	})
+
+	t.Run("matching authority", func(t *testing.T) {
+		t.Setenv("AZURE_AUTHORITY_HOST", "https://login.chinacloudapi.cn/")
+		var buf bytes.Buffer
+		logger := slog.New(slog.NewTextHandler(&buf, nil))
+		if err := checkCloud(AuthFlags{StrictCloud: true}, chinaEndpoint, relay.ProviderEntra, logger); err != nil {
+			t.Fatalf("checkCloud: %v", err)
+		}
+		if buf.Len() != 0 {
+			t.Errorf("unexpected log output %q", buf.String())
+		}
+	})
+
+	t.Run("SAS is not checked", func(t *testing.T) {
+		t.Setenv("AZURE_AUTHORITY_HOST", "")
+		if err := checkCloud(AuthFlags{StrictCloud: true}, chinaEndpoint, relay.ProviderSAS, slog.New(slog.NewTextHandler(io.Discard, nil))); err != nil {
+			t.Fatalf("checkCloud: %v", err)
+		}
+	})
+}
+
 func TestResolveAuth_RejectsPlainSchemes(t *testing.T) {
 	// aztunnel only dials TLS-protected relays, so any --relay value
 	// using ws://, http://, or another non-TLS scheme is rejected at
 	// parse time (not silently downgraded to wss).
 	t.Setenv("AZTUNNEL_RELAY_NAME", "")
 	t.Setenv("AZTUNNEL_KEY_NAME", "k")
-	t.Setenv("AZTUNNEL_KEY", "v")
+	t.Setenv("AZTUNNEL_KEY", "dGVzdGtleQ==")
 
 	for _, tc := range []struct {
 		name  string
@@ -309,6 +490,157 @@ func TestResolveAuth_RejectsPlainSchemes(t *testing.T) {
 	}
 }
 
+func TestResolveHealth_WithoutMetrics(t *testing.T) {
+	t.Setenv("AZTUNNEL_METRICS_ADDR", "")
+	t.Setenv("AZTUNNEL_HEALTH_ADDR", "")
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	m, err := resolveMetrics(ctx, &Globals{}, logger)
+	if err != nil || m != nil {
+		t.Fatalf("resolveMetrics = %v, %v; want metrics disabled", m, err)
+	}
+
+	// Reserve a free port, then hand it to the health server.
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	addr := ln.Addr().String()
+	_ = ln.Close()
+
+	readiness, err := resolveHealth(ctx, addr, logger)
+	if err != nil {
+		t.Fatalf("resolveHealth: %v", err)
+	}
+	if readiness == nil {
+		t.Fatal("resolveHealth returned nil readiness with an address set")
+	}
+
+	status := func(path string) int {
+		t.Helper()
+		var lastErr error
+		for range 20 {
+			resp, err := http.Get("http://" + addr + path)
+			if err == nil {
+				resp.Body.Close()
+				return resp.StatusCode
+			}
+			lastErr = err
+			time.Sleep(50 * time.Millisecond)
+		}
+		t.Fatalf("GET %s: %v", path, lastErr)
+		return 0
+	}
+	if got := status("/healthz"); got != http.StatusOK {
+		t.Errorf("/healthz = %d, want 200", got)
+	}
+	if got := status("/readyz"); got != http.StatusServiceUnavailable {
+		t.Errorf("/readyz = %d, want 503 before ready", got)
+	}
+	readiness.SetReady(true)
+	if got := status("/readyz"); got != http.StatusOK {
+		t.Errorf("/readyz = %d, want 200 once ready", got)
+	}
+}
+
+func TestResolveMetrics_PushOnlyFlushesOnExit(t *testing.T) {
+	t.Setenv("AZTUNNEL_METRICS_ADDR", "")
+	paths := make(chan string, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		paths <- r.URL.Path
+	}))
+	defer srv.Close()
+
+	globals := &Globals{MetricsPush: srv.URL, MetricsPushJob: "ci"}
+	m, err := resolveMetrics(context.Background(), globals, slog.New(slog.NewTextHandler(io.Discard, nil)))
+	if err != nil {
+		t.Fatalf("resolveMetrics: %v", err)
+	}
+	if m == nil {
+		t.Fatal("resolveMetrics returned nil with --metrics-push set")
+	}
+	globals.flushMetricsPush()
+	select {
+	case got := <-paths:
+		if got != "/metrics/job/ci" {
+			t.Errorf("push path = %q, want /metrics/job/ci", got)
+		}
+	default:
+		t.Error("flushMetricsPush did not push")
+	}
+}
+
+func TestResolveMetrics_TLSFlags(t *testing.T) {
+	t.Setenv("AZTUNNEL_METRICS_ADDR", "")
+	missing := filepath.Join(t.TempDir(), "missing.pem")
+	for _, tc := range []struct {
+		name      string
+		cert, key string
+		want      string
+	}{
+		{"cert only", missing, "", "must be set together"},
+		{"key only", "", missing, "must be set together"},
+		{"unreadable", missing, missing, "--metrics-tls-cert/--metrics-tls-key"},
+	} {
+		globals := &Globals{MetricsAddr: "127.0.0.1:0", MetricsTLSCert: tc.cert, MetricsTLSKey: tc.key}
+		_, err := resolveMetrics(context.Background(), globals, slog.New(slog.NewTextHandler(io.Discard, nil)))
+		if err == nil || !strings.Contains(err.Error(), tc.want) {
+			t.Errorf("%s: resolveMetrics = %v, want error containing %q", tc.name, err, tc.want)
+		}
+	}
+}
+
+func TestResolveMetrics_AdminRequiresToken(t *testing.T) {
+	t.Setenv("AZTUNNEL_METRICS_ADDR", "")
+	t.Setenv("AZTUNNEL_METRICS_TOKEN", "")
+	globals := &Globals{MetricsAddr: "127.0.0.1:0", MetricsAdmin: true}
+	_, err := resolveMetrics(context.Background(), globals, slog.New(slog.NewTextHandler(io.Discard, nil)))
+	if err == nil || !strings.Contains(err.Error(), "--metrics-admin requires --metrics-token") {
+		t.Fatalf("resolveMetrics = %v, want --metrics-token error", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	t.Setenv("AZTUNNEL_METRICS_TOKEN", "s3cret")
+	m, err := resolveMetrics(ctx, globals, slog.New(slog.NewTextHandler(io.Discard, nil)))
+	if err != nil || m == nil || !m.Admin {
+		t.Fatalf("resolveMetrics with token = %v, %v; want admin enabled", m, err)
+	}
+}
+
+func TestResolveMetrics_AccessLogOnly(t *testing.T) {
+	t.Setenv("AZTUNNEL_METRICS_ADDR", "")
+	path := filepath.Join(t.TempDir(), "access.log")
+	globals := &Globals{AccessLog: path, LogFormat: "json"}
+	m, err := resolveMetrics(context.Background(), globals, slog.New(slog.NewTextHandler(io.Discard, nil)))
+	if err != nil {
+		t.Fatalf("resolveMetrics: %v", err)
+	}
+	if m == nil || m.AccessLog == nil {
+		t.Fatal("--access-log alone did not enable the access log")
+	}
+	m.AccessLog.Info("connection", "target", "10.0.0.1:22")
+	data, err := os.ReadFile(path)
+	if err != nil || !strings.Contains(string(data), `"target":"10.0.0.1:22"`) {
+		t.Errorf("access log = %q (%v), want a JSON record", data, err)
+	}
+
+	globals.AccessLog = filepath.Join(t.TempDir(), "missing", "access.log")
+	if _, err := resolveMetrics(context.Background(), globals, slog.Default()); err == nil || !strings.Contains(err.Error(), "--access-log") {
+		t.Errorf("unwritable path: err = %v, want an --access-log error", err)
+	}
+}
+
+func TestResolveHealth_Disabled(t *testing.T) {
+	t.Setenv("AZTUNNEL_HEALTH_ADDR", "")
+	readiness, err := resolveHealth(context.Background(), "", slog.Default())
+	if err != nil || readiness != nil {
+		t.Errorf("resolveHealth = %v, %v; want nil, nil", readiness, err)
+	}
+}
+
 func TestVersion(t *testing.T) {
 	// Verify the version variable is set (compile-time default is "dev").
 	if version == "" {
@@ -352,6 +684,36 @@ func TestResolveResourceID_Missing(t *testing.T) {
 	}
 }
 
+func TestResolveHycos(t *testing.T) {
+	t.Setenv("AZTUNNEL_HYCO_NAME", "env-a,env-b")
+
+	got, err := resolveHycos([]string{"flag-a", "flag-b"})
+	if err != nil || !slices.Equal(got, []string{"flag-a", "flag-b"}) {
+		t.Errorf("resolveHycos(flags) = %q, %v, want the flag values", got, err)
+	}
+	got, err = resolveHycos(nil)
+	if err != nil || !slices.Equal(got, []string{"env-a", "env-b"}) {
+		t.Errorf("resolveHycos(nil) = %q, %v, want the comma-separated env values", got, err)
+	}
+	for _, bad := range [][]string{{"a", "a"}, {"a", ""}} {
+		if _, err := resolveHycos(bad); err == nil {
+			t.Errorf("resolveHycos(%q) accepted", bad)
+		}
+	}
+
+	// Senders serve exactly one hybrid connection.
+	if _, err := resolveHyco(nil); err == nil || !strings.Contains(err.Error(), "one hybrid connection") {
+		t.Errorf("resolveHyco(env with two) err = %v, want one-hyco error", err)
+	}
+	if h, err := resolveHyco([]string{"only"}); err != nil || h != "only" {
+		t.Errorf("resolveHyco([only]) = %q, %v", h, err)
+	}
+	t.Setenv("AZTUNNEL_HYCO_NAME", "")
+	if _, err := resolveHyco(nil); err == nil || !strings.Contains(err.Error(), "is required") {
+		t.Errorf("resolveHyco(nothing) err = %v, want required error", err)
+	}
+}
+
 func TestNewLoggerWritesToStderr(t *testing.T) {
 	// Redirect stderr before creating the logger so the handler
 	// writes to our pipe.
@@ -364,7 +726,7 @@ func TestNewLoggerWritesToStderr(t *testing.T) {
 	}
 	os.Stderr = w
 
-	logger := newLogger("info")
+	logger := newLogger("info", "text")
 	logger.Info("test message", "key", "value")
 
 	w.Close()
@@ -378,6 +740,38 @@ func TestNewLoggerWritesToStderr(t *testing.T) {
 	}
 }
 
+func TestNewLoggerJSON(t *testing.T) {
+	old := os.Stderr
+	defer func() { os.Stderr = old }()
+
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatalf("pipe: %v", err)
+	}
+	os.Stderr = w
+
+	logger := newLogger("warn", "json")
+	logger.Info("filtered out")
+	logger.Warn("test message", "key", "value")
+
+	w.Close()
+	data, _ := io.ReadAll(r)
+	r.Close()
+
+	var line map[string]any
+	if err := json.Unmarshal(bytes.TrimSpace(data), &line); err != nil {
+		t.Fatalf("output is not one JSON object: %v\n%s", err, data)
+	}
+	for _, k := range []string{"time", "level", "msg", "key"} {
+		if _, ok := line[k]; !ok {
+			t.Errorf("JSON log line missing %q: %s", k, data)
+		}
+	}
+	if line["level"] != "WARN" || line["msg"] != "test message" || line["key"] != "value" {
+		t.Errorf("level/msg/key = %v/%v/%v, want WARN/test message/value", line["level"], line["msg"], line["key"])
+	}
+}
+
 // TestCLI_MissingRequiredArgs verifies the aztunnel CLI emits a
 // clean error (not a usage dump) when a required argument is
 // missing. Runs the freshly-built binary as a subprocess and
@@ -431,6 +825,13 @@ func TestCLI_MissingRequiredArgs(t *testing.T) {
 			t.Errorf("expected error about missing argument, got: %s", output)
 		}
 	})
+
+	t.Run("sender_dynamic_with_target", func(t *testing.T) {
+		output := runClean(t, "relay-sender", "connect", "--dynamic", "127.0.0.1:22")
+		if !strings.Contains(output, "--dynamic") {
+			t.Errorf("expected error mentioning '--dynamic', got: %s", output)
+		}
+	})
 }
 
 // TestCLI_BadRelayName verifies the aztunnel CLI exits cleanly with
@@ -479,6 +880,72 @@ func TestCLI_BadRelayName(t *testing.T) {
 	}
 }
 
+// TestCLI_InterruptExitsCleanly verifies that SIGINT shuts a running
+// command down with exit status 0 and no error message.
+func TestCLI_InterruptExitsCleanly(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("os.Interrupt cannot be sent to a process on Windows")
+	}
+	binary := buildAztunnelForTest(t)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, binary, //nolint:gosec // test-controlled binary path
+		"relay-sender", "port-forward", "127.0.0.1:22",
+		"--relay", "nonexistent.relay.invalid",
+		"--hyco", "some-hyco",
+	)
+	cmd.Env = append(os.Environ(),
+		"AZTUNNEL_KEY_NAME=test-key-name",
+		"AZTUNNEL_KEY=dGVzdGtleQ==",
+	)
+	stderr, err := cmd.StderrPipe()
+	if err != nil {
+		t.Fatalf("stderr pipe: %v", err)
+	}
+	cmd.Stdout = io.Discard
+	if err := cmd.Start(); err != nil {
+		t.Fatalf("start: %v", err)
+	}
+
+	// port-forward binds locally before touching the relay; wait for
+	// it so the signal lands on a running command.
+	var out bytes.Buffer
+	sc := bufio.NewScanner(stderr)
+	for sc.Scan() {
+		out.WriteString(sc.Text() + "\n")
+		if strings.Contains(sc.Text(), "port-forward listening") {
+			break
+		}
+	}
+	if err := cmd.Process.Signal(os.Interrupt); err != nil {
+		t.Fatalf("signal: %v", err)
+	}
+	_, _ = io.Copy(&out, stderr)
+
+	if err := cmd.Wait(); err != nil {
+		t.Errorf("exit after SIGINT: %v\n%s", err, out.String())
+	}
+	if strings.Contains(out.String(), "aztunnel: error") {
+		t.Errorf("SIGINT shutdown printed an error:\n%s", out.String())
+	}
+}
+
+func TestInterruptedShutdown(t *testing.T) {
+	signalled := make(chan os.Signal, 1)
+	signalled <- os.Interrupt
+	if !interruptedShutdown(fmt.Errorf("serve: %w", context.Canceled), signalled) {
+		t.Error("Canceled after SIGINT not treated as a clean shutdown")
+	}
+	if interruptedShutdown(context.Canceled, make(chan os.Signal, 1)) {
+		t.Error("Canceled without SIGINT treated as a clean shutdown")
+	}
+	signalled <- os.Interrupt
+	if interruptedShutdown(errors.New("listen: address in use"), signalled) {
+		t.Error("real error after SIGINT treated as a clean shutdown")
+	}
+}
+
 // buildAztunnelForTest builds cmd/aztunnel into a temp directory
 // and returns the binary path. Per-test build keeps the
 // no-e2e-tag main_test.go independent of the e2e helpers' shared
@@ -498,3 +965,100 @@ func buildAztunnelForTest(t *testing.T) string {
 	}
 	return binary
 }
+
+func TestBridgeFlagsBufferSize(t *testing.T) {
+	for _, n := range []int{relay.MinBufferSize, relay.DefaultBufferSize, relay.MaxBufferSize} {
+		if got, err := (BridgeFlags{BufferSize: n}).bufferSize(); err != nil || got != n {
+			t.Errorf("bufferSize(%d) = %d, %v; want %d, nil", n, got, err, n)
+		}
+	}
+	for _, n := range []int{0, relay.MinBufferSize - 1, relay.MaxBufferSize + 1} {
+		if _, err := (BridgeFlags{BufferSize: n}).bufferSize(); err == nil {
+			t.Errorf("bufferSize(%d) succeeded, want a range error", n)
+		}
+	}
+}
+
+func TestBridgeFlagsDataPingInterval(t *testing.T) {
+	for flag, want := range map[time.Duration]time.Duration{30 * time.Second: 30 * time.Second, 0: -1} {
+		if got, err := (BridgeFlags{DataPingInterval: flag}).dataPingInterval(); err != nil || got != want {
+			t.Errorf("dataPingInterval(%v) = %v, %v; want %v, nil", flag, got, err, want)
+		}
+	}
+	if _, err := (BridgeFlags{DataPingInterval: -time.Second}).dataPingInterval(); err == nil {
+		t.Error("dataPingInterval(-1s) succeeded, want an error")
+	}
+}
+
+func TestLoopbackAddr(t *testing.T) {
+	for addr, want := range map[string]bool{
+		"127.0.0.1:9090": true,
+		"[::1]:9090":     true,
+		"localhost:9090": true,
+		":9090":          false,
+		"0.0.0.0:9090":   false,
+		"10.0.0.5:9090":  false,
+		"bogus":          false,
+	} {
+		if got := loopbackAddr(addr); got != want {
+			t.Errorf("loopbackAddr(%q) = %v, want %v", addr, got, want)
+		}
+	}
+}
+
+func TestResolveDialSource(t *testing.T) {
+	for _, tc := range []struct {
+		in, want string
+	}{
+		{"", "invalid IP"},
+		{"10.1.2.3", "10.1.2.3"},
+		{"::ffff:10.1.2.3", "10.1.2.3"},
+		{"fd00::5", "fd00::5"},
+	} {
+		got, err := resolveDialSource(tc.in)
+		if err != nil || got.String() != tc.want {
+			t.Errorf("resolveDialSource(%q) = %v, %v; want %s", tc.in, got, err, tc.want)
+		}
+	}
+	if _, err := resolveDialSource("no-such-interface0"); err == nil || !strings.Contains(err.Error(), "--dial-source") {
+		t.Errorf("unknown interface: err = %v, want a --dial-source error", err)
+	}
+}
+
+func TestRelayListener_UDPWithUpstreamSOCKS(t *testing.T) {
+	for _, env := range configEnv {
+		t.Setenv(env, "")
+	}
+	t.Setenv("AZTUNNEL_KEY_NAME", "k")
+	t.Setenv("AZTUNNEL_KEY", "dGVzdGtleQ==")
+	var c cli
+	parser, err := kong.New(&c)
+	if err != nil {
+		t.Fatalf("kong.New: %v", err)
+	}
+	if _, err := parser.Parse([]string{"relay-listener", "--relay", "my-ns", "--hyco", "h",
+		"--allow", "10.0.0.53:53", "--allow-udp", "--upstream-socks", "127.0.0.1:1080"}); err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+	err = c.RelayListener.Run(&c.Globals)
+	if err == nil || !strings.Contains(err.Error(), "--allow-udp cannot be combined with --upstream-socks") {
+		t.Errorf("Run = %v, want --allow-udp/--upstream-socks conflict", err)
+	}
+}
+
+func TestInterfaceSource(t *testing.T) {
+	ipnet := func(s string) net.Addr {
+		p := netip.MustParsePrefix(s)
+		return &net.IPNet{IP: p.Addr().AsSlice(), Mask: net.CIDRMask(p.Bits(), p.Addr().BitLen())}
+	}
+	got, err := interfaceSource("eth1", []net.Addr{ipnet("10.1.0.5/24"), ipnet("fe80::1/64")})
+	if err != nil || got != netip.MustParseAddr("10.1.0.5") {
+		t.Errorf("one address plus link-local = %v, %v; want 10.1.0.5", got, err)
+	}
+	if _, err := interfaceSource("eth1", []net.Addr{ipnet("10.1.0.5/24"), ipnet("fd00::5/64")}); err == nil || !strings.Contains(err.Error(), "several addresses") {
+		t.Errorf("two addresses: err = %v, want ambiguous", err)
+	}
+	if _, err := interfaceSource("eth1", []net.Addr{ipnet("fe80::1/64")}); err == nil || !strings.Contains(err.Error(), "no usable address") {
+		t.Errorf("link-local only: err = %v, want no usable address", err)
+	}
+}
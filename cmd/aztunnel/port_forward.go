@@ -2,10 +2,10 @@ package main
 
 import (
 	"context"
-	"fmt"
 	"net"
 	"os"
 	"os/signal"
+	"time"
 
 	"github.com/philsphicas/aztunnel/internal/sender"
 )
@@ -14,7 +14,13 @@ import (
 type PortForwardCmd struct {
 	AuthFlags
 	BindFlags
-	Target string `arg:"" required:"" help:"Target host:port."`
+	BridgeFlags
+	Target          string        `arg:"" required:"" help:"Target host:port."`
+	Pipelining      bool          `help:"Reuse one idle rendezvous for back-to-back connections when the listener supports it."`
+	HalfClose       bool          `name:"half-close" help:"Keep receiving after the local client shuts down its write side, when the listener supports it."`
+	Mux             bool          `help:"Carry every connection over one shared rendezvous when the listener supports it."`
+	EnvelopeTimeout time.Duration `name:"envelope-timeout" help:"Give up on a rendezvous the listener has not answered within this long." default:"45s"`
+	Compress        bool          `help:"Offer permessage-deflate compression on the relay WebSocket and ask the listener to do the same."`
 }
 
 // Run executes the port-forward command.
@@ -28,38 +34,74 @@ func (p *PortForwardCmd) Run(globals *Globals) error {
 	if err != nil {
 		return err
 	}
+	opts.Compression = p.Compress
 
-	bind := p.Bind
-	if p.Gateway {
-		_, port, err := net.SplitHostPort(bind)
-		if err != nil {
-			return fmt.Errorf("invalid --bind address %q: %w", bind, err)
-		}
-		if port == "" {
-			port = "0"
-		}
-		bind = "0.0.0.0:" + port
+	bind, err := p.resolve()
+	if err != nil {
+		return err
+	}
+	bufferSize, err := p.bufferSize()
+	if err != nil {
+		return err
+	}
+	dataPingInterval, err := p.dataPingInterval()
+	if err != nil {
+		return err
 	}
-	logger := newLogger(globals.LogLevel)
+	logger := newLogger(globals.LogLevel, globals.LogFormat)
 	warnInsecureTLS(opts, logger)
+	warnKeyFile(p.AuthFlags, logger)
+	if err := checkCloud(p.AuthFlags, endpoint, providerName, logger); err != nil {
+		return err
+	}
+	printConfig(globals, logger, "relay-sender port-forward", senderSnapshot{
+		relaySnapshot:    newRelaySnapshot(globals, endpoint, hyco, opts, tp, providerName),
+		Target:           p.Target,
+		Bind:             bind,
+		TCPKeepAlive:     p.TCPKeepAlive,
+		EnvelopeTimeout:  p.EnvelopeTimeout,
+		BufferSize:       bufferSize,
+		IdleTimeout:      p.IdleTimeout,
+		RateLimit:        p.RateLimit,
+		DataPingInterval: p.DataPingInterval,
+		Compress:         p.Compress,
+	})
 
 	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
 	defer stop()
+	defer notifySASReload(ctx, tp, keyFilePath(p.AuthFlags), logger)()
 
 	cfg := sender.PortForwardConfig{
-		Endpoint:      endpoint,
-		EntityPath:    hyco,
-		TokenProvider: tp,
-		ClientOptions: opts,
-		Target:        p.Target,
-		BindAddress:   bind,
-		TCPKeepAlive:  p.TCPKeepAlive,
-		Logger:        logger,
+		Endpoint:         endpoint,
+		EntityPath:       hyco,
+		TokenProvider:    tp,
+		ClientOptions:    opts,
+		Target:           p.Target,
+		BindAddress:      bind,
+		Network:          p.LocalFamily,
+		TCPKeepAlive:     p.TCPKeepAlive,
+		Logger:           logger,
+		Pipelining:       p.Pipelining,
+		HalfClose:        p.HalfClose,
+		Mux:              p.Mux,
+		BufferSize:       bufferSize,
+		IdleTimeout:      p.IdleTimeout,
+		RateLimit:        p.RateLimit,
+		DataPingInterval: dataPingInterval,
+		EnvelopeTimeout:  p.EnvelopeTimeout,
 	}
-	if cfg.Metrics, err = resolveMetrics(ctx, globals.MetricsAddr, globals.MetricsMaxTargets, logger); err != nil {
+	if cfg.Metrics, err = resolveMetrics(ctx, globals, logger); err != nil {
 		return err
 	}
 	cfg.TokenProvider = observeTokenFetch(tp, cfg.Metrics, providerName)
+	if cfg.Tracer, err = resolveTracer(globals, logger); err != nil {
+		return err
+	}
+	readiness, err := resolveHealth(ctx, globals.HealthAddr, logger)
+	if err != nil {
+		return err
+	}
+	cfg.Ready = func(net.Addr) { readiness.SetReady(true) }
 
 	return sender.PortForward(ctx, cfg)
 }
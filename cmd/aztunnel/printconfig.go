@@ -0,0 +1,322 @@
+package main
+
+import (
+	"log/slog"
+	"net/netip"
+	"net/url"
+	"time"
+
+	"github.com/philsphicas/aztunnel/internal/protocol"
+	"github.com/philsphicas/aztunnel/internal/relay"
+)
+
+// redacted replaces a secret value in --print-config output. Unset
+// secrets print as empty so operators can still tell "not configured"
+// from "configured".
+func redacted(secret string) string {
+	if secret == "" {
+		return ""
+	}
+	return "REDACTED"
+}
+
+// redactedURL returns raw with any userinfo password masked.
+func redactedURL(raw string) string {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return redacted(raw)
+	}
+	return u.Redacted()
+}
+
+// proxyString returns u as text, or "" for no proxy.
+func proxyString(u *url.URL) string {
+	if u == nil {
+		return ""
+	}
+	return u.String()
+}
+
+// dialSourceString renders an unset --dial-source as empty rather than
+// "invalid IP".
+func dialSourceString(ip netip.Addr) string {
+	if !ip.IsValid() {
+		return ""
+	}
+	return ip.String()
+}
+
+// relaySnapshot is the resolved relay connection configuration shared
+// by every relay-listener / relay-sender command. It implements
+// slog.LogValuer; secrets never leave LogValue unredacted.
+type relaySnapshot struct {
+	Endpoint     string
+	Hyco         string
+	Auth         string // relay.ProviderSAS or relay.ProviderEntra
+	SASKeyName   string
+	SASKey       string
+	SASExpiry    time.Duration
+	ClientID     string
+	InsecureTLS  bool
+	Proxy        string
+	ConfigFile   string
+	LogLevel     string
+	LogFormat    string
+	MetricsAddr  string
+	MetricsToken string
+	MetricsPush  string
+	AccessLog    string
+	HealthAddr   string
+	OTelEndpoint string
+}
+
+func newRelaySnapshot(globals *Globals, endpoint, hyco string, opts relay.ClientOptions, tp relay.TokenProvider, providerName string) relaySnapshot {
+	s := relaySnapshot{
+		Endpoint:     endpoint,
+		Hyco:         hyco,
+		Auth:         providerName,
+		InsecureTLS:  opts.TLSConfig != nil && opts.TLSConfig.InsecureSkipVerify,
+		Proxy:        proxyString(opts.Proxy),
+		ConfigFile:   string(globals.Config),
+		LogLevel:     globals.LogLevel,
+		LogFormat:    globals.LogFormat,
+		MetricsAddr:  resolveMetricsAddr(globals.MetricsAddr),
+		MetricsToken: resolveMetricsToken(globals.MetricsToken),
+		MetricsPush:  globals.MetricsPush,
+		AccessLog:    globals.AccessLog,
+		HealthAddr:   resolveHealthAddr(globals.HealthAddr),
+		OTelEndpoint: globals.OTelEndpoint,
+	}
+	switch p := tp.(type) {
+	case *relay.SASTokenProvider:
+		s.SASKeyName, s.SASKey = p.Credentials()
+		s.SASExpiry = p.Expiry
+	case *relay.EntraTokenProvider:
+		s.ClientID = p.ClientID()
+	}
+	return s
+}
+
+func (s relaySnapshot) attrs() []slog.Attr {
+	return []slog.Attr{
+		slog.String("endpoint", s.Endpoint),
+		slog.String("hyco", s.Hyco),
+		slog.String("auth", s.Auth),
+		slog.String("sas_key_name", s.SASKeyName),
+		slog.String("sas_key", redacted(s.SASKey)),
+		slog.Duration("sas_expiry", s.SASExpiry),
+		slog.String("client_id", s.ClientID),
+		slog.Bool("insecure_tls", s.InsecureTLS),
+		slog.String("proxy", redactedURL(s.Proxy)),
+		slog.String("config", s.ConfigFile),
+		slog.String("log_level", s.LogLevel),
+		slog.String("log_format", s.LogFormat),
+		slog.String("metrics_addr", s.MetricsAddr),
+		slog.String("metrics_token", redacted(s.MetricsToken)),
+		slog.String("metrics_push", redactedURL(s.MetricsPush)),
+		slog.String("access_log", s.AccessLog),
+		slog.String("health_addr", s.HealthAddr),
+		slog.String("otel_endpoint", redactedURL(s.OTelEndpoint)),
+	}
+}
+
+// LogValue implements slog.LogValuer.
+func (s relaySnapshot) LogValue() slog.Value {
+	return slog.GroupValue(s.attrs()...)
+}
+
+// listenerSnapshot is the effective relay-listener configuration.
+type listenerSnapshot struct {
+	relaySnapshot
+	AllowList        []string
+	AllowFile        string
+	DenyList         []string
+	DenyFile         string
+	TargetMap        map[string]string
+	MapFile          string
+	AllowResolve     bool
+	MaxConnections   int
+	AcceptOverflow   string
+	QueueTimeout     time.Duration
+	AcceptWorkers    int
+	ListenBacklog    int
+	ConnectTimeout   time.Duration
+	TCPKeepAlive     time.Duration
+	PipelineIdle     time.Duration
+	MetadataLimits   protocol.MetadataLimits
+	Echo             bool
+	AllowBind        bool
+	AllowUDP         bool
+	AllowMux         bool
+	ProbeTarget      bool
+	ProxyProtocol    bool
+	DialRetries      int
+	DialBackoff      time.Duration
+	DialSource       netip.Addr
+	DialFamily       string
+	UpstreamSOCKS    string
+	ChainTo          string
+	IdleReconnect    time.Duration
+	MaxMessageSize   int64
+	PingInterval     time.Duration
+	RenewInterval    time.Duration
+	MinThroughput    relay.MinThroughput
+	BufferSize       int
+	IdleTimeout      time.Duration
+	RateLimit        int64
+	DataPingInterval time.Duration
+}
+
+// LogValue implements slog.LogValuer.
+func (s listenerSnapshot) LogValue() slog.Value {
+	return slog.GroupValue(append(s.attrs(),
+		slog.Any("allow", s.AllowList),
+		slog.String("allow_file", s.AllowFile),
+		slog.Any("deny", s.DenyList),
+		slog.String("deny_file", s.DenyFile),
+		slog.Any("map", s.TargetMap),
+		slog.String("map_file", s.MapFile),
+		slog.Bool("allow_resolve", s.AllowResolve),
+		slog.Int("max_connections", s.MaxConnections),
+		slog.String("accept_overflow", s.AcceptOverflow),
+		slog.Duration("accept_queue_timeout", s.QueueTimeout),
+		slog.Int("accept_workers", s.AcceptWorkers),
+		slog.Int("listen_backlog", s.ListenBacklog),
+		slog.Duration("connect_timeout", s.ConnectTimeout),
+		slog.Duration("tcp_keepalive", s.TCPKeepAlive),
+		slog.Duration("pipeline_idle_timeout", s.PipelineIdle),
+		slog.Int("max_metadata_entries", s.MetadataLimits.MaxEntries),
+		slog.Int("max_metadata_size", s.MetadataLimits.MaxTotalSize),
+		slog.Bool("echo", s.Echo),
+		slog.Bool("allow_bind", s.AllowBind),
+		slog.Bool("allow_udp", s.AllowUDP),
+		slog.Bool("allow_mux", s.AllowMux),
+		slog.Bool("probe_target", s.ProbeTarget),
+		slog.Bool("proxy_protocol", s.ProxyProtocol),
+		slog.Int("target_dial_retries", s.DialRetries),
+		slog.Duration("target_dial_backoff", s.DialBackoff),
+		slog.String("dial_source", dialSourceString(s.DialSource)),
+		slog.String("dial_family", s.DialFamily),
+		slog.String("upstream_socks", s.UpstreamSOCKS),
+		slog.String("chain_to", s.ChainTo),
+		slog.Duration("control_idle_reconnect", s.IdleReconnect),
+		slog.Int64("max_message_size", s.MaxMessageSize),
+		slog.Duration("ping_interval", s.PingInterval),
+		slog.Duration("token_renew_interval", s.RenewInterval),
+		slog.Int64("min_throughput", s.MinThroughput.BytesPerSec),
+		slog.Duration("min_throughput_window", s.MinThroughput.Window),
+		slog.Int("buffer_size", s.BufferSize),
+		slog.Duration("idle_timeout", s.IdleTimeout),
+		slog.Int64("rate_limit", s.RateLimit),
+		slog.Duration("data_ping_interval", s.DataPingInterval),
+	)...)
+}
+
+// senderSnapshot is the effective configuration of a relay-sender
+// command. Bind is empty for connect; DialTimeout is only set by the
+// proxy modes and SOCKSAuth only by socks5-proxy, where it records
+// whether credentials are required, never the credentials themselves.
+type senderSnapshot struct {
+	relaySnapshot
+	Target           string
+	Bind             string
+	TCPKeepAlive     time.Duration
+	EnvelopeTimeout  time.Duration
+	DialTimeout      time.Duration
+	BufferSize       int
+	IdleTimeout      time.Duration
+	RateLimit        int64
+	DataPingInterval time.Duration
+	Compress         bool
+	SOCKSAuth        bool
+}
+
+// LogValue implements slog.LogValuer.
+func (s senderSnapshot) LogValue() slog.Value {
+	return slog.GroupValue(append(s.attrs(),
+		slog.String("target", s.Target),
+		slog.String("bind", s.Bind),
+		slog.Duration("tcp_keepalive", s.TCPKeepAlive),
+		slog.Duration("envelope_timeout", s.EnvelopeTimeout),
+		slog.Duration("dial_timeout", s.DialTimeout),
+		slog.Int("buffer_size", s.BufferSize),
+		slog.Duration("idle_timeout", s.IdleTimeout),
+		slog.Int64("rate_limit", s.RateLimit),
+		slog.Duration("data_ping_interval", s.DataPingInterval),
+		slog.Bool("compress", s.Compress),
+		slog.Bool("socks_auth", s.SOCKSAuth),
+	)...)
+}
+
+// arcSnapshot is the effective configuration of an arc command. Arc
+// credentials come from DefaultAzureCredential and the ARM
+// listCredentials call at runtime, so there is nothing secret here.
+type arcSnapshot struct {
+	ResourceID    string
+	Port          int
+	Service       string
+	UserAgent     string
+	CorrelationID string
+	Bind          string
+	Proxy         string
+	Compress      bool
+	ConfigFile    string
+	LogLevel      string
+	LogFormat     string
+	MetricsAddr   string
+	MetricsToken  string
+	MetricsPush   string
+	AccessLog     string
+	HealthAddr    string
+}
+
+func (a *ArcCmd) snapshot(globals *Globals, resourceID, bind string) arcSnapshot {
+	return arcSnapshot{
+		ResourceID:    resourceID,
+		Port:          a.Port,
+		Service:       a.Service,
+		UserAgent:     a.UserAgent,
+		CorrelationID: a.CorrelationID,
+		Bind:          bind,
+		Proxy:         a.Proxy,
+		Compress:      a.Compress,
+		ConfigFile:    string(globals.Config),
+		LogLevel:      globals.LogLevel,
+		LogFormat:     globals.LogFormat,
+		MetricsAddr:   resolveMetricsAddr(globals.MetricsAddr),
+		MetricsToken:  resolveMetricsToken(globals.MetricsToken),
+		MetricsPush:   globals.MetricsPush,
+		AccessLog:     globals.AccessLog,
+		HealthAddr:    resolveHealthAddr(globals.HealthAddr),
+	}
+}
+
+// LogValue implements slog.LogValuer.
+func (s arcSnapshot) LogValue() slog.Value {
+	return slog.GroupValue(
+		slog.String("resource_id", s.ResourceID),
+		slog.Int("port", s.Port),
+		slog.String("service", s.Service),
+		slog.String("arm_user_agent", s.UserAgent),
+		slog.String("arm_correlation_id", s.CorrelationID),
+		slog.String("bind", s.Bind),
+		slog.String("proxy", redactedURL(s.Proxy)),
+		slog.Bool("compress", s.Compress),
+		slog.String("config", s.ConfigFile),
+		slog.String("log_level", s.LogLevel),
+		slog.String("log_format", s.LogFormat),
+		slog.String("metrics_addr", s.MetricsAddr),
+		slog.String("metrics_token", redacted(s.MetricsToken)),
+		slog.String("metrics_push", redactedURL(s.MetricsPush)),
+		slog.String("access_log", s.AccessLog),
+		slog.String("health_addr", s.HealthAddr),
+	)
+}
+
+// printConfig logs snap at INFO when --print-config is set.
+func printConfig(globals *Globals, logger *slog.Logger, command string, snap slog.LogValuer) {
+	if !globals.PrintConfig {
+		return
+	}
+	logger.Info("effective config", "command", command, "config", snap)
+}
@@ -2,25 +2,66 @@ package main
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
 	"os"
 	"os/signal"
+	"strings"
 	"time"
 
+	"github.com/alecthomas/kong"
 	"github.com/philsphicas/aztunnel/internal/listener"
+	"github.com/philsphicas/aztunnel/internal/protocol"
+	"github.com/philsphicas/aztunnel/internal/relay"
 )
 
 // RelayListenerCmd listens on Azure Relay and forwards to local targets.
 type RelayListenerCmd struct {
 	AuthFlags
-	Allow          []string      `help:"Allowed targets (host:port, CIDR:port, CIDR:*)."`
+	BridgeFlags
+	Allow          []string      `help:"Allowed targets (host:port, *.domain:port, CIDR:port, CIDR:*)."`
+	AllowFile      string        `name:"allow-file" help:"Also allow the targets listed in this file, one per line (# comments); re-read on SIGHUP."`
+	Deny           []string      `help:"Denied targets, same syntax as --allow; checked first and override it."`
+	DenyFile       string        `name:"deny-file" help:"Also deny the targets listed in this file, one per line (# comments); re-read on SIGHUP."`
+	Map            []string      `help:"Expose a target under an alias (alias=host:port); senders request the alias and never see the real address."`
+	MapFile        string        `name:"map-file" help:"Also read alias=host:port mappings from this file, one per line (# comments); re-read on SIGHUP."`
+	AllowResolve   bool          `name:"allow-resolve" help:"Resolve hostname targets no entry names and allow them if their IPs match; dial the resolved IPs."`
 	MaxConnections int           `name:"max-connections" help:"Max concurrent connections (0 = unlimited)." default:"0"`
+	AcceptOverflow string        `name:"accept-overflow" help:"What to do with an accept at --max-connections: drop it, or queue it for --accept-queue-timeout." enum:"drop,queue" default:"drop"`
+	QueueTimeout   time.Duration `name:"accept-queue-timeout" help:"How long --accept-overflow=queue waits for a free connection slot." default:"5s"`
+	AcceptWorkers  int           `name:"accept-workers" help:"Rendezvous dial workers; 0 = one goroutine per accept." default:"0"`
+	ListenBacklog  int           `name:"listen-backlog" help:"Accepts that may queue for a free worker (0 = accept-workers)." default:"0"`
 	ConnectTimeout time.Duration `name:"connect-timeout" help:"Timeout for dialing targets." default:"30s"`
 	TCPKeepAlive   time.Duration `name:"tcp-keepalive" help:"TCP keepalive interval." default:"30s"`
+	PipelineIdle   time.Duration `name:"pipeline-idle-timeout" help:"Close a pipelined rendezvous left idle this long between connections, freeing its slot." default:"60s"`
+	MaxMetaEntries int           `name:"max-metadata-entries" help:"Max connect-envelope metadata entries (0 = default 32)." default:"0"`
+	MaxMetaSize    int           `name:"max-metadata-size" help:"Max connect-envelope metadata size in bytes (0 = default 8192)." default:"0"`
+	Echo           bool          `help:"Diagnostic mode: echo bridged data back instead of dialing targets (bypasses --allow)."`
+	AllowBind      bool          `name:"allow-bind" help:"Accept bind requests: listen on an allowed address and relay the first inbound connection."`
+	AllowUDP       bool          `name:"allow-udp" help:"Accept UDP sessions (SOCKS5 UDP ASSOCIATE): relay datagrams to allowed destinations."`
+	AllowMux       bool          `name:"allow-mux" help:"Accept mux sessions (port-forward --mux): many connections as streams over one rendezvous, each counted against --max-connections."`
+	ProbeTarget    bool          `name:"probe-target" help:"Briefly read from each new target connection and reject targets that close or reset right after accepting."`
+	ProxyProtocol  bool          `name:"proxy-protocol" help:"Send a PROXY protocol v2 header with the sender's client address to each new target connection."`
+	DialRetries    int           `name:"target-dial-retries" help:"Retry a target dial that is refused or unreachable this many times within --connect-timeout." default:"0"`
+	DialBackoff    time.Duration `name:"target-dial-backoff" help:"Wait before the first target dial retry; doubles on each retry." default:"200ms"`
+	DialSource     string        `name:"dial-source" help:"Dial targets from this local IP, or from the one address of this interface."`
+	DialFamily     string        `name:"dial-family" help:"Address family for target dials: auto, ipv4 or ipv6." enum:"auto,ipv4,ipv6" default:"auto"`
+	UpstreamSOCKS  string        `name:"upstream-socks" help:"Dial targets through the SOCKS5 proxy at this host:port."`
+	ChainRelay     string        `name:"chain-relay" help:"Forward every connection to this relay namespace instead of dialing targets (needs --chain-hyco)."`
+	ChainHyco      string        `name:"chain-hyco" help:"Hybrid connection on --chain-relay to forward connections to."`
+	MaxMessageSize int64         `name:"max-message-size" help:"Largest WebSocket message accepted on the control channel and rendezvous connections, in bytes." default:"1048576"`
+	IdleReconnect  time.Duration `name:"control-idle-reconnect" help:"Reconnect the control channel after this long without a control message while idle (0 = never)." default:"0"`
+	MinThroughput  int64         `name:"min-throughput" help:"End a bridge whose target sends fewer than this many bytes/sec once data has started (0 = off)." default:"0"`
+	ThroughputWin  time.Duration `name:"min-throughput-window" help:"Sliding window for --min-throughput." default:"30s"`
+	PingInterval   time.Duration `name:"ping-interval" help:"How often to ping the control channel; a ping unanswered for 10s (or one interval, if shorter) reconnects it." default:"30s"`
+	RenewInterval  time.Duration `name:"token-renew-interval" help:"How often to renew the relay token over the control channel." default:"45m"`
 }
 
 // Run executes the relay-listener command.
 func (r *RelayListenerCmd) Run(globals *Globals) error {
-	hyco, err := resolveHyco(r.Hyco)
+	hycos, err := resolveHycos(r.Hyco)
 	if err != nil {
 		return err
 	}
@@ -29,30 +70,302 @@ func (r *RelayListenerCmd) Run(globals *Globals) error {
 	if err != nil {
 		return err
 	}
+	chainEndpoint, err := r.chainEndpoint()
+	if err != nil {
+		return err
+	}
+	bufferSize, err := r.bufferSize()
+	if err != nil {
+		return err
+	}
+	dataPingInterval, err := r.dataPingInterval()
+	if err != nil {
+		return err
+	}
+	targetMap, err := r.targetMap()
+	if err != nil {
+		return err
+	}
+	if r.PingInterval <= 0 || r.RenewInterval <= 0 {
+		return errors.New("--ping-interval and --token-renew-interval must be positive")
+	}
+	if sas, ok := tp.(*relay.SASTokenProvider); ok && sas.Expiry > 0 && r.RenewInterval >= sas.Expiry {
+		return fmt.Errorf("--token-renew-interval (%s) must be shorter than --sas-expiry (%s)", r.RenewInterval, sas.Expiry)
+	}
+	if r.MaxMessageSize < relay.MinBufferSize {
+		return fmt.Errorf("--max-message-size must be at least %d bytes, got %d", relay.MinBufferSize, r.MaxMessageSize)
+	}
+	if r.DialRetries < 0 || r.DialBackoff <= 0 {
+		return errors.New("--target-dial-retries must not be negative and --target-dial-backoff must be positive")
+	}
+	dialSource, err := resolveDialSource(r.DialSource)
+	if err != nil {
+		return err
+	}
+	if r.UpstreamSOCKS != "" {
+		if _, _, err := net.SplitHostPort(r.UpstreamSOCKS); err != nil {
+			return fmt.Errorf("--upstream-socks %q: %w", r.UpstreamSOCKS, err)
+		}
+		if r.AllowUDP {
+			// UDP sessions cannot go through the proxy, so they would
+			// reach destinations the operator routed away from.
+			return errors.New("--allow-udp cannot be combined with --upstream-socks: UDP sessions do not use the proxy")
+		}
+	}
+	var chainTo string
+	if chainEndpoint != "" {
+		chainTo = chainEndpoint + "/" + r.ChainHyco
+	}
 
-	logger := newLogger(globals.LogLevel)
+	logger := newLogger(globals.LogLevel, globals.LogFormat)
 	warnInsecureTLS(opts, logger)
+	warnKeyFile(r.AuthFlags, logger)
+	if err := checkCloud(r.AuthFlags, endpoint, providerName, logger); err != nil {
+		return err
+	}
+	printConfig(globals, logger, "relay-listener", listenerSnapshot{
+		relaySnapshot:    newRelaySnapshot(globals, endpoint, strings.Join(hycos, ","), opts, tp, providerName),
+		AllowList:        r.Allow,
+		AllowFile:        r.AllowFile,
+		DenyList:         r.Deny,
+		DenyFile:         r.DenyFile,
+		TargetMap:        targetMap,
+		MapFile:          r.MapFile,
+		AllowResolve:     r.AllowResolve,
+		MaxConnections:   r.MaxConnections,
+		AcceptOverflow:   r.AcceptOverflow,
+		QueueTimeout:     r.QueueTimeout,
+		AcceptWorkers:    r.AcceptWorkers,
+		ListenBacklog:    r.ListenBacklog,
+		ConnectTimeout:   r.ConnectTimeout,
+		TCPKeepAlive:     r.TCPKeepAlive,
+		PipelineIdle:     r.PipelineIdle,
+		MetadataLimits:   r.metadataLimits(),
+		Echo:             r.Echo,
+		AllowBind:        r.AllowBind,
+		AllowUDP:         r.AllowUDP,
+		AllowMux:         r.AllowMux,
+		ProbeTarget:      r.ProbeTarget,
+		ProxyProtocol:    r.ProxyProtocol,
+		DialRetries:      r.DialRetries,
+		DialBackoff:      r.DialBackoff,
+		DialSource:       dialSource,
+		DialFamily:       r.DialFamily,
+		UpstreamSOCKS:    r.UpstreamSOCKS,
+		ChainTo:          chainTo,
+		IdleReconnect:    r.IdleReconnect,
+		MaxMessageSize:   r.MaxMessageSize,
+		PingInterval:     r.PingInterval,
+		RenewInterval:    r.RenewInterval,
+		MinThroughput:    r.minThroughput(),
+		BufferSize:       bufferSize,
+		IdleTimeout:      r.IdleTimeout,
+		RateLimit:        r.RateLimit,
+		DataPingInterval: r.DataPingInterval,
+	})
 
 	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
 	defer stop()
+	defer notifySASReload(ctx, tp, keyFilePath(r.AuthFlags), logger)()
 
-	m, err := resolveMetrics(ctx, globals.MetricsAddr, globals.MetricsMaxTargets, logger)
+	m, err := resolveMetrics(ctx, globals, logger)
+	if err != nil {
+		return err
+	}
+	tracer, err := resolveTracer(globals, logger)
+	if err != nil {
+		return err
+	}
+	readiness, err := resolveHealth(ctx, globals.HealthAddr, logger)
 	if err != nil {
 		return err
 	}
 
 	cfg := listener.Config{
 		Endpoint:       endpoint,
-		EntityPath:     hyco,
 		TokenProvider:  observeTokenFetch(tp, m, providerName),
 		ClientOptions:  opts,
 		AllowList:      r.Allow,
+		AllowFile:      r.AllowFile,
+		DenyList:       r.Deny,
+		DenyFile:       r.DenyFile,
+		TargetMap:      targetMap,
+		MapFile:        r.MapFile,
+		AllowResolve:   r.AllowResolve,
 		MaxConnections: r.MaxConnections,
+		AcceptOverflow: r.AcceptOverflow,
+		AcceptWorkers:  r.AcceptWorkers,
+		AcceptBacklog:  r.ListenBacklog,
 		ConnectTimeout: r.ConnectTimeout,
 		TCPKeepAlive:   r.TCPKeepAlive,
+		MetadataLimits: r.metadataLimits(),
 		Logger:         logger,
 		Metrics:        m,
+		Tracer:         tracer,
+		Readiness:      readiness,
+		OnReady:        sdNotifyReady(logger),
+		Echo:           r.Echo,
+		AllowBind:      r.AllowBind,
+		AllowUDP:       r.AllowUDP,
+		AllowMux:       r.AllowMux,
+		ProbeTarget:    r.ProbeTarget,
+		ProxyProtocol:  r.ProxyProtocol,
+		Resolver:       opts.Resolver,
+
+		AcceptQueueTimeout:   r.QueueTimeout,
+		PipelineIdleTimeout:  r.PipelineIdle,
+		TargetDialRetries:    r.DialRetries,
+		TargetDialBackoff:    r.DialBackoff,
+		DialSource:           dialSource,
+		DialFamily:           r.DialFamily,
+		UpstreamSOCKS:        r.UpstreamSOCKS,
+		ControlIdleReconnect: r.IdleReconnect,
+		MaxMessageSize:       r.MaxMessageSize,
+		PingInterval:         r.PingInterval,
+		RenewInterval:        r.RenewInterval,
+		MinThroughput:        r.minThroughput(),
+		BufferSize:           bufferSize,
+		IdleTimeout:          r.IdleTimeout,
+		RateLimit:            r.RateLimit,
+		DataPingInterval:     dataPingInterval,
+	}
+	if globals.Config != "" {
+		cfg.Reload = reloadLimits(os.Args[1:])
 	}
 
-	return listener.ListenAndServe(ctx, cfg)
+	if chainEndpoint != "" {
+		cfg.Upstream = &listener.Upstream{
+			Endpoint:      chainEndpoint,
+			EntityPath:    r.ChainHyco,
+			TokenProvider: cfg.TokenProvider,
+			ClientOptions: opts,
+		}
+	}
+
+	go sdWatchdog(ctx, sdWatchdogInterval(), logger)
+	return listener.MultiListen(ctx, cfg, hycos)
+}
+
+// reloadLimits returns the listener's Config.Reload under --config. It
+// parses args, the command line the process started with, into a fresh
+// cli so the edited file is read again with the usual flag > env >
+// file > default precedence, and returns the limits that yields.
+func reloadLimits(args []string) func() (listener.Limits, error) {
+	return func() (listener.Limits, error) {
+		var fresh cli
+		parser, err := kong.New(&fresh, kong.Name("aztunnel"), kong.Configuration(loadConfigFile))
+		if err != nil {
+			return listener.Limits{}, err
+		}
+		if _, err := parser.Parse(args); err != nil {
+			return listener.Limits{}, fmt.Errorf("re-read config file: %w", err)
+		}
+		r := fresh.RelayListener
+		return listener.Limits{
+			MaxConnections: r.MaxConnections,
+			ConnectTimeout: r.ConnectTimeout,
+			TCPKeepAlive:   r.TCPKeepAlive,
+		}, nil
+	}
+}
+
+// chainEndpoint returns the relay endpoint from --chain-relay, or ""
+// when chaining is off. The upstream namespace uses the same suffix and
+// credentials as --relay.
+func (r *RelayListenerCmd) chainEndpoint() (string, error) {
+	if r.ChainRelay == "" && r.ChainHyco == "" {
+		return "", nil
+	}
+	if r.ChainRelay == "" || r.ChainHyco == "" {
+		return "", fmt.Errorf("--chain-relay and --chain-hyco must be set together")
+	}
+	endpoint := relay.ParseRelay(r.ChainRelay, relaySuffix(r.AuthFlags))
+	if endpoint == "" {
+		return "", fmt.Errorf("invalid --chain-relay endpoint: %q", r.ChainRelay)
+	}
+	return endpoint, nil
+}
+
+// targetMap returns the alias table from --map, or nil when none is
+// given.
+func (r *RelayListenerCmd) targetMap() (map[string]string, error) {
+	if len(r.Map) == 0 {
+		return nil, nil
+	}
+	m := make(map[string]string, len(r.Map))
+	for _, s := range r.Map {
+		alias, target, err := listener.ParseMapping(s)
+		if err != nil {
+			return nil, fmt.Errorf("--map: %w", err)
+		}
+		if _, dup := m[alias]; dup {
+			return nil, fmt.Errorf("--map: alias %q given more than once", alias)
+		}
+		m[alias] = target
+	}
+	return m, nil
+}
+
+// metadataLimits returns the envelope metadata limits from the flags,
+// with unset values filled from protocol.DefaultMetadataLimits.
+func (r *RelayListenerCmd) metadataLimits() protocol.MetadataLimits {
+	return protocol.MetadataLimits{
+		MaxEntries:   r.MaxMetaEntries,
+		MaxTotalSize: r.MaxMetaSize,
+	}.WithDefaults()
+}
+
+// minThroughput returns the stall-detector settings from the flags.
+func (r *RelayListenerCmd) minThroughput() relay.MinThroughput {
+	return relay.MinThroughput{BytesPerSec: r.MinThroughput, Window: r.ThroughputWin}
+}
+
+// resolveDialSource turns --dial-source into the address target dials
+// bind to: an IP as given, or the single address of the named
+// interface. Link-local IPv6 addresses are ignored, since nearly every
+// interface has one; an interface left with more than one address is
+// ambiguous and must be given by IP instead.
+func resolveDialSource(s string) (netip.Addr, error) {
+	if s == "" {
+		return netip.Addr{}, nil
+	}
+	if ip, err := netip.ParseAddr(s); err == nil {
+		return ip.Unmap(), nil
+	}
+	ifi, err := net.InterfaceByName(s)
+	if err != nil {
+		return netip.Addr{}, fmt.Errorf("--dial-source %q is neither an IP nor an interface: %w", s, err)
+	}
+	addrs, err := ifi.Addrs()
+	if err != nil {
+		return netip.Addr{}, fmt.Errorf("--dial-source %q: %w", s, err)
+	}
+	return interfaceSource(s, addrs)
+}
+
+// interfaceSource picks the dial source from interface name's addrs.
+func interfaceSource(name string, addrs []net.Addr) (netip.Addr, error) {
+	var found []netip.Addr
+	for _, a := range addrs {
+		ipnet, ok := a.(*net.IPNet)
+		if !ok {
+			continue
+		}
+		ip, ok := netip.AddrFromSlice(ipnet.IP)
+		if !ok {
+			continue
+		}
+		ip = ip.Unmap()
+		if ip.Is6() && ip.IsLinkLocalUnicast() {
+			continue
+		}
+		found = append(found, ip)
+	}
+	switch len(found) {
+	case 0:
+		return netip.Addr{}, fmt.Errorf("--dial-source: interface %s has no usable address", name)
+	case 1:
+		return found[0], nil
+	}
+	return netip.Addr{}, fmt.Errorf("--dial-source: interface %s has several addresses (%v); give one as an IP", name, found)
 }
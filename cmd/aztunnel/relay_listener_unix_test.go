@@ -0,0 +1,149 @@
+//go:build unix
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/alecthomas/kong"
+	"github.com/coder/websocket"
+)
+
+// TestRelayListener_SIGHUPReloadsConfigLimits runs relay-listener with
+// --config against a fake relay, then edits max-connections in the file
+// and delivers SIGHUP: accepts beyond the old limit are dropped before
+// the reload and served after it, up to the new limit.
+func TestRelayListener_SIGHUPReloadsConfigLimits(t *testing.T) {
+	for _, env := range configEnv {
+		t.Setenv(env, "")
+	}
+	t.Setenv("AZTUNNEL_KEY_NAME", "k")
+	t.Setenv("AZTUNNEL_KEY", "dGVzdGtleQ==")
+
+	// Keep SIGHUP and SIGINT from reaching their default actions
+	// should one arrive before or after the listener's own handlers.
+	guard := make(chan os.Signal, 2)
+	signal.Notify(guard, syscall.SIGHUP, os.Interrupt)
+	defer signal.Stop(guard)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+
+	// Each rendezvous the listener dials holds one connection slot
+	// until the listener gives up waiting for the envelope.
+	dials := make(chan struct{}, 16)
+	rendezvous := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ws, err := websocket.Accept(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer ws.CloseNow()
+		dials <- struct{}{}
+		_, _, _ = ws.Read(ctx)
+	}))
+	defer rendezvous.Close()
+
+	accepts := make(chan string)
+	control := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ws, err := websocket.Accept(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer ws.CloseNow()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case id := <-accepts:
+				data, _ := json.Marshal(map[string]any{
+					"accept": map[string]any{"address": "wss" + strings.TrimPrefix(rendezvous.URL, "https"), "id": id},
+				})
+				if ws.Write(ctx, websocket.MessageText, data) != nil {
+					return
+				}
+			}
+		}
+	}))
+	defer control.Close()
+
+	path := filepath.Join(t.TempDir(), "listener.yaml")
+	if err := os.WriteFile(path, []byte("max-connections: 1\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	args := []string{"aztunnel", "--config", path, "relay-listener",
+		"--relay", "wss" + strings.TrimPrefix(control.URL, "https"), "--hyco", "test-hc",
+		"--relay-insecure-tls", "--allow", "127.0.0.1:1"}
+	oldArgs := os.Args
+	os.Args = args
+	defer func() { os.Args = oldArgs }()
+
+	var c cli
+	parser, err := kong.New(&c, kong.Configuration(loadConfigFile))
+	if err != nil {
+		t.Fatalf("kong.New: %v", err)
+	}
+	if _, err := parser.Parse(args[1:]); err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+	done := make(chan error, 1)
+	go func() { done <- c.RelayListener.Run(&c.Globals) }()
+	defer func() {
+		_ = syscall.Kill(os.Getpid(), syscall.SIGINT)
+		select {
+		case <-done:
+		case <-time.After(10 * time.Second):
+			t.Error("relay-listener did not stop on SIGINT")
+		}
+	}()
+
+	n := 0
+	// accept offers one rendezvous and reports whether the listener
+	// dialed it within wait.
+	accept := func(wait time.Duration) bool {
+		n++
+		select {
+		case accepts <- fmt.Sprintf("conn-%d", n):
+		case <-ctx.Done():
+			t.Fatal("control channel never connected")
+		}
+		select {
+		case <-dials:
+			return true
+		case <-time.After(wait):
+			return false
+		}
+	}
+
+	if !accept(5 * time.Second) {
+		t.Fatal("first accept was not served")
+	}
+	if accept(300 * time.Millisecond) {
+		t.Fatal("second accept was served with max-connections: 1")
+	}
+
+	if err := os.WriteFile(path, []byte("max-connections: 2\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := syscall.Kill(os.Getpid(), syscall.SIGHUP); err != nil {
+		t.Fatal(err)
+	}
+	for !accept(100 * time.Millisecond) {
+		if ctx.Err() != nil {
+			t.Fatal("max-connections never rose to 2 after SIGHUP")
+		}
+	}
+	if accept(300 * time.Millisecond) {
+		t.Error("third accept was served with max-connections: 2")
+	}
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+
+	"github.com/philsphicas/aztunnel/internal/relay"
+)
+
+// sasCredentials reads the SAS key name from AZTUNNEL_KEY_NAME and the
+// key from AZTUNNEL_KEY or, for keys that should not sit in the
+// environment, from keyFile (see parseKeyFile). Setting both key
+// sources is an error. Empty results mean SAS is not configured.
+// Errors never include the key.
+func sasCredentials(keyFile string) (keyName, key string, err error) {
+	keyName = os.Getenv("AZTUNNEL_KEY_NAME")
+	key = os.Getenv("AZTUNNEL_KEY")
+	if keyFile == "" {
+		return keyName, key, nil
+	}
+	if key != "" {
+		return "", "", errors.New("set only one of AZTUNNEL_KEY and --key-file (AZTUNNEL_KEY_FILE)")
+	}
+	data, err := os.ReadFile(keyFile) //nolint:gosec // operator-supplied key path
+	if err != nil {
+		return "", "", fmt.Errorf("read key file: %w", err)
+	}
+	fileName, key, err := parseKeyFile(data)
+	if err != nil {
+		return "", "", fmt.Errorf("key file %s: %w", keyFile, err)
+	}
+	if fileName != "" {
+		keyName = fileName
+	}
+	return keyName, key, nil
+}
+
+// keyFilePath returns --key-file, falling back to AZTUNNEL_KEY_FILE.
+func keyFilePath(af AuthFlags) string {
+	if af.KeyFile != "" {
+		return af.KeyFile
+	}
+	return os.Getenv("AZTUNNEL_KEY_FILE")
+}
+
+// parseKeyFile accepts three layouts: a JSON object with "keyName" and
+// "key"; keyName=... and key=... lines (blank lines and # comments
+// skipped); or, as before key names could live in the file, the bare
+// key. keyName is optional in the first two and empty in the third.
+// Errors never include the key.
+func parseKeyFile(data []byte) (keyName, key string, err error) {
+	text := strings.TrimSpace(string(data))
+	switch {
+	case text == "":
+		return "", "", errors.New("empty")
+	case strings.HasPrefix(text, "{"):
+		var v struct {
+			KeyName string `json:"keyName"`
+			Key     string `json:"key"`
+		}
+		// The decode error may quote file content, so it is dropped.
+		if json.Unmarshal([]byte(text), &v) != nil {
+			return "", "", errors.New("invalid JSON")
+		}
+		keyName, key = v.KeyName, v.Key
+	case strings.HasPrefix(text, "key=") || strings.HasPrefix(text, "keyName=") || strings.HasPrefix(text, "#"):
+		for n, line := range strings.Split(text, "\n") {
+			line = strings.TrimSpace(line)
+			if line == "" || strings.HasPrefix(line, "#") {
+				continue
+			}
+			name, value, _ := strings.Cut(line, "=")
+			switch strings.TrimSpace(name) {
+			case "keyName":
+				keyName = strings.TrimSpace(value)
+			case "key":
+				key = strings.TrimSpace(value)
+			default:
+				return "", "", fmt.Errorf("line %d: want keyName=... or key=...", n+1)
+			}
+		}
+	default:
+		return "", text, nil
+	}
+	if key == "" {
+		return "", "", errors.New("no key")
+	}
+	return keyName, key, nil
+}
+
+// warnKeyFile warns when the SAS key file is readable by every user on
+// the host. Call this from each cmd after resolveAuth, like
+// warnInsecureTLS.
+func warnKeyFile(af AuthFlags, logger *slog.Logger) {
+	path := keyFilePath(af)
+	if path == "" {
+		return
+	}
+	if fi, err := os.Stat(path); err == nil && fi.Mode().Perm()&0o004 != 0 {
+		logger.Warn("sas key file is world-readable; restrict it with chmod 600", "path", path, "mode", fi.Mode().Perm())
+	}
+}
+
+// reloadSAS re-reads the SAS credentials from the environment and
+// keyFile and installs them on sas. A failed read, or a key that is
+// not valid base64, keeps the current key.
+func reloadSAS(sas *relay.SASTokenProvider, keyFile string, logger *slog.Logger) {
+	keyName, key, err := sasCredentials(keyFile)
+	if err == nil {
+		err = relay.ValidateSASKey(key)
+	}
+	if err == nil {
+		err = sas.SetKey(keyName, key)
+	}
+	if err != nil {
+		logger.Warn("sas key reload failed, keeping current key", "error", err)
+		return
+	}
+	logger.Info("sas key reloaded", "sas_key_name", keyName)
+}
+
+// watchSASReload calls reloadSAS for every value received on sig until
+// ctx is done. Split from notifySASReload so tests can drive it
+// without delivering real signals to the test process.
+func watchSASReload(ctx context.Context, sas *relay.SASTokenProvider, keyFile string, logger *slog.Logger, sig <-chan os.Signal) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-sig:
+			reloadSAS(sas, keyFile, logger)
+		}
+	}
+}
+
+// notifySASReload re-reads the SAS credentials on SIGHUP when tp is a
+// SAS provider, so a rotated key (typically a rewritten keyFile) is
+// used by the next dial or token renew without a restart. For any
+// other provider it does nothing. The returned stop function
+// unregisters the signal handler.
+func notifySASReload(ctx context.Context, tp relay.TokenProvider, keyFile string, logger *slog.Logger) (stop func()) {
+	sas, ok := tp.(*relay.SASTokenProvider)
+	if !ok {
+		return func() {}
+	}
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGHUP)
+	ctx, cancel := context.WithCancel(ctx)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		watchSASReload(ctx, sas, keyFile, logger, sig)
+	}()
+	return func() {
+		signal.Stop(sig)
+		cancel()
+		<-done
+	}
+}
@@ -0,0 +1,247 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/philsphicas/aztunnel/internal/relay"
+)
+
+// TestSASReload_UsesRotatedKeyFile starts with a key file, rewrites it
+// as an operator would after rotating the key, delivers SIGHUP to the
+// watcher, and checks the provider then signs with the new key.
+func TestSASReload_UsesRotatedKeyFile(t *testing.T) {
+	keyFile := filepath.Join(t.TempDir(), "sas.key")
+	if err := os.WriteFile(keyFile, []byte("b2xkLWtleQ==\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("AZTUNNEL_RELAY_NAME", "myns")
+	t.Setenv("AZTUNNEL_KEY_NAME", "listen-rule")
+	t.Setenv("AZTUNNEL_KEY", "")
+	t.Setenv("AZTUNNEL_KEY_FILE", keyFile)
+
+	_, _, tp, _, err := resolveAuth(AuthFlags{})
+	if err != nil {
+		t.Fatalf("resolveAuth: %v", err)
+	}
+	sas, ok := tp.(*relay.SASTokenProvider)
+	if !ok {
+		t.Fatalf("expected *relay.SASTokenProvider, got %T", tp)
+	}
+	if _, key := sas.Credentials(); key != "b2xkLWtleQ==" {
+		t.Fatalf("initial key = %q, want the old key", key)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	sig := make(chan os.Signal, 1)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		watchSASReload(ctx, sas, keyFile, slog.New(slog.NewTextHandler(io.Discard, nil)), sig)
+	}()
+	defer func() { cancel(); <-done }()
+
+	if err := os.WriteFile(keyFile, []byte("bmV3LWtleQ==\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	sig <- syscall.SIGHUP
+
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		if _, key := sas.Credentials(); key == "bmV3LWtleQ==" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("provider never picked up the rotated key")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	const resURI = "https://myns.servicebus.windows.net/my-hyco"
+	token, err := sas.GetToken(context.Background(), resURI)
+	if err != nil {
+		t.Fatalf("GetToken: %v", err)
+	}
+	if !sasSignedWith(t, token, resURI, "bmV3LWtleQ==") {
+		t.Errorf("token not signed with the rotated key: %s", token)
+	}
+}
+
+// sasSignedWith reports whether token's signature is an HMAC-SHA256 of
+// its resource and expiry under key.
+func sasSignedWith(t *testing.T, token, resURI, key string) bool {
+	t.Helper()
+	q, err := url.ParseQuery(strings.TrimPrefix(token, "SharedAccessSignature "))
+	if err != nil {
+		t.Fatalf("parse token: %v", err)
+	}
+	mac := hmac.New(sha256.New, []byte(key))
+	fmt.Fprintf(mac, "%s\n%s", url.QueryEscape(strings.ToLower(resURI)), q.Get("se"))
+	return q.Get("sig") == base64.StdEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func TestSASReload_FailedReadKeepsKey(t *testing.T) {
+	t.Setenv("AZTUNNEL_KEY_NAME", "listen-rule")
+	t.Setenv("AZTUNNEL_KEY", "")
+
+	sas := &relay.SASTokenProvider{KeyName: "listen-rule", Key: "current-key"}
+	reloadSAS(sas, filepath.Join(t.TempDir(), "missing.key"), slog.New(slog.NewTextHandler(io.Discard, nil)))
+	if _, key := sas.Credentials(); key != "current-key" {
+		t.Errorf("key after failed reload = %q, want current-key", key)
+	}
+}
+
+func TestSASReload_MalformedKeyKeepsKey(t *testing.T) {
+	keyFile := filepath.Join(t.TempDir(), "sas.key")
+	if err := os.WriteFile(keyFile, []byte("not-base64-secret\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("AZTUNNEL_KEY_NAME", "listen-rule")
+	t.Setenv("AZTUNNEL_KEY", "")
+
+	var buf strings.Builder
+	sas := &relay.SASTokenProvider{KeyName: "listen-rule", Key: "Y3VycmVudC1rZXk="}
+	reloadSAS(sas, keyFile, slog.New(slog.NewTextHandler(&buf, nil)))
+	if _, key := sas.Credentials(); key != "Y3VycmVudC1rZXk=" {
+		t.Errorf("key after malformed reload = %q, want the current key", key)
+	}
+	if strings.Contains(buf.String(), "not-base64-secret") {
+		t.Errorf("reload log leaked the key: %s", buf.String())
+	}
+}
+
+func TestSASCredentials_KeyFile(t *testing.T) {
+	dir := t.TempDir()
+	empty := filepath.Join(dir, "empty.key")
+	if err := os.WriteFile(empty, []byte("\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("both_sources", func(t *testing.T) {
+		t.Setenv("AZTUNNEL_KEY_NAME", "rule")
+		t.Setenv("AZTUNNEL_KEY", "secret-inline-key")
+		_, _, err := sasCredentials(empty)
+		if err == nil {
+			t.Fatal("expected an error with both AZTUNNEL_KEY and a key file set")
+		}
+		if strings.Contains(err.Error(), "secret-inline-key") {
+			t.Errorf("error leaked the key: %v", err)
+		}
+	})
+
+	t.Run("empty_file", func(t *testing.T) {
+		t.Setenv("AZTUNNEL_KEY_NAME", "rule")
+		t.Setenv("AZTUNNEL_KEY", "")
+		if _, _, err := sasCredentials(empty); err == nil {
+			t.Fatal("expected an error for an empty key file")
+		}
+	})
+}
+
+func TestParseKeyFile(t *testing.T) {
+	for _, tc := range []struct {
+		name, data   string
+		keyName, key string
+	}{
+		{"bare", "c2VjcmV0LWtleQ==\n", "", "c2VjcmV0LWtleQ=="},
+		{"lines", "# rotated monthly\nkeyName=send-rule\nkey=c2VjcmV0LWtleQ==\n", "send-rule", "c2VjcmV0LWtleQ=="},
+		{"lines_key_only", "key=c2VjcmV0LWtleQ==", "", "c2VjcmV0LWtleQ=="},
+		{"json", `{"keyName": "send-rule", "key": "c2VjcmV0LWtleQ=="}`, "send-rule", "c2VjcmV0LWtleQ=="},
+	} {
+		keyName, key, err := parseKeyFile([]byte(tc.data))
+		if err != nil || keyName != tc.keyName || key != tc.key {
+			t.Errorf("%s: got (%q, %q, %v), want (%q, %q, nil)", tc.name, keyName, key, err, tc.keyName, tc.key)
+		}
+	}
+
+	for _, tc := range []struct{ name, data string }{
+		{"empty", " \n"},
+		{"lines_no_key", "keyName=send-rule\n"},
+		{"lines_unknown", "keyName=send-rule\npassword=secret-file-key\n"},
+		{"json_no_key", `{"keyName": "send-rule"}`},
+		{"json_invalid", `{"key": "secret-file-key"`},
+	} {
+		_, _, err := parseKeyFile([]byte(tc.data))
+		if err == nil {
+			t.Errorf("%s: expected an error", tc.name)
+			continue
+		}
+		if strings.Contains(err.Error(), "secret-file-key") {
+			t.Errorf("%s: error leaked the key: %v", tc.name, err)
+		}
+	}
+}
+
+func TestResolveAuth_KeyFileFlag(t *testing.T) {
+	dir := t.TempDir()
+	flagFile := filepath.Join(dir, "flag.key")
+	if err := os.WriteFile(flagFile, []byte("keyName=flag-rule\nkey=ZmxhZy1rZXk=\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	envFile := filepath.Join(dir, "env.key")
+	if err := os.WriteFile(envFile, []byte("env-key\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("AZTUNNEL_RELAY_NAME", "myns")
+	t.Setenv("AZTUNNEL_KEY_NAME", "env-rule")
+	t.Setenv("AZTUNNEL_KEY", "")
+	t.Setenv("AZTUNNEL_KEY_FILE", envFile)
+
+	_, _, tp, providerName, err := resolveAuth(AuthFlags{KeyFile: flagFile})
+	if err != nil {
+		t.Fatalf("resolveAuth: %v", err)
+	}
+	sas, ok := tp.(*relay.SASTokenProvider)
+	if !ok || providerName != relay.ProviderSAS {
+		t.Fatalf("got %T (%s), want SAS provider", tp, providerName)
+	}
+	if keyName, key := sas.Credentials(); keyName != "flag-rule" || key != "ZmxhZy1rZXk=" {
+		t.Errorf("credentials = (%q, %q), want the --key-file's", keyName, key)
+	}
+
+	t.Setenv("AZTUNNEL_KEY_NAME", "")
+	if _, _, _, _, err := resolveAuth(AuthFlags{}); err == nil {
+		t.Error("expected an error for a key file without a key name")
+	} else if strings.Contains(err.Error(), "env-key") {
+		t.Errorf("error leaked the key: %v", err)
+	}
+}
+
+func TestWarnKeyFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "sas.key")
+	if err := os.WriteFile(path, []byte("secret-file-key\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("AZTUNNEL_KEY_FILE", "")
+
+	var buf strings.Builder
+	logger := slog.New(slog.NewTextHandler(&buf, nil))
+	warnKeyFile(AuthFlags{KeyFile: path}, logger)
+	if buf.Len() != 0 {
+		t.Errorf("unexpected warning for a 0600 key file: %s", buf.String())
+	}
+
+	if err := os.Chmod(path, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	warnKeyFile(AuthFlags{KeyFile: path}, logger)
+	if !strings.Contains(buf.String(), "world-readable") {
+		t.Errorf("expected a world-readable warning, got: %s", buf.String())
+	}
+	if strings.Contains(buf.String(), "secret-file-key") {
+		t.Errorf("warning leaked the key: %s", buf.String())
+	}
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// sdNotify sends state (e.g. "READY=1") to the service manager over
+// $NOTIFY_SOCKET, as sd_notify(3) does. It does nothing and returns
+// nil when $NOTIFY_SOCKET is unset, so aztunnel behaves the same
+// outside systemd. A leading '@' names a socket in the abstract
+// namespace.
+func sdNotify(state string) error {
+	path := os.Getenv("NOTIFY_SOCKET")
+	if path == "" {
+		return nil
+	}
+	if path[0] == '@' {
+		path = "\x00" + path[1:]
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		return fmt.Errorf("sd_notify: %w", err)
+	}
+	defer conn.Close() //nolint:errcheck // best-effort cleanup
+	if _, err := conn.Write([]byte(state)); err != nil {
+		return fmt.Errorf("sd_notify: %w", err)
+	}
+	return nil
+}
+
+// sdNotifyReady returns a listener OnReady hook that tells systemd the
+// service is up (READY=1) the first time the control channel connects.
+// Later reconnects are not re-announced.
+func sdNotifyReady(logger *slog.Logger) func() {
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			if err := sdNotify("READY=1"); err != nil {
+				logger.Warn("systemd ready notification failed", "error", err)
+			}
+		})
+	}
+}
+
+// sdWatchdogInterval returns how often to send WATCHDOG=1: half of
+// $WATCHDOG_USEC, as sd_watchdog_enabled(3) recommends. It returns 0
+// when the watchdog is off or $WATCHDOG_PID names another process.
+func sdWatchdogInterval() time.Duration {
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return 0
+	}
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return 0
+	}
+	return time.Duration(usec) * time.Microsecond / 2
+}
+
+// sdWatchdog sends WATCHDOG=1 every interval until ctx is done. It
+// returns at once when interval is 0 or $NOTIFY_SOCKET is unset.
+func sdWatchdog(ctx context.Context, interval time.Duration, logger *slog.Logger) {
+	if interval <= 0 || os.Getenv("NOTIFY_SOCKET") == "" {
+		return
+	}
+	logger.Debug("systemd watchdog enabled", "interval", interval)
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			if err := sdNotify("WATCHDOG=1"); err != nil {
+				logger.Warn("systemd watchdog ping failed", "error", err)
+			}
+		}
+	}
+}
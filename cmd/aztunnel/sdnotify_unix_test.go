@@ -0,0 +1,108 @@
+//go:build unix
+
+package main
+
+import (
+	"context"
+	"log/slog"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// notifySocket listens on a datagram socket, points $NOTIFY_SOCKET at
+// it, and returns it for the test to read.
+func notifySocket(t *testing.T) *net.UnixConn {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "notify.sock")
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	t.Cleanup(func() { _ = conn.Close() })
+	t.Setenv("NOTIFY_SOCKET", path)
+	return conn
+}
+
+// readNotify returns the next datagram on conn.
+func readNotify(t *testing.T, conn *net.UnixConn) string {
+	t.Helper()
+	_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, 256)
+	n, err := conn.Read(buf)
+	if err != nil {
+		t.Fatalf("read notification: %v", err)
+	}
+	return string(buf[:n])
+}
+
+func TestSDNotify_Unset(t *testing.T) {
+	t.Setenv("NOTIFY_SOCKET", "")
+	if err := sdNotify("READY=1"); err != nil {
+		t.Errorf("sdNotify without NOTIFY_SOCKET = %v, want nil", err)
+	}
+}
+
+func TestSDNotify_Missing(t *testing.T) {
+	t.Setenv("NOTIFY_SOCKET", filepath.Join(t.TempDir(), "gone.sock"))
+	if err := sdNotify("READY=1"); err == nil {
+		t.Error("sdNotify to a missing socket succeeded")
+	}
+}
+
+func TestSDNotifyReady_Once(t *testing.T) {
+	conn := notifySocket(t)
+	ready := sdNotifyReady(slog.New(slog.DiscardHandler))
+	ready()
+	ready() // a control channel reconnect
+	if got := readNotify(t, conn); got != "READY=1" {
+		t.Errorf("notification = %q, want READY=1", got)
+	}
+	_ = conn.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	if n, err := conn.Read(make([]byte, 256)); err == nil {
+		t.Errorf("second notification sent (%d bytes), want READY=1 only once", n)
+	}
+}
+
+func TestSDWatchdogInterval(t *testing.T) {
+	for _, tc := range []struct {
+		name, usec, pid string
+		want            time.Duration
+	}{
+		{"off", "", "", 0},
+		{"half", "30000000", "", 15 * time.Second},
+		{"this pid", "2000000", strconv.Itoa(os.Getpid()), time.Second},
+		{"other pid", "2000000", "1", 0},
+		{"garbage", "soon", "", 0},
+	} {
+		t.Setenv("WATCHDOG_USEC", tc.usec)
+		t.Setenv("WATCHDOG_PID", tc.pid)
+		if got := sdWatchdogInterval(); got != tc.want {
+			t.Errorf("%s: interval = %v, want %v", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestSDWatchdog_Pings(t *testing.T) {
+	conn := notifySocket(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		sdWatchdog(ctx, 10*time.Millisecond, slog.New(slog.DiscardHandler))
+	}()
+	for range 2 {
+		if got := readNotify(t, conn); got != "WATCHDOG=1" {
+			t.Errorf("notification = %q, want WATCHDOG=1", got)
+		}
+	}
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("sdWatchdog did not return after cancel")
+	}
+}
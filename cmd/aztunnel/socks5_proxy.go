@@ -1,19 +1,32 @@
 package main
 
 import (
+	"bufio"
 	"context"
+	"errors"
 	"fmt"
 	"net"
 	"os"
 	"os/signal"
+	"strings"
+	"time"
 
 	"github.com/philsphicas/aztunnel/internal/sender"
+	"github.com/philsphicas/aztunnel/internal/sender/socks5"
 )
 
 // Socks5ProxyCmd runs a local SOCKS5 proxy through the relay.
 type Socks5ProxyCmd struct {
 	AuthFlags
 	BindFlags
+	BridgeFlags
+	Allow           []string      `help:"Allowed targets (host:port, *.domain:port, CIDR:port, CIDR:*)."`
+	EnvelopeTimeout time.Duration `name:"envelope-timeout" help:"Give up on a rendezvous the listener has not answered within this long." default:"45s"`
+	DialTimeout     time.Duration `name:"dial-timeout" help:"Retry a failed relay dial for up to this long per connection before replying with a failure." default:"30s"`
+	SocksUser       string        `name:"socks-user" help:"Require SOCKS5 username/password auth with this user (needs --socks-pass)."`
+	SocksPass       string        `name:"socks-pass" help:"Password for --socks-user."`
+	SocksAuthFile   string        `name:"socks-auth-file" help:"Require SOCKS5 username/password auth against user:password lines in this file."`
+	Compress        bool          `help:"Offer permessage-deflate compression on the relay WebSocket and ask the listener to do the same."`
 }
 
 // Run executes the socks5-proxy command.
@@ -27,37 +40,136 @@ func (s *Socks5ProxyCmd) Run(globals *Globals) error {
 	if err != nil {
 		return err
 	}
+	opts.Compression = s.Compress
 
-	bind := s.Bind
-	if s.Gateway {
-		_, port, err := net.SplitHostPort(bind)
-		if err != nil {
-			return fmt.Errorf("invalid --bind address %q: %w", bind, err)
-		}
-		if port == "" {
-			port = "0"
-		}
-		bind = "0.0.0.0:" + port
+	bind, err := s.resolve()
+	if err != nil {
+		return err
+	}
+	auth, err := s.socksAuth()
+	if err != nil {
+		return err
+	}
+	bufferSize, err := s.bufferSize()
+	if err != nil {
+		return err
+	}
+	dataPingInterval, err := s.dataPingInterval()
+	if err != nil {
+		return err
 	}
-	logger := newLogger(globals.LogLevel)
+	logger := newLogger(globals.LogLevel, globals.LogFormat)
 	warnInsecureTLS(opts, logger)
+	warnKeyFile(s.AuthFlags, logger)
+	if err := checkCloud(s.AuthFlags, endpoint, providerName, logger); err != nil {
+		return err
+	}
+	printConfig(globals, logger, "relay-sender socks5-proxy", senderSnapshot{
+		relaySnapshot:    newRelaySnapshot(globals, endpoint, hyco, opts, tp, providerName),
+		Bind:             bind,
+		TCPKeepAlive:     s.TCPKeepAlive,
+		EnvelopeTimeout:  s.EnvelopeTimeout,
+		DialTimeout:      s.DialTimeout,
+		BufferSize:       bufferSize,
+		IdleTimeout:      s.IdleTimeout,
+		RateLimit:        s.RateLimit,
+		DataPingInterval: s.DataPingInterval,
+		Compress:         s.Compress,
+		SOCKSAuth:        auth != nil,
+	})
 
 	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
 	defer stop()
+	defer notifySASReload(ctx, tp, keyFilePath(s.AuthFlags), logger)()
 
 	cfg := sender.SOCKS5Config{
-		Endpoint:      endpoint,
-		EntityPath:    hyco,
-		TokenProvider: tp,
-		ClientOptions: opts,
-		BindAddress:   bind,
-		TCPKeepAlive:  s.TCPKeepAlive,
-		Logger:        logger,
+		Endpoint:         endpoint,
+		EntityPath:       hyco,
+		TokenProvider:    tp,
+		ClientOptions:    opts,
+		BindAddress:      bind,
+		Network:          s.LocalFamily,
+		TCPKeepAlive:     s.TCPKeepAlive,
+		AllowList:        s.Allow,
+		Logger:           logger,
+		EnvelopeTimeout:  s.EnvelopeTimeout,
+		DialBudget:       s.DialTimeout,
+		Auth:             auth,
+		BufferSize:       bufferSize,
+		IdleTimeout:      s.IdleTimeout,
+		RateLimit:        s.RateLimit,
+		DataPingInterval: dataPingInterval,
 	}
-	if cfg.Metrics, err = resolveMetrics(ctx, globals.MetricsAddr, globals.MetricsMaxTargets, logger); err != nil {
+	if cfg.Metrics, err = resolveMetrics(ctx, globals, logger); err != nil {
 		return err
 	}
 	cfg.TokenProvider = observeTokenFetch(tp, cfg.Metrics, providerName)
+	if cfg.Tracer, err = resolveTracer(globals, logger); err != nil {
+		return err
+	}
+	readiness, err := resolveHealth(ctx, globals.HealthAddr, logger)
+	if err != nil {
+		return err
+	}
+	cfg.Ready = func(net.Addr) { readiness.SetReady(true) }
 
 	return sender.SOCKS5Proxy(ctx, cfg)
 }
+
+// socksAuth returns the SOCKS5 credential validator for --socks-user
+// and --socks-pass or --socks-auth-file, or nil when no auth is
+// configured.
+func (s *Socks5ProxyCmd) socksAuth() (socks5.CredentialValidator, error) {
+	switch {
+	case s.SocksAuthFile != "" && (s.SocksUser != "" || s.SocksPass != ""):
+		return nil, errors.New("set either --socks-user/--socks-pass or --socks-auth-file, not both")
+	case s.SocksAuthFile != "":
+		creds, err := readSOCKSAuthFile(s.SocksAuthFile)
+		if err != nil {
+			return nil, err
+		}
+		return socks5.StaticCredentials(creds), nil
+	case s.SocksUser == "" && s.SocksPass == "":
+		return nil, nil
+	case s.SocksUser == "" || s.SocksPass == "":
+		return nil, errors.New("--socks-user and --socks-pass must be set together")
+	case len(s.SocksUser) > 255 || len(s.SocksPass) > 255:
+		return nil, errors.New("--socks-user and --socks-pass are limited to 255 bytes")
+	}
+	return socks5.StaticCredentials(map[string]string{s.SocksUser: s.SocksPass}), nil
+}
+
+// readSOCKSAuthFile parses user:password lines. Blank lines and lines
+// starting with # are skipped; the password is everything after the
+// first colon. Errors never include a password.
+func readSOCKSAuthFile(path string) (map[string]string, error) {
+	f, err := os.Open(path) //nolint:gosec // operator-supplied credentials path
+	if err != nil {
+		return nil, fmt.Errorf("read --socks-auth-file: %w", err)
+	}
+	defer f.Close() //nolint:errcheck // read-only
+
+	creds := make(map[string]string)
+	sc := bufio.NewScanner(f)
+	for n := 1; sc.Scan(); n++ {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		user, pass, ok := strings.Cut(line, ":")
+		switch {
+		case !ok || user == "" || pass == "":
+			return nil, fmt.Errorf("--socks-auth-file %s line %d: want user:password", path, n)
+		case len(user) > 255 || len(pass) > 255:
+			return nil, fmt.Errorf("--socks-auth-file %s line %d: user and password are limited to 255 bytes", path, n)
+		}
+		creds[user] = pass
+	}
+	if err := sc.Err(); err != nil {
+		return nil, fmt.Errorf("read --socks-auth-file: %w", err)
+	}
+	if len(creds) == 0 {
+		return nil, fmt.Errorf("--socks-auth-file %s has no credentials", path)
+	}
+	return creds, nil
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestReadSOCKSAuthFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "socks-auth")
+	content := "# proxy users\nalice:s3cret\n\nbob:pa:ss\n"
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	creds, err := readSOCKSAuthFile(path)
+	if err != nil {
+		t.Fatalf("readSOCKSAuthFile: %v", err)
+	}
+	if len(creds) != 2 || creds["alice"] != "s3cret" || creds["bob"] != "pa:ss" {
+		t.Errorf("creds = %v, want alice and bob (password may contain ':')", creds)
+	}
+}
+
+func TestReadSOCKSAuthFile_Invalid(t *testing.T) {
+	for name, content := range map[string]string{
+		"missing colon":  "alice\n",
+		"empty password": "alice:\n",
+		"only comments":  "# nobody\n",
+	} {
+		t.Run(name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "socks-auth")
+			if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := readSOCKSAuthFile(path); err == nil {
+				t.Errorf("readSOCKSAuthFile(%q) succeeded, want error", content)
+			}
+		})
+	}
+}
+
+func TestSocksAuth(t *testing.T) {
+	none, err := (&Socks5ProxyCmd{}).socksAuth()
+	if err != nil || none != nil {
+		t.Errorf("no flags: validator = %v, err = %v; want nil, nil", none != nil, err)
+	}
+
+	v, err := (&Socks5ProxyCmd{SocksUser: "alice", SocksPass: "s3cret"}).socksAuth()
+	if err != nil {
+		t.Fatalf("user/pass: %v", err)
+	}
+	if !v("alice", "s3cret") || v("alice", "nope") {
+		t.Error("user/pass validator does not check the configured pair")
+	}
+
+	for name, cmd := range map[string]*Socks5ProxyCmd{
+		"user without pass": {SocksUser: "alice"},
+		"pass without user": {SocksPass: "s3cret"},
+		"both sources":      {SocksUser: "alice", SocksPass: "s3cret", SocksAuthFile: "x"},
+		"user too long":     {SocksUser: strings.Repeat("u", 256), SocksPass: "s3cret"},
+	} {
+		if _, err := cmd.socksAuth(); err == nil {
+			t.Errorf("%s: socksAuth succeeded, want error", name)
+		}
+	}
+}
@@ -8,6 +8,7 @@ import (
 	"io"
 	"net"
 	"os/exec"
+	"slices"
 	"sort"
 	"strconv"
 	"strings"
@@ -294,7 +295,11 @@ func (b *azureBackend) Setup(t testing.TB, opts scenarios.SetupOptions) *scenari
 		var logMsg string
 		switch opts.SenderMode {
 		case scenarios.ModePortForward:
-			proc = startPortForwardSender(t, env, auth, opts.Target, senderArgs...)
+			args := senderArgs
+			if opts.HalfClose {
+				args = append(slices.Clone(senderArgs), "--half-close")
+			}
+			proc = startPortForwardSender(t, env, auth, opts.Target, args...)
 			logMsg = "port-forward listening"
 		case scenarios.ModeSOCKS5:
 			proc = startSOCKS5Sender(t, env, auth, senderArgs...)
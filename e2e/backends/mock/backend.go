@@ -539,6 +539,7 @@ func (b *MockBackend) Setup(t testing.TB, opts scenarios.SetupOptions) *scenario
 					Logger:        senderLogger,
 					Metrics:       m,
 					Ready:         ready,
+					HalfClose:     opts.HalfClose,
 				})
 			case scenarios.ModeSOCKS5:
 				err = sender.SOCKS5Proxy(sctx, sender.SOCKS5Config{
@@ -893,6 +894,7 @@ func (b *MockBackend) SetupExpectingFailure(t testing.TB, opts scenarios.SetupOp
 				Logger:        senderLogger,
 				Metrics:       metrics.New(),
 				Ready:         ready,
+				HalfClose:     opts.HalfClose,
 			})
 		case scenarios.ModeSOCKS5:
 			err = sender.SOCKS5Proxy(sctx, sender.SOCKS5Config{
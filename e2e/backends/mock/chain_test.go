@@ -0,0 +1,134 @@
+//go:build e2e
+
+package mock
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/philsphicas/aztunnel/internal/listener"
+	"github.com/philsphicas/aztunnel/internal/metrics"
+	"github.com/philsphicas/aztunnel/internal/relay"
+	"github.com/philsphicas/aztunnel/internal/sender"
+	"github.com/philsphicas/aztunnel/mockrelay/server"
+)
+
+// TestMockChain_RelayToRelay chains two mock relays: a sender on relay
+// A reaches a listener that forwards every connection to relay B, where
+// a second listener dials an echo target. Data must round-trip through
+// both hops, and a target the far listener does not allow must be
+// rejected back to the sender.
+func TestMockChain_RelayToRelay(t *testing.T) {
+	hostA, optsA := startMockRelay(t, server.DelayProfileZero)
+	hostB, optsB := startMockRelay(t, server.DelayProfileZero)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	var wg sync.WaitGroup
+	t.Cleanup(func() { cancel(); wg.Wait() })
+
+	entityA, entityB := mustEntityName(t), mustEntityName(t)
+	silentLogger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	tp := &relay.SASTokenProvider{KeyName: server.DefaultSASKeyName, Key: server.DefaultSASKey}
+
+	echoLn, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen echo: %v", err)
+	}
+	t.Cleanup(func() { _ = echoLn.Close() })
+	go runEchoServerEmul(echoLn)
+
+	startListener := func(cfg listener.Config) *metrics.Metrics {
+		cfg.TokenProvider = tp
+		cfg.Logger = silentLogger
+		cfg.Metrics = metrics.New()
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := listener.ListenAndServe(ctx, cfg); err != nil && ctx.Err() == nil {
+				t.Logf("listener exited: %v", err)
+			}
+		}()
+		if !waitForGauge(cfg.Metrics, "aztunnel_control_channel_connected", 1, 15*time.Second) {
+			t.Fatalf("listener on %s never reported control_channel_connected", cfg.EntityPath)
+		}
+		return cfg.Metrics
+	}
+
+	// Far listener on relay B dials only the echo target.
+	startListener(listener.Config{
+		Endpoint:      hostB,
+		EntityPath:    entityB,
+		ClientOptions: optsB,
+		AllowList:     []string{echoLn.Addr().String()},
+	})
+	// Chaining listener on relay A forwards to relay B.
+	chainMetrics := startListener(listener.Config{
+		Endpoint:       hostA,
+		EntityPath:     entityA,
+		ClientOptions:  optsA,
+		ConnectTimeout: 10 * time.Second,
+		Upstream: &listener.Upstream{
+			Endpoint:      hostB,
+			EntityPath:    entityB,
+			TokenProvider: tp,
+			ClientOptions: optsB,
+		},
+	})
+
+	startSender := func(target string) string {
+		addrCh := make(chan net.Addr, 1)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := sender.PortForward(ctx, sender.PortForwardConfig{
+				Endpoint:      hostA,
+				EntityPath:    entityA,
+				TokenProvider: tp,
+				ClientOptions: optsA,
+				Target:        target,
+				BindAddress:   "127.0.0.1:0",
+				Logger:        silentLogger,
+				Metrics:       metrics.New(),
+				Ready:         func(a net.Addr) { addrCh <- a },
+			})
+			if err != nil && ctx.Err() == nil {
+				t.Logf("sender exited: %v", err)
+			}
+		}()
+		select {
+		case a := <-addrCh:
+			return a.String()
+		case <-time.After(15 * time.Second):
+			t.Fatalf("sender never became ready")
+			return ""
+		}
+	}
+
+	t.Run("echo", func(t *testing.T) {
+		addr := startSender(echoLn.Addr().String())
+		for range 3 {
+			echoRoundTrip(t, addr)
+		}
+		if got := counterReader(chainMetrics, "aztunnel_connections_total")(); got < 1 {
+			t.Errorf("chaining listener completed %d connections, want >= 1", got)
+		}
+	})
+
+	t.Run("rejected by far listener", func(t *testing.T) {
+		addr := startSender("127.0.0.1:1")
+		conn, err := net.DialTimeout("tcp", addr, 10*time.Second)
+		if err != nil {
+			t.Fatalf("dial sender: %v", err)
+		}
+		defer conn.Close() //nolint:errcheck // best-effort cleanup
+		_ = conn.SetDeadline(time.Now().Add(15 * time.Second))
+		if n, err := conn.Read(make([]byte, 1)); err == nil {
+			t.Fatalf("read %d bytes from a target the far listener rejects", n)
+		}
+	})
+}
@@ -321,6 +321,11 @@ type SetupOptions struct {
 	// dominated by the default 30 s wait.
 	ConnectTimeout time.Duration
 
+	// HalfClose turns on half-close for port-forward senders
+	// (`aztunnel relay-sender port-forward --half-close`). Ignored for
+	// other sender modes.
+	HalfClose bool
+
 	// OverrideListenerAuth, if non-nil, replaces the listener's auth
 	// credentials before launch. Used by SetupExpectingFailure to
 	// provoke listener-side auth failures.
@@ -44,6 +44,7 @@ func observabilityCases() []scenarioCase {
 		{name: "Metrics_EndpointShape", scope: AnyBackend, run: ScenarioMetrics_EndpointShape},
 		{name: "Metrics_BothSidesConverge", scope: AnyBackend, run: ScenarioMetrics_BothSidesConverge},
 		{name: "Metrics_DialDuration", scope: AnyBackend, run: ScenarioMetrics_DialDuration},
+		{name: "Metrics_SOCKS5Sessions", scope: AnyBackend, run: ScenarioMetrics_SOCKS5Sessions},
 		{name: "ListenerID_PropagatesAndChangesOnRestart", scope: AnyBackend, run: ScenarioListenerID_PropagatesAndChangesOnRestart},
 		{name: "AcceptID_Saturation", scope: AnyBackend, run: ScenarioAcceptID_Saturation},
 		{name: "TokenFetchMetric", scope: AnyBackend, run: ScenarioTokenFetchMetric},
@@ -716,6 +717,52 @@ func ScenarioMetrics_DialDuration(t *testing.T, b Backend) {
 	t.Errorf("aztunnel_dial_duration_seconds histogram has %d samples after round-trip, want >= 1", got)
 }
 
+// ScenarioMetrics_SOCKS5Sessions: drive three SOCKS5 CONNECT
+// round-trips and assert the sender counts them the same way it
+// counts port-forward connections — aztunnel_connections_total >= 3,
+// aztunnel_active_connections back to 0, and at least one
+// aztunnel_dial_duration_seconds sample. Guards the SOCKS5 path
+// against bypassing InstrumentedDial / TrackedBridge.
+func ScenarioMetrics_SOCKS5Sessions(t *testing.T, b Backend) {
+	t.Helper()
+	AssertNoLeaks(t)
+	srv := StartWorkloadServer(t, ServerBehavior{Mode: ServerProbe, RespSize: defaultProbeBody})
+	tun := b.Setup(t, SetupOptions{
+		NumListeners:   1,
+		SenderMode:     ModeSOCKS5,
+		AllowedTargets: []string{srv.Addr()},
+	})
+
+	for i := 0; i < 3; i++ {
+		conn, err := DialSOCKS5(tun.SenderAddr, srv.Addr(), 15*time.Second)
+		if err != nil {
+			t.Fatalf("SOCKS5 dial %d: %v", i, err)
+		}
+		_ = conn.SetDeadline(time.Now().Add(15 * time.Second))
+		err = probeExchangeOnConn(conn, randNonce(), defaultProbeBody, defaultProbeBody)
+		conn.Close() //nolint:errcheck // best-effort
+		if err != nil {
+			t.Fatalf("round-trip %d: %v", i, err)
+		}
+	}
+
+	s := tun.Senders[0]
+	deadline := time.Now().Add(15 * time.Second)
+	for time.Now().Before(deadline) {
+		dialOK := s.DialDurationSamples == nil || s.DialDurationSamples() >= 1
+		if s.Completed() >= 3 && s.Active() == 0 && dialOK {
+			return
+		}
+		time.Sleep(200 * time.Millisecond)
+	}
+	var samples uint64
+	if s.DialDurationSamples != nil {
+		samples = s.DialDurationSamples()
+	}
+	t.Errorf("SOCKS5 sender metrics did not converge within 15s: completed=%d active=%d dial_duration_samples=%d",
+		s.Completed(), s.Active(), samples)
+}
+
 // ScenarioListenerID_PropagatesAndChangesOnRestart: assert the
 // listener_id slog attribute appears on sender-side accept logs
 // and changes after a listener restart. Subsumes the legacy
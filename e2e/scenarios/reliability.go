@@ -20,11 +20,6 @@ import (
 // must pass against both the in-process mock backend and the real
 // Azure backend — this is the "behavior is the same shape on both
 // sides of the relay" parity gate.
-//
-// ScenarioHalfClose_RequestResponse is registered here for shape
-// (i.e. the test name shows up in output) but t.Skip()s until the
-// bridge propagates half-close. The skip exists so the suite stays
-// green while that capability is missing.
 func RunReliabilityScenarios(t *testing.T, b Backend) {
 	t.Helper()
 	runScenarioCases(t, b, reliabilityCases())
@@ -167,17 +162,17 @@ func ScenarioErrorPropagation_TargetRefused(t *testing.T, b Backend) {
 }
 
 // ScenarioErrorPropagation_TargetUnreachable asserts that a SOCKS5
-// client dialing a black-holed address sees REP=0x03 or 0x04
-// (network/host unreachable) within the configured deadline, and a
-// port-forward client also fails inside the budget. The target is
+// client dialing a black-holed address sees REP=0x03, 0x04, or 0x06
+// (network/host unreachable, TTL expired) within the configured
+// deadline, and a port-forward client also fails inside the budget. The target is
 // 192.0.2.1 from RFC 5737 TEST-NET-1, guaranteed not routable on
 // production networks.
 //
 // On Linux the kernel typically reports ETIMEDOUT for a SYN that
 // never receives SYN-ACK, classified as CodeTimeout → mapped to
-// RepHostUnreachable (0x04). Some networks instead emit ICMP
-// host/network unreachable, surfacing as 0x03 or 0x04 directly. The
-// assertion accepts either, since both are valid responses for an
+// RepTTLExpired (0x06). Some networks instead emit ICMP host/network
+// unreachable, surfacing as 0x03 or 0x04 directly. The assertion
+// accepts any of them, since all are valid responses for an
 // unreachable target.
 func ScenarioErrorPropagation_TargetUnreachable(t *testing.T, b Backend) {
 	t.Helper()
@@ -201,8 +196,8 @@ func ScenarioErrorPropagation_TargetUnreachable(t *testing.T, b Backend) {
 	if !errors.As(err, &sErr) {
 		t.Fatalf("expected SOCKS5Error from unreachable dial, got %T: %v", err, err)
 	}
-	if sErr.Rep != 0x03 && sErr.Rep != 0x04 {
-		t.Errorf("SOCKS5 REP for unreachable target = %#x, want 0x03 (net unreachable) or 0x04 (host unreachable)",
+	if sErr.Rep != 0x03 && sErr.Rep != 0x04 && sErr.Rep != 0x06 {
+		t.Errorf("SOCKS5 REP for unreachable target = %#x, want 0x03 (net unreachable), 0x04 (host unreachable), or 0x06 (TTL expired)",
 			sErr.Rep)
 	}
 	if elapsed > 20*time.Second {
@@ -470,8 +465,8 @@ const dnsFailureTarget = "nonexistent.invalid.:80"
 // "DNS misconfigured" from "target unreachable on the network".
 //
 // The scenario uses SOCKS5 so the client receives a clean SOCKS5-reply
-// failure (current sender maps unknown protocol codes to
-// RepHostUnreachable, so the REP byte itself is not asserted; the
+// failure (the sender maps dns_not_found to RepHostUnreachable, which
+// other failures share, so the REP byte itself is not asserted; the
 // metric reason label is the contract under test). The listener's
 // connection_errors_total{reason="dns_not_found"} counter is polled
 // via the Listener.ConnectionErrors accessor, which both backends
@@ -518,18 +513,12 @@ func ScenarioErrorPropagation_TargetDNSFailure(t *testing.T, b Backend) {
 }
 
 // ScenarioHalfClose_RequestResponse is the acceptance-contract test
-// for half-close propagation. The current bridge tears down both
-// directions whenever either side returns EOF (see internal/relay/
-// bridge.go), so a client that does CloseWrite to signal "I'm done
-// writing, please send the response" loses its response stream.
-//
-// The body is fully written; only the t.Skip itself gates this
-// scenario — when the bridge supports half-close, deleting the skip
-// is sufficient to enable it.
+// for half-close propagation (port-forward --half-close). A client
+// that does CloseWrite to signal "I'm done writing, please send the
+// response" must still receive the whole response stream, and the
+// target must see the whole request followed by EOF.
 func ScenarioHalfClose_RequestResponse(t *testing.T, b Backend) {
 	t.Helper()
-	t.Skip("current bridge tears down both directions on EOF instead of preserving the response stream after client CloseWrite")
-
 	AssertNoLeaks(t)
 
 	const (
@@ -542,6 +531,7 @@ func ScenarioHalfClose_RequestResponse(t *testing.T, b Backend) {
 		SenderMode:     ModePortForward,
 		Target:         target.Addr(),
 		AllowedTargets: []string{target.Addr()},
+		HalfClose:      true,
 	})
 
 	conn := dialWithRetry(t, tun.SenderAddr, 10*time.Second)
@@ -760,8 +750,8 @@ func (s *slowDrainTarget) closeAcceptedConns() {
 // requestResponseTarget is a TCP server that, on each accepted conn,
 // reads until EOF, compares the received bytes against an expected
 // request, and only writes its response when the request matches.
-// Used by the half-close scenario (currently skipped); on a bridge
-// that propagates EOF in one direction only, this exercises the
+// Used by the half-close scenario; on a bridge that propagates EOF in
+// one direction only, this exercises the
 // full request-then-response contract — both directions must
 // deliver intact payloads, not just an EOF + reply.
 type requestResponseTarget struct {
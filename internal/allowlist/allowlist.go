@@ -0,0 +1,146 @@
+// Package allowlist matches relay targets against the host:port /
+// CIDR:port patterns accepted by --allow on the listener and the
+// SOCKS5 sender.
+package allowlist
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Allowed reports whether target matches any entry of list.
+func Allowed(target string, list []string) bool {
+	_, ok := Match(target, list)
+	return ok
+}
+
+// Match returns the first entry of list that target matches.
+// Entries can be:
+//   - "host:port" — exact string match (no DNS resolution)
+//   - "*.domain:port" — any host under domain, at any depth; domain
+//     itself does not match
+//   - "CIDR:port" — CIDR match with exact port
+//   - "CIDR:*" — CIDR match with any port
+//   - "*" — allow everything
+//
+// Note: hostname entries are matched literally. Use CIDR notation for
+// IP-based restrictions to avoid bypass via IP/hostname mismatch.
+func Match(target string, list []string) (entry string, ok bool) {
+	host, port, err := net.SplitHostPort(target)
+	if err != nil {
+		return "", false
+	}
+
+	targetIP := net.ParseIP(host)
+
+	for _, entry := range list {
+		if entry == "*" {
+			return entry, true
+		}
+
+		aHost, aPort, err := splitEntry(entry)
+		if err != nil {
+			continue
+		}
+
+		// Check port.
+		if aPort != "*" && aPort != port {
+			continue
+		}
+
+		// Check host: try CIDR first, then wildcard, then exact match.
+		if _, cidr, err := net.ParseCIDR(aHost); err == nil {
+			if targetIP != nil && cidr.Contains(targetIP) {
+				return entry, true
+			}
+		} else if suffix, ok := strings.CutPrefix(aHost, "*"); ok && strings.HasPrefix(suffix, ".") {
+			if targetIP == nil && len(host) > len(suffix) && strings.HasSuffix(strings.ToLower(host), strings.ToLower(suffix)) {
+				return entry, true
+			}
+		} else if host == aHost {
+			return entry, true
+		}
+	}
+	return "", false
+}
+
+// splitEntry parses "host:port" or "CIDR:port" from allowlist format.
+// CIDR entries like "10.0.0.0/8:*" need special handling since they
+// contain a colon in the CIDR notation.
+func splitEntry(entry string) (host, port string, err error) {
+	// Find the last colon — the port separator.
+	lastColon := -1
+	for i := len(entry) - 1; i >= 0; i-- {
+		if entry[i] == ':' {
+			lastColon = i
+			break
+		}
+	}
+	if lastColon < 0 {
+		return "", "", fmt.Errorf("no port in allowlist entry: %s", entry)
+	}
+	return entry[:lastColon], entry[lastColon+1:], nil
+}
+
+// Validate reports why entry is not a well-formed allowlist entry, or
+// nil if it is: "*", or a non-empty host, "*.domain" or CIDR, a colon,
+// and a port number or "*".
+func Validate(entry string) error {
+	if entry == "*" {
+		return nil
+	}
+	host, port, err := splitEntry(entry)
+	if err != nil {
+		return err
+	}
+	if host == "" {
+		return fmt.Errorf("no host in allowlist entry: %s", entry)
+	}
+	if port != "*" {
+		if n, err := strconv.Atoi(port); err != nil || n < 1 || n > 65535 {
+			return fmt.Errorf("bad port in allowlist entry: %s", entry)
+		}
+	}
+	if host != "*" && strings.Contains(host, "*") && (!strings.HasPrefix(host, "*.") || len(host) == 2 || strings.Contains(host[1:], "*")) {
+		return fmt.Errorf("bad wildcard in allowlist entry: %s", entry)
+	}
+	if strings.Contains(host, "/") {
+		if _, _, err := net.ParseCIDR(host); err != nil {
+			return fmt.Errorf("bad CIDR in allowlist entry: %s", entry)
+		}
+	}
+	return nil
+}
+
+// ReadFile reads allowlist entries from path, one per line. Blank
+// lines and lines starting with # are skipped. Lines that fail
+// Validate are left out and reported in rejected, each error naming
+// its line number, so one typo does not discard the rest of the file.
+func ReadFile(path string) (entries []string, rejected []error, err error) {
+	f, err := os.Open(path) //nolint:gosec // operator-supplied allowlist path
+	if err != nil {
+		return nil, nil, err
+	}
+	defer f.Close() //nolint:errcheck // read-only
+
+	sc := bufio.NewScanner(f)
+	for n := 1; sc.Scan(); n++ {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if err := Validate(line); err != nil {
+			rejected = append(rejected, fmt.Errorf("line %d: %w", n, err))
+			continue
+		}
+		entries = append(entries, line)
+	}
+	if err := sc.Err(); err != nil {
+		return nil, nil, err
+	}
+	return entries, rejected, nil
+}
@@ -0,0 +1,120 @@
+package allowlist
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestAllowed(t *testing.T) {
+	tests := []struct {
+		name      string
+		target    string
+		allowList []string
+		want      bool
+	}{
+		{"wildcard", "10.0.0.1:22", []string{"*"}, true},
+		{"exact match", "10.0.0.1:22", []string{"10.0.0.1:22"}, true},
+		{"exact no match", "10.0.0.1:22", []string{"10.0.0.2:22"}, false},
+		{"wrong port", "10.0.0.1:80", []string{"10.0.0.1:22"}, false},
+		{"cidr match", "10.0.0.5:22", []string{"10.0.0.0/8:22"}, true},
+		{"cidr wildcard port", "10.0.0.5:8080", []string{"10.0.0.0/8:*"}, true},
+		{"cidr no match", "192.168.0.1:22", []string{"10.0.0.0/8:22"}, false},
+		{"multiple entries", "10.0.0.5:22", []string{"192.168.0.0/16:*", "10.0.0.0/8:22"}, true},
+		{"hostname exact", "myhost:22", []string{"myhost:22"}, true},
+		{"hostname wrong", "myhost:22", []string{"other:22"}, false},
+		{"empty target", "", []string{"*"}, false},
+		{"domain wildcard", "db.internal.example.com:443", []string{"*.example.com:443"}, true},
+		{"domain wildcard any case", "DB.Example.COM:443", []string{"*.example.com:443"}, true},
+		{"domain wildcard any port", "db.example.com:8443", []string{"*.example.com:*"}, true},
+		{"domain wildcard wrong port", "db.example.com:80", []string{"*.example.com:443"}, false},
+		{"domain wildcard apex", "example.com:443", []string{"*.example.com:443"}, false},
+		{"domain wildcard label boundary", "badexample.com:443", []string{"*.example.com:443"}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := Allowed(tt.target, tt.allowList)
+			if got != tt.want {
+				t.Errorf("Allowed(%q, %v) = %v, want %v", tt.target, tt.allowList, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSplitEntry(t *testing.T) {
+	tests := []struct {
+		entry    string
+		wantHost string
+		wantPort string
+		wantErr  bool
+	}{
+		{"10.0.0.1:22", "10.0.0.1", "22", false},
+		{"10.0.0.0/8:*", "10.0.0.0/8", "*", false},
+		{"myhost:22", "myhost", "22", false},
+		{"nocolon", "", "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.entry, func(t *testing.T) {
+			h, p, err := splitEntry(tt.entry)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, wantErr = %v", err, tt.wantErr)
+			}
+			if h != tt.wantHost {
+				t.Errorf("host = %q, want %q", h, tt.wantHost)
+			}
+			if p != tt.wantPort {
+				t.Errorf("port = %q, want %q", p, tt.wantPort)
+			}
+		})
+	}
+}
+
+func TestMatch_ReturnsEntry(t *testing.T) {
+	list := []string{"192.168.0.0/16:*", "10.0.0.0/8:22"}
+	entry, ok := Match("10.0.0.5:22", list)
+	if !ok || entry != "10.0.0.0/8:22" {
+		t.Errorf("Match = %q, %v; want %q, true", entry, ok, "10.0.0.0/8:22")
+	}
+	if entry, ok := Match("10.0.0.5:80", list); ok {
+		t.Errorf("Match = %q, true; want no match", entry)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	for _, entry := range []string{"*", "10.0.0.1:22", "10.0.0.0/8:*", "fd00::/8:443", "db.internal:5432", "*.example.com:443"} {
+		if err := Validate(entry); err != nil {
+			t.Errorf("Validate(%q) = %v, want nil", entry, err)
+		}
+	}
+	for _, entry := range []string{"", "10.0.0.1", ":22", "host:0", "host:70000", "host:ssh", "10.0.0.0/33:22", "*.:443", "db.*.com:443", "*example.com:443", "*.*.com:443"} {
+		if err := Validate(entry); err == nil {
+			t.Errorf("Validate(%q) = nil, want an error", entry)
+		}
+	}
+}
+
+func TestReadFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "allow")
+	data := "# ssh to the jump hosts\n10.0.0.0/8:22\n\n  db.internal:5432  \nnot-an-entry\n*\n"
+	if err := os.WriteFile(path, []byte(data), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	entries, rejected, err := ReadFile(path)
+	if err != nil {
+		t.Fatalf("ReadFile: %v", err)
+	}
+	want := []string{"10.0.0.0/8:22", "db.internal:5432", "*"}
+	if !slices.Equal(entries, want) {
+		t.Errorf("entries = %q, want %q", entries, want)
+	}
+	if len(rejected) != 1 || !strings.Contains(rejected[0].Error(), "line 5") {
+		t.Errorf("rejected = %v, want one error for line 5", rejected)
+	}
+
+	if _, _, err := ReadFile(filepath.Join(t.TempDir(), "missing")); err == nil {
+		t.Error("ReadFile of a missing file succeeded")
+	}
+}
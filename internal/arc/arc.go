@@ -19,11 +19,14 @@ import (
 	"io"
 	"log/slog"
 	"net/http"
+	"net/url"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
 	"github.com/Azure/azure-sdk-for-go/sdk/azcore/arm"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/policy"
 	"github.com/Azure/azure-sdk-for-go/sdk/azcore/runtime"
 	"github.com/Azure/azure-sdk-for-go/sdk/azcore/streaming"
 	"github.com/Azure/azure-sdk-for-go/sdk/azidentity"
@@ -33,11 +36,49 @@ import (
 
 const (
 	hybridConnectivityAPIVersion = "2023-03-15"
+	hybridComputeAPIVersion      = "2022-12-27"
 	defaultExpiresin             = 10800 // 3 hours (maximum)
-	defaultServiceName           = "SSH"
+	defaultServiceName           = ServiceSSH
 	defaultPort                  = 22
+
+	// credentialRefreshWindow is how long before ExpiresOn
+	// CachedRelayCredentials stops reusing a SAS, leaving room for a
+	// relay dial and its retries to finish with the old one.
+	credentialRefreshWindow = 10 * time.Minute
+)
+
+// Service names the HybridConnectivity API accepts.
+const (
+	ServiceSSH = "SSH"
+	ServiceWAC = "WAC" // Windows Admin Center
 )
 
+// servicePorts maps each service name to the port it listens on by
+// default.
+var servicePorts = map[string]int{
+	ServiceSSH: defaultPort,
+	ServiceWAC: 6516,
+}
+
+// ResolveService validates serviceName and returns its canonical
+// spelling and the port to use: port itself, or the service's default
+// port when port is 0. The name is matched case-insensitively and an
+// empty name selects SSH.
+func ResolveService(serviceName string, port int) (string, int, error) {
+	if serviceName == "" {
+		serviceName = defaultServiceName
+	}
+	name := strings.ToUpper(serviceName)
+	def, ok := servicePorts[name]
+	if !ok {
+		return "", 0, fmt.Errorf("unknown Arc service %q: want %s or %s", serviceName, ServiceSSH, ServiceWAC)
+	}
+	if port == 0 {
+		port = def
+	}
+	return name, port, nil
+}
+
 // RelayInfo holds the relay credentials returned by the listCredentials API.
 type RelayInfo struct {
 	NamespaceName             string `json:"namespaceName"`
@@ -60,17 +101,49 @@ type listCredentialsResponse struct {
 
 // Client interacts with the HybridConnectivity ARM APIs.
 type Client struct {
-	arm    *arm.Client
-	logger *slog.Logger
+	arm           *arm.Client
+	logger        *slog.Logger
+	correlationID string
+
+	// credMu guards creds, the relay credentials
+	// CachedRelayCredentials hands out, keyed by resource ID and
+	// service name. It is held across a listCredentials call so
+	// concurrent connections share one refresh.
+	credMu sync.Mutex
+	creds  map[credKey]*RelayInfo
+	now    func() time.Time // time.Now; tests override it
+}
+
+type credKey struct{ resourceID, serviceName string }
+
+// ClientOptions configures a Client. A nil *ClientOptions selects Azure
+// Public Cloud defaults.
+type ClientOptions struct {
+	arm.ClientOptions
+
+	// UserAgentSuffix, when non-empty, is appended to the User-Agent
+	// header the Azure SDK generates for every ARM request, so tenant
+	// operators can pick aztunnel's calls out of activity logs.
+	UserAgentSuffix string
+
+	// CorrelationID, when non-empty, is sent as the
+	// x-ms-correlation-request-id header on every ARM request. ARM
+	// records it in the activity log, tying all calls from one
+	// aztunnel run together.
+	CorrelationID string
 }
 
+// correlationHeader is the ARM request header carrying a
+// caller-chosen correlation ID into the activity log.
+const correlationHeader = "x-ms-correlation-request-id"
+
 // NewClient creates a Client using DefaultAzureCredential.
 // Options may be nil for Azure Public Cloud defaults.
-func NewClient(logger *slog.Logger, options *arm.ClientOptions) (*Client, error) {
+func NewClient(logger *slog.Logger, options *ClientOptions) (*Client, error) {
 	var credOpts *azidentity.DefaultAzureCredentialOptions
 	if options != nil {
 		credOpts = &azidentity.DefaultAzureCredentialOptions{
-			ClientOptions: options.ClientOptions,
+			ClientOptions: options.ClientOptions.ClientOptions,
 		}
 	}
 	cred, err := azidentity.NewDefaultAzureCredential(credOpts)
@@ -82,15 +155,45 @@ func NewClient(logger *slog.Logger, options *arm.ClientOptions) (*Client, error)
 
 // NewClientWithCredential creates a Client with a specific TokenCredential.
 // Options may be nil for Azure Public Cloud defaults.
-func NewClientWithCredential(cred azcore.TokenCredential, logger *slog.Logger, options *arm.ClientOptions) (*Client, error) {
+func NewClientWithCredential(cred azcore.TokenCredential, logger *slog.Logger, options *ClientOptions) (*Client, error) {
 	if logger == nil {
 		logger = slog.Default()
 	}
-	armClient, err := arm.NewClient("aztunnel-arc", "v1.0.0", cred, options)
+	var armOpts *arm.ClientOptions
+	var correlationID string
+	if options != nil {
+		o := options.ClientOptions
+		if options.UserAgentSuffix != "" {
+			// Copy before appending so the caller's slice is never
+			// mutated.
+			o.PerCallPolicies = append(append([]policy.Policy(nil), o.PerCallPolicies...),
+				userAgentSuffixPolicy{suffix: options.UserAgentSuffix})
+		}
+		armOpts = &o
+		correlationID = options.CorrelationID
+	}
+	armClient, err := arm.NewClient("aztunnel-arc", "v1.0.0", cred, armOpts)
 	if err != nil {
 		return nil, fmt.Errorf("create ARM client: %w", err)
 	}
-	return &Client{arm: armClient, logger: logger}, nil
+	return &Client{arm: armClient, logger: logger, correlationID: correlationID, now: time.Now}, nil
+}
+
+// userAgentSuffixPolicy appends suffix to the User-Agent header. It is
+// installed as a per-call policy, which the SDK runs after its own
+// telemetry policy has set the base User-Agent.
+type userAgentSuffixPolicy struct {
+	suffix string
+}
+
+func (p userAgentSuffixPolicy) Do(req *policy.Request) (*http.Response, error) {
+	h := req.Raw().Header
+	if ua := h.Get("User-Agent"); ua != "" {
+		h.Set("User-Agent", ua+" "+p.suffix)
+	} else {
+		h.Set("User-Agent", p.suffix)
+	}
+	return req.Next()
 }
 
 // EnsureHybridConnectivity creates the HybridConnectivity endpoint and
@@ -102,11 +205,9 @@ func NewClientWithCredential(cred azcore.TokenCredential, logger *slog.Logger, o
 // 404 "Endpoint does not exist" until the listener recovers. Prefer
 // calling GetRelayCredentials first and only calling this if it fails.
 func (c *Client) EnsureHybridConnectivity(ctx context.Context, resourceID, serviceName string, port int) error {
-	if serviceName == "" {
-		serviceName = defaultServiceName
-	}
-	if port == 0 {
-		port = defaultPort
+	serviceName, port, err := ResolveService(serviceName, port)
+	if err != nil {
+		return err
 	}
 
 	endpointPath := fmt.Sprintf("%s/providers/Microsoft.HybridConnectivity/endpoints/default", resourceID)
@@ -134,10 +235,11 @@ func (c *Client) EnsureHybridConnectivity(ctx context.Context, resourceID, servi
 }
 
 // GetRelayCredentials obtains relay credentials by calling the
-// listCredentials API.
+// listCredentials API. serviceName is resolved as by ResolveService.
 func (c *Client) GetRelayCredentials(ctx context.Context, resourceID, serviceName string) (*RelayInfo, error) {
-	if serviceName == "" {
-		serviceName = defaultServiceName
+	serviceName, _, err := ResolveService(serviceName, 0)
+	if err != nil {
+		return nil, err
 	}
 
 	credPath := fmt.Sprintf("%s/providers/Microsoft.HybridConnectivity/endpoints/default/listCredentials", resourceID)
@@ -169,6 +271,154 @@ func (c *Client) GetRelayCredentials(ctx context.Context, resourceID, serviceNam
 	return &result.Relay, nil
 }
 
+// CachedRelayCredentials is GetRelayCredentials for callers that dial
+// repeatedly: it returns the credentials from the last call for the
+// same resource and service until they are within
+// credentialRefreshWindow of their ExpiresOn, and only then asks ARM
+// again. Credentials without an ExpiresOn are never reused. It is safe
+// for concurrent use.
+func (c *Client) CachedRelayCredentials(ctx context.Context, resourceID, serviceName string) (*RelayInfo, error) {
+	serviceName, _, err := ResolveService(serviceName, 0)
+	if err != nil {
+		return nil, err
+	}
+	key := credKey{resourceID, serviceName}
+	c.credMu.Lock()
+	defer c.credMu.Unlock()
+	if info := c.creds[key]; info != nil && c.now().Add(credentialRefreshWindow).Before(time.Unix(info.ExpiresOn, 0)) {
+		return info, nil
+	}
+	info, err := c.GetRelayCredentials(ctx, resourceID, serviceName)
+	if err != nil {
+		return nil, err
+	}
+	if c.creds == nil {
+		c.creds = make(map[credKey]*RelayInfo)
+	}
+	c.creds[key] = info
+	return info, nil
+}
+
+// ServiceConfiguration is one service exposed through a machine's
+// HybridConnectivity endpoint.
+type ServiceConfiguration struct {
+	ServiceName string `json:"serviceName"`
+	Port        int    `json:"port"`
+}
+
+// serviceConfigurationList is one page of the serviceConfigurations
+// list response.
+type serviceConfigurationList struct {
+	Value []struct {
+		Properties ServiceConfiguration `json:"properties"`
+	} `json:"value"`
+	NextLink string `json:"nextLink"`
+}
+
+// ListServiceConfigurations returns the service configurations on the
+// resource's default HybridConnectivity endpoint, following nextLink
+// pages. A machine without the endpoint yields an *ARMError with
+// status 404.
+func (c *Client) ListServiceConfigurations(ctx context.Context, resourceID string) ([]ServiceConfiguration, error) {
+	listPath := fmt.Sprintf("%s/providers/Microsoft.HybridConnectivity/endpoints/default/serviceConfigurations", resourceID)
+	next := runtime.JoinPaths(c.arm.Endpoint(), listPath) + "?api-version=" + hybridConnectivityAPIVersion
+
+	c.logger.Debug("listing service configurations", "resourceID", resourceID)
+	var services []ServiceConfiguration
+	for next != "" {
+		resp, err := c.armGET(ctx, next)
+		if err != nil {
+			return nil, fmt.Errorf("list service configurations: %w", err)
+		}
+		var page serviceConfigurationList
+		if err := json.Unmarshal(resp, &page); err != nil {
+			return nil, fmt.Errorf("parse service configurations response: %w", err)
+		}
+		for _, v := range page.Value {
+			services = append(services, v.Properties)
+		}
+		next = page.NextLink
+	}
+	return services, nil
+}
+
+// Machine is one Arc-connected machine.
+type Machine struct {
+	Name          string `json:"name"`
+	ResourceGroup string `json:"resourceGroup"`
+	Location      string `json:"location"`
+	Status        string `json:"status"` // Connected, Disconnected, or Error
+	ID            string `json:"id"`
+}
+
+// machineList is one page of the Microsoft.HybridCompute/machines list
+// response.
+type machineList struct {
+	Value []struct {
+		ID         string `json:"id"`
+		Name       string `json:"name"`
+		Location   string `json:"location"`
+		Properties struct {
+			Status string `json:"status"`
+		} `json:"properties"`
+	} `json:"value"`
+	NextLink string `json:"nextLink"`
+}
+
+// ListMachines returns the Arc-connected machines in subscriptionID,
+// or only those in resourceGroup when it is non-empty, following
+// nextLink pages.
+func (c *Client) ListMachines(ctx context.Context, subscriptionID, resourceGroup string) ([]Machine, error) {
+	if subscriptionID == "" || strings.Contains(subscriptionID, "/") {
+		return nil, fmt.Errorf("invalid subscription ID %q", subscriptionID)
+	}
+	if strings.Contains(resourceGroup, "/") {
+		return nil, fmt.Errorf("invalid resource group %q", resourceGroup)
+	}
+	listPath := "/subscriptions/" + subscriptionID
+	if resourceGroup != "" {
+		listPath += "/resourceGroups/" + resourceGroup
+	}
+	listPath += "/providers/Microsoft.HybridCompute/machines"
+	next := runtime.JoinPaths(c.arm.Endpoint(), listPath) + "?api-version=" + hybridComputeAPIVersion
+
+	c.logger.Debug("listing Arc machines", "subscription", subscriptionID, "resourceGroup", resourceGroup)
+	var machines []Machine
+	for next != "" {
+		resp, err := c.armGET(ctx, next)
+		if err != nil {
+			return nil, fmt.Errorf("list machines: %w", err)
+		}
+		var page machineList
+		if err := json.Unmarshal(resp, &page); err != nil {
+			return nil, fmt.Errorf("parse machines response: %w", err)
+		}
+		for _, v := range page.Value {
+			machines = append(machines, Machine{
+				Name:          v.Name,
+				ResourceGroup: resourceGroupOf(v.ID),
+				Location:      v.Location,
+				Status:        v.Properties.Status,
+				ID:            v.ID,
+			})
+		}
+		next = page.NextLink
+	}
+	return machines, nil
+}
+
+// resourceGroupOf returns the resource group segment of an ARM
+// resource ID, or "" if it has none.
+func resourceGroupOf(id string) string {
+	parts := strings.Split(id, "/")
+	for i := 0; i+1 < len(parts); i++ {
+		if strings.EqualFold(parts[i], "resourceGroups") {
+			return parts[i+1]
+		}
+	}
+	return ""
+}
+
 // Dial connects to the Azure Relay using credentials from RelayInfo.
 // Unlike relay.Dial, this does NOT perform the aztunnel envelope exchange —
 // the Arc agent on the VM handles the local TCP connection directly.
@@ -239,6 +489,16 @@ type DialOptions struct {
 	// is emitted periodically so operator-actionable failures are not
 	// hidden.
 	ExplainSetup bool
+
+	// Proxy, when non-nil, is the proxy the relay dial goes through in
+	// place of the one HTTPS_PROXY selects (see relay.UseProxy).
+	Proxy *url.URL
+
+	// Compression offers permessage-deflate on the relay WebSocket
+	// (see relay.UseCompression). It applies to the hop to Azure Relay
+	// only, if the relay accepts it; a relay.WireCounter on the dial's
+	// context records whether it did.
+	Compression bool
 }
 
 // DialWithLogger is like Dial but logs the connection attempt and retries
@@ -280,10 +540,16 @@ func DialWithOptions(ctx context.Context, info *RelayInfo, port int, logger *slo
 			wssHost, info.HybridConnectionName, newUUID())
 
 		dialCtx, cancel := context.WithTimeout(ctx, dialTimeout)
-		ws, resp, err := websocket.Dial(dialCtx, connectURL, relay.WSDialOptions(headers, nil))
+		wsOpts := relay.WSDialOptions(headers, nil)
+		relay.UseProxy(wsOpts, opts.Proxy)
+		if opts.Compression {
+			relay.UseCompression(wsOpts)
+		}
+		ws, resp, err := websocket.Dial(dialCtx, connectURL, wsOpts)
 		cancel()
 
 		if err == nil {
+			relay.MarkDeflate(ctx, resp)
 			// Only log success at INFO if we'd already announced a wait —
 			// otherwise we'd suddenly produce a connected line out of nowhere
 			// after a silent transient retry.
@@ -376,12 +642,34 @@ func giveUpErr(attempts int, elapsed time.Duration, lastStatus int, cause error)
 		attempts, noun, elapsed.Truncate(time.Second), lastStatus, cause)
 }
 
+func (c *Client) armGET(ctx context.Context, rawURL string) ([]byte, error) {
+	req, err := runtime.NewRequest(ctx, http.MethodGet, rawURL)
+	if err != nil {
+		return nil, err
+	}
+	if c.correlationID != "" {
+		req.Raw().Header.Set(correlationHeader, c.correlationID)
+	}
+	resp, err := c.arm.Pipeline().Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = resp.Body.Close() }()
+	if resp.StatusCode >= 400 {
+		return nil, newARMError(resp)
+	}
+	return io.ReadAll(resp.Body)
+}
+
 func (c *Client) armPUT(ctx context.Context, rawURL, body string) error {
 	req, err := runtime.NewRequest(ctx, http.MethodPut, rawURL)
 	if err != nil {
 		return err
 	}
 	req.Raw().Header.Set("Content-Type", "application/json")
+	if c.correlationID != "" {
+		req.Raw().Header.Set(correlationHeader, c.correlationID)
+	}
 	if err := req.SetBody(streaming.NopCloser(strings.NewReader(body)), "application/json"); err != nil {
 		return err
 	}
@@ -402,6 +690,9 @@ func (c *Client) armPOST(ctx context.Context, rawURL, body string) ([]byte, erro
 		return nil, err
 	}
 	req.Raw().Header.Set("Content-Type", "application/json")
+	if c.correlationID != "" {
+		req.Raw().Header.Set(correlationHeader, c.correlationID)
+	}
 	if err := req.SetBody(streaming.NopCloser(strings.NewReader(body)), "application/json"); err != nil {
 		return nil, err
 	}
@@ -444,7 +735,8 @@ type sanitizedError struct {
 func (e *sanitizedError) Error() string { return e.msg }
 func (e *sanitizedError) Unwrap() error { return e.err }
 
-// sanitizeErr strips sensitive tokens from WebSocket dial errors.
+// sanitizeErr strips sensitive tokens from WebSocket dial errors, then
+// applies any patterns installed with relay.SetRedactPatterns.
 // The returned error preserves the original error chain for errors.Is/As.
 func sanitizeErr(err error) error {
 	s := err.Error()
@@ -477,7 +769,7 @@ func sanitizeErr(err error) error {
 			s = s[:idx] + p.prefix + "REDACTED" + s[afterPrefix+end:]
 		}
 	}
-	return &sanitizedError{msg: s, err: err}
+	return &sanitizedError{msg: relay.RedactString(s), err: err}
 }
 
 // newUUID generates a random UUID v4 string without external dependencies.
@@ -4,10 +4,12 @@ import (
 	"context"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"io"
 	"log/slog"
 	"net/http"
 	"net/http/httptest"
+	"reflect"
 	"strings"
 	"sync"
 	"testing"
@@ -18,6 +20,7 @@ import (
 	"github.com/Azure/azure-sdk-for-go/sdk/azcore/cloud"
 	"github.com/Azure/azure-sdk-for-go/sdk/azcore/policy"
 	"github.com/coder/websocket"
+	"github.com/philsphicas/aztunnel/internal/relay"
 )
 
 // fakeCredential implements azcore.TokenCredential for testing.
@@ -33,7 +36,15 @@ func (fakeCredential) GetToken(_ context.Context, _ policy.TokenRequestOptions)
 // transport-level rewrites.
 func newTestClient(t *testing.T, srv *httptest.Server) *Client {
 	t.Helper()
-	opts := &arm.ClientOptions{
+	return newTestClientWithOptions(t, srv, ClientOptions{})
+}
+
+// newTestClientWithOptions is newTestClient with caller-supplied
+// aztunnel-level options; the ARM endpoint and transport are always
+// pointed at srv.
+func newTestClientWithOptions(t *testing.T, srv *httptest.Server, opts ClientOptions) *Client {
+	t.Helper()
+	opts.ClientOptions = arm.ClientOptions{
 		ClientOptions: policy.ClientOptions{
 			Cloud: cloud.Configuration{
 				Services: map[cloud.ServiceName]cloud.ServiceConfiguration{
@@ -46,7 +57,7 @@ func newTestClient(t *testing.T, srv *httptest.Server) *Client {
 			Transport: srv.Client(),
 		},
 	}
-	c, err := NewClientWithCredential(fakeCredential{}, slog.Default(), opts)
+	c, err := NewClientWithCredential(fakeCredential{}, slog.Default(), &opts)
 	if err != nil {
 		t.Fatalf("newTestClient: %v", err)
 	}
@@ -145,6 +156,52 @@ func TestEnsureHybridConnectivity(t *testing.T) {
 		}
 	})
 
+	t.Run("WAC defaults to its own port", func(t *testing.T) {
+		var paths, bodies []string
+		srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			body, _ := io.ReadAll(r.Body)
+			paths = append(paths, r.URL.Path)
+			bodies = append(bodies, string(body))
+			w.WriteHeader(http.StatusOK)
+			w.Write([]byte(`{}`))
+		}))
+		defer srv.Close()
+
+		c := newTestClient(t, srv)
+		if err := c.EnsureHybridConnectivity(context.Background(), resourceID, "wac", 0); err != nil {
+			t.Fatalf("EnsureHybridConnectivity: %v", err)
+		}
+		if len(paths) != 2 {
+			t.Fatalf("expected 2 requests, got %d", len(paths))
+		}
+		wantPath := resourceID + "/providers/Microsoft.HybridConnectivity/endpoints/default/serviceConfigurations/WAC"
+		if paths[1] != wantPath {
+			t.Errorf("request 1: path = %q, want %q", paths[1], wantPath)
+		}
+		var svc struct {
+			Properties ServiceConfiguration `json:"properties"`
+		}
+		if err := json.Unmarshal([]byte(bodies[1]), &svc); err != nil {
+			t.Fatalf("service config body %q: %v", bodies[1], err)
+		}
+		if svc.Properties != (ServiceConfiguration{ServiceName: "WAC", Port: 6516}) {
+			t.Errorf("service config = %+v, want WAC on 6516", svc.Properties)
+		}
+	})
+
+	t.Run("unknown service", func(t *testing.T) {
+		srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			t.Errorf("unexpected request %s %s", r.Method, r.URL.Path)
+		}))
+		defer srv.Close()
+
+		c := newTestClient(t, srv)
+		err := c.EnsureHybridConnectivity(context.Background(), resourceID, "RDP", 0)
+		if err == nil || !strings.Contains(err.Error(), `"RDP"`) {
+			t.Errorf("err = %v, want one naming the unknown service", err)
+		}
+	})
+
 	t.Run("endpoint PUT failure", func(t *testing.T) {
 		srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 			w.WriteHeader(http.StatusForbidden)
@@ -280,6 +337,29 @@ func TestGetRelayCredentials(t *testing.T) {
 		}
 	})
 
+	t.Run("WAC", func(t *testing.T) {
+		var capturedService string
+		srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			var body map[string]string
+			json.NewDecoder(r.Body).Decode(&body)
+			capturedService = body["serviceName"]
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(validResp)
+		}))
+		defer srv.Close()
+
+		c := newTestClient(t, srv)
+		if _, err := c.GetRelayCredentials(context.Background(), resourceID, "Wac"); err != nil {
+			t.Fatalf("GetRelayCredentials: %v", err)
+		}
+		if capturedService != "WAC" {
+			t.Errorf("serviceName = %q, want WAC", capturedService)
+		}
+		if _, err := c.GetRelayCredentials(context.Background(), resourceID, "telnet"); err == nil {
+			t.Error("unknown service: expected error")
+		}
+	})
+
 	t.Run("API error", func(t *testing.T) {
 		srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 			w.WriteHeader(http.StatusNotFound)
@@ -298,6 +378,324 @@ func TestGetRelayCredentials(t *testing.T) {
 	})
 }
 
+func TestResolveService(t *testing.T) {
+	tests := []struct {
+		service     string
+		port        int
+		wantService string
+		wantPort    int
+	}{
+		{"", 0, "SSH", 22},
+		{"SSH", 0, "SSH", 22},
+		{"ssh", 2222, "SSH", 2222},
+		{"WAC", 0, "WAC", 6516},
+		{"wac", 443, "WAC", 443},
+	}
+	for _, tt := range tests {
+		service, port, err := ResolveService(tt.service, tt.port)
+		if err != nil || service != tt.wantService || port != tt.wantPort {
+			t.Errorf("ResolveService(%q, %d) = %q, %d, %v; want %q, %d", tt.service, tt.port, service, port, err, tt.wantService, tt.wantPort)
+		}
+	}
+	if _, _, err := ResolveService("RDP", 0); err == nil || !strings.Contains(err.Error(), "SSH or WAC") {
+		t.Errorf("ResolveService(RDP) err = %v, want one listing SSH and WAC", err)
+	}
+}
+
+func TestCachedRelayCredentials(t *testing.T) {
+	const resourceID = "/subscriptions/sub1/resourceGroups/rg1/providers/Microsoft.HybridCompute/machines/vm1"
+	now := time.Unix(1_700_000_000, 0)
+	expiresOn := now.Add(3 * time.Hour)
+
+	var mu sync.Mutex
+	calls := 0
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasSuffix(r.URL.Path, "/listCredentials") {
+			t.Errorf("unexpected request %s %s", r.Method, r.URL.Path)
+		}
+		mu.Lock()
+		calls++
+		mu.Unlock()
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(listCredentialsResponse{Relay: RelayInfo{
+			NamespaceName:        "azgnrelay-eastus-l1",
+			NamespaceNameSuffix:  "servicebus.windows.net",
+			HybridConnectionName: "microsoft.hybridcompute/machines/vm1/abc123",
+			AccessKey:            "SharedAccessSignature sr=test&sig=test",
+			ExpiresOn:            expiresOn.Unix(),
+		}})
+	}))
+	defer srv.Close()
+
+	c := newTestClient(t, srv)
+	c.now = func() time.Time { return now }
+	callCount := func() int {
+		mu.Lock()
+		defer mu.Unlock()
+		return calls
+	}
+
+	// Concurrent connections well before expiry share one fetch.
+	var wg sync.WaitGroup
+	for range 4 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := c.CachedRelayCredentials(context.Background(), resourceID, "SSH"); err != nil {
+				t.Errorf("CachedRelayCredentials: %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+	if got := callCount(); got != 1 {
+		t.Fatalf("listCredentials calls = %d, want 1 for connections within the window", got)
+	}
+
+	// A different service is cached separately.
+	if _, err := c.CachedRelayCredentials(context.Background(), resourceID, "WAC"); err != nil {
+		t.Fatal(err)
+	}
+	if got := callCount(); got != 2 {
+		t.Fatalf("listCredentials calls = %d, want 2 after a second service", got)
+	}
+
+	// Inside the refresh window the SAS is fetched again.
+	now = expiresOn.Add(-credentialRefreshWindow / 2)
+	if _, err := c.CachedRelayCredentials(context.Background(), resourceID, "SSH"); err != nil {
+		t.Fatal(err)
+	}
+	if got := callCount(); got != 3 {
+		t.Errorf("listCredentials calls = %d, want 3 once the SAS nears expiry", got)
+	}
+}
+
+// TestRequestTagging asserts the ARM request tagging options reach the
+// wire on both the PUT (EnsureHybridConnectivity) and POST
+// (GetRelayCredentials) paths, and that a Client without them sends
+// neither the suffix nor the correlation header.
+func TestListServiceConfigurations(t *testing.T) {
+	const resourceID = "/subscriptions/sub1/resourceGroups/rg1/providers/Microsoft.HybridCompute/machines/vm1"
+	const listPath = resourceID + "/providers/Microsoft.HybridConnectivity/endpoints/default/serviceConfigurations"
+
+	t.Run("two pages", func(t *testing.T) {
+		var srv *httptest.Server
+		srv = httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Method != http.MethodGet || r.URL.Path != listPath {
+				t.Errorf("request = %s %s, want GET %s", r.Method, r.URL.Path, listPath)
+			}
+			w.Header().Set("Content-Type", "application/json")
+			if r.URL.Query().Get("page") == "" {
+				fmt.Fprintf(w, `{"value":[{"name":"SSH","properties":{"serviceName":"SSH","port":22}}],"nextLink":%q}`,
+					srv.URL+listPath+"?api-version=2023-03-15&page=2")
+				return
+			}
+			w.Write([]byte(`{"value":[{"name":"WAC","properties":{"serviceName":"WAC","port":6516}}]}`))
+		}))
+		defer srv.Close()
+
+		c := newTestClient(t, srv)
+		got, err := c.ListServiceConfigurations(context.Background(), resourceID)
+		if err != nil {
+			t.Fatalf("ListServiceConfigurations: %v", err)
+		}
+		want := []ServiceConfiguration{{ServiceName: "SSH", Port: 22}, {ServiceName: "WAC", Port: 6516}}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("services = %+v, want %+v", got, want)
+		}
+	})
+
+	t.Run("empty", func(t *testing.T) {
+		srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "application/json")
+			w.Write([]byte(`{"value":[]}`))
+		}))
+		defer srv.Close()
+
+		c := newTestClient(t, srv)
+		got, err := c.ListServiceConfigurations(context.Background(), resourceID)
+		if err != nil {
+			t.Fatalf("ListServiceConfigurations: %v", err)
+		}
+		if len(got) != 0 {
+			t.Errorf("services = %+v, want none", got)
+		}
+	})
+
+	t.Run("missing endpoint", func(t *testing.T) {
+		srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{"error":{"code":"ResourceNotFound"}}`))
+		}))
+		defer srv.Close()
+
+		c := newTestClient(t, srv)
+		_, err := c.ListServiceConfigurations(context.Background(), resourceID)
+		var armErr *ARMError
+		if !errors.As(err, &armErr) || armErr.StatusCode != http.StatusNotFound {
+			t.Errorf("err = %v, want *ARMError with status 404", err)
+		}
+	})
+}
+
+func TestListMachines(t *testing.T) {
+	const subPath = "/subscriptions/sub1/providers/Microsoft.HybridCompute/machines"
+	const rgPath = "/subscriptions/sub1/resourceGroups/rg1/providers/Microsoft.HybridCompute/machines"
+	const vm1 = "/subscriptions/sub1/resourceGroups/rg1/providers/Microsoft.HybridCompute/machines/vm1"
+	const vm2 = "/subscriptions/sub1/resourcegroups/RG2/providers/Microsoft.HybridCompute/machines/vm2"
+
+	t.Run("subscription, two pages", func(t *testing.T) {
+		var srv *httptest.Server
+		srv = httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Method != http.MethodGet || r.URL.Path != subPath {
+				t.Errorf("request = %s %s, want GET %s", r.Method, r.URL.Path, subPath)
+			}
+			w.Header().Set("Content-Type", "application/json")
+			if r.URL.Query().Get("page") == "" {
+				if v := r.URL.Query().Get("api-version"); v != hybridComputeAPIVersion {
+					t.Errorf("api-version = %q, want %q", v, hybridComputeAPIVersion)
+				}
+				fmt.Fprintf(w, `{"value":[{"id":%q,"name":"vm1","location":"eastus","properties":{"status":"Connected"}}],"nextLink":%q}`,
+					vm1, srv.URL+subPath+"?api-version="+hybridComputeAPIVersion+"&page=2")
+				return
+			}
+			fmt.Fprintf(w, `{"value":[{"id":%q,"name":"vm2","location":"westus","properties":{"status":"Disconnected"}}]}`, vm2)
+		}))
+		defer srv.Close()
+
+		c := newTestClient(t, srv)
+		got, err := c.ListMachines(context.Background(), "sub1", "")
+		if err != nil {
+			t.Fatalf("ListMachines: %v", err)
+		}
+		want := []Machine{
+			{Name: "vm1", ResourceGroup: "rg1", Location: "eastus", Status: "Connected", ID: vm1},
+			{Name: "vm2", ResourceGroup: "RG2", Location: "westus", Status: "Disconnected", ID: vm2},
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("machines = %+v, want %+v", got, want)
+		}
+	})
+
+	t.Run("resource group", func(t *testing.T) {
+		srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path != rgPath {
+				t.Errorf("path = %s, want %s", r.URL.Path, rgPath)
+			}
+			w.Header().Set("Content-Type", "application/json")
+			w.Write([]byte(`{"value":[]}`))
+		}))
+		defer srv.Close()
+
+		c := newTestClient(t, srv)
+		got, err := c.ListMachines(context.Background(), "sub1", "rg1")
+		if err != nil {
+			t.Fatalf("ListMachines: %v", err)
+		}
+		if len(got) != 0 {
+			t.Errorf("machines = %+v, want none", got)
+		}
+	})
+
+	t.Run("invalid arguments", func(t *testing.T) {
+		srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			t.Errorf("unexpected request %s %s", r.Method, r.URL.Path)
+		}))
+		defer srv.Close()
+
+		c := newTestClient(t, srv)
+		for _, args := range [][2]string{{"", ""}, {"sub1/../x", ""}, {"sub1", "rg1/providers"}} {
+			if _, err := c.ListMachines(context.Background(), args[0], args[1]); err == nil {
+				t.Errorf("ListMachines(%q, %q) accepted", args[0], args[1])
+			}
+		}
+	})
+
+	t.Run("API error", func(t *testing.T) {
+		srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusForbidden)
+			w.Write([]byte(`{"error": {"code": "AuthorizationFailed"}}`))
+		}))
+		defer srv.Close()
+
+		c := newTestClient(t, srv)
+		_, err := c.ListMachines(context.Background(), "sub1", "")
+		var armErr *ARMError
+		if !errors.As(err, &armErr) || armErr.StatusCode != http.StatusForbidden {
+			t.Errorf("err = %v, want an *ARMError with status 403", err)
+		}
+	})
+}
+
+func TestRequestTagging(t *testing.T) {
+	const resourceID = "/subscriptions/sub1/resourceGroups/rg1/providers/Microsoft.HybridCompute/machines/vm1"
+
+	type seen struct {
+		method, userAgent, correlation string
+	}
+	newServer := func(got *[]seen) *httptest.Server {
+		var mu sync.Mutex
+		return httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			mu.Lock()
+			*got = append(*got, seen{r.Method, r.Header.Get("User-Agent"), r.Header.Get("x-ms-correlation-request-id")})
+			mu.Unlock()
+			w.Header().Set("Content-Type", "application/json")
+			w.Write([]byte(`{"relay":{"namespaceName":"ns","namespaceNameSuffix":"servicebus.windows.net","hybridConnectionName":"hc","accessKey":"k"}}`))
+		}))
+	}
+
+	t.Run("custom user agent and correlation id", func(t *testing.T) {
+		var got []seen
+		srv := newServer(&got)
+		defer srv.Close()
+
+		c := newTestClientWithOptions(t, srv, ClientOptions{
+			UserAgentSuffix: "contoso-ops/1.2",
+			CorrelationID:   "3f2c7d1e-corr",
+		})
+		if err := c.EnsureHybridConnectivity(context.Background(), resourceID, "SSH", 22); err != nil {
+			t.Fatalf("EnsureHybridConnectivity: %v", err)
+		}
+		if _, err := c.GetRelayCredentials(context.Background(), resourceID, "SSH"); err != nil {
+			t.Fatalf("GetRelayCredentials: %v", err)
+		}
+
+		if len(got) != 3 {
+			t.Fatalf("got %d requests, want 3", len(got))
+		}
+		for _, r := range got {
+			if !strings.HasSuffix(r.userAgent, " contoso-ops/1.2") {
+				t.Errorf("%s User-Agent = %q, want suffix %q", r.method, r.userAgent, "contoso-ops/1.2")
+			}
+			if !strings.Contains(r.userAgent, "aztunnel-arc") {
+				t.Errorf("%s User-Agent = %q, lost SDK module name", r.method, r.userAgent)
+			}
+			if r.correlation != "3f2c7d1e-corr" {
+				t.Errorf("%s correlation header = %q, want %q", r.method, r.correlation, "3f2c7d1e-corr")
+			}
+		}
+	})
+
+	t.Run("defaults send no tags", func(t *testing.T) {
+		var got []seen
+		srv := newServer(&got)
+		defer srv.Close()
+
+		c := newTestClient(t, srv)
+		if _, err := c.GetRelayCredentials(context.Background(), resourceID, "SSH"); err != nil {
+			t.Fatalf("GetRelayCredentials: %v", err)
+		}
+		if len(got) != 1 {
+			t.Fatalf("got %d requests, want 1", len(got))
+		}
+		if strings.Contains(got[0].userAgent, "contoso") {
+			t.Errorf("unexpected User-Agent suffix: %q", got[0].userAgent)
+		}
+		if got[0].correlation != "" {
+			t.Errorf("unexpected correlation header %q", got[0].correlation)
+		}
+	})
+}
+
 func TestARMErrorHandling(t *testing.T) {
 	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(http.StatusNotFound)
@@ -923,3 +1321,61 @@ func TestDialWithOptionsExplainSetup(t *testing.T) {
 		}
 	})
 }
+
+func TestDialWithOptionsCompression(t *testing.T) {
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ws, err := websocket.Accept(w, r, &websocket.AcceptOptions{CompressionMode: websocket.CompressionNoContextTakeover})
+		if err != nil {
+			return
+		}
+		defer ws.CloseNow()
+		_ = ws.Write(r.Context(), websocket.MessageBinary, []byte(strings.Repeat("compressible ", 256)))
+		<-r.Context().Done()
+	}))
+	defer srv.Close()
+
+	origTransport := http.DefaultTransport
+	http.DefaultTransport = &http.Transport{
+		TLSClientConfig: srv.Client().Transport.(*http.Transport).TLSClientConfig,
+	}
+	defer func() { http.DefaultTransport = origTransport }()
+
+	host := strings.TrimPrefix(srv.URL, "https://")
+	dotIdx := strings.Index(host, ".")
+	info := &RelayInfo{
+		NamespaceName:             host[:dotIdx],
+		NamespaceNameSuffix:       host[dotIdx+1:],
+		HybridConnectionName:      "test-hyco",
+		AccessKey:                 "test-key",
+		ServiceConfigurationToken: "test-token",
+	}
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	for _, compress := range []bool{false, true} {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		wire := new(relay.WireCounter)
+		ws, err := DialWithOptions(relay.WithWireCounter(ctx, wire), info, 22, logger, DialOptions{Compression: compress})
+		if err != nil {
+			cancel()
+			t.Fatalf("DialWithOptions(Compression: %v): %v", compress, err)
+		}
+		_, data, err := ws.Read(ctx)
+		_ = ws.CloseNow()
+		cancel()
+		if err != nil {
+			t.Fatalf("read: %v", err)
+		}
+		if wire.Deflate() != compress {
+			t.Errorf("Compression %v: Deflate() = %v", compress, wire.Deflate())
+		}
+		// Only a compressed dial counts its wire bytes, and the
+		// repetitive payload must shrink on the wire.
+		read, _ := wire.Bytes()
+		if compress && (read == 0 || read >= int64(len(data))) {
+			t.Errorf("wire read %d bytes for a %d-byte payload, want fewer", read, len(data))
+		}
+		if !compress && read != 0 {
+			t.Errorf("uncompressed dial counted %d wire bytes", read)
+		}
+	}
+}
@@ -0,0 +1,85 @@
+package arc
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/runtime"
+)
+
+const relayAPIVersion = "2021-11-01"
+
+// RelayNamespace is one Azure Relay namespace.
+type RelayNamespace struct {
+	Name          string `json:"name"`
+	ResourceGroup string `json:"resourceGroup"`
+	ID            string `json:"id"`
+}
+
+// armNameList is one page of an ARM list response, keeping only what
+// the Relay listings need.
+type armNameList struct {
+	Value []struct {
+		ID   string `json:"id"`
+		Name string `json:"name"`
+	} `json:"value"`
+	NextLink string `json:"nextLink"`
+}
+
+// ListRelayNamespaces returns the Azure Relay namespaces in
+// subscriptionID, following nextLink pages.
+func (c *Client) ListRelayNamespaces(ctx context.Context, subscriptionID string) ([]RelayNamespace, error) {
+	if subscriptionID == "" || strings.Contains(subscriptionID, "/") {
+		return nil, fmt.Errorf("invalid subscription ID %q", subscriptionID)
+	}
+	listPath := "/subscriptions/" + subscriptionID + "/providers/Microsoft.Relay/namespaces"
+	c.logger.Debug("listing relay namespaces", "subscription", subscriptionID)
+	var namespaces []RelayNamespace
+	err := c.listNames(ctx, listPath, func(id, name string) {
+		namespaces = append(namespaces, RelayNamespace{Name: name, ResourceGroup: resourceGroupOf(id), ID: id})
+	})
+	if err != nil {
+		return nil, fmt.Errorf("list relay namespaces: %w", err)
+	}
+	return namespaces, nil
+}
+
+// ListHybridConnections returns the names of the hybrid connections in
+// the Relay namespace with resource ID namespaceID, following nextLink
+// pages.
+func (c *Client) ListHybridConnections(ctx context.Context, namespaceID string) ([]string, error) {
+	if !strings.HasPrefix(namespaceID, "/subscriptions/") {
+		return nil, fmt.Errorf("invalid namespace resource ID %q", namespaceID)
+	}
+	var names []string
+	err := c.listNames(ctx, namespaceID+"/hybridConnections", func(_, name string) {
+		names = append(names, name)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("list hybrid connections: %w", err)
+	}
+	return names, nil
+}
+
+// listNames GETs every page of the Microsoft.Relay collection at
+// listPath and calls add for each resource in it.
+func (c *Client) listNames(ctx context.Context, listPath string, add func(id, name string)) error {
+	next := runtime.JoinPaths(c.arm.Endpoint(), listPath) + "?api-version=" + relayAPIVersion
+	for next != "" {
+		resp, err := c.armGET(ctx, next)
+		if err != nil {
+			return err
+		}
+		var page armNameList
+		if err := json.Unmarshal(resp, &page); err != nil {
+			return fmt.Errorf("parse response: %w", err)
+		}
+		for _, v := range page.Value {
+			add(v.ID, v.Name)
+		}
+		next = page.NextLink
+	}
+	return nil
+}
@@ -0,0 +1,73 @@
+package arc
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+func TestListRelayNamespaces(t *testing.T) {
+	const listPath = "/subscriptions/sub1/providers/Microsoft.Relay/namespaces"
+	const ns1 = "/subscriptions/sub1/resourceGroups/rg1/providers/Microsoft.Relay/namespaces/ns1"
+	const ns2 = "/subscriptions/sub1/resourceGroups/rg2/providers/Microsoft.Relay/namespaces/ns2"
+
+	var srv *httptest.Server
+	srv = httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet || r.URL.Path != listPath {
+			t.Errorf("request = %s %s, want GET %s", r.Method, r.URL.Path, listPath)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if r.URL.Query().Get("page") == "" {
+			if v := r.URL.Query().Get("api-version"); v != relayAPIVersion {
+				t.Errorf("api-version = %q, want %q", v, relayAPIVersion)
+			}
+			fmt.Fprintf(w, `{"value":[{"id":%q,"name":"ns1"}],"nextLink":%q}`,
+				ns1, srv.URL+listPath+"?api-version="+relayAPIVersion+"&page=2")
+			return
+		}
+		fmt.Fprintf(w, `{"value":[{"id":%q,"name":"ns2"}]}`, ns2)
+	}))
+	defer srv.Close()
+
+	c := newTestClient(t, srv)
+	got, err := c.ListRelayNamespaces(context.Background(), "sub1")
+	if err != nil {
+		t.Fatalf("ListRelayNamespaces: %v", err)
+	}
+	want := []RelayNamespace{
+		{Name: "ns1", ResourceGroup: "rg1", ID: ns1},
+		{Name: "ns2", ResourceGroup: "rg2", ID: ns2},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("namespaces = %+v, want %+v", got, want)
+	}
+
+	if _, err := c.ListRelayNamespaces(context.Background(), "sub1/../other"); err == nil {
+		t.Error("expected an error for a subscription ID with a slash")
+	}
+}
+
+func TestListHybridConnections(t *testing.T) {
+	const nsID = "/subscriptions/sub1/resourceGroups/rg1/providers/Microsoft.Relay/namespaces/ns1"
+
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != nsID+"/hybridConnections" {
+			t.Errorf("path = %s, want %s/hybridConnections", r.URL.Path, nsID)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintf(w, `{"value":[{"id":%q,"name":"ssh"},{"id":%q,"name":"rdp"}]}`, nsID+"/hybridConnections/ssh", nsID+"/hybridConnections/rdp")
+	}))
+	defer srv.Close()
+
+	c := newTestClient(t, srv)
+	got, err := c.ListHybridConnections(context.Background(), nsID)
+	if err != nil {
+		t.Fatalf("ListHybridConnections: %v", err)
+	}
+	if want := []string{"ssh", "rdp"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("hybrid connections = %v, want %v", got, want)
+	}
+}
@@ -60,6 +60,22 @@ var (
 	// surface the same label without explicit wrapping.
 	CauseTimeout = errors.New("bridge: timeout")
 
+	// CauseTooSlow indicates the minimum-throughput detector ended
+	// the bridge: data was flowing but fewer bytes than the configured
+	// rate arrived over the detector's window. Distinct from
+	// CauseTimeout, which covers a side that sends nothing at all.
+	CauseTooSlow = errors.New("bridge: too slow")
+
+	// CauseIdleTimeout indicates the bridge's idle timeout ended it:
+	// no bytes moved in either direction for the configured period.
+	// Unlike the other causes, Bridge also returns it as its error so
+	// connection metrics can count idle closes separately.
+	CauseIdleTimeout = errors.New("bridge: idle timeout")
+
+	// CauseAdminClose indicates an operator closed the bridge through
+	// the admin endpoint (POST /connections/{id}/close).
+	CauseAdminClose = errors.New("bridge: admin close")
+
 	// CauseUnknown is the fallback when no specific cause was stamped
 	// and the context error does not match any classified sentinel.
 	CauseUnknown = errors.New("bridge: unknown")
@@ -67,7 +83,7 @@ var (
 
 // Name returns a short, stable, structured-log-friendly label for
 // err: one of peer_close, local_close, user_cancel, renew_failure,
-// control_error, timeout, unknown.
+// control_error, timeout, too_slow, idle_timeout, admin_close, unknown.
 //
 // Recognised inputs include the bridgecause sentinels (matched via
 // errors.Is so wrapped errors work), context.Canceled (user_cancel),
@@ -89,6 +105,12 @@ func Name(err error) string {
 		return "control_error"
 	case errors.Is(err, CauseTimeout):
 		return "timeout"
+	case errors.Is(err, CauseTooSlow):
+		return "too_slow"
+	case errors.Is(err, CauseIdleTimeout):
+		return "idle_timeout"
+	case errors.Is(err, CauseAdminClose):
+		return "admin_close"
 	case errors.Is(err, context.DeadlineExceeded):
 		return "timeout"
 	case errors.Is(err, context.Canceled):
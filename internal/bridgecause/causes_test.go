@@ -25,6 +25,9 @@ func TestName_Sentinels(t *testing.T) {
 		{"RenewFailure", CauseRenewFailure, "renew_failure"},
 		{"ControlError", CauseControlError, "control_error"},
 		{"Timeout", CauseTimeout, "timeout"},
+		{"TooSlow", CauseTooSlow, "too_slow"},
+		{"IdleTimeout", CauseIdleTimeout, "idle_timeout"},
+		{"AdminClose", CauseAdminClose, "admin_close"},
 		{"Unknown", CauseUnknown, "unknown"},
 	}
 	for _, tc := range cases {
@@ -0,0 +1,88 @@
+package listener
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/coder/websocket"
+	"github.com/philsphicas/aztunnel/internal/relay"
+)
+
+// TestListenAndServe_AcceptWorkers runs a listener against a fake relay
+// that sends a burst of accepts, and checks Config.AcceptWorkers reaches
+// the control loop: no more rendezvous dials than workers are ever in
+// flight, where goroutine-per-accept would dial them all at once.
+func TestListenAndServe_AcceptWorkers(t *testing.T) {
+	const (
+		workers = 2
+		burst   = 8
+	)
+
+	var inFlight, maxInFlight, dialed atomic.Int32
+	rendezvous := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := inFlight.Add(1)
+		for {
+			m := maxInFlight.Load()
+			if n <= m || maxInFlight.CompareAndSwap(m, n) {
+				break
+			}
+		}
+		// Hold the dial so unbounded dials would overlap.
+		time.Sleep(50 * time.Millisecond)
+		inFlight.Add(-1)
+		dialed.Add(1)
+		http.Error(w, "gone", http.StatusGone)
+	}))
+	defer rendezvous.Close()
+
+	control := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ws, err := websocket.Accept(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer ws.CloseNow()
+		for i := range burst {
+			data, _ := json.Marshal(map[string]any{
+				"accept": map[string]any{"address": "wss" + strings.TrimPrefix(rendezvous.URL, "https"), "id": fmt.Sprintf("burst-%d", i)},
+			})
+			if err := ws.Write(r.Context(), websocket.MessageText, data); err != nil {
+				return
+			}
+		}
+		<-r.Context().Done()
+	}))
+	defer control.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	go func() {
+		_ = ListenAndServe(ctx, Config{
+			Endpoint:      strings.TrimPrefix(control.URL, "https://"),
+			EntityPath:    "test-hc",
+			TokenProvider: &relay.SASTokenProvider{KeyName: "k", Key: "dGVzdGtleQ=="},
+			ClientOptions: relay.ClientOptions{TLSConfig: control.Client().Transport.(*http.Transport).TLSClientConfig},
+			AcceptWorkers: workers,
+			AcceptBacklog: burst,
+			Logger:        slog.New(slog.NewTextHandler(io.Discard, nil)),
+		})
+	}()
+
+	for dialed.Load() < burst {
+		if ctx.Err() != nil {
+			t.Fatalf("%d of %d accepts dialed", dialed.Load(), burst)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if got := maxInFlight.Load(); got > workers {
+		t.Errorf("max concurrent rendezvous dials = %d, want <= %d (AcceptWorkers not applied)", got, workers)
+	}
+}
@@ -0,0 +1,112 @@
+package listener
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net"
+	"time"
+
+	"github.com/coder/websocket"
+	"github.com/philsphicas/aztunnel/internal/metrics"
+	"github.com/philsphicas/aztunnel/internal/protocol"
+	"github.com/philsphicas/aztunnel/internal/relay"
+)
+
+// serveBind handles a protocol.ModeBind envelope: listen on
+// env.BindAddr, report the bound address, wait up to the connect
+// timeout for one inbound connection, report its peer address, and
+// bridge it. The listen socket is closed as soon as one connection
+// arrives or the wait ends.
+func serveBind(ctx context.Context, ws *websocket.Conn, cfg Config, env protocol.ConnectEnvelope, lim Limits, logger *slog.Logger) {
+	logger.Info("bind requested", "bind_addr", env.BindAddr)
+
+	if !cfg.AllowBind {
+		logger.Warn("bind not enabled", "bind_addr", env.BindAddr)
+		_ = sendResponse(ctx, ws, cfg, false, "bind not enabled")
+		cfg.Metrics.ConnectionError("listener", metrics.ReasonModeNotAllowed)
+		return
+	}
+	if cfg.denied(env.BindAddr) {
+		logger.Warn("bind address denied", "bind_addr", env.BindAddr)
+		_ = sendResponseWithCode(ctx, ws, cfg, false, "bind address not allowed", protocol.CodeNotAllowed)
+		cfg.Metrics.ConnectionError("listener", metrics.ReasonDenylistRejected)
+		return
+	}
+	if !cfg.allowed(env.BindAddr) {
+		logger.Warn("bind address not allowed", "bind_addr", env.BindAddr)
+		_ = sendResponseWithCode(ctx, ws, cfg, false, "bind address not allowed", protocol.CodeNotAllowed)
+		cfg.Metrics.ConnectionError("listener", metrics.ReasonAllowlistRejected)
+		return
+	}
+
+	var lc net.ListenConfig
+	ln, err := lc.Listen(ctx, "tcp", env.BindAddr)
+	if err != nil {
+		logger.Warn("bind failed", "bind_addr", env.BindAddr, "error", err)
+		_ = sendResponse(ctx, ws, cfg, false, "bind failed")
+		cfg.Metrics.ConnectionError("listener", metrics.ReasonBindFailed)
+		return
+	}
+	defer ln.Close() //nolint:errcheck // best-effort cleanup
+	bound := ln.Addr().String()
+
+	if err := sendBindResponse(ctx, ws, cfg, protocol.ConnectResponse{OK: true, BoundAddr: bound}); err != nil {
+		logger.Warn("failed to send response", "error", err)
+		return
+	}
+	logger.Info("bind listening", "bound_addr", bound)
+
+	// Bound the wait by the connect timeout, and by ctx so a listener
+	// shutdown does not sit out the full timeout.
+	_ = ln.(*net.TCPListener).SetDeadline(time.Now().Add(lim.ConnectTimeout))
+	stop := context.AfterFunc(ctx, func() { _ = ln.Close() })
+	conn, err := ln.Accept()
+	stop()
+	_ = ln.Close()
+	if err != nil {
+		logger.Warn("no inbound connection for bind", "bound_addr", bound, "error", err)
+		_ = sendBindResponse(ctx, ws, cfg, protocol.ConnectResponse{
+			Error: "no inbound connection",
+			Code:  protocol.CodeTimeout,
+		})
+		cfg.Metrics.ConnectionError("listener", metrics.ReasonBindFailed)
+		return
+	}
+	defer conn.Close() //nolint:errcheck // best-effort cleanup
+	relay.SetTCPKeepAlive(conn, lim.TCPKeepAlive)
+
+	peer := conn.RemoteAddr().String()
+	if err := sendBindResponse(ctx, ws, cfg, protocol.ConnectResponse{OK: true, BoundAddr: bound, PeerAddr: peer}); err != nil {
+		logger.Warn("failed to send response", "error", err)
+		return
+	}
+	logger.Info("bind accepted", "bound_addr", bound, "peer_addr", peer)
+
+	bctx := relay.WithBridgeLogger(ctx, logger)
+	bctx = metrics.WithConnID(bctx, env.BridgeID)
+	bctx = metrics.WithConnLabels(bctx, connLabels(conn, cfg.Endpoint))
+	bctx = metrics.WithClientAddr(bctx, env.Metadata[protocol.MetaClientAddr])
+	opts := relay.BridgeOptions{BufferSize: cfg.BufferSize, IdleTimeout: cfg.IdleTimeout, RateLimit: cfg.RateLimit, PingInterval: cfg.DataPingInterval}
+	result, bridgeErr := cfg.Metrics.TrackedBridgeWithOptions(bctx, ws, conn, "listener", bound, opts)
+	attrs := []any{
+		"bound_addr", bound,
+		"peer_addr", peer,
+		"cause", result.EndCause,
+		"tcp_to_ws", result.Stats.TCPToWS,
+		"ws_to_tcp", result.Stats.WSToTCP,
+	}
+	if bridgeErr != nil {
+		attrs = append(attrs, "error", bridgeErr)
+	}
+	logger.Debug("bridge ended", attrs...)
+}
+
+// sendBindResponse sends resp stamped with the protocol version and
+// this listener's ID.
+func sendBindResponse(ctx context.Context, ws *websocket.Conn, cfg Config, resp protocol.ConnectResponse) error {
+	resp.Version = protocol.CurrentVersion
+	resp.ListenerID = cfg.ListenerID
+	data, _ := json.Marshal(resp) // simple struct, cannot fail
+	return ws.Write(ctx, websocket.MessageText, data)
+}
@@ -0,0 +1,186 @@
+package listener
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/coder/websocket"
+	"github.com/philsphicas/aztunnel/internal/metrics"
+	"github.com/philsphicas/aztunnel/internal/protocol"
+)
+
+// startBindSession serves handleConnection(cfg) over an httptest
+// WebSocket, sends a bind envelope for bindAddr, and returns the
+// client WebSocket with the first response.
+func startBindSession(t *testing.T, ctx context.Context, cfg Config, bindAddr string) (*websocket.Conn, protocol.ConnectResponse) {
+	t.Helper()
+	applyDefaults(&cfg)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ws, err := websocket.Accept(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer ws.CloseNow() //nolint:errcheck // best-effort cleanup
+		handleConnection(r.Context(), ws, cfg)
+	}))
+	t.Cleanup(srv.Close)
+
+	ws, _, err := websocket.Dial(ctx, "ws"+strings.TrimPrefix(srv.URL, "http"), nil)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	t.Cleanup(func() { _ = ws.CloseNow() })
+
+	env, _ := json.Marshal(protocol.ConnectEnvelope{
+		Version:  protocol.CurrentVersion,
+		Mode:     protocol.ModeBind,
+		BindAddr: bindAddr,
+		BridgeID: "BINDTEST",
+	})
+	if err := ws.Write(ctx, websocket.MessageText, env); err != nil {
+		t.Fatalf("write envelope: %v", err)
+	}
+	return ws, readResponse(t, ctx, ws)
+}
+
+func readResponse(t *testing.T, ctx context.Context, ws *websocket.Conn) protocol.ConnectResponse {
+	t.Helper()
+	_, data, err := ws.Read(ctx)
+	if err != nil {
+		t.Fatalf("read response: %v", err)
+	}
+	var resp protocol.ConnectResponse
+	if err := json.Unmarshal(data, &resp); err != nil {
+		t.Fatalf("parse response: %v", err)
+	}
+	return resp
+}
+
+func bindTestConfig() Config {
+	return Config{
+		AllowBind: true,
+		Logger:    slog.New(slog.NewTextHandler(io.Discard, nil)),
+		Metrics:   metrics.New(),
+	}
+}
+
+func TestServeBind_RelaysInboundConnection(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	ws, resp := startBindSession(t, ctx, bindTestConfig(), "127.0.0.1:0")
+	if !resp.OK {
+		t.Fatalf("bind response not OK: error=%q code=%q", resp.Error, resp.Code)
+	}
+	host, port, err := net.SplitHostPort(resp.BoundAddr)
+	if err != nil || host != "127.0.0.1" || port == "0" {
+		t.Fatalf("BoundAddr = %q, want 127.0.0.1 with a real port", resp.BoundAddr)
+	}
+	if resp.PeerAddr != "" {
+		t.Errorf("first response PeerAddr = %q, want empty", resp.PeerAddr)
+	}
+
+	inbound, err := net.Dial("tcp", resp.BoundAddr)
+	if err != nil {
+		t.Fatalf("dial bound address: %v", err)
+	}
+	defer inbound.Close() //nolint:errcheck // best-effort cleanup
+
+	resp = readResponse(t, ctx, ws)
+	if !resp.OK {
+		t.Fatalf("accept response not OK: error=%q code=%q", resp.Error, resp.Code)
+	}
+	if resp.PeerAddr != inbound.LocalAddr().String() {
+		t.Errorf("PeerAddr = %q, want %q", resp.PeerAddr, inbound.LocalAddr())
+	}
+
+	// The listen socket is single-use.
+	if c, err := net.DialTimeout("tcp", resp.BoundAddr, time.Second); err == nil {
+		_ = c.Close()
+		t.Error("bound address still accepting after the first connection")
+	}
+
+	// inbound -> relay
+	if _, err := inbound.Write([]byte("ping")); err != nil {
+		t.Fatalf("inbound write: %v", err)
+	}
+	_, got, err := ws.Read(ctx)
+	if err != nil || string(got) != "ping" {
+		t.Fatalf("ws read = %q, %v; want ping", got, err)
+	}
+
+	// relay -> inbound
+	if err := ws.Write(ctx, websocket.MessageBinary, []byte("pong")); err != nil {
+		t.Fatalf("ws write: %v", err)
+	}
+	buf := make([]byte, 4)
+	_ = inbound.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.ReadFull(inbound, buf); err != nil || string(buf) != "pong" {
+		t.Fatalf("inbound read = %q, %v; want pong", buf, err)
+	}
+}
+
+func TestServeBind_NoInboundTimesOut(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	cfg := bindTestConfig()
+	cfg.ConnectTimeout = 100 * time.Millisecond
+	ws, resp := startBindSession(t, ctx, cfg, "127.0.0.1:0")
+	if !resp.OK || resp.BoundAddr == "" {
+		t.Fatalf("bind response = %+v, want OK with BoundAddr", resp)
+	}
+
+	resp = readResponse(t, ctx, ws)
+	if resp.OK || resp.Code != protocol.CodeTimeout {
+		t.Errorf("second response = %+v, want OK=false code=%q", resp, protocol.CodeTimeout)
+	}
+}
+
+func TestServeBind_Rejections(t *testing.T) {
+	tests := []struct {
+		name      string
+		allowBind bool
+		allow     []string
+		bindAddr  string
+		wantErr   string
+	}{
+		{"disabled", false, nil, "127.0.0.1:0", "bind not enabled"},
+		{"not allowed", true, []string{"10.0.0.0/8:*"}, "127.0.0.1:0", "bind address not allowed"},
+		{"missing address", true, nil, "", "missing bind address"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+			cfg := bindTestConfig()
+			cfg.AllowBind = tt.allowBind
+			cfg.AllowList = tt.allow
+			_, resp := startBindSession(t, ctx, cfg, tt.bindAddr)
+			if resp.OK || resp.Error != tt.wantErr {
+				t.Errorf("response = %+v, want OK=false error=%q", resp, tt.wantErr)
+			}
+			if resp.BoundAddr != "" {
+				t.Errorf("rejected bind reported BoundAddr %q", resp.BoundAddr)
+			}
+		})
+	}
+}
+
+func TestServeEnvelope_UnsupportedMode(t *testing.T) {
+	resp := driveCustomHandshake(t, bindTestConfig(), func(ctx context.Context, ws *websocket.Conn) error {
+		data, _ := json.Marshal(protocol.ConnectEnvelope{Version: protocol.CurrentVersion, Target: "127.0.0.1:1", Mode: "tun"})
+		return ws.Write(ctx, websocket.MessageText, data)
+	})
+	if resp.OK || resp.Error != "unsupported mode" {
+		t.Errorf("response = %+v, want OK=false error=%q", resp, "unsupported mode")
+	}
+}
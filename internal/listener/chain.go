@@ -0,0 +1,109 @@
+package listener
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+
+	"github.com/coder/websocket"
+	"github.com/philsphicas/aztunnel/internal/metrics"
+	"github.com/philsphicas/aztunnel/internal/protocol"
+	"github.com/philsphicas/aztunnel/internal/relay"
+)
+
+// Upstream is a second relay hybrid connection that a chaining
+// listener forwards every accepted connection to.
+type Upstream struct {
+	Endpoint      string
+	EntityPath    string
+	TokenProvider relay.TokenProvider
+	ClientOptions relay.ClientOptions
+}
+
+// serveChained forwards env to cfg.Upstream as a sender would, asking
+// for target (env.Target after any TargetMap lookup), relays the
+// upstream listener's answer back, and on success bridges the two
+// rendezvous WebSockets. The upstream dial and its response are both
+// bounded by the connect timeout.
+func serveChained(ctx context.Context, ws *websocket.Conn, cfg Config, env protocol.ConnectEnvelope, target string, lim Limits, logger *slog.Logger) {
+	up := cfg.Upstream
+	dialCtx, cancel := context.WithTimeout(ctx, lim.ConnectTimeout)
+	defer cancel()
+
+	peer, err := cfg.Metrics.InstrumentedDial(dialCtx, up.Endpoint, up.EntityPath, up.TokenProvider, up.ClientOptions, "listener", logger)
+	if err != nil {
+		logger.Warn("upstream relay dial failed", "target", env.Target, "upstream", up.Endpoint, "error", err)
+		_ = sendResponse(ctx, ws, cfg, false, "connection failed")
+		return
+	}
+	defer peer.CloseNow() //nolint:errcheck // best-effort cleanup
+
+	fwd := env
+	fwd.Target = target
+	resp, err := forwardEnvelope(dialCtx, peer, fwd)
+	if err != nil {
+		logger.Warn("upstream envelope exchange failed", "target", env.Target, "upstream", up.Endpoint, "error", err)
+		_ = sendResponse(ctx, ws, cfg, false, "connection failed")
+		cfg.Metrics.ConnectionError("listener", metrics.ReasonRelayFailed)
+		return
+	}
+	if !resp.OK {
+		// The upstream listener already sanitized its message, so it
+		// is passed through along with the code.
+		logger.Warn("upstream rejected connection", "target", env.Target, "error", resp.Error, "code", resp.Code, "upstream_listener_id", resp.ListenerID)
+		_ = sendResponseWithCode(ctx, ws, cfg, false, resp.Error, resp.Code)
+		cfg.Metrics.ConnectionError("listener", metrics.ReasonDialFailed)
+		return
+	}
+	logger.Info("upstream accepted connection", "target", env.Target, "upstream_listener_id", resp.ListenerID)
+
+	// Pipelining is not offered across a chain. The target socket is
+	// the upstream listener's, so its address is passed through.
+	if err := sendAccept(ctx, ws, cfg, nil, nil, resp.LocalAddr); err != nil {
+		logger.Warn("failed to send response", "error", err)
+		return
+	}
+
+	bctx := relay.WithBridgeLogger(ctx, logger)
+	bctx = metrics.WithConnID(bctx, env.BridgeID)
+	bctx = metrics.WithClientAddr(bctx, env.Metadata[protocol.MetaClientAddr])
+	result, bridgeErr := cfg.Metrics.TrackedBridgeWS(bctx, ws, peer, "listener", env.Target, relay.BridgeOptions{PingInterval: cfg.DataPingInterval})
+	attrs := []any{
+		"target", env.Target,
+		"cause", result.EndCause,
+		"upstream_to_ws", result.Stats.TCPToWS,
+		"ws_to_upstream", result.Stats.WSToTCP,
+	}
+	if bridgeErr != nil {
+		attrs = append(attrs, "error", bridgeErr)
+	}
+	if code, ok := relay.WSCloseCode(bridgeErr); ok {
+		attrs = append(attrs, "close_code", code)
+	}
+	logger.Debug("bridge ended", attrs...)
+}
+
+// forwardEnvelope sends the connect part of env (target, metadata,
+// and bridge ID, so logs on every hop correlate) on peer and reads
+// the upstream listener's response.
+func forwardEnvelope(ctx context.Context, peer *websocket.Conn, env protocol.ConnectEnvelope) (protocol.ConnectResponse, error) {
+	data, _ := json.Marshal(protocol.ConnectEnvelope{ // simple struct, cannot fail
+		Version:  protocol.CurrentVersion,
+		Target:   env.Target,
+		Metadata: env.Metadata,
+		BridgeID: env.BridgeID,
+	})
+	if err := peer.Write(ctx, websocket.MessageText, data); err != nil {
+		return protocol.ConnectResponse{}, fmt.Errorf("send envelope: %w", err)
+	}
+	_, respData, err := peer.Read(ctx)
+	if err != nil {
+		return protocol.ConnectResponse{}, fmt.Errorf("read response: %w", err)
+	}
+	var resp protocol.ConnectResponse
+	if err := json.Unmarshal(respData, &resp); err != nil {
+		return protocol.ConnectResponse{}, fmt.Errorf("parse response: %w", err)
+	}
+	return resp, nil
+}
@@ -0,0 +1,22 @@
+package listener
+
+import (
+	"io"
+	"net"
+)
+
+// newEchoConn returns an in-memory net.Conn that writes back every
+// byte read from it. It stands in for the dialed target in --echo
+// diagnostic mode so a hybrid connection can be validated end to end
+// with any sender and no backend.
+//
+// The echo goroutine exits, and closes its half of the pipe, once the
+// returned conn is closed.
+func newEchoConn() net.Conn {
+	client, server := net.Pipe()
+	go func() {
+		defer server.Close() //nolint:errcheck // best-effort cleanup
+		_, _ = io.Copy(server, server)
+	}()
+	return client
+}
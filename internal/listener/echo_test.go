@@ -0,0 +1,93 @@
+package listener
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/coder/websocket"
+	"github.com/philsphicas/aztunnel/internal/metrics"
+	"github.com/philsphicas/aztunnel/internal/protocol"
+)
+
+// TestHandleConnection_EchoRoundTrip plays the sender side against an
+// --echo listener: the target is unresolvable and outside the
+// allowlist, yet the handshake succeeds and written bytes come back
+// unchanged because echo mode never consults either.
+func TestHandleConnection_EchoRoundTrip(t *testing.T) {
+	cfg := Config{
+		AllowList: []string{"10.0.0.1:22"},
+		Echo:      true,
+		Logger:    slog.New(slog.NewTextHandler(io.Discard, nil)),
+		Metrics:   metrics.New(),
+	}
+	applyDefaults(&cfg)
+
+	done := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer close(done)
+		ws, err := websocket.Accept(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer ws.CloseNow() //nolint:errcheck // best-effort cleanup
+		handleConnection(r.Context(), ws, cfg)
+	}))
+	defer srv.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	ws, _, err := websocket.Dial(ctx, "ws"+strings.TrimPrefix(srv.URL, "http"), nil)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer ws.CloseNow() //nolint:errcheck // best-effort cleanup
+
+	env, _ := json.Marshal(protocol.ConnectEnvelope{Version: protocol.CurrentVersion, Target: "nowhere.invalid:1"})
+	if err := ws.Write(ctx, websocket.MessageText, env); err != nil {
+		t.Fatalf("write envelope: %v", err)
+	}
+	_, data, err := ws.Read(ctx)
+	if err != nil {
+		t.Fatalf("read response: %v", err)
+	}
+	var resp protocol.ConnectResponse
+	if err := json.Unmarshal(data, &resp); err != nil {
+		t.Fatalf("parse response: %v", err)
+	}
+	if !resp.OK {
+		t.Fatalf("expected OK response, got error=%q code=%q", resp.Error, resp.Code)
+	}
+
+	for _, msg := range [][]byte{[]byte("hello"), bytes.Repeat([]byte{0xAB}, 16*1024)} {
+		if err := ws.Write(ctx, websocket.MessageBinary, msg); err != nil {
+			t.Fatalf("write: %v", err)
+		}
+		var got []byte
+		for len(got) < len(msg) {
+			_, chunk, err := ws.Read(ctx)
+			if err != nil {
+				t.Fatalf("read echo: %v", err)
+			}
+			got = append(got, chunk...)
+		}
+		if !bytes.Equal(got, msg) {
+			t.Fatalf("echo mismatch: got %d bytes, want %d", len(got), len(msg))
+		}
+	}
+
+	_ = ws.Close(websocket.StatusNormalClosure, "done")
+	select {
+	case <-done:
+	case <-ctx.Done():
+		t.Fatalf("handler did not return: %v", ctx.Err())
+	}
+}
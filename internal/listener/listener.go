@@ -8,9 +8,11 @@ import (
 	"context"
 	"encoding/json"
 	"errors"
-	"fmt"
 	"log/slog"
 	"net"
+	"net/netip"
+	"strings"
+	"sync"
 	"syscall"
 	"time"
 
@@ -19,6 +21,8 @@ import (
 	"github.com/philsphicas/aztunnel/internal/metrics"
 	"github.com/philsphicas/aztunnel/internal/protocol"
 	"github.com/philsphicas/aztunnel/internal/relay"
+	"github.com/philsphicas/aztunnel/internal/tracing"
+	"golang.org/x/net/proxy"
 )
 
 // Config holds relay-listener configuration.
@@ -28,11 +32,41 @@ type Config struct {
 	TokenProvider  relay.TokenProvider
 	ClientOptions  relay.ClientOptions
 	AllowList      []string // Optional target allowlist (CIDR:port patterns)
+	DenyList       []string // Optional target denylist; overrides AllowList
 	MaxConnections int
+	// AcceptOverflow and AcceptQueueTimeout choose whether an accept
+	// arriving at MaxConnections is dropped or waits for a slot; see
+	// relay.ControlConfig.
+	AcceptOverflow     string
+	AcceptQueueTimeout time.Duration
+	// AcceptWorkers and AcceptBacklog configure the relay control
+	// loop's rendezvous worker pool; see relay.ControlConfig. Zero
+	// workers keeps one goroutine per accept.
+	AcceptWorkers  int
+	AcceptBacklog  int
 	ConnectTimeout time.Duration
 	TCPKeepAlive   time.Duration
 	Logger         *slog.Logger
 	Metrics        *metrics.Metrics // optional; nil disables metrics
+	Tracer         *tracing.Tracer  // optional; nil disables tracing
+	// Readiness, if non-nil, tracks whether the control channel is
+	// connected for the standalone /readyz endpoint.
+	Readiness *metrics.Readiness
+	// OnReady, if non-nil, is called each time the listener becomes
+	// ready: a control channel connects and, under MultiListen, every
+	// other hybrid connection's is connected too. It runs on the
+	// control loop's goroutine and must not block.
+	OnReady func()
+
+	// MetadataLimits bounds the connect envelope's Metadata map.
+	// Zero fields use protocol.DefaultMetadataLimits.
+	MetadataLimits protocol.MetadataLimits
+
+	// Echo is a diagnostic mode: instead of dialing the requested
+	// target, every accepted connection is bridged to an in-memory
+	// echo. The allowlist and target dial are bypassed entirely, so
+	// never enable this on a listener that serves real traffic.
+	Echo bool
 
 	// ListenerID is the per-listener-process correlation identifier
 	// stamped onto every ConnectResponse this listener sends. Callers
@@ -41,6 +75,86 @@ type Config struct {
 	// to a known string for deterministic assertions.
 	ListenerID string
 
+	// AllowBind accepts protocol.ModeBind envelopes: the listener
+	// opens a short-lived listen socket on the requested address
+	// (subject to AllowList) and relays the first inbound connection.
+	// Off by default.
+	AllowBind bool
+
+	// AllowUDP accepts protocol.ModeUDP envelopes: the listener relays
+	// datagrams between the sender and destinations the deny and
+	// allow lists permit (see serveUDP). Off by default.
+	AllowUDP bool
+
+	// AllowMux accepts protocol.ModeMux sessions: the sender carries
+	// many connections as streams over one rendezvous, each counted
+	// against MaxConnections like a connection of its own (see
+	// serveMux). Off by default.
+	AllowMux bool
+
+	// ProbeTarget briefly reads from each new target connection before
+	// reporting success, so a backend that accepts and then closes or
+	// resets at once is rejected instead of failing on the first
+	// write (see probeTarget). Adds up to probeTimeout to connection
+	// setup for targets that wait for the client to speak first.
+	ProbeTarget bool
+
+	// TargetDialRetries is how many more times a target dial that is
+	// refused or finds the host or network unreachable is tried, so a
+	// target restarting for a moment is not reported down. Retries wait
+	// TargetDialBackoff, doubling each time, and all attempts share the
+	// ConnectTimeout budget. Zero (the default) dials once.
+	TargetDialRetries int
+	// TargetDialBackoff is the wait before the first retry. Zero means
+	// 200ms.
+	TargetDialBackoff time.Duration
+
+	// ProxyProtocol writes a PROXY protocol v2 header to each new
+	// target connection before any client data, carrying the client
+	// address the sender reported in protocol.MetaClientAddr (see
+	// proxyHeaderV2). The target must expect the header. Not applied
+	// to Echo or chained (Upstream) connections. Off by default.
+	ProxyProtocol bool
+
+	// Upstream, when non-nil, chains this listener to a second relay:
+	// each allowed connection is forwarded to Upstream's hybrid
+	// connection with the same target and bridge ID, and the two
+	// rendezvous WebSockets are bridged, instead of dialing the target
+	// here. The listener behind Upstream dials the target.
+	Upstream *Upstream
+
+	// Resolver, when non-nil, resolves target hostnames in place of
+	// the system resolver (see relay.NewResolver).
+	Resolver *net.Resolver
+
+	// DialSource, when valid, is the local address target dials and
+	// UDP sessions bind to, so a multi-homed host reaches targets
+	// through the interface that owns it. The zero Addr lets the
+	// kernel choose.
+	DialSource netip.Addr
+
+	// DialFamily restricts target dials to one address family: "ipv4"
+	// dials tcp4 and "ipv6" tcp6, so a name with both A and AAAA
+	// records never waits on a family that is black-holed. Empty or
+	// "auto" dials tcp and lets the dialer pick.
+	DialFamily string
+
+	// UpstreamSOCKS, when set, is the host:port of a SOCKS5 proxy that
+	// target connections are made through, for a listener host that
+	// can only reach targets that way. The proxy resolves target
+	// hostnames; DialSource and the TCP keepalive apply to the
+	// connection to the proxy. Not used for bind sessions; the
+	// relay-listener command refuses it together with AllowUDP, since
+	// UDP would bypass the proxy.
+	UpstreamSOCKS string
+
+	// AllowResolve lets a hostname target that no allowlist entry
+	// names through when it resolves to allowed IPs, typically ones
+	// under a CIDR entry. The name is resolved once and only the
+	// allowed IPs are dialed. Not applied to chained (Upstream)
+	// sessions, whose target is resolved by the next listener.
+	AllowResolve bool
+
 	// dialContext optionally overrides target dialing. When nil,
 	// handleConnection uses a net.Dialer honouring ConnectTimeout.
 	dialContext func(ctx context.Context, network, addr string) (net.Conn, error)
@@ -50,6 +164,98 @@ type Config struct {
 	// package default (45m). Set a short value in tests that want to
 	// exercise a real renew round-trip within an assertion budget.
 	RenewInterval time.Duration
+
+	// PingInterval is how often the control channel is pinged; see
+	// relay.ControlConfig.PingInterval. Zero selects the relay package
+	// default (30s).
+	PingInterval time.Duration
+
+	// ControlIdleReconnect forces a control-channel reconnect after
+	// this long without a control message while no connection is in
+	// flight; see relay.ControlConfig.IdleReconnect. Zero disables it.
+	ControlIdleReconnect time.Duration
+
+	// MaxMessageSize caps each WebSocket message read on the control
+	// channel and rendezvous connections; see
+	// relay.ControlConfig.MaxMessageSize. Zero selects
+	// relay.DefaultMaxMessageSize.
+	MaxMessageSize int64
+
+	// PipelineIdleTimeout bounds the wait for the next envelope on a
+	// pipelined rendezvous; the listener closes one left idle longer,
+	// freeing its connection slot. Zero uses 60s.
+	PipelineIdleTimeout time.Duration
+
+	// MinThroughput ends a bridge whose target, once it has started
+	// sending, delivers fewer bytes than the configured rate over the
+	// window (cause too_slow). The zero value disables it. Pipelined
+	// sessions are not checked.
+	MinThroughput relay.MinThroughput
+
+	// BufferSize is the bridge copy buffer size; see
+	// relay.BridgeOptions.BufferSize. Zero uses the default.
+	BufferSize int
+
+	// IdleTimeout closes a bridged connection that has moved no data
+	// for this long; see relay.BridgeOptions.IdleTimeout. Zero
+	// disables it.
+	IdleTimeout time.Duration
+
+	// RateLimit caps each direction of a bridged connection in
+	// bytes/sec; see relay.BridgeOptions.RateLimit. Zero is unlimited.
+	RateLimit int64
+
+	// DataPingInterval is how long a bridged connection's WebSocket
+	// may go without sending before it is pinged; see
+	// relay.BridgeOptions.PingInterval. Zero selects the relay package
+	// default (30s); a negative value disables pings.
+	DataPingInterval time.Duration
+
+	// AllowFile, when set, names a file of further allowlist entries,
+	// one per line, re-read on SIGHUP. With it set the allowlist is
+	// always enforced, so an empty file permits no targets.
+	AllowFile string
+
+	// DenyFile, when set, names a file of further denylist entries,
+	// loaded and re-read like AllowFile.
+	DenyFile string
+
+	// TargetMap maps aliases senders may request to the real targets
+	// the listener dials, so senders never learn backend addresses.
+	// The deny and allow lists apply to the real target; logs, metrics
+	// labels, and responses keep the alias.
+	TargetMap map[string]string
+
+	// MapFile, when set, names a file of further alias=host:port
+	// mappings, one per line, re-read on SIGHUP. TargetMap entries win
+	// over the file's.
+	MapFile string
+
+	// Reload, when non-nil, is called on SIGHUP to fetch fresh
+	// MaxConnections/ConnectTimeout/TCPKeepAlive values. The result
+	// applies to connections accepted afterwards; in-flight
+	// connections keep the values they started with. An error (or an
+	// invalid result) is logged and the current limits are kept.
+	Reload func() (Limits, error)
+
+	// live holds the effective Limits. applyDefaults seeds it from the
+	// static fields above; reloads swap it atomically.
+	live *liveLimits
+
+	// allow holds the effective allowlist when AllowFile is set:
+	// AllowList plus the file's entries, swapped on each reload.
+	allow *liveList
+
+	// deny holds the effective denylist when DenyFile is set.
+	deny *liveList
+
+	// targets holds the effective alias table when MapFile is set.
+	targets *liveMap
+
+	// control, when set by MultiListen, tracks every hybrid
+	// connection's control channel so Readiness reports ready only
+	// while all of them are connected.
+	control *controlSet
 }
 
 // applyDefaults fills in zero-valued config fields with their
@@ -73,72 +279,303 @@ func applyDefaults(cfg *Config) {
 	if cfg.TCPKeepAlive == 0 {
 		cfg.TCPKeepAlive = 30 * time.Second
 	}
+	if cfg.PipelineIdleTimeout == 0 {
+		cfg.PipelineIdleTimeout = 60 * time.Second
+	}
+	if cfg.TargetDialBackoff == 0 {
+		cfg.TargetDialBackoff = 200 * time.Millisecond
+	}
 	if cfg.ListenerID == "" {
 		cfg.ListenerID = idgen.NewListenerID()
 	}
+	if cfg.live == nil {
+		cfg.live = &liveLimits{}
+		l := Limits{
+			MaxConnections: cfg.MaxConnections,
+			ConnectTimeout: cfg.ConnectTimeout,
+			TCPKeepAlive:   cfg.TCPKeepAlive,
+		}
+		cfg.live.p.Store(&l)
+	}
 	cfg.Logger = cfg.Logger.With("listener_id", cfg.ListenerID)
 }
 
 // ListenAndServe starts the relay-listener. It blocks until ctx is cancelled.
 func ListenAndServe(ctx context.Context, cfg Config) error {
 	applyDefaults(&cfg)
+	if cfg.AllowFile != "" {
+		if err := loadAllowFile(&cfg); err != nil {
+			return err
+		}
+	}
+	if cfg.DenyFile != "" {
+		if err := loadDenyFile(&cfg); err != nil {
+			return err
+		}
+	}
+	if cfg.MapFile != "" {
+		if err := loadMapFile(&cfg); err != nil {
+			return err
+		}
+	}
 
-	if len(cfg.AllowList) == 0 {
+	switch {
+	case cfg.Echo:
+		cfg.Logger.Warn("echo diagnostic mode enabled: connections are echoed back, targets are never dialed")
+	case len(cfg.AllowList) == 0 && cfg.AllowFile == "":
 		cfg.Logger.Warn("no allowlist configured, all targets will be permitted")
 	}
+	// Quiescing is toggled through the metrics server's admin
+	// endpoints and checked on every envelope.
+	cfg.Metrics.EnableQuiesce()
+	// Report the control channel down until it first connects, so the
+	// metrics server's /readyz fails until then.
+	cfg.Metrics.SetControlChannelConnected(cfg.EntityPath, false)
 
 	ctrlCfg := relay.ControlConfig{
 		Endpoint:       cfg.Endpoint,
 		EntityPath:     cfg.EntityPath,
 		TokenProvider:  cfg.TokenProvider,
 		Options:        cfg.ClientOptions,
-		MaxConnections: cfg.MaxConnections,
 		Logger:         cfg.Logger,
 		RenewInterval:  cfg.RenewInterval,
+		PingInterval:   cfg.PingInterval,
+		AcceptWorkers:  cfg.AcceptWorkers,
+		AcceptBacklog:  cfg.AcceptBacklog,
+		IdleReconnect:  cfg.ControlIdleReconnect,
+		MaxMessageSize: cfg.MaxMessageSize,
 		Handler: func(ctx context.Context, ws *websocket.Conn) {
+			cfg.Metrics.HycoAccept(cfg.EntityPath)
 			handleConnection(ctx, ws, cfg)
 		},
+		AcceptOverflow:     cfg.AcceptOverflow,
+		AcceptQueueTimeout: cfg.AcceptQueueTimeout,
+	}
+	ctrlCfg.MaxConnectionsFunc = func() int { return cfg.limits().MaxConnections }
+	ctrlCfg.OnAcceptDropped = func(reason string) {
+		switch reason {
+		case relay.AcceptDroppedQueueFull:
+			cfg.Metrics.ConnectionError("listener", metrics.ReasonAcceptQueueFull)
+		case relay.AcceptDroppedOverflowFull:
+			cfg.Metrics.ConnectionError("listener", metrics.ReasonAcceptOverflowFull)
+		}
+	}
+	ctrlCfg.OnConnect = func() {
+		cfg.Metrics.SetControlChannelConnected(cfg.EntityPath, true)
+		cfg.Metrics.SetControlReconnectDelay(cfg.EntityPath, 0)
+		ready := cfg.control.set(cfg.EntityPath, true)
+		cfg.Readiness.SetReady(ready)
+		if ready && cfg.OnReady != nil {
+			cfg.OnReady()
+		}
+	}
+	ctrlCfg.OnDisconnect = func() {
+		cfg.Metrics.SetControlChannelConnected(cfg.EntityPath, false)
+		cfg.Readiness.SetReady(cfg.control.set(cfg.EntityPath, false))
+	}
+	ctrlCfg.OnError = func(err error) {
+		reason := relay.ControlEndedReadFailed
+		var ce *relay.ControlError
+		if errors.As(err, &ce) {
+			reason = ce.Reason
+		}
+		cfg.Metrics.ControlReconnect(cfg.EntityPath, reason)
+	}
+	ctrlCfg.OnReconnect = func(delay time.Duration) {
+		cfg.Metrics.SetControlReconnectDelay(cfg.EntityPath, delay)
+	}
+
+	if cfg.Reload != nil || cfg.AllowFile != "" || cfg.DenyFile != "" || cfg.MapFile != "" {
+		stop := notifyReload(ctx, &cfg)
+		defer stop()
 	}
-	ctrlCfg.OnConnect = func() { cfg.Metrics.SetControlChannelConnected(true) }
-	ctrlCfg.OnDisconnect = func() { cfg.Metrics.SetControlChannelConnected(false) }
 
 	return relay.ListenAndServe(ctx, ctrlCfg)
 }
 
+// MultiListen serves every hybrid connection in entityPaths from one
+// process: each gets its own ListenAndServe control loop, with its own
+// reconnect backoff, under a context shared by all of them.
+// cfg.EntityPath is ignored. The loops share cfg's ListenerID,
+// metrics, and readiness, which reports ready only while every control
+// channel is connected; MaxConnections applies to each hybrid
+// connection separately. If one loop fails to start the others are
+// cancelled. MultiListen returns once all of them have stopped.
+func MultiListen(ctx context.Context, cfg Config, entityPaths []string) error {
+	if len(entityPaths) == 0 {
+		return errors.New("no hybrid connection to listen on")
+	}
+	if len(entityPaths) == 1 {
+		cfg.EntityPath = entityPaths[0]
+		return ListenAndServe(ctx, cfg)
+	}
+	if cfg.Logger == nil {
+		cfg.Logger = slog.Default()
+	}
+	if cfg.ListenerID == "" {
+		cfg.ListenerID = idgen.NewListenerID()
+	}
+	cfg.control = &controlSet{up: make(map[string]bool, len(entityPaths))}
+	for _, path := range entityPaths {
+		cfg.control.set(path, false)
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	errs := make(chan error, len(entityPaths))
+	for _, path := range entityPaths {
+		c := cfg
+		c.EntityPath = path
+		c.Logger = cfg.Logger.With("hyco", path)
+		go func() {
+			err := ListenAndServe(ctx, c)
+			if ctx.Err() == nil {
+				cancel()
+			}
+			errs <- err
+		}()
+	}
+	var first error
+	for range entityPaths {
+		if err := <-errs; first == nil || errors.Is(first, context.Canceled) {
+			first = err
+		}
+	}
+	return first
+}
+
+// controlSet records which hybrid connections' control channels are
+// connected. A nil *controlSet describes a single-hyco listener.
+type controlSet struct {
+	mu sync.Mutex
+	up map[string]bool
+}
+
+// set records hyco's state and reports whether every hybrid
+// connection is now connected. On a nil set that is just up.
+func (s *controlSet) set(hyco string, up bool) bool {
+	if s == nil {
+		return up
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.up[hyco] = up
+	for _, v := range s.up {
+		if !v {
+			return false
+		}
+	}
+	return true
+}
+
+// handleConnection serves one accepted rendezvous. Normally that is a
+// single connect envelope and bridge; when the sender negotiates
+// protocol.CapPipelining the rendezvous carries a sequence of them,
+// and handleConnection keeps reading envelopes until the WebSocket
+// closes or a session ends without a clean end-of-stream exchange.
 func handleConnection(ctx context.Context, ws *websocket.Conn, cfg Config) {
-	logger := cfg.Logger
+	first := true
+	for serveEnvelope(ctx, ws, cfg, first) {
+		first = false
+	}
+}
 
-	// Read the connect envelope with a timeout.
-	readCtx, readCancel := context.WithTimeout(ctx, cfg.ConnectTimeout)
+// serveEnvelope reads one connect envelope from ws and bridges it to
+// its target. It reports whether the WebSocket is ready for another
+// envelope (a pipelined session that ended cleanly).
+func serveEnvelope(ctx context.Context, ws *websocket.Conn, cfg Config, first bool) bool {
+	logger := cfg.Logger
+	// Snapshot the limits once so a reload mid-connection cannot
+	// change this connection's timeouts halfway through.
+	lim := cfg.limits()
+
+	// Read the connect envelope. The first one is bounded by
+	// ConnectTimeout. Between pipelined sessions the sender holds the
+	// WebSocket idle until its next local connection, which
+	// PipelineIdleTimeout bounds so an idle rendezvous cannot keep
+	// its connection slot forever.
+	wait := lim.ConnectTimeout
+	if !first {
+		wait = cfg.PipelineIdleTimeout
+	}
+	readCtx, readCancel := context.WithTimeout(ctx, wait)
 	defer readCancel()
 	_, data, err := ws.Read(readCtx)
 	if err != nil {
+		if !first {
+			if ctx.Err() == nil && readCtx.Err() != nil {
+				logger.Debug("pipelined rendezvous idle, closing", "idle_timeout", wait)
+			} else {
+				// The sender closed an idle pipelined rendezvous.
+				logger.Debug("pipelined rendezvous closed", "error", err)
+			}
+			return false
+		}
 		attrs := []any{"error", err}
 		if code, ok := relay.WSCloseCode(err); ok {
 			attrs = append(attrs, "close_code", code)
 		}
 		logger.Warn("failed to read envelope", attrs...)
 		cfg.Metrics.ConnectionError("listener", metrics.ReasonEnvelopeError)
-		return
+		return false
 	}
 
 	var env protocol.ConnectEnvelope
 	if err := json.Unmarshal(data, &env); err != nil {
 		logger.Warn("invalid envelope", "error", err)
-		_ = sendResponse(ctx, ws, cfg, false, "invalid envelope")
+		_ = sendResponseWithCode(ctx, ws, cfg, false, "invalid envelope", protocol.CodeInvalidEnvelope)
 		cfg.Metrics.ConnectionError("listener", metrics.ReasonEnvelopeError)
-		return
+		return false
 	}
+	cfg.Metrics.EnvelopeVersion(env.Version)
 	if env.Version != protocol.CurrentVersion {
 		logger.Warn("unsupported protocol version", "version", env.Version)
-		_ = sendResponse(ctx, ws, cfg, false, "unsupported protocol version")
+		_ = sendResponseWithCode(ctx, ws, cfg, false, "unsupported protocol version", protocol.CodeInvalidEnvelope)
+		cfg.Metrics.ConnectionError("listener", metrics.ReasonEnvelopeError)
+		return false
+	}
+	if cfg.Metrics.Quiesced() {
+		logger.Info("rejecting connection while quiesced", "target", env.Target)
+		_ = sendResponseWithCode(ctx, ws, cfg, false, "listener quiescing", protocol.CodeQuiescing)
+		cfg.Metrics.ConnectionError("listener", metrics.ReasonQuiescing)
+		return false
+	}
+	switch env.Mode {
+	case "", protocol.ModeConnect:
+		if env.Target == "" {
+			_ = sendResponseWithCode(ctx, ws, cfg, false, "missing target", protocol.CodeInvalidTarget)
+			cfg.Metrics.ConnectionError("listener", metrics.ReasonEnvelopeError)
+			return false
+		}
+	case protocol.ModeBind:
+		if env.BindAddr == "" {
+			_ = sendResponseWithCode(ctx, ws, cfg, false, "missing bind address", protocol.CodeInvalidTarget)
+			cfg.Metrics.ConnectionError("listener", metrics.ReasonEnvelopeError)
+			return false
+		}
+	case protocol.ModeUDP:
+	case protocol.ModeMux:
+		if cfg.Upstream != nil {
+			// Streams are not forwarded across a chain; the sender
+			// falls back to a rendezvous per connection.
+			logger.Info("mux session refused on a chaining listener")
+			_ = sendResponseWithCode(ctx, ws, cfg, false, "unsupported mode", protocol.CodeInvalidEnvelope)
+			cfg.Metrics.ConnectionError("listener", metrics.ReasonEnvelopeError)
+			return false
+		}
+	default:
+		logger.Warn("unsupported envelope mode", "mode", env.Mode)
+		_ = sendResponseWithCode(ctx, ws, cfg, false, "unsupported mode", protocol.CodeInvalidEnvelope)
 		cfg.Metrics.ConnectionError("listener", metrics.ReasonEnvelopeError)
-		return
+		return false
 	}
-	if env.Target == "" {
-		_ = sendResponse(ctx, ws, cfg, false, "missing target")
+	if err := env.ValidateMetadata(cfg.MetadataLimits); err != nil {
+		var me *protocol.MetadataError
+		errors.As(err, &me)
+		logger.Warn("envelope metadata rejected", "error", err)
+		_ = sendResponseWithCode(ctx, ws, cfg, false, "envelope metadata exceeds limits", me.Code)
 		cfg.Metrics.ConnectionError("listener", metrics.ReasonEnvelopeError)
-		return
+		return false
 	}
 
 	// Bind the sender-minted bridge correlation ID onto the request-
@@ -148,49 +585,98 @@ func handleConnection(ctx context.Context, ws *websocket.Conn, cfg Config) {
 	// bridge_id="") so operators see explicit evidence of mixed-version
 	// traffic rather than a silently absent attribute.
 	logger = logger.With("bridge_id", env.BridgeID)
-
-	logger.Info("connection requested", "target", env.Target)
-
-	// Check allowlist.
-	if len(cfg.AllowList) > 0 && !isAllowed(env.Target, cfg.AllowList) {
-		logger.Warn("target not allowed", "target", env.Target)
-		_ = sendResponse(ctx, ws, cfg, false, "target not allowed")
-		cfg.Metrics.ConnectionError("listener", metrics.ReasonAllowlistRejected)
-		return
+	// The sender's local client, when it reported one, goes on the
+	// logs for audit trails. It is never a metric label: one series
+	// per client port would grow without bound.
+	if client := env.Metadata[protocol.MetaClientAddr]; client != "" {
+		logger = logger.With("client_addr", client)
 	}
 
-	// Dial the target.
-	dial := cfg.dialContext
-	if dial == nil {
-		dialer := &net.Dialer{Timeout: cfg.ConnectTimeout}
-		dial = dialer.DialContext
+	switch env.Mode {
+	case protocol.ModeBind:
+		// Bind, UDP and mux sessions are never pipelined.
+		serveBind(ctx, ws, cfg, env, lim, logger)
+		return false
+	case protocol.ModeUDP:
+		serveUDP(ctx, ws, cfg, env, lim, logger)
+		return false
+	case protocol.ModeMux:
+		serveMux(ctx, ws, cfg, env, logger)
+		return false
 	}
-	dialCtx, cancel := context.WithTimeout(ctx, cfg.ConnectTimeout)
-	defer cancel()
 
-	dialStart := time.Now()
-	conn, err := dial(dialCtx, "tcp", env.Target)
-	cfg.Metrics.ObserveDialDuration("listener", time.Since(dialStart).Seconds())
-	if err != nil {
-		code := classifyDialError(err)
-		logger.Warn("dial target failed", "target", env.Target, "error", err, "code", code)
-		_ = sendResponseWithCode(ctx, ws, cfg, false, "connection failed", code)
-		cfg.Metrics.ConnectionError("listener", metrics.DialReason(err, metrics.ReasonDialFailed))
-		return
+	logger.Info("connection requested", "target", env.Target)
+
+	// The span continues the sender's trace when the envelope carries
+	// its traceparent.
+	span := cfg.Tracer.Start("aztunnel.listener.connect", tracing.KindServer, env.Metadata[protocol.MetaTraceparent])
+	defer span.End()
+	span.SetAttr(tracing.AttrTarget, env.Target)
+	span.SetAttr(tracing.AttrBridgeID, env.BridgeID)
+
+	var conn net.Conn
+	if cfg.Echo {
+		conn = newEchoConn()
+	} else {
+		addrs, targetLogger, ref := cfg.checkTarget(ctx, env, lim, logger, span)
+		logger = targetLogger
+		if ref == nil && cfg.Upstream != nil {
+			// A chained session is never pipelined.
+			serveChained(ctx, ws, cfg, env, addrs[0], lim, logger)
+			return false
+		}
+		if ref == nil {
+			conn, ref = cfg.dialTarget(ctx, env, addrs, lim, logger, span)
+		}
+		if ref != nil {
+			_ = sendResponseWithCode(ctx, ws, cfg, false, ref.msg, ref.code)
+			ref.record(cfg, span)
+			return false
+		}
 	}
 	defer conn.Close() //nolint:errcheck // best-effort cleanup
 
-	// Set TCP keepalive.
-	relay.SetTCPKeepAlive(conn, cfg.TCPKeepAlive)
-
-	// Send success response.
-	if err := sendResponse(ctx, ws, cfg, true, ""); err != nil {
+	// Send success response, agreeing to pipelining or half-close if
+	// asked. Pipelined sessions already half-close, so pipelining wins.
+	var caps []string
+	pipelined := protocol.HasCapability(env.Capabilities, protocol.CapPipelining)
+	halfClose := !pipelined && protocol.HasCapability(env.Capabilities, protocol.CapHalfClose)
+	switch {
+	case pipelined:
+		caps = []string{protocol.CapPipelining}
+	case halfClose:
+		caps = []string{protocol.CapHalfClose}
+	}
+	// Only a real target socket has an address worth reporting; the
+	// echo pipe does not.
+	var localAddr string
+	if la, ok := conn.LocalAddr().(*net.TCPAddr); ok {
+		localAddr = la.String()
+	}
+	if err := sendAccept(ctx, ws, cfg, caps, compressionReply(ctx, env), localAddr); err != nil {
 		logger.Warn("failed to send response", "error", err)
-		return
+		span.SetError(err)
+		return false
 	}
 
 	// Bridge data.
-	result, bridgeErr := cfg.Metrics.TrackedBridge(ctx, ws, conn, "listener", env.Target)
+	var result relay.BridgeResult
+	var bridgeErr error
+	reusable := false
+	bctx := relay.WithBridgeLogger(ctx, logger)
+	bctx = metrics.WithConnID(bctx, env.BridgeID)
+	bctx = metrics.WithConnLabels(bctx, connLabels(conn, cfg.Endpoint))
+	bctx = metrics.WithClientAddr(bctx, env.Metadata[protocol.MetaClientAddr])
+	if pipelined {
+		var sr relay.SessionResult
+		opts := relay.BridgeOptions{BufferSize: cfg.BufferSize, IdleTimeout: cfg.IdleTimeout, RateLimit: cfg.RateLimit, PingInterval: cfg.DataPingInterval}
+		sr, bridgeErr = cfg.Metrics.TrackedBridgeSession(bctx, ws, conn, "listener", env.Target, opts)
+		result, reusable = sr.BridgeResult, sr.Reusable
+	} else {
+		bctx = relay.WithMinThroughput(bctx, cfg.MinThroughput)
+		opts := relay.BridgeOptions{HalfClose: halfClose, BufferSize: cfg.BufferSize, IdleTimeout: cfg.IdleTimeout, RateLimit: cfg.RateLimit, PingInterval: cfg.DataPingInterval}
+		result, bridgeErr = cfg.Metrics.TrackedBridgeWithOptions(bctx, ws, conn, "listener", env.Target, opts)
+	}
 	attrs := []any{
 		"target", env.Target,
 		"cause", result.EndCause,
@@ -209,13 +695,172 @@ func handleConnection(ctx context.Context, ws *websocket.Conn, cfg Config) {
 	if code, ok := relay.WSCloseCode(bridgeErr); ok {
 		attrs = append(attrs, "close_code", code)
 	}
+	if pipelined {
+		attrs = append(attrs, "reusable", reusable)
+	}
 	logger.Debug("bridge ended", attrs...)
+	span.SetAttr(tracing.AttrTCPToWS, result.Stats.TCPToWS)
+	span.SetAttr(tracing.AttrWSToTCP, result.Stats.WSToTCP)
+	span.SetAttr(tracing.AttrEndCause, result.EndCause)
+	span.SetError(bridgeErr)
+	return reusable
+}
+
+// targetRefusal is why a connect target was refused: the message and
+// code the sender is told, the metrics reason, and the span error.
+type targetRefusal struct {
+	msg, code, reason string
+	err               error
+}
+
+// record counts the refusal and marks span with it.
+func (r *targetRefusal) record(cfg Config, span *tracing.Span) {
+	cfg.Metrics.ConnectionError("listener", r.reason)
+	span.SetAttr(tracing.AttrCode, r.code)
+	span.SetError(r.err)
+}
+
+// checkTarget resolves env.Target through the alias table and checks
+// it against the deny and allow lists. It returns the addresses to
+// dial (one, or the allowed IPs of a resolved name) and the logger
+// with the backend bound, or why the target is refused.
+func (cfg *Config) checkTarget(ctx context.Context, env protocol.ConnectEnvelope, lim Limits, logger *slog.Logger, span *tracing.Span) ([]string, *slog.Logger, *targetRefusal) {
+	// Resolve an alias to its real target. Everything the sender
+	// or metrics see keeps using env.Target, the alias. A route
+	// must resolve; a plain target that is no alias is dialed
+	// as given.
+	target := env.Target
+	name, isRoute := strings.CutPrefix(env.Target, protocol.RoutePrefix)
+	if !isRoute {
+		name = env.Target
+	}
+	if backend, ok := cfg.mapped(name); ok {
+		target = backend
+		logger = logger.With("backend", backend)
+		span.SetAttr(tracing.AttrBackend, backend)
+	} else if isRoute {
+		logger.Warn("unknown route", "target", env.Target)
+		return nil, logger, &targetRefusal{"unknown route", protocol.CodeUnknownRoute, metrics.ReasonEnvelopeError, errors.New("unknown route")}
+	}
+
+	if _, _, err := net.SplitHostPort(target); err != nil {
+		logger.Warn("invalid target", "target", env.Target, "error", err)
+		return nil, logger, &targetRefusal{"invalid target", protocol.CodeInvalidTarget, metrics.ReasonEnvelopeError, err}
+	}
+
+	// Check the denylist, which overrides the allowlist.
+	if cfg.denied(target) {
+		logger.Warn("target denied", "target", env.Target)
+		return nil, logger, &targetRefusal{"target not allowed", protocol.CodeNotAllowed, metrics.ReasonDenylistRejected, errors.New("target denied")}
+	}
+
+	// Check allowlist. With AllowResolve, a hostname the list does
+	// not name is resolved here and only its allowed IPs are dialed.
+	addrs := []string{target}
+	if !cfg.allowed(target) {
+		addrs = nil
+		if cfg.AllowResolve && cfg.Upstream == nil {
+			addrs = cfg.resolveAllowed(ctx, target, lim.ConnectTimeout, logger)
+		}
+	}
+	if len(addrs) == 0 {
+		logger.Warn("target not allowed", "target", env.Target)
+		return nil, logger, &targetRefusal{"target not allowed", protocol.CodeNotAllowed, metrics.ReasonAllowlistRejected, errors.New("target not allowed")}
+	}
+	return addrs, logger, nil
+}
+
+// dialTarget dials the first of addrs that answers and readies the
+// connection for bridging: keepalive, the PROXY header, and the
+// probe, as configured.
+func (cfg *Config) dialTarget(ctx context.Context, env protocol.ConnectEnvelope, addrs []string, lim Limits, logger *slog.Logger, span *tracing.Span) (net.Conn, *targetRefusal) {
+	dial := cfg.dialContext
+	if dial == nil {
+		dial = cfg.targetDial(lim)
+	}
+	dialCtx, cancel := context.WithTimeout(ctx, lim.ConnectTimeout)
+	defer cancel()
+
+	dialStart := time.Now()
+	conn, err := dialRetry(dialCtx, dial, dialNetwork(cfg.DialFamily), addrs, cfg.TargetDialRetries, cfg.TargetDialBackoff, logger)
+	dialDuration := time.Since(dialStart)
+	cfg.Metrics.ObserveDialDuration("listener", dialDuration.Seconds())
+	span.SetAttr(tracing.AttrDialDuration, dialDuration)
+	if err != nil {
+		code := classifyDialError(err)
+		logger.Warn("dial target failed", "target", env.Target, "error", err, "code", code)
+		return nil, &targetRefusal{"connection failed", code, metrics.DialReason(err, metrics.ReasonDialFailed), err}
+	}
+
+	// Set TCP keepalive.
+	relay.SetTCPKeepAlive(conn, lim.TCPKeepAlive)
+
+	if cfg.ProxyProtocol {
+		if err := writeProxyHeader(conn, env.Metadata[protocol.MetaClientAddr], lim.ConnectTimeout); err != nil {
+			_ = conn.Close()
+			logger.Warn("write PROXY header failed", "target", env.Target, "error", err)
+			return nil, &targetRefusal{"connection failed", protocol.CodeConnectionRefused, metrics.ReasonDialFailed, err}
+		}
+	}
+
+	if cfg.ProbeTarget {
+		probed, err := probeTarget(conn)
+		if err != nil {
+			_ = conn.Close()
+			logger.Warn("target closed right after accept", "target", env.Target, "error", err)
+			return nil, &targetRefusal{"connection failed", protocol.CodeConnectionRefused, metrics.ReasonDialFailed, err}
+		}
+		conn = probed
+	}
+	// Every target connection is dialed per bridge today; the
+	// reuse label exists for a future pooling backend.
+	cfg.Metrics.TargetConnection(metrics.ReuseFresh)
+	return conn, nil
+}
+
+// connLabels returns the detail metric labels for a listener bridge.
+// Only the source IP of the target connection is kept; its port is
+// ephemeral and would give every connection its own series.
+func connLabels(conn net.Conn, endpoint string) metrics.ConnLabels {
+	local := conn.LocalAddr().String()
+	if host, _, err := net.SplitHostPort(local); err == nil {
+		local = host
+	}
+	return metrics.ConnLabels{LocalAddr: local, RelayHost: endpoint}
 }
 
 func sendResponse(ctx context.Context, ws *websocket.Conn, cfg Config, ok bool, errMsg string) error {
 	return sendResponseWithCode(ctx, ws, cfg, ok, errMsg, "")
 }
 
+// compressionReply answers an envelope's protocol.MetaCompression: it
+// echoes protocol.CompressionDeflate when the sender asked and this
+// rendezvous WebSocket negotiated permessage-deflate (the relay
+// package then attaches its WireCounter to ctx), and is nil otherwise.
+func compressionReply(ctx context.Context, env protocol.ConnectEnvelope) map[string]string {
+	if env.Metadata[protocol.MetaCompression] != protocol.CompressionDeflate || relay.WireCounterFrom(ctx) == nil {
+		return nil
+	}
+	return map[string]string{protocol.MetaCompression: protocol.CompressionDeflate}
+}
+
+// sendAccept sends the OK response, echoing the capabilities the
+// listener agreed to for this connection and any Metadata answers.
+// localAddr is the target connection's local address, or empty when
+// there is none to report.
+func sendAccept(ctx context.Context, ws *websocket.Conn, cfg Config, caps []string, meta map[string]string, localAddr string) error {
+	resp := protocol.ConnectResponse{
+		Version:      protocol.CurrentVersion,
+		OK:           true,
+		ListenerID:   cfg.ListenerID,
+		Capabilities: caps,
+		Metadata:     meta,
+		LocalAddr:    localAddr,
+	}
+	data, _ := json.Marshal(resp) // simple struct, cannot fail
+	return ws.Write(ctx, websocket.MessageText, data)
+}
+
 // sendResponseWithCode is the variant of sendResponse that includes a
 // machine-readable code so the sender can map listener-side dial
 // failures onto client-visible status (e.g. SOCKS5 REP bytes).
@@ -276,64 +921,70 @@ func classifyDialError(err error) string {
 	return ""
 }
 
-// isAllowed checks if the target matches the allowlist.
-// Allowlist entries can be:
-//   - "host:port" — exact string match (no DNS resolution)
-//   - "CIDR:port" — CIDR match with exact port
-//   - "CIDR:*" — CIDR match with any port
-//   - "*" — allow everything
-//
-// Note: hostname entries are matched literally. Use CIDR notation for
-// IP-based restrictions to avoid bypass via IP/hostname mismatch.
-func isAllowed(target string, allowList []string) bool {
-	host, port, err := net.SplitHostPort(target)
+// targetDial returns the function target connections are dialed with:
+// targetDialer's, through UpstreamSOCKS when it is set.
+func (cfg *Config) targetDial(lim Limits) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	d := cfg.targetDialer(lim)
+	if cfg.UpstreamSOCKS == "" {
+		return d.DialContext
+	}
+	socks, err := proxy.SOCKS5("tcp", cfg.UpstreamSOCKS, nil, d)
 	if err != nil {
-		return false
+		return func(context.Context, string, string) (net.Conn, error) { return nil, err }
 	}
+	return socks.(proxy.ContextDialer).DialContext
+}
 
-	targetIP := net.ParseIP(host)
-
-	for _, entry := range allowList {
-		if entry == "*" {
-			return true
-		}
+// targetDialer returns the dialer for target connections, or for the
+// connection to UpstreamSOCKS.
+func (cfg *Config) targetDialer(lim Limits) *net.Dialer {
+	d := &net.Dialer{Timeout: lim.ConnectTimeout, KeepAlive: lim.TCPKeepAlive, Resolver: cfg.Resolver}
+	if cfg.DialSource.IsValid() {
+		d.LocalAddr = &net.TCPAddr{IP: cfg.DialSource.AsSlice(), Zone: cfg.DialSource.Zone()}
+	}
+	return d
+}
 
-		aHost, aPort, err := splitAllowEntry(entry)
-		if err != nil {
-			continue
-		}
+// dialNetwork returns the DialContext network for a DialFamily.
+func dialNetwork(family string) string {
+	switch family {
+	case "ipv4":
+		return "tcp4"
+	case "ipv6":
+		return "tcp6"
+	}
+	return "tcp"
+}
 
-		// Check port.
-		if aPort != "*" && aPort != port {
-			continue
+// dialRetry dials addrs with dialAny, trying again up to retries times
+// while the failure is one a restarting target produces: connection
+// refused or host or network unreachable. The wait starts at backoff
+// and doubles. Timeouts and DNS failures are not retried, and neither
+// is anything once ctx is done; the last dial error is returned so the
+// caller classifies it as before.
+func dialRetry(ctx context.Context, dial func(ctx context.Context, network, addr string) (net.Conn, error), network string, addrs []string, retries int, backoff time.Duration, logger *slog.Logger) (net.Conn, error) {
+	for attempt := 0; ; attempt++ {
+		conn, err := dialAny(ctx, dial, network, addrs)
+		if err == nil || attempt >= retries || !retryableDial(err) || ctx.Err() != nil {
+			return conn, err
 		}
-
-		// Check host: try CIDR first, then exact match.
-		if _, cidr, err := net.ParseCIDR(aHost); err == nil {
-			if targetIP != nil && cidr.Contains(targetIP) {
-				return true
-			}
-		} else if host == aHost {
-			return true
+		delay := backoff << attempt
+		logger.Debug("dial target failed, retrying", "addr", addrs[0], "attempt", attempt+1, "delay", delay, "error", err)
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, err
+		case <-timer.C:
 		}
 	}
-	return false
 }
 
-// splitAllowEntry parses "host:port" or "CIDR:port" from allowlist format.
-// CIDR entries like "10.0.0.0/8:*" need special handling since they
-// contain a colon in the CIDR notation.
-func splitAllowEntry(entry string) (host, port string, err error) {
-	// Find the last colon — the port separator.
-	lastColon := -1
-	for i := len(entry) - 1; i >= 0; i-- {
-		if entry[i] == ':' {
-			lastColon = i
-			break
-		}
+// retryableDial reports whether dialRetry should try err's dial again.
+func retryableDial(err error) bool {
+	switch classifyDialError(err) {
+	case protocol.CodeConnectionRefused, protocol.CodeHostUnreachable, protocol.CodeNetworkUnreachable:
+		return true
 	}
-	if lastColon < 0 {
-		return "", "", fmt.Errorf("no port in allowlist entry: %s", entry)
-	}
-	return entry[:lastColon], entry[lastColon+1:], nil
+	return false
 }
@@ -10,6 +10,7 @@ import (
 	"net"
 	"net/http"
 	"net/http/httptest"
+	"net/netip"
 	"strings"
 	"sync"
 	"syscall"
@@ -19,65 +20,11 @@ import (
 	"github.com/coder/websocket"
 	"github.com/philsphicas/aztunnel/internal/metrics"
 	"github.com/philsphicas/aztunnel/internal/protocol"
+	"github.com/philsphicas/aztunnel/internal/relay"
+	"github.com/philsphicas/aztunnel/internal/sender/socks5"
+	"github.com/philsphicas/aztunnel/internal/tracing"
 )
 
-func TestIsAllowed(t *testing.T) {
-	tests := []struct {
-		name      string
-		target    string
-		allowList []string
-		want      bool
-	}{
-		{"wildcard", "10.0.0.1:22", []string{"*"}, true},
-		{"exact match", "10.0.0.1:22", []string{"10.0.0.1:22"}, true},
-		{"exact no match", "10.0.0.1:22", []string{"10.0.0.2:22"}, false},
-		{"wrong port", "10.0.0.1:80", []string{"10.0.0.1:22"}, false},
-		{"cidr match", "10.0.0.5:22", []string{"10.0.0.0/8:22"}, true},
-		{"cidr wildcard port", "10.0.0.5:8080", []string{"10.0.0.0/8:*"}, true},
-		{"cidr no match", "192.168.0.1:22", []string{"10.0.0.0/8:22"}, false},
-		{"multiple entries", "10.0.0.5:22", []string{"192.168.0.0/16:*", "10.0.0.0/8:22"}, true},
-		{"hostname exact", "myhost:22", []string{"myhost:22"}, true},
-		{"hostname wrong", "myhost:22", []string{"other:22"}, false},
-		{"empty target", "", []string{"*"}, false},
-	}
-	for _, tt := range tests {
-		t.Run(tt.name, func(t *testing.T) {
-			got := isAllowed(tt.target, tt.allowList)
-			if got != tt.want {
-				t.Errorf("isAllowed(%q, %v) = %v, want %v", tt.target, tt.allowList, got, tt.want)
-			}
-		})
-	}
-}
-
-func TestSplitAllowEntry(t *testing.T) {
-	tests := []struct {
-		entry    string
-		wantHost string
-		wantPort string
-		wantErr  bool
-	}{
-		{"10.0.0.1:22", "10.0.0.1", "22", false},
-		{"10.0.0.0/8:*", "10.0.0.0/8", "*", false},
-		{"myhost:22", "myhost", "22", false},
-		{"nocolon", "", "", true},
-	}
-	for _, tt := range tests {
-		t.Run(tt.entry, func(t *testing.T) {
-			h, p, err := splitAllowEntry(tt.entry)
-			if (err != nil) != tt.wantErr {
-				t.Fatalf("err = %v, wantErr = %v", err, tt.wantErr)
-			}
-			if h != tt.wantHost {
-				t.Errorf("host = %q, want %q", h, tt.wantHost)
-			}
-			if p != tt.wantPort {
-				t.Errorf("port = %q, want %q", p, tt.wantPort)
-			}
-		})
-	}
-}
-
 func TestClassifyDialError_Nil(t *testing.T) {
 	if got := classifyDialError(nil); got != "" {
 		t.Errorf("classifyDialError(nil) = %q, want %q", got, "")
@@ -249,6 +196,31 @@ func TestHandleConnection_ResponseCarriesListenerID(t *testing.T) {
 	}
 }
 
+func TestHandleConnection_ResponseCarriesLocalAddr(t *testing.T) {
+	peer := make(chan string, 1)
+	target := startBackend(t, func(c net.Conn) {
+		peer <- c.RemoteAddr().String()
+		_ = c.Close()
+	})
+	cfg := Config{
+		ConnectTimeout: 5 * time.Second,
+		Logger:         slog.New(slog.NewTextHandler(io.Discard, nil)),
+	}
+	resp := driveOneHandshake(t, cfg, target)
+	if !resp.OK {
+		t.Fatalf("expected OK response, got error=%q code=%q", resp.Error, resp.Code)
+	}
+	// The target sees the connection come from the reported address.
+	if want := <-peer; resp.LocalAddr != want {
+		t.Errorf("LocalAddr = %q, want %q", resp.LocalAddr, want)
+	}
+
+	cfg.Echo = true
+	if resp := driveOneHandshake(t, cfg, "echo:1"); !resp.OK || resp.LocalAddr != "" {
+		t.Errorf("echo response = %+v, want OK without local_addr", resp)
+	}
+}
+
 // TestHandleConnection_StableAcrossRequests drives 10 sequential
 // handshakes through the same Config and asserts every response
 // carries the same listener_id. Two listener_id values inside a
@@ -313,11 +285,12 @@ func TestHandleConnection_FailurePathsCarryListenerID(t *testing.T) {
 	}
 
 	tests := []struct {
-		name    string
-		cfg     Config
-		send    func(ctx context.Context, ws *websocket.Conn) error
-		wantOK  bool
-		wantErr string
+		name     string
+		cfg      Config
+		send     func(ctx context.Context, ws *websocket.Conn) error
+		wantOK   bool
+		wantErr  string
+		wantCode string
 	}{
 		{
 			name: "invalid-envelope",
@@ -331,8 +304,9 @@ func TestHandleConnection_FailurePathsCarryListenerID(t *testing.T) {
 			send: func(ctx context.Context, ws *websocket.Conn) error {
 				return ws.Write(ctx, websocket.MessageText, []byte("not json"))
 			},
-			wantOK:  false,
-			wantErr: "invalid envelope",
+			wantOK:   false,
+			wantErr:  "invalid envelope",
+			wantCode: protocol.CodeInvalidEnvelope,
 		},
 		{
 			name: "unsupported-version",
@@ -347,8 +321,9 @@ func TestHandleConnection_FailurePathsCarryListenerID(t *testing.T) {
 				data, _ := json.Marshal(protocol.ConnectEnvelope{Version: 999, Target: "x:1"})
 				return ws.Write(ctx, websocket.MessageText, data)
 			},
-			wantOK:  false,
-			wantErr: "unsupported protocol version",
+			wantOK:   false,
+			wantErr:  "unsupported protocol version",
+			wantCode: protocol.CodeInvalidEnvelope,
 		},
 		{
 			name: "missing-target",
@@ -363,8 +338,26 @@ func TestHandleConnection_FailurePathsCarryListenerID(t *testing.T) {
 				data, _ := json.Marshal(protocol.ConnectEnvelope{Version: protocol.CurrentVersion})
 				return ws.Write(ctx, websocket.MessageText, data)
 			},
-			wantOK:  false,
-			wantErr: "missing target",
+			wantOK:   false,
+			wantErr:  "missing target",
+			wantCode: protocol.CodeInvalidTarget,
+		},
+		{
+			name: "invalid-target",
+			cfg: Config{
+				ConnectTimeout: 5 * time.Second,
+				TCPKeepAlive:   5 * time.Second,
+				Logger:         slog.New(slog.NewTextHandler(io.Discard, nil)),
+				Metrics:        metrics.New(),
+				ListenerID:     listenerID,
+			},
+			send: func(ctx context.Context, ws *websocket.Conn) error {
+				data, _ := json.Marshal(protocol.ConnectEnvelope{Version: protocol.CurrentVersion, Target: "db.internal"})
+				return ws.Write(ctx, websocket.MessageText, data)
+			},
+			wantOK:   false,
+			wantErr:  "invalid target",
+			wantCode: protocol.CodeInvalidTarget,
 		},
 		{
 			name: "allowlist-rejected",
@@ -380,8 +373,9 @@ func TestHandleConnection_FailurePathsCarryListenerID(t *testing.T) {
 				data, _ := json.Marshal(protocol.ConnectEnvelope{Version: protocol.CurrentVersion, Target: "127.0.0.1:1"})
 				return ws.Write(ctx, websocket.MessageText, data)
 			},
-			wantOK:  false,
-			wantErr: "target not allowed",
+			wantOK:   false,
+			wantErr:  "target not allowed",
+			wantCode: protocol.CodeNotAllowed,
 		},
 		{
 			name: "dial-failure",
@@ -397,8 +391,9 @@ func TestHandleConnection_FailurePathsCarryListenerID(t *testing.T) {
 				data, _ := json.Marshal(protocol.ConnectEnvelope{Version: protocol.CurrentVersion, Target: addr})
 				return ws.Write(ctx, websocket.MessageText, data)
 			},
-			wantOK:  false,
-			wantErr: "connection failed",
+			wantOK:   false,
+			wantErr:  "connection failed",
+			wantCode: protocol.CodeConnectionRefused,
 		},
 	}
 
@@ -411,6 +406,9 @@ func TestHandleConnection_FailurePathsCarryListenerID(t *testing.T) {
 			if !strings.Contains(resp.Error, tt.wantErr) {
 				t.Errorf("error = %q, want substring %q", resp.Error, tt.wantErr)
 			}
+			if resp.Code != tt.wantCode {
+				t.Errorf("code = %q, want %q", resp.Code, tt.wantCode)
+			}
 			if resp.ListenerID != listenerID {
 				t.Errorf("listener_id = %q, want %q", resp.ListenerID, listenerID)
 			}
@@ -418,6 +416,40 @@ func TestHandleConnection_FailurePathsCarryListenerID(t *testing.T) {
 	}
 }
 
+func TestHandleConnection_MetadataLimits(t *testing.T) {
+	tests := []struct {
+		name     string
+		metadata map[string]string
+		wantOK   bool
+		wantCode string
+	}{
+		{"within-limits", map[string]string{"trace": "abc123"}, true, ""},
+		{"too-many", map[string]string{"a": "1", "b": "2", "c": "3"}, false, protocol.CodeTooManyMetadata},
+		{"value-too-long", map[string]string{"a": strings.Repeat("v", 65)}, false, protocol.CodeEnvelopeTooLarge},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := metrics.New()
+			cfg := Config{
+				Echo:           true,
+				MetadataLimits: protocol.MetadataLimits{MaxEntries: 2, MaxValueLen: 64},
+				Logger:         slog.New(slog.NewTextHandler(io.Discard, nil)),
+				Metrics:        m,
+			}
+			resp := driveCustomHandshake(t, cfg, func(ctx context.Context, ws *websocket.Conn) error {
+				data, _ := json.Marshal(protocol.ConnectEnvelope{Version: protocol.CurrentVersion, Target: "x:1", Metadata: tt.metadata})
+				return ws.Write(ctx, websocket.MessageText, data)
+			})
+			if resp.OK != tt.wantOK {
+				t.Errorf("ok = %v, want %v (error %q)", resp.OK, tt.wantOK, resp.Error)
+			}
+			if resp.Code != tt.wantCode {
+				t.Errorf("code = %q, want %q", resp.Code, tt.wantCode)
+			}
+		})
+	}
+}
+
 // driveOneHandshake stands up an httptest WebSocket server that
 // forwards the accepted connection to handleConnection(cfg), then
 // dials it, sends a valid ConnectEnvelope for target, and returns
@@ -613,3 +645,621 @@ func assertDialFailureLog(t *testing.T, logs, target, code string) {
 		t.Fatalf("dial-failure log missing %q:\n%s", want, hit)
 	}
 }
+
+// TestHandleConnection_CountsFreshTargetConnection asserts each
+// successfully dialed target bumps
+// aztunnel_target_connections_total{reuse="fresh"} exactly once.
+func TestHandleConnection_CountsFreshTargetConnection(t *testing.T) {
+	target, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("target listen: %v", err)
+	}
+	defer target.Close() //nolint:errcheck // best-effort cleanup
+	go func() {
+		for {
+			c, err := target.Accept()
+			if err != nil {
+				return
+			}
+			_ = c.Close()
+		}
+	}()
+
+	m := metrics.New()
+	cfg := Config{
+		Logger:  slog.New(slog.NewTextHandler(io.Discard, nil)),
+		Metrics: m,
+	}
+	for range 2 {
+		if resp := driveOneHandshake(t, cfg, target.Addr().String()); !resp.OK {
+			t.Fatalf("expected OK response, got error=%q", resp.Error)
+		}
+	}
+
+	fams, err := m.Registry.Gather()
+	if err != nil {
+		t.Fatalf("gather: %v", err)
+	}
+	var fresh float64
+	for _, f := range fams {
+		if f.GetName() != "aztunnel_target_connections_total" {
+			continue
+		}
+		for _, met := range f.GetMetric() {
+			for _, l := range met.GetLabel() {
+				if l.GetName() == "reuse" && l.GetValue() == metrics.ReuseFresh {
+					fresh = met.GetCounter().GetValue()
+				}
+			}
+		}
+	}
+	if fresh != 2 {
+		t.Errorf("target_connections_total{reuse=fresh} = %v, want 2", fresh)
+	}
+}
+
+// TestHandleConnection_Quiesce opens a bridge, quiesces the listener,
+// and asserts new envelopes are rejected with CodeQuiescing while the
+// open bridge keeps echoing; resuming accepts new envelopes again.
+func TestHandleConnection_Quiesce(t *testing.T) {
+	target := startBackend(t, func(c net.Conn) {
+		defer c.Close() //nolint:errcheck // best-effort cleanup
+		_, _ = io.Copy(c, c)
+	})
+	m := metrics.New()
+	m.EnableQuiesce()
+	cfg := Config{
+		Logger:  slog.New(slog.NewTextHandler(io.Discard, nil)),
+		Metrics: m,
+	}
+	applyDefaults(&cfg)
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ws, err := websocket.Accept(w, r, nil)
+		if err != nil {
+			return
+		}
+		handleConnection(r.Context(), ws, cfg)
+	}))
+	defer srv.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	ws, _, err := websocket.Dial(ctx, "ws"+strings.TrimPrefix(srv.URL, "http"), nil)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer ws.CloseNow() //nolint:errcheck // best-effort cleanup
+	data, _ := json.Marshal(protocol.ConnectEnvelope{Version: protocol.CurrentVersion, Target: target})
+	if err := ws.Write(ctx, websocket.MessageText, data); err != nil {
+		t.Fatalf("send envelope: %v", err)
+	}
+	if _, data, err = ws.Read(ctx); err != nil {
+		t.Fatalf("read response: %v", err)
+	}
+	var resp protocol.ConnectResponse
+	if err := json.Unmarshal(data, &resp); err != nil || !resp.OK {
+		t.Fatalf("bridge setup response = %+v, %v; want OK", resp, err)
+	}
+	echo := func(msg string) {
+		t.Helper()
+		if err := ws.Write(ctx, websocket.MessageBinary, []byte(msg)); err != nil {
+			t.Fatalf("write to bridge: %v", err)
+		}
+		_, got, err := ws.Read(ctx)
+		if err != nil || string(got) != msg {
+			t.Fatalf("echo = %q, %v; want %q", got, err, msg)
+		}
+	}
+	echo("before")
+
+	m.SetQuiesced(true)
+	resp = driveOneHandshake(t, cfg, target)
+	if resp.OK || resp.Code != protocol.CodeQuiescing {
+		t.Errorf("response while quiesced = %+v, want rejection with code %q", resp, protocol.CodeQuiescing)
+	}
+	echo("during")
+
+	m.SetQuiesced(false)
+	if resp := driveOneHandshake(t, cfg, target); !resp.OK {
+		t.Errorf("response after resume = %+v, want OK", resp)
+	}
+	echo("after")
+}
+
+// TestHandleConnection_CountsEnvelopeVersion asserts every received
+// envelope is counted by version, including versions the listener
+// rejects.
+func TestHandleConnection_CountsEnvelopeVersion(t *testing.T) {
+	target := startBackend(t, func(c net.Conn) { _ = c.Close() })
+	m := metrics.New()
+	cfg := Config{
+		Logger:  slog.New(slog.NewTextHandler(io.Discard, nil)),
+		Metrics: m,
+	}
+	for _, v := range []int{protocol.CurrentVersion, protocol.CurrentVersion, 2} {
+		driveCustomHandshake(t, cfg, func(ctx context.Context, ws *websocket.Conn) error {
+			data, _ := json.Marshal(protocol.ConnectEnvelope{Version: v, Target: target})
+			return ws.Write(ctx, websocket.MessageText, data)
+		})
+	}
+
+	fams, err := m.Registry.Gather()
+	if err != nil {
+		t.Fatalf("gather: %v", err)
+	}
+	got := map[string]float64{}
+	for _, f := range fams {
+		if f.GetName() != "aztunnel_envelope_version_total" {
+			continue
+		}
+		for _, met := range f.GetMetric() {
+			got[met.GetLabel()[0].GetValue()] = met.GetCounter().GetValue()
+		}
+	}
+	if got["1"] != 2 || got["2"] != 1 || len(got) != 2 {
+		t.Errorf("envelope_version_total = %v, want map[1:2 2:1]", got)
+	}
+}
+
+func TestCompressionReply(t *testing.T) {
+	deflate := protocol.ConnectEnvelope{Metadata: map[string]string{protocol.MetaCompression: protocol.CompressionDeflate}}
+	withWire := relay.WithWireCounter(context.Background(), new(relay.WireCounter))
+
+	if got := compressionReply(withWire, deflate); got[protocol.MetaCompression] != protocol.CompressionDeflate {
+		t.Errorf("requested and negotiated: reply = %v, want compression=deflate", got)
+	}
+	if got := compressionReply(context.Background(), deflate); got != nil {
+		t.Errorf("rendezvous hop uncompressed: reply = %v, want nil", got)
+	}
+	if got := compressionReply(withWire, protocol.ConnectEnvelope{}); got != nil {
+		t.Errorf("not requested: reply = %v, want nil", got)
+	}
+}
+
+// connectionErrors returns aztunnel_connection_errors_total for the
+// listener role and reason.
+func connectionErrors(t *testing.T, m *metrics.Metrics, reason string) float64 {
+	t.Helper()
+	fams, err := m.Registry.Gather()
+	if err != nil {
+		t.Fatalf("gather: %v", err)
+	}
+	for _, f := range fams {
+		if f.GetName() != "aztunnel_connection_errors_total" {
+			continue
+		}
+		for _, met := range f.GetMetric() {
+			labels := map[string]string{}
+			for _, l := range met.GetLabel() {
+				labels[l.GetName()] = l.GetValue()
+			}
+			if labels["role"] == "listener" && labels["reason"] == reason {
+				return met.GetCounter().GetValue()
+			}
+		}
+	}
+	return 0
+}
+
+// waitConnectionErrors waits for connectionErrors to reach want; the
+// listener records a refusal just after sending it.
+func waitConnectionErrors(t *testing.T, m *metrics.Metrics, reason string, want float64) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for connectionErrors(t, m, reason) != want {
+		if time.Now().After(deadline) {
+			t.Fatalf("connection_errors_total{reason=%s} = %v, want %v", reason, connectionErrors(t, m, reason), want)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// TestHandleConnection_DenyOverridesAllow asserts a target matching
+// both lists is refused as denylist_rejected, while other targets the
+// allowlist covers still connect.
+func TestHandleConnection_DenyOverridesAllow(t *testing.T) {
+	var targets [2]net.Listener
+	for i := range targets {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatalf("target listen: %v", err)
+		}
+		defer ln.Close() //nolint:errcheck // best-effort cleanup
+		go func() {
+			for {
+				c, err := ln.Accept()
+				if err != nil {
+					return
+				}
+				_ = c.Close()
+			}
+		}()
+		targets[i] = ln
+	}
+	denied, allowed := targets[0].Addr().String(), targets[1].Addr().String()
+
+	m := metrics.New()
+	cfg := Config{
+		AllowList: []string{"127.0.0.0/8:*"},
+		DenyList:  []string{denied},
+		Logger:    slog.New(slog.DiscardHandler),
+		Metrics:   m,
+	}
+	resp := driveOneHandshake(t, cfg, denied)
+	if resp.OK || resp.Code != protocol.CodeNotAllowed {
+		t.Errorf("denied target: OK=%v code=%q, want rejection with %q", resp.OK, resp.Code, protocol.CodeNotAllowed)
+	}
+	if resp := driveOneHandshake(t, cfg, allowed); !resp.OK {
+		t.Errorf("allowed target: got error=%q, want OK", resp.Error)
+	}
+	if got := connectionErrors(t, m, metrics.ReasonDenylistRejected); got != 1 {
+		t.Errorf("connection_errors_total{reason=denylist_rejected} = %v, want 1", got)
+	}
+	if got := connectionErrors(t, m, metrics.ReasonAllowlistRejected); got != 0 {
+		t.Errorf("connection_errors_total{reason=allowlist_rejected} = %v, want 0", got)
+	}
+}
+
+// TestHandleConnection_DenyIMDS asserts a denied metadata endpoint is
+// refused without a dial even when every target is otherwise allowed.
+func TestHandleConnection_DenyIMDS(t *testing.T) {
+	cfg := Config{
+		AllowList: []string{"*"},
+		DenyList:  []string{"169.254.169.254/32:*"},
+		Logger:    slog.New(slog.DiscardHandler),
+		dialContext: func(context.Context, string, string) (net.Conn, error) {
+			t.Error("denied target was dialed")
+			return nil, errors.New("unexpected dial")
+		},
+	}
+	for _, target := range []string{"169.254.169.254:80", "169.254.169.254:443"} {
+		if resp := driveOneHandshake(t, cfg, target); resp.OK || resp.Code != protocol.CodeNotAllowed {
+			t.Errorf("%s: OK=%v code=%q, want rejection with %q", target, resp.OK, resp.Code, protocol.CodeNotAllowed)
+		}
+	}
+}
+
+func TestHandleConnection_TraceparentContinuesTrace(t *testing.T) {
+	spans := make(chan map[string]any, 1)
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			ResourceSpans []struct {
+				ScopeSpans []struct {
+					Spans []map[string]any `json:"spans"`
+				} `json:"scopeSpans"`
+			} `json:"resourceSpans"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err == nil {
+			spans <- req.ResourceSpans[0].ScopeSpans[0].Spans[0]
+		}
+	}))
+	defer collector.Close()
+	tracer, err := tracing.New(tracing.Config{Endpoint: collector.URL, ExportInterval: 10 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tracer.Close(context.Background()) //nolint:errcheck // span already exported
+
+	const traceparent = "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+	cfg := Config{
+		AllowList: []string{"127.0.0.1:22"},
+		Logger:    slog.New(slog.DiscardHandler),
+		Tracer:    tracer,
+	}
+	resp := driveCustomHandshake(t, cfg, func(ctx context.Context, ws *websocket.Conn) error {
+		data, _ := json.Marshal(protocol.ConnectEnvelope{
+			Version:  protocol.CurrentVersion,
+			Target:   "10.0.0.1:22",
+			BridgeID: "b-1",
+			Metadata: map[string]string{protocol.MetaTraceparent: traceparent},
+		})
+		return ws.Write(ctx, websocket.MessageText, data)
+	})
+	if resp.OK {
+		t.Fatal("target outside the allowlist was accepted")
+	}
+
+	select {
+	case span := <-spans:
+		if span["traceId"] != "4bf92f3577b34da6a3ce929d0e0e4736" || span["parentSpanId"] != "00f067aa0ba902b7" {
+			t.Errorf("span trace/parent = %v/%v, want the sender's traceparent", span["traceId"], span["parentSpanId"])
+		}
+		if span["name"] != "aztunnel.listener.connect" {
+			t.Errorf("span name = %v", span["name"])
+		}
+		status, _ := span["status"].(map[string]any)
+		if status["code"] != float64(2) {
+			t.Errorf("span status = %v, want an error", span["status"])
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no span exported")
+	}
+}
+
+// uriTokenProvider records the resource URI of every token request,
+// one per control-channel attempt.
+type uriTokenProvider struct {
+	mu   sync.Mutex
+	uris map[string]int
+}
+
+func (p *uriTokenProvider) GetToken(_ context.Context, resourceURI string) (string, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.uris[resourceURI]++
+	return "test-token", nil
+}
+
+func (p *uriTokenProvider) seen(uri string) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.uris[uri] > 0
+}
+
+func TestMultiListen_RunsOneLoopPerHyco(t *testing.T) {
+	tp := &uriTokenProvider{uris: map[string]int{}}
+	readiness := &metrics.Readiness{}
+	cfg := Config{
+		// A refused endpoint fails every control dial at once, so each
+		// loop asks for a token and then backs off.
+		Endpoint:      "127.0.0.1:1",
+		TokenProvider: tp,
+		Logger:        slog.New(slog.DiscardHandler),
+		Readiness:     readiness,
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- MultiListen(ctx, cfg, []string{"hyco-a", "hyco-b"}) }()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for _, hyco := range []string{"hyco-a", "hyco-b"} {
+		uri := relay.ResourceURI(cfg.Endpoint, hyco)
+		for !tp.seen(uri) {
+			if time.Now().After(deadline) {
+				t.Fatalf("no control loop requested a token for %s", uri)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	if readiness.Ready() {
+		t.Error("ready with no control channel connected")
+	}
+
+	cancel()
+	select {
+	case err := <-done:
+		if !errors.Is(err, context.Canceled) {
+			t.Errorf("MultiListen = %v, want context.Canceled", err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("MultiListen did not return after cancel")
+	}
+}
+
+func TestMultiListen_StartupErrorStopsAll(t *testing.T) {
+	cfg := Config{
+		Endpoint:      "127.0.0.1:1",
+		TokenProvider: &uriTokenProvider{uris: map[string]int{}},
+		Logger:        slog.New(slog.DiscardHandler),
+		AllowFile:     t.TempDir() + "/missing",
+	}
+	done := make(chan error, 1)
+	go func() { done <- MultiListen(context.Background(), cfg, []string{"hyco-a", "hyco-b"}) }()
+	select {
+	case err := <-done:
+		if err == nil || errors.Is(err, context.Canceled) {
+			t.Errorf("MultiListen = %v, want the allow-file error", err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("MultiListen did not return after a startup error")
+	}
+}
+
+func TestControlSet(t *testing.T) {
+	var single *controlSet
+	if !single.set("a", true) || single.set("a", false) {
+		t.Error("nil controlSet should report the state it was given")
+	}
+	s := &controlSet{up: map[string]bool{"a": false, "b": false}}
+	if s.set("a", true) {
+		t.Error("ready with b still down")
+	}
+	if !s.set("b", true) {
+		t.Error("not ready with both up")
+	}
+	if s.set("a", false) {
+		t.Error("ready after a went down")
+	}
+}
+
+func TestDialRetry(t *testing.T) {
+	refused := &net.OpError{Op: "dial", Net: "tcp", Err: syscall.ECONNREFUSED}
+	logger := slog.New(slog.DiscardHandler)
+
+	t.Run("retries until the target accepts", func(t *testing.T) {
+		var calls int
+		dial := func(context.Context, string, string) (net.Conn, error) {
+			if calls++; calls < 3 {
+				return nil, refused
+			}
+			c, _ := net.Pipe()
+			return c, nil
+		}
+		conn, err := dialRetry(context.Background(), dial, "tcp", []string{"10.0.0.1:22"}, 3, time.Millisecond, logger)
+		if err != nil {
+			t.Fatalf("dialRetry: %v", err)
+		}
+		_ = conn.Close()
+		if calls != 3 {
+			t.Errorf("dials = %d, want 3", calls)
+		}
+	})
+
+	t.Run("returns the last error when retries run out", func(t *testing.T) {
+		var calls int
+		dial := func(context.Context, string, string) (net.Conn, error) {
+			calls++
+			return nil, refused
+		}
+		_, err := dialRetry(context.Background(), dial, "tcp", []string{"10.0.0.1:22"}, 2, time.Millisecond, logger)
+		if classifyDialError(err) != protocol.CodeConnectionRefused {
+			t.Errorf("err = %v, want connection refused", err)
+		}
+		if calls != 3 {
+			t.Errorf("dials = %d, want 3", calls)
+		}
+	})
+
+	t.Run("does not retry other failures", func(t *testing.T) {
+		var calls int
+		dial := func(context.Context, string, string) (net.Conn, error) {
+			calls++
+			return nil, &net.DNSError{Err: "no such host", IsNotFound: true}
+		}
+		_, _ = dialRetry(context.Background(), dial, "tcp", []string{"nope.invalid:22"}, 3, time.Millisecond, logger)
+		if calls != 1 {
+			t.Errorf("dials = %d, want 1", calls)
+		}
+	})
+
+	t.Run("stops waiting when ctx is done", func(t *testing.T) {
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancel()
+		dial := func(context.Context, string, string) (net.Conn, error) { return nil, refused }
+		start := time.Now()
+		_, err := dialRetry(ctx, dial, "tcp", []string{"10.0.0.1:22"}, 5, time.Hour, logger)
+		if elapsed := time.Since(start); elapsed > 5*time.Second {
+			t.Errorf("dialRetry took %v after ctx expired", elapsed)
+		}
+		if classifyDialError(err) != protocol.CodeConnectionRefused {
+			t.Errorf("err = %v, want the last dial error", err)
+		}
+	})
+}
+
+func TestTargetDialer_DialSource(t *testing.T) {
+	lim := Limits{ConnectTimeout: 5 * time.Second}
+	if d := (&Config{}).targetDialer(lim); d.LocalAddr != nil {
+		t.Errorf("LocalAddr = %v without DialSource, want nil", d.LocalAddr)
+	}
+
+	cfg := &Config{DialSource: netip.MustParseAddr("127.0.0.1")}
+	d := cfg.targetDialer(lim)
+	if d.LocalAddr == nil || d.LocalAddr.String() != "127.0.0.1:0" {
+		t.Fatalf("LocalAddr = %v, want 127.0.0.1:0", d.LocalAddr)
+	}
+
+	// A dial through it leaves from the source address.
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close() //nolint:errcheck // best-effort cleanup
+	conn, err := d.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer conn.Close() //nolint:errcheck // best-effort cleanup
+	if ip := conn.LocalAddr().(*net.TCPAddr).IP.String(); ip != "127.0.0.1" {
+		t.Errorf("dialed from %s, want 127.0.0.1", ip)
+	}
+}
+
+func TestHandleConnection_DialFamily(t *testing.T) {
+	for family, want := range map[string]string{
+		"":     "tcp",
+		"auto": "tcp",
+		"ipv4": "tcp4",
+		"ipv6": "tcp6",
+	} {
+		got := make(chan string, 1)
+		cfg := Config{
+			AllowList:  []string{"example.internal:22"},
+			DialFamily: family,
+			Logger:     slog.New(slog.DiscardHandler),
+			dialContext: func(_ context.Context, network, _ string) (net.Conn, error) {
+				got <- network
+				return nil, errors.New("synthetic failure")
+			},
+		}
+		driveOneHandshake(t, cfg, "example.internal:22")
+		if network := <-got; network != want {
+			t.Errorf("DialFamily %q dialed %q, want %q", family, network, want)
+		}
+	}
+}
+
+// TestHandleConnection_UpstreamSOCKS dials a target only a local
+// SOCKS5 proxy can resolve and asserts the listener reaches it through
+// the proxy.
+func TestHandleConnection_UpstreamSOCKS(t *testing.T) {
+	backend := startBackend(t, func(c net.Conn) {
+		defer c.Close() //nolint:errcheck // best-effort cleanup
+		_, _ = c.Write([]byte("hello"))
+		_, _ = io.Copy(io.Discard, c)
+	})
+	requested := make(chan string, 1)
+	proxyAddr := startBackend(t, func(c net.Conn) {
+		defer c.Close() //nolint:errcheck // best-effort cleanup
+		target, err := socks5.Handshake(c)
+		if err != nil {
+			t.Errorf("proxy handshake: %v", err)
+			return
+		}
+		requested <- target
+		if target != "backend.internal:22" {
+			_ = socks5.SendReply(c, socks5.RepHostUnreachable, nil)
+			return
+		}
+		up, err := net.Dial("tcp", backend)
+		if err != nil {
+			_ = socks5.SendReply(c, socks5.RepConnectionRefused, nil)
+			return
+		}
+		defer up.Close() //nolint:errcheck // best-effort cleanup
+		_ = socks5.SendReply(c, socks5.RepSuccess, up.LocalAddr().(*net.TCPAddr))
+		go func() { _, _ = io.Copy(up, c) }()
+		_, _ = io.Copy(c, up)
+	})
+
+	cfg := Config{
+		AllowList:     []string{"backend.internal:22"},
+		UpstreamSOCKS: proxyAddr,
+		Logger:        slog.New(slog.DiscardHandler),
+	}
+	if resp := driveOneHandshake(t, cfg, "backend.internal:22"); !resp.OK {
+		t.Fatalf("response = %+v, want OK", resp)
+	}
+	if got := <-requested; got != "backend.internal:22" {
+		t.Errorf("proxy asked for %q, want backend.internal:22", got)
+	}
+}
+
+// TestHandleConnection_LogsClientAddr asserts the client address a
+// sender reports in the envelope reaches the listener's log lines.
+func TestHandleConnection_LogsClientAddr(t *testing.T) {
+	var logBuf bytes.Buffer
+	cfg := Config{
+		AllowList: []string{"127.0.0.1:22"},
+		Logger:    slog.New(slog.NewTextHandler(&logBuf, nil)),
+	}
+	driveCustomHandshake(t, cfg, func(ctx context.Context, ws *websocket.Conn) error {
+		data, _ := json.Marshal(protocol.ConnectEnvelope{
+			Version:  protocol.CurrentVersion,
+			Target:   "10.0.0.1:22",
+			BridgeID: "b-1",
+			Metadata: map[string]string{protocol.MetaClientAddr: "192.0.2.7:50123"},
+		})
+		return ws.Write(ctx, websocket.MessageText, data)
+	})
+	for _, line := range strings.Split(logBuf.String(), "\n") {
+		if strings.Contains(line, `msg="target not allowed"`) {
+			if !strings.Contains(line, "client_addr=192.0.2.7:50123") {
+				t.Errorf("log line lacks client_addr: %s", line)
+			}
+			return
+		}
+	}
+	t.Fatalf("no 'target not allowed' line in logs:\n%s", logBuf.String())
+}
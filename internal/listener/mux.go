@@ -0,0 +1,211 @@
+package listener
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net"
+	"sync"
+
+	"github.com/coder/websocket"
+	"github.com/philsphicas/aztunnel/internal/metrics"
+	"github.com/philsphicas/aztunnel/internal/protocol"
+	"github.com/philsphicas/aztunnel/internal/relay"
+	"github.com/philsphicas/aztunnel/internal/tracing"
+)
+
+// serveMux handles a protocol.ModeMux envelope: accept the session,
+// then serve each stream the sender opens as its own connection, dialed
+// and checked like a connect envelope. Every stream counts against
+// MaxConnections: the session's own rendezvous slot covers one, and
+// each further stream takes another (see muxSlots), so a mux session
+// gets no more connections than separate rendezvous would. The session
+// lasts until the sender closes the WebSocket.
+func serveMux(ctx context.Context, ws *websocket.Conn, cfg Config, env protocol.ConnectEnvelope, logger *slog.Logger) {
+	logger.Info("mux session requested")
+	if !cfg.AllowMux {
+		logger.Warn("mux not enabled")
+		// The sender takes the code as "unsupported" and dials a
+		// rendezvous per connection from then on.
+		_ = sendResponseWithCode(ctx, ws, cfg, false, "mux not enabled", protocol.CodeNotAllowed)
+		cfg.Metrics.ConnectionError("listener", metrics.ReasonModeNotAllowed)
+		return
+	}
+	if err := sendAccept(ctx, ws, cfg, nil, compressionReply(ctx, env), ""); err != nil {
+		logger.Warn("failed to send response", "error", err)
+		return
+	}
+
+	mux := relay.NewMux(ctx, ws, false, relay.BridgeOptions{PingInterval: cfg.DataPingInterval}, logger)
+	slots := &muxSlots{sessionFree: true}
+	var wg sync.WaitGroup
+	streams := 0
+	for {
+		s, err := mux.Accept(ctx)
+		if err != nil {
+			break
+		}
+		streams++
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			serveStream(ctx, s, cfg, slots)
+		}()
+	}
+	_ = mux.Close()
+	wg.Wait()
+	logger.Debug("mux session ended", "streams", streams)
+}
+
+// muxSlots tracks the MaxConnections slots a mux session's streams
+// hold. The slot the session's rendezvous took when it was accepted
+// goes to one stream at a time; every other stream takes its own from
+// the control loop (relay.AcquireConnSlot).
+type muxSlots struct {
+	mu          sync.Mutex
+	sessionFree bool
+}
+
+// acquire takes a slot for one stream and returns its release, or
+// false when the listener is at MaxConnections.
+func (m *muxSlots) acquire(ctx context.Context) (release func(), ok bool) {
+	m.mu.Lock()
+	if m.sessionFree {
+		m.sessionFree = false
+		m.mu.Unlock()
+		return func() {
+			m.mu.Lock()
+			m.sessionFree = true
+			m.mu.Unlock()
+		}, true
+	}
+	m.mu.Unlock()
+	return relay.AcquireConnSlot(ctx)
+}
+
+// serveStream serves one mux stream: the MuxOpen envelope is checked
+// and its target dialed as serveEnvelope would, and the answer goes
+// back as the stream's MuxReply. A stream that finds the listener at
+// MaxConnections is refused with protocol.CodeAtCapacity.
+func serveStream(ctx context.Context, s *relay.MuxStream, cfg Config, slots *muxSlots) {
+	defer s.Close() //nolint:errcheck // best-effort cleanup
+	logger := cfg.Logger
+	lim := cfg.limits()
+
+	release, ok := slots.acquire(ctx)
+	if !ok {
+		logger.Warn("mux stream refused at max connections", "max_connections", lim.MaxConnections)
+		_ = refuseStream(s, cfg, "listener at max connections", protocol.CodeAtCapacity)
+		cfg.Metrics.ConnectionError("listener", metrics.ReasonAtCapacity)
+		return
+	}
+	defer release()
+
+	var env protocol.ConnectEnvelope
+	if err := json.Unmarshal(s.Header(), &env); err != nil {
+		logger.Warn("invalid envelope", "error", err)
+		_ = refuseStream(s, cfg, "invalid envelope", protocol.CodeInvalidEnvelope)
+		cfg.Metrics.ConnectionError("listener", metrics.ReasonEnvelopeError)
+		return
+	}
+	cfg.Metrics.EnvelopeVersion(env.Version)
+	if env.Version != protocol.CurrentVersion {
+		logger.Warn("unsupported protocol version", "version", env.Version)
+		_ = refuseStream(s, cfg, "unsupported protocol version", protocol.CodeInvalidEnvelope)
+		cfg.Metrics.ConnectionError("listener", metrics.ReasonEnvelopeError)
+		return
+	}
+	if cfg.Metrics.Quiesced() {
+		logger.Info("rejecting connection while quiesced", "target", env.Target)
+		_ = refuseStream(s, cfg, "listener quiescing", protocol.CodeQuiescing)
+		cfg.Metrics.ConnectionError("listener", metrics.ReasonQuiescing)
+		return
+	}
+	if env.Target == "" {
+		_ = refuseStream(s, cfg, "missing target", protocol.CodeInvalidTarget)
+		cfg.Metrics.ConnectionError("listener", metrics.ReasonEnvelopeError)
+		return
+	}
+	if err := env.ValidateMetadata(cfg.MetadataLimits); err != nil {
+		var me *protocol.MetadataError
+		errors.As(err, &me)
+		logger.Warn("envelope metadata rejected", "error", err)
+		_ = refuseStream(s, cfg, "envelope metadata exceeds limits", me.Code)
+		cfg.Metrics.ConnectionError("listener", metrics.ReasonEnvelopeError)
+		return
+	}
+
+	logger = logger.With("bridge_id", env.BridgeID)
+	if client := env.Metadata[protocol.MetaClientAddr]; client != "" {
+		logger = logger.With("client_addr", client)
+	}
+	logger.Info("connection requested", "target", env.Target, "mux", true)
+
+	span := cfg.Tracer.Start("aztunnel.listener.connect", tracing.KindServer, env.Metadata[protocol.MetaTraceparent])
+	defer span.End()
+	span.SetAttr(tracing.AttrTarget, env.Target)
+	span.SetAttr(tracing.AttrBridgeID, env.BridgeID)
+
+	var conn net.Conn
+	if cfg.Echo {
+		conn = newEchoConn()
+	} else {
+		addrs, targetLogger, ref := cfg.checkTarget(ctx, env, lim, logger, span)
+		logger = targetLogger
+		if ref == nil {
+			conn, ref = cfg.dialTarget(ctx, env, addrs, lim, logger, span)
+		}
+		if ref != nil {
+			_ = refuseStream(s, cfg, ref.msg, ref.code)
+			ref.record(cfg, span)
+			return
+		}
+	}
+	defer conn.Close() //nolint:errcheck // best-effort cleanup
+
+	resp := protocol.ConnectResponse{OK: true}
+	if la, ok := conn.LocalAddr().(*net.TCPAddr); ok {
+		resp.LocalAddr = la.String()
+	}
+	if err := replyStream(s, cfg, resp); err != nil {
+		logger.Warn("failed to send response", "error", err)
+		span.SetError(err)
+		return
+	}
+
+	bctx := relay.WithBridgeLogger(ctx, logger)
+	bctx = metrics.WithConnID(bctx, env.BridgeID)
+	bctx = metrics.WithConnLabels(bctx, connLabels(conn, cfg.Endpoint))
+	bctx = metrics.WithClientAddr(bctx, env.Metadata[protocol.MetaClientAddr])
+	opts := relay.BridgeOptions{BufferSize: cfg.BufferSize, IdleTimeout: cfg.IdleTimeout, RateLimit: cfg.RateLimit, PingInterval: cfg.DataPingInterval}
+	result, bridgeErr := cfg.Metrics.TrackedBridgeStream(bctx, s, conn, "listener", env.Target, opts)
+	attrs := []any{
+		"target", env.Target,
+		"cause", result.EndCause,
+		"tcp_to_ws", result.Stats.TCPToWS,
+		"ws_to_tcp", result.Stats.WSToTCP,
+	}
+	if bridgeErr != nil {
+		attrs = append(attrs, "error", bridgeErr)
+	}
+	logger.Debug("bridge ended", attrs...)
+	span.SetAttr(tracing.AttrTCPToWS, result.Stats.TCPToWS)
+	span.SetAttr(tracing.AttrWSToTCP, result.Stats.WSToTCP)
+	span.SetAttr(tracing.AttrEndCause, result.EndCause)
+	span.SetError(bridgeErr)
+}
+
+// replyStream sends resp as a stream's MuxReply, stamped with the
+// protocol version and this listener's ID.
+func replyStream(s *relay.MuxStream, cfg Config, resp protocol.ConnectResponse) error {
+	resp.Version = protocol.CurrentVersion
+	resp.ListenerID = cfg.ListenerID
+	data, _ := json.Marshal(resp) // simple struct, cannot fail
+	return s.Reply(data)
+}
+
+// refuseStream is sendResponseWithCode for a mux stream.
+func refuseStream(s *relay.MuxStream, cfg Config, errMsg, code string) error {
+	return replyStream(s, cfg, protocol.ConnectResponse{Error: errMsg, Code: code})
+}
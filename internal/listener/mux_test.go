@@ -0,0 +1,217 @@
+package listener
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/coder/websocket"
+	"github.com/philsphicas/aztunnel/internal/metrics"
+	"github.com/philsphicas/aztunnel/internal/protocol"
+	"github.com/philsphicas/aztunnel/internal/relay"
+)
+
+// openMuxSession starts a ModeMux session against a real
+// handleConnection and returns the sender's end of the mux, and the
+// response to the mux envelope.
+func openMuxSession(t *testing.T, cfg Config) (context.Context, *relay.Mux, protocol.ConnectResponse) {
+	t.Helper()
+	applyDefaults(&cfg)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	t.Cleanup(cancel)
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ws, err := websocket.Accept(w, r, nil)
+		if err != nil {
+			return
+		}
+		handleConnection(r.Context(), ws, cfg)
+	}))
+	t.Cleanup(srv.Close)
+
+	ws, _, err := websocket.Dial(ctx, "ws"+strings.TrimPrefix(srv.URL, "http"), nil)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	t.Cleanup(func() { _ = ws.CloseNow() })
+	data, _ := json.Marshal(protocol.ConnectEnvelope{Version: protocol.CurrentVersion, Mode: protocol.ModeMux})
+	if err := ws.Write(ctx, websocket.MessageText, data); err != nil {
+		t.Fatalf("send envelope: %v", err)
+	}
+	resp := readResponse(t, ctx, ws)
+	if !resp.OK {
+		return ctx, nil, resp
+	}
+	mux := relay.NewMux(ctx, ws, true, relay.BridgeOptions{}, cfg.Logger)
+	t.Cleanup(func() { _ = mux.Close() })
+	return ctx, mux, resp
+}
+
+// openStream opens a stream to target and returns it with the
+// listener's reply.
+func openStream(t *testing.T, ctx context.Context, mux *relay.Mux, target string) (*relay.MuxStream, protocol.ConnectResponse) {
+	t.Helper()
+	hdr, _ := json.Marshal(protocol.ConnectEnvelope{Version: protocol.CurrentVersion, Target: target})
+	s, reply, err := mux.Open(ctx, hdr)
+	if err != nil {
+		t.Fatalf("open stream: %v", err)
+	}
+	t.Cleanup(func() { _ = s.Close() })
+	var resp protocol.ConnectResponse
+	if err := json.Unmarshal(reply, &resp); err != nil {
+		t.Fatalf("parse reply %q: %v", reply, err)
+	}
+	return s, resp
+}
+
+func TestServeMux_Streams(t *testing.T) {
+	a := greetingTarget(t, "from a")
+	b := greetingTarget(t, "from b")
+	ctx, mux, resp := openMuxSession(t, Config{
+		AllowMux:  true,
+		AllowList: []string{a, b},
+		Logger:    slog.New(slog.NewTextHandler(io.Discard, nil)),
+	})
+	if !resp.OK {
+		t.Fatalf("mux response = %+v, want OK", resp)
+	}
+
+	// Two streams share the session; a refused one does not end it.
+	sa, respA := openStream(t, ctx, mux, a)
+	sb, respB := openStream(t, ctx, mux, b)
+	_, refused := openStream(t, ctx, mux, "127.0.0.1:9")
+	if !respA.OK || !respB.OK || respA.LocalAddr == "" {
+		t.Fatalf("stream replies = %+v, %+v, want OK with a local address", respA, respB)
+	}
+	if refused.OK || refused.Code != protocol.CodeNotAllowed {
+		t.Errorf("refused stream reply = %+v, want %s", refused, protocol.CodeNotAllowed)
+	}
+	for s, want := range map[*relay.MuxStream]string{sa: "from a", sb: "from b"} {
+		_ = s.CloseWrite()
+		got, err := io.ReadAll(s)
+		if err != nil || string(got) != want {
+			t.Errorf("stream read = %q (%v), want %q", got, err, want)
+		}
+	}
+}
+
+func TestServeMux_RefusedWhenChaining(t *testing.T) {
+	_, mux, resp := openMuxSession(t, Config{
+		AllowMux: true,
+		Upstream: &Upstream{Endpoint: "upstream.invalid", EntityPath: "next"},
+		Logger:   slog.New(slog.NewTextHandler(io.Discard, nil)),
+	})
+	if mux != nil || resp.OK || resp.Code != protocol.CodeInvalidEnvelope {
+		t.Errorf("mux response = %+v, want refused with %s", resp, protocol.CodeInvalidEnvelope)
+	}
+}
+
+func TestServeMux_RefusedWithoutAllowMux(t *testing.T) {
+	m := metrics.New()
+	_, mux, resp := openMuxSession(t, Config{
+		Logger:  slog.New(slog.NewTextHandler(io.Discard, nil)),
+		Metrics: m,
+	})
+	if mux != nil || resp.OK || resp.Code != protocol.CodeNotAllowed {
+		t.Errorf("mux response = %+v, want refused with %s", resp, protocol.CodeNotAllowed)
+	}
+	waitConnectionErrors(t, m, metrics.ReasonModeNotAllowed, 1)
+	if got := connectionErrors(t, m, metrics.ReasonAllowlistRejected); got != 0 {
+		t.Errorf("connection_errors_total{reason=allowlist_rejected} = %v, want 0", got)
+	}
+}
+
+// TestServeMux_StreamsCountAgainstMaxConnections runs a listener with
+// MaxConnections 2 behind a fake relay whose one rendezvous opens a
+// mux session: the session's slot and one more carry two streams, a
+// third is refused at capacity, and closing a stream frees its slot.
+func TestServeMux_StreamsCountAgainstMaxConnections(t *testing.T) {
+	target := greetingTarget(t, "hi")
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	sessions := make(chan *websocket.Conn, 1)
+	rendezvous := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ws, err := websocket.Accept(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer ws.CloseNow()
+		sessions <- ws
+		<-ctx.Done()
+	}))
+	defer rendezvous.Close()
+	control := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ws, err := websocket.Accept(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer ws.CloseNow()
+		data, _ := json.Marshal(map[string]any{
+			"accept": map[string]any{"address": "wss" + strings.TrimPrefix(rendezvous.URL, "https"), "id": "mux"},
+		})
+		_ = ws.Write(r.Context(), websocket.MessageText, data)
+		<-r.Context().Done()
+	}))
+	defer control.Close()
+
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	go func() {
+		_ = ListenAndServe(ctx, Config{
+			Endpoint:       strings.TrimPrefix(control.URL, "https://"),
+			EntityPath:     "test-hc",
+			TokenProvider:  &relay.SASTokenProvider{KeyName: "k", Key: "dGVzdGtleQ=="},
+			ClientOptions:  relay.ClientOptions{TLSConfig: control.Client().Transport.(*http.Transport).TLSClientConfig},
+			MaxConnections: 2,
+			AllowMux:       true,
+			AllowList:      []string{target},
+			Logger:         logger,
+		})
+	}()
+
+	var ws *websocket.Conn
+	select {
+	case ws = <-sessions:
+	case <-ctx.Done():
+		t.Fatal("listener never dialed the rendezvous")
+	}
+	data, _ := json.Marshal(protocol.ConnectEnvelope{Version: protocol.CurrentVersion, Mode: protocol.ModeMux})
+	if err := ws.Write(ctx, websocket.MessageText, data); err != nil {
+		t.Fatalf("send envelope: %v", err)
+	}
+	if resp := readResponse(t, ctx, ws); !resp.OK {
+		t.Fatalf("mux response = %+v, want OK", resp)
+	}
+	mux := relay.NewMux(ctx, ws, true, relay.BridgeOptions{}, logger)
+	defer mux.Close()
+
+	first, resp1 := openStream(t, ctx, mux, target)
+	_, resp2 := openStream(t, ctx, mux, target)
+	if !resp1.OK || !resp2.OK {
+		t.Fatalf("stream replies = %+v, %+v, want both OK within MaxConnections", resp1, resp2)
+	}
+	if _, resp := openStream(t, ctx, mux, target); resp.OK || resp.Code != protocol.CodeAtCapacity {
+		t.Errorf("third stream reply = %+v, want refused with %s", resp, protocol.CodeAtCapacity)
+	}
+
+	_ = first.CloseWrite()
+	_, _ = io.ReadAll(first)
+	_ = first.Close()
+	for {
+		s, resp := openStream(t, ctx, mux, target)
+		_ = s.Close()
+		if resp.OK {
+			break
+		}
+		if ctx.Err() != nil {
+			t.Fatal("closing a stream never freed its slot")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,306 @@
+package listener
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/coder/websocket"
+	"github.com/philsphicas/aztunnel/internal/protocol"
+	"github.com/philsphicas/aztunnel/internal/relay"
+)
+
+// greetingTarget starts a TCP server that writes greeting to each
+// connection and closes it, like a Connection: close HTTP server.
+func greetingTarget(t *testing.T, greeting string) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			_, _ = c.Write([]byte(greeting))
+			c.Close()
+		}
+	}()
+	return ln.Addr().String()
+}
+
+// pipelinedSession sends one envelope offering pipelining, checks the
+// listener agreed, and returns the bytes received before the
+// listener's end-of-stream marker. It then sends our own marker so the
+// listener can move on to the next envelope.
+func pipelinedSession(ctx context.Context, t *testing.T, ws *websocket.Conn, target string) string {
+	t.Helper()
+	data, _ := json.Marshal(protocol.ConnectEnvelope{
+		Version:      protocol.CurrentVersion,
+		Target:       target,
+		Capabilities: []string{protocol.CapPipelining},
+	})
+	if err := ws.Write(ctx, websocket.MessageText, data); err != nil {
+		t.Fatalf("send envelope: %v", err)
+	}
+	_, data, err := ws.Read(ctx)
+	if err != nil {
+		t.Fatalf("read response: %v", err)
+	}
+	var resp protocol.ConnectResponse
+	if err := json.Unmarshal(data, &resp); err != nil {
+		t.Fatalf("parse response: %v", err)
+	}
+	if !resp.OK || !protocol.HasCapability(resp.Capabilities, protocol.CapPipelining) {
+		t.Fatalf("response = %+v, want OK with pipelining", resp)
+	}
+
+	var got strings.Builder
+	for {
+		typ, data, err := ws.Read(ctx)
+		if err != nil {
+			t.Fatalf("read data: %v", err)
+		}
+		if typ == websocket.MessageText {
+			break
+		}
+		got.Write(data)
+	}
+	eos, _ := json.Marshal(protocol.EndOfStream{EOS: true})
+	if err := ws.Write(ctx, websocket.MessageText, eos); err != nil {
+		t.Fatalf("send end-of-stream: %v", err)
+	}
+	return got.String()
+}
+
+func TestHandleConnection_PipelinedEnvelopes(t *testing.T) {
+	targetA := greetingTarget(t, "hello from A")
+	targetB := greetingTarget(t, "hello from B")
+
+	cfg := Config{Logger: slog.New(slog.NewTextHandler(io.Discard, nil))}
+	applyDefaults(&cfg)
+	done := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ws, err := websocket.Accept(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer ws.CloseNow() //nolint:errcheck // best-effort cleanup
+		handleConnection(r.Context(), ws, cfg)
+		close(done)
+	}))
+	defer srv.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	ws, _, err := websocket.Dial(ctx, "ws"+strings.TrimPrefix(srv.URL, "http"), nil)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer ws.CloseNow() //nolint:errcheck // best-effort cleanup
+
+	if got := pipelinedSession(ctx, t, ws, targetA); got != "hello from A" {
+		t.Errorf("first session got %q, want %q", got, "hello from A")
+	}
+	if got := pipelinedSession(ctx, t, ws, targetB); got != "hello from B" {
+		t.Errorf("second session got %q, want %q", got, "hello from B")
+	}
+
+	// Closing the idle rendezvous ends handleConnection.
+	_ = ws.Close(websocket.StatusNormalClosure, "")
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("handleConnection did not return after the sender closed")
+	}
+}
+
+func TestHandleConnection_NoPipeliningWithoutCapability(t *testing.T) {
+	cfg := Config{
+		Echo:   true,
+		Logger: slog.New(slog.NewTextHandler(io.Discard, nil)),
+	}
+	resp := driveOneHandshake(t, cfg, "x:1")
+	if !resp.OK {
+		t.Fatalf("response = %+v, want OK", resp)
+	}
+	if len(resp.Capabilities) != 0 {
+		t.Errorf("capabilities = %v, want none when the sender offered none", resp.Capabilities)
+	}
+}
+
+// TestHandleConnection_HalfClose offers protocol.CapHalfClose and
+// sends an end-of-stream marker after the request: the target must
+// see EOF, and its reply (written after that EOF) must still come
+// back, followed by the listener's own marker.
+func TestHandleConnection_HalfClose(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer ln.Close()
+	go func() {
+		c, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		req, _ := io.ReadAll(c)
+		_, _ = c.Write(append([]byte("reply to "), req...))
+	}()
+
+	cfg := Config{Logger: slog.New(slog.NewTextHandler(io.Discard, nil))}
+	applyDefaults(&cfg)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ws, err := websocket.Accept(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer ws.CloseNow() //nolint:errcheck // best-effort cleanup
+		handleConnection(r.Context(), ws, cfg)
+	}))
+	defer srv.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	ws, _, err := websocket.Dial(ctx, "ws"+strings.TrimPrefix(srv.URL, "http"), nil)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer ws.CloseNow() //nolint:errcheck // best-effort cleanup
+
+	data, _ := json.Marshal(protocol.ConnectEnvelope{
+		Version:      protocol.CurrentVersion,
+		Target:       ln.Addr().String(),
+		Capabilities: []string{protocol.CapHalfClose},
+	})
+	if err := ws.Write(ctx, websocket.MessageText, data); err != nil {
+		t.Fatalf("send envelope: %v", err)
+	}
+	_, data, err = ws.Read(ctx)
+	if err != nil {
+		t.Fatalf("read response: %v", err)
+	}
+	var resp protocol.ConnectResponse
+	if err := json.Unmarshal(data, &resp); err != nil {
+		t.Fatalf("parse response: %v", err)
+	}
+	if !resp.OK || !protocol.HasCapability(resp.Capabilities, protocol.CapHalfClose) {
+		t.Fatalf("response = %+v, want OK with half_close", resp)
+	}
+
+	if err := ws.Write(ctx, websocket.MessageBinary, []byte("ping")); err != nil {
+		t.Fatalf("send data: %v", err)
+	}
+	eos, _ := json.Marshal(protocol.EndOfStream{EOS: true})
+	if err := ws.Write(ctx, websocket.MessageText, eos); err != nil {
+		t.Fatalf("send end-of-stream: %v", err)
+	}
+
+	var got strings.Builder
+	for {
+		typ, data, err := ws.Read(ctx)
+		if err != nil {
+			t.Fatalf("read data after %q: %v", got.String(), err)
+		}
+		if typ == websocket.MessageText {
+			break
+		}
+		got.Write(data)
+	}
+	if got.String() != "reply to ping" {
+		t.Errorf("got %q, want %q", got.String(), "reply to ping")
+	}
+}
+
+// TestListenAndServe_IdlePipelinedRendezvousFreesSlot parks a pipelined
+// rendezvous after one session, as the sender's pool does, on a
+// listener with MaxConnections 1. The listener must close it after
+// PipelineIdleTimeout so the next accept gets the slot.
+func TestListenAndServe_IdlePipelinedRendezvousFreesSlot(t *testing.T) {
+	target := greetingTarget(t, "hello")
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	sessions := make(chan *websocket.Conn, 2)
+	rendezvous := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ws, err := websocket.Accept(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer ws.CloseNow()
+		sessions <- ws
+		<-ctx.Done()
+	}))
+	defer rendezvous.Close()
+	accepts := make(chan string)
+	control := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ws, err := websocket.Accept(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer ws.CloseNow()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case id := <-accepts:
+				data, _ := json.Marshal(map[string]any{
+					"accept": map[string]any{"address": "wss" + strings.TrimPrefix(rendezvous.URL, "https"), "id": id},
+				})
+				if ws.Write(ctx, websocket.MessageText, data) != nil {
+					return
+				}
+			}
+		}
+	}))
+	defer control.Close()
+
+	go func() {
+		_ = ListenAndServe(ctx, Config{
+			Endpoint:            strings.TrimPrefix(control.URL, "https://"),
+			EntityPath:          "test-hc",
+			TokenProvider:       &relay.SASTokenProvider{KeyName: "k", Key: "dGVzdGtleQ=="},
+			ClientOptions:       relay.ClientOptions{TLSConfig: control.Client().Transport.(*http.Transport).TLSClientConfig},
+			MaxConnections:      1,
+			PipelineIdleTimeout: 200 * time.Millisecond,
+			AllowList:           []string{target},
+			Logger:              slog.New(slog.NewTextHandler(io.Discard, nil)),
+		})
+	}()
+
+	accept := func(id string) *websocket.Conn {
+		t.Helper()
+		accepts <- id
+		select {
+		case ws := <-sessions:
+			return ws
+		case <-time.After(5 * time.Second):
+			t.Fatalf("accept %s: listener never dialed the rendezvous", id)
+			return nil
+		}
+	}
+	ws := accept("first")
+	if got := pipelinedSession(ctx, t, ws, target); got != "hello" {
+		t.Fatalf("session got %q, want hello", got)
+	}
+
+	// Park the rendezvous: the listener must give up on it.
+	start := time.Now()
+	readCtx, readCancel := context.WithTimeout(ctx, 5*time.Second)
+	defer readCancel()
+	if _, _, err := ws.Read(readCtx); readCtx.Err() != nil {
+		t.Fatalf("idle pipelined rendezvous still open after %v: %v", time.Since(start), err)
+	}
+	accept("second")
+}
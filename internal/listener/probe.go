@@ -0,0 +1,65 @@
+package listener
+
+import (
+	"errors"
+	"net"
+	"os"
+	"time"
+)
+
+// probeTimeout is how long probeTarget waits on a fresh target
+// connection. A backend that accepts and then resets or closes at once
+// does so well within it; a healthy one that waits for the client to
+// speak first simply times out.
+const probeTimeout = 100 * time.Millisecond
+
+// probeTarget reads from a freshly dialed target connection for up to
+// probeTimeout to catch backends that accept and then immediately
+// close or reset, before the listener reports success to the sender.
+// A read that times out means the connection is open and idle. A read
+// that returns data (a server banner) also passes; the returned conn
+// replays those bytes ahead of the rest of the stream. Any other
+// result is returned as an error and the caller should reject the
+// connection.
+func probeTarget(conn net.Conn) (net.Conn, error) {
+	if err := conn.SetReadDeadline(time.Now().Add(probeTimeout)); err != nil {
+		return nil, err
+	}
+	buf := make([]byte, 4096)
+	n, err := conn.Read(buf)
+	if derr := conn.SetReadDeadline(time.Time{}); derr != nil {
+		return nil, derr
+	}
+	if n > 0 {
+		return &probedConn{Conn: conn, pending: buf[:n]}, nil
+	}
+	if errors.Is(err, os.ErrDeadlineExceeded) {
+		return conn, nil
+	}
+	return nil, err
+}
+
+// probedConn is a target connection whose first bytes were consumed by
+// probeTarget. Reads return those bytes first.
+type probedConn struct {
+	net.Conn
+	pending []byte
+}
+
+func (c *probedConn) Read(p []byte) (int, error) {
+	if len(c.pending) > 0 {
+		n := copy(p, c.pending)
+		c.pending = c.pending[n:]
+		return n, nil
+	}
+	return c.Conn.Read(p)
+}
+
+// CloseWrite half-closes the underlying connection when it supports
+// it, so pipelined sessions can still signal end-of-stream.
+func (c *probedConn) CloseWrite() error {
+	if cw, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return nil
+}
@@ -0,0 +1,88 @@
+package listener
+
+import (
+	"io"
+	"log/slog"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/philsphicas/aztunnel/internal/protocol"
+)
+
+// startBackend listens on loopback and runs serve on every accepted
+// connection. It returns the listen address.
+func startBackend(t *testing.T, serve func(net.Conn)) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	t.Cleanup(func() { _ = ln.Close() })
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go serve(c)
+		}
+	}()
+	return ln.Addr().String()
+}
+
+func probeTestConfig() Config {
+	return Config{
+		ProbeTarget:    true,
+		ConnectTimeout: 5 * time.Second,
+		Logger:         slog.New(slog.NewTextHandler(io.Discard, nil)),
+	}
+}
+
+func TestProbeTarget_RejectsAcceptThenClose(t *testing.T) {
+	target := startBackend(t, func(c net.Conn) { _ = c.Close() })
+
+	resp := driveOneHandshake(t, probeTestConfig(), target)
+	if resp.OK {
+		t.Fatal("listener reported success for a backend that closed on accept")
+	}
+	if resp.Code != protocol.CodeConnectionRefused {
+		t.Errorf("Code = %q, want %q", resp.Code, protocol.CodeConnectionRefused)
+	}
+}
+
+func TestProbeTarget_AcceptsIdleBackend(t *testing.T) {
+	target := startBackend(t, func(c net.Conn) {
+		defer c.Close() //nolint:errcheck // best-effort cleanup
+		_, _ = io.Copy(io.Discard, c)
+	})
+
+	if resp := driveOneHandshake(t, probeTestConfig(), target); !resp.OK {
+		t.Errorf("response = %+v, want OK for an idle backend", resp)
+	}
+}
+
+func TestProbeTarget_KeepsBanner(t *testing.T) {
+	target := startBackend(t, func(c net.Conn) {
+		defer c.Close() //nolint:errcheck // best-effort cleanup
+		_, _ = c.Write([]byte("SSH-2.0-test\r\n"))
+		_, _ = io.Copy(io.Discard, c)
+	})
+	conn, err := net.Dial("tcp", target)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer conn.Close() //nolint:errcheck // best-effort cleanup
+
+	probed, err := probeTarget(conn)
+	if err != nil {
+		t.Fatalf("probeTarget: %v", err)
+	}
+	buf := make([]byte, len("SSH-2.0-test\r\n"))
+	if _, err := io.ReadFull(probed, buf); err != nil || string(buf) != "SSH-2.0-test\r\n" {
+		t.Errorf("read after probe = %q, %v; want the banner", buf, err)
+	}
+	if _, ok := probed.(interface{ CloseWrite() error }); !ok {
+		t.Error("probed conn lost CloseWrite")
+	}
+}
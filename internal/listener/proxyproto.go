@@ -0,0 +1,68 @@
+package listener
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"net/netip"
+	"time"
+)
+
+// proxyV2Signature opens every PROXY protocol v2 header
+// (https://www.haproxy.org/download/2.9/doc/proxy-protocol.txt).
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// PROXY v2 version/command and address family bytes.
+const (
+	proxyV2Local = 0x20 // version 2, LOCAL: use the connection's own addresses
+	proxyV2Proxy = 0x21 // version 2, PROXY: addresses follow
+	proxyV2TCP4  = 0x11
+	proxyV2TCP6  = 0x21
+)
+
+// proxyHeaderV2 returns the PROXY protocol v2 header the listener
+// writes to a target connection ahead of any data. client is the
+// original client's ip:port as the sender reported it in
+// protocol.MetaClientAddr, and target is the target connection's
+// remote address. When client is empty or unparseable the header
+// uses the LOCAL command, which tells the target to fall back to the
+// connection's real endpoints, so a sender that does not report an
+// address never gets a made-up one. Mixed families are sent as IPv6,
+// with the IPv4 side mapped.
+func proxyHeaderV2(client string, target net.Addr) []byte {
+	src, srcErr := netip.ParseAddrPort(client)
+	var dst netip.AddrPort
+	if ta, ok := target.(*net.TCPAddr); ok {
+		dst = ta.AddrPort()
+	}
+	if srcErr != nil || !dst.IsValid() {
+		return append(append([]byte{}, proxyV2Signature...), proxyV2Local, 0, 0, 0)
+	}
+
+	srcIP, dstIP := src.Addr().Unmap(), dst.Addr().Unmap()
+	fam := byte(proxyV2TCP4)
+	if !srcIP.Is4() || !dstIP.Is4() {
+		fam = proxyV2TCP6
+		srcIP, dstIP = netip.AddrFrom16(srcIP.As16()), netip.AddrFrom16(dstIP.As16())
+	}
+	addrs := srcIP.AsSlice()
+	addrs = append(addrs, dstIP.AsSlice()...)
+	addrs = binary.BigEndian.AppendUint16(addrs, src.Port())
+	addrs = binary.BigEndian.AppendUint16(addrs, dst.Port())
+
+	h := append([]byte{}, proxyV2Signature...)
+	h = append(h, proxyV2Proxy, fam)
+	h = binary.BigEndian.AppendUint16(h, uint16(len(addrs)))
+	return append(h, addrs...)
+}
+
+// writeProxyHeader writes the PROXY v2 header for client to a freshly
+// dialed target connection, bounded by timeout.
+func writeProxyHeader(conn net.Conn, client string, timeout time.Duration) error {
+	_ = conn.SetWriteDeadline(time.Now().Add(timeout))
+	defer conn.SetWriteDeadline(time.Time{}) //nolint:errcheck // best-effort reset
+	if _, err := conn.Write(proxyHeaderV2(client, conn.RemoteAddr())); err != nil {
+		return fmt.Errorf("PROXY header: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,92 @@
+package listener
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/coder/websocket"
+	"github.com/philsphicas/aztunnel/internal/protocol"
+)
+
+func TestProxyHeaderV2(t *testing.T) {
+	const sig = "0d0a0d0a000d0a515549540a"
+	for _, tc := range []struct {
+		name   string
+		client string
+		target net.Addr
+		want   string
+	}{
+		{
+			"ipv4", "192.0.2.7:50123", &net.TCPAddr{IP: net.ParseIP("10.0.0.5"), Port: 5432},
+			sig + "21" + "11" + "000c" + "c0000207" + "0a000005" + "c3cb" + "1538",
+		},
+		{
+			"ipv6", "[2001:db8::1]:443", &net.TCPAddr{IP: net.ParseIP("2001:db8::2"), Port: 22},
+			sig + "21" + "21" + "0024" + "20010db8000000000000000000000001" + "20010db8000000000000000000000002" + "01bb" + "0016",
+		},
+		{
+			"mixed", "192.0.2.7:1", &net.TCPAddr{IP: net.ParseIP("::1"), Port: 2},
+			sig + "21" + "21" + "0024" + "00000000000000000000ffffc0000207" + "00000000000000000000000000000001" + "0001" + "0002",
+		},
+		{"no client", "", &net.TCPAddr{IP: net.ParseIP("10.0.0.5"), Port: 5432}, sig + "20" + "00" + "0000"},
+		{"bad client", "not-an-addr", &net.TCPAddr{IP: net.ParseIP("10.0.0.5"), Port: 5432}, sig + "20" + "00" + "0000"},
+		{"unix target", "192.0.2.7:1", &net.UnixAddr{Name: "/run/db.sock", Net: "unix"}, sig + "20" + "00" + "0000"},
+	} {
+		if got := hex.EncodeToString(proxyHeaderV2(tc.client, tc.target)); got != tc.want {
+			t.Errorf("%s: header = %s, want %s", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestProxyProtocol_HeaderPrecedesData(t *testing.T) {
+	got := make(chan []byte, 1)
+	target := startBackend(t, func(c net.Conn) {
+		defer c.Close() //nolint:errcheck // best-effort cleanup
+		buf := make([]byte, 28)
+		_ = c.SetReadDeadline(time.Now().Add(5 * time.Second))
+		_, _ = io.ReadFull(c, buf)
+		got <- buf
+	})
+	cfg := Config{
+		ProxyProtocol:  true,
+		ConnectTimeout: 5 * time.Second,
+		Logger:         slog.New(slog.NewTextHandler(io.Discard, nil)),
+	}
+	resp := driveCustomHandshake(t, cfg, func(ctx context.Context, ws *websocket.Conn) error {
+		data, _ := json.Marshal(protocol.ConnectEnvelope{
+			Version:  protocol.CurrentVersion,
+			Target:   target,
+			Metadata: map[string]string{protocol.MetaClientAddr: "192.0.2.7:50123"},
+		})
+		return ws.Write(ctx, websocket.MessageText, data)
+	})
+	if !resp.OK {
+		t.Fatalf("response = %+v, want OK", resp)
+	}
+
+	want := proxyHeaderV2("192.0.2.7:50123", mustTCPAddr(t, target))
+	select {
+	case b := <-got:
+		if !bytes.Equal(b, want) {
+			t.Errorf("target read %x, want %x", b, want)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("target received no header")
+	}
+}
+
+func mustTCPAddr(t *testing.T, addr string) *net.TCPAddr {
+	t.Helper()
+	a, err := net.ResolveTCPAddr("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return a
+}
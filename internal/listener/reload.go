@@ -0,0 +1,228 @@
+package listener
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/signal"
+	"slices"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/philsphicas/aztunnel/internal/allowlist"
+)
+
+// Limits are the listener settings that can change at runtime without
+// restarting the process or dropping the control channel. A reload
+// swaps the whole struct atomically: connections accepted after the
+// swap see the new values, while connections already in flight keep
+// the snapshot they started with.
+type Limits struct {
+	MaxConnections int           // 0 = unlimited
+	ConnectTimeout time.Duration // envelope read + target dial budget
+	TCPKeepAlive   time.Duration // keepalive period for target TCP conns
+}
+
+// withDefaults fills zero-valued durations with the same defaults
+// applyDefaults uses at startup.
+func (l Limits) withDefaults() Limits {
+	if l.ConnectTimeout == 0 {
+		l.ConnectTimeout = 30 * time.Second
+	}
+	if l.TCPKeepAlive == 0 {
+		l.TCPKeepAlive = 30 * time.Second
+	}
+	return l
+}
+
+func (l Limits) validate() error {
+	if l.MaxConnections < 0 {
+		return fmt.Errorf("max connections must be >= 0, got %d", l.MaxConnections)
+	}
+	if l.ConnectTimeout < 0 {
+		return fmt.Errorf("connect timeout must be >= 0, got %s", l.ConnectTimeout)
+	}
+	if l.TCPKeepAlive < 0 {
+		return fmt.Errorf("tcp keepalive must be >= 0, got %s", l.TCPKeepAlive)
+	}
+	return nil
+}
+
+// liveLimits is the shared, atomically-swappable holder behind
+// Config. It is a pointer so every copy of a Config (handleConnection
+// takes Config by value) observes the same reloads.
+type liveLimits struct {
+	p atomic.Pointer[Limits]
+}
+
+// limits returns the current effective limits. Configs that never went
+// through applyDefaults (some tests drive handleConnection directly)
+// fall back to the static fields.
+func (c *Config) limits() Limits {
+	if c.live != nil {
+		if l := c.live.p.Load(); l != nil {
+			return *l
+		}
+	}
+	return Limits{
+		MaxConnections: c.MaxConnections,
+		ConnectTimeout: c.ConnectTimeout,
+		TCPKeepAlive:   c.TCPKeepAlive,
+	}
+}
+
+// setLimits validates l and, if valid, makes it the effective limits
+// for connections accepted from now on.
+func (c *Config) setLimits(l Limits) error {
+	if err := l.validate(); err != nil {
+		return err
+	}
+	if c.live == nil {
+		return errors.New("listener limits not initialised")
+	}
+	l = l.withDefaults()
+	c.live.p.Store(&l)
+	return nil
+}
+
+// liveList is a shared, atomically-swappable target list behind
+// Config.AllowFile or Config.DenyFile, a pointer for the same reason
+// as liveLimits.
+type liveList struct {
+	p atomic.Pointer[[]string]
+}
+
+// allowed reports whether target passes the current allowlist. Without
+// AllowFile an empty AllowList permits everything.
+func (c *Config) allowed(target string) bool {
+	list := c.AllowList
+	if c.allow != nil {
+		if l := c.allow.p.Load(); l != nil {
+			list = *l
+		}
+	}
+	if len(list) == 0 && c.AllowFile == "" {
+		return true
+	}
+	return allowlist.Allowed(target, list)
+}
+
+// denied reports whether target matches the current denylist.
+func (c *Config) denied(target string) bool {
+	list := c.DenyList
+	if c.deny != nil {
+		if l := c.deny.p.Load(); l != nil {
+			list = *l
+		}
+	}
+	return allowlist.Allowed(target, list)
+}
+
+// loadAllowFile reads cfg.AllowFile and makes AllowList plus its
+// entries the allowlist for connections accepted from now on. Lines
+// that are not valid entries are logged and skipped. A file that
+// cannot be read is an error and leaves the current list in place.
+func loadAllowFile(cfg *Config) error {
+	if cfg.allow == nil {
+		cfg.allow = &liveList{}
+	}
+	return loadListFile(cfg.Logger, "allow", cfg.AllowFile, cfg.AllowList, cfg.allow)
+}
+
+// loadDenyFile is loadAllowFile for cfg.DenyFile and DenyList.
+func loadDenyFile(cfg *Config) error {
+	if cfg.deny == nil {
+		cfg.deny = &liveList{}
+	}
+	return loadListFile(cfg.Logger, "deny", cfg.DenyFile, cfg.DenyList, cfg.deny)
+}
+
+// loadListFile reads the kind ("allow" or "deny") list file at path
+// and stores base plus its valid entries in live.
+func loadListFile(logger *slog.Logger, kind, path string, base []string, live *liveList) error {
+	entries, rejected, err := allowlist.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("read %s file: %w", kind, err)
+	}
+	for _, r := range rejected {
+		logger.Warn(kind+" file entry rejected", "path", path, "error", r)
+	}
+	list := append(slices.Clip(base), entries...)
+	live.p.Store(&list)
+	logger.Info(kind+"list loaded", "path", path, "entries", len(list), "rejected", len(rejected))
+	return nil
+}
+
+// reload re-reads cfg.AllowFile, cfg.DenyFile, and cfg.MapFile, if set,
+// and fetches fresh limits from cfg.Reload, if set, applying each
+// independently. A failed read, fetch, or invalid result leaves the
+// corresponding current values untouched.
+func reload(cfg *Config) {
+	if cfg.AllowFile != "" {
+		if err := loadAllowFile(cfg); err != nil {
+			cfg.Logger.Warn("reload failed, keeping current allowlist", "error", err)
+		}
+	}
+	if cfg.DenyFile != "" {
+		if err := loadDenyFile(cfg); err != nil {
+			cfg.Logger.Warn("reload failed, keeping current denylist", "error", err)
+		}
+	}
+	if cfg.MapFile != "" {
+		if err := loadMapFile(cfg); err != nil {
+			cfg.Logger.Warn("reload failed, keeping current target map", "error", err)
+		}
+	}
+	if cfg.Reload == nil {
+		return
+	}
+	l, err := cfg.Reload()
+	if err == nil {
+		err = cfg.setLimits(l)
+	}
+	if err != nil {
+		cfg.Logger.Warn("reload failed, keeping current limits", "error", err)
+		return
+	}
+	cur := cfg.limits()
+	cfg.Logger.Info("listener limits reloaded",
+		"max_connections", cur.MaxConnections,
+		"connect_timeout", cur.ConnectTimeout,
+		"tcp_keepalive", cur.TCPKeepAlive)
+}
+
+// watchReload calls reload for every value received on sig until ctx
+// is done. Split from notifyReload so tests can drive it without
+// delivering real signals to the test process.
+func watchReload(ctx context.Context, cfg *Config, sig <-chan os.Signal) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-sig:
+			reload(cfg)
+		}
+	}
+}
+
+// notifyReload starts a goroutine that reloads cfg's allowlist,
+// denylist, and target map files and limits on SIGHUP.
+// The returned stop function unregisters the signal handler.
+func notifyReload(ctx context.Context, cfg *Config) (stop func()) {
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGHUP)
+	ctx, cancel := context.WithCancel(ctx)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		watchReload(ctx, cfg, sig)
+	}()
+	return func() {
+		signal.Stop(sig)
+		cancel()
+		<-done
+	}
+}
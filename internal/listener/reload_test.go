@@ -0,0 +1,229 @@
+package listener
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// TestReload_ChangesMaxConnections drives the SIGHUP watcher with a
+// synthetic signal and asserts the effective MaxConnections — the value
+// the relay control loop consults on every accept — picks up the
+// reloaded value while an in-flight snapshot keeps the old one.
+func TestReload_ChangesMaxConnections(t *testing.T) {
+	cfg := Config{
+		MaxConnections: 1,
+		Logger:         slog.New(slog.DiscardHandler),
+		Reload: func() (Limits, error) {
+			return Limits{MaxConnections: 5, ConnectTimeout: 2 * time.Second}, nil
+		},
+	}
+	applyDefaults(&cfg)
+
+	inFlight := cfg.limits()
+	if inFlight.MaxConnections != 1 {
+		t.Fatalf("initial MaxConnections = %d, want 1", inFlight.MaxConnections)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	sig := make(chan os.Signal, 1)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		watchReload(ctx, &cfg, sig)
+	}()
+	sig <- syscall.SIGHUP
+
+	deadline := time.Now().Add(2 * time.Second)
+	for cfg.limits().MaxConnections != 5 {
+		if time.Now().After(deadline) {
+			t.Fatalf("MaxConnections = %d after reload, want 5", cfg.limits().MaxConnections)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	cancel()
+	<-done
+
+	got := cfg.limits()
+	if got.ConnectTimeout != 2*time.Second {
+		t.Errorf("ConnectTimeout = %s, want 2s", got.ConnectTimeout)
+	}
+	// Unset fields fall back to the startup defaults.
+	if got.TCPKeepAlive != 30*time.Second {
+		t.Errorf("TCPKeepAlive = %s, want 30s default", got.TCPKeepAlive)
+	}
+	// Copies of cfg (handleConnection takes Config by value) share the
+	// same live limits.
+	cp := cfg
+	if cp.limits().MaxConnections != 5 {
+		t.Errorf("copied config MaxConnections = %d, want 5", cp.limits().MaxConnections)
+	}
+	if inFlight.MaxConnections != 1 {
+		t.Errorf("in-flight snapshot changed to %d", inFlight.MaxConnections)
+	}
+}
+
+func TestReload_ErrorKeepsCurrentLimits(t *testing.T) {
+	tests := []struct {
+		name   string
+		reload func() (Limits, error)
+	}{
+		{"fetch error", func() (Limits, error) { return Limits{}, errors.New("config file unreadable") }},
+		{"negative max", func() (Limits, error) { return Limits{MaxConnections: -1}, nil }},
+		{"negative timeout", func() (Limits, error) { return Limits{ConnectTimeout: -time.Second}, nil }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			cfg := Config{
+				MaxConnections: 7,
+				Logger:         slog.New(slog.NewTextHandler(&buf, nil)),
+				Reload:         tt.reload,
+			}
+			applyDefaults(&cfg)
+
+			reload(&cfg)
+
+			if got := cfg.limits().MaxConnections; got != 7 {
+				t.Errorf("MaxConnections = %d after failed reload, want 7", got)
+			}
+			if !strings.Contains(buf.String(), "reload failed") {
+				t.Errorf("missing reload failure log:\n%s", buf.String())
+			}
+		})
+	}
+}
+
+func TestLimits_WithoutApplyDefaultsUsesStaticFields(t *testing.T) {
+	cfg := Config{MaxConnections: 3, ConnectTimeout: time.Second}
+	got := cfg.limits()
+	if got.MaxConnections != 3 || got.ConnectTimeout != time.Second {
+		t.Errorf("limits() = %+v, want static fields", got)
+	}
+	if err := cfg.setLimits(Limits{MaxConnections: 1}); err == nil {
+		t.Error("setLimits on an uninitialised config should fail")
+	}
+}
+
+// TestReload_AllowFile loads an allowlist file, rewrites it, and checks
+// a SIGHUP-driven reload swaps the list for new connections, keeps the
+// --allow entries, logs rejected lines, and survives a missing file.
+func TestReload_AllowFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "allow")
+	if err := os.WriteFile(path, []byte("# jump hosts\n10.0.0.0/8:22\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	cfg := Config{
+		AllowList: []string{"db.internal:5432"},
+		AllowFile: path,
+		Logger:    slog.New(slog.NewTextHandler(&buf, nil)),
+	}
+	applyDefaults(&cfg)
+	if err := loadAllowFile(&cfg); err != nil {
+		t.Fatalf("loadAllowFile: %v", err)
+	}
+	check := func(when string, want map[string]bool) {
+		t.Helper()
+		for target, ok := range want {
+			if got := cfg.allowed(target); got != ok {
+				t.Errorf("%s: allowed(%q) = %v, want %v", when, target, got, ok)
+			}
+		}
+	}
+	check("initial", map[string]bool{"10.1.2.3:22": true, "db.internal:5432": true, "192.168.0.1:22": false})
+
+	if err := os.WriteFile(path, []byte("192.168.0.0/16:*\nbogus\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	sig := make(chan os.Signal, 1)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		watchReload(ctx, &cfg, sig)
+	}()
+	sig <- syscall.SIGHUP
+	deadline := time.Now().Add(2 * time.Second)
+	for !cfg.allowed("192.168.0.1:22") {
+		if time.Now().After(deadline) {
+			t.Fatal("allowlist not reloaded after SIGHUP")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	cancel()
+	<-done
+	check("after reload", map[string]bool{"10.1.2.3:22": false, "db.internal:5432": true, "192.168.0.1:443": true})
+	if !strings.Contains(buf.String(), "allow file entry rejected") || !strings.Contains(buf.String(), "line 2") {
+		t.Errorf("missing rejected-line log:\n%s", buf.String())
+	}
+
+	if err := os.Remove(path); err != nil {
+		t.Fatal(err)
+	}
+	reload(&cfg)
+	check("after failed reload", map[string]bool{"192.168.0.1:443": true})
+	if !strings.Contains(buf.String(), "keeping current allowlist") {
+		t.Errorf("missing reload failure log:\n%s", buf.String())
+	}
+}
+
+func TestAllowFile_EmptyDeniesAll(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "allow")
+	if err := os.WriteFile(path, []byte("# nothing yet\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	cfg := Config{AllowFile: path, Logger: slog.New(slog.DiscardHandler)}
+	applyDefaults(&cfg)
+	if err := loadAllowFile(&cfg); err != nil {
+		t.Fatalf("loadAllowFile: %v", err)
+	}
+	if cfg.allowed("10.0.0.1:22") {
+		t.Error("empty allow file permitted a target, want all denied")
+	}
+	if !(&Config{}).allowed("10.0.0.1:22") {
+		t.Error("no allowlist and no allow file should permit every target")
+	}
+}
+
+func TestReload_DenyFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "deny")
+	if err := os.WriteFile(path, []byte("# IMDS\n169.254.169.254/32:*\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	cfg := Config{DenyList: []string{"10.0.0.1:22"}, DenyFile: path, Logger: slog.New(slog.DiscardHandler)}
+	applyDefaults(&cfg)
+	if err := loadDenyFile(&cfg); err != nil {
+		t.Fatalf("loadDenyFile: %v", err)
+	}
+	if !cfg.denied("169.254.169.254:80") || !cfg.denied("10.0.0.1:22") || cfg.denied("10.0.0.2:22") {
+		t.Error("initial denylist does not match DenyList plus the file")
+	}
+
+	if err := os.WriteFile(path, []byte("10.0.0.2:22\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	reload(&cfg)
+	if cfg.denied("169.254.169.254:80") || !cfg.denied("10.0.0.1:22") || !cfg.denied("10.0.0.2:22") {
+		t.Error("denylist not replaced by the reloaded file")
+	}
+
+	if err := os.Remove(path); err != nil {
+		t.Fatal(err)
+	}
+	reload(&cfg)
+	if !cfg.denied("10.0.0.2:22") {
+		t.Error("unreadable deny file dropped the current denylist")
+	}
+	if (&Config{}).denied("10.0.0.1:22") {
+		t.Error("no denylist should deny nothing")
+	}
+}
@@ -0,0 +1,60 @@
+package listener
+
+import (
+	"context"
+	"log/slog"
+	"net"
+	"time"
+)
+
+// resolveAllowed resolves target's host once and returns host:port for
+// each resolved IP the allowlist permits and the denylist does not
+// match. The caller dials those
+// addresses rather than the name, so a second lookup cannot swap in an
+// answer that was never checked (DNS rebinding). It returns nil when
+// target's host is an IP literal, the lookup fails, or no resolved IP
+// is allowed.
+func (c *Config) resolveAllowed(ctx context.Context, target string, timeout time.Duration, logger *slog.Logger) []string {
+	host, port, err := net.SplitHostPort(target)
+	if err != nil || net.ParseIP(host) != nil {
+		return nil
+	}
+	resolver := c.Resolver
+	if resolver == nil {
+		resolver = net.DefaultResolver
+	}
+	lookupCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	ips, err := resolver.LookupNetIP(lookupCtx, "ip", host)
+	if err != nil {
+		logger.Warn("allow-resolve lookup failed", "target", target, "error", err)
+		return nil
+	}
+	var addrs []string
+	for _, ip := range ips {
+		addr := net.JoinHostPort(ip.Unmap().String(), port)
+		if c.allowed(addr) && !c.denied(addr) {
+			addrs = append(addrs, addr)
+		}
+	}
+	if len(addrs) > 0 {
+		logger.Debug("target allowed by resolution", "target", target, "addrs", addrs)
+	}
+	return addrs
+}
+
+// dialAny dials addrs on network in order and returns the first
+// connection made, or the last error when every dial fails.
+func dialAny(ctx context.Context, dial func(ctx context.Context, network, addr string) (net.Conn, error), network string, addrs []string) (net.Conn, error) {
+	var err error
+	for _, addr := range addrs {
+		var conn net.Conn
+		if conn, err = dial(ctx, network, addr); err == nil {
+			return conn, nil
+		}
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	return nil, err
+}
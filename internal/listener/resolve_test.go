@@ -0,0 +1,114 @@
+package listener
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net"
+	"slices"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/philsphicas/aztunnel/internal/protocol"
+)
+
+// These tests rely on localhost resolving to 127.0.0.1, which every
+// supported platform's hosts file provides.
+
+func TestResolveAllowed(t *testing.T) {
+	logger := slog.New(slog.DiscardHandler)
+	ctx := context.Background()
+	for _, tc := range []struct {
+		name   string
+		list   []string
+		target string
+		want   []string
+	}{
+		{"resolved into CIDR", []string{"127.0.0.0/8:*"}, "localhost:22", []string{"127.0.0.1:22"}},
+		{"resolved outside CIDR", []string{"10.0.0.0/8:*"}, "localhost:22", nil},
+		{"wrong port", []string{"127.0.0.0/8:80"}, "localhost:22", nil},
+		{"IP literal", []string{"127.0.0.0/8:*"}, "10.0.0.1:22", nil},
+	} {
+		cfg := Config{AllowList: tc.list, AllowResolve: true}
+		if got := cfg.resolveAllowed(ctx, tc.target, time.Second, logger); !slices.Equal(got, tc.want) {
+			t.Errorf("%s: resolveAllowed(%q) = %q, want %q", tc.name, tc.target, got, tc.want)
+		}
+	}
+}
+
+func TestDialAny(t *testing.T) {
+	var tried []string
+	dial := func(_ context.Context, _, addr string) (net.Conn, error) {
+		tried = append(tried, addr)
+		if addr == "10.0.0.2:22" {
+			c, _ := net.Pipe()
+			return c, nil
+		}
+		return nil, errors.New("refused")
+	}
+	conn, err := dialAny(context.Background(), dial, "tcp", []string{"10.0.0.1:22", "10.0.0.2:22", "10.0.0.3:22"})
+	if err != nil {
+		t.Fatalf("dialAny: %v", err)
+	}
+	_ = conn.Close()
+	if want := []string{"10.0.0.1:22", "10.0.0.2:22"}; !slices.Equal(tried, want) {
+		t.Errorf("tried %q, want %q", tried, want)
+	}
+	if _, err := dialAny(context.Background(), dial, "tcp", []string{"10.0.0.1:22"}); err == nil {
+		t.Error("dialAny succeeded with every dial failing")
+	}
+}
+
+// TestHandleConnection_AllowResolve asserts a hostname the allowlist
+// does not name passes only with AllowResolve, and that the listener
+// then dials the resolved IP rather than the name.
+func TestHandleConnection_AllowResolve(t *testing.T) {
+	target, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("target listen: %v", err)
+	}
+	defer target.Close() //nolint:errcheck // best-effort cleanup
+	go func() {
+		for {
+			c, err := target.Accept()
+			if err != nil {
+				return
+			}
+			_ = c.Close()
+		}
+	}()
+	port := strconv.Itoa(target.Addr().(*net.TCPAddr).Port)
+
+	var (
+		mu     sync.Mutex
+		dialed []string
+	)
+	var d net.Dialer
+	cfg := Config{
+		Logger:    slog.New(slog.DiscardHandler),
+		AllowList: []string{"127.0.0.0/8:" + port},
+		dialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			mu.Lock()
+			dialed = append(dialed, addr)
+			mu.Unlock()
+			return d.DialContext(ctx, network, addr)
+		},
+	}
+
+	resp := driveOneHandshake(t, cfg, "localhost:"+port)
+	if resp.OK || resp.Code != protocol.CodeNotAllowed {
+		t.Fatalf("without AllowResolve: OK=%v code=%q, want rejection with %q", resp.OK, resp.Code, protocol.CodeNotAllowed)
+	}
+
+	cfg.AllowResolve = true
+	if resp := driveOneHandshake(t, cfg, "localhost:"+port); !resp.OK {
+		t.Fatalf("with AllowResolve: got error=%q, want OK", resp.Error)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if want := []string{"127.0.0.1:" + port}; !slices.Equal(dialed, want) {
+		t.Errorf("dialed %q, want %q", dialed, want)
+	}
+}
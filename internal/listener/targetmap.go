@@ -0,0 +1,98 @@
+package listener
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"sync/atomic"
+)
+
+// liveMap is the shared, atomically-swappable alias table behind
+// Config.MapFile, a pointer for the same reason as liveLimits.
+type liveMap struct {
+	p atomic.Pointer[map[string]string]
+}
+
+// ParseMapping parses an alias=host:port target mapping. The alias is
+// matched against the whole requested target, so it may carry a port
+// of its own ("db:5432") or none ("db").
+func ParseMapping(s string) (alias, target string, err error) {
+	alias, target, ok := strings.Cut(s, "=")
+	alias, target = strings.TrimSpace(alias), strings.TrimSpace(target)
+	if !ok || alias == "" {
+		return "", "", fmt.Errorf("bad target mapping %q: want alias=host:port", s)
+	}
+	if host, _, err := net.SplitHostPort(target); err != nil || host == "" {
+		return "", "", fmt.Errorf("bad target mapping %q: target must be host:port", s)
+	}
+	return alias, target, nil
+}
+
+// readMapFile reads alias=host:port mappings from path, one per line.
+// Blank lines and lines starting with # are skipped; lines that fail
+// ParseMapping are left out and reported in rejected.
+func readMapFile(path string) (m map[string]string, rejected []error, err error) {
+	f, err := os.Open(path) //nolint:gosec // operator-supplied mapping path
+	if err != nil {
+		return nil, nil, err
+	}
+	defer f.Close() //nolint:errcheck // read-only
+
+	m = make(map[string]string)
+	sc := bufio.NewScanner(f)
+	for n := 1; sc.Scan(); n++ {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		alias, target, err := ParseMapping(line)
+		if err != nil {
+			rejected = append(rejected, fmt.Errorf("line %d: %w", n, err))
+			continue
+		}
+		m[alias] = target
+	}
+	if err := sc.Err(); err != nil {
+		return nil, nil, err
+	}
+	return m, rejected, nil
+}
+
+// loadMapFile reads cfg.MapFile and makes its mappings plus TargetMap
+// the alias table for connections accepted from now on. TargetMap
+// wins where both name the same alias. Lines that are not valid
+// mappings are logged and skipped. A file that cannot be read is an
+// error and leaves the current table in place.
+func loadMapFile(cfg *Config) error {
+	m, rejected, err := readMapFile(cfg.MapFile)
+	if err != nil {
+		return fmt.Errorf("read map file: %w", err)
+	}
+	for _, r := range rejected {
+		cfg.Logger.Warn("map file entry rejected", "path", cfg.MapFile, "error", r)
+	}
+	for alias, target := range cfg.TargetMap {
+		m[alias] = target
+	}
+	if cfg.targets == nil {
+		cfg.targets = &liveMap{}
+	}
+	cfg.targets.p.Store(&m)
+	cfg.Logger.Info("target map loaded", "path", cfg.MapFile, "entries", len(m), "rejected", len(rejected))
+	return nil
+}
+
+// mapped returns the real target behind alias, if the current alias
+// table has one.
+func (c *Config) mapped(alias string) (string, bool) {
+	m := c.TargetMap
+	if c.targets != nil {
+		if l := c.targets.p.Load(); l != nil {
+			m = *l
+		}
+	}
+	target, ok := m[alias]
+	return target, ok
+}
@@ -0,0 +1,195 @@
+package listener
+
+import (
+	"context"
+	"log/slog"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/philsphicas/aztunnel/internal/metrics"
+	"github.com/philsphicas/aztunnel/internal/protocol"
+)
+
+func TestParseMapping(t *testing.T) {
+	for _, tc := range []struct {
+		in, alias, target string
+	}{
+		{"db=10.0.0.5:5432", "db", "10.0.0.5:5432"},
+		{"db:5432 = db-01.internal:5432", "db:5432", "db-01.internal:5432"},
+		{"v6=[fd00::1]:22", "v6", "[fd00::1]:22"},
+	} {
+		alias, target, err := ParseMapping(tc.in)
+		if err != nil || alias != tc.alias || target != tc.target {
+			t.Errorf("ParseMapping(%q) = %q, %q, %v; want %q, %q", tc.in, alias, target, err, tc.alias, tc.target)
+		}
+	}
+	for _, in := range []string{"", "db", "=10.0.0.5:5432", "db=10.0.0.5", "db=:5432"} {
+		if _, _, err := ParseMapping(in); err == nil {
+			t.Errorf("ParseMapping(%q) succeeded, want an error", in)
+		}
+	}
+}
+
+func TestLoadMapFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "map")
+	data := "# backends\ndb=10.0.0.5:5432\nweb=10.0.0.6:443\nbogus\n"
+	if err := os.WriteFile(path, []byte(data), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	cfg := Config{
+		TargetMap: map[string]string{"web": "10.0.0.7:443"},
+		MapFile:   path,
+		Logger:    slog.New(slog.DiscardHandler),
+	}
+	applyDefaults(&cfg)
+	if err := loadMapFile(&cfg); err != nil {
+		t.Fatalf("loadMapFile: %v", err)
+	}
+	for alias, want := range map[string]string{"db": "10.0.0.5:5432", "web": "10.0.0.7:443"} {
+		if got, ok := cfg.mapped(alias); !ok || got != want {
+			t.Errorf("mapped(%q) = %q, %v; want %q", alias, got, ok, want)
+		}
+	}
+
+	if err := os.WriteFile(path, []byte("cache=10.0.0.8:6379\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	reload(&cfg)
+	if _, ok := cfg.mapped("db"); ok {
+		t.Error("db still mapped after reload removed it")
+	}
+	if got, _ := cfg.mapped("cache"); got != "10.0.0.8:6379" {
+		t.Errorf("mapped(cache) = %q after reload, want 10.0.0.8:6379", got)
+	}
+}
+
+// TestHandleConnection_TargetMap asserts an alias is dialed as its
+// backend, checked against the allowlist as the backend, and labelled
+// as the alias, while an unmapped target goes through unchanged.
+func TestHandleConnection_TargetMap(t *testing.T) {
+	target, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("target listen: %v", err)
+	}
+	defer target.Close() //nolint:errcheck // best-effort cleanup
+	go func() {
+		for {
+			c, err := target.Accept()
+			if err != nil {
+				return
+			}
+			_ = c.Close()
+		}
+	}()
+	backend := target.Addr().String()
+
+	var (
+		mu     sync.Mutex
+		dialed []string
+	)
+	var d net.Dialer
+	m := metrics.New()
+	cfg := Config{
+		AllowList: []string{backend, "127.0.0.1:1"},
+		TargetMap: map[string]string{"db:5432": backend},
+		Logger:    slog.New(slog.DiscardHandler),
+		Metrics:   m,
+		dialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			mu.Lock()
+			dialed = append(dialed, addr)
+			mu.Unlock()
+			return d.DialContext(ctx, network, addr)
+		},
+	}
+
+	if resp := driveOneHandshake(t, cfg, "db:5432"); !resp.OK {
+		t.Fatalf("alias: got error=%q, want OK", resp.Error)
+	}
+	if resp := driveOneHandshake(t, cfg, "127.0.0.1:1"); resp.OK {
+		t.Error("unmapped closed port: got OK, want a dial failure")
+	}
+	if resp := driveOneHandshake(t, cfg, "cache:6379"); resp.OK || resp.Code != protocol.CodeNotAllowed {
+		t.Errorf("unmapped, unlisted: OK=%v code=%q, want rejection with %q", resp.OK, resp.Code, protocol.CodeNotAllowed)
+	}
+
+	mu.Lock()
+	if want := []string{backend, "127.0.0.1:1"}; !slices.Equal(dialed, want) {
+		t.Errorf("dialed %q, want %q", dialed, want)
+	}
+	mu.Unlock()
+
+	// The bridge records its target label once it ends.
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		labels := connectionTargets(t, m)
+		if slices.Contains(labels, backend) {
+			t.Fatalf("connections_total labelled with backend %q, want the alias only", backend)
+		}
+		if slices.Contains(labels, "db:5432") {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("connections_total targets = %q, want db:5432", labels)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+// connectionTargets returns the target labels of
+// aztunnel_connections_total.
+func connectionTargets(t *testing.T, m *metrics.Metrics) []string {
+	t.Helper()
+	fams, err := m.Registry.Gather()
+	if err != nil {
+		t.Fatalf("gather: %v", err)
+	}
+	var targets []string
+	for _, f := range fams {
+		if f.GetName() != "aztunnel_connections_total" {
+			continue
+		}
+		for _, met := range f.GetMetric() {
+			for _, l := range met.GetLabel() {
+				if l.GetName() == "target" {
+					targets = append(targets, l.GetValue())
+				}
+			}
+		}
+	}
+	return targets
+}
+
+func TestHandleConnection_Route(t *testing.T) {
+	backend := startBackend(t, func(c net.Conn) { _ = c.Close() })
+	dialed := make(chan string, 1)
+	cfg := Config{
+		TargetMap: map[string]string{"db": backend},
+		Logger:    slog.New(slog.DiscardHandler),
+		dialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			dialed <- addr
+			return (&net.Dialer{}).DialContext(ctx, network, addr)
+		},
+	}
+
+	if resp := driveOneHandshake(t, cfg, protocol.RoutePrefix+"db"); !resp.OK {
+		t.Fatalf("route:db response = %+v, want OK", resp)
+	}
+	if got := <-dialed; got != backend {
+		t.Errorf("route:db dialed %q, want %q", got, backend)
+	}
+
+	resp := driveOneHandshake(t, cfg, protocol.RoutePrefix+"cache")
+	if resp.OK || resp.Code != protocol.CodeUnknownRoute {
+		t.Errorf("route:cache response = %+v, want refused with %s", resp, protocol.CodeUnknownRoute)
+	}
+	select {
+	case addr := <-dialed:
+		t.Errorf("unknown route dialed %q", addr)
+	default:
+	}
+}
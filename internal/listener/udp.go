@@ -0,0 +1,236 @@
+package listener
+
+import (
+	"context"
+	"log/slog"
+	"net"
+	"net/netip"
+	"sync"
+	"sync/atomic"
+
+	"github.com/coder/websocket"
+	"github.com/philsphicas/aztunnel/internal/metrics"
+	"github.com/philsphicas/aztunnel/internal/protocol"
+)
+
+// udpCacheSize caps the per-association destination and peer tables.
+// A session that names more destinations than this starts over with
+// empty tables rather than growing without bound.
+const udpCacheSize = 1024
+
+// serveUDP handles a protocol.ModeUDP envelope: open one unconnected
+// UDP socket, send each datagram the sender frames to its destination,
+// and frame every reply from a destination already sent to back to the
+// sender. Destinations are checked against the deny and allow lists
+// like connect targets, datagram by datagram; a refused datagram is
+// dropped, since UDP has no way to say why. The socket binds
+// DialSource when it is set. The association lasts until the sender
+// closes the WebSocket.
+func serveUDP(ctx context.Context, ws *websocket.Conn, cfg Config, env protocol.ConnectEnvelope, lim Limits, logger *slog.Logger) {
+	logger.Info("udp association requested")
+
+	if !cfg.AllowUDP {
+		logger.Warn("udp not enabled")
+		// The code lets a SOCKS5 sender answer "not allowed" rather
+		// than a generic failure.
+		_ = sendResponseWithCode(ctx, ws, cfg, false, "udp not enabled", protocol.CodeNotAllowed)
+		cfg.Metrics.ConnectionError("listener", metrics.ReasonModeNotAllowed)
+		return
+	}
+
+	// Datagrams leave from DialSource like target dials do, so a
+	// multi-homed listener uses the same egress for both.
+	var laddr *net.UDPAddr
+	if cfg.DialSource.IsValid() {
+		laddr = &net.UDPAddr{IP: cfg.DialSource.AsSlice(), Zone: cfg.DialSource.Zone()}
+	}
+	pc, err := net.ListenUDP("udp", laddr)
+	if err != nil {
+		logger.Warn("udp socket failed", "error", err)
+		_ = sendResponse(ctx, ws, cfg, false, "udp failed")
+		cfg.Metrics.ConnectionError("listener", metrics.ReasonDialFailed)
+		return
+	}
+	defer pc.Close() //nolint:errcheck // best-effort cleanup
+
+	if err := sendAccept(ctx, ws, cfg, nil, compressionReply(ctx, env), ""); err != nil {
+		logger.Warn("failed to send response", "error", err)
+		return
+	}
+	ws.SetReadLimit(protocol.MaxDatagramFrame)
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	stop := context.AfterFunc(ctx, func() { _ = pc.Close() })
+	defer stop()
+
+	s := &udpSession{cfg: &cfg, lim: lim, logger: logger, dests: map[string]netip.AddrPort{}, peers: map[netip.AddrPort]bool{}}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		defer cancel()
+		s.replies(ctx, ws, pc)
+	}()
+	s.forward(ctx, ws, pc)
+	cancel()
+	<-done
+	logger.Debug("udp association ended", "datagrams_out", s.out.Load(), "datagrams_in", s.in.Load(), "dropped", s.dropped.Load())
+}
+
+// udpSession is the state of one UDP association: the destinations it
+// has resolved and the peers it has sent to, whose replies it accepts.
+type udpSession struct {
+	cfg    *Config
+	lim    Limits
+	logger *slog.Logger
+
+	mu    sync.Mutex
+	dests map[string]netip.AddrPort // host:port -> resolved; invalid when refused
+	peers map[netip.AddrPort]bool
+
+	out, in, dropped atomic.Int64
+}
+
+// forward sends each datagram the sender frames until the WebSocket
+// closes.
+func (s *udpSession) forward(ctx context.Context, ws *websocket.Conn, pc *net.UDPConn) {
+	for {
+		typ, frame, err := ws.Read(ctx)
+		if err != nil {
+			return
+		}
+		if typ != websocket.MessageBinary {
+			continue
+		}
+		target, payload, err := protocol.ParseDatagram(frame)
+		if err != nil {
+			s.logger.Debug("dropping malformed datagram frame", "error", err)
+			s.dropped.Add(1)
+			continue
+		}
+		dst, ok := s.resolve(ctx, target)
+		if !ok {
+			s.dropped.Add(1)
+			continue
+		}
+		if _, err := pc.WriteToUDPAddrPort(payload, dst); err != nil {
+			s.logger.Debug("udp send failed", "target", target, "error", err)
+			s.dropped.Add(1)
+			continue
+		}
+		s.out.Add(1)
+	}
+}
+
+// replies frames each datagram from a peer this session has sent to
+// back to the sender until pc is closed. Datagrams from anyone else
+// are dropped, so the socket is not an open inbound port.
+func (s *udpSession) replies(ctx context.Context, ws *websocket.Conn, pc *net.UDPConn) {
+	buf := make([]byte, 65535)
+	var frame []byte
+	for {
+		n, from, err := pc.ReadFromUDPAddrPort(buf)
+		if err != nil {
+			return
+		}
+		from = netip.AddrPortFrom(from.Addr().Unmap(), from.Port())
+		s.mu.Lock()
+		known := s.peers[from]
+		s.mu.Unlock()
+		if !known {
+			s.dropped.Add(1)
+			continue
+		}
+		frame = protocol.AppendDatagram(frame[:0], from.String(), buf[:n])
+		if err := ws.Write(ctx, websocket.MessageBinary, frame); err != nil {
+			return
+		}
+		s.in.Add(1)
+	}
+}
+
+// resolve returns the address to send target's datagrams to, checking
+// it against the deny and allow lists the way serveEnvelope checks a
+// connect target. Answers, refusals included, are cached for the
+// session so a DNS client does not cost a lookup per query.
+func (s *udpSession) resolve(ctx context.Context, target string) (netip.AddrPort, bool) {
+	s.mu.Lock()
+	dst, cached := s.dests[target]
+	s.mu.Unlock()
+	if !cached {
+		dst = s.lookup(ctx, target)
+		s.mu.Lock()
+		if len(s.dests) >= udpCacheSize {
+			clear(s.dests)
+		}
+		s.dests[target] = dst
+		s.mu.Unlock()
+	}
+	if !dst.IsValid() {
+		return dst, false
+	}
+	s.mu.Lock()
+	if !s.peers[dst] {
+		if len(s.peers) >= udpCacheSize {
+			clear(s.peers)
+		}
+		s.peers[dst] = true
+	}
+	s.mu.Unlock()
+	return dst, true
+}
+
+// lookup resolves and checks target; the zero AddrPort means refused.
+func (s *udpSession) lookup(ctx context.Context, target string) netip.AddrPort {
+	host, port, err := net.SplitHostPort(target)
+	if err != nil {
+		s.logger.Warn("invalid udp target", "target", target, "error", err)
+		return netip.AddrPort{}
+	}
+	if s.cfg.denied(target) {
+		s.logger.Warn("udp target denied", "target", target)
+		s.cfg.Metrics.ConnectionError("listener", metrics.ReasonDenylistRejected)
+		return netip.AddrPort{}
+	}
+	addr := target
+	if !s.cfg.allowed(target) {
+		var addrs []string
+		if s.cfg.AllowResolve {
+			addrs = s.cfg.resolveAllowed(ctx, target, s.lim.ConnectTimeout, s.logger)
+		}
+		if len(addrs) == 0 {
+			s.logger.Warn("udp target not allowed", "target", target)
+			s.cfg.Metrics.ConnectionError("listener", metrics.ReasonAllowlistRejected)
+			return netip.AddrPort{}
+		}
+		addr = addrs[0]
+	} else if net.ParseIP(host) == nil {
+		// An allowed name is resolved once here; the resolved IP is
+		// still held to the denylist.
+		resolver := s.cfg.Resolver
+		if resolver == nil {
+			resolver = net.DefaultResolver
+		}
+		lookupCtx, cancel := context.WithTimeout(ctx, s.lim.ConnectTimeout)
+		ips, err := resolver.LookupNetIP(lookupCtx, "ip", host)
+		cancel()
+		if err != nil || len(ips) == 0 {
+			s.logger.Warn("udp target lookup failed", "target", target, "error", err)
+			s.cfg.Metrics.ConnectionError("listener", metrics.DialReason(err, metrics.ReasonDialFailed))
+			return netip.AddrPort{}
+		}
+		addr = net.JoinHostPort(ips[0].Unmap().String(), port)
+		if s.cfg.denied(addr) {
+			s.logger.Warn("udp target denied", "target", target, "addr", addr)
+			s.cfg.Metrics.ConnectionError("listener", metrics.ReasonDenylistRejected)
+			return netip.AddrPort{}
+		}
+	}
+	dst, err := netip.ParseAddrPort(addr)
+	if err != nil {
+		s.logger.Warn("invalid udp target", "target", target, "error", err)
+		return netip.AddrPort{}
+	}
+	s.logger.Debug("udp target allowed", "target", target, "addr", dst)
+	return netip.AddrPortFrom(dst.Addr().Unmap(), dst.Port())
+}
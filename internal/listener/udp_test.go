@@ -0,0 +1,197 @@
+package listener
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/coder/websocket"
+	"github.com/philsphicas/aztunnel/internal/metrics"
+	"github.com/philsphicas/aztunnel/internal/protocol"
+)
+
+// startUDPEcho answers every datagram on a loopback UDP socket with
+// "echo:" and the payload, and returns the socket's address.
+func startUDPEcho(t *testing.T) string {
+	t.Helper()
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen udp: %v", err)
+	}
+	t.Cleanup(func() { _ = pc.Close() })
+	go func() {
+		buf := make([]byte, 1500)
+		for {
+			n, from, err := pc.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			_, _ = pc.WriteTo(append([]byte("echo:"), buf[:n]...), from)
+		}
+	}()
+	return pc.LocalAddr().String()
+}
+
+// openUDPSession starts a ModeUDP session against a real
+// handleConnection and returns the sender's end of the WebSocket once
+// the listener has accepted it.
+func openUDPSession(t *testing.T, cfg Config) (context.Context, *websocket.Conn) {
+	t.Helper()
+	applyDefaults(&cfg)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	t.Cleanup(cancel)
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ws, err := websocket.Accept(w, r, nil)
+		if err != nil {
+			return
+		}
+		handleConnection(r.Context(), ws, cfg)
+	}))
+	t.Cleanup(srv.Close)
+
+	ws, _, err := websocket.Dial(ctx, "ws"+strings.TrimPrefix(srv.URL, "http"), nil)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	t.Cleanup(func() { _ = ws.CloseNow() })
+	data, _ := json.Marshal(protocol.ConnectEnvelope{Version: protocol.CurrentVersion, Mode: protocol.ModeUDP})
+	if err := ws.Write(ctx, websocket.MessageText, data); err != nil {
+		t.Fatalf("send envelope: %v", err)
+	}
+	_, data, err = ws.Read(ctx)
+	if err != nil {
+		t.Fatalf("read response: %v", err)
+	}
+	var resp protocol.ConnectResponse
+	if err := json.Unmarshal(data, &resp); err != nil || !resp.OK {
+		t.Fatalf("response = %+v (%v), want OK", resp, err)
+	}
+	return ctx, ws
+}
+
+func TestServeUDP_RelaysDatagrams(t *testing.T) {
+	echo := startUDPEcho(t)
+	ctx, ws := openUDPSession(t, Config{
+		AllowUDP:  true,
+		AllowList: []string{echo},
+		Logger:    slog.New(slog.NewTextHandler(io.Discard, nil)),
+	})
+
+	// A refused destination is dropped silently; the allowed one that
+	// follows still gets through and its reply names the echo server.
+	for _, dg := range []struct{ addr, payload string }{
+		{"127.0.0.1:9", "refused"},
+		{echo, "query"},
+	} {
+		if err := ws.Write(ctx, websocket.MessageBinary, protocol.AppendDatagram(nil, dg.addr, []byte(dg.payload))); err != nil {
+			t.Fatalf("write datagram: %v", err)
+		}
+	}
+	typ, frame, err := ws.Read(ctx)
+	if err != nil {
+		t.Fatalf("read reply: %v", err)
+	}
+	src, payload, err := protocol.ParseDatagram(frame)
+	if err != nil || typ != websocket.MessageBinary {
+		t.Fatalf("reply frame %x (%v): %v", frame, typ, err)
+	}
+	if src != echo || string(payload) != "echo:query" {
+		t.Errorf("reply = %q from %s, want echo:query from %s", payload, src, echo)
+	}
+}
+
+func TestServeUDP_DialSource(t *testing.T) {
+	// 127.0.0.2 is a distinct loopback source on Linux; elsewhere it
+	// may not be bindable.
+	source := netip.MustParseAddr("127.0.0.2")
+	probe, err := net.ListenUDP("udp", &net.UDPAddr{IP: source.AsSlice()})
+	if err != nil {
+		t.Skipf("cannot bind %s: %v", source, err)
+	}
+	_ = probe.Close()
+
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen udp: %v", err)
+	}
+	t.Cleanup(func() { _ = pc.Close() })
+	dest := pc.LocalAddr().String()
+	ctx, ws := openUDPSession(t, Config{
+		AllowUDP:   true,
+		AllowList:  []string{dest},
+		DialSource: source,
+		Logger:     slog.New(slog.NewTextHandler(io.Discard, nil)),
+	})
+	if err := ws.Write(ctx, websocket.MessageBinary, protocol.AppendDatagram(nil, dest, []byte("query"))); err != nil {
+		t.Fatalf("write datagram: %v", err)
+	}
+	_ = pc.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, 1500)
+	_, from, err := pc.ReadFrom(buf)
+	if err != nil {
+		t.Fatalf("read datagram: %v", err)
+	}
+	if ip := from.(*net.UDPAddr).IP.String(); ip != source.String() {
+		t.Errorf("datagram from %s, want %s", ip, source)
+	}
+}
+
+func TestServeUDP_NotEnabled(t *testing.T) {
+	m := metrics.New()
+	cfg := Config{Logger: slog.New(slog.NewTextHandler(io.Discard, nil)), Metrics: m}
+	resp := driveCustomHandshake(t, cfg, func(ctx context.Context, ws *websocket.Conn) error {
+		data, _ := json.Marshal(protocol.ConnectEnvelope{Version: protocol.CurrentVersion, Mode: protocol.ModeUDP})
+		return ws.Write(ctx, websocket.MessageText, data)
+	})
+	if resp.OK || resp.Code != protocol.CodeNotAllowed {
+		t.Errorf("response = %+v, want refused with %s", resp, protocol.CodeNotAllowed)
+	}
+	waitConnectionErrors(t, m, metrics.ReasonModeNotAllowed, 1)
+}
+
+func TestUDPSession_Resolve(t *testing.T) {
+	s := &udpSession{
+		cfg: &Config{
+			AllowList: []string{"127.0.0.0/8:53", "localhost:53"},
+			DenyList:  []string{"127.0.0.2:*"},
+		},
+		lim:    Limits{ConnectTimeout: 5 * time.Second},
+		logger: slog.New(slog.NewTextHandler(io.Discard, nil)),
+		dests:  map[string]netip.AddrPort{},
+		peers:  map[netip.AddrPort]bool{},
+	}
+	for _, tc := range []struct {
+		target string
+		ok     bool
+	}{
+		{"127.0.0.1:53", true},
+		{"127.0.0.2:53", false}, // denied
+		{"127.0.0.1:54", false}, // not allowed
+		{"10.0.0.1:53", false},  // not allowed
+		{"no-port", false},
+		{"localhost:53", true}, // allowed name, resolved once
+	} {
+		dst, ok := s.resolve(context.Background(), tc.target)
+		if ok != tc.ok {
+			t.Errorf("resolve(%q) = %v %v, want ok=%v", tc.target, dst, ok, tc.ok)
+		}
+		if ok && !s.peers[dst] {
+			t.Errorf("resolve(%q): %v not recorded as a peer", tc.target, dst)
+		}
+	}
+	if _, cached := s.dests["10.0.0.1:53"]; !cached {
+		t.Error("refusal not cached")
+	}
+	if s.peers[netip.MustParseAddrPort("127.0.0.2:53")] {
+		t.Error("denied destination recorded as a peer")
+	}
+}
@@ -0,0 +1,76 @@
+package metrics
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"time"
+
+	"github.com/philsphicas/aztunnel/internal/relay"
+)
+
+// NewAccessLogger returns a logger for Metrics.AccessLog writing to w
+// in format ("json", or text otherwise). It logs every record whatever
+// --log-level says, and scrubs secrets like the operational logger.
+func NewAccessLogger(w io.Writer, format string) *slog.Logger {
+	var h slog.Handler = slog.NewTextHandler(w, nil)
+	if format == "json" {
+		h = slog.NewJSONHandler(w, nil)
+	}
+	return slog.New(relay.NewRedactingHandler(h))
+}
+
+// accessInfo is what an access-log record carries beyond the metric
+// labels: the connection's id, its target before SanitizeTarget, the
+// client that opened it, and why the bridge ended.
+type accessInfo struct {
+	id     string
+	target string
+	client string
+	cause  string
+	start  time.Time
+}
+
+// clientAddrKey is the context key for WithClientAddr.
+type clientAddrKey struct{}
+
+// WithClientAddr returns a copy of ctx carrying the address of the
+// client a bridged connection serves, for the access log. It is never
+// a metric label.
+func WithClientAddr(ctx context.Context, addr string) context.Context {
+	return context.WithValue(ctx, clientAddrKey{}, addr)
+}
+
+func clientAddrFrom(ctx context.Context) string {
+	addr, _ := ctx.Value(clientAddrKey{}).(string)
+	return addr
+}
+
+// setEndCause records the bridgecause label a Tracked* wrapper's bridge
+// ended with, for the access log. Safe to call on a nil receiver.
+func (t *ConnectionTracker) setEndCause(cause string) {
+	if t == nil || t.access == nil {
+		return
+	}
+	t.access.cause = cause
+}
+
+// logAccess writes the access-log record for a finished connection.
+func (t *ConnectionTracker) logAccess(durationSec float64, toRelayBytes, fromRelayBytes int64, status string) {
+	a := t.access
+	if a == nil {
+		return
+	}
+	t.m.AccessLog.LogAttrs(context.Background(), slog.LevelInfo, "connection",
+		slog.String("id", a.id),
+		slog.String("role", t.role),
+		slog.String("target", a.target),
+		slog.String("client", a.client),
+		slog.Time("started", a.start),
+		slog.Duration("duration", time.Duration(durationSec*float64(time.Second))),
+		slog.Int64("bytes_to_relay", toRelayBytes),
+		slog.Int64("bytes_from_relay", fromRelayBytes),
+		slog.String("status", status),
+		slog.String("cause", a.cause),
+	)
+}
@@ -0,0 +1,65 @@
+package metrics
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"maps"
+	"slices"
+	"testing"
+)
+
+func TestAccessLog(t *testing.T) {
+	var buf bytes.Buffer
+	m := New()
+	m.MaxTargets = 1
+	m.AccessLog = NewAccessLogger(&buf, "json")
+
+	// A first target uses up the label budget, so the second is
+	// recorded as OverflowTarget in metrics but verbatim in the log.
+	_, first := m.trackBridge(context.Background(), "listener", "10.0.0.1:22")
+	first.Done(0.1, 0, 0, nil)
+	buf.Reset()
+
+	ctx := WithClientAddr(WithConnID(context.Background(), "b-1"), "192.0.2.7:50123")
+	_, tracker := m.trackBridge(ctx, "listener", "db.internal:5432")
+	tracker.setEndCause("local_close")
+	tracker.Done(1.5, 100, 200, nil)
+
+	var rec map[string]any
+	if err := json.Unmarshal(buf.Bytes(), &rec); err != nil {
+		t.Fatalf("parse record %q: %v", buf.String(), err)
+	}
+	want := map[string]any{
+		"msg":              "connection",
+		"id":               "b-1",
+		"role":             "listener",
+		"target":           "db.internal:5432",
+		"client":           "192.0.2.7:50123",
+		"duration":         float64(1500000000),
+		"bytes_to_relay":   float64(100),
+		"bytes_from_relay": float64(200),
+		"status":           "success",
+		"cause":            "local_close",
+	}
+	for k, v := range want {
+		if rec[k] != v {
+			t.Errorf("%s = %v, want %v", k, rec[k], v)
+		}
+	}
+	keys := slices.Sorted(maps.Keys(rec))
+	wantKeys := []string{"bytes_from_relay", "bytes_to_relay", "cause", "client", "duration", "id", "level", "msg", "role", "started", "status", "target", "time"}
+	if !slices.Equal(keys, wantKeys) {
+		t.Errorf("record keys = %v, want %v", keys, wantKeys)
+	}
+}
+
+func TestAccessLog_Disabled(t *testing.T) {
+	m := New()
+	_, tracker := m.trackBridge(context.Background(), "sender", "10.0.0.1:22")
+	if tracker.access != nil {
+		t.Error("tracker has access info without AccessLog")
+	}
+	tracker.setEndCause("peer_close")
+	tracker.Done(1, 1, 1, nil)
+}
@@ -0,0 +1,200 @@
+package metrics
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/philsphicas/aztunnel/internal/bridgecause"
+	"github.com/philsphicas/aztunnel/internal/idgen"
+)
+
+// ConnInfo describes one live bridged connection in the /connections
+// listing.
+type ConnInfo struct {
+	ID      string    `json:"id"`
+	Role    string    `json:"role"`
+	Target  string    `json:"target"`
+	Started time.Time `json:"started"`
+}
+
+// liveConn is a registry entry: the listing fields plus the cancel
+// func that ends the connection's bridge.
+type liveConn struct {
+	info   ConnInfo
+	cancel context.CancelCauseFunc
+}
+
+// connRegistry tracks the bridges started through TrackedBridge and
+// TrackedBridgeSession so they can be listed and closed by id.
+type connRegistry struct {
+	mu    sync.Mutex
+	conns map[string]*liveConn
+}
+
+// add registers a connection under id, minting a fresh id if id is
+// empty or already in use (a pre-bridge_id sender, or a collision).
+func (r *connRegistry) add(id, role, target string, cancel context.CancelCauseFunc) *liveConn {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.conns == nil {
+		r.conns = make(map[string]*liveConn)
+	}
+	for id == "" || r.conns[id] != nil {
+		id = idgen.NewBridgeID()
+	}
+	c := &liveConn{
+		info:   ConnInfo{ID: id, Role: role, Target: target, Started: time.Now()},
+		cancel: cancel,
+	}
+	r.conns[id] = c
+	return c
+}
+
+func (r *connRegistry) remove(c *liveConn) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.conns[c.info.ID] == c {
+		delete(r.conns, c.info.ID)
+	}
+}
+
+// list returns the live connections, oldest first.
+func (r *connRegistry) list() []ConnInfo {
+	r.mu.Lock()
+	out := make([]ConnInfo, 0, len(r.conns))
+	for _, c := range r.conns {
+		out = append(out, c.info)
+	}
+	r.mu.Unlock()
+	sort.Slice(out, func(i, j int) bool { return out[i].Started.Before(out[j].Started) })
+	return out
+}
+
+// close cancels the bridge of the connection with the given id. It
+// reports false if no such connection is live. The entry itself is
+// removed when the bridge returns.
+func (r *connRegistry) close(id string) bool {
+	r.mu.Lock()
+	c := r.conns[id]
+	r.mu.Unlock()
+	if c == nil {
+		return false
+	}
+	c.cancel(bridgecause.CauseAdminClose)
+	return true
+}
+
+// Connections returns the live bridged connections, oldest first.
+// Safe to call on a nil receiver.
+func (m *Metrics) Connections() []ConnInfo {
+	if m == nil {
+		return nil
+	}
+	return m.live.list()
+}
+
+// CloseConnection ends the bridge of the live connection with the given
+// id (cause admin_close). It reports false if no such connection is
+// live. Safe to call on a nil receiver.
+func (m *Metrics) CloseConnection(id string) bool {
+	if m == nil {
+		return false
+	}
+	return m.live.close(id)
+}
+
+// trackBridge opens a connection tracker for a bridge and registers it
+// in the live-connection registry. The returned context is cancelled by
+// CloseConnection; the tracker's Done unregisters it. When ctx carries
+// an unclaimed tracker from TrackConnection, the bridge takes that one
+// over instead.
+func (m *Metrics) trackBridge(ctx context.Context, role, target string) (context.Context, *ConnectionTracker) {
+	if t, _ := ctx.Value(trackerKey{}).(*ConnectionTracker); t != nil && !t.claimed {
+		t.claimed = true
+		return ctx, t
+	}
+	tracker := m.connectionOpened(role, target, connLabelsFrom(ctx))
+	if tracker == nil {
+		return ctx, nil
+	}
+	ctx, cancel := context.WithCancelCause(ctx)
+	tracker.live = m.live.add(connIDFrom(ctx), role, target, cancel)
+	if m.AccessLog != nil {
+		tracker.access = &accessInfo{
+			id:     tracker.live.info.ID,
+			target: target,
+			client: clientAddrFrom(ctx),
+			start:  tracker.live.info.Started,
+		}
+	}
+	return ctx, tracker
+}
+
+// trackerKey is the context key for TrackConnection.
+type trackerKey struct{}
+
+// TrackConnection opens the tracker for a connection ahead of its relay
+// dial and envelope exchange, so a connection that fails before its
+// bridge still shows in /connections and is counted with status error
+// in connections_total. The first Tracked* bridge run on the returned
+// context takes the tracker over and finishes it; Finish records the
+// connection when none did. ctx should already carry the connection's
+// WithConnID, WithConnLabels and WithClientAddr values. Safe to call
+// on a nil receiver.
+func (m *Metrics) TrackConnection(ctx context.Context, role, target string) (context.Context, *ConnectionTracker) {
+	ctx, tracker := m.trackBridge(ctx, role, target)
+	if tracker == nil {
+		return ctx, nil
+	}
+	tracker.start = time.Now()
+	return context.WithValue(ctx, trackerKey{}, tracker), tracker
+}
+
+// Finish records a connection opened by TrackConnection that ended
+// before any bridge took its tracker over, such as a failed dial or a
+// rejected envelope: no bytes moved, and err decides the status. It
+// does nothing once a bridge has taken the tracker, and is safe to
+// call on a nil tracker.
+func (t *ConnectionTracker) Finish(err error) {
+	if t == nil || t.claimed {
+		return
+	}
+	t.claimed = true
+	t.Done(time.Since(t.start).Seconds(), 0, 0, err)
+}
+
+// connIDKey is the context key for WithConnID.
+type connIDKey struct{}
+
+// WithConnID returns a copy of ctx carrying the id TrackedBridge and
+// TrackedBridgeSession register the connection under. Callers pass the
+// bridge_id so the /connections listing matches the logs. Without it
+// a fresh id is minted.
+func WithConnID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, connIDKey{}, id)
+}
+
+func connIDFrom(ctx context.Context) string {
+	id, _ := ctx.Value(connIDKey{}).(string)
+	return id
+}
+
+// handleConnections serves GET /connections: the live connections as a
+// JSON array.
+func (m *Metrics) handleConnections(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(m.Connections())
+}
+
+// handleCloseConnection serves POST /connections/{id}/close.
+func (m *Metrics) handleCloseConnection(w http.ResponseWriter, r *http.Request) {
+	if !m.CloseConnection(r.PathValue("id")) {
+		http.Error(w, "no such connection", http.StatusNotFound)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
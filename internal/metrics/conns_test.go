@@ -0,0 +1,302 @@
+package metrics
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/coder/websocket"
+
+	"github.com/philsphicas/aztunnel/internal/relay"
+)
+
+// adminToken is the bearer token the admin endpoint tests serve with.
+const adminToken = "s3cret"
+
+// adminDo sends a body-less method request for url carrying auth as
+// its Authorization header, when set.
+func adminDo(t *testing.T, method, url, auth string) *http.Response {
+	t.Helper()
+	req, err := http.NewRequest(method, url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if auth != "" {
+		req.Header.Set("Authorization", auth)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("%s %s: %v", method, url, err)
+	}
+	return resp
+}
+
+func TestCloseConnection_EndsTrackedBridge(t *testing.T) {
+	// WebSocket peer that holds the connection open until closed.
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ws, err := websocket.Accept(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer ws.CloseNow()
+		for {
+			if _, _, err := ws.Read(r.Context()); err != nil {
+				return
+			}
+		}
+	}))
+	defer srv.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	ws, _, err := websocket.Dial(ctx, "ws"+strings.TrimPrefix(srv.URL, "http"), nil)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer ws.CloseNow()
+	local, remote := net.Pipe()
+	defer remote.Close()
+
+	m := New()
+	m.Admin = true
+	m.Token = adminToken
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	go func() {
+		_ = m.Serve(ctx, ln, slog.New(slog.NewTextHandler(io.Discard, nil)))
+	}()
+	base := "http://" + ln.Addr().String()
+
+	type bridgeEnd struct {
+		result relay.BridgeResult
+		err    error
+	}
+	done := make(chan bridgeEnd, 1)
+	go func() {
+		r, err := m.TrackedBridge(WithConnID(ctx, "BRIDGE1"), ws, local, "sender", "host:22")
+		done <- bridgeEnd{r, err}
+	}()
+
+	listing := func() []ConnInfo {
+		t.Helper()
+		resp := adminDo(t, http.MethodGet, base+"/connections", "Bearer "+adminToken)
+		defer resp.Body.Close()
+		var conns []ConnInfo
+		if err := json.NewDecoder(resp.Body).Decode(&conns); err != nil {
+			t.Fatalf("decode listing: %v", err)
+		}
+		return conns
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for len(m.Connections()) == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("bridge never registered")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	conns := listing()
+	if len(conns) != 1 || conns[0].ID != "BRIDGE1" || conns[0].Target != "host:22" {
+		t.Fatalf("listing = %+v, want one connection BRIDGE1 to host:22", conns)
+	}
+
+	// A cross-site form POST carries no Authorization header.
+	resp := adminDo(t, http.MethodPost, base+"/connections/BRIDGE1/close", "")
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("POST close without token status = %d, want %d", resp.StatusCode, http.StatusUnauthorized)
+	}
+	if len(m.Connections()) != 1 {
+		t.Fatal("POST close without token ended the connection")
+	}
+
+	resp = adminDo(t, http.MethodPost, base+"/connections/BRIDGE1/close", "Bearer "+adminToken)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent {
+		t.Errorf("POST close status = %d, want %d", resp.StatusCode, http.StatusNoContent)
+	}
+
+	select {
+	case end := <-done:
+		if end.result.EndCause != "admin_close" {
+			t.Errorf("EndCause = %q, want %q", end.result.EndCause, "admin_close")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("bridge did not end after close")
+	}
+	if conns := listing(); len(conns) != 0 {
+		t.Errorf("listing after close = %+v, want empty", conns)
+	}
+
+	resp = adminDo(t, http.MethodPost, base+"/connections/BRIDGE1/close", "Bearer "+adminToken)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("second POST close status = %d, want %d", resp.StatusCode, http.StatusNotFound)
+	}
+}
+
+func TestTrackConnection(t *testing.T) {
+	m := New()
+
+	// A connection that never reaches a bridge is listed while it
+	// sets up, then counted as an error with no bytes.
+	ctx, tracker := m.TrackConnection(WithConnID(context.Background(), "FAILED"), "sender", "a:1")
+	if got := m.Connections(); len(got) != 1 || got[0].ID != "FAILED" {
+		t.Errorf("Connections = %+v, want the connection being set up", got)
+	}
+	tracker.Finish(io.ErrUnexpectedEOF)
+	tracker.Finish(io.ErrUnexpectedEOF) // a second Finish is a no-op
+	if c := getCounter(t, m.connectionsTotal, "sender", "a:1", "error"); c != 1 {
+		t.Errorf("connections_total(error) = %v, want 1", c)
+	}
+	if g := getGauge(t, m.activeConnections, "sender", "a:1"); g != 0 {
+		t.Errorf("active_connections = %v, want 0", g)
+	}
+	if len(m.Connections()) != 0 || ctx.Err() == nil {
+		t.Error("finished connection is still registered")
+	}
+
+	// A bridge run on the context takes the tracker over, and
+	// Finish then leaves the bridge's outcome alone.
+	ctx, tracker = m.TrackConnection(context.Background(), "sender", "b:1")
+	if _, bt := m.trackBridge(ctx, "sender", "b:1"); bt != tracker {
+		t.Fatal("bridge opened its own tracker instead of taking over")
+	}
+	tracker.Done(1, 10, 20, nil)
+	tracker.Finish(io.ErrUnexpectedEOF)
+	if c := getCounter(t, m.connectionsTotal, "sender", "b:1", "success"); c != 1 {
+		t.Errorf("connections_total(success) = %v, want 1", c)
+	}
+	if c := getCounter(t, m.connectionsTotal, "sender", "b:1", "error"); c != 0 {
+		t.Errorf("connections_total(error) = %v, want 0", c)
+	}
+}
+
+func TestConnRegistry_MintsIDWhenMissingOrTaken(t *testing.T) {
+	var r connRegistry
+	noop := func(error) {}
+	a := r.add("", "listener", "a:1", noop)
+	b := r.add("SAME", "listener", "b:1", noop)
+	c := r.add("SAME", "listener", "c:1", noop)
+	if a.info.ID == "" {
+		t.Error("empty id was not replaced")
+	}
+	if b.info.ID != "SAME" || c.info.ID == "SAME" {
+		t.Errorf("ids = %q, %q; want the second SAME to get a fresh id", b.info.ID, c.info.ID)
+	}
+	r.remove(b)
+	if got := len(r.list()); got != 2 {
+		t.Errorf("len(list) = %d, want 2", got)
+	}
+}
+
+func TestAdminEndpoints_OffByDefault(t *testing.T) {
+	m := New()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	go func() {
+		_ = m.Serve(ctx, ln, slog.New(slog.NewTextHandler(io.Discard, nil)))
+	}()
+
+	resp, err := http.Get("http://" + ln.Addr().String() + "/connections")
+	if err != nil {
+		t.Fatalf("GET /connections: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("GET /connections status = %d, want %d without Admin", resp.StatusCode, http.StatusNotFound)
+	}
+}
+
+func TestAdminEndpoints_RequireToken(t *testing.T) {
+	m := New()
+	m.Admin = true
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	if err := m.Serve(context.Background(), ln, slog.New(slog.NewTextHandler(io.Discard, nil))); err == nil {
+		t.Fatal("Serve with Admin and no Token succeeded")
+	}
+	if _, err := net.Dial("tcp", ln.Addr().String()); err == nil {
+		t.Error("listener still accepting after Serve refused to start")
+	}
+}
+
+func TestQuiesceEndpoints(t *testing.T) {
+	m := New()
+	m.Admin = true
+	m.Token = adminToken
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	go func() {
+		_ = m.Serve(ctx, ln, slog.New(slog.NewTextHandler(io.Discard, nil)))
+	}()
+	base := "http://" + ln.Addr().String()
+	post := func(path string) int {
+		t.Helper()
+		resp := adminDo(t, http.MethodPost, base+path, "Bearer "+adminToken)
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	// Not a listener: the toggle is unavailable.
+	if code := post("/quiesce"); code != http.StatusNotFound {
+		t.Errorf("POST /quiesce status = %d, want %d before EnableQuiesce", code, http.StatusNotFound)
+	}
+	if m.Quiesced() {
+		t.Fatal("quiesced without EnableQuiesce")
+	}
+
+	m.EnableQuiesce()
+	// Gated like /connections/{id}/close: a forged POST without the
+	// token must not pause the listener.
+	for _, auth := range []string{"", "Bearer wrong"} {
+		resp := adminDo(t, http.MethodPost, base+"/quiesce", auth)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusUnauthorized {
+			t.Errorf("POST /quiesce with %q status = %d, want %d", auth, resp.StatusCode, http.StatusUnauthorized)
+		}
+	}
+	if m.Quiesced() {
+		t.Fatal("quiesced by a POST without the token")
+	}
+	if code := post("/quiesce"); code != http.StatusNoContent {
+		t.Errorf("POST /quiesce status = %d, want %d", code, http.StatusNoContent)
+	}
+	if !m.Quiesced() {
+		t.Error("Quiesced() = false after POST /quiesce")
+	}
+	if code := post("/resume"); code != http.StatusNoContent {
+		t.Errorf("POST /resume status = %d, want %d", code, http.StatusNoContent)
+	}
+	if m.Quiesced() {
+		t.Error("Quiesced() = true after POST /resume")
+	}
+
+	m.SetQuiesced(true)
+	resp := adminDo(t, http.MethodPost, base+"/resume", "")
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized || !m.Quiesced() {
+		t.Errorf("POST /resume without token = %d, quiesced %v; want %d and still quiesced",
+			resp.StatusCode, m.Quiesced(), http.StatusUnauthorized)
+	}
+}
@@ -0,0 +1,60 @@
+package metrics
+
+import (
+	"context"
+	"log/slog"
+	"net"
+	"net/http"
+	"sync/atomic"
+)
+
+// Readiness records whether the process is ready to carry traffic: the
+// listener's control channel is connected, or a sender's local socket
+// is bound. A nil *Readiness is valid and ignores updates, so callers
+// need not check whether a health server was requested.
+type Readiness struct {
+	ready atomic.Bool
+}
+
+// SetReady updates the readiness state.
+func (r *Readiness) SetReady(ready bool) {
+	if r == nil {
+		return
+	}
+	r.ready.Store(ready)
+}
+
+// Ready reports the current readiness state.
+func (r *Readiness) Ready() bool {
+	return r != nil && r.ready.Load()
+}
+
+// ServeHealth starts an HTTP server on ln that serves only /healthz
+// and /readyz, independent of the metrics server. /healthz answers 200
+// while the process is running; /readyz answers 200 when r is ready and
+// 503 otherwise. It blocks until ctx is cancelled, then shuts down
+// gracefully.
+func ServeHealth(ctx context.Context, ln net.Listener, r *Readiness, logger *slog.Logger) error {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", handleHealthz)
+	mux.HandleFunc("/readyz", handleReadyz(r.Ready))
+	return serveHTTP(ctx, ln, mux, "", "", logger, "health server listening")
+}
+
+// handleHealthz answers 200 while the process is serving.
+func handleHealthz(w http.ResponseWriter, _ *http.Request) {
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write([]byte("ok\n"))
+}
+
+// handleReadyz answers 200 when ready reports true and 503 otherwise.
+func handleReadyz(ready func() bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, _ *http.Request) {
+		if !ready() {
+			http.Error(w, "not ready", http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		_, _ = w.Write([]byte("ready\n"))
+	}
+}
@@ -0,0 +1,116 @@
+package metrics
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestServeHealth(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	base := "http://" + ln.Addr().String()
+
+	r := &Readiness{}
+	done := make(chan error, 1)
+	go func() {
+		done <- ServeHealth(ctx, ln, r, slog.New(slog.NewTextHandler(io.Discard, nil)))
+	}()
+
+	get := func(path string) int {
+		t.Helper()
+		resp, err := http.Get(base + path)
+		if err != nil {
+			t.Fatalf("GET %s: %v", path, err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	if got := get("/healthz"); got != http.StatusOK {
+		t.Errorf("/healthz = %d, want 200", got)
+	}
+	if got := get("/readyz"); got != http.StatusServiceUnavailable {
+		t.Errorf("/readyz before ready = %d, want 503", got)
+	}
+	r.SetReady(true)
+	if got := get("/readyz"); got != http.StatusOK {
+		t.Errorf("/readyz after ready = %d, want 200", got)
+	}
+	if got := get("/metrics"); got != http.StatusNotFound {
+		t.Errorf("/metrics = %d, want 404 on the health server", got)
+	}
+
+	cancel()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("ServeHealth: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("ServeHealth did not return after cancel")
+	}
+}
+
+func TestServe_HealthProbes(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	m := New()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	base := "http://" + ln.Addr().String()
+	go func() {
+		_ = m.Serve(ctx, ln, slog.New(slog.NewTextHandler(io.Discard, nil)))
+	}()
+
+	get := func(path string) int {
+		t.Helper()
+		resp, err := http.Get(base + path)
+		if err != nil {
+			t.Fatalf("GET %s: %v", path, err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	if got := get("/healthz"); got != http.StatusOK {
+		t.Errorf("/healthz = %d, want 200", got)
+	}
+	if got := get("/readyz"); got != http.StatusOK {
+		t.Errorf("/readyz with no control channel (sender) = %d, want 200", got)
+	}
+	m.SetControlChannelConnected("hc", false)
+	if got := get("/readyz"); got != http.StatusServiceUnavailable {
+		t.Errorf("/readyz while disconnected = %d, want 503", got)
+	}
+	if got := get("/healthz"); got != http.StatusOK {
+		t.Errorf("/healthz while disconnected = %d, want 200", got)
+	}
+	m.SetControlChannelConnected("hc", true)
+	if got := get("/readyz"); got != http.StatusOK {
+		t.Errorf("/readyz once connected = %d, want 200", got)
+	}
+	if got := get("/metrics"); got != http.StatusOK {
+		t.Errorf("/metrics = %d, want 200 alongside the probes", got)
+	}
+}
+
+func TestNilReadiness(t *testing.T) {
+	var r *Readiness
+	r.SetReady(true)
+	if r.Ready() {
+		t.Error("nil Readiness reports ready")
+	}
+}
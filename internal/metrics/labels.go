@@ -0,0 +1,84 @@
+package metrics
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+)
+
+// labelBudget caps the number of distinct values one label may take.
+// Values seen while under the cap are kept verbatim for the life of
+// the process; once the cap is reached every new value is reported as
+// OverflowTarget.
+type labelBudget struct {
+	count atomic.Int64
+	seen  sync.Map // map[string]struct{}
+}
+
+// sanitize returns value if it is within a budget of max distinct
+// values, or OverflowTarget if the cap has been reached. Values that
+// have been seen before are always returned as-is. max <= 0 means
+// unlimited.
+func (b *labelBudget) sanitize(value string, max int) string {
+	if max <= 0 {
+		return value
+	}
+
+	for {
+		// Fast path: already-known value.
+		if _, ok := b.seen.Load(value); ok {
+			return value
+		}
+
+		cur := b.count.Load()
+		if cur >= int64(max) {
+			// Re-check: another goroutine may have stored this value
+			// between our Load and this cap check.
+			if _, ok := b.seen.Load(value); ok {
+				return value
+			}
+			return OverflowTarget
+		}
+
+		// Try to reserve a slot atomically.
+		if !b.count.CompareAndSwap(cur, cur+1) {
+			continue
+		}
+
+		// Slot reserved. Store the value, undoing the increment if
+		// another goroutine stored it first.
+		if _, loaded := b.seen.LoadOrStore(value, struct{}{}); loaded {
+			b.count.Add(-1)
+		}
+
+		return value
+	}
+}
+
+// ConnLabels are the per-connection detail labels recorded on
+// aztunnel_active_connections_detailed when Metrics.DetailedLabels is
+// set.
+type ConnLabels struct {
+	// LocalAddr is the local endpoint of the bridged connection: the
+	// sender's bind address, or the listener's source IP toward the
+	// target. Callers must keep it low-cardinality (no ephemeral
+	// ports).
+	LocalAddr string
+	// RelayHost is the relay namespace endpoint the connection runs
+	// through.
+	RelayHost string
+}
+
+// connLabelsKey is the context key for WithConnLabels.
+type connLabelsKey struct{}
+
+// WithConnLabels returns a copy of ctx carrying l for TrackedBridge and
+// TrackedBridgeSession. Without it the detail labels are empty.
+func WithConnLabels(ctx context.Context, l ConnLabels) context.Context {
+	return context.WithValue(ctx, connLabelsKey{}, l)
+}
+
+func connLabelsFrom(ctx context.Context) ConnLabels {
+	l, _ := ctx.Value(connLabelsKey{}).(ConnLabels)
+	return l
+}
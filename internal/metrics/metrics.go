@@ -4,13 +4,17 @@ package metrics
 import (
 	"context"
 	"errors"
+	"fmt"
 	"log/slog"
 	"net"
+	"regexp"
+	"strconv"
+	"strings"
 	"sync"
-	"sync/atomic"
 	"time"
 
 	"github.com/coder/websocket"
+	"github.com/philsphicas/aztunnel/internal/bridgecause"
 	"github.com/philsphicas/aztunnel/internal/relay"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/collectors"
@@ -39,6 +43,69 @@ const (
 	// ReasonDialTimeout because the failure happened before any SYN was
 	// sent; the underlying network may be fine.
 	ReasonDNSTimeout = "dns_timeout"
+	// ReasonAcceptQueueFull is the reason label for accept messages the
+	// listener dropped because its accept worker backlog was full.
+	ReasonAcceptQueueFull = "accept_queue_full"
+	// ReasonAcceptOverflowFull is the reason label for accept messages
+	// dropped because --accept-overflow=queue already held as many
+	// waiting accepts as it allows.
+	ReasonAcceptOverflowFull = "accept_overflow_full"
+	// ReasonAbandonedRendezvous is the reason label for sender
+	// rendezvous closed because the listener never answered the
+	// connect envelope within the sender's envelope timeout.
+	ReasonAbandonedRendezvous = "abandoned_rendezvous"
+	// ReasonBindFailed is the reason label for bind-mode envelopes
+	// whose listen socket could not be opened or saw no inbound
+	// connection before the listener's connect timeout.
+	ReasonBindFailed = "bind_failed"
+	// ReasonQuiescing is the reason label for envelopes rejected
+	// because an operator quiesced the listener.
+	ReasonQuiescing = "quiescing"
+	// ReasonDenylistRejected is the reason label for targets refused
+	// because they match the listener's denylist.
+	ReasonDenylistRejected = "denylist_rejected"
+	// ReasonAtCapacity is the reason label for mux streams refused
+	// because the listener already serves its --max-connections.
+	ReasonAtCapacity = "at_capacity"
+	// ReasonModeNotAllowed is the reason label for bind, udp, and mux
+	// sessions refused because the listener was not started with the
+	// flag that enables the mode.
+	ReasonModeNotAllowed = "mode_not_allowed"
+)
+
+// Reuse label values for aztunnel_target_connections_total.
+const (
+	// ReuseFresh marks a target connection dialed for this bridge.
+	ReuseFresh = "fresh"
+	// ReuseReused marks a target connection taken from a pool. Nothing
+	// pools target connections yet; the value is reserved so dashboards
+	// can be built against the final label set.
+	ReuseReused = "reused"
+)
+
+// OverflowEnvelopeVersion is the version label for envelopes whose
+// version is negative or above MaxEnvelopeVersionLabel, so a sender
+// cannot mint unbounded series.
+const OverflowEnvelopeVersion = "other"
+
+// MaxEnvelopeVersionLabel is the highest envelope version recorded
+// under its own label.
+const MaxEnvelopeVersionLabel = 15
+
+// Proxy label values for aztunnel_sender_rejections_total.
+const (
+	ProxySOCKS5 = "socks5"
+	ProxyHTTP   = "http"
+)
+
+// Reason label values for aztunnel_sender_rejections_total.
+const (
+	// SenderRejectNotAllowed marks a proxy target refused by the
+	// sender-side allowlist before any relay dial.
+	SenderRejectNotAllowed = "not_allowed"
+	// SenderRejectAuthFailed marks a SOCKS5 client that offered no
+	// acceptable auth method or wrong credentials.
+	SenderRejectAuthFailed = "auth_failed"
 )
 
 // Metrics holds all Prometheus metrics for aztunnel.
@@ -50,25 +117,168 @@ type Metrics struct {
 	// Zero means unlimited.
 	MaxTargets int
 
+	// SLOThreshold is the Apdex target T for dial latency: each dial
+	// duration observation is also counted as SLOSatisfied (<= T),
+	// SLOTolerating (<= 4T), or SLOFrustrated. Zero disables the SLO
+	// counters; the dial histogram is recorded either way.
+	SLOThreshold time.Duration
+
 	connectionsTotal   *prometheus.CounterVec
 	connectionErrors   *prometheus.CounterVec
 	bytesTotal         *prometheus.CounterVec
 	activeConnections  *prometheus.GaugeVec
+	activeDetailed     *prometheus.GaugeVec
 	controlChannelUp   prometheus.Gauge
+	hycoControlUp      *prometheus.GaugeVec
+	controlReconnects  *prometheus.CounterVec
+	controlDelay       *prometheus.GaugeVec
+	hycoAccepts        *prometheus.CounterVec
+	quiescedGauge      prometheus.Gauge
 	connectionDuration *prometheus.HistogramVec
 	dialDuration       *prometheus.HistogramVec
+	dialSLO            *prometheus.CounterVec
 	tokenFetchSeconds  *prometheus.HistogramVec
 	tokenFetchTotal    *prometheus.CounterVec
-
-	targetCount atomic.Int64
-	targets     sync.Map // map[string]struct{}
+	targetConns        *prometheus.CounterVec
+	envelopeVersions   *prometheus.CounterVec
+	senderRejections   *prometheus.CounterVec
+	compressionBytes   *prometheus.CounterVec
+	throughput         *prometheus.GaugeVec
+
+	// DetailedLabels additionally records each bridged connection on
+	// aztunnel_active_connections_detailed with local_addr and
+	// relay_host labels (see WithConnLabels). Each of those labels is
+	// capped at MaxTargets distinct values, like target. Off by
+	// default because of the extra series.
+	DetailedLabels bool
+
+	// AccessLog, when non-nil, receives one record per finished
+	// bridged connection: id, role, target, client (see
+	// WithClientAddr), start, duration, bytes each way, status, and end
+	// cause. See NewAccessLogger. Records carry no error text, so no
+	// secret can reach them.
+	AccessLog *slog.Logger
+
+	// Admin additionally serves GET /connections,
+	// POST /connections/{id}/close, POST /quiesce, and POST /resume on
+	// the metrics server. Off by default: these endpoints end live
+	// connections or stop new ones, so Serve refuses Admin without
+	// Token. The bearer token also keeps a browser from forging the
+	// body-less POSTs for a page the operator visits.
+	Admin bool
+
+	// Pprof additionally serves the net/http/pprof handlers under
+	// /debug/pprof/ on the metrics server. Off by default: profiles
+	// expose memory contents and cost CPU, so the metrics address
+	// should be loopback-only when this is on.
+	Pprof bool
+
+	// Token, when set, makes every endpoint on the metrics server but
+	// /healthz and /readyz answer 401 unless the request carries
+	// "Authorization: Bearer <Token>". Probes stay open so kubelets
+	// and load balancers need no credentials.
+	Token string
+
+	// TLSCertFile and TLSKeyFile, when both set, make the metrics
+	// server speak HTTPS with this PEM certificate and key instead of
+	// plain HTTP. The health server is unaffected.
+	TLSCertFile string
+	TLSKeyFile  string
+
+	targets    labelBudget
+	localAddrs labelBudget
+	relayHosts labelBudget
+
+	live connRegistry
+
+	bytes byteTotals
+
+	quiesce quiesceState
+
+	controlMu sync.Mutex
+	controlUp map[string]bool // hyco -> connected, for the summary gauge
 }
 
-// New creates a new Metrics instance with a custom Prometheus registry.
+// New creates a new Metrics instance with its own Prometheus registry.
+// Every call gets a fresh registry, so any number of instances can
+// coexist in one process.
 func New() *Metrics {
+	// A fresh registry has nothing to conflict with, so the error is
+	// unreachable here.
+	m, _ := NewWithRegistry(prometheus.NewRegistry())
+	return m
+}
+
+// NewWithRegistry creates a Metrics instance whose collectors are
+// registered on reg, for embedders that expose aztunnel metrics
+// alongside their own. The Go and process collectors are shared
+// process-wide state: if reg already has them (from the embedder or an
+// earlier instance) the existing ones are kept. A conflict on an
+// aztunnel collector, such as a second instance on the same registry,
+// returns an error and leaves reg as it was.
+func NewWithRegistry(reg *prometheus.Registry) (*Metrics, error) {
+	return newMetrics(reg, reg, true)
+}
+
+// NewWithLabels is New with labels attached as constant labels to
+// every metric it exposes, such as env or cluster for a Prometheus
+// that scrapes several deployments. Label names must be valid
+// Prometheus names, must not start with "__", and must not clash with
+// a label an aztunnel metric already has.
+func NewWithLabels(labels map[string]string) (*Metrics, error) {
+	return NewWithOptions(Options{Labels: labels})
+}
+
+// Options configures NewWithOptions.
+type Options struct {
+	// Labels are constant labels attached to every metric, as for
+	// NewWithLabels.
+	Labels map[string]string
+
+	// DisableRuntimeMetrics leaves the Go and process collectors (the
+	// go_* and process_* series) off the registry, for scrapes that
+	// only want aztunnel's own metrics.
+	DisableRuntimeMetrics bool
+}
+
+// NewWithOptions creates a Metrics instance with its own Prometheus
+// registry, configured by opts. The zero Options is New.
+func NewWithOptions(opts Options) (*Metrics, error) {
+	for name := range opts.Labels {
+		if !labelNameRE.MatchString(name) || strings.HasPrefix(name, "__") {
+			return nil, fmt.Errorf("invalid metrics label name %q", name)
+		}
+	}
 	reg := prometheus.NewRegistry()
-	reg.MustRegister(collectors.NewGoCollector())
-	reg.MustRegister(collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}))
+	var r prometheus.Registerer = reg
+	if len(opts.Labels) > 0 {
+		r = prometheus.WrapRegistererWith(opts.Labels, reg)
+	}
+	return newMetrics(reg, r, !opts.DisableRuntimeMetrics)
+}
+
+// labelNameRE matches a legal Prometheus label name.
+var labelNameRE = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+// newMetrics builds a Metrics exposed through reg whose collectors are
+// registered through r, which is reg itself or a wrapper around it.
+// runtime adds the Go and process collectors.
+func newMetrics(reg *prometheus.Registry, r prometheus.Registerer, runtime bool) (*Metrics, error) {
+	var shared []prometheus.Collector
+	if runtime {
+		shared = []prometheus.Collector{
+			collectors.NewGoCollector(),
+			collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		}
+	}
+	for _, c := range shared {
+		if err := r.Register(c); err != nil {
+			if are := (prometheus.AlreadyRegisteredError{}); errors.As(err, &are) {
+				continue
+			}
+			return nil, fmt.Errorf("register runtime collector: %w", err)
+		}
+	}
 
 	m := &Metrics{
 		Registry: reg,
@@ -97,10 +307,46 @@ func New() *Metrics {
 			Help:      "Number of currently active bridged connections.",
 		}, []string{"role", "target"}),
 
+		activeDetailed: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "active_connections_detailed",
+			Help:      "Currently active bridged connections by local address and relay host (only with detailed labels enabled).",
+		}, []string{"role", "target", "local_addr", "relay_host"}),
+
 		controlChannelUp: prometheus.NewGauge(prometheus.GaugeOpts{
 			Namespace: namespace,
 			Name:      "control_channel_connected",
-			Help:      "Whether the listener control channel is connected (1) or not (0).",
+			Help:      "Whether every listener control channel is connected (1) or not (0).",
+		}),
+
+		hycoControlUp: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "hyco_control_channel_connected",
+			Help:      "Whether the listener control channel for a hybrid connection is connected (1) or not (0).",
+		}, []string{"hyco"}),
+
+		controlReconnects: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "control_reconnects_total",
+			Help:      "Listener control-channel sessions or dials that failed and were retried, by hybrid connection and control_ended reason.",
+		}, []string{"hyco", "reason"}),
+
+		controlDelay: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "control_reconnect_delay_seconds",
+			Help:      "Current listener control-channel reconnect backoff delay in seconds; 0 while connected.",
+		}, []string{"hyco"}),
+
+		hycoAccepts: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "hyco_accepts_total",
+			Help:      "Rendezvous accepted by the listener, by hybrid connection.",
+		}, []string{"hyco"}),
+
+		quiescedGauge: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "listener_quiesced",
+			Help:      "Whether the listener is quiesced and rejecting new connections (1) or not (0).",
 		}),
 
 		connectionDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
@@ -117,6 +363,12 @@ func New() *Metrics {
 			Buckets:   []float64{0.001, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30},
 		}, []string{"role"}),
 
+		dialSLO: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "dial_slo_total",
+			Help:      "Outbound dials by Apdex category (satisfied, tolerating, frustrated) against the configured SLO threshold.",
+		}, []string{"role", "category"}),
+
 		tokenFetchSeconds: prometheus.NewHistogramVec(prometheus.HistogramOpts{
 			Namespace: namespace,
 			Name:      "token_fetch_seconds",
@@ -137,21 +389,71 @@ func New() *Metrics {
 			Name:      "token_fetch_total",
 			Help:      "Count of TokenProvider.GetToken calls by outcome.",
 		}, []string{"provider", "result"}),
+
+		targetConns: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "target_connections_total",
+			Help:      "Listener target connections used for bridging, by whether they were freshly dialed or reused.",
+		}, []string{"reuse"}),
+
+		envelopeVersions: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "envelope_version_total",
+			Help:      "Connect envelopes received by the listener, by protocol version.",
+		}, []string{"version"}),
+
+		senderRejections: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "sender_rejections_total",
+			Help:      "Proxy requests refused by sender-side policy, by proxy and reason.",
+		}, []string{"proxy", "reason"}),
+
+		compressionBytes: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "compression_bytes_total",
+			Help:      "Bytes bridged over relay WebSockets that negotiated permessage-deflate, as payload (uncompressed) and on the wire (compressed, with framing and TLS).",
+		}, []string{"role", "direction", "form"}),
+
+		throughput: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "throughput_bytes_per_second",
+			Help:      "Bytes per second through the relay tunnel in both directions, sampled periodically by the metrics server from connections that completed in the interval.",
+		}, []string{"role"}),
 	}
 
-	reg.MustRegister(
+	own := []prometheus.Collector{
 		m.connectionsTotal,
 		m.connectionErrors,
 		m.bytesTotal,
 		m.activeConnections,
+		m.activeDetailed,
 		m.controlChannelUp,
+		m.hycoControlUp,
+		m.controlReconnects,
+		m.controlDelay,
+		m.hycoAccepts,
+		m.quiescedGauge,
 		m.connectionDuration,
 		m.dialDuration,
+		m.dialSLO,
 		m.tokenFetchSeconds,
 		m.tokenFetchTotal,
-	)
+		m.targetConns,
+		m.envelopeVersions,
+		m.senderRejections,
+		m.compressionBytes,
+		m.throughput,
+	}
+	for i, c := range own {
+		if err := r.Register(c); err != nil {
+			for _, done := range own[:i] {
+				r.Unregister(done)
+			}
+			return nil, fmt.Errorf("register aztunnel metrics: %w", err)
+		}
+	}
 
-	return m
+	return m, nil
 }
 
 // SanitizeTarget returns target if it is within the cardinality budget,
@@ -161,39 +463,7 @@ func (m *Metrics) SanitizeTarget(target string) string {
 	if m == nil {
 		return target
 	}
-	if m.MaxTargets <= 0 {
-		return target
-	}
-
-	for {
-		// Fast path: already-known target.
-		if _, ok := m.targets.Load(target); ok {
-			return target
-		}
-
-		cur := m.targetCount.Load()
-		if cur >= int64(m.MaxTargets) {
-			// Re-check: another goroutine may have stored this target
-			// between our Load and this cap check.
-			if _, ok := m.targets.Load(target); ok {
-				return target
-			}
-			return OverflowTarget
-		}
-
-		// Try to reserve a slot atomically.
-		if !m.targetCount.CompareAndSwap(cur, cur+1) {
-			continue
-		}
-
-		// Slot reserved. Store the target, undoing the increment if
-		// another goroutine stored it first.
-		if _, loaded := m.targets.LoadOrStore(target, struct{}{}); loaded {
-			m.targetCount.Add(-1)
-		}
-
-		return target
-	}
+	return m.targets.sanitize(target, m.MaxTargets)
 }
 
 // ConnectionOpened increments the active connection gauge and should be
@@ -201,12 +471,28 @@ func (m *Metrics) SanitizeTarget(target string) string {
 // outcome when the connection ends. The target is sanitized through the
 // cardinality guard.
 func (m *Metrics) ConnectionOpened(role, target string) *ConnectionTracker {
+	return m.connectionOpened(role, target, ConnLabels{})
+}
+
+// connectionOpened is ConnectionOpened with the detail labels used
+// when DetailedLabels is set.
+func (m *Metrics) connectionOpened(role, target string, l ConnLabels) *ConnectionTracker {
 	if m == nil {
 		return nil
 	}
 	target = m.SanitizeTarget(target)
 	m.activeConnections.WithLabelValues(role, target).Inc()
-	return &ConnectionTracker{m: m, role: role, target: target}
+	t := &ConnectionTracker{m: m, role: role, target: target}
+	if m.DetailedLabels {
+		t.detail = []string{
+			role,
+			target,
+			m.localAddrs.sanitize(l.LocalAddr, m.MaxTargets),
+			m.relayHosts.sanitize(l.RelayHost, m.MaxTargets),
+		}
+		m.activeDetailed.WithLabelValues(t.detail...).Inc()
+	}
+	return t
 }
 
 // ConnectionError records a connection failure that did not reach the bridge.
@@ -219,8 +505,9 @@ func (m *Metrics) ConnectionError(role, reason string) {
 
 // DialReason maps a dial error to a metric reason label. It returns
 // ReasonDialTimeout for network timeouts, ReasonDNSTimeout for DNS
-// resolver timeouts, ReasonDNSNotFound for non-timeout DNS failures, or
-// fallback for any other error.
+// resolver timeouts, ReasonDNSNotFound for non-timeout DNS failures,
+// ReasonAuthFailed when the relay rejected the token for the dial's
+// action (*relay.ClaimError), or fallback for any other error.
 //
 // The DNS-error classification is scoped to listener target dials by
 // gating on `fallback == ReasonDialFailed`. Sender callers pass
@@ -237,6 +524,10 @@ func DialReason(err error, fallback string) string {
 	if errors.Is(err, context.DeadlineExceeded) {
 		return ReasonDialTimeout
 	}
+	var claimErr *relay.ClaimError
+	if errors.As(err, &claimErr) {
+		return ReasonAuthFailed
+	}
 	if fallback == ReasonDialFailed {
 		var dnsErr *net.DNSError
 		if errors.As(err, &dnsErr) {
@@ -253,12 +544,38 @@ func DialReason(err error, fallback string) string {
 	return fallback
 }
 
-// ObserveDialDuration records how long an outbound dial took.
+// Apdex categories for aztunnel_dial_slo_total.
+const (
+	SLOSatisfied  = "satisfied"
+	SLOTolerating = "tolerating"
+	SLOFrustrated = "frustrated"
+)
+
+// SLOCategory classifies a dial duration against the Apdex target
+// threshold: satisfied up to threshold, tolerating up to four times
+// threshold, frustrated beyond that.
+func SLOCategory(seconds float64, threshold time.Duration) string {
+	t := threshold.Seconds()
+	switch {
+	case seconds <= t:
+		return SLOSatisfied
+	case seconds <= 4*t:
+		return SLOTolerating
+	default:
+		return SLOFrustrated
+	}
+}
+
+// ObserveDialDuration records how long an outbound dial took, and its
+// SLO category when SLOThreshold is set.
 func (m *Metrics) ObserveDialDuration(role string, seconds float64) {
 	if m == nil {
 		return
 	}
 	m.dialDuration.WithLabelValues(role).Observe(seconds)
+	if m.SLOThreshold > 0 {
+		m.dialSLO.WithLabelValues(role, SLOCategory(seconds, m.SLOThreshold)).Inc()
+	}
 }
 
 // ObserveTokenFetch records the latency and outcome of a single
@@ -273,16 +590,116 @@ func (m *Metrics) ObserveTokenFetch(provider, result string, durationSec float64
 	m.tokenFetchTotal.WithLabelValues(provider, result).Inc()
 }
 
-// SetControlChannelConnected sets the control channel gauge.
-func (m *Metrics) SetControlChannelConnected(up bool) {
+// TargetConnection records a listener target connection handed to a
+// bridge. reuse is ReuseFresh or ReuseReused.
+func (m *Metrics) TargetConnection(reuse string) {
+	if m == nil {
+		return
+	}
+	m.targetConns.WithLabelValues(reuse).Inc()
+}
+
+// EnvelopeVersion records one connect envelope received with protocol
+// version v, including versions the listener then rejects. Versions
+// outside 0..MaxEnvelopeVersionLabel are recorded as
+// OverflowEnvelopeVersion.
+func (m *Metrics) EnvelopeVersion(v int) {
+	if m == nil {
+		return
+	}
+	label := OverflowEnvelopeVersion
+	if v >= 0 && v <= MaxEnvelopeVersionLabel {
+		label = strconv.Itoa(v)
+	}
+	m.envelopeVersions.WithLabelValues(label).Inc()
+}
+
+// SenderRejection records a request refused by a sender proxy's own
+// policy. proxy is ProxySOCKS5 or ProxyHTTP, and reason one of the
+// SenderReject* constants.
+func (m *Metrics) SenderRejection(proxy, reason string) {
+	if m == nil {
+		return
+	}
+	m.senderRejections.WithLabelValues(proxy, reason).Inc()
+}
+
+// SetControlChannelConnected records whether the control channel for
+// hyco is connected. The per-hyco gauge follows each call; the
+// unlabelled control_channel_connected summary is 1 only while every
+// hyco reported so far is connected, so single-hyco dashboards and
+// alerts keep working unchanged.
+func (m *Metrics) SetControlChannelConnected(hyco string, up bool) {
+	if m == nil {
+		return
+	}
+	m.controlMu.Lock()
+	defer m.controlMu.Unlock()
+	if m.controlUp == nil {
+		m.controlUp = make(map[string]bool)
+	}
+	m.controlUp[hyco] = up
+	m.hycoControlUp.WithLabelValues(hyco).Set(boolGauge(up))
+
+	all := true
+	for _, v := range m.controlUp {
+		all = all && v
+	}
+	m.controlChannelUp.Set(boolGauge(all))
+}
+
+// ControlReady reports whether every control channel reported through
+// SetControlChannelConnected is connected, the readiness the metrics
+// server's /readyz serves. A process that never reports one, such as
+// a sender, is always ready.
+func (m *Metrics) ControlReady() bool {
+	if m == nil {
+		return true
+	}
+	m.controlMu.Lock()
+	defer m.controlMu.Unlock()
+	for _, up := range m.controlUp {
+		if !up {
+			return false
+		}
+	}
+	return true
+}
+
+// ControlReconnect records a failed control-channel session or dial for
+// hyco that the listener is about to retry. reason is the
+// control_ended reason (relay.ControlEnded*).
+func (m *Metrics) ControlReconnect(hyco, reason string) {
+	if m == nil {
+		return
+	}
+	m.controlReconnects.WithLabelValues(hyco, reason).Inc()
+}
+
+// SetControlReconnectDelay records the backoff delay before hyco's next
+// control-channel reconnect. Pass 0 once the channel is connected.
+func (m *Metrics) SetControlReconnectDelay(hyco string, d time.Duration) {
+	if m == nil {
+		return
+	}
+	m.controlDelay.WithLabelValues(hyco).Set(d.Seconds())
+}
+
+// HycoAccept records a rendezvous accepted on hyco's control channel.
+// The hyco label is bounded by the hybrid connections the listener was
+// started with, so unlike target it needs no budget.
+func (m *Metrics) HycoAccept(hyco string) {
 	if m == nil {
 		return
 	}
-	if up {
-		m.controlChannelUp.Set(1)
-	} else {
-		m.controlChannelUp.Set(0)
+	m.hycoAccepts.WithLabelValues(hyco).Inc()
+}
+
+func boolGauge(b bool) float64 {
+	if b {
+		return 1
 	}
+	return 0
 }
 
 // ConnectionTracker records the outcome of a single bridged connection.
@@ -290,6 +707,14 @@ type ConnectionTracker struct {
 	m      *Metrics
 	role   string
 	target string
+	detail []string    // activeDetailed label values; nil unless DetailedLabels
+	live   *liveConn   // registry entry; nil unless opened by trackBridge
+	access *accessInfo // nil unless AccessLog is set and opened by trackBridge
+
+	// Set by TrackConnection: when the connection was opened, and
+	// whether a bridge or Finish has taken the tracker since.
+	start   time.Time
+	claimed bool
 }
 
 // Done records the completion of a connection. toRelayBytes is data sent
@@ -300,27 +725,119 @@ func (t *ConnectionTracker) Done(durationSec float64, toRelayBytes, fromRelayByt
 		return
 	}
 	status := "success"
-	if err != nil {
+	switch {
+	case errors.Is(err, bridgecause.CauseIdleTimeout):
+		status = "idle_timeout"
+	case err != nil:
 		status = "error"
 	}
+	if t.live != nil {
+		t.m.live.remove(t.live)
+		t.live.cancel(nil) // release the bridge context
+	}
 	t.m.activeConnections.WithLabelValues(t.role, t.target).Dec()
+	if t.detail != nil {
+		t.m.activeDetailed.WithLabelValues(t.detail...).Dec()
+	}
 	t.m.connectionsTotal.WithLabelValues(t.role, t.target, status).Inc()
 	t.m.connectionDuration.WithLabelValues(t.role, t.target).Observe(durationSec)
 	t.m.bytesTotal.WithLabelValues(t.role, t.target, "to_relay").Add(float64(toRelayBytes))
 	t.m.bytesTotal.WithLabelValues(t.role, t.target, "from_relay").Add(float64(fromRelayBytes))
+	t.m.bytes.add(t.role, toRelayBytes+fromRelayBytes)
+	t.logAccess(durationSec, toRelayBytes, fromRelayBytes, status)
 }
 
-// TrackedBridge wraps relay.Bridge with connection lifecycle tracking.
-// Safe to call on a nil receiver.
+// TrackedBridge wraps relay.Bridge with connection lifecycle tracking
+// and registers the bridge in the live-connection registry (see
+// WithConnID and CloseConnection). Safe to call on a nil receiver.
 func (m *Metrics) TrackedBridge(ctx context.Context, ws *websocket.Conn, rwc net.Conn, role, target string) (relay.BridgeResult, error) {
-	tracker := m.ConnectionOpened(role, target)
+	return m.TrackedBridgeWithOptions(ctx, ws, rwc, role, target, relay.BridgeOptions{})
+}
+
+// TrackedBridgeWithOptions is TrackedBridge for relay.BridgeWithOptions.
+// Safe to call on a nil receiver.
+func (m *Metrics) TrackedBridgeWithOptions(ctx context.Context, ws *websocket.Conn, rwc net.Conn, role, target string, opts relay.BridgeOptions) (relay.BridgeResult, error) {
+	ctx, tracker := m.trackBridge(ctx, role, target)
+	compressed := m.trackCompression(ctx, role)
+	start := time.Now()
+	var result relay.BridgeResult
+	var err error
+	defer func() {
+		tracker.setEndCause(result.EndCause)
+		tracker.Done(time.Since(start).Seconds(), result.Stats.TCPToWS, result.Stats.WSToTCP, err)
+		compressed(result.Stats)
+	}()
+	result, err = relay.BridgeWithOptions(ctx, ws, rwc, opts)
+	return result, err
+}
+
+// TrackedBridgeSession wraps relay.BridgeSession with the same
+// connection lifecycle tracking as TrackedBridge, so each pipelined
+// connection counts as one connection. Safe to call on a nil receiver.
+func (m *Metrics) TrackedBridgeSession(ctx context.Context, ws *websocket.Conn, rwc net.Conn, role, target string, opts relay.BridgeOptions) (relay.SessionResult, error) {
+	ctx, tracker := m.trackBridge(ctx, role, target)
+	compressed := m.trackCompression(ctx, role)
+	start := time.Now()
+	var result relay.SessionResult
+	var err error
+	defer func() {
+		tracker.setEndCause(result.EndCause)
+		tracker.Done(time.Since(start).Seconds(), result.Stats.TCPToWS, result.Stats.WSToTCP, err)
+		compressed(result.Stats)
+	}()
+	result, err = relay.BridgeSession(ctx, ws, rwc, opts)
+	return result, err
+}
+
+// TrackedBridgeStream wraps relay.BridgeStream with the same
+// connection lifecycle tracking as TrackedBridge, so each mux stream
+// counts as one connection. Safe to call on a nil receiver.
+func (m *Metrics) TrackedBridgeStream(ctx context.Context, s *relay.MuxStream, rwc net.Conn, role, target string, opts relay.BridgeOptions) (relay.BridgeResult, error) {
+	ctx, tracker := m.trackBridge(ctx, role, target)
+	start := time.Now()
+	var result relay.BridgeResult
+	var err error
+	defer func() {
+		tracker.setEndCause(result.EndCause)
+		tracker.Done(time.Since(start).Seconds(), result.Stats.TCPToWS, result.Stats.WSToTCP, err)
+	}()
+	result, err = relay.BridgeStream(ctx, s, rwc, opts)
+	return result, err
+}
+
+// trackCompression snapshots the relay.WireCounter on ctx when its
+// WebSocket negotiated permessage-deflate, and returns a func that adds
+// a bridge's payload bytes, and the wire bytes the WebSocket moved
+// meanwhile, to compression_bytes_total. Without such a counter the
+// func does nothing.
+func (m *Metrics) trackCompression(ctx context.Context, role string) func(relay.BridgeStats) {
+	w := relay.WireCounterFrom(ctx)
+	if m == nil || w == nil || !w.Deflate() {
+		return func(relay.BridgeStats) {}
+	}
+	read0, written0 := w.Bytes()
+	return func(s relay.BridgeStats) {
+		read, written := w.Bytes()
+		m.compressionBytes.WithLabelValues(role, "to_relay", "payload").Add(float64(s.TCPToWS))
+		m.compressionBytes.WithLabelValues(role, "from_relay", "payload").Add(float64(s.WSToTCP))
+		m.compressionBytes.WithLabelValues(role, "to_relay", "wire").Add(float64(written - written0))
+		m.compressionBytes.WithLabelValues(role, "from_relay", "wire").Add(float64(read - read0))
+	}
+}
+
+// TrackedBridgeWS wraps relay.BridgeWS with the same connection
+// lifecycle tracking as TrackedBridge, for a relay-to-relay hop. Safe
+// to call on a nil receiver.
+func (m *Metrics) TrackedBridgeWS(ctx context.Context, ws, peer *websocket.Conn, role, target string, opts relay.BridgeOptions) (relay.BridgeResult, error) {
+	ctx, tracker := m.trackBridge(ctx, role, target)
 	start := time.Now()
 	var result relay.BridgeResult
 	var err error
 	defer func() {
+		tracker.setEndCause(result.EndCause)
 		tracker.Done(time.Since(start).Seconds(), result.Stats.TCPToWS, result.Stats.WSToTCP, err)
 	}()
-	result, err = relay.Bridge(ctx, ws, rwc)
+	result, err = relay.BridgeWS(ctx, ws, peer, opts)
 	return result, err
 }
 
@@ -2,19 +2,35 @@ package metrics
 
 import (
 	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
 	"errors"
 	"fmt"
 	"io"
 	"log/slog"
+	"math/big"
 	"net"
 	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
 	"strings"
 	"sync"
 	"testing"
 	"time"
 
+	"github.com/philsphicas/aztunnel/internal/bridgecause"
 	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	dto "github.com/prometheus/client_model/go"
+
+	"github.com/philsphicas/aztunnel/internal/relay"
 )
 
 func TestNew(t *testing.T) {
@@ -29,10 +45,17 @@ func TestNew(t *testing.T) {
 	}
 
 	// Trigger all metrics so they appear in Gather output.
+	m.SLOThreshold = time.Second
 	m.ConnectionError("test", "test")
 	m.ObserveDialDuration("test", 0.1)
 	m.ObserveTokenFetch("stub", "ok", 0.01)
-	m.SetControlChannelConnected(true)
+	m.SetControlChannelConnected("test-hyco", true)
+	m.ControlReconnect("test-hyco", "dial_failed")
+	m.SetControlReconnectDelay("test-hyco", time.Second)
+	m.HycoAccept("test-hyco")
+	m.TargetConnection(ReuseFresh)
+	m.EnvelopeVersion(1)
+	m.SenderRejection(ProxySOCKS5, SenderRejectNotAllowed)
 	tracker := m.ConnectionOpened("test", "test:22")
 	tracker.Done(1.0, 100, 200, nil)
 
@@ -47,10 +70,16 @@ func TestNew(t *testing.T) {
 		"aztunnel_bytes_total",
 		"aztunnel_active_connections",
 		"aztunnel_control_channel_connected",
+		"aztunnel_hyco_control_channel_connected",
+		"aztunnel_hyco_accepts_total",
 		"aztunnel_connection_duration_seconds",
 		"aztunnel_dial_duration_seconds",
+		"aztunnel_dial_slo_total",
 		"aztunnel_token_fetch_seconds",
 		"aztunnel_token_fetch_total",
+		"aztunnel_target_connections_total",
+		"aztunnel_envelope_version_total",
+		"aztunnel_sender_rejections_total",
 	}
 	got := make(map[string]bool)
 	for _, f := range fams {
@@ -64,6 +93,102 @@ func TestNew(t *testing.T) {
 	}
 }
 
+func TestNew_MultipleInstances(t *testing.T) {
+	a, b := New(), New()
+	if a == nil || b == nil {
+		t.Fatal("New() returned nil")
+	}
+	if a.Registry == b.Registry {
+		t.Fatal("instances share a registry")
+	}
+	a.ConnectionError("sender", ReasonDialFailed)
+	if v := getCounter(t, b.connectionErrors, "sender", ReasonDialFailed); v != 0 {
+		t.Errorf("second instance saw first instance's error count: %v", v)
+	}
+}
+
+func TestNewWithRegistry_SharedRegistry(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	// The embedder already registered the runtime collectors.
+	reg.MustRegister(collectors.NewGoCollector())
+
+	m, err := NewWithRegistry(reg)
+	if err != nil {
+		t.Fatalf("NewWithRegistry: %v", err)
+	}
+	if m.Registry != reg {
+		t.Error("Registry is not the supplied registry")
+	}
+
+	// A second instance clashes on the aztunnel collectors: it must
+	// fail with an error, not panic, and leave the first intact.
+	if _, err := NewWithRegistry(reg); err == nil {
+		t.Fatal("second NewWithRegistry on the same registry succeeded")
+	}
+	m.ConnectionError("sender", ReasonDialFailed)
+	fams, err := reg.Gather()
+	if err != nil {
+		t.Fatalf("Gather: %v", err)
+	}
+	found := false
+	for _, f := range fams {
+		if f.GetName() == "aztunnel_connection_errors_total" {
+			found = true
+		}
+	}
+	if !found {
+		t.Error("first instance's metrics missing after the failed second registration")
+	}
+}
+
+func TestNewWithLabels(t *testing.T) {
+	m, err := NewWithLabels(map[string]string{"env": "prod", "cluster": "eastus"})
+	if err != nil {
+		t.Fatalf("NewWithLabels: %v", err)
+	}
+	m.ConnectionError("listener", ReasonDialFailed)
+
+	rec := httptest.NewRecorder()
+	promhttp.HandlerFor(m.Registry, promhttp.HandlerOpts{}).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	want := `aztunnel_connection_errors_total{cluster="eastus",env="prod",reason="dial_failed",role="listener"} 1`
+	if !strings.Contains(rec.Body.String(), want) {
+		t.Errorf("scrape missing %s", want)
+	}
+}
+
+func TestNewWithLabels_InvalidName(t *testing.T) {
+	for _, name := range []string{"", "1env", "env-name", "__env", "role"} {
+		if _, err := NewWithLabels(map[string]string{name: "x"}); err == nil {
+			t.Errorf("NewWithLabels(%q) succeeded, want error", name)
+		}
+	}
+}
+
+func TestNewWithOptions_DisableRuntimeMetrics(t *testing.T) {
+	for _, disable := range []bool{false, true} {
+		m, err := NewWithOptions(Options{DisableRuntimeMetrics: disable})
+		if err != nil {
+			t.Fatalf("NewWithOptions: %v", err)
+		}
+		m.ConnectionError("listener", ReasonDialFailed)
+		fams, err := m.Registry.Gather()
+		if err != nil {
+			t.Fatalf("gather: %v", err)
+		}
+		var goSeries, own bool
+		for _, f := range fams {
+			goSeries = goSeries || f.GetName() == "go_goroutines"
+			own = own || f.GetName() == "aztunnel_connection_errors_total"
+		}
+		if goSeries == disable {
+			t.Errorf("DisableRuntimeMetrics=%v: go_goroutines present = %v", disable, goSeries)
+		}
+		if !own {
+			t.Errorf("DisableRuntimeMetrics=%v: aztunnel metrics missing", disable)
+		}
+	}
+}
+
 func TestConnectionTracker(t *testing.T) {
 	m := New()
 	tracker := m.ConnectionOpened("listener", "10.0.0.1:22")
@@ -110,6 +235,19 @@ func TestConnectionTrackerError(t *testing.T) {
 	}
 }
 
+func TestConnectionTrackerIdleTimeout(t *testing.T) {
+	m := New()
+	tracker := m.ConnectionOpened("sender", "host:80")
+	tracker.Done(1.0, 100, 200, fmt.Errorf("bridge: %w", bridgecause.CauseIdleTimeout))
+
+	if c := getCounter(t, m.connectionsTotal, "sender", "host:80", "idle_timeout"); c != 1 {
+		t.Errorf("connections_total(idle_timeout) = %v, want 1", c)
+	}
+	if c := getCounter(t, m.connectionsTotal, "sender", "host:80", "error"); c != 0 {
+		t.Errorf("connections_total(error) = %v, want 0", c)
+	}
+}
+
 func TestConnectionError(t *testing.T) {
 	m := New()
 	m.ConnectionError("listener", "dial_failed")
@@ -154,6 +292,11 @@ func TestDialReason(t *testing.T) {
 	if r := DialReason(wrappedDeadline, "relay_failed"); r != ReasonDialTimeout {
 		t.Errorf("DialReason(wrapped DeadlineExceeded) = %q, want %q", r, ReasonDialTimeout)
 	}
+	// Relay claim rejection returns auth_failed.
+	claim := fmt.Errorf("dial relay: %w", &relay.ClaimError{Action: relay.ActionConnect, StatusCode: http.StatusUnauthorized, Err: errors.New("401")})
+	if r := DialReason(claim, ReasonRelayFailed); r != ReasonAuthFailed {
+		t.Errorf("DialReason(ClaimError) = %q, want %q", r, ReasonAuthFailed)
+	}
 }
 
 func TestDialReason_DNSNotFound(t *testing.T) {
@@ -239,22 +382,170 @@ func TestObserveDialDuration(t *testing.T) {
 	t.Error("dial_duration_seconds metric not found")
 }
 
+func TestObserveDialDuration_SLOCategories(t *testing.T) {
+	m := New()
+	m.SLOThreshold = 100 * time.Millisecond
+
+	m.ObserveDialDuration("sender", 0.05) // below T
+	m.ObserveDialDuration("sender", 0.1)  // at T
+	m.ObserveDialDuration("sender", 0.25) // within 4T
+	m.ObserveDialDuration("sender", 0.4)  // at 4T
+	m.ObserveDialDuration("sender", 0.5)  // above 4T
+
+	for _, tc := range []struct {
+		category string
+		want     float64
+	}{
+		{SLOSatisfied, 2},
+		{SLOTolerating, 2},
+		{SLOFrustrated, 1},
+	} {
+		if got := getCounter(t, m.dialSLO, "sender", tc.category); got != tc.want {
+			t.Errorf("dial_slo_total{category=%q} = %v, want %v", tc.category, got, tc.want)
+		}
+	}
+}
+
+func TestObserveDialDuration_SLODisabled(t *testing.T) {
+	m := New()
+	m.ObserveDialDuration("sender", 0.05)
+
+	fams, _ := m.Registry.Gather()
+	for _, f := range fams {
+		if f.GetName() == "aztunnel_dial_slo_total" {
+			t.Errorf("dial_slo_total has %d series with SLOThreshold unset, want none", len(f.GetMetric()))
+		}
+	}
+}
+
+func TestTargetConnection(t *testing.T) {
+	m := New()
+	for range 3 {
+		m.TargetConnection(ReuseFresh)
+	}
+
+	if c := getCounter(t, m.targetConns, ReuseFresh); c != 3 {
+		t.Errorf("target_connections_total{reuse=fresh} = %v, want 3", c)
+	}
+	if c := getCounter(t, m.targetConns, ReuseReused); c != 0 {
+		t.Errorf("target_connections_total{reuse=reused} = %v, want 0", c)
+	}
+}
+
+func TestEnvelopeVersion(t *testing.T) {
+	m := New()
+	m.EnvelopeVersion(1)
+	m.EnvelopeVersion(1)
+	m.EnvelopeVersion(2)
+	m.EnvelopeVersion(-1)
+	m.EnvelopeVersion(MaxEnvelopeVersionLabel + 1)
+
+	for _, tc := range []struct {
+		version string
+		want    float64
+	}{
+		{"1", 2},
+		{"2", 1},
+		{OverflowEnvelopeVersion, 2},
+	} {
+		if c := getCounter(t, m.envelopeVersions, tc.version); c != tc.want {
+			t.Errorf("envelope_version_total{version=%q} = %v, want %v", tc.version, c, tc.want)
+		}
+	}
+}
+
+func TestSenderRejection(t *testing.T) {
+	m := New()
+	m.SenderRejection(ProxySOCKS5, SenderRejectNotAllowed)
+	m.SenderRejection(ProxySOCKS5, SenderRejectNotAllowed)
+	m.SenderRejection(ProxyHTTP, SenderRejectNotAllowed)
+
+	if c := getCounter(t, m.senderRejections, ProxySOCKS5, SenderRejectNotAllowed); c != 2 {
+		t.Errorf("sender_rejections_total{proxy=socks5,reason=not_allowed} = %v, want 2", c)
+	}
+	if c := getCounter(t, m.senderRejections, ProxyHTTP, SenderRejectNotAllowed); c != 1 {
+		t.Errorf("sender_rejections_total{proxy=http,reason=not_allowed} = %v, want 1", c)
+	}
+}
+
 func TestSetControlChannelConnected(t *testing.T) {
 	m := New()
 
-	m.SetControlChannelConnected(true)
+	m.SetControlChannelConnected("hyco-a", true)
 	v := getScalarGauge(t, m.controlChannelUp)
 	if v != 1 {
 		t.Errorf("control_channel_connected = %v, want 1", v)
 	}
 
-	m.SetControlChannelConnected(false)
+	m.SetControlChannelConnected("hyco-a", false)
 	v = getScalarGauge(t, m.controlChannelUp)
 	if v != 0 {
 		t.Errorf("control_channel_connected = %v, want 0", v)
 	}
 }
 
+func TestSetControlChannelConnected_PerHyco(t *testing.T) {
+	m := New()
+
+	m.SetControlChannelConnected("hyco-a", true)
+	m.SetControlChannelConnected("hyco-b", false)
+
+	if v := getGauge(t, m.hycoControlUp, "hyco-a"); v != 1 {
+		t.Errorf("hyco_control_channel_connected{hyco-a} = %v, want 1", v)
+	}
+	if v := getGauge(t, m.hycoControlUp, "hyco-b"); v != 0 {
+		t.Errorf("hyco_control_channel_connected{hyco-b} = %v, want 0", v)
+	}
+	if v := getScalarGauge(t, m.controlChannelUp); v != 0 {
+		t.Errorf("control_channel_connected = %v, want 0 while hyco-b is down", v)
+	}
+
+	m.SetControlChannelConnected("hyco-b", true)
+	if v := getGauge(t, m.hycoControlUp, "hyco-a"); v != 1 {
+		t.Errorf("hyco_control_channel_connected{hyco-a} = %v, want 1 after hyco-b connected", v)
+	}
+	if v := getScalarGauge(t, m.controlChannelUp); v != 1 {
+		t.Errorf("control_channel_connected = %v, want 1 with both hycos up", v)
+	}
+}
+
+func TestControlReconnect(t *testing.T) {
+	m := New()
+
+	m.ControlReconnect("hyco-a", "auth_failed")
+	m.ControlReconnect("hyco-a", "auth_failed")
+	m.ControlReconnect("hyco-a", "dial_failed")
+	m.SetControlReconnectDelay("hyco-a", 4*time.Second)
+
+	if c := getCounter(t, m.controlReconnects, "hyco-a", "auth_failed"); c != 2 {
+		t.Errorf("control_reconnects_total{auth_failed} = %v, want 2", c)
+	}
+	if c := getCounter(t, m.controlReconnects, "hyco-a", "dial_failed"); c != 1 {
+		t.Errorf("control_reconnects_total{dial_failed} = %v, want 1", c)
+	}
+	if v := getGauge(t, m.controlDelay, "hyco-a"); v != 4 {
+		t.Errorf("control_reconnect_delay_seconds = %v, want 4", v)
+	}
+
+	m.SetControlReconnectDelay("hyco-a", 0)
+	if v := getGauge(t, m.controlDelay, "hyco-a"); v != 0 {
+		t.Errorf("control_reconnect_delay_seconds = %v, want 0 once connected", v)
+	}
+}
+
+func TestHycoAccept(t *testing.T) {
+	m := New()
+	m.HycoAccept("hyco-a")
+	m.HycoAccept("hyco-a")
+	m.HycoAccept("hyco-b")
+	if c := getCounter(t, m.hycoAccepts, "hyco-a"); c != 2 {
+		t.Errorf("hyco_accepts_total{hyco-a} = %v, want 2", c)
+	}
+	if c := getCounter(t, m.hycoAccepts, "hyco-b"); c != 1 {
+		t.Errorf("hyco_accepts_total{hyco-b} = %v, want 1", c)
+	}
+}
+
 func TestMetricsEndpoint(t *testing.T) {
 	m := New()
 	m.ConnectionError("listener", "test_error")
@@ -303,6 +594,157 @@ func TestMetricsEndpoint(t *testing.T) {
 	}
 }
 
+func TestMetricsEndpoint_Token(t *testing.T) {
+	m := New()
+	m.Token = "s3cret"
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	go func() {
+		_ = m.Serve(ctx, ln, slog.New(slog.NewTextHandler(io.Discard, nil)))
+	}()
+
+	for _, tc := range []struct {
+		path, auth string
+		want       int
+	}{
+		{"/metrics", "", http.StatusUnauthorized},
+		{"/metrics", "Bearer wrong", http.StatusUnauthorized},
+		{"/metrics", "s3cret", http.StatusUnauthorized},
+		{"/metrics", "Bearer s3cret", http.StatusOK},
+		{"/healthz", "", http.StatusOK}, // probes stay open
+	} {
+		req, _ := http.NewRequest(http.MethodGet, "http://"+ln.Addr().String()+tc.path, nil)
+		if tc.auth != "" {
+			req.Header.Set("Authorization", tc.auth)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("GET %s: %v", tc.path, err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != tc.want {
+			t.Errorf("GET %s with %q = %d, want %d", tc.path, tc.auth, resp.StatusCode, tc.want)
+		}
+		if tc.want == http.StatusUnauthorized && resp.Header.Get("WWW-Authenticate") == "" {
+			t.Errorf("GET %s with %q: 401 without WWW-Authenticate", tc.path, tc.auth)
+		}
+	}
+}
+
+// writeSelfSignedCert writes a PEM certificate and key for 127.0.0.1
+// to dir and returns the certificate's pool along with the file paths.
+func writeSelfSignedCert(t *testing.T, dir string) (pool *x509.CertPool, certFile, keyFile string) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "aztunnel-metrics-test"},
+		NotBefore:    time.Now().Add(-time.Minute),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certFile, keyFile = filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	pool = x509.NewCertPool()
+	pool.AddCert(cert)
+	return pool, certFile, keyFile
+}
+
+func TestMetricsEndpoint_TLS(t *testing.T) {
+	pool, certFile, keyFile := writeSelfSignedCert(t, t.TempDir())
+	m := New()
+	m.TLSCertFile, m.TLSKeyFile = certFile, keyFile
+	m.ConnectionError("listener", ReasonDialFailed)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	go func() {
+		_ = m.Serve(ctx, ln, slog.New(slog.NewTextHandler(io.Discard, nil)))
+	}()
+
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool, MinVersion: tls.VersionTLS12}}}
+	resp, err := client.Get("https://" + ln.Addr().String() + "/metrics")
+	if err != nil {
+		t.Fatalf("GET https /metrics: %v", err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || !strings.Contains(string(body), "aztunnel_connection_errors_total") {
+		t.Errorf("https scrape = %d, body missing aztunnel metrics:\n%.200s", resp.StatusCode, body)
+	}
+
+	// Plain HTTP to the TLS port gets the server's 400, not metrics.
+	resp, err = http.Get("http://" + ln.Addr().String() + "/metrics")
+	if err != nil {
+		t.Fatalf("GET http /metrics: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("plain http scrape = %d, want 400", resp.StatusCode)
+	}
+}
+
+func TestPprofEndpoints(t *testing.T) {
+	for _, enabled := range []bool{false, true} {
+		m := New()
+		m.Pprof = enabled
+		ctx, cancel := context.WithCancel(context.Background())
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			cancel()
+			t.Fatalf("listen: %v", err)
+		}
+		go func() {
+			_ = m.Serve(ctx, ln, slog.New(slog.NewTextHandler(io.Discard, nil)))
+		}()
+
+		resp, err := http.Get("http://" + ln.Addr().String() + "/debug/pprof/goroutine?debug=1")
+		if err != nil {
+			cancel()
+			t.Fatalf("Pprof=%v: GET /debug/pprof/goroutine: %v", enabled, err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		cancel()
+
+		want := http.StatusNotFound
+		if enabled {
+			want = http.StatusOK
+		}
+		if resp.StatusCode != want {
+			t.Errorf("Pprof=%v: status = %d, want %d", enabled, resp.StatusCode, want)
+		}
+		if enabled && !strings.Contains(string(body), "goroutine profile") {
+			t.Errorf("Pprof=%v: body is not a goroutine profile: %.200s", enabled, body)
+		}
+	}
+}
+
 func TestMetricsIntegration_BridgeFlow(t *testing.T) {
 	// This test verifies the full metrics flow:
 	// WebSocket echo server → Bridge → ConnectionTracker → /metrics endpoint
@@ -368,6 +810,55 @@ func TestMetricsIntegration_BridgeFlow(t *testing.T) {
 	}
 }
 
+func TestDetailedLabels(t *testing.T) {
+	m := New()
+	m.MaxTargets = 2
+	m.DetailedLabels = true
+
+	open := func(local, relayHost string) *ConnectionTracker {
+		t.Helper()
+		ctx := WithConnLabels(context.Background(), ConnLabels{LocalAddr: local, RelayHost: relayHost})
+		return m.connectionOpened("sender", "host:22", connLabelsFrom(ctx))
+	}
+	a := open("127.0.0.1:2222", "ns1.servicebus.windows.net")
+	b := open("127.0.0.1:3333", "ns2.servicebus.windows.net")
+	c := open("127.0.0.1:4444", "ns3.servicebus.windows.net")
+
+	if g := getGauge(t, m.activeDetailed, "sender", "host:22", "127.0.0.1:2222", "ns1.servicebus.windows.net"); g != 1 {
+		t.Errorf("active_connections_detailed{2222,ns1} = %v, want 1", g)
+	}
+	if g := getGauge(t, m.activeDetailed, "sender", "host:22", "127.0.0.1:3333", "ns2.servicebus.windows.net"); g != 1 {
+		t.Errorf("active_connections_detailed{3333,ns2} = %v, want 1", g)
+	}
+	// The third distinct value of each label is past the cap.
+	if g := getGauge(t, m.activeDetailed, "sender", "host:22", OverflowTarget, OverflowTarget); g != 1 {
+		t.Errorf("active_connections_detailed{overflow} = %v, want 1", g)
+	}
+
+	for _, tr := range []*ConnectionTracker{a, b, c} {
+		tr.Done(1.0, 0, 0, nil)
+	}
+	if g := getGauge(t, m.activeDetailed, "sender", "host:22", OverflowTarget, OverflowTarget); g != 0 {
+		t.Errorf("active_connections_detailed{overflow} after Done = %v, want 0", g)
+	}
+}
+
+func TestDetailedLabels_Off(t *testing.T) {
+	m := New()
+	ctx := WithConnLabels(context.Background(), ConnLabels{LocalAddr: "127.0.0.1:2222", RelayHost: "ns.servicebus.windows.net"})
+	m.connectionOpened("sender", "host:22", connLabelsFrom(ctx)).Done(1.0, 0, 0, nil)
+
+	fams, err := m.Registry.Gather()
+	if err != nil {
+		t.Fatalf("gather: %v", err)
+	}
+	for _, f := range fams {
+		if f.GetName() == "aztunnel_active_connections_detailed" {
+			t.Errorf("detailed gauge has %d series with DetailedLabels off, want none", len(f.GetMetric()))
+		}
+	}
+}
+
 func TestSanitizeTarget_UnderCap(t *testing.T) {
 	m := New()
 	m.MaxTargets = 3
@@ -493,7 +984,16 @@ func TestNilMetrics(t *testing.T) {
 	m.ConnectionError("sender", ReasonDialFailed)
 	m.ObserveDialDuration("sender", 0.1)
 	m.ObserveTokenFetch("entra", "ok", 0.1)
-	m.SetControlChannelConnected(true)
+	m.SetControlChannelConnected("test-hyco", true)
+	m.ControlReconnect("test-hyco", "dial_failed")
+	m.SetControlReconnectDelay("test-hyco", time.Second)
+	m.HycoAccept("test-hyco")
+	m.TargetConnection(ReuseFresh)
+	m.EnvelopeVersion(1)
+	m.SenderRejection(ProxySOCKS5, SenderRejectNotAllowed)
+	if !m.ControlReady() {
+		t.Error("ControlReady on nil should report ready")
+	}
 
 	// Calling Done on a nil *ConnectionTracker must not panic.
 	var nilTracker *ConnectionTracker
@@ -0,0 +1,79 @@
+package metrics
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/url"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/push"
+)
+
+// Pusher pushes a Metrics registry to a Prometheus Pushgateway, for
+// short-lived commands (one-shot connect, CI jobs) that exit before a
+// scraper would see them.
+//
+// Pushed series carry only the registry's own labels (role, target,
+// reason, ...) plus the job grouping label; credentials in the
+// gateway URL are sent as HTTP basic auth and never appear in the
+// pushed URL, labels, or returned errors.
+type Pusher struct {
+	pusher *push.Pusher
+	addr   string // gateway URL with any userinfo redacted
+}
+
+// NewPusher returns a Pusher that sends m's registry to the gateway at
+// rawURL under job. rawURL must be an http or https URL; a user:password
+// in it is moved to basic auth.
+func (m *Metrics) NewPusher(rawURL, job string) (*Pusher, error) {
+	if job == "" {
+		return nil, fmt.Errorf("metrics push job must not be empty")
+	}
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("metrics push url: %w", err)
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("metrics push url %q: want http:// or https://host", u.Redacted())
+	}
+	addr := u.Redacted()
+	user := u.User
+	u.User = nil
+	p := push.New(u.String(), job).Gatherer(m.Registry)
+	if user != nil {
+		pass, _ := user.Password()
+		p = p.BasicAuth(user.Username(), pass)
+	}
+	return &Pusher{pusher: p, addr: addr}, nil
+}
+
+// Push sends the current registry contents, replacing any metrics
+// previously pushed under the same job.
+func (p *Pusher) Push(ctx context.Context) error {
+	if err := p.pusher.PushContext(ctx); err != nil {
+		return fmt.Errorf("metrics push to %s: %w", p.addr, err)
+	}
+	return nil
+}
+
+// Run pushes every interval until ctx is cancelled. Failures are
+// logged and retried on the next tick. The final push on shutdown is
+// the caller's job (see Push), since ctx is already done by then.
+func (p *Pusher) Run(ctx context.Context, interval time.Duration, logger *slog.Logger) {
+	if logger == nil {
+		logger = slog.Default()
+	}
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			if err := p.Push(ctx); err != nil && ctx.Err() == nil {
+				logger.Warn("metrics push failed", "error", err)
+			}
+		}
+	}
+}
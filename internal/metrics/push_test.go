@@ -0,0 +1,117 @@
+package metrics
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+type pushRequest struct {
+	method, path, user, pass, body string
+}
+
+// stubPushgateway records every push it receives.
+func stubPushgateway(t *testing.T) (*httptest.Server, <-chan pushRequest) {
+	t.Helper()
+	reqs := make(chan pushRequest, 16)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		user, pass, _ := r.BasicAuth()
+		reqs <- pushRequest{r.Method, r.URL.Path, user, pass, string(body)}
+		w.WriteHeader(http.StatusOK)
+	}))
+	t.Cleanup(srv.Close)
+	return srv, reqs
+}
+
+func TestPusher_Push(t *testing.T) {
+	srv, reqs := stubPushgateway(t)
+	m := New()
+	m.ConnectionError("sender", ReasonRelayFailed)
+
+	u := strings.Replace(srv.URL, "http://", "http://ci:pgw-secret@", 1)
+	p, err := m.NewPusher(u, "nightly-connect")
+	if err != nil {
+		t.Fatalf("NewPusher: %v", err)
+	}
+	if err := p.Push(context.Background()); err != nil {
+		t.Fatalf("Push: %v", err)
+	}
+
+	req := <-reqs
+	if req.method != http.MethodPut {
+		t.Errorf("method = %s, want PUT", req.method)
+	}
+	if req.path != "/metrics/job/nightly-connect" {
+		t.Errorf("path = %q, want /metrics/job/nightly-connect", req.path)
+	}
+	if req.user != "ci" || req.pass != "pgw-secret" {
+		t.Errorf("basic auth = %q:%q, want ci:pgw-secret", req.user, req.pass)
+	}
+	if !strings.Contains(req.body, "aztunnel_connection_errors_total") {
+		t.Error("push body missing aztunnel_connection_errors_total")
+	}
+	if strings.Contains(req.body, "pgw-secret") {
+		t.Error("push body contains the gateway password")
+	}
+}
+
+func TestPusher_ErrorRedactsPassword(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		http.Error(w, "nope", http.StatusBadGateway)
+	}))
+	defer srv.Close()
+
+	u := strings.Replace(srv.URL, "http://", "http://ci:pgw-secret@", 1)
+	p, err := New().NewPusher(u, "job")
+	if err != nil {
+		t.Fatalf("NewPusher: %v", err)
+	}
+	err = p.Push(context.Background())
+	if err == nil {
+		t.Fatal("Push succeeded against a failing gateway")
+	}
+	if strings.Contains(err.Error(), "pgw-secret") {
+		t.Errorf("error leaked the gateway password: %v", err)
+	}
+}
+
+func TestNewPusher_RejectsBadInput(t *testing.T) {
+	m := New()
+	for _, tc := range []struct{ url, job string }{
+		{"http://pgw:9091", ""},
+		{"pgw:9091", "job"},
+		{"ftp://pgw:9091", "job"},
+	} {
+		if _, err := m.NewPusher(tc.url, tc.job); err == nil {
+			t.Errorf("NewPusher(%q, %q) succeeded, want error", tc.url, tc.job)
+		}
+	}
+}
+
+func TestPusher_RunPushesPeriodically(t *testing.T) {
+	srv, reqs := stubPushgateway(t)
+	p, err := New().NewPusher(srv.URL, "job")
+	if err != nil {
+		t.Fatalf("NewPusher: %v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		p.Run(ctx, 20*time.Millisecond, nil)
+	}()
+	for range 2 {
+		select {
+		case <-reqs:
+		case <-time.After(2 * time.Second):
+			t.Fatal("periodic push did not arrive")
+		}
+	}
+	cancel()
+	<-done
+}
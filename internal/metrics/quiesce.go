@@ -0,0 +1,55 @@
+package metrics
+
+import (
+	"net/http"
+	"sync/atomic"
+)
+
+// quiesceState is the operator pause toggled through POST /quiesce and
+// POST /resume. enabled is set by a relay-listener, the only command
+// that honours the toggle; elsewhere the endpoints answer 404.
+type quiesceState struct {
+	enabled atomic.Bool
+	on      atomic.Bool
+}
+
+// EnableQuiesce makes the /quiesce and /resume admin endpoints
+// available. A relay-listener calls it at startup and checks Quiesced
+// for every new envelope. Safe to call on a nil receiver.
+func (m *Metrics) EnableQuiesce() {
+	if m == nil {
+		return
+	}
+	m.quiesce.enabled.Store(true)
+}
+
+// SetQuiesced pauses (true) or resumes (false) acceptance of new
+// connections. Bridges already running are unaffected. Safe to call on
+// a nil receiver.
+func (m *Metrics) SetQuiesced(on bool) {
+	if m == nil {
+		return
+	}
+	m.quiesce.on.Store(on)
+	m.quiescedGauge.Set(boolGauge(on))
+}
+
+// Quiesced reports whether new connections should be rejected. A nil
+// receiver is never quiesced.
+func (m *Metrics) Quiesced() bool {
+	return m != nil && m.quiesce.on.Load()
+}
+
+// handleQuiesce serves POST /quiesce (on) and POST /resume (off).
+// Serve registers it behind the same bearer token as the
+// /connections close endpoint; a request without it never gets here.
+func (m *Metrics) handleQuiesce(on bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, _ *http.Request) {
+		if !m.quiesce.enabled.Load() {
+			http.Error(w, "quiesce is only supported by relay-listener", http.StatusNotFound)
+			return
+		}
+		m.SetQuiesced(on)
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
@@ -2,27 +2,90 @@ package metrics
 
 import (
 	"context"
+	"crypto/subtle"
+	"crypto/tls"
 	"errors"
 	"log/slog"
 	"net"
 	"net/http"
+	"net/http/pprof"
+	"slices"
 	"time"
 
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
 // Serve starts an HTTP server on the provided listener that exposes
-// Prometheus metrics at /metrics. It blocks until the context is cancelled,
-// then shuts down gracefully.
+// Prometheus metrics at /metrics, /healthz and /readyz probes (see
+// ControlReady), and, when Admin is set, the
+// /connections, /quiesce, and /resume admin endpoints, and when Pprof
+// is set, /debug/pprof/. When Token is set, all but the probes require
+// it as a bearer token; Admin without Token is an error. When
+// TLSCertFile and TLSKeyFile are set, it
+// serves HTTPS. While it runs, it also samples
+// aztunnel_throughput_bytes_per_second. It blocks until the context is
+// cancelled, then shuts down gracefully.
 func (m *Metrics) Serve(ctx context.Context, ln net.Listener, logger *slog.Logger) error {
-	if logger == nil {
-		logger = slog.Default()
+	if m.Admin && m.Token == "" {
+		_ = ln.Close()
+		return errAdminWithoutToken
 	}
 	mux := http.NewServeMux()
 	mux.Handle("/metrics", promhttp.HandlerFor(m.Registry, promhttp.HandlerOpts{}))
+	mux.HandleFunc("/healthz", handleHealthz)
+	mux.HandleFunc("/readyz", handleReadyz(m.ControlReady))
+	if m.Admin {
+		mux.HandleFunc("GET /connections", m.handleConnections)
+		mux.HandleFunc("POST /connections/{id}/close", m.handleCloseConnection)
+		mux.HandleFunc("POST /quiesce", m.handleQuiesce(true))
+		mux.HandleFunc("POST /resume", m.handleQuiesce(false))
+	}
+	if m.Pprof {
+		// Registered by hand: importing net/http/pprof only adds
+		// these to http.DefaultServeMux, which is never served.
+		mux.HandleFunc("/debug/pprof/", pprof.Index)
+		mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+		mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+		mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+		mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	}
+	var handler http.Handler = mux
+	if m.Token != "" {
+		handler = requireBearer(m.Token, mux, "/healthz", "/readyz")
+	}
+	go m.sampleThroughput(ctx, throughputInterval)
+	return serveHTTP(ctx, ln, handler, m.TLSCertFile, m.TLSKeyFile, logger, "metrics server listening")
+}
+
+// errAdminWithoutToken is returned by Serve for Admin without Token.
+var errAdminWithoutToken = errors.New("metrics admin endpoints require a bearer token")
 
+// requireBearer wraps h so that requests for any path but the open
+// ones answer 401 unless they carry "Authorization: Bearer <token>".
+// The comparison is constant-time so response timing does not leak
+// the token.
+func requireBearer(token string, h http.Handler, open ...string) http.Handler {
+	want := []byte("Bearer " + token)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !slices.Contains(open, r.URL.Path) &&
+			subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), want) != 1 {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="aztunnel"`)
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// serveHTTP runs handler on ln until ctx is cancelled, then shuts the
+// server down gracefully. With certFile and keyFile it serves HTTPS.
+// msg is logged at INFO once the server starts.
+func serveHTTP(ctx context.Context, ln net.Listener, handler http.Handler, certFile, keyFile string, logger *slog.Logger, msg string) error {
+	if logger == nil {
+		logger = slog.Default()
+	}
 	srv := &http.Server{
-		Handler:           mux,
+		Handler:           handler,
 		ReadHeaderTimeout: 10 * time.Second,
 		ReadTimeout:       10 * time.Second,
 		WriteTimeout:      10 * time.Second,
@@ -38,8 +101,15 @@ func (m *Metrics) Serve(ctx context.Context, ln net.Listener, logger *slog.Logge
 		close(shutdownDone)
 	}()
 
-	logger.Info("metrics server listening", "addr", ln.Addr())
-	if err := srv.Serve(ln); !errors.Is(err, http.ErrServerClosed) {
+	logger.Info(msg, "addr", ln.Addr(), "tls", certFile != "")
+	var err error
+	if certFile != "" {
+		srv.TLSConfig = &tls.Config{MinVersion: tls.VersionTLS12}
+		err = srv.ServeTLS(ln, certFile, keyFile)
+	} else {
+		err = srv.Serve(ln)
+	}
+	if !errors.Is(err, http.ErrServerClosed) {
 		return err
 	}
 	// Wait for graceful shutdown only if it was triggered by ctx cancellation.
@@ -0,0 +1,74 @@
+package metrics
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// throughputInterval is how often Serve samples the byte totals behind
+// aztunnel_throughput_bytes_per_second.
+const throughputInterval = 10 * time.Second
+
+// byteTotals is the per-role byte count the throughput sampler reads.
+// aztunnel_bytes_total has a series per target and direction; summing
+// it back up on every tick would cost a Collect, so Done feeds this
+// aggregate alongside it.
+type byteTotals struct {
+	mu    sync.Mutex
+	total map[string]int64 // role -> bytes in both directions
+	last  map[string]int64 // total as of the previous sample
+}
+
+func (b *byteTotals) add(role string, n int64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.total == nil {
+		b.total = make(map[string]int64)
+	}
+	b.total[role] += n
+}
+
+// deltas returns the bytes each role has moved since the previous call.
+// A role seen before but idle since reports zero.
+func (b *byteTotals) deltas() map[string]int64 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.last == nil {
+		b.last = make(map[string]int64)
+	}
+	out := make(map[string]int64, len(b.total))
+	for role, n := range b.total {
+		out[role] = n - b.last[role]
+		b.last[role] = n
+	}
+	return out
+}
+
+// sampleThroughput sets aztunnel_throughput_bytes_per_second every
+// interval until ctx is done.
+func (m *Metrics) sampleThroughput(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	last := time.Now()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			m.recordThroughput(now.Sub(last))
+			last = now
+		}
+	}
+}
+
+// recordThroughput sets each role's gauge to the bytes moved since the
+// previous sample divided by elapsed.
+func (m *Metrics) recordThroughput(elapsed time.Duration) {
+	if elapsed <= 0 {
+		return
+	}
+	for role, n := range m.bytes.deltas() {
+		m.throughput.WithLabelValues(role).Set(float64(n) / elapsed.Seconds())
+	}
+}
@@ -0,0 +1,53 @@
+package metrics
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestRecordThroughput(t *testing.T) {
+	m := New()
+	m.ConnectionOpened("sender", "10.0.0.5:22").Done(1, 3000, 7000, nil)
+	m.ConnectionOpened("listener", "10.0.0.5:22").Done(1, 500, 500, nil)
+
+	m.recordThroughput(10 * time.Second)
+	if got := getGauge(t, m.throughput, "sender"); got != 1000 {
+		t.Errorf("sender throughput = %v, want 1000", got)
+	}
+	if got := getGauge(t, m.throughput, "listener"); got != 100 {
+		t.Errorf("listener throughput = %v, want 100", got)
+	}
+
+	// Only bytes since the previous sample count; an idle role drops
+	// to zero.
+	m.ConnectionOpened("sender", "10.0.0.6:22").Done(1, 200, 0, nil)
+	m.recordThroughput(time.Second)
+	if got := getGauge(t, m.throughput, "sender"); got != 200 {
+		t.Errorf("sender throughput = %v, want 200", got)
+	}
+	if got := getGauge(t, m.throughput, "listener"); got != 0 {
+		t.Errorf("idle listener throughput = %v, want 0", got)
+	}
+}
+
+func TestSampleThroughput_StopsOnCancel(t *testing.T) {
+	m := New()
+	m.ConnectionOpened("sender", "10.0.0.5:22").Done(1, 100, 100, nil)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		m.sampleThroughput(ctx, 5*time.Millisecond)
+	}()
+	deadline := time.Now().Add(5 * time.Second)
+	for getGauge(t, m.throughput, "sender") == 0 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("sampler did not stop after cancel")
+	}
+}
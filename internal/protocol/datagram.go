@@ -0,0 +1,37 @@
+package protocol
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+// MaxDatagramFrame is the largest ModeUDP frame: the address length
+// prefix, the longest host:port (a 253-byte name and ":65535"), and
+// the largest UDP payload. Peers raise their WebSocket read limit to
+// this for a UDP session.
+const MaxDatagramFrame = 2 + 259 + 65535
+
+// ErrShortDatagram reports a ModeUDP frame too short for the address
+// its length prefix announces.
+var ErrShortDatagram = errors.New("short datagram frame")
+
+// AppendDatagram appends a ModeUDP frame to b: addr's length as a
+// big-endian uint16, addr itself (a host:port), then payload.
+func AppendDatagram(b []byte, addr string, payload []byte) []byte {
+	b = binary.BigEndian.AppendUint16(b, uint16(len(addr)))
+	b = append(b, addr...)
+	return append(b, payload...)
+}
+
+// ParseDatagram splits a ModeUDP frame built by AppendDatagram into
+// its address and payload. payload aliases frame.
+func ParseDatagram(frame []byte) (addr string, payload []byte, err error) {
+	if len(frame) < 2 {
+		return "", nil, ErrShortDatagram
+	}
+	n := int(binary.BigEndian.Uint16(frame))
+	if len(frame) < 2+n {
+		return "", nil, ErrShortDatagram
+	}
+	return string(frame[2 : 2+n]), frame[2+n:], nil
+}
@@ -0,0 +1,32 @@
+package protocol
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+func TestDatagramRoundTrip(t *testing.T) {
+	for _, tc := range []struct{ addr, payload string }{
+		{"10.0.0.53:53", "query"},
+		{"[2001:db8::1]:443", ""},
+		{"dns.internal:53", "\x00\x01binary"},
+	} {
+		frame := AppendDatagram(nil, tc.addr, []byte(tc.payload))
+		addr, payload, err := ParseDatagram(frame)
+		if err != nil {
+			t.Fatalf("ParseDatagram(%q): %v", tc.addr, err)
+		}
+		if addr != tc.addr || !bytes.Equal(payload, []byte(tc.payload)) {
+			t.Errorf("round trip = %q %q, want %q %q", addr, payload, tc.addr, tc.payload)
+		}
+	}
+}
+
+func TestParseDatagram_Short(t *testing.T) {
+	for _, frame := range [][]byte{nil, {0}, {0, 5, 'a', 'b'}} {
+		if _, _, err := ParseDatagram(frame); !errors.Is(err, ErrShortDatagram) {
+			t.Errorf("ParseDatagram(%v) err = %v, want ErrShortDatagram", frame, err)
+		}
+	}
+}
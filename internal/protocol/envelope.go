@@ -5,6 +5,8 @@
 // raw binary WebSocket frames for data.
 package protocol
 
+import "slices"
+
 // ConnectEnvelope is sent by the relay-sender to the relay-listener
 // immediately after the rendezvous WebSocket is established.
 type ConnectEnvelope struct {
@@ -12,8 +14,18 @@ type ConnectEnvelope struct {
 	Version int `json:"version"`
 
 	// Target is the host:port the sender wants the listener to dial.
+	// Empty for ModeBind, ModeUDP and ModeMux.
 	Target string `json:"target"`
 
+	// Mode selects what the listener does with the envelope: empty or
+	// ModeConnect dials Target, ModeBind listens on BindAddr, ModeUDP
+	// relays datagrams, ModeMux carries many connections.
+	Mode string `json:"mode,omitempty"`
+
+	// BindAddr is the host:port the listener listens on for ModeBind
+	// (port 0 picks a free port). Unused in other modes.
+	BindAddr string `json:"bind_addr,omitempty"`
+
 	// Metadata carries extensible key-value pairs for future use
 	// (auth tokens, compression negotiation, trace IDs, etc.).
 	Metadata map[string]string `json:"metadata,omitempty"`
@@ -25,6 +37,12 @@ type ConnectEnvelope struct {
 	// means a sender on a pre-P5 version. The format is unspecified
 	// (callers should not parse).
 	BridgeID string `json:"bridge_id,omitempty"`
+
+	// Capabilities lists optional protocol features the sender
+	// supports (e.g. CapPipelining). A feature is in effect only when
+	// the listener echoes it in ConnectResponse.Capabilities; older
+	// peers ignore the field.
+	Capabilities []string `json:"capabilities,omitempty"`
 }
 
 // ConnectResponse is sent by the relay-listener back to the relay-sender
@@ -53,6 +71,121 @@ type ConnectResponse struct {
 	// mixed-version senders ignore the field. Format is unspecified
 	// (currently 16 base32 chars from [A-Z2-7]; do not parse).
 	ListenerID string `json:"listener_id,omitempty"`
+
+	// Capabilities lists the subset of the envelope's Capabilities the
+	// listener agreed to for this connection. Only set when OK is true.
+	Capabilities []string `json:"capabilities,omitempty"`
+
+	// BoundAddr is the address the listener is listening on, in the
+	// first ModeBind response.
+	BoundAddr string `json:"bound_addr,omitempty"`
+
+	// PeerAddr is the remote address of the inbound connection, in the
+	// second ModeBind response.
+	PeerAddr string `json:"peer_addr,omitempty"`
+
+	// LocalAddr is the listener's own address (ip:port) on the target
+	// connection, in a ModeConnect OK response: the address the target
+	// sees the connection come from, which a SOCKS5 sender reports as
+	// BND.ADDR and BND.PORT. Empty in echo mode and from older
+	// listeners.
+	LocalAddr string `json:"local_addr,omitempty"`
+
+	// Metadata answers negotiation keys from the envelope's Metadata
+	// (e.g. MetaCompression). Only set when OK is true; older
+	// listeners never set it.
+	Metadata map[string]string `json:"metadata,omitempty"`
+}
+
+// Envelope modes carried in ConnectEnvelope.Mode.
+const (
+	// ModeConnect asks the listener to dial Target. It is the default
+	// when Mode is empty.
+	ModeConnect = "connect"
+
+	// ModeBind asks the listener to listen on BindAddr and relay the
+	// first inbound connection back, like SOCKS5 BIND. The listener
+	// answers twice: once with BoundAddr when the socket is listening,
+	// and again with PeerAddr when a connection arrives (or OK=false
+	// if none does within the listener's connect timeout). Data frames
+	// follow the second response. Bind envelopes leave Target empty,
+	// so listeners that predate ModeBind reject them as missing a
+	// target instead of dialing anything.
+	ModeBind = "bind"
+
+	// ModeUDP turns the session into a UDP association, like SOCKS5
+	// UDP ASSOCIATE. After an OK response each binary message in
+	// either direction is one datagram framed by AppendDatagram: the
+	// sender names each datagram's destination, and the listener
+	// names the source of each reply. Text messages are not used. UDP
+	// envelopes leave Target empty, so listeners that predate ModeUDP
+	// reject them as missing a target.
+	ModeUDP = "udp"
+
+	// ModeMux turns the session into a multiplexed tunnel: after an
+	// OK response every binary message in either direction is a mux
+	// frame (see AppendMuxFrame), and the sender opens one stream per
+	// connection with MuxOpen instead of dialing a rendezvous for it.
+	// Mux envelopes leave Target empty, so listeners that predate
+	// ModeMux reject them as missing a target or with an unknown
+	// mode, and the sender falls back to a rendezvous per connection.
+	ModeMux = "mux"
+)
+
+// CapPipelining lets one rendezvous WebSocket carry a sequence of
+// connections. Each connection ends when both sides have sent an
+// end-of-stream marker (a text message, see EndOfStream) after its
+// binary data; the sender may then send the next ConnectEnvelope on
+// the same WebSocket. Connections are sequential, never concurrent.
+const CapPipelining = "pipelining"
+
+// CapHalfClose lets one direction of a connection finish while the
+// other keeps flowing. A side whose local end reaches EOF sends an
+// end-of-stream marker (see EndOfStream) instead of closing the
+// WebSocket; the receiver half-closes its local end and keeps copying
+// the other way. The WebSocket closes once both directions have ended.
+// Pipelining already implies this, so a listener agreeing to
+// CapPipelining ignores CapHalfClose.
+const CapHalfClose = "half_close"
+
+// MetaCompression is the Metadata key for WebSocket compression. A
+// sender that offered permessage-deflate on its relay dial sets it to
+// CompressionDeflate in the envelope; the listener echoes the same
+// value in ConnectResponse.Metadata when its own rendezvous WebSocket
+// negotiated permessage-deflate too. Compression is negotiated per
+// WebSocket handshake, so the exchange reports what each side's hop
+// agreed rather than switching compression on.
+const MetaCompression = "compression"
+
+// MetaTraceparent is the Metadata key carrying the sender span's W3C
+// traceparent (https://www.w3.org/TR/trace-context/), so the
+// listener's span joins the sender's trace. It is set only when the
+// sender has tracing enabled; listeners without it ignore the key.
+const MetaTraceparent = "traceparent"
+
+// MetaClientAddr is the Metadata key carrying the address ("ip:port")
+// of the local client the sender accepted. The listener logs it with
+// each connection and, with --proxy-protocol, passes it on to the
+// target. Senders set it only for TCP clients.
+// The sender asserts it, so it is only as trustworthy as the senders
+// holding the relay's Send right.
+const MetaClientAddr = "client_addr"
+
+// CompressionDeflate is the MetaCompression value for
+// permessage-deflate (RFC 7692).
+const CompressionDeflate = "deflate"
+
+// EndOfStream is the body of the text message that ends one pipelined
+// connection in one direction. Data frames are always binary, so any
+// text message inside a pipelined connection is treated as this marker.
+// A CapHalfClose connection uses the same marker.
+type EndOfStream struct {
+	EOS bool `json:"eos"`
+}
+
+// HasCapability reports whether caps contains c.
+func HasCapability(caps []string, c string) bool {
+	return slices.Contains(caps, c)
 }
 
 // CurrentVersion is the current protocol version.
@@ -90,4 +223,45 @@ const (
 	// Distinct from CodeTimeout because the failure happened before any SYN was
 	// sent; the underlying network may be fine.
 	CodeDNSTimeout = "dns_timeout"
+
+	// CodeEnvelopeTooLarge indicates the envelope's Metadata exceeded a
+	// key length, value length, or total size limit. See MetadataLimits.
+	CodeEnvelopeTooLarge = "envelope_too_large"
+
+	// CodeTooManyMetadata indicates the envelope carried more Metadata
+	// entries than the listener accepts. See MetadataLimits.
+	CodeTooManyMetadata = "too_many_metadata"
+
+	// CodeNotAllowed indicates the listener's allowlist refused the
+	// target or bind address.
+	CodeNotAllowed = "not_allowed"
+
+	// CodeQuiescing indicates the listener is paused for maintenance
+	// and rejects new connections; retrying later or through another
+	// listener may succeed.
+	CodeQuiescing = "quiescing"
+
+	// CodeAtCapacity indicates the listener is already serving its
+	// maximum number of connections; retrying later may succeed.
+	CodeAtCapacity = "at_capacity"
+
+	// CodeInvalidTarget indicates the envelope named no target (or
+	// bind address), or one that is not host:port.
+	CodeInvalidTarget = "invalid_target"
+
+	// CodeInvalidEnvelope indicates the listener could not use the
+	// envelope at all: malformed JSON, an unsupported protocol
+	// version, or an unknown mode.
+	CodeInvalidEnvelope = "invalid_envelope"
+
+	// CodeUnknownRoute indicates the target named a route (see
+	// RoutePrefix) the listener's alias table does not have.
+	CodeUnknownRoute = "unknown_route"
 )
+
+// RoutePrefix marks a Target that names one of the listener's routes,
+// "route:<name>", rather than an address. The listener looks the name
+// up in its alias table and refuses the connection with
+// CodeUnknownRoute if it is not there, instead of treating the target
+// as an address.
+const RoutePrefix = "route:"
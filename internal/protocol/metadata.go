@@ -0,0 +1,81 @@
+package protocol
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// MetadataLimits bounds ConnectEnvelope.Metadata so a buggy or
+// malicious sender cannot make the listener hold an arbitrarily large
+// map. A zero field selects the matching DefaultMetadataLimits value.
+type MetadataLimits struct {
+	MaxEntries   int // number of keys
+	MaxKeyLen    int // bytes per key
+	MaxValueLen  int // bytes per value
+	MaxTotalSize int // bytes of the JSON-encoded map
+}
+
+// DefaultMetadataLimits are generous for trace IDs and negotiation
+// flags while keeping the map far below the WebSocket read limit.
+var DefaultMetadataLimits = MetadataLimits{
+	MaxEntries:   32,
+	MaxKeyLen:    128,
+	MaxValueLen:  1024,
+	MaxTotalSize: 8 << 10,
+}
+
+// WithDefaults returns l with zero fields replaced by
+// DefaultMetadataLimits.
+func (l MetadataLimits) WithDefaults() MetadataLimits {
+	if l.MaxEntries <= 0 {
+		l.MaxEntries = DefaultMetadataLimits.MaxEntries
+	}
+	if l.MaxKeyLen <= 0 {
+		l.MaxKeyLen = DefaultMetadataLimits.MaxKeyLen
+	}
+	if l.MaxValueLen <= 0 {
+		l.MaxValueLen = DefaultMetadataLimits.MaxValueLen
+	}
+	if l.MaxTotalSize <= 0 {
+		l.MaxTotalSize = DefaultMetadataLimits.MaxTotalSize
+	}
+	return l
+}
+
+// MetadataError reports a Metadata limit violation. Code is
+// CodeTooManyMetadata or CodeEnvelopeTooLarge and is suitable for
+// ConnectResponse.Code.
+type MetadataError struct {
+	Code   string
+	Detail string
+}
+
+func (e *MetadataError) Error() string {
+	return fmt.Sprintf("%s: %s", e.Code, e.Detail)
+}
+
+// ValidateMetadata checks e.Metadata against l (after WithDefaults)
+// and returns a *MetadataError for the first limit exceeded. Keys and
+// values are reported by length only, never by content.
+func (e ConnectEnvelope) ValidateMetadata(l MetadataLimits) error {
+	if len(e.Metadata) == 0 {
+		return nil
+	}
+	l = l.WithDefaults()
+	if n := len(e.Metadata); n > l.MaxEntries {
+		return &MetadataError{Code: CodeTooManyMetadata, Detail: fmt.Sprintf("%d metadata entries, limit %d", n, l.MaxEntries)}
+	}
+	for k, v := range e.Metadata {
+		if len(k) > l.MaxKeyLen {
+			return &MetadataError{Code: CodeEnvelopeTooLarge, Detail: fmt.Sprintf("metadata key of %d bytes, limit %d", len(k), l.MaxKeyLen)}
+		}
+		if len(v) > l.MaxValueLen {
+			return &MetadataError{Code: CodeEnvelopeTooLarge, Detail: fmt.Sprintf("metadata value of %d bytes, limit %d", len(v), l.MaxValueLen)}
+		}
+	}
+	data, _ := json.Marshal(e.Metadata) // map[string]string, cannot fail
+	if len(data) > l.MaxTotalSize {
+		return &MetadataError{Code: CodeEnvelopeTooLarge, Detail: fmt.Sprintf("metadata of %d bytes, limit %d", len(data), l.MaxTotalSize)}
+	}
+	return nil
+}
@@ -0,0 +1,65 @@
+package protocol
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestValidateMetadata(t *testing.T) {
+	many := make(map[string]string)
+	for i := range DefaultMetadataLimits.MaxEntries + 1 {
+		many["k"+strconv.Itoa(i)] = "v"
+	}
+	bulky := make(map[string]string)
+	for i := range 4 {
+		bulky["k"+strconv.Itoa(i)] = strings.Repeat("x", 900)
+	}
+
+	tests := []struct {
+		name     string
+		metadata map[string]string
+		limits   MetadataLimits
+		wantCode string
+	}{
+		{"nil", nil, MetadataLimits{}, ""},
+		{"valid", map[string]string{"trace": "abc123", "compress": "none"}, MetadataLimits{}, ""},
+		{"too many entries", many, MetadataLimits{}, CodeTooManyMetadata},
+		{"key too long", map[string]string{strings.Repeat("k", 129): "v"}, MetadataLimits{}, CodeEnvelopeTooLarge},
+		{"value too long", map[string]string{"k": strings.Repeat("v", 1025)}, MetadataLimits{}, CodeEnvelopeTooLarge},
+		{"total too large", bulky, MetadataLimits{MaxTotalSize: 2048}, CodeEnvelopeTooLarge},
+		{"custom entry limit", map[string]string{"a": "1", "b": "2"}, MetadataLimits{MaxEntries: 1}, CodeTooManyMetadata},
+		{"custom limits allow more", map[string]string{"k": strings.Repeat("v", 2000)}, MetadataLimits{MaxValueLen: 4096}, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			env := ConnectEnvelope{Version: CurrentVersion, Target: "h:1", Metadata: tt.metadata}
+			err := env.ValidateMetadata(tt.limits)
+			if tt.wantCode == "" {
+				if err != nil {
+					t.Fatalf("ValidateMetadata: %v", err)
+				}
+				return
+			}
+			var me *MetadataError
+			if !errors.As(err, &me) {
+				t.Fatalf("err = %v, want *MetadataError", err)
+			}
+			if me.Code != tt.wantCode {
+				t.Errorf("code = %q, want %q", me.Code, tt.wantCode)
+			}
+		})
+	}
+}
+
+func TestValidateMetadata_DoesNotLeakContent(t *testing.T) {
+	env := ConnectEnvelope{Metadata: map[string]string{"token": strings.Repeat("s3cret", 200)}}
+	err := env.ValidateMetadata(MetadataLimits{})
+	if err == nil {
+		t.Fatal("want error")
+	}
+	if strings.Contains(err.Error(), "s3cret") {
+		t.Errorf("error leaks metadata value: %v", err)
+	}
+}
@@ -0,0 +1,71 @@
+package protocol
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+// Mux frame types. Every binary message on a ModeMux WebSocket is one
+// frame built by AppendMuxFrame: a big-endian uint32 stream id, one
+// type byte, then the payload. Text messages are not used.
+const (
+	// MuxOpen starts a stream. Only the sender opens streams, with
+	// odd ids counting up from 1. The payload is a JSON
+	// ConnectEnvelope naming the stream's target; Mode and
+	// Capabilities are ignored.
+	MuxOpen byte = 1
+
+	// MuxReply answers a MuxOpen with a JSON ConnectResponse. Data
+	// follows only an OK reply; a refused stream is finished.
+	MuxReply byte = 2
+
+	// MuxData carries stream bytes. A side may have at most
+	// MuxWindow bytes of data in flight per stream until the peer
+	// grants more with MuxWindowUpdate.
+	MuxData byte = 3
+
+	// MuxClose says the side sending it has no more data for the
+	// stream, like a TCP half-close. A stream is finished once both
+	// sides have sent MuxClose.
+	MuxClose byte = 4
+
+	// MuxReset aborts a stream in both directions. The payload is
+	// empty.
+	MuxReset byte = 5
+
+	// MuxWindowUpdate grants the peer more send window on a stream.
+	// The payload is the number of bytes as a big-endian uint32.
+	MuxWindowUpdate byte = 6
+)
+
+// MuxWindow is each stream's initial send window in either direction.
+// A peer that sends more than the window allows has the stream reset.
+const MuxWindow = 256 << 10
+
+// MuxMaxData is the largest MuxData payload. With the frame header it
+// stays under the websocket package's default read limit, so either
+// side reads mux frames without raising it.
+const MuxMaxData = 16 << 10
+
+// muxHeaderSize is the stream id and type byte in front of every
+// payload.
+const muxHeaderSize = 5
+
+// ErrShortMuxFrame reports a mux frame shorter than its header.
+var ErrShortMuxFrame = errors.New("short mux frame")
+
+// AppendMuxFrame appends a mux frame for stream id to b.
+func AppendMuxFrame(b []byte, id uint32, typ byte, payload []byte) []byte {
+	b = binary.BigEndian.AppendUint32(b, id)
+	b = append(b, typ)
+	return append(b, payload...)
+}
+
+// ParseMuxFrame splits a frame built by AppendMuxFrame. payload
+// aliases frame.
+func ParseMuxFrame(frame []byte) (id uint32, typ byte, payload []byte, err error) {
+	if len(frame) < muxHeaderSize {
+		return 0, 0, nil, ErrShortMuxFrame
+	}
+	return binary.BigEndian.Uint32(frame), frame[4], frame[muxHeaderSize:], nil
+}
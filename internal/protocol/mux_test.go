@@ -0,0 +1,36 @@
+package protocol
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+func TestMuxFrameRoundTrip(t *testing.T) {
+	for _, tc := range []struct {
+		id      uint32
+		typ     byte
+		payload string
+	}{
+		{1, MuxOpen, `{"version":1,"target":"db:5432"}`},
+		{3, MuxData, "\x00\x01binary"},
+		{0xfffffffd, MuxClose, ""},
+	} {
+		frame := AppendMuxFrame(nil, tc.id, tc.typ, []byte(tc.payload))
+		id, typ, payload, err := ParseMuxFrame(frame)
+		if err != nil {
+			t.Fatalf("ParseMuxFrame(%d): %v", tc.id, err)
+		}
+		if id != tc.id || typ != tc.typ || !bytes.Equal(payload, []byte(tc.payload)) {
+			t.Errorf("round trip = %d %d %q, want %d %d %q", id, typ, payload, tc.id, tc.typ, tc.payload)
+		}
+	}
+}
+
+func TestParseMuxFrame_Short(t *testing.T) {
+	for _, frame := range [][]byte{nil, {0, 0, 0, 1}} {
+		if _, _, _, err := ParseMuxFrame(frame); !errors.Is(err, ErrShortMuxFrame) {
+			t.Errorf("ParseMuxFrame(%v) err = %v, want ErrShortMuxFrame", frame, err)
+		}
+	}
+}
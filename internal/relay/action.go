@@ -0,0 +1,66 @@
+package relay
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+)
+
+// Action is the hybrid connection operation a relay dial requests via
+// sb-hc-action. Azure Relay authorizes each action against a different
+// claim on the token: connect requires Send, listen requires Listen. A
+// SAS token's sr= scope is the same for both (ResourceURI of the
+// endpoint and hybrid connection), so the rule the key belongs to, not
+// the token, decides which actions it may perform.
+type Action string
+
+// Hybrid connection actions.
+const (
+	ActionConnect Action = "connect"
+	ActionListen  Action = "listen"
+)
+
+// Claim returns the authorization claim the relay requires for a.
+func (a Action) Claim() string {
+	if a == ActionListen {
+		return "Listen"
+	}
+	return "Send"
+}
+
+// ClaimError reports that the relay rejected a dial's token (HTTP 401
+// or 403) for the requested action — typically a listen-only key used
+// to connect, or a send-only key used to listen.
+type ClaimError struct {
+	Action     Action
+	StatusCode int
+	Err        error
+}
+
+func (e *ClaimError) Error() string {
+	return fmt.Sprintf("relay rejected token for %s (HTTP %d; %s requires the %s claim): %v",
+		e.Action, e.StatusCode, e.Action, e.Action.Claim(), e.Err)
+}
+
+func (e *ClaimError) Unwrap() error { return e.Err }
+
+// claimErr wraps err in a *ClaimError when resp shows the relay
+// refused the token for action; otherwise it returns err unchanged.
+func claimErr(action Action, resp *http.Response, err error) error {
+	if !dialAuthFailed(resp) {
+		return err
+	}
+	return &ClaimError{Action: action, StatusCode: resp.StatusCode, Err: err}
+}
+
+// actionURL fetches a token for endpoint/entityPath and returns the
+// wss URL for action carrying it. The token's resource URI and the
+// dial URL are derived from the same endpoint and entity path, so the
+// token is always scoped to the hybrid connection being dialed.
+func (o ClientOptions) actionURL(ctx context.Context, tp TokenProvider, endpoint, entityPath string, action Action) (string, error) {
+	token, err := tp.GetToken(ctx, ResourceURI(endpoint, entityPath))
+	if err != nil {
+		return "", err
+	}
+	return o.hcURL(endpoint, entityPath, action, token), nil
+}
@@ -0,0 +1,127 @@
+package relay
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/coder/websocket"
+)
+
+// claimServer emulates Azure Relay's per-action authorization: tokens
+// signed with the "listen-rule" key may only listen, tokens signed
+// with the "send-rule" key may only connect. It records the sr= scope
+// of every token it sees.
+func claimServer(t *testing.T, scopes chan<- string) string {
+	t.Helper()
+	srv := dialTestServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		tok, err := url.ParseQuery(strings.TrimPrefix(q.Get("sb-hc-token"), "SharedAccessSignature "))
+		if err != nil {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if scopes != nil {
+			scopes <- tok.Get("sr")
+		}
+		want := map[string]string{"listen": "listen-rule", "connect": "send-rule"}[q.Get("sb-hc-action")]
+		if tok.Get("skn") != want {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		ws, err := websocket.Accept(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer ws.CloseNow()
+		<-r.Context().Done()
+	}))
+	return strings.TrimPrefix(srv.URL, "https://")
+}
+
+func TestDialWithRetry_ListenTokenForConnect(t *testing.T) {
+	scopes := make(chan string, 1)
+	endpoint := claimServer(t, scopes)
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	tp := &SASTokenProvider{KeyName: "listen-rule", Key: "k"}
+	_, err := DialWithRetry(ctx, endpoint, "my-hyco", tp, ClientOptions{}, logger)
+	var ce *ClaimError
+	if !errors.As(err, &ce) {
+		t.Fatalf("err = %v, want *ClaimError", err)
+	}
+	if ce.Action != ActionConnect || ce.StatusCode != http.StatusUnauthorized {
+		t.Errorf("ClaimError = {%s, %d}, want {connect, 401}", ce.Action, ce.StatusCode)
+	}
+	if !strings.Contains(err.Error(), "Send claim") {
+		t.Errorf("error %q should name the missing Send claim", err)
+	}
+	if strings.Contains(err.Error(), "sig=") {
+		t.Errorf("error leaked the token: %v", err)
+	}
+	want := strings.ToLower(ResourceURI(endpoint, "my-hyco"))
+	if got := <-scopes; got != want {
+		t.Errorf("token sr = %q, want %q", got, want)
+	}
+}
+
+func TestDial_SendTokenForConnect(t *testing.T) {
+	endpoint := claimServer(t, nil)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	ws, err := Dial(ctx, endpoint, "my-hyco", &SASTokenProvider{KeyName: "send-rule", Key: "k"}, ClientOptions{})
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	ws.CloseNow()
+
+	_, err = Dial(ctx, endpoint, "my-hyco", &SASTokenProvider{KeyName: "listen-rule", Key: "k"}, ClientOptions{})
+	var ce *ClaimError
+	if !errors.As(err, &ce) || ce.Action != ActionConnect {
+		t.Errorf("err = %v, want *ClaimError for connect", err)
+	}
+}
+
+func TestRunControlLoop_SendTokenForListen(t *testing.T) {
+	endpoint := claimServer(t, nil)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	logger, _ := captureLogger()
+	_, err := runControlLoop(ctx, ControlConfig{
+		Endpoint:      endpoint,
+		EntityPath:    "my-hyco",
+		TokenProvider: &SASTokenProvider{KeyName: "send-rule", Key: "k"},
+		Logger:        logger,
+		DialTimeout:   5 * time.Second,
+	})
+	var ce *ClaimError
+	if !errors.As(err, &ce) {
+		t.Fatalf("err = %v, want *ClaimError", err)
+	}
+	if ce.Action != ActionListen || ce.Action.Claim() != "Listen" {
+		t.Errorf("ClaimError action = %s (claim %s), want listen (Listen)", ce.Action, ce.Action.Claim())
+	}
+}
+
+func TestClaimErr_PassesThroughNonAuthFailures(t *testing.T) {
+	base := errors.New("boom")
+	for _, resp := range []*http.Response{nil, {StatusCode: http.StatusNotFound}} {
+		if got := claimErr(ActionConnect, resp, base); got != base {
+			t.Errorf("claimErr(%v) = %v, want the original error", resp, got)
+		}
+	}
+	got := claimErr(ActionListen, &http.Response{StatusCode: http.StatusForbidden}, base)
+	if !errors.Is(got, base) {
+		t.Errorf("ClaimError should unwrap to the dial error, got %v", got)
+	}
+}
@@ -9,10 +9,12 @@ import (
 	"crypto/hmac"
 	"crypto/sha256"
 	"encoding/base64"
+	"errors"
 	"fmt"
 	"net/url"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
@@ -127,14 +129,75 @@ func WithMetrics(p TokenProvider, obs TokenFetchObserver, provider string) Token
 }
 
 // SASTokenProvider generates Shared Access Signature tokens.
+//
+// KeyName and Key are the initial credentials. SetKey replaces them
+// while the provider is in use (e.g. after a key rotation), so the
+// next GetToken — the next dial or control-channel renew — signs with
+// the new key without a restart. Read the effective pair through
+// Credentials; the fields keep their initial values.
 type SASTokenProvider struct {
 	KeyName string
 	Key     string
+
+	// Expiry is how long each token GetToken signs stays valid. Zero
+	// selects tokenExpiry (1h). A listener renews its control-channel
+	// token well before then only if its renew interval is shorter.
+	Expiry time.Duration
+
+	rotated atomic.Pointer[sasCredentials]
+}
+
+// sasCredentials is one SAS key name/key pair installed by SetKey.
+type sasCredentials struct {
+	keyName, key string
 }
 
-// GetToken generates a SAS token for the given resource URI.
+// GetToken generates a SAS token for the given resource URI, valid
+// for the provider's expiry.
 func (p *SASTokenProvider) GetToken(_ context.Context, resourceURI string) (string, error) {
-	return GenerateSASToken(resourceURI, p.KeyName, p.Key, tokenExpiry)
+	keyName, key := p.Credentials()
+	return GenerateSASToken(resourceURI, keyName, key, p.expiry())
+}
+
+// expiry returns Expiry, or tokenExpiry when it is unset.
+func (p *SASTokenProvider) expiry() time.Duration {
+	if p.Expiry <= 0 {
+		return tokenExpiry
+	}
+	return p.Expiry
+}
+
+// tokenLifetime returns how long a token from tp stays valid, for the
+// renew loop's expiry estimates: a SAS provider's expiry, looking
+// through WithMetrics, or tokenExpiry for any other provider.
+func tokenLifetime(tp TokenProvider) time.Duration {
+	if m, ok := tp.(*metricsTokenProvider); ok {
+		tp = m.inner
+	}
+	if sas, ok := tp.(*SASTokenProvider); ok {
+		return sas.expiry()
+	}
+	return tokenExpiry
+}
+
+// Credentials returns the key name and key GetToken currently signs
+// with: the last pair passed to SetKey, or KeyName/Key if none was.
+func (p *SASTokenProvider) Credentials() (keyName, key string) {
+	if c := p.rotated.Load(); c != nil {
+		return c.keyName, c.key
+	}
+	return p.KeyName, p.Key
+}
+
+// SetKey atomically replaces the key name and key used for tokens
+// generated from now on. Tokens already handed out stay valid until
+// they expire. Both values must be non-empty.
+func (p *SASTokenProvider) SetKey(keyName, key string) error {
+	if keyName == "" || key == "" {
+		return errors.New("sas key name and key must both be set")
+	}
+	p.rotated.Store(&sasCredentials{keyName: keyName, key: key})
+	return nil
 }
 
 // EntraTokenProvider obtains OAuth2 tokens via Azure Identity
@@ -152,7 +215,8 @@ func (p *SASTokenProvider) GetToken(_ context.Context, resourceURI string) (stri
 // intentionally not cached, so a subsequent call retries the underlying
 // fetch instead of repeating a stale failure.
 type EntraTokenProvider struct {
-	cred azcore.TokenCredential
+	cred     azcore.TokenCredential
+	clientID string
 
 	mu         sync.Mutex
 	cached     azcore.AccessToken
@@ -161,11 +225,36 @@ type EntraTokenProvider struct {
 
 // NewEntraTokenProvider creates a token provider using DefaultAzureCredential.
 func NewEntraTokenProvider() (*EntraTokenProvider, error) {
-	cred, err := azidentity.NewDefaultAzureCredential(nil)
+	return NewEntraTokenProviderWithOptions(EntraOptions{})
+}
+
+// EntraOptions configures NewEntraTokenProviderWithOptions.
+type EntraOptions struct {
+	// ManagedIdentityClientID, when set, authenticates as the
+	// user-assigned managed identity with this client ID instead of
+	// trying the DefaultAzureCredential chain, whose managed identity
+	// leg otherwise picks the host's default identity (or the one
+	// named by AZURE_CLIENT_ID).
+	ManagedIdentityClientID string
+}
+
+// NewEntraTokenProviderWithOptions creates a token provider configured
+// by opts; the zero EntraOptions is equivalent to NewEntraTokenProvider.
+func NewEntraTokenProviderWithOptions(opts EntraOptions) (*EntraTokenProvider, error) {
+	if opts.ManagedIdentityClientID == "" {
+		cred, err := azidentity.NewDefaultAzureCredential(nil)
+		if err != nil {
+			return nil, fmt.Errorf("create Azure credential: %w", err)
+		}
+		return &EntraTokenProvider{cred: cred}, nil
+	}
+	cred, err := azidentity.NewManagedIdentityCredential(&azidentity.ManagedIdentityCredentialOptions{
+		ID: azidentity.ClientID(opts.ManagedIdentityClientID),
+	})
 	if err != nil {
-		return nil, fmt.Errorf("create Azure credential: %w", err)
+		return nil, fmt.Errorf("create managed identity credential: %w", err)
 	}
-	return &EntraTokenProvider{cred: cred}, nil
+	return &EntraTokenProvider{cred: cred, clientID: opts.ManagedIdentityClientID}, nil
 }
 
 // NewEntraTokenProviderWithCredential creates a token provider with a specific
@@ -174,6 +263,12 @@ func NewEntraTokenProviderWithCredential(cred azcore.TokenCredential) *EntraToke
 	return &EntraTokenProvider{cred: cred}
 }
 
+// ClientID returns the managed identity client ID the provider was
+// created with, or "" for the default identity.
+func (p *EntraTokenProvider) ClientID() string {
+	return p.clientID
+}
+
 // GetToken obtains an OAuth2 token for Azure Relay, returning a cached token
 // when one is available and not yet stale. Staleness mirrors azcore's
 // canonical BearerTokenPolicy.shouldRefresh: if the credential set a
@@ -270,6 +365,24 @@ func (p *EntraTokenProvider) refreshOnce(ctx context.Context, ch chan struct{})
 	return tk.Token, nil
 }
 
+// errInvalidSASKey is returned by ValidateSASKey for a key that is not
+// base64. The key itself is never part of the message.
+var errInvalidSASKey = errors.New("invalid SAS key format: want the base64 primary or secondary key of a shared access policy")
+
+// ValidateSASKey reports whether key looks like an Azure Relay SAS key,
+// so that a mistyped or truncated key fails at startup rather than as
+// a relay auth error on the first dial. Relay keys are base64, though
+// tokens are signed with the key string as given, not its decoding.
+func ValidateSASKey(key string) error {
+	if key == "" {
+		return errors.New("sas key is empty")
+	}
+	if _, err := base64.StdEncoding.DecodeString(key); err != nil {
+		return errInvalidSASKey
+	}
+	return nil
+}
+
 // GenerateSASToken creates a SharedAccessSignature token for Azure Relay.
 // The key is the raw key value from the Azure portal.
 func GenerateSASToken(resourceURI, keyName, key string, expiry time.Duration) (string, error) {
@@ -319,11 +432,25 @@ func (e *sanitizedError) Unwrap() error { return e.err }
 // sanitizeErr strips token query parameters from WebSocket dial errors
 // to avoid leaking credentials in log output. The returned error preserves
 // the original error chain for errors.Is/As.
-func sanitizeErr(err error) error {
-	s := err.Error()
-	// Strip all occurrences of sb-hc-token=... from URLs in the error message.
-	const marker = "sb-hc-token="
-	const redacted = "sb-hc-token=REDACTED"
+//
+// extraKeys names additional query parameters whose values are
+// redacted the same way (see ClientOptions.ExtraQuery). Patterns
+// installed with SetRedactPatterns are applied last.
+func sanitizeErr(err error, extraKeys ...string) error {
+	s := redactQueryParam(err.Error(), "sb-hc-token")
+	for _, k := range extraKeys {
+		s = redactQueryParam(s, url.QueryEscape(k))
+	}
+	return &sanitizedError{msg: RedactString(s), err: err}
+}
+
+// redactQueryParam replaces the value of every key=... occurrence in s
+// with REDACTED. A match preceded by another key character is skipped
+// so that a key which is a suffix of a longer key ("x-token" vs
+// "token") is not mistaken for it.
+func redactQueryParam(s, key string) string {
+	marker := key + "="
+	const redacted = "REDACTED"
 	pos := 0
 	for pos < len(s) {
 		i := strings.Index(s[pos:], marker)
@@ -332,13 +459,22 @@ func sanitizeErr(err error) error {
 		}
 		i += pos // absolute position
 		valStart := i + len(marker)
+		if i > 0 && isQueryKeyByte(s[i-1]) {
+			pos = valStart
+			continue
+		}
 		end := strings.IndexAny(s[valStart:], "\" &")
 		if end == -1 {
-			s = s[:valStart] + "REDACTED"
+			s = s[:valStart] + redacted
 		} else {
-			s = s[:valStart] + "REDACTED" + s[valStart+end:]
+			s = s[:valStart] + redacted + s[valStart+end:]
 		}
-		pos = i + len(redacted)
+		pos = valStart + len(redacted)
 	}
-	return &sanitizedError{msg: s, err: err}
+	return s
+}
+
+func isQueryKeyByte(b byte) bool {
+	return b == '-' || b == '_' || b == '.' || b == '%' ||
+		('0' <= b && b <= '9') || ('a' <= b && b <= 'z') || ('A' <= b && b <= 'Z')
 }
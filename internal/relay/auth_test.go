@@ -44,6 +44,14 @@ func TestSanitizeErr(t *testing.T) {
 		}
 	})
 
+	t.Run("extra keys", func(t *testing.T) {
+		err := sanitizeErr(fmt.Errorf("wss://h/$hc/e?sb-hc-token=SECRET1&x-key=SECRET2&key=SECRET3"), "key")
+		want := "wss://h/$hc/e?sb-hc-token=REDACTED&x-key=SECRET2&key=REDACTED"
+		if err.Error() != want {
+			t.Errorf("got %q, want %q", err.Error(), want)
+		}
+	})
+
 	t.Run("preserves error chain", func(t *testing.T) {
 		orig := fmt.Errorf("outer: %w", context.DeadlineExceeded)
 		err := sanitizeErr(orig)
@@ -146,6 +154,28 @@ func TestEntraTokenProvider_ConcurrentDedup(t *testing.T) {
 	}
 }
 
+// TestEntraTokenProvider_CachesWithinWindow verifies that sequential
+// callers reuse a token whose ExpiresOn is outside the refresh skew: a
+// sender opening one relay dial per local connection must not reach the
+// underlying credential on every dial.
+func TestEntraTokenProvider_CachesWithinWindow(t *testing.T) {
+	cred := &programmableCredential{token: "tok", expiry: time.Now().Add(time.Hour)}
+	tp := NewEntraTokenProviderWithCredential(cred)
+
+	for i := range 3 {
+		tok, err := tp.GetToken(context.Background(), "ignored")
+		if err != nil {
+			t.Fatalf("GetToken %d: %v", i, err)
+		}
+		if tok != "tok" {
+			t.Errorf("GetToken %d = %q, want %q", i, tok, "tok")
+		}
+	}
+	if got := cred.calls.Load(); got != 1 {
+		t.Errorf("underlying credential called %d times, want 1", got)
+	}
+}
+
 // TestEntraTokenProvider_RefreshAfterSkew verifies that a cached token whose
 // ExpiresOn sits inside the refresh skew is not reused: the next GetToken
 // triggers a fresh underlying fetch and returns the new token. Without this
@@ -4,6 +4,7 @@ import (
 	"context"
 	"errors"
 	"io"
+	"log/slog"
 	"net"
 	"sync/atomic"
 	"time"
@@ -14,8 +15,9 @@ import (
 )
 
 const (
-	// bridgePingInterval is how often we send WebSocket pings on data channels
-	// to prevent Azure Relay from dropping idle connections (~120s timeout).
+	// bridgePingInterval is how long a data channel may go without
+	// sending before we ping it, to prevent Azure Relay from dropping
+	// idle connections (~120s timeout).
 	bridgePingInterval = 30 * time.Second
 	bridgePingTimeout  = 10 * time.Second
 )
@@ -42,6 +44,8 @@ type BridgeStats struct {
 // The first pump decides the bridge outcome. After the first pump
 // returns the bridge cancels/drains the other direction, so the
 // second pump is treated as collateral and always reported as nil.
+// (With BridgeOptions.HalfClose a second pump that ends on its own
+// reports its own error, and it decides the outcome instead.)
 // Induced-cancellation shapes (context canceled/deadline or timeout)
 // are still filtered to nil on the first pump so parent-ctx cancel
 // and timeout bridges report clean per-direction errors alongside an
@@ -65,6 +69,32 @@ type BridgeResult struct {
 	EndCause string
 }
 
+// bridgeLoggerKey is the context key for WithBridgeLogger.
+type bridgeLoggerKey struct{}
+
+// WithBridgeLogger returns a copy of ctx carrying logger for Bridge's
+// lifecycle trace. When the logger is enabled at DEBUG, Bridge emits
+// one line when each direction starts, one per chunk copied (size
+// only — never payload bytes), and one when each direction ends with
+// its terminating error. Every line carries trace=<event> and
+// direction=tcp_to_ws|ws_to_tcp so one-directional stalls and
+// half-close bugs can be followed per direction. Without this (or
+// above DEBUG) Bridge does no trace work at all.
+func WithBridgeLogger(ctx context.Context, logger *slog.Logger) context.Context {
+	return context.WithValue(ctx, bridgeLoggerKey{}, logger)
+}
+
+// bridgeTracer returns the trace logger carried by ctx, or nil when
+// there is none or it is not enabled at DEBUG. The pumps check for nil
+// so the disabled path costs one comparison per chunk.
+func bridgeTracer(ctx context.Context) *slog.Logger {
+	logger, _ := ctx.Value(bridgeLoggerKey{}).(*slog.Logger)
+	if logger == nil || !logger.Enabled(ctx, slog.LevelDebug) {
+		return nil
+	}
+	return logger
+}
+
 // pumpResult identifies which I/O operation a bridge pump exited on
 // so the cause classifier can distinguish a peer-side failure
 // (ws.Write to a dead peer) from a local-side failure (tcp.Read EOF).
@@ -73,6 +103,47 @@ type pumpResult struct {
 	err error
 }
 
+// BridgeOptions tunes BridgeWithOptions. The zero value is Bridge's
+// behaviour: the bridge ends as soon as either direction does.
+type BridgeOptions struct {
+	// HalfClose keeps the other direction running after one side has
+	// finished sending (protocol.CapHalfClose). Local EOF sends an
+	// end-of-stream text message instead of ending the bridge, and the
+	// peer's marker half-closes the local side (CloseWrite, where
+	// supported). The bridge ends once both directions have finished,
+	// or as soon as either fails. Only set it when both peers agreed
+	// to the capability; an older peer would copy the marker onto its
+	// TCP connection as data.
+	HalfClose bool
+
+	// BufferSize is the copy buffer size for each direction, between
+	// MinBufferSize and MaxBufferSize; zero uses DefaultBufferSize.
+	// Buffers are pooled per size across bridges.
+	BufferSize int
+
+	// IdleTimeout ends the bridge once no bytes have moved in either
+	// direction for this long, with cause idle_timeout; the bridge
+	// then returns bridgecause.CauseIdleTimeout as its error. Zero
+	// disables it. WebSocket keepalive pings do not count as traffic.
+	IdleTimeout time.Duration
+
+	// RateLimit caps each direction at this many bytes per second,
+	// allowing bursts of up to one second's worth; zero means
+	// unlimited. BridgeStats still counts every byte relayed.
+	RateLimit int64
+
+	// PingInterval is how long the WebSocket may go without sending
+	// before it is pinged, so the relay does not drop it while idle; a
+	// connection that keeps sending is never pinged. Zero selects
+	// bridgePingInterval (30s); a negative value disables pings, for
+	// peers whose applications send their own keepalives.
+	PingInterval time.Duration
+
+	// PingTimeout bounds each ping. Zero selects bridgePingTimeout
+	// (10s), capped at PingInterval.
+	PingTimeout time.Duration
+}
+
 // Bridge copies data bidirectionally between a WebSocket connection
 // and a TCP connection until one side closes or the context is
 // cancelled. It returns a BridgeResult with byte counters, the
@@ -94,29 +165,44 @@ type pumpResult struct {
 //     the bridge's later pump-exit cancel is then the no-op, and the
 //     parent's cause wins.
 //
-// Bridge waits for every spawned goroutine (both pumps and the ping
-// loop) before returning, so it does not leak goroutines on its
-// caller.
+// Bridge waits for every spawned goroutine (both pumps, the ping loop,
+// the WithMinThroughput detector, and the idle detector) before
+// returning, so it does not leak goroutines on its caller.
 func Bridge(ctx context.Context, ws *websocket.Conn, tcp net.Conn) (BridgeResult, error) {
+	return BridgeWithOptions(ctx, ws, tcp, BridgeOptions{})
+}
+
+// BridgeWithOptions is Bridge with the behaviour adjusted by opts. With
+// opts.HalfClose a direction that ends cleanly (local EOF, or the
+// peer's end-of-stream marker) no longer tears the bridge down; the
+// other direction runs until it ends too, and the per-direction errors
+// and EndCause then come from whichever direction finished last.
+func BridgeWithOptions(ctx context.Context, ws *websocket.Conn, tcp net.Conn, opts BridgeOptions) (BridgeResult, error) {
 	ctx, cancel := context.WithCancelCause(ctx)
 	defer cancel(nil)
 
+	tr := bridgeTracer(ctx)
 	var tcpToWSBytes, wsToTCPBytes atomic.Int64
 	// One single-slot channel per direction so the bridge can
 	// attribute each error to the pump that produced it.
 	wsToTCPCh := make(chan pumpResult, 1)
 	tcpToWSCh := make(chan pumpResult, 1)
 	pingDone := make(chan struct{})
+	ka := newKeepalive(opts)
 
 	// WebSocket → TCP
 	go func() {
-		op, err := wsToTCP(ctx, ws, tcp, &wsToTCPBytes)
+		traceStart(tr, "ws_to_tcp")
+		op, err := wsToTCP(ctx, ws, tcp, &wsToTCPBytes, tr, opts)
+		traceEnd(tr, "ws_to_tcp", op, err, wsToTCPBytes.Load())
 		wsToTCPCh <- pumpResult{op: op, err: err}
 	}()
 
 	// TCP → WebSocket
 	go func() {
-		op, err := tcpToWS(ctx, ws, tcp, &tcpToWSBytes)
+		traceStart(tr, "tcp_to_ws")
+		op, err := tcpToWS(ctx, ws, tcp, &tcpToWSBytes, tr, opts, ka)
+		traceEnd(tr, "tcp_to_ws", op, err, tcpToWSBytes.Load())
 		tcpToWSCh <- pumpResult{op: op, err: err}
 	}()
 
@@ -125,9 +211,43 @@ func Bridge(ctx context.Context, ws *websocket.Conn, tcp net.Conn) (BridgeResult
 	// returning and not leak this goroutine past the caller.
 	go func() {
 		defer close(pingDone)
-		bridgePingLoop(ctx, ws)
+		ka.run(ctx, ws)
 	}()
 
+	// Optional minimum-throughput detector (WithMinThroughput). It
+	// stamps CauseTooSlow before unblocking the pumps so the cause
+	// wins over the timeout the expired read deadline produces.
+	// stopWatch ends it early once the TCP side has half-closed, when
+	// there is nothing left to measure.
+	watchCtx, stopWatch := context.WithCancel(ctx)
+	defer stopWatch()
+	watchDone := make(chan struct{})
+	if mt := minThroughputFrom(ctx); mt.enabled() {
+		go func() {
+			defer close(watchDone)
+			watchThroughput(watchCtx, &tcpToWSBytes, mt, func() {
+				cancel(bridgecause.CauseTooSlow)
+				_ = tcp.SetReadDeadline(time.Now())
+			})
+		}()
+	} else {
+		close(watchDone)
+	}
+
+	// Optional idle timeout, stamped and unblocked the same way.
+	idleDone := make(chan struct{})
+	if opts.IdleTimeout > 0 {
+		go func() {
+			defer close(idleDone)
+			watchIdle(ctx, &tcpToWSBytes, &wsToTCPBytes, opts.IdleTimeout, func() {
+				cancel(bridgecause.CauseIdleTimeout)
+				_ = tcp.SetReadDeadline(time.Now())
+			})
+		}()
+	} else {
+		close(idleDone)
+	}
+
 	// Wait for the first direction to finish, stamp cause, then
 	// unblock/drain the other pump.
 	var first pumpResult
@@ -139,22 +259,47 @@ func Bridge(ctx context.Context, ws *websocket.Conn, tcp net.Conn) (BridgeResult
 	case r := <-tcpToWSCh:
 		first = r
 	}
-	cancel(causeFromPumpExit(first.op, first.err))
+
+	// Half-close: a clean end of one direction leaves the other
+	// running until it ends on its own or the parent ctx is done.
+	var second pumpResult
+	secondDone := false
+	if opts.HalfClose && first.err == nil && (first.op == "ws_eos" || first.op == "tcp_eos") {
+		pending := tcpToWSCh
+		if first.op == "tcp_eos" {
+			pending = wsToTCPCh
+			stopWatch()
+		}
+		select {
+		case second = <-pending:
+			secondDone = true
+		case <-ctx.Done():
+		}
+	}
+	last := first
+	if secondDone {
+		last = second
+	}
+	cancel(causeFromPumpExit(last.op, last.err))
 	// Unblock tcp.Read in the second pump (if it was tcpToWS) by
 	// expiring its read deadline. The ws-side pump's ws.Reader sees
 	// the cancel via the internal ctx.
 	_ = tcp.SetReadDeadline(time.Now())
 
-	if firstWasWSToTCP {
-		<-tcpToWSCh
-	} else {
-		<-wsToTCPCh
+	if !secondDone {
+		if firstWasWSToTCP {
+			second = <-tcpToWSCh
+		} else {
+			second = <-wsToTCPCh
+		}
 	}
 
 	// Join the ping loop before returning. ctx is already cancelled,
 	// so the loop's select returns on the next iteration; any
 	// in-flight ws.Ping aborts via its pingCtx (derived from ctx).
 	<-pingDone
+	<-watchDone
+	<-idleDone
 
 	var wsErr, tcpErr error
 	if firstWasWSToTCP {
@@ -164,6 +309,15 @@ func Bridge(ctx context.Context, ws *websocket.Conn, tcp net.Conn) (BridgeResult
 		tcpErr = first.err
 		wsErr = nil
 	}
+	if secondDone {
+		// The second direction ended on its own, so its error is
+		// its own failure rather than teardown collateral.
+		if firstWasWSToTCP {
+			tcpErr = second.err
+		} else {
+			wsErr = second.err
+		}
+	}
 	if isInducedCancellation(wsErr) {
 		wsErr = nil
 	}
@@ -186,8 +340,13 @@ func Bridge(ctx context.Context, ws *websocket.Conn, tcp net.Conn) (BridgeResult
 	// callers' existing observable behavior (WARN-on-cancel sender
 	// callers still fire on a parent-ctx cancellation; a normal
 	// peer-close stays at DEBUG). The second pump always races the
-	// bridge cancel/teardown and is treated as collateral noise.
-	return result, first.err
+	// bridge cancel/teardown and is treated as collateral noise. A
+	// half-closed bridge reports the direction that ended it, and an
+	// idle timeout reports its sentinel.
+	if errors.Is(context.Cause(ctx), bridgecause.CauseIdleTimeout) {
+		return result, bridgecause.CauseIdleTimeout
+	}
+	return result, last.err
 }
 
 // isInducedCancellation reports whether err is the artifact of the
@@ -221,8 +380,9 @@ func isInducedCancellation(err error) bool {
 //
 // Classification rules:
 //
-//   - nil + ws_read: the WebSocket peer closed cleanly → peer_close.
-//   - nil + tcp_read: the local TCP side EOF'd → local_close.
+//   - nil + ws_read / ws_eos: the WebSocket peer closed cleanly, or
+//     sent its half-close marker last → peer_close.
+//   - nil + tcp_read / tcp_eos: the local TCP side EOF'd → local_close.
 //   - net.Error.Timeout(): timeout regardless of side.
 //   - websocket.CloseError: the peer surfaced a close frame
 //     (including the synthetic 1006 the websocket layer reports on
@@ -236,7 +396,7 @@ func isInducedCancellation(err error) bool {
 //     bridgecause.Name) wins.
 func causeFromPumpExit(op string, err error) error {
 	if err == nil {
-		if op == "ws_read" {
+		if op == "ws_read" || op == "ws_eos" {
 			return bridgecause.CausePeerClose
 		}
 		return bridgecause.CauseLocalClose
@@ -260,34 +420,100 @@ func causeFromPumpExit(op string, err error) error {
 	}
 }
 
-// bridgePingLoop sends periodic WebSocket pings to keep the data channel alive.
-func bridgePingLoop(ctx context.Context, ws *websocket.Conn) {
-	ticker := time.NewTicker(bridgePingInterval)
-	defer ticker.Stop()
+// keepalive pings a data channel's WebSocket once it has sent nothing
+// for the ping interval. The pumps call wrote after each message they
+// send, so a busy connection is never pinged and an idle one wakes the
+// loop once per interval. A nil keepalive (pings disabled) does
+// nothing.
+type keepalive struct {
+	interval  time.Duration
+	timeout   time.Duration
+	lastWrite atomic.Int64 // UnixNano of the last message or ping sent
+}
+
+// newKeepalive returns the keepalive for opts' ping settings, or nil
+// when opts disables pings.
+func newKeepalive(opts BridgeOptions) *keepalive {
+	interval := opts.PingInterval
+	switch {
+	case interval < 0:
+		return nil
+	case interval == 0:
+		interval = bridgePingInterval
+	}
+	timeout := opts.PingTimeout
+	if timeout <= 0 {
+		timeout = bridgePingTimeout
+	}
+	k := &keepalive{interval: interval, timeout: min(timeout, interval)}
+	k.wrote()
+	return k
+}
+
+// wrote records that a message was just sent on the WebSocket.
+func (k *keepalive) wrote() {
+	if k != nil {
+		k.lastWrite.Store(time.Now().UnixNano())
+	}
+}
+
+// run pings ws whenever it has been idle for the interval, until ctx
+// is done.
+func (k *keepalive) run(ctx context.Context, ws *websocket.Conn) {
+	if k == nil {
+		return
+	}
+	timer := time.NewTimer(k.interval)
+	defer timer.Stop()
 	for {
 		select {
 		case <-ctx.Done():
 			return
-		case <-ticker.C:
-			pingCtx, cancel := context.WithTimeout(ctx, bridgePingTimeout)
-			_ = ws.Ping(pingCtx) // best-effort; data flow or context cancel will clean up
-			cancel()
+		case <-timer.C:
 		}
+		if idle := time.Since(time.Unix(0, k.lastWrite.Load())); idle < k.interval {
+			timer.Reset(k.interval - idle)
+			continue
+		}
+		pingCtx, cancel := context.WithTimeout(ctx, k.timeout)
+		_ = ws.Ping(pingCtx) // best-effort; data flow or context cancel will clean up
+		cancel()
+		k.wrote()
+		timer.Reset(k.interval)
 	}
 }
 
 // wsToTCP pumps data from the WebSocket to the local TCP side and
 // returns the operation tag plus its terminating error. The op tag
 // is what causeFromPumpExit consults to distinguish a peer-side
-// failure (ws_read) from a local-side failure (tcp_write).
-func wsToTCP(ctx context.Context, ws *websocket.Conn, tcp net.Conn, count *atomic.Int64) (string, error) {
+// failure (ws_read) from a local-side failure (tcp_write). With
+// opts.HalfClose a text message is the peer's end-of-stream marker:
+// the local side is half-closed (CloseWrite, where supported) and the
+// pump ends with "ws_eos".
+func wsToTCP(ctx context.Context, ws *websocket.Conn, tcp net.Conn, count *atomic.Int64, tr *slog.Logger, opts BridgeOptions) (string, error) {
+	bufs := buffersFor(opts.BufferSize)
+	bufp := bufs.get()
+	defer bufs.put(bufp)
+	dst := pumpWriter(ctx, tcp, newRateLimiter(opts.RateLimit))
 	for {
-		_, r, err := ws.Reader(ctx)
+		typ, r, err := ws.Reader(ctx)
 		if err != nil {
 			return "ws_read", ignoreNormalClose(err)
 		}
-		n, err := io.Copy(tcp, r)
+		if opts.HalfClose && typ == websocket.MessageText {
+			if _, err := io.Copy(io.Discard, r); err != nil {
+				return "ws_read", err
+			}
+			if cw, ok := tcp.(interface{ CloseWrite() error }); ok {
+				_ = cw.CloseWrite()
+			}
+			return "ws_eos", nil
+		}
+		n, err := io.CopyBuffer(dst, r, *bufp)
 		count.Add(n)
+		if tr != nil {
+			tr.Debug("bridge trace", "trace", "chunk", "direction", "ws_to_tcp", "bytes", n)
+		}
 		if err != nil {
 			return "tcp_write", err
 		}
@@ -297,23 +523,61 @@ func wsToTCP(ctx context.Context, ws *websocket.Conn, tcp net.Conn, count *atomi
 // tcpToWS pumps data from the local TCP side to the WebSocket and
 // returns the operation tag plus its terminating error. ws.Write
 // failures here are peer-side (the peer's read half died), not
-// local-side; the op tag preserves that distinction.
-func tcpToWS(ctx context.Context, ws *websocket.Conn, tcp net.Conn, count *atomic.Int64) (string, error) {
-	buf := make([]byte, 32*1024)
+// local-side; the op tag preserves that distinction. With
+// opts.HalfClose a clean EOF sends the end-of-stream marker and
+// returns "tcp_eos". Each message sent is reported to ka.
+func tcpToWS(ctx context.Context, ws *websocket.Conn, tcp net.Conn, count *atomic.Int64, tr *slog.Logger, opts BridgeOptions, ka *keepalive) (string, error) {
+	// ws.Write does not retain buf, so it can go back to the pool as
+	// soon as the pump returns.
+	bufs := buffersFor(opts.BufferSize)
+	bufp := bufs.get()
+	defer bufs.put(bufp)
+	buf := *bufp
+	lim := newRateLimiter(opts.RateLimit)
 	for {
-		n, err := tcp.Read(buf)
+		n, err := tcp.Read(buf[:lim.chunk(len(buf))])
 		if n > 0 {
+			if wErr := lim.wait(ctx, n); wErr != nil {
+				return "ws_write", wErr
+			}
 			if wErr := ws.Write(ctx, websocket.MessageBinary, buf[:n]); wErr != nil {
 				return "ws_write", wErr
 			}
+			ka.wrote()
 			count.Add(int64(n))
+			if tr != nil {
+				tr.Debug("bridge trace", "trace", "chunk", "direction", "tcp_to_ws", "bytes", n)
+			}
 		}
 		if err != nil {
-			return "tcp_read", ignoreEOF(err)
+			err = ignoreEOF(err)
+			if opts.HalfClose && err == nil {
+				if wErr := ws.Write(ctx, websocket.MessageText, endOfStreamMsg); wErr != nil {
+					return "ws_write", wErr
+				}
+				return "tcp_eos", nil
+			}
+			return "tcp_read", err
 		}
 	}
 }
 
+// traceStart logs that a bridge direction began. tr may be nil.
+func traceStart(tr *slog.Logger, direction string) {
+	if tr != nil {
+		tr.Debug("bridge trace", "trace", "start", "direction", direction)
+	}
+}
+
+// traceEnd logs how a bridge direction ended: the pump operation it
+// exited on, its raw terminating error (nil on a clean close), and the
+// bytes it copied. tr may be nil.
+func traceEnd(tr *slog.Logger, direction, op string, err error, bytes int64) {
+	if tr != nil {
+		tr.Debug("bridge trace", "trace", "end", "direction", direction, "op", op, "error", err, "bytes", bytes)
+	}
+}
+
 func ignoreNormalClose(err error) error {
 	var closeErr websocket.CloseError
 	if errors.As(err, &closeErr) && closeErr.Code == websocket.StatusNormalClosure {
@@ -5,6 +5,7 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"log/slog"
 	"net"
 	"net/http"
 	"net/http/httptest"
@@ -823,3 +824,327 @@ type timeoutError struct{}
 func (*timeoutError) Error() string   { return "scripted-conn: deadline exceeded" }
 func (*timeoutError) Timeout() bool   { return true }
 func (*timeoutError) Temporary() bool { return true }
+
+func TestBridge_TraceLifecycle(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ws, err := websocket.Accept(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer ws.CloseNow()
+		for {
+			typ, data, err := ws.Read(r.Context())
+			if err != nil {
+				return
+			}
+			if err := ws.Write(r.Context(), typ, data); err != nil {
+				return
+			}
+		}
+	}))
+	defer srv.Close()
+
+	wsURL := "ws" + strings.TrimPrefix(srv.URL, "http")
+	ws, _, err := websocket.Dial(context.Background(), wsURL, nil)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer ws.CloseNow()
+
+	clientConn, serverConn := net.Pipe()
+	defer serverConn.Close()
+
+	logger, rec := captureLogger()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		_, _ = Bridge(WithBridgeLogger(ctx, logger), ws, serverConn)
+	}()
+
+	const payload = "trace-payload-must-not-be-logged"
+	if _, err := clientConn.Write([]byte(payload)); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	buf := make([]byte, 64)
+	_ = clientConn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := io.ReadFull(clientConn, buf[:len(payload)]); err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	clientConn.Close()
+	select {
+	case <-done:
+	case <-time.After(3 * time.Second):
+		t.Fatal("bridge did not terminate")
+	}
+
+	seen := map[string]bool{}
+	for _, r := range rec.records(t) {
+		if r["msg"] != "bridge trace" {
+			continue
+		}
+		event, _ := r["trace"].(string)
+		dir, _ := r["direction"].(string)
+		seen[event+"/"+dir] = true
+		if event == "chunk" {
+			if b, _ := r["bytes"].(float64); b != float64(len(payload)) {
+				t.Errorf("%s chunk bytes = %v, want %d", dir, r["bytes"], len(payload))
+			}
+		}
+	}
+	for _, want := range []string{
+		"start/tcp_to_ws", "start/ws_to_tcp",
+		"chunk/tcp_to_ws", "chunk/ws_to_tcp",
+		"end/tcp_to_ws", "end/ws_to_tcp",
+	} {
+		if !seen[want] {
+			t.Errorf("missing trace line %s; saw %v", want, seen)
+		}
+	}
+
+	rec.mu.Lock()
+	raw := string(rec.buf)
+	rec.mu.Unlock()
+	if strings.Contains(raw, payload) {
+		t.Errorf("trace leaked payload bytes: %s", raw)
+	}
+}
+
+func TestBridgeTracer_DisabledAboveDebug(t *testing.T) {
+	info := slog.New(slog.NewTextHandler(io.Discard, &slog.HandlerOptions{Level: slog.LevelInfo}))
+	if tr := bridgeTracer(WithBridgeLogger(context.Background(), info)); tr != nil {
+		t.Error("tracer enabled for an INFO logger")
+	}
+	if tr := bridgeTracer(context.Background()); tr != nil {
+		t.Error("tracer enabled without a logger")
+	}
+}
+
+// tcpConnPair returns the two ends of a loopback TCP connection, which
+// (unlike net.Pipe) support CloseWrite.
+func tcpConnPair(t *testing.T) (client, server *net.TCPConn) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer ln.Close()
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		c, _ := ln.Accept()
+		accepted <- c
+	}()
+	c, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	s := <-accepted
+	if s == nil {
+		t.Fatal("accept failed")
+	}
+	t.Cleanup(func() {
+		_ = c.Close()
+		_ = s.Close()
+	})
+	return c.(*net.TCPConn), s.(*net.TCPConn)
+}
+
+// TestBridgeWithOptions_HalfClose runs a sender-side and a
+// listener-side bridge back to back. The client sends a request and
+// half-closes; the target must see the whole request followed by EOF,
+// and its reply must still reach the client before both bridges end
+// cleanly.
+func TestBridgeWithOptions_HalfClose(t *testing.T) {
+	wsSender, wsListener := wsPair(t)
+	client, senderLocal := tcpConnPair(t)
+	listenerLocal, target := tcpConnPair(t)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	type outcome struct {
+		result BridgeResult
+		err    error
+	}
+	opts := BridgeOptions{HalfClose: true}
+	senderCh := make(chan outcome, 1)
+	listenerCh := make(chan outcome, 1)
+	go func() {
+		r, err := BridgeWithOptions(ctx, wsSender, senderLocal, opts)
+		senderCh <- outcome{r, err}
+	}()
+	go func() {
+		r, err := BridgeWithOptions(ctx, wsListener, listenerLocal, opts)
+		listenerCh <- outcome{r, err}
+	}()
+
+	// Target: read the request to EOF, then answer and close.
+	targetErr := make(chan error, 1)
+	go func() {
+		_ = target.SetDeadline(time.Now().Add(5 * time.Second))
+		req, err := io.ReadAll(target)
+		if err == nil && string(req) != "request" {
+			err = fmt.Errorf("target read %q, want %q", req, "request")
+		}
+		if err == nil {
+			_, err = target.Write([]byte("response"))
+		}
+		_ = target.Close()
+		targetErr <- err
+	}()
+
+	_ = client.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := client.Write([]byte("request")); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	if err := client.CloseWrite(); err != nil {
+		t.Fatalf("CloseWrite: %v", err)
+	}
+	got, err := io.ReadAll(client)
+	if err != nil {
+		t.Fatalf("read response: %v", err)
+	}
+	if string(got) != "response" {
+		t.Errorf("response = %q, want %q", got, "response")
+	}
+	if err := <-targetErr; err != nil {
+		t.Fatalf("target: %v", err)
+	}
+
+	for name, ch := range map[string]chan outcome{"sender": senderCh, "listener": listenerCh} {
+		select {
+		case res := <-ch:
+			if res.err != nil || res.result.TCPToWS != nil || res.result.WSToTCP != nil {
+				t.Errorf("%s bridge: err=%v tcp_to_ws=%v ws_to_tcp=%v, want all nil",
+					name, res.err, res.result.TCPToWS, res.result.WSToTCP)
+			}
+			if res.result.Stats.TCPToWS == 0 || res.result.Stats.WSToTCP == 0 {
+				t.Errorf("%s bridge stats = %+v, want bytes in both directions", name, res.result.Stats)
+			}
+		case <-time.After(3 * time.Second):
+			t.Fatalf("%s bridge did not end after both directions closed", name)
+		}
+	}
+}
+
+// TestBridgeWithOptions_HalfCloseParentCancel guards the wait for the
+// second direction: once the local side has half-closed, a parent
+// cancel must still end the bridge.
+func TestBridgeWithOptions_HalfCloseParentCancel(t *testing.T) {
+	ws, peer := wsPair(t)
+	client, local := tcpConnPair(t)
+
+	ctx, cancel := context.WithCancelCause(context.Background())
+	defer cancel(nil)
+	done := make(chan BridgeResult, 1)
+	go func() {
+		r, _ := BridgeWithOptions(ctx, ws, local, BridgeOptions{HalfClose: true})
+		done <- r
+	}()
+
+	if err := client.CloseWrite(); err != nil {
+		t.Fatalf("CloseWrite: %v", err)
+	}
+	// The peer sees the end-of-stream marker as a text message.
+	rctx, rcancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer rcancel()
+	typ, _, err := peer.Read(rctx)
+	if err != nil {
+		t.Fatalf("peer read: %v", err)
+	}
+	if typ != websocket.MessageText {
+		t.Fatalf("peer got %v, want the text end-of-stream marker", typ)
+	}
+
+	cancel(bridgecause.CauseUserCancel)
+	select {
+	case r := <-done:
+		if r.EndCause != "user_cancel" {
+			t.Errorf("EndCause = %q, want %q", r.EndCause, "user_cancel")
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("bridge did not end on parent cancel")
+	}
+}
+
+func TestNewKeepalive(t *testing.T) {
+	if ka := newKeepalive(BridgeOptions{PingInterval: -1}); ka != nil {
+		t.Errorf("negative PingInterval: keepalive = %+v, want nil", ka)
+	}
+	ka := newKeepalive(BridgeOptions{})
+	if ka.interval != bridgePingInterval || ka.timeout != bridgePingTimeout {
+		t.Errorf("defaults = %v/%v, want %v/%v", ka.interval, ka.timeout, bridgePingInterval, bridgePingTimeout)
+	}
+	ka = newKeepalive(BridgeOptions{PingInterval: time.Second})
+	if ka.timeout != time.Second {
+		t.Errorf("timeout = %v, want it capped at the 1s interval", ka.timeout)
+	}
+}
+
+// TestKeepalive_PingsOnlyWhenIdle counts the pings a peer receives
+// from a WebSocket that keeps sending and from one left idle.
+func TestKeepalive_PingsOnlyWhenIdle(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		interval time.Duration
+		busy     bool
+		wantPing bool
+	}{
+		{"idle", 20 * time.Millisecond, false, true},
+		{"busy", 50 * time.Millisecond, true, false},
+		{"disabled", -1, false, false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var mu sync.Mutex
+			pings := 0
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				ws, err := websocket.Accept(w, r, &websocket.AcceptOptions{
+					OnPingReceived: func(context.Context, []byte) bool {
+						mu.Lock()
+						pings++
+						mu.Unlock()
+						return true
+					},
+				})
+				if err != nil {
+					return
+				}
+				defer ws.CloseNow()
+				for {
+					if _, _, err := ws.Read(r.Context()); err != nil {
+						return
+					}
+				}
+			}))
+			defer srv.Close()
+			ctx, cancel := context.WithTimeout(context.Background(), 300*time.Millisecond)
+			defer cancel()
+			ws, _, err := websocket.Dial(context.Background(), "ws"+strings.TrimPrefix(srv.URL, "http"), nil)
+			if err != nil {
+				t.Fatalf("dial: %v", err)
+			}
+			defer ws.CloseNow()
+			ws.CloseRead(context.Background())
+
+			ka := newKeepalive(BridgeOptions{PingInterval: tc.interval})
+			if tc.busy {
+				go func() {
+					for ctx.Err() == nil {
+						if ws.Write(ctx, websocket.MessageBinary, []byte("x")) == nil {
+							ka.wrote()
+						}
+						time.Sleep(5 * time.Millisecond)
+					}
+				}()
+			}
+			ka.run(ctx, ws)
+
+			mu.Lock()
+			defer mu.Unlock()
+			if got := pings > 0; got != tc.wantPing {
+				t.Errorf("pings = %d, want pinged %v", pings, tc.wantPing)
+			}
+		})
+	}
+}
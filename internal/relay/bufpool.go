@@ -0,0 +1,82 @@
+package relay
+
+import (
+	"io"
+	"sync"
+)
+
+// Bridge copy buffer sizes (BridgeOptions.BufferSize). The buffer is
+// the read size of each TCP-to-WebSocket pump, so it also caps the
+// size of one binary message.
+const (
+	DefaultBufferSize = 32 * 1024
+	MinBufferSize     = 1024
+	MaxBufferSize     = 1024 * 1024
+)
+
+// bufferPool recycles fixed-size pump buffers across bridges, so a high
+// rate of short connections does not allocate (and later collect) one
+// buffer per connection. Buffers are handed out as *[]byte to keep
+// Put allocation-free. A nil *bufferPool disables pooling: get
+// allocates and put discards.
+type bufferPool struct {
+	size int
+	pool sync.Pool
+}
+
+func newBufferPool(size int) *bufferPool {
+	p := &bufferPool{size: size}
+	p.pool.New = func() any {
+		b := make([]byte, size)
+		return &b
+	}
+	return p
+}
+
+// get returns a buffer of the pool's size. Its contents are whatever
+// the previous holder left; callers must only use bytes they read into
+// it themselves.
+func (p *bufferPool) get() *[]byte {
+	if p == nil {
+		b := make([]byte, DefaultBufferSize)
+		return &b
+	}
+	return p.pool.Get().(*[]byte)
+}
+
+// put returns b to the pool. The caller must not use b afterwards.
+// Buffers of another size are dropped so every get sees the same size.
+func (p *bufferPool) put(b *[]byte) {
+	if p == nil || len(*b) != p.size {
+		return
+	}
+	p.pool.Put(b)
+}
+
+// bridgeBuffers serves bridges at DefaultBufferSize. Benchmarks set it
+// to nil to measure the unpooled baseline.
+var bridgeBuffers = newBufferPool(DefaultBufferSize)
+
+// sizedBuffers holds one pool per non-default BufferSize in use. A
+// process only ever configures a handful of sizes, so pools are never
+// removed.
+var sizedBuffers sync.Map // int → *bufferPool
+
+// buffersFor returns the pool for size; zero means DefaultBufferSize.
+func buffersFor(size int) *bufferPool {
+	if size == 0 || size == DefaultBufferSize {
+		return bridgeBuffers
+	}
+	if p, ok := sizedBuffers.Load(size); ok {
+		return p.(*bufferPool)
+	}
+	p, _ := sizedBuffers.LoadOrStore(size, newBufferPool(size))
+	return p.(*bufferPool)
+}
+
+// writerOnly hides an io.ReaderFrom (such as *net.TCPConn) from
+// io.CopyBuffer so the copy uses the pooled buffer instead of the
+// ReadFrom fallback, which allocates a fresh buffer on every call.
+type writerOnly struct {
+	io.Writer
+}
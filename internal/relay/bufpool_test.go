@@ -0,0 +1,186 @@
+package relay
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/coder/websocket"
+)
+
+func TestBufferPool_Size(t *testing.T) {
+	p := newBufferPool(1024)
+	b := p.get()
+	if len(*b) != 1024 {
+		t.Fatalf("len = %d, want 1024", len(*b))
+	}
+	p.put(b)
+
+	// A buffer of another size must not be handed out later.
+	odd := make([]byte, 10)
+	p.put(&odd)
+	for range 10 {
+		if b := p.get(); len(*b) != 1024 {
+			t.Fatalf("get after foreign put: len = %d, want 1024", len(*b))
+		}
+	}
+
+	var disabled *bufferPool
+	if b := disabled.get(); len(*b) != DefaultBufferSize {
+		t.Errorf("nil pool get: len = %d, want %d", len(*b), DefaultBufferSize)
+	}
+	disabled.put(b) // must not panic
+}
+
+func TestBuffersFor(t *testing.T) {
+	if buffersFor(0) != bridgeBuffers || buffersFor(DefaultBufferSize) != bridgeBuffers {
+		t.Error("zero and DefaultBufferSize must share the default pool")
+	}
+	p := buffersFor(4096)
+	if p == bridgeBuffers || buffersFor(4096) != p {
+		t.Error("a custom size must get its own pool, reused on later calls")
+	}
+	if b := p.get(); len(*b) != 4096 {
+		t.Errorf("len = %d, want 4096", len(*b))
+	}
+}
+
+// TestTCPToWS_BufferSizeCapsMessages checks BridgeOptions.BufferSize
+// reaches the pump: no binary message may exceed it.
+func TestTCPToWS_BufferSizeCapsMessages(t *testing.T) {
+	ws, peer := wsPair(t)
+	payload := bytes.Repeat([]byte("x"), 3*MinBufferSize+1)
+	msgs := runTCPToWS(t, ws, peer, payload, BridgeOptions{BufferSize: MinBufferSize})
+	var total int
+	for _, m := range msgs {
+		if len(m) > MinBufferSize {
+			t.Fatalf("message of %d bytes exceeds BufferSize %d", len(m), MinBufferSize)
+		}
+		total += len(m)
+	}
+	if total != len(payload) {
+		t.Errorf("received %d bytes, want %d", total, len(payload))
+	}
+}
+
+// runTCPToWS pumps payload through tcpToWS from one side of a pipe and
+// returns the WebSocket messages received on the other.
+func runTCPToWS(t testing.TB, ws, peer *websocket.Conn, payload []byte, opts BridgeOptions) [][]byte {
+	local, remote := net.Pipe()
+	go func() {
+		_, _ = remote.Write(payload)
+		_ = remote.Close()
+	}()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	var count atomic.Int64
+	if _, err := tcpToWS(ctx, ws, local, &count, nil, opts, nil); err != nil {
+		t.Fatalf("tcpToWS: %v", err)
+	}
+	_ = local.Close()
+
+	var msgs [][]byte
+	for total := 0; total < len(payload); {
+		_, msg, err := peer.Read(ctx)
+		if err != nil {
+			t.Fatalf("read: %v", err)
+		}
+		msgs = append(msgs, msg)
+		total += len(msg)
+	}
+	return msgs
+}
+
+// TestTCPToWS_PooledBufferDoesNotLeak fills a pooled buffer with one
+// connection's data and asserts the next connection to reuse it sends
+// only its own bytes.
+func TestTCPToWS_PooledBufferDoesNotLeak(t *testing.T) {
+	old := bridgeBuffers
+	bridgeBuffers = newBufferPool(DefaultBufferSize)
+	t.Cleanup(func() { bridgeBuffers = old })
+
+	ws, peer := wsPair(t)
+	runTCPToWS(t, ws, peer, bytes.Repeat([]byte("secret"), DefaultBufferSize/6), BridgeOptions{})
+
+	msgs := runTCPToWS(t, ws, peer, []byte("b"), BridgeOptions{})
+	if len(msgs) != 1 || string(msgs[0]) != "b" {
+		t.Errorf("second connection sent %d messages, first %q; want exactly \"b\"", len(msgs), msgs[0][:min(len(msgs[0]), 16)])
+	}
+}
+
+// BenchmarkTCPToWS_ShortSession measures one short connection's
+// TCP-to-WebSocket pump with and without buffer pooling; compare
+// allocs/op and B/op.
+func BenchmarkTCPToWS_ShortSession(b *testing.B) {
+	payload := []byte("GET / HTTP/1.1\r\nHost: example\r\n\r\n")
+	for _, bc := range []struct {
+		name string
+		pool *bufferPool
+	}{
+		{"pooled", newBufferPool(DefaultBufferSize)},
+		{"unpooled", nil},
+	} {
+		b.Run(bc.name, func(b *testing.B) {
+			old := bridgeBuffers
+			bridgeBuffers = bc.pool
+			defer func() { bridgeBuffers = old }()
+
+			ws, peer := wsPair(b)
+			b.ReportAllocs()
+			for b.Loop() {
+				runTCPToWS(b, ws, peer, payload, BridgeOptions{})
+			}
+		})
+	}
+}
+
+// BenchmarkWSToTCP_ShortSession measures one short connection's
+// WebSocket-to-TCP pump (a few small messages, then a normal close)
+// with and without buffer pooling; compare allocs/op and B/op.
+func BenchmarkWSToTCP_ShortSession(b *testing.B) {
+	msg := []byte("HTTP/1.1 200 OK\r\nContent-Length: 2\r\n\r\nok")
+	for _, bc := range []struct {
+		name string
+		pool *bufferPool
+	}{
+		{"pooled", newBufferPool(DefaultBufferSize)},
+		{"unpooled", nil},
+	} {
+		b.Run(bc.name, func(b *testing.B) {
+			old := bridgeBuffers
+			bridgeBuffers = bc.pool
+			defer func() { bridgeBuffers = old }()
+
+			ctx := context.Background()
+			b.ReportAllocs()
+			for b.Loop() {
+				b.StopTimer()
+				ws, peer := wsPair(b)
+				local, remote := net.Pipe()
+				go func() { _, _ = io.Copy(io.Discard, remote) }()
+				b.StartTimer()
+
+				go func() {
+					for range 4 {
+						_ = peer.Write(ctx, websocket.MessageBinary, msg)
+					}
+					_ = peer.Close(websocket.StatusNormalClosure, "")
+				}()
+				var count atomic.Int64
+				if _, err := wsToTCP(ctx, ws, local, &count, nil, BridgeOptions{}); err != nil {
+					b.Fatalf("wsToTCP: %v", err)
+				}
+
+				b.StopTimer()
+				_ = local.Close()
+				_ = remote.Close()
+				b.StartTimer()
+			}
+		})
+	}
+}
@@ -1,8 +1,14 @@
 package relay
 
 import (
+	"context"
 	"crypto/tls"
+	"fmt"
+	"net"
 	"net/http"
+	"net/url"
+	"strings"
+	"time"
 
 	"github.com/coder/websocket"
 )
@@ -22,6 +28,86 @@ type ClientOptions struct {
 	// relayCurvePreferences (P-384 first) when the caller leaves it
 	// empty; a caller-supplied non-empty list is preserved.
 	TLSConfig *tls.Config
+
+	// ExtraQuery holds additional query parameters appended to the
+	// connect/listen URLs (e.g. future sb-hc-* switches or
+	// diagnostics). sb-hc-action and sb-hc-token are always set by
+	// this package; entries for those keys are ignored. Values are
+	// treated as potentially sensitive and redacted from dial errors.
+	ExtraQuery url.Values
+
+	// Resolver, when non-nil, resolves the relay endpoint host in
+	// place of the system resolver (see NewResolver).
+	Resolver *net.Resolver
+
+	// RelayIP, when non-nil, pins the relay endpoint host to this
+	// address: dials to it connect to RelayIP instead of resolving the
+	// name, while the TLS SNI, certificate check, and Host header still
+	// use the real host. Dials to other hosts (listener rendezvous
+	// addresses) are unaffected.
+	RelayIP net.IP
+
+	// Compression offers permessage-deflate (without context
+	// takeover) on every WebSocket dial. It takes effect only if the
+	// relay accepts it in the handshake. A dial whose context carries
+	// a WireCounter then counts its connection's bytes into it.
+	Compression bool
+
+	// RetryJitter is the fraction of each DialWithRetry backoff delay
+	// that is randomised, so senders whose dials all failed while a
+	// listener's control channel bounced do not all redial at the same
+	// instant: the sleep is drawn from [delay*(1-RetryJitter), delay].
+	// Zero selects full jitter (1); a negative value disables jitter.
+	// Values above 1 are treated as 1. See ControlConfig.ReconnectJitter
+	// for the listener side.
+	RetryJitter float64
+
+	// Proxy, when non-nil, is the HTTP(S) or SOCKS5 proxy every relay
+	// dial goes through, in place of the one HTTPS_PROXY and NO_PROXY
+	// select. Through a proxy the relay host is resolved by the proxy,
+	// so Resolver and RelayIP no longer apply to it.
+	Proxy *url.URL
+}
+
+// reservedQueryKeys are the security-critical query parameters that
+// ExtraQuery must never override or duplicate.
+var reservedQueryKeys = []string{"sb-hc-action", "sb-hc-token"}
+
+func isReservedQueryKey(k string) bool {
+	for _, r := range reservedQueryKeys {
+		if strings.EqualFold(k, r) {
+			return true
+		}
+	}
+	return false
+}
+
+// hcURL builds the wss URL for a hybrid connection action carrying
+// token, followed by any non-reserved ExtraQuery parameters in sorted
+// key order.
+func (o ClientOptions) hcURL(endpoint, entityPath string, action Action, token string) string {
+	u := fmt.Sprintf("%s/$hc/%s?sb-hc-action=%s&sb-hc-token=%s",
+		o.wssBase(endpoint), url.PathEscape(entityPath), action, url.QueryEscape(token))
+	extra := url.Values{}
+	for k, vs := range o.ExtraQuery {
+		if !isReservedQueryKey(k) {
+			extra[k] = vs
+		}
+	}
+	if len(extra) > 0 {
+		u += "&" + extra.Encode()
+	}
+	return u
+}
+
+// sanitizeErr is relay.sanitizeErr with every ExtraQuery key redacted
+// in addition to sb-hc-token.
+func (o ClientOptions) sanitizeErr(err error) error {
+	keys := make([]string, 0, len(o.ExtraQuery))
+	for k := range o.ExtraQuery {
+		keys = append(keys, k)
+	}
+	return sanitizeErr(err, keys...)
 }
 
 // sessionCache is the process-wide TLS client session cache shared by
@@ -85,9 +171,46 @@ func (o ClientOptions) wssBase(endpoint string) string {
 // dialOptions returns websocket.DialOptions for this ClientOptions.
 // Delegates to WSDialOptions so the relay package's own dials get the
 // same shared session cache / TLS-hygiene defaults as callers in
-// internal/arc.
-func (o ClientOptions) dialOptions() *websocket.DialOptions {
-	return WSDialOptions(nil, o.TLSConfig)
+// internal/arc. A custom Resolver or RelayIP replaces the transport's
+// dialer with one matching http.DefaultTransport's timeouts. endpoint
+// is the relay host[:port] that RelayIP pins. Compression sets the
+// compression mode and wraps the dialer to fill in WireCounters.
+func (o ClientOptions) dialOptions(endpoint string) *websocket.DialOptions {
+	opts := WSDialOptions(nil, o.TLSConfig)
+	UseProxy(opts, o.Proxy)
+	tr := opts.HTTPClient.Transport.(*http.Transport)
+	if o.Resolver != nil || o.RelayIP != nil {
+		d := &net.Dialer{
+			Timeout:   30 * time.Second,
+			KeepAlive: 30 * time.Second,
+			Resolver:  o.Resolver,
+		}
+		tr.DialContext = d.DialContext
+		if o.RelayIP != nil {
+			pinned := hostOnly(endpoint)
+			ip := o.RelayIP.String()
+			// http.Transport takes the TLS ServerName from the request URL,
+			// not the dialed address, so only the TCP destination changes.
+			tr.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+				if host, port, err := net.SplitHostPort(addr); err == nil && strings.EqualFold(host, pinned) {
+					addr = net.JoinHostPort(ip, port)
+				}
+				return d.DialContext(ctx, network, addr)
+			}
+		}
+	}
+	if o.Compression {
+		UseCompression(opts)
+	}
+	return opts
+}
+
+// hostOnly returns the host part of a host[:port] endpoint.
+func hostOnly(endpoint string) string {
+	if host, _, err := net.SplitHostPort(endpoint); err == nil {
+		return host
+	}
+	return endpoint
 }
 
 // WSDialOptions builds *websocket.DialOptions for a wss dial to Azure
@@ -114,8 +237,14 @@ func (o ClientOptions) dialOptions() *websocket.DialOptions {
 // touch TLSConfig.NextProtos). The ClientSessionCache field is a
 // pointer to a shared, concurrency-safe LRU, so cloning still shares
 // the same cache across dials — which is what makes resumption work.
+//
+// The transport honours HTTPS_PROXY and NO_PROXY even when the cloned
+// one has no Proxy set; UseProxy substitutes an explicit proxy.
 func WSDialOptions(headers http.Header, baseTLS *tls.Config) *websocket.DialOptions {
 	tr := defaultTransportClone()
+	if tr.Proxy == nil {
+		tr.Proxy = http.ProxyFromEnvironment
+	}
 	if baseTLS == nil && tr.TLSClientConfig != nil {
 		baseTLS = tr.TLSClientConfig
 	}
@@ -132,6 +261,25 @@ func WSDialOptions(headers http.Header, baseTLS *tls.Config) *websocket.DialOpti
 	}
 }
 
+// UseProxy makes opts, as returned by WSDialOptions, dial through proxy
+// instead of the proxy the environment selects. A nil proxy leaves
+// opts unchanged.
+func UseProxy(opts *websocket.DialOptions, proxy *url.URL) {
+	if proxy == nil {
+		return
+	}
+	opts.HTTPClient.Transport.(*http.Transport).Proxy = http.ProxyURL(proxy)
+}
+
+// UseCompression makes opts, as returned by WSDialOptions, offer
+// permessage-deflate (without context takeover) and count the bytes of
+// a connection dialed with a WireCounter on its context.
+func UseCompression(opts *websocket.DialOptions) {
+	opts.CompressionMode = websocket.CompressionNoContextTakeover
+	tr := opts.HTTPClient.Transport.(*http.Transport)
+	tr.DialContext = countWire(tr.DialContext)
+}
+
 // tlsConfigForDial returns a fresh *tls.Config derived from base with
 // the shared ClientSessionCache and a TLS 1.3 minimum stamped on
 // unconditionally. aztunnel only dials Azure Relay, which supports
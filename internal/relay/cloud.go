@@ -0,0 +1,102 @@
+package relay
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+)
+
+// Cloud names an Azure cloud for the endpoint/credential consistency
+// check. The values are the azcore cloud configuration names.
+type Cloud string
+
+// Known clouds.
+const (
+	CloudPublic = Cloud("AzurePublic")
+	CloudChina  = Cloud("AzureChina")
+	CloudUSGov  = Cloud("AzureGovernment")
+)
+
+// cloudRelaySuffixes maps each cloud's relay namespace suffix to it.
+var cloudRelaySuffixes = map[string]Cloud{
+	DefaultRelaySuffix:              CloudPublic,
+	".servicebus.chinacloudapi.cn":  CloudChina,
+	".servicebus.usgovcloudapi.net": CloudUSGov,
+}
+
+// cloudAuthorityHosts maps each cloud's Entra authority host to it.
+var cloudAuthorityHosts = map[string]Cloud{
+	"login.microsoftonline.com": CloudPublic,
+	"login.chinacloudapi.cn":    CloudChina,
+	"login.microsoftonline.us":  CloudUSGov,
+}
+
+// CloudForEndpoint returns the cloud a relay endpoint (as returned by
+// ParseRelay) belongs to, judged by its namespace suffix. ok is false
+// for endpoints outside the known suffixes, such as mock or
+// self-hosted relays.
+func CloudForEndpoint(endpoint string) (c Cloud, ok bool) {
+	host := strings.ToLower(endpoint)
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	for suffix, c := range cloudRelaySuffixes {
+		if strings.HasSuffix(host, suffix) {
+			return c, true
+		}
+	}
+	return "", false
+}
+
+// CloudForAuthorityHost returns the cloud an Entra authority host
+// (AZURE_AUTHORITY_HOST, with or without scheme) belongs to. An empty
+// host means the azidentity default, the public cloud. ok is false for
+// unrecognised hosts such as private authorities.
+func CloudForAuthorityHost(authorityHost string) (c Cloud, ok bool) {
+	if authorityHost == "" {
+		return CloudPublic, true
+	}
+	host := authorityHost
+	if u, err := url.Parse(authorityHost); err == nil && u.Host != "" {
+		host = u.Host
+	}
+	c, ok = cloudAuthorityHosts[strings.ToLower(strings.TrimSuffix(host, "/"))]
+	return c, ok
+}
+
+// CloudMismatchError reports a relay endpoint whose cloud differs from
+// the cloud of the Entra authority that will issue its tokens. Such a
+// pairing fails at the relay with an authorization error that does
+// not mention the cloud, so callers surface this before dialing.
+type CloudMismatchError struct {
+	Endpoint      string
+	EndpointCloud Cloud
+	AuthorityHost string
+	AuthCloud     Cloud
+}
+
+func (e *CloudMismatchError) Error() string {
+	authority := e.AuthorityHost
+	if authority == "" {
+		authority = "default authority"
+	}
+	return fmt.Sprintf("relay endpoint %s is in %s but Entra credentials come from %s (%s); set --relay-suffix or AZURE_AUTHORITY_HOST for the same cloud",
+		e.Endpoint, e.EndpointCloud, e.AuthCloud, authority)
+}
+
+// CheckCloud compares the cloud of endpoint with the cloud of
+// authorityHost and returns a *CloudMismatchError when both are known
+// and differ. It returns nil when either side is unrecognised, since
+// the check cannot tell what was intended.
+func CheckCloud(endpoint, authorityHost string) error {
+	ec, ok := CloudForEndpoint(endpoint)
+	if !ok {
+		return nil
+	}
+	ac, ok := CloudForAuthorityHost(authorityHost)
+	if !ok || ac == ec {
+		return nil
+	}
+	return &CloudMismatchError{Endpoint: endpoint, EndpointCloud: ec, AuthorityHost: authorityHost, AuthCloud: ac}
+}
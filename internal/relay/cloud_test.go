@@ -0,0 +1,74 @@
+package relay
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestCloudForEndpoint(t *testing.T) {
+	tests := []struct {
+		endpoint string
+		want     Cloud
+		ok       bool
+	}{
+		{"my-relay.servicebus.windows.net", CloudPublic, true},
+		{"MY-RELAY.SERVICEBUS.WINDOWS.NET", CloudPublic, true},
+		{"my-relay.servicebus.chinacloudapi.cn", CloudChina, true},
+		{"my-relay.servicebus.usgovcloudapi.net", CloudUSGov, true},
+		{"my-relay.servicebus.chinacloudapi.cn:443", CloudChina, true},
+		{"127.0.0.1:8443", "", false},
+		{"relay.example.com", "", false},
+	}
+	for _, tt := range tests {
+		got, ok := CloudForEndpoint(tt.endpoint)
+		if got != tt.want || ok != tt.ok {
+			t.Errorf("CloudForEndpoint(%q) = %q, %v; want %q, %v", tt.endpoint, got, ok, tt.want, tt.ok)
+		}
+	}
+}
+
+func TestCloudForAuthorityHost(t *testing.T) {
+	tests := []struct {
+		host string
+		want Cloud
+		ok   bool
+	}{
+		{"", CloudPublic, true},
+		{"https://login.microsoftonline.com/", CloudPublic, true},
+		{"https://login.chinacloudapi.cn/", CloudChina, true},
+		{"login.microsoftonline.us", CloudUSGov, true},
+		{"https://login.example.internal/", "", false},
+	}
+	for _, tt := range tests {
+		got, ok := CloudForAuthorityHost(tt.host)
+		if got != tt.want || ok != tt.ok {
+			t.Errorf("CloudForAuthorityHost(%q) = %q, %v; want %q, %v", tt.host, got, ok, tt.want, tt.ok)
+		}
+	}
+}
+
+func TestCheckCloud(t *testing.T) {
+	tests := []struct {
+		name          string
+		endpoint      string
+		authorityHost string
+		wantMismatch  bool
+	}{
+		{"public default", "ns.servicebus.windows.net", "", false},
+		{"china matched", "ns.servicebus.chinacloudapi.cn", "https://login.chinacloudapi.cn/", false},
+		{"china suffix, default authority", "ns.servicebus.chinacloudapi.cn", "", true},
+		{"public suffix, china authority", "ns.servicebus.windows.net", "https://login.chinacloudapi.cn/", true},
+		{"usgov suffix, china authority", "ns.servicebus.usgovcloudapi.net", "https://login.chinacloudapi.cn/", true},
+		{"unknown endpoint", "127.0.0.1:8443", "https://login.chinacloudapi.cn/", false},
+		{"unknown authority", "ns.servicebus.windows.net", "https://login.example.internal/", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := CheckCloud(tt.endpoint, tt.authorityHost)
+			var me *CloudMismatchError
+			if got := errors.As(err, &me); got != tt.wantMismatch {
+				t.Fatalf("mismatch = %v (err %v), want %v", got, err, tt.wantMismatch)
+			}
+		})
+	}
+}
@@ -0,0 +1,112 @@
+package relay
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"strings"
+	"sync/atomic"
+)
+
+// permessage-deflate (RFC 7692) is negotiated in each WebSocket
+// handshake, so it applies per hop: between the sender and Azure
+// Relay, and between Azure Relay and the listener's rendezvous dial.
+// A sender with ClientOptions.Compression offers it on its relay dial;
+// the listener offers it on a rendezvous dial only when the sender's
+// handshake, forwarded in the accept message's connectHeaders, did.
+const deflateExtension = "permessage-deflate"
+
+// WireCounter counts the bytes the network connection under one relay
+// WebSocket moves, after permessage-deflate, WebSocket framing, and
+// TLS. Dials with ClientOptions.Compression fill in the counter found
+// on their context (see WithWireCounter); comparing it with a bridge's
+// payload byte counts shows what compression saves. Safe for
+// concurrent use.
+type WireCounter struct {
+	read, written atomic.Int64
+	deflate       atomic.Bool
+}
+
+// Bytes returns the bytes read from and written to the relay so far,
+// including the handshake.
+func (w *WireCounter) Bytes() (read, written int64) {
+	return w.read.Load(), w.written.Load()
+}
+
+// Deflate reports whether the WebSocket negotiated permessage-deflate.
+func (w *WireCounter) Deflate() bool {
+	return w.deflate.Load()
+}
+
+type wireCounterKey struct{}
+
+// WithWireCounter returns a child context that makes a compressed relay
+// dial count its connection's bytes into w. The listener's Handler
+// context carries the rendezvous WebSocket's counter when that
+// WebSocket negotiated permessage-deflate.
+func WithWireCounter(ctx context.Context, w *WireCounter) context.Context {
+	return context.WithValue(ctx, wireCounterKey{}, w)
+}
+
+// WireCounterFrom returns the counter attached by WithWireCounter, or
+// nil.
+func WireCounterFrom(ctx context.Context) *WireCounter {
+	w, _ := ctx.Value(wireCounterKey{}).(*WireCounter)
+	return w
+}
+
+// countWire wraps dial so connections dialed with a WireCounter on
+// their context report their traffic to it.
+func countWire(dial func(ctx context.Context, network, addr string) (net.Conn, error)) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	if dial == nil {
+		dial = (&net.Dialer{}).DialContext
+	}
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		c, err := dial(ctx, network, addr)
+		if err != nil {
+			return nil, err
+		}
+		if w := WireCounterFrom(ctx); w != nil {
+			return &countingConn{Conn: c, w: w}, nil
+		}
+		return c, nil
+	}
+}
+
+type countingConn struct {
+	net.Conn
+	w *WireCounter
+}
+
+func (c *countingConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	c.w.read.Add(int64(n))
+	return n, err
+}
+
+func (c *countingConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	c.w.written.Add(int64(n))
+	return n, err
+}
+
+// MarkDeflate records on ctx's WireCounter, if any, whether the
+// handshake response resp accepted permessage-deflate. Dials made with
+// UseCompression outside this package call it on success.
+func MarkDeflate(ctx context.Context, resp *http.Response) {
+	if w := WireCounterFrom(ctx); w != nil && resp != nil {
+		w.deflate.Store(strings.Contains(resp.Header.Get("Sec-WebSocket-Extensions"), deflateExtension))
+	}
+}
+
+// offersDeflate reports whether a sender's handshake headers, as
+// forwarded in an accept message's connectHeaders, offered
+// permessage-deflate.
+func offersDeflate(headers map[string]string) bool {
+	for k, v := range headers {
+		if strings.EqualFold(k, "Sec-WebSocket-Extensions") && strings.Contains(v, deflateExtension) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,112 @@
+package relay
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/coder/websocket"
+)
+
+func TestOffersDeflate(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		headers map[string]string
+		want    bool
+	}{
+		{"none", nil, false},
+		{"deflate", map[string]string{"Sec-WebSocket-Extensions": "permessage-deflate; client_no_context_takeover"}, true},
+		{"lower-case key", map[string]string{"sec-websocket-extensions": "permessage-deflate"}, true},
+		{"other extension", map[string]string{"Sec-WebSocket-Extensions": "x-webkit-deflate-frame"}, false},
+		{"other header", map[string]string{"X-Note": "permessage-deflate"}, false},
+	} {
+		if got := offersDeflate(tc.headers); got != tc.want {
+			t.Errorf("%s: offersDeflate = %v, want %v", tc.name, got, tc.want)
+		}
+	}
+}
+
+// compressingServer accepts WebSockets with mode, reads one message,
+// and answers "ok".
+func compressingServer(t *testing.T, mode websocket.CompressionMode) http.Handler {
+	t.Helper()
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ws, err := websocket.Accept(w, r, &websocket.AcceptOptions{CompressionMode: mode})
+		if err != nil {
+			return
+		}
+		defer ws.CloseNow()
+		ws.SetReadLimit(1 << 20)
+		if _, _, err := ws.Read(r.Context()); err != nil {
+			return
+		}
+		_ = ws.Write(r.Context(), websocket.MessageText, []byte("ok"))
+		<-r.Context().Done()
+	})
+}
+
+func TestDial_CompressionCountsWire(t *testing.T) {
+	payload := bytes.Repeat([]byte("GET /index.html HTTP/1.1\r\nHost: example\r\n\r\n"), 4096)
+	for _, tc := range []struct {
+		name    string
+		mode    websocket.CompressionMode
+		deflate bool
+	}{
+		{"negotiated", websocket.CompressionNoContextTakeover, true},
+		{"declined", websocket.CompressionDisabled, false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			srv := dialTestServer(t, compressingServer(t, tc.mode))
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+
+			wire := new(WireCounter)
+			ws, err := Dial(WithWireCounter(ctx, wire), testEndpoint(srv), "hc", &mockTokenProvider{token: "t"}, ClientOptions{Compression: true})
+			if err != nil {
+				t.Fatalf("Dial: %v", err)
+			}
+			defer ws.CloseNow()
+			if wire.Deflate() != tc.deflate {
+				t.Fatalf("Deflate = %v, want %v", wire.Deflate(), tc.deflate)
+			}
+
+			_, before := wire.Bytes()
+			if err := ws.Write(ctx, websocket.MessageBinary, payload); err != nil {
+				t.Fatalf("write: %v", err)
+			}
+			if _, _, err := ws.Read(ctx); err != nil {
+				t.Fatalf("read: %v", err)
+			}
+			_, after := wire.Bytes()
+			sent := after - before
+			if tc.deflate && sent > int64(len(payload)/10) {
+				t.Errorf("sent %d wire bytes for %d compressible bytes, want under a tenth", sent, len(payload))
+			}
+			if !tc.deflate && sent < int64(len(payload)) {
+				t.Errorf("sent %d wire bytes for %d uncompressed bytes, want at least as many", sent, len(payload))
+			}
+		})
+	}
+}
+
+func TestDialAccept_CompressionOnlyWhenOffered(t *testing.T) {
+	useInsecureTransport(t)
+	srv := tlsServer(t, compressingServer(t, websocket.CompressionNoContextTakeover))
+	cfg := ControlConfig{DialTimeout: 5 * time.Second, Logger: discardLogger()}
+
+	for _, deflate := range []bool{false, true} {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		ws, wire := dialAccept(ctx, acceptJob{addr: "wss://" + testEndpoint(srv), logger: discardLogger(), deflate: deflate}, cfg)
+		if ws == nil {
+			cancel()
+			t.Fatalf("deflate=%v: dial failed", deflate)
+		}
+		if got := wire != nil; got != deflate {
+			t.Errorf("deflate=%v: got WireCounter %v, want one only when the sender offered compression", deflate, got)
+		}
+		_ = ws.CloseNow()
+		cancel()
+	}
+}
@@ -6,8 +6,8 @@ import (
 	"errors"
 	"fmt"
 	"log/slog"
+	"math/rand/v2"
 	"net/http"
-	"net/url"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -21,11 +21,30 @@ import (
 const (
 	tokenExpiry          = 1 * time.Hour
 	defaultRenewInterval = 45 * time.Minute
-	pingInterval         = 30 * time.Second
-	pingTimeout          = 10 * time.Second
+	defaultPingInterval  = 30 * time.Second
+	defaultPingTimeout   = 10 * time.Second
 	reconnectMin         = 1 * time.Second
 	reconnectMax         = 30 * time.Second
 	reconnectReset       = 2 // multiplier
+
+	defaultAcceptQueueTimeout = 5 * time.Second
+	defaultAcceptQueueLimit   = 256
+)
+
+// DefaultMaxMessageSize is the ControlConfig.MaxMessageSize used when
+// none is set: MaxBufferSize, so a peer bridging with the largest
+// --buffer-size never sends a data message the listener refuses. The
+// websocket package's own default, 32 KiB, is below that.
+const DefaultMaxMessageSize = MaxBufferSize
+
+// ControlConfig.AcceptOverflow values.
+const (
+	// AcceptOverflowDrop drops an accept that arrives while
+	// MaxConnections are in flight.
+	AcceptOverflowDrop = "drop"
+	// AcceptOverflowQueue holds such an accept for up to
+	// AcceptQueueTimeout waiting for a connection to finish.
+	AcceptOverflowQueue = "queue"
 )
 
 // AcceptHandler is called for each accepted rendezvous connection.
@@ -41,8 +60,45 @@ type ControlConfig struct {
 	TokenProvider  TokenProvider
 	Handler        AcceptHandler
 	MaxConnections int // 0 = unlimited
-	DialTimeout    time.Duration
-	Logger         *slog.Logger
+	// MaxConnectionsFunc, when non-nil, is consulted on every accept
+	// instead of MaxConnections so the limit can change while the
+	// control loop runs (listener SIGHUP reload). A return value <= 0
+	// means unlimited. Connections already admitted are unaffected by
+	// a lowered limit.
+	MaxConnectionsFunc func() int
+	// AcceptOverflow selects what happens to an accept that arrives
+	// while MaxConnections are in flight: AcceptOverflowDrop (the
+	// default, also selected by "") drops it with reason
+	// AcceptDroppedSemaphoreFull; AcceptOverflowQueue waits up to
+	// AcceptQueueTimeout for a slot on a separate goroutine, so the
+	// control read loop never blocks, and drops it only if none frees.
+	AcceptOverflow string
+	// AcceptQueueTimeout bounds the AcceptOverflowQueue wait. Zero
+	// selects defaultAcceptQueueTimeout (5s).
+	AcceptQueueTimeout time.Duration
+	// AcceptQueueLimit caps how many accepts AcceptOverflowQueue holds
+	// at once, each on its own goroutine; an accept past the cap is
+	// dropped with reason AcceptDroppedOverflowFull. Zero selects
+	// defaultAcceptQueueLimit (256).
+	AcceptQueueLimit int
+	// AcceptWorkers, when > 0, bounds how many rendezvous dials run
+	// at once: accept messages are queued for a fixed pool of workers
+	// instead of each getting its own goroutine. Once a worker's dial
+	// succeeds the Handler runs on its own goroutine, so the pool
+	// limits dial concurrency during bursts, not bridge concurrency
+	// (that is MaxConnections). Zero keeps one goroutine per accept.
+	AcceptWorkers int
+	// AcceptBacklog is the number of accept messages that may wait for
+	// a free worker. Accepts arriving when the backlog is full are
+	// dropped with reason AcceptDroppedQueueFull. Zero selects
+	// AcceptWorkers. Ignored unless AcceptWorkers > 0.
+	AcceptBacklog int
+	// OnAcceptDropped is called with the accept_dropped reason when the
+	// accept backlog or the AcceptOverflowQueue queue overflows.
+	// Optional.
+	OnAcceptDropped func(reason string)
+	DialTimeout     time.Duration
+	Logger          *slog.Logger
 	// Options controls transport (scheme, TLS) for the control channel
 	// dial and the listener's outbound rendezvous dial. The zero value
 	// is real-Azure-compatible (wss + http.DefaultClient).
@@ -51,11 +107,55 @@ type ControlConfig struct {
 	OnConnect func()
 	// OnDisconnect is called when the control channel disconnects. Optional.
 	OnDisconnect func()
+	// OnError is called with the error each failed control-channel
+	// session or dial attempt ended with, before the reconnect delay.
+	// The error is a *ControlError carrying the control_ended reason.
+	// It is not called on shutdown. Optional.
+	OnError func(err error)
+	// OnReconnect is called with the backoff delay before each
+	// reconnect attempt, after OnError. Optional.
+	OnReconnect func(delay time.Duration)
 	// RenewInterval is how often the listener renews its SAS/Entra
 	// token over the control channel. Zero selects defaultRenewInterval
 	// (45m). Tests set a short value to drive a real renew round-trip
 	// within an assertion budget.
 	RenewInterval time.Duration
+	// PingInterval is how often the listener pings the control
+	// channel to detect a dead connection. Zero selects
+	// defaultPingInterval (30s).
+	PingInterval time.Duration
+	// PingTimeout bounds each control-channel ping; a ping that gets
+	// no pong within it ends the control channel. Zero selects
+	// defaultPingTimeout (10s), capped at PingInterval.
+	PingTimeout time.Duration
+	// ReconnectJitter is the fraction of each control-channel
+	// reconnect delay that is randomised, so listeners that lose the
+	// relay together do not all redial at the same instant: the sleep
+	// is drawn from [delay*(1-ReconnectJitter), delay]. Zero selects
+	// full jitter (1); a negative value disables jitter, which tests
+	// use for deterministic timing. Values above 1 are treated as 1.
+	ReconnectJitter float64
+	// IdleReconnect, when > 0, forces a control-channel reconnect if
+	// no control message has arrived for this long and no accepted
+	// connection is in flight. It recovers listen sockets the relay
+	// has silently stopped routing to while they still answer pings.
+	// Zero disables it.
+	IdleReconnect time.Duration
+	// MaxMessageSize is the largest WebSocket message the control
+	// channel and each rendezvous connection accept (see
+	// websocket.Conn.SetReadLimit). A larger message fails the read
+	// with websocket.ErrMessageTooBig and closes the connection with
+	// StatusMessageTooBig. Zero selects DefaultMaxMessageSize.
+	MaxMessageSize int64
+}
+
+// readLimit returns the read limit for the control channel and
+// rendezvous connections.
+func (cfg *ControlConfig) readLimit() int64 {
+	if cfg.MaxMessageSize > 0 {
+		return cfg.MaxMessageSize
+	}
+	return DefaultMaxMessageSize
 }
 
 // ListenAndServe connects to the Azure Relay control channel and accepts
@@ -83,20 +183,44 @@ func ListenAndServe(ctx context.Context, cfg ControlConfig) error {
 		if time.Since(start) > reconnectMax {
 			delay = reconnectMin
 		}
-		cfg.Logger.Warn("control channel disconnected, reconnecting", "error", err, "delay", delay)
+		sleep := jitterDelay(delay, cfg.ReconnectJitter)
+		cfg.Logger.Warn("control channel disconnected, reconnecting", "error", err, "delay", sleep)
 		if connected && cfg.OnDisconnect != nil {
 			cfg.OnDisconnect()
 		}
+		if cfg.OnError != nil {
+			cfg.OnError(err)
+		}
+		if cfg.OnReconnect != nil {
+			cfg.OnReconnect(sleep)
+		}
 		select {
 		case <-ctx.Done():
 			return ctx.Err()
-		case <-time.After(delay):
+		case <-time.After(sleep):
 		}
 		// Exponential backoff capped at reconnectMax.
 		delay = min(delay*reconnectReset, reconnectMax)
 	}
 }
 
+// jitterDelay returns d shortened by a random amount of up to
+// frac*d (see ControlConfig.ReconnectJitter). The backoff itself keeps
+// growing deterministically; only each sleep is randomised.
+func jitterDelay(d time.Duration, frac float64) time.Duration {
+	switch {
+	case frac < 0 || d <= 0:
+		return d
+	case frac == 0 || frac > 1:
+		frac = 1
+	}
+	return d - time.Duration(jitterSource()*frac*float64(d))
+}
+
+// jitterSource returns the random fraction, in [0, 1), that
+// jitterDelay takes off a delay. Tests replace it to pin sleeps.
+var jitterSource = rand.Float64 // #nosec G404 -- jitter is timing noise, not a security boundary.
+
 // loopState carries the deferred-emit inputs for control_ended out of
 // the goroutines that detect a forced-reconnect cause. renewLoop,
 // pingLoop, and the read loop all call setEnd before cancelling the
@@ -184,10 +308,12 @@ func runControlLoop(ctx context.Context, cfg ControlConfig) (connected bool, err
 			attrs = append(attrs, "error", reportErr)
 		}
 		logger.Info(EventControlEnded, attrs...)
+		if err != nil {
+			err = &ControlError{Reason: cause, Err: err}
+		}
 	}()
 
-	resURI := ResourceURI(cfg.Endpoint, cfg.EntityPath)
-	token, err := cfg.TokenProvider.GetToken(ctx, resURI)
+	listenURL, err := cfg.Options.actionURL(ctx, cfg.TokenProvider, cfg.Endpoint, cfg.EntityPath, ActionListen)
 	if err != nil {
 		if ctx.Err() == nil {
 			state.setEnd(ControlEndedTokenFetchFailed, nil)
@@ -196,12 +322,10 @@ func runControlLoop(ctx context.Context, cfg ControlConfig) (connected bool, err
 	}
 
 	wssBase := cfg.Options.wssBase(cfg.Endpoint)
-	listenURL := fmt.Sprintf("%s/$hc/%s?sb-hc-action=listen&sb-hc-token=%s",
-		wssBase, url.PathEscape(cfg.EntityPath), url.QueryEscape(token))
 
 	dialCtx, dialCancel := context.WithTimeout(ctx, cfg.DialTimeout)
 	defer dialCancel()
-	ws, resp, dialErr := websocket.Dial(dialCtx, listenURL, cfg.Options.dialOptions())
+	ws, resp, dialErr := websocket.Dial(dialCtx, listenURL, cfg.Options.dialOptions(cfg.Endpoint))
 	if dialErr != nil {
 		// Operator-driven cancellation propagated through dialCtx
 		// is classified as context_cancelled (no setEnd call —
@@ -214,9 +338,11 @@ func runControlLoop(ctx context.Context, cfg ControlConfig) (connected bool, err
 		default:
 			state.setEnd(ControlEndedDialFailed, nil)
 		}
-		return false, fmt.Errorf("dial control: %w", sanitizeErr(dialErr))
+		return false, fmt.Errorf("dial control: %w", claimErr(ActionListen, resp, cfg.Options.sanitizeErr(dialErr)))
 	}
 	defer func() { _ = ws.CloseNow() }()
+	ws.SetReadLimit(cfg.readLimit())
+	logTLSState(ctx, logger, resp, "control tls negotiated")
 
 	// control_started fires here, after the dial has succeeded —
 	// this is the operational milestone every other listener
@@ -241,7 +367,13 @@ func runControlLoop(ctx context.Context, cfg ControlConfig) (connected bool, err
 	// rather than the unclassified context.Canceled.
 	loopCtx, loopCancel := context.WithCancelCause(ctx)
 
-	sem := newConnSemaphore(cfg.MaxConnections)
+	var sem *connSemaphore
+	if cfg.MaxConnectionsFunc != nil {
+		sem = newConnSemaphoreFunc(cfg.MaxConnectionsFunc)
+	} else {
+		sem = newConnSemaphore(cfg.MaxConnections)
+	}
+	loopCtx = context.WithValue(loopCtx, connSlotsKey{}, sem)
 
 	var wg sync.WaitGroup
 	// Cancel ordering matters: the deferred loopCancel must run
@@ -255,21 +387,115 @@ func runControlLoop(ctx context.Context, cfg ControlConfig) (connected bool, err
 	if renewInterval == 0 {
 		renewInterval = defaultRenewInterval
 	}
+	pingInterval := cfg.PingInterval
+	if pingInterval == 0 {
+		pingInterval = defaultPingInterval
+	}
+	pingTimeout := cfg.PingTimeout
+	if pingTimeout == 0 {
+		pingTimeout = min(defaultPingTimeout, pingInterval)
+	}
 
 	// Token renewal goroutine.
 	wg.Add(1)
 	go func() {
 		defer wg.Done()
-		renewLoop(loopCtx, ws, resURI, cfg.TokenProvider, logger, loopCancel, state, renewInterval)
+		renewLoop(loopCtx, ws, ResourceURI(cfg.Endpoint, cfg.EntityPath), cfg.TokenProvider, logger, loopCancel, state, renewInterval)
 	}()
 
 	// Ping heartbeat goroutine.
 	wg.Add(1)
 	go func() {
 		defer wg.Done()
-		pingLoop(loopCtx, ws, logger, loopCancel, state, pingInterval)
+		pingLoop(loopCtx, ws, logger, loopCancel, state, pingInterval, pingTimeout)
 	}()
 
+	// Idle reconnect goroutine.
+	activity := &controlActivity{}
+	activity.touch()
+	if cfg.IdleReconnect > 0 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			idleReconnectLoop(loopCtx, activity, sem, loopCancel, state, cfg.IdleReconnect)
+		}()
+	}
+
+	release := func(logger *slog.Logger) {
+		sem.release()
+		logger.Debug("accept released")
+	}
+
+	// Optional fixed worker pool for rendezvous dials. Accepts still
+	// queued when the loop ends are discarded; their semaphore slots
+	// die with sem.
+	var queue chan acceptJob
+	if cfg.AcceptWorkers > 0 {
+		backlog := cfg.AcceptBacklog
+		if backlog <= 0 {
+			backlog = cfg.AcceptWorkers
+		}
+		queue = make(chan acceptJob, backlog)
+		for range cfg.AcceptWorkers {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for {
+					select {
+					case <-loopCtx.Done():
+						return
+					case job := <-queue:
+						ws, wire := dialAccept(loopCtx, job, cfg)
+						if ws == nil {
+							release(job.logger)
+							continue
+						}
+						wg.Add(1)
+						go func() {
+							defer wg.Done()
+							defer release(job.logger)
+							serveAccept(loopCtx, ws, wire, cfg)
+						}()
+					}
+				}
+			}()
+		}
+	}
+
+	// dispatch hands an accept that holds a semaphore slot to the
+	// worker pool, or to its own goroutine without one.
+	dispatch := func(job acceptJob) {
+		if queue != nil {
+			select {
+			case queue <- job:
+			default:
+				release(job.logger)
+				job.logger.Warn(EventAcceptDropped, "reason", AcceptDroppedQueueFull)
+				if cfg.OnAcceptDropped != nil {
+					cfg.OnAcceptDropped(AcceptDroppedQueueFull)
+				}
+			}
+			return
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer release(job.logger)
+			handleAccept(loopCtx, job, cfg)
+		}()
+	}
+
+	queueTimeout := cfg.AcceptQueueTimeout
+	if queueTimeout <= 0 {
+		queueTimeout = defaultAcceptQueueTimeout
+	}
+	queueLimit := cfg.AcceptQueueLimit
+	if queueLimit <= 0 {
+		queueLimit = defaultAcceptQueueLimit
+	}
+	// queued counts the accepts waiting for a slot in queue mode.
+	var queued atomic.Int64
+
 	// Read accept messages from the control channel.
 	for {
 		_, data, readErr := ws.Read(loopCtx)
@@ -288,6 +514,7 @@ func runControlLoop(ctx context.Context, cfg ControlConfig) (connected bool, err
 			loopCancel(bridgecause.CauseControlError)
 			return true, fmt.Errorf("read control: %w", readErr)
 		}
+		activity.touch()
 
 		var msg struct {
 			Accept *struct {
@@ -314,25 +541,55 @@ func runControlLoop(ctx context.Context, cfg ControlConfig) (connected bool, err
 		acceptLogger := logger.With("accept_id", acceptID)
 
 		acceptLogger.Info(EventAcceptAttempted)
+		job := acceptJob{
+			addr:    msg.Accept.Address,
+			logger:  acceptLogger,
+			deflate: offersDeflate(msg.Accept.ConnectHeaders),
+		}
 
 		if !sem.tryAcquire(loopCtx) {
-			acceptLogger.Warn(EventAcceptDropped, "reason", AcceptDroppedSemaphoreFull)
+			if cfg.AcceptOverflow != AcceptOverflowQueue {
+				acceptLogger.Warn(EventAcceptDropped, "reason", AcceptDroppedSemaphoreFull)
+				continue
+			}
+			if queued.Add(1) > int64(queueLimit) {
+				queued.Add(-1)
+				acceptLogger.Warn(EventAcceptDropped, "reason", AcceptDroppedOverflowFull, "limit", queueLimit)
+				if cfg.OnAcceptDropped != nil {
+					cfg.OnAcceptDropped(AcceptDroppedOverflowFull)
+				}
+				continue
+			}
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				job.logger.Debug("accept queued for a free connection slot", "timeout", queueTimeout)
+				ok := sem.acquire(loopCtx, queueTimeout)
+				queued.Add(-1)
+				if !ok {
+					job.logger.Warn(EventAcceptDropped, "reason", AcceptDroppedSemaphoreFull, "queued", true)
+					return
+				}
+				job.logger.Debug("accept acquired", "queued", true)
+				dispatch(job)
+			}()
 			continue
 		}
 		acceptLogger.Debug("accept acquired")
-
-		wg.Add(1)
-		go func(addr string, logger *slog.Logger) {
-			defer wg.Done()
-			defer func() {
-				sem.release()
-				logger.Debug("accept released")
-			}()
-			handleAccept(loopCtx, addr, cfg, logger)
-		}(msg.Accept.Address, acceptLogger)
+		dispatch(job)
 	}
 }
 
+// acceptJob is one queued accept message awaiting a pool worker.
+type acceptJob struct {
+	addr   string
+	logger *slog.Logger
+
+	// deflate is set when the sender offered permessage-deflate; the
+	// rendezvous dial then offers it too.
+	deflate bool
+}
+
 // classifyControlEndReason maps a runControlLoop return error onto one
 // of the ControlEnded* enum values. Used only as a fallback when the
 // renew/ping goroutines have NOT already stored a more specific cause
@@ -363,7 +620,18 @@ func dialAuthFailed(resp *http.Response) bool {
 	return resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden
 }
 
-func handleAccept(ctx context.Context, addr string, cfg ControlConfig, logger *slog.Logger) {
+func handleAccept(ctx context.Context, job acceptJob, cfg ControlConfig) {
+	if ws, wire := dialAccept(ctx, job, cfg); ws != nil {
+		serveAccept(ctx, ws, wire, cfg)
+	}
+}
+
+// dialAccept dials the rendezvous address from an accept message. It
+// returns nil (after logging accept_dropped) when the dial fails. The
+// WireCounter is non-nil when the rendezvous negotiated
+// permessage-deflate.
+func dialAccept(ctx context.Context, job acceptJob, cfg ControlConfig) (*websocket.Conn, *WireCounter) {
+	logger := job.logger
 	logger.Debug("accept dial started")
 	dialCtx, dialCancel := context.WithTimeout(ctx, cfg.DialTimeout)
 	defer dialCancel()
@@ -371,7 +639,14 @@ func handleAccept(ctx context.Context, addr string, cfg ControlConfig, logger *s
 	if logger.Enabled(ctx, slog.LevelDebug) {
 		dialCtx, trace = newDialTrace(dialCtx, time.Now())
 	}
-	ws, resp, err := websocket.Dial(dialCtx, addr, cfg.Options.dialOptions())
+	opts := cfg.Options
+	opts.Compression = job.deflate
+	var wire *WireCounter
+	if job.deflate {
+		wire = new(WireCounter)
+		dialCtx = WithWireCounter(dialCtx, wire)
+	}
+	ws, resp, err := websocket.Dial(dialCtx, job.addr, opts.dialOptions(cfg.Endpoint))
 	if err != nil {
 		reason := AcceptDroppedDialFailed
 		trace.log(ctx, logger, "accept rendezvous trace (dial failed)")
@@ -379,20 +654,39 @@ func handleAccept(ctx context.Context, addr string, cfg ControlConfig, logger *s
 			reason = AcceptDroppedAuthFailed
 		}
 		logger.Warn(EventAcceptDropped, "reason", reason, "error", sanitizeErr(err))
-		return
+		return nil, nil
 	}
 	trace.log(ctx, logger, "accept rendezvous trace")
+	ws.SetReadLimit(cfg.readLimit())
+	logTLSState(ctx, logger, resp, "accept rendezvous tls negotiated")
 	logger.Debug("accept dial complete", "ok", true)
-	defer func() { _ = ws.CloseNow() }()
-
 	logger.Info(EventAcceptOK)
+	MarkDeflate(dialCtx, resp)
+	if wire != nil && !wire.Deflate() {
+		wire = nil
+	}
+	return ws, wire
+}
 
+// serveAccept runs the Handler on an established rendezvous connection
+// and closes it afterwards. A non-nil wire is attached to the Handler's
+// context (see WireCounterFrom).
+func serveAccept(ctx context.Context, ws *websocket.Conn, wire *WireCounter, cfg ControlConfig) {
+	defer func() { _ = ws.CloseNow() }()
+	if wire != nil {
+		ctx = WithWireCounter(ctx, wire)
+	}
 	cfg.Handler(ctx, ws)
 	_ = ws.Close(websocket.StatusNormalClosure, "done")
 }
 
 const maxRenewRetries = 3
 
+// renewRetryJitter is the fraction of each renew retry delay that is
+// randomised (see jitterDelay), so listeners whose renewals fail
+// together, as when Entra ID has a blip, do not retry in lockstep.
+const renewRetryJitter = 0.5
+
 func renewLoop(ctx context.Context, ws *websocket.Conn, resURI string, tp TokenProvider, logger *slog.Logger, cancel context.CancelCauseFunc, state *loopState, interval time.Duration) {
 	// tokenMintedAt drives the expires_in_seconds attribute on
 	// renew_attempted and the new_expires_in_seconds attribute on
@@ -402,7 +696,7 @@ func renewLoop(ctx context.Context, ws *websocket.Conn, resURI string, tp TokenP
 	// until the current token expires" estimate.
 	//
 	// The estimate is computed against the SAS-token validity window
-	// (tokenExpiry = 1h, the value passed to NewSASToken). For Entra
+	// (tokenLifetime: the SAS provider's Expiry, 1h by default). For Entra
 	// credentials the actual on-wire token lifetime comes from the
 	// credential and may differ from 1h; the attribute is therefore
 	// best understood as "seconds until the listener will rotate"
@@ -448,11 +742,11 @@ func renewOnce(ctx context.Context, ws *websocket.Conn, resURI string, tp TokenP
 					"error", ctx.Err(),
 					"code", RenewFailedContextCancel)
 				return time.Time{}, ctx.Err()
-			case <-time.After(time.Duration(attempt-1) * 5 * time.Second):
+			case <-time.After(jitterDelay(time.Duration(attempt-1)*5*time.Second, renewRetryJitter)):
 			}
 		}
 
-		expiresInSec := int64(time.Until(currentTokenMintedAt.Add(tokenExpiry)).Seconds())
+		expiresInSec := int64(time.Until(currentTokenMintedAt.Add(tokenLifetime(tp))).Seconds())
 		logger.Info(EventRenewAttempted,
 			"attempt", attempt,
 			"expires_in_seconds", expiresInSec)
@@ -477,7 +771,7 @@ func renewOnce(ctx context.Context, ws *websocket.Conn, resURI string, tp TokenP
 		now := time.Now()
 		logger.Info(EventRenewOK,
 			"attempt", attempt,
-			"new_expires_in_seconds", int64(tokenExpiry.Seconds()),
+			"new_expires_in_seconds", int64(tokenLifetime(tp).Seconds()),
 			"elapsed_ms", time.Since(start).Milliseconds())
 		return now, nil
 	}
@@ -493,7 +787,7 @@ func renewOnce(ctx context.Context, ws *websocket.Conn, resURI string, tp TokenP
 	return time.Time{}, lastErr
 }
 
-func pingLoop(ctx context.Context, ws *websocket.Conn, logger *slog.Logger, cancel context.CancelCauseFunc, state *loopState, interval time.Duration) {
+func pingLoop(ctx context.Context, ws *websocket.Conn, logger *slog.Logger, cancel context.CancelCauseFunc, state *loopState, interval, timeout time.Duration) {
 	ticker := time.NewTicker(interval)
 	defer ticker.Stop()
 	for {
@@ -501,7 +795,7 @@ func pingLoop(ctx context.Context, ws *websocket.Conn, logger *slog.Logger, canc
 		case <-ctx.Done():
 			return
 		case <-ticker.C:
-			pingCtx, pingCancel := context.WithTimeout(ctx, pingTimeout)
+			pingCtx, pingCancel := context.WithTimeout(ctx, timeout)
 			err := ws.Ping(pingCtx)
 			pingCancel()
 			if err != nil {
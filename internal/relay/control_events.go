@@ -35,12 +35,14 @@ const (
 	AcceptDroppedSemaphoreFull = "semaphore_full"
 	AcceptDroppedDialFailed    = "dial_failed"
 	AcceptDroppedAuthFailed    = "auth_failed"
+	AcceptDroppedQueueFull     = "queue_full"
+	AcceptDroppedOverflowFull  = "overflow_full"
 )
 
 // control_ended.reason values. A small enum so an operator query
 // ("give me every loop that ended because dial failed") matches one
-// fixed string. Forced-reconnect causes (renew_failed, ping_failed)
-// are surfaced here separately from the read-loop's wrapped
+// fixed string. Forced-reconnect causes (renew_failed, ping_failed,
+// idle_reconnect) are surfaced here separately from the read-loop's wrapped
 // context.Canceled return — see runControlLoop's endCause tracking.
 const (
 	ControlEndedDialFailed       = "dial_failed"
@@ -50,4 +52,17 @@ const (
 	ControlEndedContextCancelled = "context_cancelled"
 	ControlEndedRenewFailed      = "renew_failed"
 	ControlEndedPingFailed       = "ping_failed"
+	ControlEndedIdleReconnect    = "idle_reconnect"
 )
+
+// ControlError is the error a control-channel session ended with,
+// tagged with its control_ended reason so callers of ControlConfig.OnError
+// can tell auth failures from network ones without parsing messages.
+type ControlError struct {
+	Reason string // one of the ControlEnded* values
+	Err    error
+}
+
+func (e *ControlError) Error() string { return e.Err.Error() }
+
+func (e *ControlError) Unwrap() error { return e.Err }
@@ -0,0 +1,94 @@
+package relay
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/coder/websocket"
+)
+
+// TestRunControlLoop_NoGoroutineLeak starts several control loops
+// against a control server that never sends anything, waits until every
+// loop is connected (ping + renew goroutines running), cancels them all,
+// and asserts the process-wide goroutine count returns to its baseline.
+func TestRunControlLoop_NoGoroutineLeak(t *testing.T) {
+	useInsecureTransport(t)
+
+	const loops = 8
+
+	baseline := runtime.NumGoroutine()
+
+	controlSrv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ws, err := websocket.Accept(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer ws.CloseNow()
+		for {
+			if _, _, err := ws.Read(r.Context()); err != nil {
+				return
+			}
+		}
+	}))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	connected := make(chan struct{}, loops)
+	var wg sync.WaitGroup
+	for range loops {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			cfg := ControlConfig{
+				Endpoint:      testEndpoint(controlSrv),
+				EntityPath:    "test-entity",
+				TokenProvider: &mockTokenProvider{token: "test-token"},
+				Handler:       func(context.Context, *websocket.Conn) {},
+				DialTimeout:   2 * time.Second,
+				Logger:        discardLogger(),
+				OnConnect:     func() { connected <- struct{}{} },
+			}
+			_, _ = runControlLoop(ctx, cfg)
+		}()
+	}
+
+	timeout := time.After(5 * time.Second)
+	for range loops {
+		select {
+		case <-connected:
+		case <-timeout:
+			cancel()
+			t.Fatal("control loops did not all connect")
+		}
+	}
+	// Each connected loop runs at least its renew and ping goroutines.
+	if got := runtime.NumGoroutine() - baseline; got < 2*loops {
+		t.Errorf("goroutines = %d above baseline while connected, want at least %d", got, 2*loops)
+	}
+
+	cancel()
+	wg.Wait()
+	controlSrv.Close()
+
+	waitForGoroutines(t, baseline, 5*time.Second)
+	if n := runtime.NumGoroutine(); n > baseline {
+		buf := make([]byte, 1<<20)
+		buf = buf[:runtime.Stack(buf, true)]
+		t.Fatalf("goroutines = %d after teardown, baseline %d\n%s", n, baseline, buf)
+	}
+}
+
+// waitForGoroutines polls until the goroutine count is at or below
+// want, or timeout elapses. Goroutine exit after close/cancel is
+// asynchronous, so a single sample would be flaky.
+func waitForGoroutines(t *testing.T, want int, timeout time.Duration) {
+	t.Helper()
+	deadline := time.Now().Add(timeout)
+	for runtime.NumGoroutine() > want && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -116,7 +116,7 @@ func TestHandleAccept(t *testing.T) {
 		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 		defer cancel()
 
-		handleAccept(ctx, "wss://"+testEndpoint(rendezvousSrv), cfg, discardLogger())
+		handleAccept(ctx, acceptJob{addr: "wss://" + testEndpoint(rendezvousSrv), logger: discardLogger()}, cfg)
 
 		select {
 		case <-handlerCalled:
@@ -139,7 +139,7 @@ func TestHandleAccept(t *testing.T) {
 		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 		defer cancel()
 
-		handleAccept(ctx, "ws://127.0.0.1:1", cfg, logger)
+		handleAccept(ctx, acceptJob{addr: "ws://127.0.0.1:1", logger: logger}, cfg)
 
 		records := rec.records(t)
 		var dropped map[string]any
@@ -156,6 +156,44 @@ func TestHandleAccept(t *testing.T) {
 			t.Errorf("accept_dropped.reason = %v, want %q", dropped["reason"], AcceptDroppedDialFailed)
 		}
 	})
+
+	t.Run("oversized message fails the read", func(t *testing.T) {
+		rendezvousSrv := tlsServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ws, err := websocket.Accept(w, r, nil)
+			if err != nil {
+				return
+			}
+			defer ws.CloseNow()
+			_ = ws.Write(r.Context(), websocket.MessageBinary, make([]byte, 1024))
+			_ = ws.Write(r.Context(), websocket.MessageBinary, make([]byte, 4096))
+			_, _, _ = ws.Read(r.Context())
+		}))
+
+		readErrs := make(chan error, 2)
+		cfg := ControlConfig{
+			DialTimeout:    5 * time.Second,
+			Logger:         discardLogger(),
+			MaxMessageSize: 2048,
+			Handler: func(ctx context.Context, ws *websocket.Conn) {
+				for range 2 {
+					_, _, err := ws.Read(ctx)
+					readErrs <- err
+				}
+			},
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+
+		handleAccept(ctx, acceptJob{addr: "wss://" + testEndpoint(rendezvousSrv), logger: discardLogger()}, cfg)
+
+		if err := <-readErrs; err != nil {
+			t.Errorf("read under the limit: %v", err)
+		}
+		if err := <-readErrs; !errors.Is(err, websocket.ErrMessageTooBig) {
+			t.Errorf("read over the limit = %v, want ErrMessageTooBig", err)
+		}
+	})
 }
 
 // ---------- TestRenewOnce ----------
@@ -383,7 +421,7 @@ func TestPingLoop(t *testing.T) {
 			}
 		}))
 
-		ctx, cancel := context.WithTimeout(context.Background(), pingInterval+pingTimeout+10*time.Second)
+		ctx, cancel := context.WithTimeout(context.Background(), defaultPingInterval+defaultPingTimeout+10*time.Second)
 		defer cancel()
 
 		ws, _, err := websocket.Dial(ctx, "wss://"+testEndpoint(srv), nil)
@@ -407,13 +445,13 @@ func TestPingLoop(t *testing.T) {
 			pingLoop(loopCtx, ws, discardLogger(), func(cause error) {
 				close(cancelCalled)
 				loopCancel(cause)
-			}, &loopState{}, pingInterval)
+			}, &loopState{}, defaultPingInterval, defaultPingTimeout)
 		}()
 
 		select {
 		case <-cancelCalled:
 			// success - ping failure triggered cancel
-		case <-time.After(pingInterval + pingTimeout + 5*time.Second):
+		case <-time.After(defaultPingInterval + defaultPingTimeout + 5*time.Second):
 			t.Fatal("cancel was not called after ping failure")
 		}
 
@@ -450,7 +488,7 @@ func TestPingLoop(t *testing.T) {
 			defer close(done)
 			pingLoop(loopCtx, ws, discardLogger(), func(cause error) {
 				t.Errorf("cancel should not be called on context cancel; cause=%v", cause)
-			}, &loopState{}, pingInterval)
+			}, &loopState{}, defaultPingInterval, defaultPingTimeout)
 		}()
 
 		loopCancel(nil)
@@ -605,7 +643,7 @@ func TestPingLoop_StampsCauseControlError(t *testing.T) {
 		t.Fatalf("dial: %v", err)
 	}
 	// Close the WS so the next ws.Ping fails fast without waiting
-	// out pingTimeout.
+	// out the ping timeout.
 	_ = ws.CloseNow()
 
 	loopCtx, loopCancel := context.WithCancelCause(ctx)
@@ -614,7 +652,7 @@ func TestPingLoop_StampsCauseControlError(t *testing.T) {
 	done := make(chan struct{})
 	go func() {
 		defer close(done)
-		pingLoop(loopCtx, ws, discardLogger(), loopCancel, &loopState{}, 50*time.Millisecond)
+		pingLoop(loopCtx, ws, discardLogger(), loopCancel, &loopState{}, 50*time.Millisecond, defaultPingTimeout)
 	}()
 
 	select {
@@ -628,6 +666,52 @@ func TestPingLoop_StampsCauseControlError(t *testing.T) {
 	<-done
 }
 
+// TestPingLoop_HonoursTimeout verifies that a ping the peer never
+// answers ends the loop after the configured timeout rather than the
+// default.
+func TestPingLoop_HonoursTimeout(t *testing.T) {
+	useInsecureTransport(t)
+
+	// The server never reads, so it never answers pings.
+	srv := tlsServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ws, err := websocket.Accept(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer ws.CloseNow()
+		<-r.Context().Done()
+	}))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	ws, _, err := websocket.Dial(ctx, "wss://"+testEndpoint(srv), nil)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer ws.CloseNow()
+
+	loopCtx, loopCancel := context.WithCancelCause(ctx)
+	defer loopCancel(nil)
+
+	state := &loopState{}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		pingLoop(loopCtx, ws, discardLogger(), loopCancel, state, 50*time.Millisecond, 100*time.Millisecond)
+	}()
+
+	select {
+	case <-loopCtx.Done():
+	case <-time.After(defaultPingTimeout / 2):
+		t.Fatal("pingLoop did not give up on an unanswered ping within the configured timeout")
+	}
+	<-done
+	if reason, _ := state.load(); reason != ControlEndedPingFailed {
+		t.Errorf("end reason = %q, want %q", reason, ControlEndedPingFailed)
+	}
+}
+
 func TestRunControlLoop(t *testing.T) {
 	useInsecureTransport(t)
 
@@ -1028,6 +1112,51 @@ func TestListenAndServe(t *testing.T) {
 		}
 	})
 
+	t.Run("reports each failure and backoff delay", func(t *testing.T) {
+		type failure struct {
+			err   error
+			delay time.Duration
+		}
+		failures := make(chan failure, 10)
+		var lastErr error
+		cfg := ControlConfig{
+			// Refused port: every attempt fails at the dial.
+			Endpoint:        "127.0.0.1:1",
+			EntityPath:      "test-entity",
+			TokenProvider:   &mockTokenProvider{token: "test-token"},
+			Handler:         func(ctx context.Context, ws *websocket.Conn) {},
+			DialTimeout:     500 * time.Millisecond,
+			Logger:          discardLogger(),
+			ReconnectJitter: -1,
+			OnError:         func(err error) { lastErr = err },
+			OnReconnect: func(delay time.Duration) {
+				failures <- failure{lastErr, delay}
+			},
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		done := make(chan error, 1)
+		go func() { done <- ListenAndServe(ctx, cfg) }()
+
+		for i, want := range []time.Duration{reconnectMin, reconnectMin * reconnectReset} {
+			select {
+			case f := <-failures:
+				var ce *ControlError
+				if !errors.As(f.err, &ce) || ce.Reason != ControlEndedDialFailed {
+					t.Errorf("failure %d: err = %v, want *ControlError with reason %q", i, f.err, ControlEndedDialFailed)
+				}
+				if f.delay != want {
+					t.Errorf("failure %d: delay = %v, want %v", i, f.delay, want)
+				}
+			case <-ctx.Done():
+				t.Fatalf("only %d failures reported", i)
+			}
+		}
+		cancel()
+		<-done
+	})
+
 	t.Run("sets default logger and dial timeout", func(t *testing.T) {
 		ctx, cancel := context.WithCancel(context.Background())
 		cancel() // cancel immediately
@@ -1049,6 +1178,29 @@ func TestListenAndServe(t *testing.T) {
 	})
 }
 
+func TestJitterDelay(t *testing.T) {
+	const d = 8 * time.Second
+	for _, tc := range []struct {
+		frac   float64
+		lo, hi time.Duration
+	}{
+		{frac: -1, lo: d, hi: d},
+		{frac: 0, lo: 0, hi: d},
+		{frac: 0.25, lo: 6 * time.Second, hi: d},
+		{frac: 1, lo: 0, hi: d},
+		{frac: 5, lo: 0, hi: d},
+	} {
+		for range 100 {
+			if got := jitterDelay(d, tc.frac); got < tc.lo || got > tc.hi {
+				t.Fatalf("jitterDelay(%v, %v) = %v, want within [%v, %v]", d, tc.frac, got, tc.lo, tc.hi)
+			}
+		}
+	}
+	if got := jitterDelay(0, 1); got != 0 {
+		t.Errorf("jitterDelay(0, 1) = %v, want 0", got)
+	}
+}
+
 // ---------- TestControlSessionID ----------
 
 // captureLogger returns a slog logger that writes JSON records to the
@@ -1841,3 +1993,309 @@ func TestAcceptID_PresentOnDrop(t *testing.T) {
 		t.Errorf("accept dropped level=%v, want %v (drops are operator-actionable)", got, want)
 	}
 }
+
+// TestRunControlLoop_AcceptWorkerPool sends a burst of accept messages
+// to a listener configured with a small worker pool and asserts that
+// every accept is served while no more than AcceptWorkers rendezvous
+// dials are ever in flight at once.
+func TestRunControlLoop_AcceptWorkerPool(t *testing.T) {
+	useInsecureTransport(t)
+
+	const (
+		workers = 2
+		burst   = 30
+	)
+
+	var inFlight, maxInFlight atomic.Int32
+	rendezvousSrv := tlsServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := inFlight.Add(1)
+		for {
+			m := maxInFlight.Load()
+			if n <= m || maxInFlight.CompareAndSwap(m, n) {
+				break
+			}
+		}
+		// Hold the upgrade briefly so concurrent dials overlap if the
+		// pool does not bound them.
+		time.Sleep(10 * time.Millisecond)
+		inFlight.Add(-1)
+		ws, err := websocket.Accept(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer ws.CloseNow()
+		for {
+			if _, _, err := ws.Read(r.Context()); err != nil {
+				return
+			}
+		}
+	}))
+	rendezvousAddr := "wss://" + testEndpoint(rendezvousSrv)
+
+	var served atomic.Int32
+	allServed := make(chan struct{})
+	controlSrv := tlsServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ws, err := websocket.Accept(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer ws.CloseNow()
+		for i := range burst {
+			data, _ := json.Marshal(map[string]any{
+				"accept": map[string]any{"address": rendezvousAddr, "id": fmt.Sprintf("burst-%d", i)},
+			})
+			if err := ws.Write(r.Context(), websocket.MessageText, data); err != nil {
+				return
+			}
+		}
+		select {
+		case <-allServed:
+		case <-time.After(10 * time.Second):
+		}
+		ws.Close(websocket.StatusNormalClosure, "done")
+	}))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+	defer cancel()
+
+	var dropped atomic.Int32
+	cfg := ControlConfig{
+		Endpoint:      testEndpoint(controlSrv),
+		EntityPath:    "test-entity",
+		TokenProvider: &mockTokenProvider{token: "test-token"},
+		AcceptWorkers: workers,
+		AcceptBacklog: burst,
+		Handler: func(ctx context.Context, ws *websocket.Conn) {
+			if served.Add(1) == burst {
+				close(allServed)
+			}
+		},
+		OnAcceptDropped: func(string) { dropped.Add(1) },
+		DialTimeout:     5 * time.Second,
+		Logger:          discardLogger(),
+	}
+
+	if _, err := runControlLoop(ctx, cfg); err == nil {
+		t.Fatal("expected error from runControlLoop when server closes")
+	}
+	if got := served.Load(); got != burst {
+		t.Errorf("served %d accepts, want %d", got, burst)
+	}
+	if got := maxInFlight.Load(); got > workers {
+		t.Errorf("max concurrent rendezvous dials = %d, want <= %d", got, workers)
+	}
+	if got := dropped.Load(); got != 0 {
+		t.Errorf("dropped %d accepts with a backlog large enough for the burst", got)
+	}
+}
+
+// TestRunControlLoop_AcceptBacklogOverflowDrops fills a one-worker,
+// one-slot pool with stalled rendezvous dials and asserts the overflow
+// is dropped with reason queue_full and reported via OnAcceptDropped.
+func TestRunControlLoop_AcceptBacklogOverflowDrops(t *testing.T) {
+	useInsecureTransport(t)
+
+	const burst = 5
+
+	unblock := make(chan struct{})
+	rendezvousSrv := tlsServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-unblock:
+		case <-r.Context().Done():
+		}
+		http.Error(w, "gone", http.StatusGone)
+	}))
+	rendezvousAddr := "wss://" + testEndpoint(rendezvousSrv)
+
+	drops := make(chan string, burst)
+	controlSrv := tlsServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ws, err := websocket.Accept(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer ws.CloseNow()
+		defer close(unblock)
+		for i := range burst {
+			data, _ := json.Marshal(map[string]any{
+				"accept": map[string]any{"address": rendezvousAddr, "id": fmt.Sprintf("overflow-%d", i)},
+			})
+			if err := ws.Write(r.Context(), websocket.MessageText, data); err != nil {
+				return
+			}
+		}
+		// One accept is in the worker, one in the backlog; the rest
+		// must overflow.
+		deadline := time.After(5 * time.Second)
+		for range burst - 2 {
+			select {
+			case <-drops:
+			case <-deadline:
+				ws.Close(websocket.StatusNormalClosure, "timeout")
+				return
+			}
+		}
+		ws.Close(websocket.StatusNormalClosure, "done")
+	}))
+
+	logger, rec := captureLogger()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	cfg := ControlConfig{
+		Endpoint:        testEndpoint(controlSrv),
+		EntityPath:      "test-entity",
+		TokenProvider:   &mockTokenProvider{token: "test-token"},
+		AcceptWorkers:   1,
+		AcceptBacklog:   1,
+		Handler:         func(context.Context, *websocket.Conn) {},
+		OnAcceptDropped: func(reason string) { drops <- reason },
+		DialTimeout:     5 * time.Second,
+		Logger:          logger,
+	}
+	_, _ = runControlLoop(ctx, cfg)
+
+	var queueFull int
+	for _, r := range rec.records(t) {
+		if r["msg"] == EventAcceptDropped && r["reason"] == AcceptDroppedQueueFull {
+			queueFull++
+		}
+	}
+	if queueFull < burst-2 {
+		t.Errorf("accept_dropped{reason=queue_full} records = %d, want >= %d", queueFull, burst-2)
+	}
+}
+
+// TestRunControlLoop_AcceptOverflow saturates MaxConnections=1 and
+// sends a second accept. In drop mode it is dropped at once; in queue
+// mode it waits and is served when the first connection finishes,
+// while a third accept past AcceptQueueLimit is dropped.
+func TestRunControlLoop_AcceptOverflow(t *testing.T) {
+	useInsecureTransport(t)
+
+	rendezvousSrv := tlsServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ws, err := websocket.Accept(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer ws.CloseNow()
+		for {
+			if _, _, err := ws.Read(r.Context()); err != nil {
+				return
+			}
+		}
+	}))
+	rendezvousAddr := "wss://" + testEndpoint(rendezvousSrv)
+
+	for _, mode := range []string{AcceptOverflowDrop, AcceptOverflowQueue} {
+		t.Run(mode, func(t *testing.T) {
+			sends := make(chan string)
+			controlSrv := tlsServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				ws, err := websocket.Accept(w, r, nil)
+				if err != nil {
+					return
+				}
+				defer ws.CloseNow()
+				for {
+					select {
+					case id := <-sends:
+						data, _ := json.Marshal(map[string]any{
+							"accept": map[string]any{"address": rendezvousAddr, "id": id},
+						})
+						if err := ws.Write(r.Context(), websocket.MessageText, data); err != nil {
+							return
+						}
+					case <-r.Context().Done():
+						return
+					}
+				}
+			}))
+
+			logger, store := newCaptureHandler()
+			ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+			defer cancel()
+
+			var served atomic.Int32
+			entered := make(chan struct{}, 3)
+			finishFirst := make(chan struct{})
+			drops := make(chan string, 3)
+			cfg := ControlConfig{
+				Endpoint:       testEndpoint(controlSrv),
+				EntityPath:     "test-entity",
+				TokenProvider:  &mockTokenProvider{token: "test-token"},
+				MaxConnections: 1,
+				AcceptOverflow: mode,
+				// Queue mode holds one waiting accept; a third is
+				// dropped rather than parked on another goroutine.
+				AcceptQueueLimit: 1,
+				OnAcceptDropped:  func(reason string) { drops <- reason },
+				Handler: func(ctx context.Context, ws *websocket.Conn) {
+					n := served.Add(1)
+					entered <- struct{}{}
+					if n == 1 {
+						select {
+						case <-finishFirst:
+						case <-ctx.Done():
+						}
+					}
+				},
+				DialTimeout: 2 * time.Second,
+				Logger:      logger,
+			}
+			loopDone := make(chan struct{})
+			go func() {
+				defer close(loopDone)
+				_, _ = runControlLoop(ctx, cfg)
+			}()
+			defer func() { cancel(); <-loopDone }()
+
+			sends <- "first"
+			select {
+			case <-entered:
+			case <-time.After(5 * time.Second):
+				t.Fatal("first accept was never served")
+			}
+			sends <- "second"
+
+			switch mode {
+			case AcceptOverflowDrop:
+				if _, ok := store.waitForRecord(EventAcceptDropped, 5*time.Second); !ok {
+					t.Fatal("second accept was not dropped while saturated")
+				}
+				close(finishFirst)
+				select {
+				case <-entered:
+					t.Fatal("dropped accept was served after a slot freed")
+				case <-time.After(200 * time.Millisecond):
+				}
+			case AcceptOverflowQueue:
+				if _, ok := store.waitForRecord("accept queued for a free connection slot", 5*time.Second); !ok {
+					t.Fatal("second accept was not queued while saturated")
+				}
+				sends <- "third"
+				select {
+				case reason := <-drops:
+					if reason != AcceptDroppedOverflowFull {
+						t.Errorf("OnAcceptDropped reason = %q, want %q", reason, AcceptDroppedOverflowFull)
+					}
+				case <-time.After(5 * time.Second):
+					t.Fatal("accept past AcceptQueueLimit was not dropped")
+				}
+				close(finishFirst)
+				select {
+				case <-entered:
+				case <-time.After(5 * time.Second):
+					t.Fatal("queued accept was not served after the first connection finished")
+				}
+				select {
+				case <-entered:
+					t.Fatal("accept dropped at the queue limit was served")
+				case <-time.After(200 * time.Millisecond):
+				}
+				dropped := store.filterByMsg(EventAcceptDropped)
+				if len(dropped) != 1 || dropped[0].attrs["reason"] != AcceptDroppedOverflowFull {
+					t.Errorf("queue mode drops = %+v, want one %s", dropped, AcceptDroppedOverflowFull)
+				}
+			}
+		})
+	}
+}
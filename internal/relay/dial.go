@@ -5,7 +5,6 @@ import (
 	"fmt"
 	"log/slog"
 	"net/http"
-	"net/url"
 	"time"
 
 	"github.com/coder/websocket"
@@ -23,21 +22,18 @@ const (
 // Dial connects to the Azure Relay as a sender, establishing a rendezvous
 // WebSocket connection that will be paired with a listener.
 func Dial(ctx context.Context, endpoint, entityPath string, tp TokenProvider, opts ClientOptions) (*websocket.Conn, error) {
-	resURI := ResourceURI(endpoint, entityPath)
-	token, err := tp.GetToken(ctx, resURI)
+	connectURL, err := opts.actionURL(ctx, tp, endpoint, entityPath, ActionConnect)
 	if err != nil {
 		return nil, fmt.Errorf("get token: %w", err)
 	}
 
-	connectURL := fmt.Sprintf("%s/$hc/%s?sb-hc-action=connect&sb-hc-token=%s",
-		opts.wssBase(endpoint), url.PathEscape(entityPath), url.QueryEscape(token))
-
 	dialCtx, cancel := context.WithTimeout(ctx, defaultDialTimeout)
 	defer cancel()
-	ws, _, err := websocket.Dial(dialCtx, connectURL, opts.dialOptions())
+	ws, resp, err := websocket.Dial(dialCtx, connectURL, opts.dialOptions(endpoint))
 	if err != nil {
-		return nil, fmt.Errorf("dial relay: %w", sanitizeErr(err))
+		return nil, fmt.Errorf("dial relay: %w", claimErr(ActionConnect, resp, opts.sanitizeErr(err)))
 	}
+	MarkDeflate(ctx, resp)
 	return ws, nil
 }
 
@@ -48,7 +44,8 @@ func IsRetryableStatus(code int) bool {
 }
 
 // DialWithRetry is like Dial but retries on transient HTTP 404/503 errors
-// (no active listener) with exponential backoff until ctx expires.
+// (no active listener) with jittered exponential backoff (see
+// ClientOptions.RetryJitter) until ctx expires.
 func DialWithRetry(ctx context.Context, endpoint, entityPath string, tp TokenProvider, opts ClientOptions, logger *slog.Logger) (*websocket.Conn, error) {
 	if logger == nil {
 		logger = slog.Default()
@@ -57,26 +54,24 @@ func DialWithRetry(ctx context.Context, endpoint, entityPath string, tp TokenPro
 
 	delay := retryInitial
 	for {
-		resURI := ResourceURI(endpoint, entityPath)
-		token, err := tp.GetToken(ctx, resURI)
+		connectURL, err := opts.actionURL(ctx, tp, endpoint, entityPath, ActionConnect)
 		if err != nil {
 			logger.Warn("relay dial failed", "error", err)
 			return nil, fmt.Errorf("get token: %w", err)
 		}
 
-		connectURL := fmt.Sprintf("%s/$hc/%s?sb-hc-action=connect&sb-hc-token=%s",
-			opts.wssBase(endpoint), url.PathEscape(entityPath), url.QueryEscape(token))
-
 		dialCtx, cancel := context.WithTimeout(ctx, defaultDialTimeout)
 		var trace *dialTrace
 		if logger.Enabled(ctx, slog.LevelDebug) {
 			dialCtx, trace = newDialTrace(dialCtx, time.Now())
 		}
-		ws, resp, dialErr := websocket.Dial(dialCtx, connectURL, opts.dialOptions())
+		ws, resp, dialErr := websocket.Dial(dialCtx, connectURL, opts.dialOptions(endpoint))
 		cancel()
 
 		if dialErr == nil {
+			MarkDeflate(ctx, resp)
 			trace.log(ctx, logger, "relay rendezvous trace")
+			logTLSState(ctx, logger, resp, "relay rendezvous tls negotiated")
 			logger.Debug("relay connected", "entityPath", entityPath)
 			return ws, nil
 		}
@@ -88,16 +83,18 @@ func DialWithRetry(ctx context.Context, endpoint, entityPath string, tp TokenPro
 
 		// Only retry on 404/503 (no active listener / listener transitioning).
 		if resp == nil || !IsRetryableStatus(resp.StatusCode) {
-			logger.Warn("relay dial failed", "error", sanitizeErr(dialErr))
-			return nil, fmt.Errorf("dial relay: %w", sanitizeErr(dialErr))
+			err := claimErr(ActionConnect, resp, opts.sanitizeErr(dialErr))
+			logger.Warn("relay dial failed", "error", err)
+			return nil, fmt.Errorf("dial relay: %w", err)
 		}
 
-		logger.Warn("relay dial failed (retrying)", "status", resp.StatusCode, "delay", delay, "error", sanitizeErr(dialErr))
+		sleep := jitterDelay(delay, opts.RetryJitter)
+		logger.Warn("relay dial failed (retrying)", "status", resp.StatusCode, "delay", sleep, "error", opts.sanitizeErr(dialErr))
 
 		select {
 		case <-ctx.Done():
 			return nil, fmt.Errorf("dial relay: %w", ctx.Err())
-		case <-time.After(delay):
+		case <-time.After(sleep):
 		}
 
 		delay = min(delay*retryMultiplier, retryMax)
@@ -7,6 +7,7 @@ import (
 	"fmt"
 	"io"
 	"log/slog"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
@@ -86,6 +87,66 @@ func TestDial(t *testing.T) {
 		}
 	})
 
+	t.Run("extra query parameters", func(t *testing.T) {
+		var gotQuery url.Values
+		srv := dialTestServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			gotQuery = r.URL.Query()
+			ws, err := websocket.Accept(w, r, nil)
+			if err != nil {
+				return
+			}
+			defer ws.CloseNow()
+			<-r.Context().Done()
+		}))
+
+		tp := &mockTokenProvider{token: "test-sas-token"}
+		endpoint := strings.TrimPrefix(srv.URL, "https://")
+		opts := ClientOptions{ExtraQuery: url.Values{
+			"sb-hc-diag":   {"on"},
+			"custom":       {"a", "b"},
+			"sb-hc-token":  {"attacker-token"},
+			"SB-HC-ACTION": {"listen"},
+		}}
+
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+
+		ws, err := Dial(ctx, endpoint, "my-entity", tp, opts)
+		if err != nil {
+			t.Fatalf("Dial: %v", err)
+		}
+		defer ws.CloseNow()
+
+		if got := gotQuery.Get("sb-hc-diag"); got != "on" {
+			t.Errorf("sb-hc-diag = %q, want %q", got, "on")
+		}
+		if got := gotQuery["custom"]; len(got) != 2 || got[0] != "a" || got[1] != "b" {
+			t.Errorf("custom = %q, want [a b]", got)
+		}
+		// Security-critical parameters cannot be overridden or duplicated.
+		if got := gotQuery["sb-hc-token"]; len(got) != 1 || got[0] != "test-sas-token" {
+			t.Errorf("sb-hc-token = %q, want only the provider token", got)
+		}
+		if got := gotQuery["sb-hc-action"]; len(got) != 1 || got[0] != "connect" {
+			t.Errorf("sb-hc-action = %q, want [connect]", got)
+		}
+		if _, ok := gotQuery["SB-HC-ACTION"]; ok {
+			t.Error("case-variant of sb-hc-action reached the relay")
+		}
+	})
+
+	t.Run("extra query values redacted from errors", func(t *testing.T) {
+		tp := &mockTokenProvider{token: "test-token"}
+		opts := ClientOptions{ExtraQuery: url.Values{"diag-key": {"SECRETVALUE"}}}
+		err := opts.sanitizeErr(fmt.Errorf(`failed to WebSocket dial: "wss://h/$hc/e?sb-hc-action=connect&sb-hc-token=%s&diag-key=SECRETVALUE"`, tp.token))
+		if strings.Contains(err.Error(), "SECRETVALUE") || strings.Contains(err.Error(), tp.token) {
+			t.Errorf("error not sanitized: %v", err)
+		}
+		if !strings.Contains(err.Error(), "diag-key=REDACTED") {
+			t.Errorf("expected diag-key=REDACTED in %v", err)
+		}
+	})
+
 	t.Run("token provider error", func(t *testing.T) {
 		tp := &mockTokenProvider{err: fmt.Errorf("auth failed")}
 
@@ -424,6 +485,54 @@ func TestDialWithRetry(t *testing.T) {
 		}
 	})
 
+	t.Run("jitters the retry delay", func(t *testing.T) {
+		orig := jitterSource
+		jitterSource = func() float64 { return 0.75 }
+		t.Cleanup(func() { jitterSource = orig })
+
+		for _, tc := range []struct {
+			jitter float64
+			want   string
+		}{
+			{0, "delay=250ms"},   // full jitter takes 3/4 of the 1s delay
+			{0.5, "delay=625ms"}, // half jitter takes 3/8
+			{-1, "delay=1s"},     // disabled
+		} {
+			var mu sync.Mutex
+			attempts := 0
+			srv := dialTestServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				mu.Lock()
+				attempts++
+				n := attempts
+				mu.Unlock()
+				if n == 1 {
+					w.WriteHeader(http.StatusServiceUnavailable)
+					return
+				}
+				ws, err := websocket.Accept(w, r, nil)
+				if err != nil {
+					return
+				}
+				defer ws.CloseNow()
+				<-r.Context().Done()
+			}))
+
+			var logBuf strings.Builder
+			logger := slog.New(slog.NewTextHandler(&logBuf, nil))
+			tp := &mockTokenProvider{token: "test-token"}
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			ws, err := DialWithRetry(ctx, strings.TrimPrefix(srv.URL, "https://"), "test-entity", tp, ClientOptions{RetryJitter: tc.jitter}, logger)
+			cancel()
+			if err != nil {
+				t.Fatalf("RetryJitter=%v: DialWithRetry: %v", tc.jitter, err)
+			}
+			ws.CloseNow()
+			if !strings.Contains(logBuf.String(), tc.want) {
+				t.Errorf("RetryJitter=%v: retry log missing %s:\n%s", tc.jitter, tc.want, logBuf.String())
+			}
+		}
+	})
+
 	t.Run("GetToken failure on retry returns immediately", func(t *testing.T) {
 		var mu sync.Mutex
 		attempts := 0
@@ -459,3 +568,64 @@ func TestDialWithRetry(t *testing.T) {
 		}
 	})
 }
+
+// connectProxy starts a stub HTTP proxy that tunnels CONNECT requests
+// and reports each one's target on the returned channel.
+func connectProxy(t *testing.T) (*url.URL, <-chan string) {
+	t.Helper()
+	seen := make(chan string, 4)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodConnect {
+			http.Error(w, "CONNECT only", http.StatusMethodNotAllowed)
+			return
+		}
+		seen <- r.Host
+		upstream, err := net.Dial("tcp", r.Host)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		defer upstream.Close()
+		conn, _, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		_, _ = io.WriteString(conn, "HTTP/1.1 200 Connection established\r\n\r\n")
+		go func() { _, _ = io.Copy(upstream, conn) }()
+		_, _ = io.Copy(conn, upstream)
+	}))
+	t.Cleanup(srv.Close)
+	u, _ := url.Parse(srv.URL)
+	return u, seen
+}
+
+func TestDial_Proxy(t *testing.T) {
+	srv := dialTestServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ws, err := websocket.Accept(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer ws.CloseNow()
+		<-r.Context().Done()
+	}))
+	proxy, seen := connectProxy(t)
+	endpoint := strings.TrimPrefix(srv.URL, "https://")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	ws, err := Dial(ctx, endpoint, "my-entity", &mockTokenProvider{token: "t"}, ClientOptions{Proxy: proxy})
+	if err != nil {
+		t.Fatalf("Dial through proxy: %v", err)
+	}
+	defer ws.CloseNow()
+
+	select {
+	case host := <-seen:
+		if host != endpoint {
+			t.Errorf("proxy CONNECT to %q, want %q", host, endpoint)
+		}
+	default:
+		t.Error("dial did not go through the proxy")
+	}
+}
@@ -0,0 +1,43 @@
+package relay
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+)
+
+// idleSamples is how many times per BridgeOptions.IdleTimeout the idle
+// detector looks for traffic, so an idle bridge is closed at most
+// IdleTimeout/idleSamples after the timeout has passed.
+const idleSamples = 4
+
+// watchIdle records when either byte counter last moved and calls
+// onIdle, then returns, once neither has moved for timeout. It returns
+// without calling onIdle when ctx ends.
+func watchIdle(ctx context.Context, a, b *atomic.Int64, timeout time.Duration, onIdle func()) {
+	step := timeout / idleSamples
+	if step <= 0 {
+		step = timeout
+	}
+	ticker := time.NewTicker(step)
+	defer ticker.Stop()
+
+	seen := a.Load() + b.Load()
+	lastActive := time.Now()
+	for {
+		var now time.Time
+		select {
+		case <-ctx.Done():
+			return
+		case now = <-ticker.C:
+		}
+		if n := a.Load() + b.Load(); n != seen {
+			seen, lastActive = n, now
+			continue
+		}
+		if now.Sub(lastActive) >= timeout {
+			onIdle()
+			return
+		}
+	}
+}
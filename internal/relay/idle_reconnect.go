@@ -0,0 +1,52 @@
+package relay
+
+import (
+	"context"
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"github.com/philsphicas/aztunnel/internal/bridgecause"
+)
+
+// controlActivity records when the control channel last delivered a
+// message. The read loop touches it after every successful read.
+type controlActivity struct {
+	last atomic.Int64 // UnixNano
+}
+
+func (a *controlActivity) touch() { a.last.Store(time.Now().UnixNano()) }
+
+func (a *controlActivity) since() time.Duration {
+	return time.Since(time.Unix(0, a.last.Load()))
+}
+
+// idleReconnectLoop forces a control-channel reconnect once no message
+// has arrived for idle. Pings are deliberately not counted: the wedged
+// listen sockets this guards against keep answering pings while the
+// relay stops routing accepts to them. A window that expires while
+// connections are still in flight is extended rather than acted on,
+// since the reconnect would tear those bridges down; the check runs
+// again after another idle period.
+func idleReconnectLoop(ctx context.Context, activity *controlActivity, sem *connSemaphore, cancel context.CancelCauseFunc, state *loopState, idle time.Duration) {
+	timer := time.NewTimer(idle)
+	defer timer.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-timer.C:
+		}
+		quiet := activity.since()
+		switch {
+		case quiet < idle:
+			timer.Reset(idle - quiet)
+		case sem.inUse() > 0:
+			timer.Reset(idle)
+		default:
+			state.setEnd(ControlEndedIdleReconnect, fmt.Errorf("no control messages for %s", quiet.Round(time.Millisecond)))
+			cancel(bridgecause.CauseControlError)
+			return
+		}
+	}
+}
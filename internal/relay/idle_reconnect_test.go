@@ -0,0 +1,116 @@
+package relay
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/coder/websocket"
+
+	"github.com/philsphicas/aztunnel/internal/bridgecause"
+)
+
+// TestListenAndServe_IdleReconnect runs the listener against a control
+// server that accepts the dial and then never sends anything. With a
+// short IdleReconnect the loop must give up on the quiet channel and
+// dial again, reporting control_ended{reason=idle_reconnect}.
+func TestListenAndServe_IdleReconnect(t *testing.T) {
+	useInsecureTransport(t)
+
+	var dials atomic.Int32
+	redialed := make(chan struct{})
+	controlSrv := tlsServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ws, err := websocket.Accept(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer ws.CloseNow()
+		if dials.Add(1) == 2 {
+			close(redialed)
+		}
+		// Quiet: keep reading (so pings are answered) but never
+		// send an accept.
+		for {
+			if _, _, err := ws.Read(r.Context()); err != nil {
+				return
+			}
+		}
+	}))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	logger, rec := captureLogger()
+	cfg := ControlConfig{
+		Endpoint:      testEndpoint(controlSrv),
+		EntityPath:    "test-entity",
+		TokenProvider: &mockTokenProvider{token: "test-token"},
+		Handler:       func(context.Context, *websocket.Conn) {},
+		DialTimeout:   2 * time.Second,
+		Logger:        logger,
+		IdleReconnect: 200 * time.Millisecond,
+	}
+
+	done := make(chan error, 1)
+	go func() { done <- ListenAndServe(ctx, cfg) }()
+
+	select {
+	case <-redialed:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("control channel was not re-dialed after going quiet (dials=%d)", dials.Load())
+	}
+	cancel()
+	<-done
+
+	var reason string
+	for _, r := range rec.records(t) {
+		if r["msg"] == EventControlEnded {
+			reason, _ = r["reason"].(string)
+			break
+		}
+	}
+	if reason != ControlEndedIdleReconnect {
+		t.Errorf("first control_ended reason = %q, want %q", reason, ControlEndedIdleReconnect)
+	}
+}
+
+func TestIdleReconnectLoop_WaitsForInFlight(t *testing.T) {
+	const idle = 50 * time.Millisecond
+	activity := &controlActivity{}
+	activity.touch()
+	sem := newConnSemaphore(0)
+	if !sem.tryAcquire(context.Background()) {
+		t.Fatal("tryAcquire failed")
+	}
+
+	ctx, cancel := context.WithCancelCause(context.Background())
+	defer cancel(nil)
+	state := &loopState{}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		idleReconnectLoop(ctx, activity, sem, cancel, state, idle)
+	}()
+
+	select {
+	case <-done:
+		t.Fatal("idle reconnect fired while a connection was in flight")
+	case <-time.After(4 * idle):
+	}
+
+	sem.release()
+	select {
+	case <-done:
+	case <-time.After(5 * idle):
+		t.Fatal("idle reconnect did not fire after the connection released")
+	}
+	if cause, _ := state.load(); cause != ControlEndedIdleReconnect {
+		t.Errorf("cause = %q, want %q", cause, ControlEndedIdleReconnect)
+	}
+	if !errors.Is(context.Cause(ctx), bridgecause.CauseControlError) {
+		t.Errorf("context cause = %v, want CauseControlError", context.Cause(ctx))
+	}
+}
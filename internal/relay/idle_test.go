@@ -0,0 +1,117 @@
+package relay
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/coder/websocket"
+	"github.com/philsphicas/aztunnel/internal/bridgecause"
+)
+
+type idleOutcome struct {
+	r   BridgeResult
+	err error
+}
+
+// idleBridge starts a Bridge with the given IdleTimeout against a
+// draining WebSocket peer, and writes one byte to the local side every
+// interval until the test ends (never when interval is zero). It
+// returns the channel the outcome arrives on and a func that closes
+// the local side.
+func idleBridge(t *testing.T, timeout, interval time.Duration) (<-chan idleOutcome, func()) {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ws, err := websocket.Accept(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer ws.CloseNow()
+		for {
+			if _, _, err := ws.Read(r.Context()); err != nil {
+				return
+			}
+		}
+	}))
+	t.Cleanup(srv.Close)
+
+	ws, _, err := websocket.Dial(context.Background(), "ws"+strings.TrimPrefix(srv.URL, "http"), nil)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	t.Cleanup(func() { _ = ws.CloseNow() })
+
+	clientConn, serverConn := net.Pipe()
+	t.Cleanup(func() { _ = serverConn.Close() })
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	t.Cleanup(cancel)
+
+	ch := make(chan idleOutcome, 1)
+	go func() {
+		r, err := BridgeWithOptions(ctx, ws, serverConn, BridgeOptions{IdleTimeout: timeout})
+		ch <- idleOutcome{r, err}
+	}()
+	if interval > 0 {
+		go func() {
+			for {
+				if _, err := clientConn.Write([]byte{'x'}); err != nil {
+					return
+				}
+				select {
+				case <-ctx.Done():
+					return
+				case <-time.After(interval):
+				}
+			}
+		}()
+	}
+	return ch, func() { _ = clientConn.Close() }
+}
+
+func TestBridge_IdleTimeout_SilentEnds(t *testing.T) {
+	ch, closeLocal := idleBridge(t, 100*time.Millisecond, 0)
+	defer closeLocal()
+
+	select {
+	case o := <-ch:
+		if o.r.EndCause != "idle_timeout" {
+			t.Errorf("EndCause = %q, want %q", o.r.EndCause, "idle_timeout")
+		}
+		if !errors.Is(o.err, bridgecause.CauseIdleTimeout) {
+			t.Errorf("err = %v, want CauseIdleTimeout", o.err)
+		}
+		if o.r.TCPToWS != nil {
+			t.Errorf("TCPToWS = %v, want nil (the induced deadline is not a local failure)", o.r.TCPToWS)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("idle bridge was not terminated")
+	}
+}
+
+func TestBridge_IdleTimeout_ActiveSurvives(t *testing.T) {
+	timeout := 100 * time.Millisecond
+	ch, closeLocal := idleBridge(t, timeout, 20*time.Millisecond)
+	select {
+	case o := <-ch:
+		t.Fatalf("bridge ended early with cause %q", o.r.EndCause)
+	case <-time.After(5 * timeout):
+	}
+	closeLocal()
+	select {
+	case o := <-ch:
+		if o.r.EndCause != "local_close" {
+			t.Errorf("EndCause = %q, want %q", o.r.EndCause, "local_close")
+		}
+		if o.err != nil {
+			t.Errorf("err = %v, want nil", o.err)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("bridge did not terminate after local close")
+	}
+}
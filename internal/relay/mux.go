@@ -0,0 +1,682 @@
+package relay
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/coder/websocket"
+
+	"github.com/philsphicas/aztunnel/internal/bridgecause"
+	"github.com/philsphicas/aztunnel/internal/protocol"
+)
+
+// muxMaxStreams bounds the streams the sender may have open on one
+// mux at the listener; a MuxOpen beyond it is reset. It also bounds
+// the streams waiting for Accept.
+const muxMaxStreams = 256
+
+// ErrMuxClosed is returned by stream and Mux operations once the mux
+// WebSocket has gone away.
+var ErrMuxClosed = errors.New("mux closed")
+
+// errStreamReset is returned by a stream the peer reset.
+var errStreamReset = errors.New("mux stream reset")
+
+// Mux runs the protocol.ModeMux frame protocol over one WebSocket,
+// carrying many streams at once. The side that dialed the rendezvous
+// (the sender) opens streams with Open; the other side takes them
+// with Accept.
+//
+// Each stream has its own send window (protocol.MuxWindow), so a slow
+// reader on one stream stalls only that stream's writer and never the
+// WebSocket the others share.
+type Mux struct {
+	ws     *websocket.Conn
+	ctx    context.Context
+	cancel context.CancelCauseFunc
+	client bool
+	logger *slog.Logger
+
+	mu      sync.Mutex
+	streams map[uint32]*MuxStream
+	nextID  uint32
+
+	accept chan *MuxStream
+	done   chan struct{}
+	ka     *keepalive
+}
+
+// NewMux starts the mux frame protocol on ws once the ModeMux
+// envelope exchange has succeeded. client is true on the sender,
+// which opens streams. The mux runs until ctx ends, Close is called,
+// or the WebSocket fails; it pings the WebSocket meanwhile so Azure
+// Relay does not drop it while idle. Only the ping options of opts
+// apply; each stream takes its own at BridgeStream.
+func NewMux(ctx context.Context, ws *websocket.Conn, client bool, opts BridgeOptions, logger *slog.Logger) *Mux {
+	ctx, cancel := context.WithCancelCause(ctx)
+	m := &Mux{
+		ws:      ws,
+		ctx:     ctx,
+		cancel:  cancel,
+		client:  client,
+		logger:  logger,
+		streams: make(map[uint32]*MuxStream),
+		nextID:  1,
+		accept:  make(chan *MuxStream, muxMaxStreams),
+		done:    make(chan struct{}),
+		ka:      newKeepalive(opts),
+	}
+	pingDone := make(chan struct{})
+	go func() {
+		defer close(pingDone)
+		m.ka.run(ctx, ws)
+	}()
+	go func() {
+		defer close(m.done)
+		err := m.readLoop()
+		m.shutdown(err)
+		<-pingDone
+	}()
+	return m
+}
+
+// Done is closed once the mux has shut down.
+func (m *Mux) Done() <-chan struct{} { return m.done }
+
+// Close shuts the mux down, failing every open stream, and closes the
+// WebSocket.
+func (m *Mux) Close() error {
+	err := m.ws.Close(websocket.StatusNormalClosure, "")
+	m.cancel(ErrMuxClosed)
+	<-m.done
+	return err
+}
+
+// Open starts a stream whose MuxOpen payload is hdr and waits for the
+// peer's MuxReply, returning the stream and the reply payload. A peer
+// that resets the stream instead of replying fails Open at once with
+// a stream-reset error. The caller closes the stream, also when the
+// reply refuses it.
+func (m *Mux) Open(ctx context.Context, hdr []byte) (*MuxStream, []byte, error) {
+	m.mu.Lock()
+	if m.ctx.Err() != nil {
+		m.mu.Unlock()
+		return nil, nil, ErrMuxClosed
+	}
+	id := m.nextID
+	m.nextID += 2
+	s := newMuxStream(m, id)
+	m.streams[id] = s
+	m.mu.Unlock()
+
+	if err := m.writeFrame(id, protocol.MuxOpen, hdr); err != nil {
+		_ = s.Close()
+		return nil, nil, err
+	}
+	select {
+	case reply := <-s.reply:
+		return s, reply, nil
+	case <-s.failed:
+		// Reset by the peer (or the mux failed) before any reply.
+		s.mu.Lock()
+		err := s.werr
+		s.mu.Unlock()
+		return nil, nil, err
+	case <-ctx.Done():
+		_ = s.Close()
+		return nil, nil, ctx.Err()
+	case <-m.done:
+		return nil, nil, ErrMuxClosed
+	}
+}
+
+// Accept returns the next stream the peer opened. Its MuxOpen payload
+// is Header; the caller answers with Reply.
+func (m *Mux) Accept(ctx context.Context) (*MuxStream, error) {
+	select {
+	case s := <-m.accept:
+		return s, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-m.done:
+		return nil, ErrMuxClosed
+	}
+}
+
+// readLoop dispatches frames until the WebSocket fails.
+func (m *Mux) readLoop() error {
+	for {
+		typ, data, err := m.ws.Read(m.ctx)
+		if err != nil {
+			return err
+		}
+		if typ != websocket.MessageBinary {
+			continue
+		}
+		id, ft, payload, err := protocol.ParseMuxFrame(data)
+		if err != nil {
+			return err
+		}
+		if ft == protocol.MuxOpen {
+			m.opened(id, payload)
+			continue
+		}
+		m.mu.Lock()
+		s := m.streams[id]
+		m.mu.Unlock()
+		if s == nil {
+			// A stream this side has already closed.
+			continue
+		}
+		switch ft {
+		case protocol.MuxReply:
+			select {
+			case s.reply <- payload:
+			default:
+			}
+		case protocol.MuxData:
+			if !s.deliver(payload) {
+				m.logger.Debug("mux stream exceeded its window", "stream", id)
+				s.reset()
+				go func() { _ = m.writeFrame(id, protocol.MuxReset, nil) }()
+			}
+		case protocol.MuxClose:
+			s.remoteClose()
+		case protocol.MuxReset:
+			s.reset()
+		case protocol.MuxWindowUpdate:
+			if len(payload) == 4 {
+				s.grant(int(binary.BigEndian.Uint32(payload)))
+			}
+		}
+	}
+}
+
+// opened registers a stream the peer opened and queues it for Accept,
+// or resets it when this side does not take streams, the id is in
+// use, or too many are open.
+func (m *Mux) opened(id uint32, hdr []byte) {
+	m.mu.Lock()
+	_, dup := m.streams[id]
+	ok := !m.client && !dup && len(m.streams) < muxMaxStreams
+	var s *MuxStream
+	if ok {
+		s = newMuxStream(m, id)
+		s.hdr = hdr
+		m.streams[id] = s
+	}
+	m.mu.Unlock()
+	if !ok {
+		go func() { _ = m.writeFrame(id, protocol.MuxReset, nil) }()
+		return
+	}
+	m.accept <- s
+}
+
+// shutdown fails every stream once the read loop has ended.
+func (m *Mux) shutdown(err error) {
+	m.cancel(err)
+	m.mu.Lock()
+	streams := m.streams
+	m.streams = make(map[uint32]*MuxStream)
+	m.mu.Unlock()
+	for _, s := range streams {
+		s.fail(ErrMuxClosed)
+	}
+	_ = m.ws.CloseNow()
+}
+
+func (m *Mux) remove(id uint32) {
+	m.mu.Lock()
+	delete(m.streams, id)
+	m.mu.Unlock()
+}
+
+func (m *Mux) writeFrame(id uint32, typ byte, payload []byte) error {
+	if err := m.ws.Write(m.ctx, websocket.MessageBinary, protocol.AppendMuxFrame(nil, id, typ, payload)); err != nil {
+		if m.ctx.Err() != nil {
+			return ErrMuxClosed
+		}
+		return err
+	}
+	m.ka.wrote()
+	return nil
+}
+
+// MuxStream is one connection carried by a Mux. It is a net.Conn
+// whose CloseWrite sends protocol.MuxClose; Close without both sides
+// having closed their writes resets the stream.
+type MuxStream struct {
+	m     *Mux
+	id    uint32
+	hdr   []byte
+	reply chan []byte
+
+	readable chan struct{}
+	writable chan struct{}
+	failed   chan struct{} // closed by the first fail
+	failOnce sync.Once
+
+	mu         sync.Mutex
+	buf        []byte
+	rerr       error // io.EOF after the peer's MuxClose
+	werr       error
+	recvWindow int // bytes the peer may still send
+	unacked    int // bytes read and not yet granted back
+	sendWindow int
+	localEOF   bool
+	remoteEOF  bool
+	finished   bool // reset, or both sides closed their writes
+	rdeadline  time.Time
+	wdeadline  time.Time
+}
+
+func newMuxStream(m *Mux, id uint32) *MuxStream {
+	return &MuxStream{
+		m:          m,
+		id:         id,
+		reply:      make(chan []byte, 1),
+		readable:   make(chan struct{}, 1),
+		writable:   make(chan struct{}, 1),
+		failed:     make(chan struct{}),
+		recvWindow: protocol.MuxWindow,
+		sendWindow: protocol.MuxWindow,
+	}
+}
+
+// Header returns the MuxOpen payload of a stream from Accept.
+func (s *MuxStream) Header() []byte { return s.hdr }
+
+// Reply answers an accepted stream's MuxOpen.
+func (s *MuxStream) Reply(payload []byte) error {
+	return s.m.writeFrame(s.id, protocol.MuxReply, payload)
+}
+
+// Read reads stream data, returning io.EOF once the peer has closed
+// its write side and everything it sent has been read.
+func (s *MuxStream) Read(b []byte) (int, error) {
+	for {
+		s.mu.Lock()
+		if len(s.buf) > 0 {
+			n := copy(b, s.buf)
+			s.buf = s.buf[n:]
+			if len(s.buf) == 0 {
+				s.buf = nil
+			}
+			var grant int
+			s.unacked += n
+			if s.unacked >= protocol.MuxWindow/2 && !s.remoteEOF && !s.finished {
+				grant, s.unacked = s.unacked, 0
+				s.recvWindow += grant
+			}
+			s.mu.Unlock()
+			if grant > 0 {
+				_ = s.m.writeFrame(s.id, protocol.MuxWindowUpdate, binary.BigEndian.AppendUint32(nil, uint32(grant)))
+			}
+			return n, nil
+		}
+		if s.rerr != nil {
+			err := s.rerr
+			s.mu.Unlock()
+			return 0, err
+		}
+		deadline := s.rdeadline
+		s.mu.Unlock()
+		if err := waitStream(s.readable, deadline); err != nil {
+			return 0, err
+		}
+	}
+}
+
+// Write sends b as MuxData frames, waiting for send window as needed.
+func (s *MuxStream) Write(b []byte) (int, error) {
+	var written int
+	for len(b) > 0 {
+		s.mu.Lock()
+		if s.werr != nil {
+			err := s.werr
+			s.mu.Unlock()
+			return written, err
+		}
+		if s.sendWindow == 0 {
+			deadline := s.wdeadline
+			s.mu.Unlock()
+			if err := waitStream(s.writable, deadline); err != nil {
+				return written, err
+			}
+			continue
+		}
+		n := min(len(b), s.sendWindow, protocol.MuxMaxData)
+		s.sendWindow -= n
+		s.mu.Unlock()
+		if err := s.m.writeFrame(s.id, protocol.MuxData, b[:n]); err != nil {
+			return written, err
+		}
+		written += n
+		b = b[n:]
+	}
+	return written, nil
+}
+
+// CloseWrite sends MuxClose: the peer reads io.EOF once it has read
+// everything written before.
+func (s *MuxStream) CloseWrite() error {
+	s.mu.Lock()
+	if s.werr != nil {
+		s.mu.Unlock()
+		return nil
+	}
+	s.werr = net.ErrClosed
+	s.localEOF = true
+	s.finished = s.remoteEOF
+	s.mu.Unlock()
+	return s.m.writeFrame(s.id, protocol.MuxClose, nil)
+}
+
+// Close releases the stream. A stream that has not finished cleanly
+// is reset, so the peer stops sending to it.
+func (s *MuxStream) Close() error {
+	s.mu.Lock()
+	finished := s.finished
+	s.finished = true
+	s.buf = nil
+	if s.rerr == nil || s.rerr == io.EOF {
+		s.rerr = net.ErrClosed
+	}
+	if s.werr == nil {
+		s.werr = net.ErrClosed
+	}
+	s.mu.Unlock()
+	notify(s.readable)
+	notify(s.writable)
+	s.m.remove(s.id)
+	if !finished {
+		_ = s.m.writeFrame(s.id, protocol.MuxReset, nil)
+	}
+	return nil
+}
+
+// deliver queues data from the peer, reporting false when it exceeds
+// the window granted.
+func (s *MuxStream) deliver(p []byte) bool {
+	s.mu.Lock()
+	if s.remoteEOF || len(p) > s.recvWindow {
+		s.mu.Unlock()
+		return false
+	}
+	s.recvWindow -= len(p)
+	if !s.finished {
+		s.buf = append(s.buf, p...)
+	}
+	s.mu.Unlock()
+	notify(s.readable)
+	return true
+}
+
+func (s *MuxStream) remoteClose() {
+	s.mu.Lock()
+	s.remoteEOF = true
+	s.finished = s.finished || s.localEOF
+	if s.rerr == nil {
+		s.rerr = io.EOF
+	}
+	s.mu.Unlock()
+	notify(s.readable)
+}
+
+func (s *MuxStream) grant(n int) {
+	s.mu.Lock()
+	s.sendWindow += n
+	s.mu.Unlock()
+	notify(s.writable)
+}
+
+// reset ends the stream in both directions without a reply to the
+// peer.
+func (s *MuxStream) reset() {
+	s.fail(errStreamReset)
+	s.m.remove(s.id)
+}
+
+func (s *MuxStream) fail(err error) {
+	s.mu.Lock()
+	s.finished = true
+	if s.rerr == nil || s.rerr == io.EOF {
+		s.rerr = err
+	}
+	if s.werr == nil {
+		s.werr = err
+	}
+	s.mu.Unlock()
+	s.failOnce.Do(func() { close(s.failed) })
+	notify(s.readable)
+	notify(s.writable)
+}
+
+// LocalAddr returns a placeholder; a stream has no address of its own.
+func (s *MuxStream) LocalAddr() net.Addr { return muxAddr{} }
+
+// RemoteAddr returns a placeholder; a stream has no address of its own.
+func (s *MuxStream) RemoteAddr() net.Addr { return muxAddr{} }
+
+// SetDeadline sets both the read and write deadlines.
+func (s *MuxStream) SetDeadline(t time.Time) error {
+	_ = s.SetReadDeadline(t)
+	return s.SetWriteDeadline(t)
+}
+
+// SetReadDeadline bounds Read waits; a blocked Read sees the change.
+func (s *MuxStream) SetReadDeadline(t time.Time) error {
+	s.mu.Lock()
+	s.rdeadline = t
+	s.mu.Unlock()
+	notify(s.readable)
+	return nil
+}
+
+// SetWriteDeadline bounds Write's wait for send window.
+func (s *MuxStream) SetWriteDeadline(t time.Time) error {
+	s.mu.Lock()
+	s.wdeadline = t
+	s.mu.Unlock()
+	notify(s.writable)
+	return nil
+}
+
+type muxAddr struct{}
+
+func (muxAddr) Network() string { return "mux" }
+func (muxAddr) String() string  { return "mux" }
+
+// notify wakes a waiter on a single-slot channel without blocking.
+func notify(ch chan struct{}) {
+	select {
+	case ch <- struct{}{}:
+	default:
+	}
+}
+
+// waitStream waits for ch until deadline (zero waits indefinitely).
+func waitStream(ch chan struct{}, deadline time.Time) error {
+	if deadline.IsZero() {
+		<-ch
+		return nil
+	}
+	d := time.Until(deadline)
+	if d <= 0 {
+		return os.ErrDeadlineExceeded
+	}
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-ch:
+		return nil
+	case <-t.C:
+		return os.ErrDeadlineExceeded
+	}
+}
+
+// BridgeStream copies data between a mux stream and a local
+// connection. It always half-closes: local EOF closes the stream's
+// write side and the stream's EOF half-closes the local side, and the
+// bridge ends once both directions have, or as soon as either fails.
+// Only opts.BufferSize, opts.IdleTimeout and opts.RateLimit apply.
+// The caller closes both ends afterwards.
+func BridgeStream(ctx context.Context, s *MuxStream, tcp net.Conn, opts BridgeOptions) (BridgeResult, error) {
+	ctx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
+
+	tr := bridgeTracer(ctx)
+	var tcpToWSBytes, wsToTCPBytes atomic.Int64
+	wsToTCPCh := make(chan pumpResult, 1)
+	tcpToWSCh := make(chan pumpResult, 1)
+
+	go func() {
+		traceStart(tr, "ws_to_tcp")
+		op, err := streamToTCP(ctx, s, tcp, &wsToTCPBytes, tr, opts)
+		traceEnd(tr, "ws_to_tcp", op, err, wsToTCPBytes.Load())
+		wsToTCPCh <- pumpResult{op: op, err: err}
+	}()
+	go func() {
+		traceStart(tr, "tcp_to_ws")
+		op, err := tcpToStream(ctx, s, tcp, &tcpToWSBytes, tr, opts)
+		traceEnd(tr, "tcp_to_ws", op, err, tcpToWSBytes.Load())
+		tcpToWSCh <- pumpResult{op: op, err: err}
+	}()
+
+	// Ending the bridge ctx, for whatever reason, unblocks both pumps.
+	stop := context.AfterFunc(ctx, func() {
+		now := time.Now()
+		_ = tcp.SetDeadline(now)
+		_ = s.SetDeadline(now)
+	})
+	defer stop()
+
+	idleDone := make(chan struct{})
+	if opts.IdleTimeout > 0 {
+		go func() {
+			defer close(idleDone)
+			watchIdle(ctx, &tcpToWSBytes, &wsToTCPBytes, opts.IdleTimeout, func() {
+				cancel(bridgecause.CauseIdleTimeout)
+			})
+		}()
+	} else {
+		close(idleDone)
+	}
+
+	// The first direction to fail ends the bridge; when both end
+	// cleanly the last one decides the cause.
+	var wsRes, tcpRes, last pumpResult
+	var bridgeErr error
+	failed := false
+	for range 2 {
+		select {
+		case wsRes = <-wsToTCPCh:
+			last = wsRes
+		case tcpRes = <-tcpToWSCh:
+			last = tcpRes
+		}
+		if !failed && (last.err != nil || (last.op != "ws_eos" && last.op != "tcp_eos")) {
+			failed = true
+			bridgeErr = last.err
+			cancel(causeFromPumpExit(last.op, last.err))
+		}
+	}
+	cancel(causeFromPumpExit(last.op, last.err))
+	<-idleDone
+
+	wsErr, tcpErr := wsRes.err, tcpRes.err
+	if isInducedCancellation(wsErr) {
+		wsErr = nil
+	}
+	if isInducedCancellation(tcpErr) {
+		tcpErr = nil
+	}
+	cause := context.Cause(ctx)
+	result := BridgeResult{
+		Stats: BridgeStats{
+			TCPToWS: tcpToWSBytes.Load(),
+			WSToTCP: wsToTCPBytes.Load(),
+		},
+		TCPToWS:  tcpErr,
+		WSToTCP:  wsErr,
+		EndCause: bridgecause.Name(cause),
+	}
+	if errors.Is(cause, bridgecause.CauseIdleTimeout) {
+		return result, bridgecause.CauseIdleTimeout
+	}
+	return result, bridgeErr
+}
+
+// streamToTCP copies the stream to tcp until the stream's EOF, which
+// half-closes tcp and returns "ws_eos".
+func streamToTCP(ctx context.Context, s *MuxStream, tcp net.Conn, count *atomic.Int64, tr *slog.Logger, opts BridgeOptions) (string, error) {
+	bufs := buffersFor(opts.BufferSize)
+	bufp := bufs.get()
+	defer bufs.put(bufp)
+	buf := *bufp
+	dst := pumpWriter(ctx, tcp, newRateLimiter(opts.RateLimit))
+	for {
+		n, err := s.Read(buf)
+		if n > 0 {
+			if _, wErr := dst.Write(buf[:n]); wErr != nil {
+				return "tcp_write", wErr
+			}
+			count.Add(int64(n))
+			if tr != nil {
+				tr.Debug("bridge trace", "trace", "chunk", "direction", "ws_to_tcp", "bytes", n)
+			}
+		}
+		if err == io.EOF {
+			if cw, ok := tcp.(interface{ CloseWrite() error }); ok {
+				_ = cw.CloseWrite()
+			}
+			return "ws_eos", nil
+		}
+		if err != nil {
+			return "ws_read", err
+		}
+	}
+}
+
+// tcpToStream copies tcp to the stream until tcp's EOF, which closes
+// the stream's write side and returns "tcp_eos".
+func tcpToStream(ctx context.Context, s *MuxStream, tcp net.Conn, count *atomic.Int64, tr *slog.Logger, opts BridgeOptions) (string, error) {
+	bufs := buffersFor(opts.BufferSize)
+	bufp := bufs.get()
+	defer bufs.put(bufp)
+	buf := *bufp
+	lim := newRateLimiter(opts.RateLimit)
+	for {
+		n, err := tcp.Read(buf[:lim.chunk(len(buf))])
+		if n > 0 {
+			if wErr := lim.wait(ctx, n); wErr != nil {
+				return "ws_write", wErr
+			}
+			if _, wErr := s.Write(buf[:n]); wErr != nil {
+				return "ws_write", wErr
+			}
+			count.Add(int64(n))
+			if tr != nil {
+				tr.Debug("bridge trace", "trace", "chunk", "direction", "tcp_to_ws", "bytes", n)
+			}
+		}
+		if err != nil {
+			if err = ignoreEOF(err); err != nil {
+				return "tcp_read", err
+			}
+			if wErr := s.CloseWrite(); wErr != nil {
+				return "ws_write", wErr
+			}
+			return "tcp_eos", nil
+		}
+	}
+}
@@ -0,0 +1,206 @@
+package relay
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/coder/websocket"
+	"github.com/philsphicas/aztunnel/internal/protocol"
+)
+
+// muxPair returns the client (opening) and server (accepting) ends of
+// a mux over a loopback WebSocket.
+func muxPair(t *testing.T) (client, server *Mux) {
+	t.Helper()
+	accepted := make(chan *Mux, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ws, err := websocket.Accept(w, r, nil)
+		if err != nil {
+			return
+		}
+		m := NewMux(context.Background(), ws, false, BridgeOptions{}, discardLogger())
+		accepted <- m
+		<-m.Done()
+	}))
+	t.Cleanup(srv.Close)
+
+	ws, _, err := websocket.Dial(context.Background(), "ws"+strings.TrimPrefix(srv.URL, "http"), nil)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	client = NewMux(context.Background(), ws, true, BridgeOptions{}, discardLogger())
+	server = <-accepted
+	t.Cleanup(func() {
+		_ = client.Close()
+		_ = server.Close()
+	})
+	return client, server
+}
+
+func TestMux_Streams(t *testing.T) {
+	client, server := muxPair(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	// The server echoes each stream's header back as data, then
+	// echoes whatever the stream carries until its EOF.
+	go func() {
+		for {
+			s, err := server.Accept(ctx)
+			if err != nil {
+				return
+			}
+			go func() {
+				defer s.Close()
+				_ = s.Reply([]byte("ok"))
+				_, _ = s.Write(s.Header())
+				_, _ = io.Copy(s, s)
+				_ = s.CloseWrite()
+			}()
+		}
+	}()
+
+	for _, name := range []string{"a", "b"} {
+		s, reply, err := client.Open(ctx, []byte(name))
+		if err != nil {
+			t.Fatalf("Open(%s): %v", name, err)
+		}
+		if string(reply) != "ok" {
+			t.Errorf("reply = %q, want ok", reply)
+		}
+		// More than one window's worth exercises the window updates.
+		payload := bytes.Repeat([]byte(name), protocol.MuxWindow*3)
+		go func() {
+			_, _ = s.Write(payload)
+			_ = s.CloseWrite()
+		}()
+		got, err := io.ReadAll(s)
+		if err != nil {
+			t.Fatalf("stream %s: read: %v", name, err)
+		}
+		if want := append([]byte(name), payload...); !bytes.Equal(got, want) {
+			t.Errorf("stream %s: got %d bytes, want %d", name, len(got), len(want))
+		}
+		_ = s.Close()
+	}
+}
+
+func TestMux_ResetAndShutdown(t *testing.T) {
+	client, server := muxPair(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	go func() {
+		s, err := server.Accept(ctx)
+		if err != nil {
+			return
+		}
+		_ = s.Reply(nil)
+		// Closing without a clean end resets the stream.
+		_ = s.Close()
+	}()
+	s, _, err := client.Open(ctx, nil)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	if _, err := io.ReadAll(s); !errors.Is(err, errStreamReset) {
+		t.Errorf("read of a reset stream = %v, want errStreamReset", err)
+	}
+
+	// A stream still open when the mux goes away fails rather than
+	// hanging.
+	go func() {
+		if s, err := server.Accept(ctx); err == nil {
+			_ = s.Reply(nil)
+		}
+	}()
+	s, _, err = client.Open(ctx, nil)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	_ = server.Close()
+	if _, err := io.ReadAll(s); !errors.Is(err, ErrMuxClosed) {
+		t.Errorf("read after shutdown = %v, want ErrMuxClosed", err)
+	}
+	if _, _, err := client.Open(ctx, nil); !errors.Is(err, ErrMuxClosed) {
+		t.Errorf("Open after shutdown = %v, want ErrMuxClosed", err)
+	}
+}
+
+// TestMux_OpenReset checks that Open fails as soon as the peer resets
+// the stream instead of replying, rather than waiting out ctx.
+func TestMux_OpenReset(t *testing.T) {
+	client, server := muxPair(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	go func() {
+		if s, err := server.Accept(ctx); err == nil {
+			_ = s.Close() // no Reply: resets the stream
+		}
+	}()
+	start := time.Now()
+	s, _, err := client.Open(ctx, nil)
+	if !errors.Is(err, errStreamReset) || s != nil {
+		t.Fatalf("Open of a stream reset before its reply = %v, %v, want errStreamReset", s, err)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("Open returned after %v, want it to fail on the reset", elapsed)
+	}
+}
+
+func TestBridgeStream(t *testing.T) {
+	client, server := muxPair(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	// The server side bridges its stream to a TCP peer that answers
+	// once the request has been half-closed.
+	localApp, localBridge := tcpConnPair(t)
+	done := make(chan BridgeResult, 1)
+	go func() {
+		s, err := server.Accept(ctx)
+		if err != nil {
+			return
+		}
+		defer s.Close()
+		_ = s.Reply(nil)
+		res, _ := BridgeStream(ctx, s, localBridge, BridgeOptions{})
+		done <- res
+	}()
+	go func() {
+		req, _ := io.ReadAll(localApp)
+		_, _ = localApp.Write(append([]byte("re:"), req...))
+		_ = localApp.CloseWrite()
+	}()
+
+	s, _, err := client.Open(ctx, nil)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	defer s.Close()
+	_, _ = s.Write([]byte("ping"))
+	_ = s.CloseWrite()
+	got, err := io.ReadAll(s)
+	if err != nil || string(got) != "re:ping" {
+		t.Errorf("reply = %q (%v), want re:ping", got, err)
+	}
+	select {
+	case res := <-done:
+		if res.Stats.WSToTCP != 4 || res.Stats.TCPToWS != 7 {
+			t.Errorf("stats = %+v, want 4 in and 7 out", res.Stats)
+		}
+		if res.TCPToWS != nil || res.WSToTCP != nil {
+			t.Errorf("direction errors = %v / %v, want none", res.TCPToWS, res.WSToTCP)
+		}
+	case <-ctx.Done():
+		t.Fatal("BridgeStream did not return")
+	}
+}
@@ -3,6 +3,7 @@ package relay
 import (
 	"context"
 	"net"
+	"sync"
 	"time"
 )
 
@@ -20,36 +21,111 @@ func SetTCPKeepAlive(conn net.Conn, d time.Duration) {
 	_ = tcpConn.SetKeepAlivePeriod(d)
 }
 
-// connSemaphore limits concurrent connections. A nil channel (from
-// newConnSemaphore(0)) imposes no limit.
+// connSemaphore limits concurrent connections. The limit is read
+// through limit on every acquire so a listener can change its
+// MaxConnections at runtime (see ControlConfig.MaxConnectionsFunc); a
+// limit <= 0 imposes no limit. Lowering the limit below the current
+// in-flight count never evicts existing holders — new acquires fail
+// until enough of them release.
 type connSemaphore struct {
-	ch chan struct{}
+	limit func() int
+
+	mu sync.Mutex
+	n  int
+	// released is closed and cleared on every release to wake acquire
+	// waiters; nil while nobody waits.
+	released chan struct{}
 }
 
 func newConnSemaphore(max int) *connSemaphore {
-	if max <= 0 {
-		return &connSemaphore{}
-	}
-	return &connSemaphore{ch: make(chan struct{}, max)}
+	return newConnSemaphoreFunc(func() int { return max })
+}
+
+func newConnSemaphoreFunc(limit func() int) *connSemaphore {
+	return &connSemaphore{limit: limit}
 }
 
 func (s *connSemaphore) tryAcquire(ctx context.Context) bool {
-	if s.ch == nil {
-		return true
-	}
-	select {
-	case s.ch <- struct{}{}:
-		return true
-	case <-ctx.Done():
+	if ctx.Err() != nil {
 		return false
-	default:
+	}
+	max := s.limit()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if max > 0 && s.n >= max {
 		return false
 	}
+	s.n++
+	return true
+}
+
+// acquire is tryAcquire with a bounded wait: it retries on every
+// release until it gets a slot, wait elapses, or ctx is done. Waiters
+// are woken together, so slots are not handed out in arrival order. A
+// raised limit is noticed on the next release, not immediately.
+func (s *connSemaphore) acquire(ctx context.Context, wait time.Duration) bool {
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	for {
+		// Take the wake channel before trying so a release between
+		// the failed try and the select is not missed.
+		s.mu.Lock()
+		if s.released == nil {
+			s.released = make(chan struct{})
+		}
+		released := s.released
+		s.mu.Unlock()
+
+		if s.tryAcquire(ctx) {
+			return true
+		}
+		select {
+		case <-ctx.Done():
+			return false
+		case <-timer.C:
+			return false
+		case <-released:
+		}
+	}
+}
+
+// inUse reports how many holders currently have the semaphore.
+func (s *connSemaphore) inUse() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.n
 }
 
 func (s *connSemaphore) release() {
-	if s.ch == nil {
-		return
+	s.mu.Lock()
+	if s.n > 0 {
+		s.n--
+	}
+	if s.released != nil {
+		close(s.released)
+		s.released = nil
+	}
+	s.mu.Unlock()
+}
+
+// connSlotsKey is the context key for the semaphore AcquireConnSlot
+// takes from.
+type connSlotsKey struct{}
+
+// AcquireConnSlot takes one more MaxConnections slot from the control
+// loop that accepted the connection ctx belongs to, for a Handler that
+// carries more than one connection over its rendezvous, like the
+// streams of a mux session. It reports false, with a nil release, when
+// the limit is reached. Outside a control loop (a Handler driven
+// directly) it always succeeds. Call release once the connection ends.
+func AcquireConnSlot(ctx context.Context) (release func(), ok bool) {
+	sem, _ := ctx.Value(connSlotsKey{}).(*connSemaphore)
+	if sem == nil {
+		return func() {}, true
+	}
+	if !sem.tryAcquire(ctx) {
+		return nil, false
 	}
-	<-s.ch
+	var once sync.Once
+	return func() { once.Do(sem.release) }, true
 }
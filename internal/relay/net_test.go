@@ -2,7 +2,9 @@ package relay
 
 import (
 	"context"
+	"sync/atomic"
 	"testing"
+	"time"
 )
 
 func TestConnSemaphore_Unlimited(t *testing.T) {
@@ -50,3 +52,113 @@ func TestConnSemaphore_ContextCancel(t *testing.T) {
 		t.Fatal("acquire with cancelled context should fail")
 	}
 }
+
+// TestConnSemaphore_DynamicLimit covers the listener reload path: the
+// limit is read on every acquire, so raising it admits more holders
+// and lowering it blocks new acquires without evicting existing ones.
+func TestConnSemaphore_DynamicLimit(t *testing.T) {
+	var limit atomic.Int64
+	limit.Store(1)
+	sem := newConnSemaphoreFunc(func() int { return int(limit.Load()) })
+	ctx := context.Background()
+
+	if !sem.tryAcquire(ctx) {
+		t.Fatal("first acquire should succeed")
+	}
+	if sem.tryAcquire(ctx) {
+		t.Fatal("second acquire should fail at limit 1")
+	}
+
+	limit.Store(3)
+	if !sem.tryAcquire(ctx) || !sem.tryAcquire(ctx) {
+		t.Fatal("acquires should succeed after raising limit to 3")
+	}
+	if sem.tryAcquire(ctx) {
+		t.Fatal("fourth acquire should fail at limit 3")
+	}
+
+	// Lower below the in-flight count: new acquires fail until enough
+	// holders release.
+	limit.Store(2)
+	sem.release()
+	if sem.tryAcquire(ctx) {
+		t.Fatal("acquire should fail with 2 in flight at limit 2")
+	}
+	sem.release()
+	if !sem.tryAcquire(ctx) {
+		t.Fatal("acquire should succeed with 1 in flight at limit 2")
+	}
+
+	// Zero means unlimited.
+	limit.Store(0)
+	for range 10 {
+		if !sem.tryAcquire(ctx) {
+			t.Fatal("acquire should always succeed at limit 0")
+		}
+	}
+}
+
+// TestConnSemaphore_Acquire covers the bounded wait used by
+// AcceptOverflowQueue: a release wakes a waiter, and a full semaphore
+// gives up after the wait or on cancellation.
+func TestConnSemaphore_Acquire(t *testing.T) {
+	sem := newConnSemaphore(1)
+	ctx := context.Background()
+	if !sem.acquire(ctx, time.Second) {
+		t.Fatal("acquire on an empty semaphore should succeed")
+	}
+
+	start := time.Now()
+	if sem.acquire(ctx, 50*time.Millisecond) {
+		t.Fatal("acquire should time out while the semaphore is full")
+	}
+	if elapsed := time.Since(start); elapsed < 50*time.Millisecond {
+		t.Errorf("acquire gave up after %v, want >= 50ms", elapsed)
+	}
+
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		sem.release()
+	}()
+	if !sem.acquire(ctx, 5*time.Second) {
+		t.Fatal("acquire should succeed once the holder releases")
+	}
+
+	cancelCtx, cancel := context.WithCancel(ctx)
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		cancel()
+	}()
+	if sem.acquire(cancelCtx, 5*time.Second) {
+		t.Fatal("acquire should fail when the context is cancelled")
+	}
+}
+
+// TestAcquireConnSlot covers the extra slots mux streams take: outside
+// a control loop there is no limit, inside one they share its
+// semaphore, and a release is idempotent.
+func TestAcquireConnSlot(t *testing.T) {
+	if release, ok := AcquireConnSlot(context.Background()); !ok {
+		t.Fatal("AcquireConnSlot outside a control loop should succeed")
+	} else {
+		release()
+	}
+
+	sem := newConnSemaphore(1)
+	ctx := context.WithValue(context.Background(), connSlotsKey{}, sem)
+	release, ok := AcquireConnSlot(ctx)
+	if !ok {
+		t.Fatal("AcquireConnSlot on an empty semaphore should succeed")
+	}
+	if _, ok := AcquireConnSlot(ctx); ok {
+		t.Fatal("AcquireConnSlot should fail while the semaphore is full")
+	}
+	release()
+	release()
+	if n := sem.inUse(); n != 0 {
+		t.Errorf("inUse after release = %d, want 0", n)
+	}
+	if _, ok := AcquireConnSlot(ctx); !ok {
+		t.Error("AcquireConnSlot should succeed after a release")
+	}
+}
@@ -0,0 +1,222 @@
+package relay
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net"
+	"sync/atomic"
+	"time"
+
+	"github.com/coder/websocket"
+
+	"github.com/philsphicas/aztunnel/internal/bridgecause"
+	"github.com/philsphicas/aztunnel/internal/protocol"
+)
+
+// sessionDrainTimeout bounds how long a pipelined session waits for
+// the second direction to finish once the first has ended: the local
+// side to EOF after a half-close, or the peer's end-of-stream marker
+// after ours. Past it the session is torn down and the WebSocket is
+// not reused.
+const sessionDrainTimeout = 10 * time.Second
+
+// endOfStreamMsg is the encoded protocol.EndOfStream marker.
+var endOfStreamMsg, _ = json.Marshal(protocol.EndOfStream{EOS: true})
+
+// SessionResult is the outcome of one BridgeSession.
+type SessionResult struct {
+	BridgeResult
+
+	// Reusable is true when both directions ended with an
+	// end-of-stream marker exchange, leaving the WebSocket idle and
+	// ready for the next ConnectEnvelope. When false the caller must
+	// close the WebSocket.
+	Reusable bool
+}
+
+// BridgeSession is the pipelining (protocol.CapPipelining) variant of
+// Bridge: it copies one connection's data over ws and returns with
+// the WebSocket still open so the caller can run another session on
+// it.
+//
+// Each direction ends with an end-of-stream text message instead of
+// a WebSocket close. When the local side reaches EOF the session
+// sends its marker and keeps copying peer data until the peer's
+// marker arrives; when the peer's marker arrives first the local side
+// is half-closed (CloseWrite, where supported) and read until EOF,
+// then the session answers with its own marker. Either wait is
+// bounded by sessionDrainTimeout.
+//
+// Unlike Bridge, BridgeSession never cancels the context passed to
+// ws reads or writes, because coder/websocket closes the connection
+// when that context ends. A parent ctx cancel therefore still tears
+// the WebSocket down, and Reusable is false.
+//
+// Only opts.BufferSize, opts.RateLimit and the ping options apply: a
+// session always half-closes, and an idle session is left alone like
+// an idle pooled rendezvous.
+func BridgeSession(ctx context.Context, ws *websocket.Conn, tcp net.Conn, opts BridgeOptions) (SessionResult, error) {
+	bufs := buffersFor(opts.BufferSize)
+	tr := bridgeTracer(ctx)
+	var tcpToWSBytes, wsToTCPBytes atomic.Int64
+	wsToTCPCh := make(chan pumpResult, 1)
+	tcpToWSCh := make(chan pumpResult, 1)
+
+	ka := newKeepalive(opts)
+	pingCtx, stopPing := context.WithCancel(ctx)
+	pingDone := make(chan struct{})
+	go func() {
+		defer close(pingDone)
+		ka.run(pingCtx, ws)
+	}()
+
+	go func() {
+		traceStart(tr, "ws_to_tcp")
+		op, err := sessionWSToTCP(ctx, ws, tcp, bufs, newRateLimiter(opts.RateLimit), &wsToTCPBytes, tr)
+		traceEnd(tr, "ws_to_tcp", op, err, wsToTCPBytes.Load())
+		wsToTCPCh <- pumpResult{op: op, err: err}
+	}()
+	go func() {
+		traceStart(tr, "tcp_to_ws")
+		op, err := sessionTCPToWS(ctx, ws, tcp, bufs, newRateLimiter(opts.RateLimit), &tcpToWSBytes, tr, ka)
+		traceEnd(tr, "tcp_to_ws", op, err, tcpToWSBytes.Load())
+		tcpToWSCh <- pumpResult{op: op, err: err}
+	}()
+
+	var wsRes, tcpRes pumpResult
+	var cause error
+	select {
+	case wsRes = <-wsToTCPCh:
+		cause = causeFromPumpExit("ws_read", wsRes.err)
+		if wsRes.op == "ws_eos" {
+			// The peer is done sending; let the local side finish
+			// its reply, then answer with our marker.
+			if cw, ok := tcp.(interface{ CloseWrite() error }); ok {
+				_ = cw.CloseWrite()
+			}
+			_ = tcp.SetReadDeadline(time.Now().Add(sessionDrainTimeout))
+		} else {
+			_ = tcp.SetReadDeadline(time.Now())
+		}
+		tcpRes = <-tcpToWSCh
+	case tcpRes = <-tcpToWSCh:
+		cause = causeFromPumpExit("tcp_read", tcpRes.err)
+		select {
+		case wsRes = <-wsToTCPCh:
+		case <-time.After(sessionDrainTimeout):
+			_ = ws.CloseNow()
+			wsRes = <-wsToTCPCh
+		}
+	}
+	stopPing()
+	<-pingDone
+
+	reusable := wsRes.op == "ws_eos" && tcpRes.op != "ws_write" && ctx.Err() == nil
+	if ctx.Err() != nil {
+		cause = context.Cause(ctx)
+	}
+	wsErr, tcpErr := wsRes.err, tcpRes.err
+	if isInducedCancellation(wsErr) {
+		wsErr = nil
+	}
+	if isInducedCancellation(tcpErr) {
+		tcpErr = nil
+	}
+	result := SessionResult{
+		BridgeResult: BridgeResult{
+			Stats: BridgeStats{
+				TCPToWS: tcpToWSBytes.Load(),
+				WSToTCP: wsToTCPBytes.Load(),
+			},
+			TCPToWS:  tcpErr,
+			WSToTCP:  wsErr,
+			EndCause: bridgecause.Name(cause),
+		},
+		Reusable: reusable,
+	}
+	if reusable {
+		return result, nil
+	}
+	if wsRes.err != nil {
+		return result, wsRes.err
+	}
+	return result, tcpRes.err
+}
+
+// sessionWSToTCP copies binary messages from ws to tcp until the
+// peer's end-of-stream marker (any text message), returning op
+// "ws_eos" and a nil error in that case. A local write failure does
+// not end the pump: later messages are discarded so the marker can
+// still be consumed and the WebSocket reused; the first write error
+// is returned alongside "ws_eos".
+func sessionWSToTCP(ctx context.Context, ws *websocket.Conn, tcp net.Conn, bufs *bufferPool, lim *rateLimiter, count *atomic.Int64, tr *slog.Logger) (string, error) {
+	bufp := bufs.get()
+	defer bufs.put(bufp)
+	dst := pumpWriter(ctx, tcp, lim)
+	var writeErr error
+	for {
+		typ, r, err := ws.Reader(ctx)
+		if err != nil {
+			return "ws_read", ignoreNormalClose(err)
+		}
+		if typ == websocket.MessageText {
+			if _, err := io.Copy(io.Discard, r); err != nil {
+				return "ws_read", err
+			}
+			return "ws_eos", writeErr
+		}
+		if writeErr != nil {
+			if _, err := io.Copy(io.Discard, r); err != nil {
+				return "ws_read", err
+			}
+			continue
+		}
+		n, err := io.CopyBuffer(dst, r, *bufp)
+		count.Add(n)
+		if tr != nil {
+			tr.Debug("bridge trace", "trace", "chunk", "direction", "ws_to_tcp", "bytes", n)
+		}
+		if err != nil {
+			writeErr = err
+			// Drain the rest of this message before reading the next.
+			if _, err := io.Copy(io.Discard, r); err != nil {
+				return "ws_read", err
+			}
+		}
+	}
+}
+
+// sessionTCPToWS copies tcp to ws as binary messages until tcp.Read
+// fails (EOF, the drain deadline, or an error), then sends the
+// end-of-stream marker. It returns "tcp_read" with the read error (nil
+// on EOF) after a successful marker write, or "ws_write" when any
+// WebSocket write fails. Each message sent is reported to ka.
+func sessionTCPToWS(ctx context.Context, ws *websocket.Conn, tcp net.Conn, bufs *bufferPool, lim *rateLimiter, count *atomic.Int64, tr *slog.Logger, ka *keepalive) (string, error) {
+	bufp := bufs.get()
+	defer bufs.put(bufp)
+	buf := *bufp
+	for {
+		n, err := tcp.Read(buf[:lim.chunk(len(buf))])
+		if n > 0 {
+			if wErr := lim.wait(ctx, n); wErr != nil {
+				return "ws_write", wErr
+			}
+			if wErr := ws.Write(ctx, websocket.MessageBinary, buf[:n]); wErr != nil {
+				return "ws_write", wErr
+			}
+			ka.wrote()
+			count.Add(int64(n))
+			if tr != nil {
+				tr.Debug("bridge trace", "trace", "chunk", "direction", "tcp_to_ws", "bytes", n)
+			}
+		}
+		if err != nil {
+			if wErr := ws.Write(ctx, websocket.MessageText, endOfStreamMsg); wErr != nil {
+				return "ws_write", wErr
+			}
+			return "tcp_read", ignoreEOF(err)
+		}
+	}
+}
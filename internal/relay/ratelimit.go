@@ -0,0 +1,93 @@
+package relay
+
+import (
+	"context"
+	"io"
+	"time"
+)
+
+// rateLimiter paces one bridge direction to BridgeOptions.RateLimit
+// with a token bucket that holds up to one second of traffic. Each
+// pump owns its own limiter, so it is not safe for concurrent use. A
+// nil *rateLimiter never waits.
+type rateLimiter struct {
+	rate   float64 // bytes per second, also the bucket size
+	tokens float64
+	last   time.Time
+}
+
+func newRateLimiter(bytesPerSec int64) *rateLimiter {
+	if bytesPerSec <= 0 {
+		return nil
+	}
+	r := float64(bytesPerSec)
+	return &rateLimiter{rate: r, tokens: r, last: time.Now()}
+}
+
+// chunk caps a read or write of n bytes to the bucket size, so a
+// large buffer is paced in steps rather than one long wait.
+func (l *rateLimiter) chunk(n int) int {
+	if l == nil {
+		return n
+	}
+	return max(1, min(n, int(l.rate)))
+}
+
+// wait takes n bytes' worth of tokens, sleeping until the bucket has
+// refilled enough to cover them. It returns ctx.Err() as soon as ctx
+// ends, so a throttled bridge still tears down promptly.
+func (l *rateLimiter) wait(ctx context.Context, n int) error {
+	if l == nil {
+		return nil
+	}
+	now := time.Now()
+	l.tokens = min(l.rate, l.tokens+now.Sub(l.last).Seconds()*l.rate)
+	l.last = now
+	l.tokens -= float64(n)
+	if l.tokens >= 0 {
+		return nil
+	}
+	t := time.NewTimer(time.Duration(-l.tokens / l.rate * float64(time.Second)))
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-t.C:
+		return nil
+	}
+}
+
+// rateWriter paces writes to w through lim. Like writerOnly, it hides
+// any io.ReaderFrom on w so io.CopyBuffer keeps using the pooled
+// buffer.
+type rateWriter struct {
+	ctx context.Context
+	w   io.Writer
+	lim *rateLimiter
+}
+
+func (rw rateWriter) Write(p []byte) (int, error) {
+	var written int
+	for len(p) > 0 {
+		n := rw.lim.chunk(len(p))
+		if err := rw.lim.wait(rw.ctx, n); err != nil {
+			return written, err
+		}
+		n, err := rw.w.Write(p[:n])
+		written += n
+		if err != nil {
+			return written, err
+		}
+		p = p[n:]
+	}
+	return written, nil
+}
+
+// pumpWriter returns the destination io.CopyBuffer should write tcp
+// through: rate limited when lim is set, otherwise plain writerOnly.
+func pumpWriter(ctx context.Context, tcp io.Writer, lim *rateLimiter) io.Writer {
+	if lim == nil {
+		return writerOnly{tcp}
+	}
+	return rateWriter{ctx: ctx, w: tcp, lim: lim}
+}
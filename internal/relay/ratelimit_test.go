@@ -0,0 +1,109 @@
+package relay
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/coder/websocket"
+)
+
+func TestRateLimiter_WaitHonoursCancel(t *testing.T) {
+	lim := newRateLimiter(1)
+	ctx, cancel := context.WithCancel(context.Background())
+	if err := lim.wait(ctx, 1); err != nil {
+		t.Fatalf("first byte (within burst): %v", err)
+	}
+	time.AfterFunc(50*time.Millisecond, cancel)
+
+	start := time.Now()
+	if err := lim.wait(ctx, 100); !errors.Is(err, context.Canceled) {
+		t.Errorf("wait err = %v, want context.Canceled", err)
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("wait returned %v after cancel, want prompt return", d)
+	}
+}
+
+func TestRateLimiter_NilNeverWaits(t *testing.T) {
+	var lim *rateLimiter
+	if lim != newRateLimiter(0) {
+		t.Fatal("newRateLimiter(0) should be nil")
+	}
+	if err := lim.wait(context.Background(), 1<<30); err != nil {
+		t.Errorf("wait: %v", err)
+	}
+	if got := lim.chunk(4096); got != 4096 {
+		t.Errorf("chunk = %d, want 4096", got)
+	}
+}
+
+// TestTCPToWS_RateLimit sends two seconds' worth of data at the limit:
+// the first second passes as a burst, the second is paced, and the
+// byte count stays exact.
+func TestTCPToWS_RateLimit(t *testing.T) {
+	const rate = 20_000
+	ws, peer := wsPair(t)
+	payload := bytes.Repeat([]byte{'x'}, 2*rate)
+
+	start := time.Now()
+	msgs := runTCPToWS(t, ws, peer, payload, BridgeOptions{RateLimit: rate})
+	if d := time.Since(start); d < 900*time.Millisecond {
+		t.Errorf("relayed %d bytes in %v, want about 1s at %d B/s after the burst", len(payload), d, rate)
+	}
+	var total int
+	for _, m := range msgs {
+		if len(m) > rate {
+			t.Errorf("message of %d bytes exceeds the %d-byte bucket", len(m), rate)
+		}
+		total += len(m)
+	}
+	if total != len(payload) {
+		t.Errorf("relayed %d bytes, want %d", total, len(payload))
+	}
+}
+
+func TestWSToTCP_RateLimit(t *testing.T) {
+	const rate = 20_000
+	ws, peer := wsPair(t)
+	payload := bytes.Repeat([]byte{'x'}, 2*rate)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	go func() {
+		// Two messages: one would exceed the WebSocket read limit.
+		_ = peer.Write(ctx, websocket.MessageBinary, payload[:rate])
+		_ = peer.Write(ctx, websocket.MessageBinary, payload[rate:])
+		_ = peer.Write(ctx, websocket.MessageText, endOfStreamMsg)
+	}()
+
+	local, remote := net.Pipe()
+	got := make(chan int, 1)
+	go func() {
+		b, _ := io.ReadAll(remote)
+		got <- len(b)
+	}()
+
+	var count atomic.Int64
+	start := time.Now()
+	op, err := wsToTCP(ctx, ws, local, &count, nil, BridgeOptions{HalfClose: true, RateLimit: rate})
+	d := time.Since(start)
+	_ = local.Close()
+	if op != "ws_eos" || err != nil {
+		t.Fatalf("wsToTCP = %q, %v; want ws_eos, nil", op, err)
+	}
+	if d < 900*time.Millisecond {
+		t.Errorf("relayed %d bytes in %v, want about 1s at %d B/s after the burst", len(payload), d, rate)
+	}
+	if n := count.Load(); n != int64(len(payload)) {
+		t.Errorf("count = %d, want %d", n, len(payload))
+	}
+	if n := <-got; n != len(payload) {
+		t.Errorf("target received %d bytes, want %d", n, len(payload))
+	}
+}
@@ -0,0 +1,139 @@
+package relay
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"regexp"
+	"sync/atomic"
+)
+
+// customRedactions holds the deployment-specific secret patterns set by
+// SetRedactPatterns, compiled once. A nil pointer means none.
+var customRedactions atomic.Pointer[[]*regexp.Regexp]
+
+// SetRedactPatterns installs extra secret patterns that sanitizeErr,
+// RedactString and NewRedactingHandler scrub in addition to the
+// built-in token patterns. Each pattern is a Go regular expression. A
+// pattern without capture groups has its whole match replaced with
+// REDACTED; a pattern with groups has only the group contents replaced,
+// so `mytoken=(\S+)` keeps the "mytoken=" prefix readable.
+//
+// Patterns are compiled once here; an invalid pattern is reported and
+// leaves the previous set in place. Passing no patterns clears the set.
+func SetRedactPatterns(patterns []string) error {
+	if len(patterns) == 0 {
+		customRedactions.Store(nil)
+		return nil
+	}
+	res := make([]*regexp.Regexp, 0, len(patterns))
+	for _, p := range patterns {
+		re, err := regexp.Compile(p)
+		if err != nil {
+			return fmt.Errorf("invalid redact pattern %q: %w", p, err)
+		}
+		res = append(res, re)
+	}
+	customRedactions.Store(&res)
+	return nil
+}
+
+// RedactString applies the patterns installed by SetRedactPatterns to
+// s. It returns s unchanged when none are installed.
+func RedactString(s string) string {
+	res := customRedactions.Load()
+	if res == nil {
+		return s
+	}
+	for _, re := range *res {
+		s = redactRegexp(re, s)
+	}
+	return s
+}
+
+func redactRegexp(re *regexp.Regexp, s string) string {
+	if re.NumSubexp() == 0 {
+		return re.ReplaceAllLiteralString(s, "REDACTED")
+	}
+	matches := re.FindAllStringSubmatchIndex(s, -1)
+	if matches == nil {
+		return s
+	}
+	var out []byte
+	last := 0
+	for _, m := range matches {
+		// m[0:2] spans the whole match; m[2:] are group pairs in
+		// left-to-right order. Unmatched optional groups are -1.
+		for g := 2; g+1 < len(m); g += 2 {
+			if m[g] < 0 || m[g] < last {
+				continue
+			}
+			out = append(out, s[last:m[g]]...)
+			out = append(out, "REDACTED"...)
+			last = m[g+1]
+		}
+	}
+	out = append(out, s[last:]...)
+	return string(out)
+}
+
+// NewRedactingHandler wraps h so the message and every string or error
+// attribute of each record pass through RedactString before reaching
+// h. With no patterns installed records pass through untouched.
+func NewRedactingHandler(h slog.Handler) slog.Handler {
+	return &redactingHandler{h: h}
+}
+
+type redactingHandler struct {
+	h slog.Handler
+}
+
+func (r *redactingHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return r.h.Enabled(ctx, level)
+}
+
+func (r *redactingHandler) Handle(ctx context.Context, rec slog.Record) error {
+	if customRedactions.Load() == nil {
+		return r.h.Handle(ctx, rec)
+	}
+	out := slog.NewRecord(rec.Time, rec.Level, RedactString(rec.Message), rec.PC)
+	rec.Attrs(func(a slog.Attr) bool {
+		out.AddAttrs(redactAttr(a))
+		return true
+	})
+	return r.h.Handle(ctx, out)
+}
+
+func (r *redactingHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	red := make([]slog.Attr, len(attrs))
+	for i, a := range attrs {
+		red[i] = redactAttr(a)
+	}
+	return &redactingHandler{h: r.h.WithAttrs(red)}
+}
+
+func (r *redactingHandler) WithGroup(name string) slog.Handler {
+	return &redactingHandler{h: r.h.WithGroup(name)}
+}
+
+func redactAttr(a slog.Attr) slog.Attr {
+	v := a.Value.Resolve()
+	switch v.Kind() {
+	case slog.KindString:
+		a.Value = slog.StringValue(RedactString(v.String()))
+	case slog.KindGroup:
+		group := v.Group()
+		red := make([]slog.Attr, len(group))
+		for i, ga := range group {
+			red[i] = redactAttr(ga)
+		}
+		a.Value = slog.GroupValue(red...)
+	case slog.KindAny:
+		if err, ok := v.Any().(error); ok && err != nil {
+			if s := err.Error(); RedactString(s) != s {
+				a.Value = slog.StringValue(RedactString(s))
+			}
+		}
+	}
+	return a
+}
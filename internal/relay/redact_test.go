@@ -0,0 +1,88 @@
+package relay
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+	"testing"
+)
+
+// setRedactPatterns installs patterns for the duration of a test.
+func setRedactPatterns(t *testing.T, patterns ...string) {
+	t.Helper()
+	if err := SetRedactPatterns(patterns); err != nil {
+		t.Fatalf("SetRedactPatterns: %v", err)
+	}
+	t.Cleanup(func() { _ = SetRedactPatterns(nil) })
+}
+
+func TestRedactString(t *testing.T) {
+	setRedactPatterns(t, `corp-[0-9a-f]{8}`, `x-api-key=([^&\s]+)`)
+
+	tests := []struct {
+		name, in, want string
+	}{
+		{"whole match", "auth corp-deadbeef failed", "auth REDACTED failed"},
+		{"group only", "GET /?x-api-key=s3cr3t&q=1", "GET /?x-api-key=REDACTED&q=1"},
+		{"both", "corp-0badf00d x-api-key=k", "REDACTED x-api-key=REDACTED"},
+		{"no match", "connection refused", "connection refused"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := RedactString(tt.in); got != tt.want {
+				t.Errorf("RedactString(%q) = %q, want %q", tt.in, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSetRedactPatterns_Invalid(t *testing.T) {
+	setRedactPatterns(t, `keep-[a-z]+`)
+	if err := SetRedactPatterns([]string{`(unclosed`}); err == nil {
+		t.Fatal("expected error for invalid pattern")
+	}
+	// The previously installed set stays active.
+	if got := RedactString("keep-me"); got != "REDACTED" {
+		t.Errorf("RedactString after failed set = %q, want REDACTED", got)
+	}
+}
+
+func TestSanitizeErr_CustomPatternKeepsBuiltins(t *testing.T) {
+	setRedactPatterns(t, `meta-token:\s*(\S+)`)
+
+	err := sanitizeErr(fmt.Errorf("dial wss://h/$hc/e?sb-hc-token=SECRET1 meta-token: SECRET2 status 401"))
+	if strings.Contains(err.Error(), "SECRET") {
+		t.Errorf("secret survived sanitizeErr: %v", err)
+	}
+	want := "dial wss://h/$hc/e?sb-hc-token=REDACTED meta-token: REDACTED status 401"
+	if err.Error() != want {
+		t.Errorf("sanitizeErr = %q, want %q", err.Error(), want)
+	}
+}
+
+func TestRedactingHandler(t *testing.T) {
+	setRedactPatterns(t, `tok_[A-Za-z0-9]+`)
+
+	var buf bytes.Buffer
+	logger := slog.New(NewRedactingHandler(slog.NewTextHandler(&buf, nil))).
+		With("bound", "tok_bound1")
+	logger.Info("saw tok_msg2",
+		"plain", "tok_attr3",
+		"error", errors.New("upstream said tok_err4"),
+		slog.Group("g", "nested", "tok_group5"),
+		"target", "10.0.0.1:22")
+
+	out := buf.String()
+	for _, secret := range []string{"tok_bound1", "tok_msg2", "tok_attr3", "tok_err4", "tok_group5"} {
+		if strings.Contains(out, secret) {
+			t.Errorf("log output leaked %q:\n%s", secret, out)
+		}
+	}
+	for _, keep := range []string{"saw REDACTED", "upstream said REDACTED", "target=10.0.0.1:22"} {
+		if !strings.Contains(out, keep) {
+			t.Errorf("log output missing %q:\n%s", keep, out)
+		}
+	}
+}
@@ -2,6 +2,8 @@ package relay
 
 import (
 	"context"
+	"net/url"
+	"strconv"
 	"strings"
 	"testing"
 	"time"
@@ -54,6 +56,112 @@ func TestSASTokenProvider_GetToken(t *testing.T) {
 	}
 }
 
+func TestSASTokenProvider_Expiry(t *testing.T) {
+	for _, tc := range []struct {
+		expiry, want time.Duration
+	}{
+		{0, tokenExpiry},
+		{10 * time.Minute, 10 * time.Minute},
+		{24 * time.Hour, 24 * time.Hour},
+	} {
+		tp := &SASTokenProvider{KeyName: "mypolicy", Key: "test-secret-key", Expiry: tc.expiry}
+		before := time.Now()
+		token, err := tp.GetToken(context.Background(), "https://test.servicebus.windows.net/myhc")
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		q, err := url.ParseQuery(strings.TrimPrefix(token, "SharedAccessSignature "))
+		if err != nil {
+			t.Fatalf("parse token: %v", err)
+		}
+		se, err := strconv.ParseInt(q.Get("se"), 10, 64)
+		if err != nil {
+			t.Fatalf("parse se: %v", err)
+		}
+		// se is whole seconds, so allow a second either side.
+		if got := time.Unix(se, 0).Sub(before); got < tc.want-time.Second || got > tc.want+time.Second {
+			t.Errorf("Expiry %s: token expires in %s, want %s", tc.expiry, got, tc.want)
+		}
+		if got := tokenLifetime(&metricsTokenProvider{inner: tp}); got != tc.want {
+			t.Errorf("Expiry %s: tokenLifetime = %s, want %s", tc.expiry, got, tc.want)
+		}
+	}
+}
+
+func TestValidateSASKey(t *testing.T) {
+	for _, key := range []string{
+		"dGVzdGtleQ==",
+		"q0Fj8pMqXZ8o6J1kV4m2Yw3rT5uH7sLdN9bC1eA0fGk=",
+	} {
+		if err := ValidateSASKey(key); err != nil {
+			t.Errorf("ValidateSASKey(%q) = %v, want nil", key, err)
+		}
+	}
+	for _, key := range []string{
+		"",
+		"not a key",
+		"dGVzdGtleQ",   // truncated padding
+		"dGVzdGtl*Q==", // typo
+		"'dGVzdGtleQ=='",
+	} {
+		err := ValidateSASKey(key)
+		if err == nil {
+			t.Errorf("ValidateSASKey(%q) = nil, want an error", key)
+			continue
+		}
+		if key != "" && strings.Contains(err.Error(), key) {
+			t.Errorf("ValidateSASKey(%q): error leaked the key: %v", key, err)
+		}
+	}
+}
+
+func TestSASTokenProvider_SetKey(t *testing.T) {
+	const resURI = "https://test.servicebus.windows.net/myhc"
+	tp := &SASTokenProvider{KeyName: "old-rule", Key: "old-key"}
+
+	if err := tp.SetKey("new-rule", "new-key"); err != nil {
+		t.Fatalf("SetKey: %v", err)
+	}
+	token, err := tp.GetToken(context.Background(), resURI)
+	if err != nil {
+		t.Fatalf("GetToken: %v", err)
+	}
+	if !strings.Contains(token, "skn=new-rule") {
+		t.Errorf("token not issued for the new key name: %s", token)
+	}
+	if !validSASSignature(t, token, resURI, "new-key") {
+		t.Errorf("token is not signed with the new key: %s", token)
+	}
+	if validSASSignature(t, token, resURI, "old-key") {
+		t.Errorf("token still verifies with the old key: %s", token)
+	}
+	if name, key := tp.Credentials(); name != "new-rule" || key != "new-key" {
+		t.Errorf("Credentials() = (%q, %q), want (new-rule, new-key)", name, key)
+	}
+
+	if err := tp.SetKey("", "k"); err == nil {
+		t.Error("SetKey with an empty key name succeeded")
+	}
+	if name, _ := tp.Credentials(); name != "new-rule" {
+		t.Errorf("rejected SetKey changed the credentials to %q", name)
+	}
+}
+
+// validSASSignature reports whether token's sig matches an HMAC of its
+// own sr/se fields under key.
+func validSASSignature(t *testing.T, token, resURI, key string) bool {
+	t.Helper()
+	q, err := url.ParseQuery(strings.TrimPrefix(token, "SharedAccessSignature "))
+	if err != nil {
+		t.Fatalf("parse token: %v", err)
+	}
+	exp, err := strconv.ParseInt(q.Get("se"), 10, 64)
+	if err != nil {
+		t.Fatalf("parse se: %v", err)
+	}
+	return q.Get("sig") == sign(url.QueryEscape(strings.ToLower(resURI)), exp, key)
+}
+
 func TestEntraTokenProvider_GetToken(t *testing.T) {
 	// Use a mock credential to test the EntraTokenProvider without
 	// requiring real Azure credentials.
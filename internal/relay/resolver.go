@@ -0,0 +1,191 @@
+package relay
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ResolverOptions selects the DNS servers aztunnel resolves relay
+// endpoints and listener targets through. The zero value means the
+// system resolver.
+type ResolverOptions struct {
+	// Servers are plain DNS servers (host:port, or host for port 53)
+	// tried in order.
+	Servers []string
+	// DoH is a DNS-over-HTTPS endpoint (RFC 8484), e.g.
+	// https://1.1.1.1/dns-query. It takes precedence over Servers.
+	// The DoH host itself is resolved with the system resolver, so
+	// prefer an IP literal on networks without working system DNS.
+	DoH string
+}
+
+// dnsQueryTimeout bounds one DNS-over-HTTPS round trip.
+const dnsQueryTimeout = 5 * time.Second
+
+// NewResolver returns a *net.Resolver for o, or nil when o selects the
+// system resolver. A nil *net.Resolver is what net.Dialer treats as
+// the default, so callers can store the result unconditionally.
+func NewResolver(o ResolverOptions) (*net.Resolver, error) {
+	switch {
+	case o.DoH != "":
+		u, err := url.Parse(o.DoH)
+		if err != nil || u.Scheme != "https" || u.Host == "" {
+			return nil, fmt.Errorf("invalid DoH URL %q: must be https://host/path", o.DoH)
+		}
+		client := &http.Client{Timeout: dnsQueryTimeout}
+		return &net.Resolver{
+			PreferGo: true,
+			Dial: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				return newDoHConn(ctx, client, u.String()), nil
+			},
+		}, nil
+	case len(o.Servers) > 0:
+		servers := make([]string, len(o.Servers))
+		for i, s := range o.Servers {
+			if _, _, err := net.SplitHostPort(s); err != nil {
+				s = net.JoinHostPort(strings.Trim(s, "[]"), "53")
+			}
+			servers[i] = s
+		}
+		return &net.Resolver{
+			PreferGo: true,
+			Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+				var d net.Dialer
+				var errs []error
+				for _, s := range servers {
+					conn, err := d.DialContext(ctx, network, s)
+					if err == nil {
+						return conn, nil
+					}
+					errs = append(errs, err)
+				}
+				return nil, errors.Join(errs...)
+			},
+		}, nil
+	default:
+		return nil, nil
+	}
+}
+
+// dohConn adapts DNS-over-HTTPS to the net.Conn the Go resolver
+// expects from Dial. dohConn is not a net.PacketConn, so the resolver
+// frames queries with the RFC 1035 two-byte length prefix whatever the
+// network; each complete query written is POSTed to the DoH endpoint
+// as application/dns-message and the framed answer is queued for Read.
+type dohConn struct {
+	ctx    context.Context
+	client *http.Client
+	url    string
+
+	mu       sync.Mutex
+	pending  bytes.Buffer // partially written query
+	answers  bytes.Buffer // framed answers not yet read
+	deadline time.Time
+	closed   bool
+}
+
+func newDoHConn(ctx context.Context, client *http.Client, u string) *dohConn {
+	return &dohConn{ctx: ctx, client: client, url: u}
+}
+
+func (c *dohConn) Write(b []byte) (int, error) {
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return 0, net.ErrClosed
+	}
+	c.pending.Write(b)
+	var queries [][]byte
+	for c.pending.Len() >= 2 {
+		n := int(binary.BigEndian.Uint16(c.pending.Bytes()))
+		if c.pending.Len() < 2+n {
+			break
+		}
+		c.pending.Next(2)
+		queries = append(queries, bytes.Clone(c.pending.Next(n)))
+	}
+	deadline := c.deadline
+	c.mu.Unlock()
+
+	for _, q := range queries {
+		answer, err := c.exchange(q, deadline)
+		if err != nil {
+			return 0, err
+		}
+		var l [2]byte
+		binary.BigEndian.PutUint16(l[:], uint16(len(answer)))
+		c.mu.Lock()
+		c.answers.Write(l[:])
+		c.answers.Write(answer)
+		c.mu.Unlock()
+	}
+	return len(b), nil
+}
+
+// exchange performs one DoH round trip.
+func (c *dohConn) exchange(query []byte, deadline time.Time) ([]byte, error) {
+	ctx := c.ctx
+	if !deadline.IsZero() {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithDeadline(ctx, deadline)
+		defer cancel()
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.url, bytes.NewReader(query))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/dns-message")
+	req.Header.Set("Accept", "application/dns-message")
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("doh query: %w", err)
+	}
+	defer resp.Body.Close() //nolint:errcheck // best-effort cleanup
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("doh query: %s", resp.Status)
+	}
+	return io.ReadAll(io.LimitReader(resp.Body, 65535))
+}
+
+func (c *dohConn) Read(b []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.answers.Len() == 0 {
+		return 0, io.EOF
+	}
+	return c.answers.Read(b)
+}
+
+func (c *dohConn) Close() error {
+	c.mu.Lock()
+	c.closed = true
+	c.mu.Unlock()
+	return nil
+}
+
+func (c *dohConn) SetDeadline(t time.Time) error {
+	c.mu.Lock()
+	c.deadline = t
+	c.mu.Unlock()
+	return nil
+}
+
+func (c *dohConn) SetReadDeadline(time.Time) error    { return nil }
+func (c *dohConn) SetWriteDeadline(t time.Time) error { return c.SetDeadline(t) }
+func (c *dohConn) LocalAddr() net.Addr                { return dohAddr{} }
+func (c *dohConn) RemoteAddr() net.Addr               { return dohAddr{} }
+
+type dohAddr struct{}
+
+func (dohAddr) Network() string { return "doh" }
+func (dohAddr) String() string  { return "doh" }
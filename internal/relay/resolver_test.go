@@ -0,0 +1,209 @@
+package relay
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// stubDNSAnswer answers a DNS query with a single A record for ip (or
+// no records for non-A queries). Enough of RFC 1035 for the Go
+// resolver: the question is echoed back and the answer points at it.
+func stubDNSAnswer(query []byte, ip net.IP) []byte {
+	if len(query) < 12 {
+		return nil
+	}
+	// End of the question: QNAME labels, then QTYPE and QCLASS.
+	i := 12
+	for i < len(query) && query[i] != 0 {
+		i += int(query[i]) + 1
+	}
+	i += 5
+	if i > len(query) {
+		return nil
+	}
+	qtype := binary.BigEndian.Uint16(query[i-4:])
+
+	var b bytes.Buffer
+	b.Write(query[:2])          // ID
+	b.Write([]byte{0x81, 0x80}) // response, RD, RA
+	b.Write([]byte{0, 1})       // QDCOUNT
+	if qtype == 1 {
+		b.Write([]byte{0, 1}) // ANCOUNT
+	} else {
+		b.Write([]byte{0, 0})
+	}
+	b.Write([]byte{0, 0, 0, 0}) // NSCOUNT, ARCOUNT
+	b.Write(query[12:i])
+	if qtype == 1 {
+		b.Write([]byte{0xc0, 0x0c, 0, 1, 0, 1, 0, 0, 0, 60, 0, 4})
+		b.Write(ip.To4())
+	}
+	return b.Bytes()
+}
+
+// startStubDNS serves stubDNSAnswer over UDP and returns its address
+// and a counter of queries received.
+func startStubDNS(t *testing.T, ip net.IP) (string, *atomic.Int64) {
+	t.Helper()
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen udp: %v", err)
+	}
+	t.Cleanup(func() { _ = pc.Close() })
+	var queries atomic.Int64
+	go func() {
+		buf := make([]byte, 1500)
+		for {
+			n, addr, err := pc.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			queries.Add(1)
+			if resp := stubDNSAnswer(buf[:n], ip); resp != nil {
+				_, _ = pc.WriteTo(resp, addr)
+			}
+		}
+	}()
+	return pc.LocalAddr().String(), &queries
+}
+
+func TestNewResolver_DefaultIsSystem(t *testing.T) {
+	r, err := NewResolver(ResolverOptions{})
+	if err != nil {
+		t.Fatalf("NewResolver: %v", err)
+	}
+	if r != nil {
+		t.Errorf("NewResolver(zero) = %v, want nil (system resolver)", r)
+	}
+}
+
+func TestNewResolver_Servers(t *testing.T) {
+	addr, queries := startStubDNS(t, net.IPv4(10, 1, 2, 3))
+	r, err := NewResolver(ResolverOptions{Servers: []string{addr}})
+	if err != nil {
+		t.Fatalf("NewResolver: %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	addrs, err := r.LookupHost(ctx, "target.aztunnel.test")
+	if err != nil {
+		t.Fatalf("LookupHost: %v", err)
+	}
+	if len(addrs) != 1 || addrs[0] != "10.1.2.3" {
+		t.Errorf("LookupHost = %v, want [10.1.2.3]", addrs)
+	}
+	if queries.Load() == 0 {
+		t.Error("stub DNS server saw no queries")
+	}
+}
+
+func TestNewResolver_DoH(t *testing.T) {
+	var queries atomic.Int64
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || r.Header.Get("Content-Type") != "application/dns-message" {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+		q, _ := io.ReadAll(r.Body)
+		queries.Add(1)
+		w.Header().Set("Content-Type", "application/dns-message")
+		_, _ = w.Write(stubDNSAnswer(q, net.IPv4(10, 4, 5, 6)))
+	}))
+	defer srv.Close()
+
+	// The DoH client uses http.DefaultTransport; trust the test server.
+	orig := http.DefaultTransport
+	http.DefaultTransport = srv.Client().Transport
+	defer func() { http.DefaultTransport = orig }()
+
+	r, err := NewResolver(ResolverOptions{DoH: srv.URL + "/dns-query", Servers: []string{"192.0.2.1:53"}})
+	if err != nil {
+		t.Fatalf("NewResolver: %v", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	addrs, err := r.LookupHost(ctx, "target.aztunnel.test")
+	if err != nil {
+		t.Fatalf("LookupHost: %v", err)
+	}
+	if len(addrs) != 1 || addrs[0] != "10.4.5.6" {
+		t.Errorf("LookupHost = %v, want [10.4.5.6]", addrs)
+	}
+	if queries.Load() == 0 {
+		t.Error("DoH server saw no queries")
+	}
+}
+
+func TestNewResolver_InvalidDoH(t *testing.T) {
+	for _, u := range []string{"http://1.1.1.1/dns-query", "https://", "::"} {
+		if _, err := NewResolver(ResolverOptions{DoH: u}); err == nil {
+			t.Errorf("NewResolver(DoH=%q) succeeded, want error", u)
+		}
+	}
+}
+
+func TestClientOptions_ResolverUsedForRelayDial(t *testing.T) {
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer srv.Close()
+	_, port, _ := net.SplitHostPort(strings.TrimPrefix(srv.URL, "https://"))
+
+	addr, queries := startStubDNS(t, net.IPv4(127, 0, 0, 1))
+	r, err := NewResolver(ResolverOptions{Servers: []string{addr}})
+	if err != nil {
+		t.Fatalf("NewResolver: %v", err)
+	}
+	opts := ClientOptions{
+		TLSConfig: &tls.Config{InsecureSkipVerify: true}, //nolint:gosec // test server
+		Resolver:  r,
+	}
+
+	resp, err := opts.dialOptions("").HTTPClient.Get("https://relay.aztunnel.test:" + port + "/")
+	if err != nil {
+		t.Fatalf("GET through custom resolver: %v", err)
+	}
+	resp.Body.Close()
+	if queries.Load() == 0 {
+		t.Error("relay host was not resolved through the configured server")
+	}
+}
+
+func TestClientOptions_RelayIPPinsEndpoint(t *testing.T) {
+	var gotHost, gotSNI string
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotHost, gotSNI = r.Host, r.TLS.ServerName
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer srv.Close()
+	_, port, _ := net.SplitHostPort(strings.TrimPrefix(srv.URL, "https://"))
+
+	// relay.aztunnel.test does not resolve; only the pin can reach srv.
+	endpoint := "relay.aztunnel.test:" + port
+	opts := ClientOptions{
+		TLSConfig: &tls.Config{InsecureSkipVerify: true}, //nolint:gosec // test server
+		RelayIP:   net.IPv4(127, 0, 0, 1),
+	}
+	resp, err := opts.dialOptions(endpoint).HTTPClient.Get("https://" + endpoint + "/")
+	if err != nil {
+		t.Fatalf("GET through pinned IP: %v", err)
+	}
+	resp.Body.Close()
+	if gotHost != endpoint {
+		t.Errorf("Host = %q, want %q", gotHost, endpoint)
+	}
+	if gotSNI != "relay.aztunnel.test" {
+		t.Errorf("SNI = %q, want relay.aztunnel.test", gotSNI)
+	}
+}
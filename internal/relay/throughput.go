@@ -0,0 +1,77 @@
+package relay
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+)
+
+// throughputSamples is how many samples the minimum-throughput
+// detector takes per window, so the window slides in steps of
+// Window/throughputSamples rather than jumping a whole window at a
+// time.
+const throughputSamples = 4
+
+// MinThroughput configures Bridge's stall detector. Once data has
+// started flowing from the local side, every sliding Window must carry
+// at least BytesPerSec*Window bytes or the bridge ends with cause
+// too_slow. A window in which nothing at all arrived is left alone:
+// that is an idle connection, not a slow one. Either field <= 0
+// disables the detector.
+type MinThroughput struct {
+	BytesPerSec int64
+	Window      time.Duration
+}
+
+func (mt MinThroughput) enabled() bool { return mt.BytesPerSec > 0 && mt.Window > 0 }
+
+// minThroughputKey is the context key for WithMinThroughput.
+type minThroughputKey struct{}
+
+// WithMinThroughput returns a copy of ctx that makes Bridge enforce mt
+// on the bytes it reads from its local (TCP) side. On the listener
+// that side is the target, so a backend that trickles its response
+// is cut off. BridgeSession ignores the setting.
+func WithMinThroughput(ctx context.Context, mt MinThroughput) context.Context {
+	return context.WithValue(ctx, minThroughputKey{}, mt)
+}
+
+func minThroughputFrom(ctx context.Context) MinThroughput {
+	mt, _ := ctx.Value(minThroughputKey{}).(MinThroughput)
+	return mt
+}
+
+// watchThroughput samples count every Window/throughputSamples and
+// calls onSlow, then returns, the first time a full window that began
+// after data had started saw some bytes but fewer than the minimum.
+// It returns without calling onSlow when ctx ends.
+func watchThroughput(ctx context.Context, count *atomic.Int64, mt MinThroughput, onSlow func()) {
+	step := mt.Window / throughputSamples
+	if step <= 0 {
+		step = mt.Window
+	}
+	ticker := time.NewTicker(step)
+	defer ticker.Stop()
+
+	// Cumulative byte counts at each of the last throughputSamples+1
+	// ticks; ring[0] is the count one window ago.
+	want := int64(float64(mt.BytesPerSec) * mt.Window.Seconds())
+	ring := make([]int64, 0, throughputSamples+1)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		ring = append(ring, count.Load())
+		if len(ring) < cap(ring) {
+			continue
+		}
+		start, moved := ring[0], ring[len(ring)-1]-ring[0]
+		ring = append(ring[:0], ring[1:]...)
+		if start > 0 && moved > 0 && moved < want {
+			onSlow()
+			return
+		}
+	}
+}
@@ -0,0 +1,120 @@
+package relay
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/coder/websocket"
+)
+
+// throughputBridge starts a Bridge against a draining WebSocket peer
+// with mt applied, and writes chunk to the local side every interval
+// until the test ends (once when interval is zero). It returns the channel the BridgeResult
+// arrives on and a func that closes the local side.
+func throughputBridge(t *testing.T, mt MinThroughput, chunk []byte, interval time.Duration) (<-chan BridgeResult, func()) {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ws, err := websocket.Accept(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer ws.CloseNow()
+		for {
+			if _, _, err := ws.Read(r.Context()); err != nil {
+				return
+			}
+		}
+	}))
+	t.Cleanup(srv.Close)
+
+	ws, _, err := websocket.Dial(context.Background(), "ws"+strings.TrimPrefix(srv.URL, "http"), nil)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	t.Cleanup(func() { _ = ws.CloseNow() })
+
+	clientConn, serverConn := net.Pipe()
+	t.Cleanup(func() { _ = serverConn.Close() })
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	t.Cleanup(cancel)
+
+	ch := make(chan BridgeResult, 1)
+	go func() {
+		r, _ := Bridge(WithMinThroughput(ctx, mt), ws, serverConn)
+		ch <- r
+	}()
+	go func() {
+		for {
+			if len(chunk) > 0 {
+				if _, err := clientConn.Write(chunk); err != nil {
+					return
+				}
+			}
+			if interval == 0 {
+				return
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(interval):
+			}
+		}
+	}()
+	return ch, func() { _ = clientConn.Close() }
+}
+
+func TestBridge_MinThroughput_TrickleEndsTooSlow(t *testing.T) {
+	// 1 byte every 20ms is ~50 B/s, far below the 1000 B/s minimum.
+	ch, closeLocal := throughputBridge(t, MinThroughput{BytesPerSec: 1000, Window: 200 * time.Millisecond}, []byte{'x'}, 20*time.Millisecond)
+	defer closeLocal()
+
+	select {
+	case r := <-ch:
+		if r.EndCause != "too_slow" {
+			t.Errorf("EndCause = %q, want %q", r.EndCause, "too_slow")
+		}
+		if r.TCPToWS != nil {
+			t.Errorf("TCPToWS = %v, want nil (the induced deadline is not a local failure)", r.TCPToWS)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("trickling bridge was not terminated")
+	}
+}
+
+func TestBridge_MinThroughput_FastAndIdleSurvive(t *testing.T) {
+	mt := MinThroughput{BytesPerSec: 1000, Window: 100 * time.Millisecond}
+	for _, tc := range []struct {
+		name     string
+		chunk    []byte
+		interval time.Duration
+	}{
+		{"fast", bytes.Repeat([]byte{'x'}, 4096), 10 * time.Millisecond},
+		// One burst and then silence: an idle connection, not a slow one.
+		{"idle", []byte("hello"), 0},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			ch, closeLocal := throughputBridge(t, mt, tc.chunk, tc.interval)
+			select {
+			case r := <-ch:
+				t.Fatalf("bridge ended early with cause %q", r.EndCause)
+			case <-time.After(6 * mt.Window):
+			}
+			closeLocal()
+			select {
+			case r := <-ch:
+				if r.EndCause != "local_close" {
+					t.Errorf("EndCause = %q, want %q", r.EndCause, "local_close")
+				}
+			case <-time.After(3 * time.Second):
+				t.Fatal("bridge did not terminate after local close")
+			}
+		})
+	}
+}
@@ -0,0 +1,35 @@
+package relay
+
+import (
+	"context"
+	"crypto/tls"
+	"log/slog"
+	"net/http"
+)
+
+// logTLSState emits a single DEBUG line describing the TLS session
+// negotiated for a successful relay WebSocket dial: protocol version,
+// cipher suite, key-exchange group, and whether the session was
+// resumed from the shared ClientSessionCache. Compliance reporting
+// consumes this line to show which TLS parameters the relay channel
+// actually used.
+//
+// The state comes from resp.TLS, which net/http populates from the
+// underlying *tls.Conn for the 101 upgrade response. Only the
+// negotiated parameters are logged — never the server certificate
+// chain, session tickets, or the dial URL (which embeds the SAS
+// token).
+//
+// Safe to call with a nil resp or a resp without TLS state (plain
+// ws:// test servers); nothing is logged in that case.
+func logTLSState(ctx context.Context, logger *slog.Logger, resp *http.Response, msg string) {
+	if logger == nil || resp == nil || resp.TLS == nil || !logger.Enabled(ctx, slog.LevelDebug) {
+		return
+	}
+	st := resp.TLS
+	logger.Debug(msg,
+		"tls_version", tls.VersionName(st.Version),
+		"cipher_suite", tls.CipherSuiteName(st.CipherSuite),
+		"curve", st.CurveID.String(),
+		"resumed", st.DidResume)
+}
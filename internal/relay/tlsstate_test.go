@@ -0,0 +1,72 @@
+package relay
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/coder/websocket"
+)
+
+func TestDialWithRetry_LogsNegotiatedTLS(t *testing.T) {
+	srv := dialTestServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ws, err := websocket.Accept(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer ws.CloseNow()
+		<-r.Context().Done()
+	}))
+
+	logger, rec := captureLogger()
+	tp := &mockTokenProvider{token: "secret-sas-token"}
+	endpoint := strings.TrimPrefix(srv.URL, "https://")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	ws, err := DialWithRetry(ctx, endpoint, "my-entity", tp, ClientOptions{}, logger)
+	if err != nil {
+		t.Fatalf("DialWithRetry: %v", err)
+	}
+	defer ws.CloseNow()
+
+	var got map[string]any
+	for _, r := range rec.records(t) {
+		if r["msg"] == "relay rendezvous tls negotiated" {
+			got = r
+			break
+		}
+	}
+	if got == nil {
+		t.Fatalf("missing tls negotiated record in %v", rec.records(t))
+	}
+	if got["tls_version"] != "TLS 1.3" {
+		t.Errorf("tls_version = %v, want %q", got["tls_version"], "TLS 1.3")
+	}
+	if s, _ := got["cipher_suite"].(string); !strings.HasPrefix(s, "TLS_") {
+		t.Errorf("cipher_suite = %v, want a TLS_* suite name", got["cipher_suite"])
+	}
+	if got["curve"] != "CurveP384" {
+		t.Errorf("curve = %v, want %q", got["curve"], "CurveP384")
+	}
+
+	// The token must never reach the log output.
+	rec.mu.Lock()
+	raw := string(rec.buf)
+	rec.mu.Unlock()
+	if strings.Contains(raw, "secret-sas-token") {
+		t.Errorf("log output leaked the SAS token: %s", raw)
+	}
+}
+
+func TestLogTLSState_NoTLSIsSilent(t *testing.T) {
+	logger, rec := captureLogger()
+	logTLSState(context.Background(), logger, nil, "nil response")
+	logTLSState(context.Background(), logger, &http.Response{}, "plaintext response")
+	if n := len(rec.records(t)); n != 0 {
+		t.Errorf("got %d records, want 0", n)
+	}
+}
@@ -0,0 +1,123 @@
+package relay
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"sync/atomic"
+
+	"github.com/coder/websocket"
+
+	"github.com/philsphicas/aztunnel/internal/bridgecause"
+)
+
+// BridgeWS copies messages bidirectionally between two WebSocket
+// connections until one side closes or the context is cancelled. It is
+// Bridge for a relay-to-relay hop: ws is the downstream rendezvous (the
+// side Bridge calls ws) and peer is the upstream one, which takes the
+// place of Bridge's TCP side. Message types are preserved.
+//
+// The result follows Bridge's conventions with peer in the TCP role:
+// Stats.TCPToWS counts bytes from peer to ws, Stats.WSToTCP bytes from
+// ws to peer, and EndCause is peer_close when ws ended the bridge and
+// local_close when peer did. Both connections are pinged to keep the
+// relays from dropping them while idle; only the ping options of opts
+// apply. BridgeWS does not close either connection; cancelling its
+// internal context on return aborts any read still in flight.
+func BridgeWS(ctx context.Context, ws, peer *websocket.Conn, opts BridgeOptions) (BridgeResult, error) {
+	ctx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
+
+	tr := bridgeTracer(ctx)
+	var peerToWSBytes, wsToPeerBytes atomic.Int64
+	wsToPeerCh := make(chan pumpResult, 1)
+	peerToWSCh := make(chan pumpResult, 1)
+	pingDone := make(chan struct{}, 2)
+	wsKA, peerKA := newKeepalive(opts), newKeepalive(opts)
+
+	go func() {
+		traceStart(tr, "ws_to_tcp")
+		op, err := copyMessages(ctx, ws, peer, "ws_read", "tcp_write", "ws_to_tcp", &wsToPeerBytes, tr, peerKA)
+		traceEnd(tr, "ws_to_tcp", op, err, wsToPeerBytes.Load())
+		wsToPeerCh <- pumpResult{op: op, err: err}
+	}()
+	go func() {
+		traceStart(tr, "tcp_to_ws")
+		op, err := copyMessages(ctx, peer, ws, "tcp_read", "ws_write", "tcp_to_ws", &peerToWSBytes, tr, wsKA)
+		traceEnd(tr, "tcp_to_ws", op, err, peerToWSBytes.Load())
+		peerToWSCh <- pumpResult{op: op, err: err}
+	}()
+	for c, ka := range map[*websocket.Conn]*keepalive{ws: wsKA, peer: peerKA} {
+		go func() {
+			defer func() { pingDone <- struct{}{} }()
+			ka.run(ctx, c)
+		}()
+	}
+
+	var first pumpResult
+	var firstWasWSToPeer bool
+	select {
+	case r := <-wsToPeerCh:
+		first = r
+		firstWasWSToPeer = true
+	case r := <-peerToWSCh:
+		first = r
+	}
+	// Both pumps read with ctx, so cancelling it unblocks the other.
+	cancel(causeFromPumpExit(first.op, first.err))
+	if firstWasWSToPeer {
+		<-peerToWSCh
+	} else {
+		<-wsToPeerCh
+	}
+	<-pingDone
+	<-pingDone
+
+	result := BridgeResult{
+		Stats: BridgeStats{
+			TCPToWS: peerToWSBytes.Load(),
+			WSToTCP: wsToPeerBytes.Load(),
+		},
+		EndCause: bridgecause.Name(context.Cause(ctx)),
+	}
+	firstErr := first.err
+	if isInducedCancellation(firstErr) {
+		firstErr = nil
+	}
+	if firstWasWSToPeer {
+		result.WSToTCP = firstErr
+	} else {
+		result.TCPToWS = firstErr
+	}
+	return result, first.err
+}
+
+// copyMessages pumps messages from src to dst, keeping each message's
+// type, and returns the operation tag (readOp or writeOp) plus its
+// terminating error for causeFromPumpExit. Each message sent is
+// reported to ka, dst's keepalive.
+func copyMessages(ctx context.Context, src, dst *websocket.Conn, readOp, writeOp, direction string, count *atomic.Int64, tr *slog.Logger, ka *keepalive) (string, error) {
+	for {
+		typ, r, err := src.Reader(ctx)
+		if err != nil {
+			return readOp, ignoreNormalClose(err)
+		}
+		w, err := dst.Writer(ctx, typ)
+		if err != nil {
+			return writeOp, err
+		}
+		n, err := io.Copy(w, r)
+		count.Add(n)
+		if tr != nil {
+			tr.Debug("bridge trace", "trace", "chunk", "direction", direction, "bytes", n)
+		}
+		if err != nil {
+			_ = w.Close()
+			return writeOp, err
+		}
+		if err := w.Close(); err != nil {
+			return writeOp, err
+		}
+		ka.wrote()
+	}
+}
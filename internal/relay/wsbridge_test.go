@@ -0,0 +1,108 @@
+package relay
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/coder/websocket"
+)
+
+// wsPair returns both ends of one WebSocket connection.
+func wsPair(t testing.TB) (client, server *websocket.Conn) {
+	t.Helper()
+	accepted := make(chan *websocket.Conn, 1)
+	done := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ws, err := websocket.Accept(w, r, nil)
+		if err != nil {
+			return
+		}
+		accepted <- ws
+		<-done
+	}))
+	t.Cleanup(srv.Close)
+	t.Cleanup(func() { close(done) })
+
+	client, _, err := websocket.Dial(context.Background(), "ws"+strings.TrimPrefix(srv.URL, "http"), nil)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	server = <-accepted
+	t.Cleanup(func() {
+		_ = client.CloseNow()
+		_ = server.CloseNow()
+	})
+	return client, server
+}
+
+func TestBridgeWS(t *testing.T) {
+	down, downSrv := wsPair(t)
+	upCli, up := wsPair(t)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	type out struct {
+		result BridgeResult
+		err    error
+	}
+	done := make(chan out, 1)
+	go func() {
+		r, err := BridgeWS(ctx, downSrv, upCli, BridgeOptions{})
+		done <- out{r, err}
+	}()
+
+	if err := down.Write(ctx, websocket.MessageBinary, []byte("hello")); err != nil {
+		t.Fatalf("downstream write: %v", err)
+	}
+	typ, got, err := up.Read(ctx)
+	if err != nil || typ != websocket.MessageBinary || string(got) != "hello" {
+		t.Fatalf("upstream read = %v %q, %v; want binary hello", typ, got, err)
+	}
+
+	if err := up.Write(ctx, websocket.MessageText, []byte("hi")); err != nil {
+		t.Fatalf("upstream write: %v", err)
+	}
+	typ, got, err = down.Read(ctx)
+	if err != nil || typ != websocket.MessageText || string(got) != "hi" {
+		t.Fatalf("downstream read = %v %q, %v; want text hi", typ, got, err)
+	}
+
+	// The downstream side ends the bridge, like a sender hanging up.
+	go func() { _ = down.Close(websocket.StatusNormalClosure, "") }()
+	select {
+	case o := <-done:
+		if o.result.EndCause != "peer_close" {
+			t.Errorf("EndCause = %q, want peer_close", o.result.EndCause)
+		}
+		if o.result.Stats.WSToTCP != 5 || o.result.Stats.TCPToWS != 2 {
+			t.Errorf("Stats = %+v, want WSToTCP=5 TCPToWS=2", o.result.Stats)
+		}
+		if o.err != nil {
+			t.Errorf("err = %v, want nil on a normal close", o.err)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("BridgeWS did not return after the downstream closed")
+	}
+}
+
+func TestBridgeWS_UpstreamClose(t *testing.T) {
+	_, downSrv := wsPair(t)
+	upCli, up := wsPair(t)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	go func() { _ = up.Close(websocket.StatusNormalClosure, "") }()
+	result, err := BridgeWS(ctx, downSrv, upCli, BridgeOptions{})
+	if result.EndCause != "local_close" {
+		t.Errorf("EndCause = %q, want local_close", result.EndCause)
+	}
+	if err != nil {
+		t.Errorf("err = %v, want nil on a normal close", err)
+	}
+}
@@ -0,0 +1,43 @@
+package sender
+
+import (
+	"context"
+	"log/slog"
+
+	"github.com/philsphicas/aztunnel/internal/protocol"
+	"github.com/philsphicas/aztunnel/internal/relay"
+)
+
+// withWireCounter attaches a fresh relay.WireCounter to ctx when opts
+// offers compression, so the relay dial records whether
+// permessage-deflate was negotiated and the bridge metrics can report
+// the bytes it saved. Without compression it returns ctx and nil.
+func withWireCounter(ctx context.Context, opts relay.ClientOptions) (context.Context, *relay.WireCounter) {
+	if !opts.Compression {
+		return ctx, nil
+	}
+	wire := new(relay.WireCounter)
+	return relay.WithWireCounter(ctx, wire), wire
+}
+
+// compressionMetadata returns the envelope Metadata that asks the
+// listener whether its hop is compressed too, or nil when opts does
+// not offer compression.
+func compressionMetadata(opts relay.ClientOptions) map[string]string {
+	if !opts.Compression {
+		return nil
+	}
+	return map[string]string{protocol.MetaCompression: protocol.CompressionDeflate}
+}
+
+// logCompression records which hops of a compressed connection
+// negotiated permessage-deflate: the sender's own relay WebSocket and,
+// per the listener's answer, the listener's rendezvous.
+func logCompression(logger *slog.Logger, wire *relay.WireCounter, resp protocol.ConnectResponse) {
+	if wire == nil {
+		return
+	}
+	logger.Debug("compression negotiated",
+		"sender_hop", wire.Deflate(),
+		"listener_hop", resp.Metadata[protocol.MetaCompression] == protocol.CompressionDeflate)
+}
@@ -9,6 +9,7 @@ import (
 	"github.com/philsphicas/aztunnel/internal/idgen"
 	"github.com/philsphicas/aztunnel/internal/metrics"
 	"github.com/philsphicas/aztunnel/internal/relay"
+	"github.com/philsphicas/aztunnel/internal/tracing"
 )
 
 // ConnectConfig holds configuration for the connect (stdin/stdout) mode.
@@ -17,53 +18,115 @@ type ConnectConfig struct {
 	EntityPath    string
 	TokenProvider relay.TokenProvider
 	ClientOptions relay.ClientOptions
-	Target        string // host:port
+	Target        string // host:port; ignored when Dynamic is set
 	Stdin         io.ReadCloser
 	Stdout        io.WriteCloser
 	Logger        *slog.Logger
 	Metrics       *metrics.Metrics // optional; nil disables metrics
+	Tracer        *tracing.Tracer  // optional; nil disables tracing
 	// DialBudget bounds the relay dial + retry duration. Zero (the
 	// default) uses defaultDialBudget. See issue #94: without a
 	// bound, retry runs until the parent ctx is cancelled (which in
 	// `connect` mode is the process lifetime), keeping the user
 	// hanging if no listener ever appears.
 	DialBudget time.Duration
+	// EnvelopeTimeout bounds the wait for the listener's response to
+	// the connect envelope. Zero uses defaultEnvelopeTimeout.
+	EnvelopeTimeout time.Duration
+	// Dynamic reads the target from the first line of Stdin instead
+	// of Target, so a wrapper (ssh ProxyCommand, a script) can pick
+	// the destination at run time. The line must be host:port; the
+	// bytes after it are bridged as usual.
+	Dynamic bool
+	// AllowList optionally restricts the targets a Dynamic line may
+	// name, using the listener's --allow syntax. A refused target
+	// fails before the relay is dialed. Empty allows everything.
+	AllowList []string
+	// BufferSize is the bridge copy buffer size; see
+	// relay.BridgeOptions.BufferSize. Zero uses the default.
+	BufferSize int
+
+	// IdleTimeout closes a bridged connection that has moved no data
+	// for this long; see relay.BridgeOptions.IdleTimeout. Zero
+	// disables it.
+	IdleTimeout time.Duration
+
+	// RateLimit caps each direction of a bridged connection in
+	// bytes/sec; see relay.BridgeOptions.RateLimit. Zero is unlimited.
+	RateLimit int64
+
+	// DataPingInterval is how long a bridged connection's WebSocket
+	// may go without sending before it is pinged; see
+	// relay.BridgeOptions.PingInterval. Zero selects the relay package
+	// default (30s); a negative value disables pings.
+	DataPingInterval time.Duration
 }
 
 // Connect performs a one-shot connection: dials the relay, sends the
 // envelope, and bridges stdin/stdout with the tunnel. It returns when
 // either side closes.
-func Connect(ctx context.Context, cfg ConnectConfig) error {
+func Connect(ctx context.Context, cfg ConnectConfig) (err error) {
 	if cfg.Logger == nil {
 		cfg.Logger = slog.Default()
 	}
+	if cfg.Dynamic {
+		target, stdin, err := resolveDynamicTarget(cfg)
+		if err != nil {
+			cfg.Logger.Warn("dynamic target rejected", "error", err)
+			return err
+		}
+		cfg.Target, cfg.Stdin = target, stdin
+	}
 
 	bridgeID := idgen.NewBridgeID()
 	logger := cfg.Logger.With("bridge_id", bridgeID)
 	logger.Info("connection requested", "target", cfg.Target)
 
+	span := cfg.Tracer.Start("aztunnel.sender.connect", tracing.KindClient, "")
+	defer span.End()
+	span.SetAttr(tracing.AttrTarget, cfg.Target)
+	span.SetAttr(tracing.AttrBridgeID, bridgeID)
+
+	stdio := &stdioConn{in: cfg.Stdin, out: cfg.Stdout}
+
+	// Track the connection from here so one that fails before its
+	// bridge still counts.
+	ctx = metrics.WithConnID(ctx, bridgeID)
+	ctx = metrics.WithConnLabels(ctx, connLabels(stdio, cfg.Endpoint))
+	ctx, tracker := cfg.Metrics.TrackConnection(ctx, "sender", cfg.Target)
+	defer func() { tracker.Finish(err) }()
+
 	// Per-connection dial budget caps retry duration so the user
 	// isn't left hanging if no listener ever appears (issue #94).
 	// The bridge below uses the original ctx (process lifetime),
 	// not dialCtx, so a successful dial isn't torn down here.
+	ctx, wire := withWireCounter(ctx, cfg.ClientOptions)
 	dialCtx, cancelDial := context.WithTimeout(ctx, dialBudget(cfg.DialBudget))
+	dialStart := time.Now()
 	ws, err := cfg.Metrics.InstrumentedDial(dialCtx, cfg.Endpoint, cfg.EntityPath, cfg.TokenProvider, cfg.ClientOptions, "sender", logger)
 	cancelDial()
+	span.SetAttr(tracing.AttrDialDuration, time.Since(dialStart))
 	if err != nil {
+		span.SetError(err)
 		return err
 	}
 	defer func() { _ = ws.CloseNow() }()
 
-	listenerID, err := sendEnvelopeAndCheck(ctx, ws, cfg.Target, bridgeID)
+	resp, err := sendEnvelopeAndCheck(ctx, ws, cfg.Target, bridgeID, envelopeMetadata(cfg.ClientOptions, span, nil), cfg.EnvelopeTimeout)
 	if err != nil {
-		logRejection(logger, cfg.Target, listenerID, err)
-		cfg.Metrics.ConnectionError("sender", metrics.ReasonEnvelopeError)
+		logRejection(logger, cfg.Target, resp.ListenerID, err)
+		cfg.Metrics.ConnectionError("sender", envelopeReason(err))
+		span.SetAttr(tracing.AttrListenerID, resp.ListenerID)
+		span.SetError(err)
 		return err
 	}
-	logAccept(logger, cfg.Target, listenerID)
+	logAccept(logger, cfg.Target, resp.ListenerID)
+	span.SetAttr(tracing.AttrListenerID, resp.ListenerID)
+	logCompression(logger, wire, resp)
 
-	stdio := &stdioConn{in: cfg.Stdin, out: cfg.Stdout}
-	result, bridgeErr := cfg.Metrics.TrackedBridge(ctx, ws, stdio, "sender", cfg.Target)
+	bctx := relay.WithBridgeLogger(ctx, logger)
+	opts := relay.BridgeOptions{BufferSize: cfg.BufferSize, IdleTimeout: cfg.IdleTimeout, RateLimit: cfg.RateLimit, PingInterval: cfg.DataPingInterval}
+	result, bridgeErr := cfg.Metrics.TrackedBridgeWithOptions(bctx, ws, stdio, "sender", cfg.Target, opts)
 	attrs := []any{
 		"target", cfg.Target,
 		"cause", result.EndCause,
@@ -83,5 +146,6 @@ func Connect(ctx context.Context, cfg ConnectConfig) error {
 		attrs = append(attrs, "close_code", code)
 	}
 	logger.Debug("bridge ended", attrs...)
+	traceBridge(span, result, bridgeErr)
 	return bridgeErr
 }
@@ -16,6 +16,7 @@ import (
 	"github.com/coder/websocket"
 	"github.com/philsphicas/aztunnel/internal/protocol"
 	"github.com/philsphicas/aztunnel/internal/relay"
+	"github.com/philsphicas/aztunnel/internal/sender/socks5"
 )
 
 func TestDialBudget_DefaultsWhenZeroOrNegative(t *testing.T) {
@@ -130,6 +131,80 @@ func TestForwardConnection_DialBudgetBoundsRetry(t *testing.T) {
 	}
 }
 
+// TestHandleSOCKS5_DialBudgetBoundsRetry is the socks5-proxy
+// counterpart of TestForwardConnection_DialBudgetBoundsRetry: a relay
+// that never accepts is retried until cfg.DialBudget (--dial-timeout)
+// runs out, then the client gets RepGeneralFailure.
+func TestHandleSOCKS5_DialBudgetBoundsRetry(t *testing.T) {
+	var attempts atomic.Int32
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		attempts.Add(1)
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	defer srv.Close()
+
+	u, err := url.Parse(srv.URL)
+	if err != nil {
+		t.Fatalf("url.Parse: %v", err)
+	}
+
+	local, peer := tcpPairForBudget(t)
+	defer local.Close()
+	defer peer.Close()
+
+	cfg := SOCKS5Config{
+		Endpoint:      u.Host,
+		EntityPath:    "test-hc",
+		TokenProvider: budgetTokenProvider{},
+		ClientOptions: relay.ClientOptions{
+			TLSConfig: srv.Client().Transport.(*http.Transport).TLSClientConfig,
+		},
+		Logger:     slog.New(slog.NewTextHandler(io.Discard, nil)),
+		DialBudget: 250 * time.Millisecond,
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	errCh := make(chan error, 1)
+	start := time.Now()
+	go func() { errCh <- handleSOCKS5(ctx, local, cfg) }()
+
+	_ = peer.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := peer.Write([]byte{0x05, 0x01, 0x00}); err != nil {
+		t.Fatalf("write greeting: %v", err)
+	}
+	auth := make([]byte, 2)
+	if _, err := io.ReadFull(peer, auth); err != nil {
+		t.Fatalf("read auth reply: %v", err)
+	}
+	if _, err := peer.Write([]byte{0x05, 0x01, 0x00, 0x01, 10, 0, 0, 5, 0, 22}); err != nil {
+		t.Fatalf("write request: %v", err)
+	}
+	reply := make([]byte, 10)
+	if _, err := io.ReadFull(peer, reply); err != nil {
+		t.Fatalf("read reply: %v", err)
+	}
+	if reply[1] != socks5.RepGeneralFailure {
+		t.Errorf("REP = %#x, want %#x", reply[1], socks5.RepGeneralFailure)
+	}
+
+	select {
+	case err := <-errCh:
+		if err == nil {
+			t.Fatal("handleSOCKS5 returned nil; want budget-bounded error")
+		}
+		if elapsed := time.Since(start); elapsed > 2*time.Second {
+			t.Fatalf("handleSOCKS5 returned after %v; budget=%v should have aborted much sooner", elapsed, cfg.DialBudget)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("handleSOCKS5 did not return within 3s; dial budget is not being honoured")
+	}
+	if attempts.Load() == 0 {
+		t.Error("relay was never dialed")
+	}
+}
+
 // TestForwardConnection_HappyPathSurvivesDialBudget guards against
 // the regression that sank PR #103: if the dial succeeds, the bridge
 // must continue to use the parent context, not a context that was
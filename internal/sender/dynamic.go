@@ -0,0 +1,74 @@
+package sender
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+
+	"github.com/philsphicas/aztunnel/internal/allowlist"
+)
+
+// maxDynamicTargetLine caps the target line read in dynamic connect
+// mode. A DNS name is at most 253 bytes, so anything longer than this
+// is not a host:port and is rejected rather than buffered.
+const maxDynamicTargetLine = 512
+
+// readDynamicTarget reads the first newline-terminated line from r and
+// returns it as a host:port target. A trailing "\r" is tolerated so
+// the line can come from a CRLF source.
+func readDynamicTarget(r *bufio.Reader) (string, error) {
+	line, err := r.ReadSlice('\n')
+	if errors.Is(err, bufio.ErrBufferFull) {
+		return "", fmt.Errorf("dynamic target line exceeds %d bytes", maxDynamicTargetLine)
+	}
+	if err != nil {
+		if errors.Is(err, io.EOF) {
+			return "", errors.New("stdin closed before a dynamic target line was read")
+		}
+		return "", fmt.Errorf("read dynamic target: %w", err)
+	}
+	target := string(bytes.TrimSuffix(bytes.TrimSuffix(line, []byte("\n")), []byte("\r")))
+	if err := validateTarget(target); err != nil {
+		return "", fmt.Errorf("dynamic target %q: %w", target, err)
+	}
+	return target, nil
+}
+
+// validateTarget checks that target is a host:port with a non-empty
+// host and a numeric port in 1-65535.
+func validateTarget(target string) error {
+	host, port, err := net.SplitHostPort(target)
+	if err != nil {
+		return err
+	}
+	if host == "" {
+		return errors.New("missing host")
+	}
+	n, err := strconv.Atoi(port)
+	if err != nil || n < 1 || n > 65535 {
+		return fmt.Errorf("invalid port %q", port)
+	}
+	return nil
+}
+
+// resolveDynamicTarget reads the target line from cfg.Stdin, checks it
+// against cfg.AllowList, and returns the target together with a stdin
+// that still yields every byte buffered past the line.
+func resolveDynamicTarget(cfg ConnectConfig) (string, io.ReadCloser, error) {
+	br := bufio.NewReaderSize(cfg.Stdin, maxDynamicTargetLine)
+	target, err := readDynamicTarget(br)
+	if err != nil {
+		return "", nil, err
+	}
+	if len(cfg.AllowList) > 0 && !allowlist.Allowed(target, cfg.AllowList) {
+		return "", nil, fmt.Errorf("dynamic target %s not allowed", target)
+	}
+	return target, struct {
+		io.Reader
+		io.Closer
+	}{br, cfg.Stdin}, nil
+}
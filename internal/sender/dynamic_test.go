@@ -0,0 +1,191 @@
+package sender
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/coder/websocket"
+	"github.com/philsphicas/aztunnel/internal/protocol"
+	"github.com/philsphicas/aztunnel/internal/relay"
+)
+
+func TestReadDynamicTarget(t *testing.T) {
+	tests := []struct {
+		name    string
+		in      string
+		want    string
+		wantErr string
+	}{
+		{name: "host port", in: "db.internal:5432\nrest", want: "db.internal:5432"},
+		{name: "crlf", in: "10.0.0.5:22\r\n", want: "10.0.0.5:22"},
+		{name: "ipv6", in: "[::1]:8080\n", want: "[::1]:8080"},
+		{name: "no newline", in: "db.internal:5432", wantErr: "stdin closed"},
+		{name: "missing port", in: "db.internal\n", wantErr: "missing port"},
+		{name: "empty host", in: ":22\n", wantErr: "missing host"},
+		{name: "port zero", in: "db:0\n", wantErr: "invalid port"},
+		{name: "port range", in: "db:70000\n", wantErr: "invalid port"},
+		{name: "named port", in: "db:ssh\n", wantErr: "invalid port"},
+		{name: "too long", in: strings.Repeat("a", maxDynamicTargetLine) + ":22\n", wantErr: "exceeds"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := readDynamicTarget(bufio.NewReaderSize(strings.NewReader(tt.in), maxDynamicTargetLine))
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("readDynamicTarget(%q) error = %v, want containing %q", tt.in, err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("readDynamicTarget(%q): %v", tt.in, err)
+			}
+			if got != tt.want {
+				t.Errorf("readDynamicTarget(%q) = %q, want %q", tt.in, got, tt.want)
+			}
+		})
+	}
+}
+
+type bufferWriteCloser struct{ bytes.Buffer }
+
+func (*bufferWriteCloser) Close() error { return nil }
+
+// TestConnect_DynamicTarget feeds a target line followed by payload
+// through stdin and checks that the envelope names the line's target
+// and that the payload after the line reaches the tunnel intact.
+func TestConnect_DynamicTarget(t *testing.T) {
+	const payload = "hello after the target line"
+
+	gotTarget := make(chan string, 1)
+	gotData := make(chan string, 1)
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ws, err := websocket.Accept(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer ws.CloseNow()
+		_, env, err := ws.Read(r.Context())
+		if err != nil {
+			return
+		}
+		var ce protocol.ConnectEnvelope
+		if err := json.Unmarshal(env, &ce); err != nil {
+			t.Errorf("server: unmarshal envelope: %v", err)
+			return
+		}
+		gotTarget <- ce.Target
+		resp, _ := json.Marshal(protocol.ConnectResponse{Version: protocol.CurrentVersion, OK: true})
+		if err := ws.Write(r.Context(), websocket.MessageText, resp); err != nil {
+			return
+		}
+		var data []byte
+		for {
+			_, msg, err := ws.Read(r.Context())
+			if err != nil {
+				break
+			}
+			data = append(data, msg...)
+		}
+		gotData <- string(data)
+	}))
+	defer srv.Close()
+
+	u, err := url.Parse(srv.URL)
+	if err != nil {
+		t.Fatalf("url.Parse: %v", err)
+	}
+
+	cfg := ConnectConfig{
+		Endpoint:      u.Host,
+		EntityPath:    "test-hc",
+		TokenProvider: budgetTokenProvider{},
+		ClientOptions: relay.ClientOptions{
+			TLSConfig: srv.Client().Transport.(*http.Transport).TLSClientConfig,
+		},
+		Stdin:     io.NopCloser(strings.NewReader("db.internal:5432\n" + payload)),
+		Stdout:    &bufferWriteCloser{},
+		Logger:    slog.New(slog.NewTextHandler(io.Discard, nil)),
+		Dynamic:   true,
+		AllowList: []string{"db.internal:5432"},
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := Connect(ctx, cfg); err != nil {
+		t.Fatalf("Connect: %v", err)
+	}
+
+	select {
+	case target := <-gotTarget:
+		if target != "db.internal:5432" {
+			t.Errorf("envelope target = %q, want %q", target, "db.internal:5432")
+		}
+	case <-ctx.Done():
+		t.Fatal("server never received an envelope")
+	}
+	select {
+	case data := <-gotData:
+		if data != payload {
+			t.Errorf("tunnel data = %q, want %q", data, payload)
+		}
+	case <-ctx.Done():
+		t.Fatal("server never finished reading tunnel data")
+	}
+}
+
+// TestConnect_DynamicTargetRejected checks that an invalid or
+// disallowed target line fails before any relay dial is attempted.
+func TestConnect_DynamicTargetRejected(t *testing.T) {
+	var dials atomic.Int32
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		dials.Add(1)
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	defer srv.Close()
+
+	u, err := url.Parse(srv.URL)
+	if err != nil {
+		t.Fatalf("url.Parse: %v", err)
+	}
+
+	for _, tt := range []struct {
+		name, line, wantErr string
+	}{
+		{name: "invalid", line: "not-a-target\n", wantErr: "missing port"},
+		{name: "not allowed", line: "10.1.2.3:22\n", wantErr: "not allowed"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := ConnectConfig{
+				Endpoint:      u.Host,
+				EntityPath:    "test-hc",
+				TokenProvider: budgetTokenProvider{},
+				ClientOptions: relay.ClientOptions{
+					TLSConfig: srv.Client().Transport.(*http.Transport).TLSClientConfig,
+				},
+				Stdin:     io.NopCloser(strings.NewReader(tt.line)),
+				Stdout:    &bufferWriteCloser{},
+				Logger:    slog.New(slog.NewTextHandler(io.Discard, nil)),
+				Dynamic:   true,
+				AllowList: []string{"10.0.0.0/24:*"},
+			}
+			err := Connect(context.Background(), cfg)
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("Connect error = %v, want containing %q", err, tt.wantErr)
+			}
+		})
+	}
+	if n := dials.Load(); n != 0 {
+		t.Errorf("relay dialed %d times, want 0", n)
+	}
+}
@@ -0,0 +1,43 @@
+package sender
+
+import (
+	"errors"
+	"time"
+
+	"github.com/philsphicas/aztunnel/internal/metrics"
+)
+
+// defaultEnvelopeTimeout bounds how long the sender spends writing the
+// envelope and waiting for the listener's ConnectResponse. Without it a
+// rendezvous the relay paired but the listener never answers (a hung
+// or wedged listener, or a half-open relay path) keeps its WebSocket
+// and goroutines until the local client gives up or the process exits.
+//
+// The listener only answers after dialing the target, bounded by its
+// --connect-timeout (30s by default), so this is set comfortably above
+// that: a slow target dial is reported by the listener as dial_timeout
+// rather than being cut off here as an abandoned rendezvous.
+const defaultEnvelopeTimeout = 45 * time.Second
+
+// envelopeTimeout returns d unchanged, or defaultEnvelopeTimeout when
+// d is zero or negative (see dialBudget).
+func envelopeTimeout(d time.Duration) time.Duration {
+	if d <= 0 {
+		return defaultEnvelopeTimeout
+	}
+	return d
+}
+
+// errAbandonedRendezvous is wrapped by sendEnvelope when the listener
+// does not answer the envelope within the envelope timeout. The
+// rendezvous WebSocket is closed before the error is returned.
+var errAbandonedRendezvous = errors.New("abandoned rendezvous: no listener response")
+
+// envelopeReason maps a sendEnvelope error to its connection error
+// metric reason.
+func envelopeReason(err error) string {
+	if errors.Is(err, errAbandonedRendezvous) {
+		return metrics.ReasonAbandonedRendezvous
+	}
+	return metrics.ReasonEnvelopeError
+}
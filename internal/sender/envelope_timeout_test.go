@@ -0,0 +1,161 @@
+package sender
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/coder/websocket"
+	"github.com/philsphicas/aztunnel/internal/metrics"
+	"github.com/philsphicas/aztunnel/internal/relay"
+)
+
+func TestEnvelopeTimeout_DefaultsWhenZeroOrNegative(t *testing.T) {
+	if got := envelopeTimeout(0); got != defaultEnvelopeTimeout {
+		t.Errorf("envelopeTimeout(0) = %v, want %v", got, defaultEnvelopeTimeout)
+	}
+	if got := envelopeTimeout(-time.Second); got != defaultEnvelopeTimeout {
+		t.Errorf("envelopeTimeout(-1s) = %v, want %v", got, defaultEnvelopeTimeout)
+	}
+	if got := envelopeTimeout(5 * time.Second); got != 5*time.Second {
+		t.Errorf("envelopeTimeout(5s) = %v, want 5s", got)
+	}
+}
+
+// TestForwardConnection_AbandonedRendezvous models a relay that pairs
+// the rendezvous but whose listener never answers the envelope. The
+// sender must give up after EnvelopeTimeout, close the WebSocket, and
+// count the connection as abandoned_rendezvous.
+func TestForwardConnection_AbandonedRendezvous(t *testing.T) {
+	closed := make(chan struct{})
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ws, err := websocket.Accept(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer ws.CloseNow()
+		if _, _, err := ws.Read(r.Context()); err != nil {
+			return
+		}
+		// Never respond; the next read fails once the sender closes.
+		_, _, _ = ws.Read(r.Context())
+		close(closed)
+	}))
+	defer srv.Close()
+
+	u, err := url.Parse(srv.URL)
+	if err != nil {
+		t.Fatalf("url.Parse: %v", err)
+	}
+
+	local, peer := tcpPairForBudget(t)
+	defer local.Close()
+	defer peer.Close()
+
+	m := metrics.New()
+	cfg := PortForwardConfig{
+		Endpoint:      u.Host,
+		EntityPath:    "test-hc",
+		TokenProvider: budgetTokenProvider{},
+		ClientOptions: relay.ClientOptions{
+			TLSConfig: srv.Client().Transport.(*http.Transport).TLSClientConfig,
+		},
+		Target:          "example.internal:443",
+		Logger:          slog.New(slog.NewTextHandler(io.Discard, nil)),
+		Metrics:         m,
+		EnvelopeTimeout: 200 * time.Millisecond,
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	errCh := make(chan error, 1)
+	start := time.Now()
+	go func() {
+		errCh <- forwardConnection(ctx, local, cfg.Target, cfg)
+	}()
+
+	select {
+	case err := <-errCh:
+		if !errors.Is(err, errAbandonedRendezvous) {
+			t.Fatalf("forwardConnection err = %v, want errAbandonedRendezvous", err)
+		}
+		if elapsed := time.Since(start); elapsed > 2*time.Second {
+			t.Errorf("forwardConnection returned after %v; envelope timeout is %v", elapsed, cfg.EnvelopeTimeout)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("forwardConnection did not return; envelope timeout is not being honoured")
+	}
+
+	select {
+	case <-closed:
+	case <-time.After(3 * time.Second):
+		t.Error("abandoned rendezvous WebSocket was not closed")
+	}
+
+	fams, err := m.Registry.Gather()
+	if err != nil {
+		t.Fatalf("gather: %v", err)
+	}
+	var got float64
+	for _, f := range fams {
+		if f.GetName() != "aztunnel_connection_errors_total" {
+			continue
+		}
+		for _, mt := range f.GetMetric() {
+			for _, l := range mt.GetLabel() {
+				if l.GetName() == "reason" && l.GetValue() == metrics.ReasonAbandonedRendezvous {
+					got = mt.GetCounter().GetValue()
+				}
+			}
+		}
+	}
+	if got != 1 {
+		t.Errorf("connection_errors_total{reason=abandoned_rendezvous} = %v, want 1", got)
+	}
+}
+
+// TestSendEnvelope_StalledWrite holds the WebSocket's writer so the
+// envelope write cannot start, standing in for a peer that stopped
+// reading: the timeout must cover the write as well as the read.
+func TestSendEnvelope_StalledWrite(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ws, err := websocket.Accept(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer ws.CloseNow()
+		_, _, _ = ws.Read(r.Context())
+	}))
+	defer srv.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	ws, _, err := websocket.Dial(ctx, "ws"+strings.TrimPrefix(srv.URL, "http"), nil)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer ws.CloseNow()
+	if _, err := ws.Writer(ctx, websocket.MessageBinary); err != nil {
+		t.Fatalf("Writer: %v", err)
+	}
+
+	start := time.Now()
+	_, err = sendEnvelopeAndCheck(ctx, ws, "example.internal:443", "", nil, 100*time.Millisecond)
+	if !errors.Is(err, errAbandonedRendezvous) {
+		t.Fatalf("sendEnvelopeAndCheck err = %v, want errAbandonedRendezvous", err)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("sendEnvelopeAndCheck returned after %v; envelope timeout is 100ms", elapsed)
+	}
+	if envelopeReason(err) != metrics.ReasonAbandonedRendezvous {
+		t.Errorf("envelopeReason = %q, want %q", envelopeReason(err), metrics.ReasonAbandonedRendezvous)
+	}
+}
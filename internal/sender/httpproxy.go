@@ -0,0 +1,295 @@
+package sender
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/philsphicas/aztunnel/internal/allowlist"
+	"github.com/philsphicas/aztunnel/internal/idgen"
+	"github.com/philsphicas/aztunnel/internal/metrics"
+	"github.com/philsphicas/aztunnel/internal/protocol"
+	"github.com/philsphicas/aztunnel/internal/relay"
+	"github.com/philsphicas/aztunnel/internal/tracing"
+)
+
+// HTTPProxyConfig holds configuration for http-proxy mode.
+type HTTPProxyConfig struct {
+	Endpoint      string
+	EntityPath    string
+	TokenProvider relay.TokenProvider
+	ClientOptions relay.ClientOptions
+	BindAddress   string // local address:port to listen on
+	Network       string // local listener network: tcp (default), tcp4, or tcp6
+	TCPKeepAlive  time.Duration
+	Logger        *slog.Logger
+	Metrics       *metrics.Metrics // optional; nil disables metrics
+	Tracer        *tracing.Tracer  // optional; nil disables tracing
+	// DialBudget bounds the per-connection relay dial + retry
+	// duration. Zero uses defaultDialBudget.
+	DialBudget time.Duration
+	// EnvelopeTimeout bounds the wait for the listener's response to
+	// the connect envelope. Zero uses defaultEnvelopeTimeout.
+	EnvelopeTimeout time.Duration
+	// Ready, if non-nil, is invoked once after the local bind succeeds
+	// and before the accept loop starts.
+	Ready func(net.Addr)
+	// AllowList optionally restricts the targets clients may CONNECT
+	// to, using the listener's --allow syntax. A refused target gets
+	// 403 Forbidden without a relay dial. Empty allows everything.
+	AllowList []string
+	// BufferSize is the bridge copy buffer size; see
+	// relay.BridgeOptions.BufferSize. Zero uses the default.
+	BufferSize int
+
+	// IdleTimeout closes a bridged connection that has moved no data
+	// for this long; see relay.BridgeOptions.IdleTimeout. Zero
+	// disables it.
+	IdleTimeout time.Duration
+
+	// RateLimit caps each direction of a bridged connection in
+	// bytes/sec; see relay.BridgeOptions.RateLimit. Zero is unlimited.
+	RateLimit int64
+
+	// DataPingInterval is how long a bridged connection's WebSocket
+	// may go without sending before it is pinged; see
+	// relay.BridgeOptions.PingInterval. Zero selects the relay package
+	// default (30s); a negative value disables pings.
+	DataPingInterval time.Duration
+}
+
+// HTTPProxy starts a local HTTP CONNECT proxy and forwards each
+// tunnel through the relay. The target is the CONNECT request's
+// authority. It blocks until ctx is cancelled.
+func HTTPProxy(ctx context.Context, cfg HTTPProxyConfig) error {
+	if cfg.Logger == nil {
+		cfg.Logger = slog.Default()
+	}
+	if cfg.TCPKeepAlive == 0 {
+		cfg.TCPKeepAlive = 30 * time.Second
+	}
+
+	ln, err := listen(cfg.Network, cfg.BindAddress, cfg.Logger)
+	if err != nil {
+		return err
+	}
+	defer ln.Close() //nolint:errcheck // best-effort cleanup
+	cfg.Logger.Info("http-proxy listening", "bind", ln.Addr())
+	if cfg.Ready != nil {
+		cfg.Ready(ln.Addr())
+	}
+
+	go func() {
+		<-ctx.Done()
+		ln.Close() //nolint:errcheck // best-effort cleanup
+	}()
+
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			cfg.Logger.Warn("accept failed", "error", err)
+			continue
+		}
+
+		go func() {
+			defer conn.Close() //nolint:errcheck // best-effort cleanup
+			// As with handleSOCKS5, the error is logged inside and
+			// returned for tests.
+			_ = handleHTTPConnect(ctx, conn, cfg)
+		}()
+	}
+}
+
+func handleHTTPConnect(ctx context.Context, conn net.Conn, cfg HTTPProxyConfig) (err error) {
+	relay.SetTCPKeepAlive(conn, cfg.TCPKeepAlive)
+
+	// Read the CONNECT request under the same deadline the SOCKS5
+	// handshake gets. A client may send its first bytes (a TLS
+	// ClientHello, say) right behind the request, so whatever br has
+	// buffered past the headers is replayed into the bridge. The
+	// request is capped at http.DefaultMaxHeaderBytes, as http.Server
+	// caps it, so a client cannot grow it without bound.
+	_ = conn.SetReadDeadline(time.Now().Add(30 * time.Second))
+	head := &io.LimitedReader{R: conn, N: http.DefaultMaxHeaderBytes}
+	br := bufio.NewReader(head)
+	req, err := http.ReadRequest(br)
+	if err != nil {
+		status := http.StatusBadRequest
+		if head.N == 0 {
+			status = http.StatusRequestHeaderFieldsTooLarge
+		}
+		writeHTTPStatus(conn, status)
+		err = fmt.Errorf("http-proxy request: %w", err)
+		cfg.Logger.Warn("http-proxy failed", "error", err)
+		return err
+	}
+	_ = conn.SetReadDeadline(time.Time{}) // clear deadline
+
+	if req.Method != http.MethodConnect {
+		writeHTTPStatus(conn, http.StatusMethodNotAllowed, "Allow: CONNECT")
+		cfg.Logger.Warn("http-proxy method not allowed", "method", req.Method)
+		return fmt.Errorf("http-proxy method %s not allowed", req.Method)
+	}
+	target := req.Host
+	if err := validateTarget(target); err != nil {
+		writeHTTPStatus(conn, http.StatusBadRequest)
+		err = fmt.Errorf("http-proxy target %q: %w", target, err)
+		cfg.Logger.Warn("http-proxy failed", "error", err)
+		return err
+	}
+	if len(cfg.AllowList) > 0 && !allowlist.Allowed(target, cfg.AllowList) {
+		writeHTTPStatus(conn, http.StatusForbidden)
+		cfg.Logger.Warn("http-proxy target not allowed", "target", target, "reason", metrics.SenderRejectNotAllowed, "allow", cfg.AllowList)
+		cfg.Metrics.SenderRejection(metrics.ProxyHTTP, metrics.SenderRejectNotAllowed)
+		return fmt.Errorf("http-proxy target %s not allowed", target)
+	}
+
+	bridgeID := idgen.NewBridgeID()
+	logger := cfg.Logger.With("bridge_id", bridgeID)
+	logger.Info("connection requested", "target", target)
+
+	span := cfg.Tracer.Start("aztunnel.sender.http_connect", tracing.KindClient, "")
+	defer span.End()
+	span.SetAttr(tracing.AttrTarget, target)
+	span.SetAttr(tracing.AttrBridgeID, bridgeID)
+
+	// Track the connection from here so one that fails before its
+	// bridge still counts.
+	ctx = metrics.WithConnID(ctx, bridgeID)
+	ctx = metrics.WithConnLabels(ctx, connLabels(conn, cfg.Endpoint))
+	ctx = metrics.WithClientAddr(ctx, clientAddr(conn))
+	ctx, tracker := cfg.Metrics.TrackConnection(ctx, "sender", target)
+	defer func() { tracker.Finish(err) }()
+
+	// The bridge uses ctx, not dialCtx; see handleSOCKS5.
+	ctx, wire := withWireCounter(ctx, cfg.ClientOptions)
+	dialCtx, cancelDial := context.WithTimeout(ctx, dialBudget(cfg.DialBudget))
+	dialStart := time.Now()
+	ws, err := cfg.Metrics.InstrumentedDial(dialCtx, cfg.Endpoint, cfg.EntityPath, cfg.TokenProvider, cfg.ClientOptions, "sender", logger)
+	cancelDial()
+	span.SetAttr(tracing.AttrDialDuration, time.Since(dialStart))
+	if err != nil {
+		writeHTTPStatus(conn, http.StatusBadGateway)
+		logger.Warn("http-proxy failed", "error", err)
+		span.SetError(err)
+		return err
+	}
+	defer func() { _ = ws.CloseNow() }()
+
+	resp, err := sendEnvelopeAndCheck(ctx, ws, target, bridgeID, envelopeMetadata(cfg.ClientOptions, span, conn.RemoteAddr()), cfg.EnvelopeTimeout)
+	if err != nil {
+		logRejection(logger, target, resp.ListenerID, err)
+		writeHTTPStatus(conn, httpStatusForError(err))
+		cfg.Metrics.ConnectionError("sender", envelopeReason(err))
+		span.SetAttr(tracing.AttrListenerID, resp.ListenerID)
+		span.SetError(err)
+		return err
+	}
+	logAccept(logger, target, resp.ListenerID)
+	span.SetAttr(tracing.AttrListenerID, resp.ListenerID)
+	logCompression(logger, wire, resp)
+
+	if _, err := conn.Write([]byte("HTTP/1.1 200 Connection Established\r\n\r\n")); err != nil {
+		err = fmt.Errorf("http-proxy reply: %w", err)
+		logger.Warn("http-proxy failed", "error", err)
+		span.SetError(err)
+		return err
+	}
+
+	var local net.Conn = conn
+	if n := br.Buffered(); n > 0 {
+		// br reads through the header cap, so only its buffered bytes
+		// are replayed; the rest of the stream comes from conn.
+		ahead, _ := br.Peek(n)
+		local = &bufferedConn{Conn: conn, r: io.MultiReader(bytes.NewReader(ahead), conn)}
+	}
+	bctx := relay.WithBridgeLogger(ctx, logger)
+	opts := relay.BridgeOptions{BufferSize: cfg.BufferSize, IdleTimeout: cfg.IdleTimeout, RateLimit: cfg.RateLimit, PingInterval: cfg.DataPingInterval}
+	result, bridgeErr := cfg.Metrics.TrackedBridgeWithOptions(bctx, ws, local, "sender", target, opts)
+	attrs := []any{
+		"cause", result.EndCause,
+		"tcp_to_ws", result.Stats.TCPToWS,
+		"ws_to_tcp", result.Stats.WSToTCP,
+	}
+	if result.TCPToWS != nil {
+		attrs = append(attrs, "tcp_to_ws_err", result.TCPToWS)
+	}
+	if result.WSToTCP != nil {
+		attrs = append(attrs, "ws_to_tcp_err", result.WSToTCP)
+	}
+	if code, ok := relay.WSCloseCode(bridgeErr); ok {
+		attrs = append(attrs, "close_code", code)
+	}
+	traceBridge(span, result, bridgeErr)
+	if bridgeErr != nil {
+		errAttrs := append([]any{"error", bridgeErr}, attrs...)
+		logger.Warn("http-proxy failed", errAttrs...)
+	} else {
+		logger.Debug("bridge ended", attrs...)
+	}
+	return bridgeErr
+}
+
+// writeHTTPStatus writes a body-less response with status code and
+// any extra header lines. The proxy closes the connection after every
+// non-200 reply, so it says so.
+func writeHTTPStatus(conn net.Conn, code int, headers ...string) {
+	msg := fmt.Sprintf("HTTP/1.1 %d %s\r\n", code, http.StatusText(code))
+	for _, h := range headers {
+		msg += h + "\r\n"
+	}
+	msg += "Content-Length: 0\r\nConnection: close\r\n\r\n"
+	_, _ = conn.Write([]byte(msg))
+}
+
+// httpStatusForError maps a failed envelope exchange to the status
+// the CONNECT client sees, the HTTP counterpart of socks5RepForError:
+// timeouts are 504, policy refusals 403, a malformed target 400, and
+// a quiesced listener 503. Anything else, including no listener
+// answer at all, is 502.
+func httpStatusForError(err error) int {
+	var ce *connectRejected
+	if !errors.As(err, &ce) {
+		return http.StatusBadGateway
+	}
+	switch ce.Code {
+	case protocol.CodeTimeout, protocol.CodeDNSTimeout:
+		return http.StatusGatewayTimeout
+	case protocol.CodeNotAllowed:
+		return http.StatusForbidden
+	case protocol.CodeInvalidTarget:
+		return http.StatusBadRequest
+	case protocol.CodeQuiescing:
+		return http.StatusServiceUnavailable
+	}
+	return http.StatusBadGateway
+}
+
+// bufferedConn is a net.Conn whose reads drain r, which replays the
+// bytes read ahead while parsing the CONNECT request and then reads
+// Conn, so those bytes are not lost.
+type bufferedConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (c *bufferedConn) Read(p []byte) (int, error) { return c.r.Read(p) }
+
+// CloseWrite half-closes the underlying connection when it supports
+// it, so the bridge's half-close handling still reaches the client.
+func (c *bufferedConn) CloseWrite() error {
+	if cw, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return nil
+}
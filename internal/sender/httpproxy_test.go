@@ -0,0 +1,223 @@
+package sender
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/coder/websocket"
+	"github.com/philsphicas/aztunnel/internal/metrics"
+	"github.com/philsphicas/aztunnel/internal/protocol"
+	"github.com/philsphicas/aztunnel/internal/relay"
+)
+
+// driveHTTPConnect runs handleHTTPConnect on one end of a TCP pair,
+// writes request on the other, and returns the parsed response, the
+// reader positioned after it, and handleHTTPConnect's error channel.
+func driveHTTPConnect(t *testing.T, cfg HTTPProxyConfig, request string) (*http.Response, *bufio.Reader, <-chan error) {
+	t.Helper()
+	local, peer := tcpPairForBudget(t)
+	t.Cleanup(func() { _ = local.Close(); _ = peer.Close() })
+
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- handleHTTPConnect(context.Background(), local, cfg)
+		_ = local.Close()
+	}()
+
+	_ = peer.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.WriteString(peer, request); err != nil {
+		t.Fatalf("write request: %v", err)
+	}
+	br := bufio.NewReader(peer)
+	resp, err := http.ReadResponse(br, nil)
+	if err != nil {
+		t.Fatalf("read response: %v", err)
+	}
+	return resp, br, errCh
+}
+
+// oversizedConnect is a CONNECT request whose headers fill exactly
+// http.DefaultMaxHeaderBytes without ending, so the proxy reads all of
+// it and leaves nothing unread to reset the connection.
+func oversizedConnect() string {
+	head := "CONNECT 10.0.0.5:22 HTTP/1.1\r\nHost: 10.0.0.5:22\r\nX-Pad: "
+	return head + strings.Repeat("a", http.DefaultMaxHeaderBytes-len(head))
+}
+
+func TestHandleHTTPConnect_Rejects(t *testing.T) {
+	for _, tc := range []struct {
+		name      string
+		allow     []string
+		request   string
+		want      int
+		wantAllow string
+	}{
+		{"GET", nil, "GET http://10.0.0.5/ HTTP/1.1\r\nHost: 10.0.0.5\r\n\r\n", http.StatusMethodNotAllowed, "CONNECT"},
+		{"missing port", nil, "CONNECT 10.0.0.5 HTTP/1.1\r\nHost: 10.0.0.5\r\n\r\n", http.StatusBadRequest, ""},
+		{"not allowed", []string{"192.168.0.0/16:*"}, "CONNECT 10.0.0.5:22 HTTP/1.1\r\nHost: 10.0.0.5:22\r\n\r\n", http.StatusForbidden, ""},
+		{"malformed", nil, "NOT HTTP\r\n\r\n", http.StatusBadRequest, ""},
+		{"headers too large", nil, oversizedConnect(), http.StatusRequestHeaderFieldsTooLarge, ""},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			m := metrics.New()
+			cfg := HTTPProxyConfig{
+				// No relay endpoint: a rejected request must never dial.
+				Logger:    slog.New(slog.NewTextHandler(io.Discard, nil)),
+				Metrics:   m,
+				AllowList: tc.allow,
+			}
+			resp, _, errCh := driveHTTPConnect(t, cfg, tc.request)
+			if resp.StatusCode != tc.want {
+				t.Errorf("status = %d, want %d", resp.StatusCode, tc.want)
+			}
+			if got := resp.Header.Get("Allow"); got != tc.wantAllow {
+				t.Errorf("Allow = %q, want %q", got, tc.wantAllow)
+			}
+			select {
+			case err := <-errCh:
+				if err == nil {
+					t.Error("handleHTTPConnect err = nil, want a rejection")
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("handleHTTPConnect did not return")
+			}
+			// Only the policy refusal counts; malformed requests are
+			// client errors, not rejections.
+			want := 0.0
+			if tc.want == http.StatusForbidden {
+				want = 1
+			}
+			if got := senderRejections(t, m, metrics.ProxyHTTP, metrics.SenderRejectNotAllowed); got != want {
+				t.Errorf("sender_rejections_total{proxy=http,reason=not_allowed} = %v, want %v", got, want)
+			}
+		})
+	}
+}
+
+func TestHandleHTTPConnect_Bridges(t *testing.T) {
+	gotTarget := make(chan string, 1)
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ws, err := websocket.Accept(w, r, nil)
+		if err != nil {
+			t.Errorf("server: websocket.Accept: %v", err)
+			return
+		}
+		defer ws.CloseNow()
+		_, data, err := ws.Read(r.Context())
+		if err != nil {
+			t.Errorf("server: read envelope: %v", err)
+			return
+		}
+		var env protocol.ConnectEnvelope
+		if err := json.Unmarshal(data, &env); err != nil {
+			t.Errorf("server: unmarshal envelope: %v", err)
+			return
+		}
+		gotTarget <- env.Target
+		resp, _ := json.Marshal(protocol.ConnectResponse{Version: protocol.CurrentVersion, OK: true})
+		if err := ws.Write(r.Context(), websocket.MessageText, resp); err != nil {
+			t.Errorf("server: write response: %v", err)
+			return
+		}
+		// Echo one payload frame, then wait for the client to close.
+		_, msg, err := ws.Read(r.Context())
+		if err != nil {
+			t.Errorf("server: read payload: %v", err)
+			return
+		}
+		_ = ws.Write(r.Context(), websocket.MessageBinary, msg)
+		_, _, _ = ws.Read(r.Context())
+	}))
+	defer srv.Close()
+	u, _ := url.Parse(srv.URL)
+
+	cfg := HTTPProxyConfig{
+		Endpoint:      u.Host,
+		EntityPath:    "http-proxy",
+		TokenProvider: budgetTokenProvider{},
+		ClientOptions: relay.ClientOptions{TLSConfig: srv.Client().Transport.(*http.Transport).TLSClientConfig},
+		Logger:        slog.New(slog.NewTextHandler(io.Discard, nil)),
+		DialBudget:    5 * time.Second,
+	}
+	// The payload rides in the same write as the request, the way an
+	// eager TLS client sends its ClientHello, and must still reach the
+	// relay.
+	const payload = "early bytes"
+	resp, br, _ := driveHTTPConnect(t, cfg, "CONNECT db.internal:5432 HTTP/1.1\r\nHost: db.internal:5432\r\n\r\n"+payload)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status = %d, want 200", resp.StatusCode)
+	}
+	if got := <-gotTarget; got != "db.internal:5432" {
+		t.Errorf("envelope target = %q, want db.internal:5432", got)
+	}
+	echo := make([]byte, len(payload))
+	if _, err := io.ReadFull(br, echo); err != nil {
+		t.Fatalf("read echo: %v", err)
+	}
+	if string(echo) != payload {
+		t.Errorf("echo = %q, want %q", echo, payload)
+	}
+}
+
+func TestHTTPStatusForError(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		err  error
+		want int
+	}{
+		{"refused", &connectRejected{Code: protocol.CodeConnectionRefused}, http.StatusBadGateway},
+		{"timeout", &connectRejected{Code: protocol.CodeTimeout}, http.StatusGatewayTimeout},
+		{"dns timeout", &connectRejected{Code: protocol.CodeDNSTimeout}, http.StatusGatewayTimeout},
+		{"not allowed", &connectRejected{Code: protocol.CodeNotAllowed}, http.StatusForbidden},
+		{"invalid target", &connectRejected{Code: protocol.CodeInvalidTarget}, http.StatusBadRequest},
+		{"quiescing", &connectRejected{Code: protocol.CodeQuiescing}, http.StatusServiceUnavailable},
+		{"no code", &connectRejected{Message: "connection failed"}, http.StatusBadGateway},
+		{"wrapped", fmt.Errorf("envelope: %w", &connectRejected{Code: protocol.CodeNotAllowed}), http.StatusForbidden},
+		{"no listener answer", errors.New("read response: EOF"), http.StatusBadGateway},
+	} {
+		if got := httpStatusForError(tc.err); got != tc.want {
+			t.Errorf("%s: httpStatusForError = %d, want %d", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestHTTPProxy_ServesConnect(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	ready := make(chan string, 1)
+	done := make(chan error, 1)
+	go func() {
+		done <- HTTPProxy(ctx, HTTPProxyConfig{
+			BindAddress: "127.0.0.1:0",
+			AllowList:   []string{"10.0.0.1:1"},
+			Logger:      slog.New(slog.NewTextHandler(io.Discard, nil)),
+			Ready:       func(a net.Addr) { ready <- a.String() },
+		})
+	}()
+	addr := <-ready
+
+	// Go's own client speaks CONNECT to an https:// URL through an
+	// http:// proxy; the allowlist refusal comes back as its error.
+	proxyURL, _ := url.Parse("http://" + addr)
+	client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)}, Timeout: 5 * time.Second}
+	_, err := client.Get("https://db.internal:5432/")
+	if err == nil || !strings.Contains(err.Error(), "Forbidden") {
+		t.Errorf("Get err = %v, want the proxy's 403", err)
+	}
+
+	cancel()
+	if err := <-done; !errors.Is(err, context.Canceled) {
+		t.Errorf("HTTPProxy = %v, want context.Canceled", err)
+	}
+}
@@ -0,0 +1,76 @@
+//go:build unix
+
+package sender
+
+import (
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// shortSocketDir returns a directory whose paths fit in sun_path,
+// which t.TempDir's long names can overflow.
+func shortSocketDir(t *testing.T) string {
+	t.Helper()
+	dir, err := os.MkdirTemp("", "azt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = os.RemoveAll(dir) })
+	return dir
+}
+
+func TestListen_UnixSocket(t *testing.T) {
+	t.Setenv("AZTUNNEL_SYSTEMD_SOCKET", "")
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	path := filepath.Join(shortSocketDir(t), "pf.sock")
+
+	// A socket file nobody listens on any more is stale and replaced.
+	stale, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatalf("listen stale: %v", err)
+	}
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	_ = stale.Close()
+
+	ln, err := listen("tcp", "unix:"+path, logger)
+	if err != nil {
+		t.Fatalf("listen over stale socket: %v", err)
+	}
+	c, err := net.DialTimeout("unix", path, time.Second)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	_ = c.Close()
+
+	// A live socket is never taken over.
+	if _, err := listen("tcp", "unix:"+path, logger); err == nil || !strings.Contains(err.Error(), "in use") {
+		t.Errorf("second listen err = %v, want in use", err)
+	}
+
+	// Closing the listener removes the socket file.
+	_ = ln.Close()
+	if _, err := os.Lstat(path); !os.IsNotExist(err) {
+		t.Errorf("socket file after Close: %v, want it removed", err)
+	}
+}
+
+func TestListen_UnixSocketRefusesRegularFile(t *testing.T) {
+	t.Setenv("AZTUNNEL_SYSTEMD_SOCKET", "")
+	path := filepath.Join(shortSocketDir(t), "not-a-socket")
+	if err := os.WriteFile(path, []byte("keep me"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	_, err := listen("tcp", "unix:"+path, slog.New(slog.NewTextHandler(io.Discard, nil)))
+	if err == nil || !strings.Contains(err.Error(), "not a socket") {
+		t.Fatalf("listen err = %v, want not a socket", err)
+	}
+	if data, _ := os.ReadFile(path); string(data) != "keep me" {
+		t.Errorf("regular file was modified: %q", data)
+	}
+}
@@ -0,0 +1,174 @@
+package sender
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"sync"
+
+	"github.com/philsphicas/aztunnel/internal/idgen"
+	"github.com/philsphicas/aztunnel/internal/protocol"
+	"github.com/philsphicas/aztunnel/internal/relay"
+	"github.com/philsphicas/aztunnel/internal/tracing"
+)
+
+// muxSession holds port-forward's shared protocol.ModeMux rendezvous.
+// The first connection dials it and later ones open streams on it; a
+// connection arriving after it failed dials a new one. A listener that
+// refuses the mode is remembered, and every later connection dials a
+// rendezvous of its own as if Mux were off. All methods are safe on a
+// nil session, which never has a mux.
+type muxSession struct {
+	mu          sync.Mutex
+	mux         *relay.Mux
+	unsupported bool
+	closed      bool
+}
+
+// get returns the live mux, dialing one when there is none, or nil
+// when this connection should dial its own rendezvous instead.
+// Concurrent callers wait for a single dial.
+func (p *muxSession) get(ctx context.Context, cfg PortForwardConfig, logger *slog.Logger) *relay.Mux {
+	if p == nil {
+		return nil
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.unsupported || p.closed {
+		return nil
+	}
+	if p.mux != nil {
+		select {
+		case <-p.mux.Done():
+			p.mux = nil
+		default:
+			return p.mux
+		}
+	}
+	mux, err := dialMux(ctx, cfg)
+	if err != nil {
+		var rejected *connectRejected
+		if errors.As(err, &rejected) && muxRefused(rejected.Code) {
+			logger.Info("listener does not support mux, using a rendezvous per connection", "listener_id", rejected.ListenerID)
+			p.unsupported = true
+		} else {
+			logger.Warn("mux session failed, using a rendezvous for this connection", "error", err)
+		}
+		return nil
+	}
+	p.mux = mux
+	return mux
+}
+
+// close shuts the mux down and makes later gets return nil.
+func (p *muxSession) close() {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	mux := p.mux
+	p.mux = nil
+	p.closed = true
+	p.mu.Unlock()
+	if mux != nil {
+		_ = mux.Close()
+	}
+}
+
+// muxRefused reports whether a rejected ModeMux envelope means the
+// listener predates the mode or will not serve it (not_allowed: run
+// without --allow-mux), rather than a refusal that may pass, like
+// quiescing. Listeners older than response codes answer without one.
+func muxRefused(code string) bool {
+	return code == "" || code == protocol.CodeInvalidEnvelope || code == protocol.CodeInvalidTarget || code == protocol.CodeNotAllowed
+}
+
+// dialMux dials a rendezvous and turns it into a mux session. The mux
+// lives on ctx, port-forward's own, and logs with cfg.Logger rather
+// than any one connection's logger.
+func dialMux(ctx context.Context, cfg PortForwardConfig) (*relay.Mux, error) {
+	logger := cfg.Logger
+	dialCtx, cancelDial := context.WithTimeout(ctx, dialBudget(cfg.DialBudget))
+	ws, err := cfg.Metrics.InstrumentedDial(dialCtx, cfg.Endpoint, cfg.EntityPath, cfg.TokenProvider, cfg.ClientOptions, "sender", logger)
+	cancelDial()
+	if err != nil {
+		return nil, err
+	}
+	env := protocol.ConnectEnvelope{
+		Version:  protocol.CurrentVersion,
+		Mode:     protocol.ModeMux,
+		Metadata: compressionMetadata(cfg.ClientOptions),
+		BridgeID: idgen.NewBridgeID(),
+	}
+	resp, err := sendEnvelope(ctx, ws, env, cfg.EnvelopeTimeout)
+	if err != nil {
+		_ = ws.CloseNow()
+		return nil, err
+	}
+	logger.Info("mux session started", "mux_id", env.BridgeID, "listener_id", resp.ListenerID)
+	return relay.NewMux(ctx, ws, true, relay.BridgeOptions{PingInterval: cfg.DataPingInterval}, logger.With("mux_id", env.BridgeID)), nil
+}
+
+// forwardStream carries one port-forward connection as a stream of
+// mux. It reports false, having sent nothing the listener acted on,
+// when the stream could not be opened because the mux has failed or
+// the listener reset it without replying; the caller then dials a
+// rendezvous for the connection instead. ctx
+// carries the connection's metrics tracking (TrackConnection).
+func forwardStream(ctx context.Context, mux *relay.Mux, conn net.Conn, env protocol.ConnectEnvelope, cfg PortForwardConfig, logger *slog.Logger, span *tracing.Span) (bool, error) {
+	target := env.Target
+	if err := env.ValidateMetadata(protocol.DefaultMetadataLimits); err != nil {
+		return true, fmt.Errorf("send envelope: %w", err)
+	}
+	hdr, _ := json.Marshal(env) // simple struct, cannot fail
+
+	timeout := envelopeTimeout(cfg.EnvelopeTimeout)
+	openCtx, cancel := context.WithTimeout(ctx, timeout)
+	s, reply, err := mux.Open(openCtx, hdr)
+	abandoned := ctx.Err() == nil && openCtx.Err() != nil
+	cancel()
+	if err != nil && !abandoned {
+		logger.Debug("mux stream open failed, dialing a rendezvous", "error", err)
+		return false, nil
+	}
+	var resp protocol.ConnectResponse
+	if abandoned {
+		err = fmt.Errorf("read response: %w after %s", errAbandonedRendezvous, timeout)
+	} else if perr := json.Unmarshal(reply, &resp); perr != nil {
+		err = fmt.Errorf("parse response: %w", perr)
+	} else if !resp.OK {
+		err = &connectRejected{Message: resp.Error, Code: resp.Code, ListenerID: resp.ListenerID}
+	}
+	if s != nil {
+		defer s.Close() //nolint:errcheck // best-effort cleanup
+	}
+	if err != nil {
+		logRejection(logger, target, resp.ListenerID, err)
+		cfg.Metrics.ConnectionError("sender", envelopeReason(err))
+		span.SetAttr(tracing.AttrListenerID, resp.ListenerID)
+		span.SetError(err)
+		return true, err
+	}
+	logAccept(logger, target, resp.ListenerID)
+	span.SetAttr(tracing.AttrListenerID, resp.ListenerID)
+
+	bctx := relay.WithBridgeLogger(ctx, logger)
+	opts := relay.BridgeOptions{BufferSize: cfg.BufferSize, IdleTimeout: cfg.IdleTimeout, RateLimit: cfg.RateLimit, PingInterval: cfg.DataPingInterval}
+	result, bridgeErr := cfg.Metrics.TrackedBridgeStream(bctx, s, conn, "sender", target, opts)
+	attrs := []any{
+		"cause", result.EndCause,
+		"tcp_to_ws", result.Stats.TCPToWS,
+		"ws_to_tcp", result.Stats.WSToTCP,
+		"mux", true,
+	}
+	traceBridge(span, result, bridgeErr)
+	if bridgeErr != nil {
+		logger.Warn("forward failed", append([]any{"error", bridgeErr}, attrs...)...)
+	} else {
+		logger.Debug("bridge ended", attrs...)
+	}
+	return true, bridgeErr
+}
@@ -0,0 +1,213 @@
+package sender
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/coder/websocket"
+	"github.com/philsphicas/aztunnel/internal/protocol"
+	"github.com/philsphicas/aztunnel/internal/relay"
+)
+
+// muxListener is a minimal relay + listener that dials each envelope's
+// target and bridges it, serving ModeMux sessions when mux is set and
+// refusing them like an older listener otherwise. Each rendezvous
+// first waits setup, standing in for the relay's rendezvous latency.
+func muxListener(tb testing.TB, mux bool, setup time.Duration, rendezvous *atomic.Int32) *httptest.Server {
+	tb.Helper()
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(setup)
+		ws, err := websocket.Accept(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer ws.CloseNow()
+		rendezvous.Add(1)
+		ctx := r.Context()
+		_, data, err := ws.Read(ctx)
+		if err != nil {
+			return
+		}
+		var env protocol.ConnectEnvelope
+		_ = json.Unmarshal(data, &env)
+		reply := func(resp protocol.ConnectResponse) []byte {
+			resp.Version = protocol.CurrentVersion
+			data, _ := json.Marshal(resp)
+			return data
+		}
+		if env.Mode != protocol.ModeMux {
+			target, err := net.Dial("tcp", env.Target)
+			if err != nil {
+				return
+			}
+			defer target.Close()
+			_ = ws.Write(ctx, websocket.MessageText, reply(protocol.ConnectResponse{OK: true}))
+			_, _ = relay.Bridge(ctx, ws, target)
+			_ = ws.Close(websocket.StatusNormalClosure, "")
+			return
+		}
+		if !mux {
+			_ = ws.Write(ctx, websocket.MessageText, reply(protocol.ConnectResponse{Error: "unsupported mode", Code: protocol.CodeInvalidEnvelope}))
+			return
+		}
+		_ = ws.Write(ctx, websocket.MessageText, reply(protocol.ConnectResponse{OK: true}))
+		m := relay.NewMux(ctx, ws, false, relay.BridgeOptions{}, slog.New(slog.NewTextHandler(io.Discard, nil)))
+		for {
+			s, err := m.Accept(ctx)
+			if err != nil {
+				return
+			}
+			go func() {
+				defer s.Close()
+				var env protocol.ConnectEnvelope
+				_ = json.Unmarshal(s.Header(), &env)
+				target, err := net.Dial("tcp", env.Target)
+				if err != nil {
+					_ = s.Reply(reply(protocol.ConnectResponse{Error: "connection failed"}))
+					return
+				}
+				defer target.Close()
+				_ = s.Reply(reply(protocol.ConnectResponse{OK: true}))
+				_, _ = relay.BridgeStream(ctx, s, target, relay.BridgeOptions{})
+			}()
+		}
+	}))
+	tb.Cleanup(srv.Close)
+	return srv
+}
+
+// pongTarget answers every connection with "pong" and closes it once
+// the client has.
+func pongTarget(tb testing.TB) string {
+	tb.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		tb.Fatalf("listen: %v", err)
+	}
+	tb.Cleanup(func() { _ = ln.Close() })
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				_, _ = c.Write([]byte("pong"))
+				_, _ = io.Copy(io.Discard, c)
+			}()
+		}
+	}()
+	return ln.Addr().String()
+}
+
+func muxTestConfig(srv *httptest.Server, target string) PortForwardConfig {
+	u, _ := url.Parse(srv.URL)
+	return PortForwardConfig{
+		Endpoint:      u.Host,
+		EntityPath:    "test-hc",
+		TokenProvider: budgetTokenProvider{},
+		ClientOptions: relay.ClientOptions{TLSConfig: srv.Client().Transport.(*http.Transport).TLSClientConfig},
+		Target:        target,
+		Logger:        slog.New(slog.NewTextHandler(io.Discard, nil)),
+		Mux:           true,
+		mux:           &muxSession{},
+	}
+}
+
+// shortSession forwards one connection that reads the target's pong.
+func shortSession(tb testing.TB, ctx context.Context, cfg PortForwardConfig) {
+	local, peer := net.Pipe()
+	errCh := make(chan error, 1)
+	go func() {
+		defer local.Close()
+		errCh <- forwardConnection(ctx, local, cfg.Target, cfg)
+	}()
+	got := make([]byte, 4)
+	_ = peer.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.ReadFull(peer, got); err != nil || string(got) != "pong" {
+		tb.Fatalf("read = %q (%v), want pong", got, err)
+	}
+	_ = peer.Close()
+	if err := <-errCh; err != nil {
+		tb.Fatalf("forwardConnection: %v", err)
+	}
+}
+
+func TestForwardConnection_MuxSharesRendezvous(t *testing.T) {
+	var rendezvous atomic.Int32
+	srv := muxListener(t, true, 0, &rendezvous)
+	cfg := muxTestConfig(srv, pongTarget(t))
+	defer cfg.mux.close()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	done := make(chan struct{})
+	for range 3 {
+		go func() {
+			defer func() { done <- struct{}{} }()
+			shortSession(t, ctx, cfg)
+		}()
+	}
+	for range 3 {
+		<-done
+	}
+	shortSession(t, ctx, cfg)
+	if n := rendezvous.Load(); n != 1 {
+		t.Errorf("rendezvous count = %d, want 1 shared by every connection", n)
+	}
+}
+
+func TestForwardConnection_MuxFallsBack(t *testing.T) {
+	var rendezvous atomic.Int32
+	srv := muxListener(t, false, 0, &rendezvous)
+	cfg := muxTestConfig(srv, pongTarget(t))
+	defer cfg.mux.close()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	// The refused mux envelope costs one rendezvous; after that each
+	// connection dials its own and the mode is not offered again.
+	for range 2 {
+		shortSession(t, ctx, cfg)
+	}
+	if n := rendezvous.Load(); n != 3 {
+		t.Errorf("rendezvous count = %d, want 3 (the refused mux, then one per connection)", n)
+	}
+}
+
+// BenchmarkPortForward_ShortSessions measures back-to-back short
+// connections with a rendezvous each and as streams of one mux, with
+// a simulated rendezvous setup cost; compare ns/op.
+func BenchmarkPortForward_ShortSessions(b *testing.B) {
+	for _, bc := range []struct {
+		name string
+		mux  bool
+	}{
+		{"rendezvous", false},
+		{"mux", true},
+	} {
+		b.Run(bc.name, func(b *testing.B) {
+			var rendezvous atomic.Int32
+			srv := muxListener(b, true, 2*time.Millisecond, &rendezvous)
+			cfg := muxTestConfig(srv, pongTarget(b))
+			if !bc.mux {
+				cfg.Mux, cfg.mux = false, nil
+			}
+			defer cfg.mux.close()
+			ctx := context.Background()
+			for b.Loop() {
+				shortSession(b, ctx, cfg)
+			}
+		})
+	}
+}
@@ -0,0 +1,69 @@
+package sender
+
+import (
+	"sync"
+
+	"github.com/coder/websocket"
+	"github.com/philsphicas/aztunnel/internal/relay"
+)
+
+// rendezvousPool holds at most one idle pipelined rendezvous
+// WebSocket between port-forward connections (see
+// protocol.CapPipelining). Sessions are sequential, so one slot is
+// enough to amortize the rendezvous for back-to-back short
+// connections; a concurrent connection simply dials its own.
+//
+// An idle WebSocket is not pinged, so Azure Relay may drop it after
+// its idle timeout; forwardConnection redials when a reused
+// rendezvous fails the envelope exchange. All methods are safe on a
+// nil pool, which never holds anything.
+type rendezvousPool struct {
+	mu       sync.Mutex
+	idle     *websocket.Conn
+	idleWire *relay.WireCounter
+	closed   bool
+}
+
+// get removes and returns the idle WebSocket and its WireCounter (nil
+// without compression), or nil.
+func (p *rendezvousPool) get() (*websocket.Conn, *relay.WireCounter) {
+	if p == nil {
+		return nil, nil
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	ws, wire := p.idle, p.idleWire
+	p.idle, p.idleWire = nil, nil
+	return ws, wire
+}
+
+// put parks ws and its WireCounter for the next connection, or closes
+// ws when the slot is taken or the pool has been closed.
+func (p *rendezvousPool) put(ws *websocket.Conn, wire *relay.WireCounter) {
+	if p != nil {
+		p.mu.Lock()
+		if !p.closed && p.idle == nil {
+			p.idle, p.idleWire = ws, wire
+			ws = nil
+		}
+		p.mu.Unlock()
+	}
+	if ws != nil {
+		_ = ws.CloseNow()
+	}
+}
+
+// close closes the idle WebSocket and makes later puts close theirs.
+func (p *rendezvousPool) close() {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	ws := p.idle
+	p.idle, p.idleWire = nil, nil
+	p.closed = true
+	p.mu.Unlock()
+	if ws != nil {
+		_ = ws.Close(websocket.StatusNormalClosure, "")
+	}
+}
@@ -0,0 +1,146 @@
+package sender
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/coder/websocket"
+	"github.com/philsphicas/aztunnel/internal/protocol"
+	"github.com/philsphicas/aztunnel/internal/relay"
+)
+
+// pipelinedListener is a minimal relay + listener: every rendezvous
+// loops reading envelopes, dials the target, and bridges it with
+// relay.BridgeSession while sessions stay reusable.
+func pipelinedListener(t *testing.T, rendezvous *atomic.Int32) *httptest.Server {
+	t.Helper()
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ws, err := websocket.Accept(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer ws.CloseNow()
+		rendezvous.Add(1)
+		for {
+			_, data, err := ws.Read(r.Context())
+			if err != nil {
+				return
+			}
+			var env protocol.ConnectEnvelope
+			if err := json.Unmarshal(data, &env); err != nil {
+				return
+			}
+			target, err := net.Dial("tcp", env.Target)
+			if err != nil {
+				return
+			}
+			resp, _ := json.Marshal(protocol.ConnectResponse{Version: protocol.CurrentVersion, OK: true, Capabilities: env.Capabilities})
+			if err := ws.Write(r.Context(), websocket.MessageText, resp); err != nil {
+				target.Close()
+				return
+			}
+			res, _ := relay.BridgeSession(r.Context(), ws, target, relay.BridgeOptions{})
+			target.Close()
+			if !res.Reusable {
+				return
+			}
+		}
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestForwardConnection_PipeliningReusesRendezvous(t *testing.T) {
+	var rendezvous atomic.Int32
+	srv := pipelinedListener(t, &rendezvous)
+	u, err := url.Parse(srv.URL)
+	if err != nil {
+		t.Fatalf("url.Parse: %v", err)
+	}
+
+	targetLn, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer targetLn.Close()
+	go func() {
+		for {
+			c, err := targetLn.Accept()
+			if err != nil {
+				return
+			}
+			_, _ = c.Write([]byte("pong"))
+			c.Close()
+		}
+	}()
+
+	cfg := PortForwardConfig{
+		Endpoint:      u.Host,
+		EntityPath:    "test-hc",
+		TokenProvider: budgetTokenProvider{},
+		ClientOptions: relay.ClientOptions{
+			TLSConfig: srv.Client().Transport.(*http.Transport).TLSClientConfig,
+		},
+		Target:     targetLn.Addr().String(),
+		Logger:     slog.New(slog.NewTextHandler(io.Discard, nil)),
+		Pipelining: true,
+		pool:       &rendezvousPool{},
+	}
+	defer cfg.pool.close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	for i := range 2 {
+		local, peer := tcpPairForBudget(t)
+		errCh := make(chan error, 1)
+		go func() {
+			defer local.Close()
+			errCh <- forwardConnection(ctx, local, cfg.Target, cfg)
+		}()
+		_ = peer.SetReadDeadline(time.Now().Add(5 * time.Second))
+		got, err := io.ReadAll(peer)
+		if err != nil {
+			t.Fatalf("connection %d: read: %v", i, err)
+		}
+		if string(got) != "pong" {
+			t.Errorf("connection %d: got %q, want %q", i, got, "pong")
+		}
+		peer.Close()
+		select {
+		case err := <-errCh:
+			if err != nil {
+				t.Fatalf("connection %d: forwardConnection: %v", i, err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("connection %d: forwardConnection did not return", i)
+		}
+	}
+
+	if n := rendezvous.Load(); n != 1 {
+		t.Errorf("rendezvous count = %d, want 1 (second connection should reuse the first)", n)
+	}
+}
+
+func TestRendezvousPool_NilAndClosed(t *testing.T) {
+	var nilPool *rendezvousPool
+	if ws, _ := nilPool.get(); ws != nil {
+		t.Errorf("nil pool get = %v, want nil", ws)
+	}
+	nilPool.close()
+
+	p := &rendezvousPool{}
+	p.close()
+	if ws, _ := p.get(); ws != nil {
+		t.Errorf("closed pool get = %v, want nil", ws)
+	}
+}
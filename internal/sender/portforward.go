@@ -1,5 +1,5 @@
 // Package sender implements the relay-sender modes: port-forward,
-// socks5-proxy, and connect (stdin/stdout).
+// socks5-proxy, http-proxy, and connect (stdin/stdout).
 package sender
 
 import (
@@ -10,6 +10,8 @@ import (
 	"io"
 	"log/slog"
 	"net"
+	"os"
+	"strings"
 	"time"
 
 	"github.com/coder/websocket"
@@ -17,6 +19,7 @@ import (
 	"github.com/philsphicas/aztunnel/internal/metrics"
 	"github.com/philsphicas/aztunnel/internal/protocol"
 	"github.com/philsphicas/aztunnel/internal/relay"
+	"github.com/philsphicas/aztunnel/internal/tracing"
 )
 
 // PortForwardConfig holds configuration for port-forward mode.
@@ -26,22 +29,69 @@ type PortForwardConfig struct {
 	TokenProvider relay.TokenProvider
 	ClientOptions relay.ClientOptions
 	Target        string // host:port to forward to
-	BindAddress   string // local address:port to listen on
+	BindAddress   string // local address:port, or unix:/path, to listen on
+	Network       string // local listener network: tcp (default), tcp4, or tcp6
 	TCPKeepAlive  time.Duration
 	Logger        *slog.Logger
 	Metrics       *metrics.Metrics // optional; nil disables metrics
+	Tracer        *tracing.Tracer  // optional; nil disables tracing
 	// DialBudget bounds the per-connection relay dial + retry
 	// duration. Zero (the default) uses defaultDialBudget. See
 	// issue #94: without a per-connection bound, retry continues
 	// after the local app has closed its socket, producing ghost
 	// rendezvous when a listener eventually appears.
 	DialBudget time.Duration
+	// EnvelopeTimeout bounds the wait for the listener's response to
+	// the connect envelope. Zero uses defaultEnvelopeTimeout.
+	EnvelopeTimeout time.Duration
 	// Ready, if non-nil, is invoked once after the local bind succeeds
 	// and before the accept loop starts. Tests use this to learn the
 	// chosen bind address (when BindAddress is :0) without having to
 	// probe with a real TCP dial that would consume a listener slot
 	// under MaxConnections. Production callers leave this nil.
 	Ready func(net.Addr)
+	// Pipelining offers protocol.CapPipelining to the listener so
+	// back-to-back connections can reuse one idle rendezvous instead
+	// of dialing a new one each time. Listeners that do not support
+	// it fall back to one rendezvous per connection.
+	Pipelining bool
+	// HalfClose offers protocol.CapHalfClose so a local client that
+	// shuts down its write side (CloseWrite) still receives the rest
+	// of the target's reply. Without it, or against a listener that
+	// does not support it, the first EOF ends the connection.
+	HalfClose bool
+	// Mux carries every connection as a stream of one shared
+	// rendezvous (protocol.ModeMux) instead of dialing a rendezvous
+	// for each, so only the first connection pays the dial. Against
+	// a listener that does not support it, connections fall back to
+	// a rendezvous each. It takes precedence over Pipelining.
+	Mux bool
+	// BufferSize is the bridge copy buffer size; see
+	// relay.BridgeOptions.BufferSize. Zero uses the default.
+	BufferSize int
+
+	// IdleTimeout closes a bridged connection that has moved no data
+	// for this long; see relay.BridgeOptions.IdleTimeout. Zero
+	// disables it.
+	IdleTimeout time.Duration
+
+	// RateLimit caps each direction of a bridged connection in
+	// bytes/sec; see relay.BridgeOptions.RateLimit. Zero is unlimited.
+	RateLimit int64
+
+	// DataPingInterval is how long a bridged connection's WebSocket
+	// may go without sending before it is pinged; see
+	// relay.BridgeOptions.PingInterval. Zero selects the relay package
+	// default (30s); a negative value disables pings.
+	DataPingInterval time.Duration
+
+	// pool holds the idle pipelined rendezvous. PortForward sets it
+	// when Pipelining is on; nil otherwise.
+	pool *rendezvousPool
+
+	// mux holds the shared mux session. PortForward sets it when Mux
+	// is on; nil otherwise.
+	mux *muxSession
 }
 
 // PortForward starts a local TCP listener and forwards each connection
@@ -54,9 +104,9 @@ func PortForward(ctx context.Context, cfg PortForwardConfig) error {
 		cfg.TCPKeepAlive = 30 * time.Second
 	}
 
-	ln, err := net.Listen("tcp", cfg.BindAddress)
+	ln, err := listen(cfg.Network, cfg.BindAddress, cfg.Logger)
 	if err != nil {
-		return fmt.Errorf("listen %s: %w", cfg.BindAddress, err)
+		return err
 	}
 	defer ln.Close() //nolint:errcheck // best-effort cleanup
 	cfg.Logger.Info("port-forward listening", "bind", ln.Addr(), "target", cfg.Target)
@@ -69,6 +119,15 @@ func PortForward(ctx context.Context, cfg PortForwardConfig) error {
 		ln.Close() //nolint:errcheck // best-effort cleanup
 	}()
 
+	if cfg.Pipelining {
+		cfg.pool = &rendezvousPool{}
+		defer cfg.pool.close()
+	}
+	if cfg.Mux {
+		cfg.mux = &muxSession{}
+		defer cfg.mux.close()
+	}
+
 	for {
 		conn, err := ln.Accept()
 		if err != nil {
@@ -90,7 +149,7 @@ func PortForward(ctx context.Context, cfg PortForwardConfig) error {
 	}
 }
 
-func forwardConnection(ctx context.Context, conn net.Conn, target string, cfg PortForwardConfig) error {
+func forwardConnection(ctx context.Context, conn net.Conn, target string, cfg PortForwardConfig) (err error) {
 	// Set TCP keepalive on the incoming connection.
 	relay.SetTCPKeepAlive(conn, cfg.TCPKeepAlive)
 
@@ -98,33 +157,125 @@ func forwardConnection(ctx context.Context, conn net.Conn, target string, cfg Po
 	logger := cfg.Logger.With("bridge_id", bridgeID)
 	logger.Info("connection requested", "target", target)
 
+	span := cfg.Tracer.Start("aztunnel.sender.port_forward", tracing.KindClient, "")
+	defer span.End()
+	span.SetAttr(tracing.AttrTarget, target)
+	span.SetAttr(tracing.AttrBridgeID, bridgeID)
+
+	// Track the connection from here so one that fails before its
+	// bridge still counts. The shared mux lives on port-forward's own
+	// ctx rather than this connection's.
+	muxCtx := ctx
+	ctx = metrics.WithConnID(ctx, bridgeID)
+	ctx = metrics.WithConnLabels(ctx, connLabels(conn, cfg.Endpoint))
+	ctx = metrics.WithClientAddr(ctx, clientAddr(conn))
+	ctx, tracker := cfg.Metrics.TrackConnection(ctx, "sender", target)
+	defer func() { tracker.Finish(err) }()
+
 	// Per-connection dial budget caps retry duration so a stale
 	// local socket can't keep retrying indefinitely (issue #94).
 	// The bridge below intentionally uses the original ctx, not
 	// dialCtx, so a successful dial isn't torn down by cancelDial.
-	dialCtx, cancelDial := context.WithTimeout(ctx, dialBudget(cfg.DialBudget))
-	ws, err := cfg.Metrics.InstrumentedDial(dialCtx, cfg.Endpoint, cfg.EntityPath, cfg.TokenProvider, cfg.ClientOptions, "sender", logger)
-	cancelDial()
-	if err != nil {
-		logger.Warn("forward failed", "error", err)
-		return err
+	dial := func() (*websocket.Conn, *relay.WireCounter, error) {
+		dialCtx, cancelDial := context.WithTimeout(ctx, dialBudget(cfg.DialBudget))
+		defer cancelDial()
+		dialCtx, wire := withWireCounter(dialCtx, cfg.ClientOptions)
+		dialStart := time.Now()
+		ws, err := cfg.Metrics.InstrumentedDial(dialCtx, cfg.Endpoint, cfg.EntityPath, cfg.TokenProvider, cfg.ClientOptions, "sender", logger)
+		span.SetAttr(tracing.AttrDialDuration, time.Since(dialStart))
+		if err != nil {
+			logger.Warn("forward failed", "error", err)
+			span.SetError(err)
+		}
+		return ws, wire, err
+	}
+
+	env := protocol.ConnectEnvelope{
+		Version:  protocol.CurrentVersion,
+		Target:   target,
+		Metadata: envelopeMetadata(cfg.ClientOptions, span, conn.RemoteAddr()),
+		BridgeID: bridgeID,
+	}
+	if cfg.Pipelining {
+		env.Capabilities = append(env.Capabilities, protocol.CapPipelining)
+	}
+	if cfg.HalfClose {
+		env.Capabilities = append(env.Capabilities, protocol.CapHalfClose)
+	}
+
+	if mux := cfg.mux.get(muxCtx, cfg, logger); mux != nil {
+		if handled, err := forwardStream(ctx, mux, conn, env, cfg, logger, span); handled {
+			return err
+		}
+	}
+
+	ws, wire := cfg.pool.get()
+	reused := ws != nil
+	if !reused {
+		if ws, wire, err = dial(); err != nil {
+			return err
+		}
 	}
-	defer func() { _ = ws.CloseNow() }()
 
 	// Send envelope and read response.
-	listenerID, err := sendEnvelopeAndCheck(ctx, ws, target, bridgeID)
+	resp, err := sendEnvelope(ctx, ws, env, cfg.EnvelopeTimeout)
+	var rejected *connectRejected
+	if err != nil && reused && !errors.As(err, &rejected) {
+		// The idle rendezvous went stale (e.g. the relay's idle
+		// timeout); retry once on a fresh one.
+		logger.Debug("idle pipelined rendezvous failed, redialing", "error", err)
+		_ = ws.CloseNow()
+		reused = false
+		if ws, wire, err = dial(); err != nil {
+			return err
+		}
+		resp, err = sendEnvelope(ctx, ws, env, cfg.EnvelopeTimeout)
+	}
+	keep := false
+	defer func() {
+		if keep {
+			cfg.pool.put(ws, wire)
+		} else {
+			_ = ws.CloseNow()
+		}
+	}()
 	if err != nil {
 		// logRejection already emits a contextual WARN with target,
 		// code, and listener_id; do not log "forward failed" on top
 		// of it (the doubled WARN obscures rather than clarifies).
-		logRejection(logger, target, listenerID, err)
-		cfg.Metrics.ConnectionError("sender", metrics.ReasonEnvelopeError)
+		logRejection(logger, target, resp.ListenerID, err)
+		cfg.Metrics.ConnectionError("sender", envelopeReason(err))
+		span.SetAttr(tracing.AttrListenerID, resp.ListenerID)
+		span.SetError(err)
 		return err
 	}
-	logAccept(logger, target, listenerID)
+	logAccept(logger, target, resp.ListenerID)
+	span.SetAttr(tracing.AttrListenerID, resp.ListenerID)
+	logCompression(logger, wire, resp)
 
 	// Bridge data.
-	result, bridgeErr := cfg.Metrics.TrackedBridge(ctx, ws, conn, "sender", target)
+	var result relay.BridgeResult
+	var bridgeErr error
+	pipelined := cfg.Pipelining && protocol.HasCapability(resp.Capabilities, protocol.CapPipelining)
+	bctx := relay.WithBridgeLogger(ctx, logger)
+	if wire != nil {
+		bctx = relay.WithWireCounter(bctx, wire)
+	}
+	if pipelined {
+		var sr relay.SessionResult
+		opts := relay.BridgeOptions{BufferSize: cfg.BufferSize, IdleTimeout: cfg.IdleTimeout, RateLimit: cfg.RateLimit, PingInterval: cfg.DataPingInterval}
+		sr, bridgeErr = cfg.Metrics.TrackedBridgeSession(bctx, ws, conn, "sender", target, opts)
+		result, keep = sr.BridgeResult, sr.Reusable
+	} else {
+		opts := relay.BridgeOptions{
+			HalfClose:    cfg.HalfClose && protocol.HasCapability(resp.Capabilities, protocol.CapHalfClose),
+			BufferSize:   cfg.BufferSize,
+			IdleTimeout:  cfg.IdleTimeout,
+			RateLimit:    cfg.RateLimit,
+			PingInterval: cfg.DataPingInterval,
+		}
+		result, bridgeErr = cfg.Metrics.TrackedBridgeWithOptions(bctx, ws, conn, "sender", target, opts)
+	}
 	attrs := []any{
 		"cause", result.EndCause,
 		"tcp_to_ws", result.Stats.TCPToWS,
@@ -139,6 +290,10 @@ func forwardConnection(ctx context.Context, conn net.Conn, target string, cfg Po
 	if code, ok := relay.WSCloseCode(bridgeErr); ok {
 		attrs = append(attrs, "close_code", code)
 	}
+	if pipelined {
+		attrs = append(attrs, "reused", reused, "reusable", keep)
+	}
+	traceBridge(span, result, bridgeErr)
 	if bridgeErr != nil {
 		errAttrs := append([]any{"error", bridgeErr}, attrs...)
 		logger.Warn("forward failed", errAttrs...)
@@ -158,35 +313,67 @@ func forwardConnection(ctx context.Context, conn net.Conn, target string, cfg Po
 //
 // bridgeID is the sender-minted correlation ID for this bridge; it is
 // propagated to the listener via ConnectEnvelope.BridgeID so logs on
-// both ends carry the same value.
+// both ends carry the same value. meta becomes ConnectEnvelope.Metadata
+// and may be nil.
 //
-// The returned listenerID is the value from ConnectResponse.ListenerID:
-// non-empty for current-version listeners (success or rejection), empty
-// for pre-listener_id listeners or for failures that occur before any
-// response was read (write/read/parse errors).
-func sendEnvelopeAndCheck(ctx context.Context, ws *websocket.Conn, target, bridgeID string) (string, error) {
+// The returned resp.ListenerID is non-empty for current-version
+// listeners (success or rejection), empty for pre-listener_id
+// listeners or for failures that occur before any response was read
+// (write/read/parse errors).
+func sendEnvelopeAndCheck(ctx context.Context, ws *websocket.Conn, target, bridgeID string, meta map[string]string, timeout time.Duration) (protocol.ConnectResponse, error) {
 	env := protocol.ConnectEnvelope{
 		Version:  protocol.CurrentVersion,
 		Target:   target,
+		Metadata: meta,
 		BridgeID: bridgeID,
 	}
-	data, _ := json.Marshal(env) // simple struct, cannot fail
-	if err := ws.Write(ctx, websocket.MessageText, data); err != nil {
-		return "", fmt.Errorf("send envelope: %w", err)
+	return sendEnvelope(ctx, ws, env, timeout)
+}
+
+// sendEnvelope writes env and waits for the listener's response,
+// returning it with the same error shape as sendEnvelopeAndCheck. It
+// validates env.Metadata against the default limits first so an
+// oversized envelope fails locally rather than being rejected by the
+// listener after a rendezvous.
+//
+// The whole exchange, the envelope write as well as the response
+// read, is bounded by timeout (envelopeTimeout). When it expires the
+// context cancellation closes ws and the returned error wraps
+// errAbandonedRendezvous.
+func sendEnvelope(ctx context.Context, ws *websocket.Conn, env protocol.ConnectEnvelope, timeout time.Duration) (protocol.ConnectResponse, error) {
+	if err := env.ValidateMetadata(protocol.DefaultMetadataLimits); err != nil {
+		return protocol.ConnectResponse{}, fmt.Errorf("send envelope: %w", err)
 	}
+	data, _ := json.Marshal(env) // simple struct, cannot fail
 
-	_, respData, err := ws.Read(ctx)
+	timeout = envelopeTimeout(timeout)
+	exchangeCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	abandoned := func(op string) error {
+		_ = ws.CloseNow()
+		return fmt.Errorf("%s: %w after %s", op, errAbandonedRendezvous, timeout)
+	}
+	if err := ws.Write(exchangeCtx, websocket.MessageText, data); err != nil {
+		if ctx.Err() == nil && exchangeCtx.Err() != nil {
+			return protocol.ConnectResponse{}, abandoned("send envelope")
+		}
+		return protocol.ConnectResponse{}, fmt.Errorf("send envelope: %w", err)
+	}
+	_, respData, err := ws.Read(exchangeCtx)
 	if err != nil {
-		return "", fmt.Errorf("read response: %w", err)
+		if ctx.Err() == nil && exchangeCtx.Err() != nil {
+			return protocol.ConnectResponse{}, abandoned("read response")
+		}
+		return protocol.ConnectResponse{}, fmt.Errorf("read response: %w", err)
 	}
 	var resp protocol.ConnectResponse
 	if err := json.Unmarshal(respData, &resp); err != nil {
-		return "", fmt.Errorf("parse response: %w", err)
+		return protocol.ConnectResponse{}, fmt.Errorf("parse response: %w", err)
 	}
 	if !resp.OK {
-		return resp.ListenerID, &connectRejected{Message: resp.Error, Code: resp.Code, ListenerID: resp.ListenerID}
+		return resp, &connectRejected{Message: resp.Error, Code: resp.Code, ListenerID: resp.ListenerID}
 	}
-	return resp.ListenerID, nil
+	return resp, nil
 }
 
 // connectRejected is returned from sendEnvelopeAndCheck when the
@@ -221,6 +408,16 @@ func logAccept(logger *slog.Logger, target, listenerID string) {
 	logger.Info("listener accepted connection", attrs...)
 }
 
+// connLabels returns the detail metric labels for a sender bridge. The
+// local address of an accepted connection is the bind address, so it
+// stays low-cardinality; stdio connections report "stdio".
+func connLabels(conn net.Conn, endpoint string) metrics.ConnLabels {
+	return metrics.ConnLabels{
+		LocalAddr: conn.LocalAddr().String(),
+		RelayHost: endpoint,
+	}
+}
+
 // logRejection emits a structured Warn for a sendEnvelopeAndCheck
 // failure. Centralised so all three sender entry points share the
 // same log shape.
@@ -256,6 +453,39 @@ func logRejection(logger *slog.Logger, target, listenerID string, err error) {
 	logger.Warn("envelope exchange failed", attrs...)
 }
 
+// unixSocketPath returns the socket path of a unix:/path bind address.
+func unixSocketPath(bindAddress string) (string, bool) {
+	return strings.CutPrefix(bindAddress, "unix:")
+}
+
+// listenUnix listens on the Unix domain socket at path. A socket file
+// left behind by a process that exited without cleaning up is removed
+// first; one that still accepts connections, or a path that is not a
+// socket, is an error rather than something to delete. The listener
+// unlinks the socket file when it is closed.
+func listenUnix(path string) (net.Listener, error) {
+	if path == "" {
+		return nil, errors.New("listen unix: empty socket path")
+	}
+	if fi, err := os.Lstat(path); err == nil {
+		if fi.Mode()&os.ModeSocket == 0 {
+			return nil, fmt.Errorf("listen unix:%s: file exists and is not a socket", path)
+		}
+		if c, err := net.DialTimeout("unix", path, time.Second); err == nil {
+			_ = c.Close()
+			return nil, fmt.Errorf("listen unix:%s: socket is in use", path)
+		}
+		if err := os.Remove(path); err != nil {
+			return nil, fmt.Errorf("listen unix:%s: remove stale socket: %w", path, err)
+		}
+	}
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, fmt.Errorf("listen unix:%s: %w", path, err)
+	}
+	return ln, nil
+}
+
 // stdioConn adapts stdin/stdout to net.Conn for use with Bridge.
 type stdioConn struct {
 	in  io.ReadCloser
@@ -10,12 +10,17 @@ import (
 	"net"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
+	"strconv"
 	"strings"
 	"testing"
 	"time"
 
 	"github.com/coder/websocket"
+	"github.com/philsphicas/aztunnel/internal/metrics"
 	"github.com/philsphicas/aztunnel/internal/protocol"
+	"github.com/philsphicas/aztunnel/internal/relay"
+	"github.com/philsphicas/aztunnel/internal/tracing"
 )
 
 // --- stdioConn tests ---
@@ -281,7 +286,8 @@ func TestSendEnvelopeAndCheck(t *testing.T) {
 			}
 			defer ws.CloseNow()
 
-			listenerID, err := sendEnvelopeAndCheck(ctx, ws, tt.target, "TESTBRIDGEID0001")
+			resp, err := sendEnvelopeAndCheck(ctx, ws, tt.target, "TESTBRIDGEID0001", nil, 0)
+			listenerID := resp.ListenerID
 
 			if listenerID != tt.wantListenerID {
 				t.Errorf("listenerID = %q, want %q", listenerID, tt.wantListenerID)
@@ -340,7 +346,8 @@ func TestSendEnvelopeAndCheck_WriteError(t *testing.T) {
 	// Give the server a moment to send its close frame.
 	time.Sleep(50 * time.Millisecond)
 
-	listenerID, err := sendEnvelopeAndCheck(ctx, ws, "localhost:80", "TESTBRIDGEID0002")
+	resp, err := sendEnvelopeAndCheck(ctx, ws, "localhost:80", "TESTBRIDGEID0002", nil, 0)
+	listenerID := resp.ListenerID
 	if err == nil {
 		t.Fatal("expected error when writing to closed websocket, got nil")
 	}
@@ -353,6 +360,23 @@ func TestSendEnvelopeAndCheck_WriteError(t *testing.T) {
 	}
 }
 
+func TestSendEnvelope_MetadataTooLarge(t *testing.T) {
+	env := protocol.ConnectEnvelope{
+		Version:  protocol.CurrentVersion,
+		Target:   "localhost:80",
+		Metadata: map[string]string{"blob": strings.Repeat("x", protocol.DefaultMetadataLimits.MaxValueLen+1)},
+	}
+	// The nil conn proves validation fails before anything is written.
+	_, err := sendEnvelope(context.Background(), nil, env, 0)
+	var me *protocol.MetadataError
+	if !errors.As(err, &me) {
+		t.Fatalf("err = %v, want *protocol.MetadataError", err)
+	}
+	if me.Code != protocol.CodeEnvelopeTooLarge {
+		t.Errorf("code = %q, want %q", me.Code, protocol.CodeEnvelopeTooLarge)
+	}
+}
+
 func TestSendEnvelopeAndCheck_InvalidResponse(t *testing.T) {
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
@@ -387,7 +411,8 @@ func TestSendEnvelopeAndCheck_InvalidResponse(t *testing.T) {
 	}
 	defer ws.CloseNow()
 
-	listenerID, err := sendEnvelopeAndCheck(ctx, ws, "localhost:80", "TESTBRIDGEID0003")
+	resp, err := sendEnvelopeAndCheck(ctx, ws, "localhost:80", "TESTBRIDGEID0003", nil, 0)
+	listenerID := resp.ListenerID
 	if err == nil {
 		t.Fatal("expected error for invalid JSON response, got nil")
 	}
@@ -520,3 +545,191 @@ func TestLogAccept(t *testing.T) {
 		}
 	})
 }
+
+func TestListen_LocalFamilyTCP4(t *testing.T) {
+	probe, err := net.Listen("tcp6", "[::1]:0")
+	if err != nil {
+		t.Skipf("IPv6 loopback unavailable: %v", err)
+	}
+	_ = probe.Close()
+
+	t.Setenv("AZTUNNEL_SYSTEMD_SOCKET", "")
+	ln, err := listen("tcp4", ":0", slog.New(slog.NewTextHandler(io.Discard, nil)))
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer ln.Close() //nolint:errcheck // best-effort cleanup
+	addr := ln.Addr().(*net.TCPAddr)
+	if addr.IP.To4() == nil {
+		t.Fatalf("tcp4 listener bound %s, want an IPv4 address", addr)
+	}
+
+	port := strconv.Itoa(addr.Port)
+	c, err := net.DialTimeout("tcp4", net.JoinHostPort("127.0.0.1", port), time.Second)
+	if err != nil {
+		t.Fatalf("IPv4 dial: %v", err)
+	}
+	_ = c.Close()
+	if c, err := net.DialTimeout("tcp6", net.JoinHostPort("::1", port), time.Second); err == nil {
+		_ = c.Close()
+		t.Error("IPv6 dial succeeded against a tcp4 listener")
+	}
+}
+
+// --- envelopeMetadata tests ---
+
+func TestEnvelopeMetadata(t *testing.T) {
+	if meta := envelopeMetadata(relay.ClientOptions{}, nil, nil); meta != nil {
+		t.Errorf("no compression, no span: metadata = %v, want nil", meta)
+	}
+	// Only a TCP client's address is worth passing on.
+	if meta := envelopeMetadata(relay.ClientOptions{}, nil, &net.UnixAddr{Name: "/run/app.sock", Net: "unix"}); meta != nil {
+		t.Errorf("unix client: metadata = %v, want nil", meta)
+	}
+	client := &net.TCPAddr{IP: net.ParseIP("192.0.2.7"), Port: 50123}
+	if meta := envelopeMetadata(relay.ClientOptions{}, nil, client); meta[protocol.MetaClientAddr] != "192.0.2.7:50123" {
+		t.Errorf("tcp client: metadata = %v, want client_addr 192.0.2.7:50123", meta)
+	}
+
+	tracer, err := tracing.New(tracing.Config{Endpoint: "http://127.0.0.1:1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tracer.Close(context.Background()) //nolint:errcheck // span never ended
+	span := tracer.Start("op", tracing.KindClient, "")
+	meta := envelopeMetadata(relay.ClientOptions{Compression: true}, span, nil)
+	if meta[protocol.MetaTraceparent] != span.Traceparent() || meta[protocol.MetaCompression] != protocol.CompressionDeflate {
+		t.Errorf("metadata = %v, want traceparent %s and compression", meta, span.Traceparent())
+	}
+}
+
+// refusingListener is a relay + listener that refuses every envelope
+// with CodeNotAllowed.
+func refusingListener(t *testing.T) *httptest.Server {
+	t.Helper()
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ws, err := websocket.Accept(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer ws.CloseNow()
+		if _, _, err := ws.Read(r.Context()); err != nil {
+			return
+		}
+		data, _ := json.Marshal(protocol.ConnectResponse{Version: protocol.CurrentVersion, Error: "target not allowed", Code: protocol.CodeNotAllowed})
+		_ = ws.Write(r.Context(), websocket.MessageText, data)
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+// senderConnections returns the sender's aztunnel_active_connections
+// and its aztunnel_connections_total with status, summed over targets.
+func senderConnections(t *testing.T, m *metrics.Metrics, status string) (active, total float64) {
+	t.Helper()
+	fams, err := m.Registry.Gather()
+	if err != nil {
+		t.Fatalf("gather: %v", err)
+	}
+	for _, f := range fams {
+		for _, mt := range f.GetMetric() {
+			labels := map[string]string{}
+			for _, l := range mt.GetLabel() {
+				labels[l.GetName()] = l.GetValue()
+			}
+			if labels["role"] != "sender" {
+				continue
+			}
+			switch {
+			case f.GetName() == "aztunnel_active_connections":
+				active += mt.GetGauge().GetValue()
+			case f.GetName() == "aztunnel_connections_total" && labels["status"] == status:
+				total += mt.GetCounter().GetValue()
+			}
+		}
+	}
+	return active, total
+}
+
+// TestSenderModes_CountRefusedConnections checks that every sender
+// mode counts a connection the listener refused, or whose relay dial
+// failed, in connections_total with status error.
+func TestSenderModes_CountRefusedConnections(t *testing.T) {
+	srv := refusingListener(t)
+	u, _ := url.Parse(srv.URL)
+	tlsConfig := srv.Client().Transport.(*http.Transport).TLSClientConfig
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	modes := map[string]func(ctx context.Context, endpoint string, m *metrics.Metrics) error{
+		"port-forward": func(ctx context.Context, endpoint string, m *metrics.Metrics) error {
+			local, peer := tcpPairForBudget(t)
+			defer peer.Close()
+			defer local.Close()
+			return forwardConnection(ctx, local, "10.0.0.5:22", PortForwardConfig{
+				Endpoint: endpoint, EntityPath: "test-hc", TokenProvider: budgetTokenProvider{},
+				ClientOptions: relay.ClientOptions{TLSConfig: tlsConfig},
+				Target:        "10.0.0.5:22", Logger: logger, Metrics: m, DialBudget: time.Second,
+			})
+		},
+		"socks5": func(ctx context.Context, endpoint string, m *metrics.Metrics) error {
+			local, peer := tcpPairForBudget(t)
+			defer peer.Close()
+			defer local.Close()
+			go func() {
+				_, _ = peer.Write([]byte{0x05, 0x01, 0x00})
+				_, _ = io.ReadFull(peer, make([]byte, 2))
+				_, _ = peer.Write([]byte{0x05, 0x01, 0x00, 0x01, 10, 0, 0, 5, 0, 22})
+				_, _ = io.Copy(io.Discard, peer)
+			}()
+			return handleSOCKS5(ctx, local, SOCKS5Config{
+				Endpoint: endpoint, EntityPath: "test-hc", TokenProvider: budgetTokenProvider{},
+				ClientOptions: relay.ClientOptions{TLSConfig: tlsConfig},
+				Logger:        logger, Metrics: m, DialBudget: time.Second,
+			})
+		},
+		"http-proxy": func(ctx context.Context, endpoint string, m *metrics.Metrics) error {
+			local, peer := tcpPairForBudget(t)
+			defer peer.Close()
+			defer local.Close()
+			go func() {
+				_, _ = io.WriteString(peer, "CONNECT 10.0.0.5:22 HTTP/1.1\r\nHost: 10.0.0.5:22\r\n\r\n")
+				_, _ = io.Copy(io.Discard, peer)
+			}()
+			return handleHTTPConnect(ctx, local, HTTPProxyConfig{
+				Endpoint: endpoint, EntityPath: "test-hc", TokenProvider: budgetTokenProvider{},
+				ClientOptions: relay.ClientOptions{TLSConfig: tlsConfig},
+				Logger:        logger, Metrics: m, DialBudget: time.Second,
+			})
+		},
+		"connect": func(ctx context.Context, endpoint string, m *metrics.Metrics) error {
+			return Connect(ctx, ConnectConfig{
+				Endpoint: endpoint, EntityPath: "test-hc", TokenProvider: budgetTokenProvider{},
+				ClientOptions: relay.ClientOptions{TLSConfig: tlsConfig},
+				Target:        "10.0.0.5:22", Logger: logger, Metrics: m, DialBudget: time.Second,
+				Stdin: io.NopCloser(strings.NewReader("")), Stdout: &fakeWriteCloser{Writer: io.Discard},
+			})
+		},
+	}
+	for name, run := range modes {
+		for _, tc := range []struct {
+			name     string
+			endpoint string
+		}{
+			{"refused", u.Host},
+			{"dial failed", "127.0.0.1:1"},
+		} {
+			t.Run(name+"/"+tc.name, func(t *testing.T) {
+				ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+				defer cancel()
+				m := metrics.New()
+				if err := run(ctx, tc.endpoint, m); err == nil {
+					t.Fatal("connection succeeded, want an error")
+				}
+				active, errored := senderConnections(t, m, "error")
+				if active != 0 || errored != 1 {
+					t.Errorf("active = %v, connections_total{status=error} = %v; want 0 and 1", active, errored)
+				}
+			})
+		}
+	}
+}
@@ -1,14 +1,19 @@
 // Package socks5 implements a minimal SOCKS5 server (RFC 1928) that supports
-// the CONNECT command with no authentication. It is used by the sender to
-// accept dynamic forwarding requests from clients like ssh -D.
+// the CONNECT and UDP ASSOCIATE commands with no authentication or,
+// optionally, username/password authentication (RFC 1929). It is used by the
+// sender to accept dynamic forwarding requests from clients like ssh -D.
 package socks5
 
 import (
+	"bytes"
+	"crypto/subtle"
 	"encoding/binary"
 	"errors"
 	"fmt"
 	"io"
 	"net"
+	"net/netip"
+	"slices"
 	"strconv"
 )
 
@@ -17,9 +22,16 @@ const (
 	Version5 = 0x05
 
 	AuthNone         = 0x00
+	AuthUserPass     = 0x02
 	AuthNoAcceptable = 0xFF
 
-	CmdConnect = 0x01
+	// UserPassVersion is the RFC 1929 sub-negotiation version.
+	UserPassVersion = 0x01
+	UserPassSuccess = 0x00
+	UserPassFailure = 0x01
+
+	CmdConnect      = 0x01
+	CmdUDPAssociate = 0x03
 
 	AddrIPv4   = 0x01
 	AddrDomain = 0x03
@@ -36,88 +48,173 @@ const (
 	RepAddressNotSupported  = 0x08
 )
 
+// Errors from the authentication phase of HandshakeAuth. The client has
+// already been answered, so the caller must close the connection
+// without sending a SendReply.
+var (
+	// ErrNoAcceptableAuth means the client offered no method the
+	// server accepts; it was sent AuthNoAcceptable.
+	ErrNoAcceptableAuth = errors.New("no acceptable auth method offered")
+	// ErrAuthFailed means the client's username/password was
+	// rejected; it was sent UserPassFailure.
+	ErrAuthFailed = errors.New("username/password rejected")
+)
+
+// CredentialValidator reports whether a SOCKS5 username/password pair
+// is accepted.
+type CredentialValidator func(user, pass string) bool
+
+// StaticCredentials returns a CredentialValidator that accepts exactly
+// the user/password pairs in creds. Passwords are compared in constant
+// time.
+func StaticCredentials(creds map[string]string) CredentialValidator {
+	return func(user, pass string) bool {
+		want, ok := creds[user]
+		// Compare even for unknown users so timing does not reveal
+		// which user names exist.
+		match := subtle.ConstantTimeCompare([]byte(pass), []byte(want)) == 1
+		return ok && match
+	}
+}
+
+// errAddressType reports an ATYP this server does not support.
+var errAddressType = errors.New("unsupported address type")
+
+// errFragment reports a fragmented UDP datagram (FRAG != 0), which
+// this server does not reassemble.
+var errFragment = errors.New("fragmented datagram")
+
+// Request is a parsed SOCKS5 request.
+type Request struct {
+	// Cmd is CmdConnect or CmdUDPAssociate.
+	Cmd byte
+	// Target is the host:port to connect to, or for CmdUDPAssociate
+	// the address the client will send datagrams from (often
+	// 0.0.0.0:0 when it does not know yet).
+	Target string
+}
+
 // Handshake performs the server-side SOCKS5 negotiation on conn.
 // It handles auth method negotiation (accepting only "no auth") and
 // parses a CONNECT request. On success it returns the target host:port.
 // The caller is responsible for sending the reply via SendReply.
 func Handshake(conn io.ReadWriter) (string, error) {
+	return HandshakeAuth(conn, nil)
+}
+
+// HandshakeAuth is Handshake with optional username/password
+// authentication. With a nil validate it accepts only "no auth"; with
+// a non-nil one it accepts only AuthUserPass and checks the client's
+// RFC 1929 credentials with validate. Authentication failures return
+// ErrNoAcceptableAuth or ErrAuthFailed after answering the client.
+func HandshakeAuth(conn io.ReadWriter, validate CredentialValidator) (string, error) {
+	req, err := HandshakeRequest(conn, validate)
+	if err != nil {
+		return "", err
+	}
+	if req.Cmd != CmdConnect {
+		_ = SendReply(conn, RepCommandNotSupported, nil)
+		return "", fmt.Errorf("unsupported SOCKS command: %d", req.Cmd)
+	}
+	return req.Target, nil
+}
+
+// HandshakeRequest is HandshakeAuth for servers that also take UDP
+// ASSOCIATE: it returns the request with its command instead of
+// refusing everything but CONNECT. Other commands still get
+// RepCommandNotSupported.
+func HandshakeRequest(conn io.ReadWriter, validate CredentialValidator) (Request, error) {
 	// Auth method negotiation: VER | NMETHODS | METHODS...
 	header := make([]byte, 2)
 	if _, err := io.ReadFull(conn, header); err != nil {
-		return "", fmt.Errorf("read auth header: %w", err)
+		return Request{}, fmt.Errorf("read auth header: %w", err)
 	}
 	if header[0] != Version5 {
-		return "", fmt.Errorf("unsupported SOCKS version: %d", header[0])
+		return Request{}, fmt.Errorf("unsupported SOCKS version: %d", header[0])
 	}
 	nMethods := int(header[1])
 	if nMethods == 0 {
-		return "", errors.New("no auth methods offered")
+		return Request{}, errors.New("no auth methods offered")
 	}
 	methods := make([]byte, nMethods)
 	if _, err := io.ReadFull(conn, methods); err != nil {
-		return "", fmt.Errorf("read auth methods: %w", err)
+		return Request{}, fmt.Errorf("read auth methods: %w", err)
 	}
 
-	hasNoAuth := false
-	for _, m := range methods {
-		if m == AuthNone {
-			hasNoAuth = true
-			break
-		}
+	method := byte(AuthNone)
+	if validate != nil {
+		method = AuthUserPass
 	}
-	if !hasNoAuth {
+	if !slices.Contains(methods, method) {
 		_, _ = conn.Write([]byte{Version5, AuthNoAcceptable})
-		return "", errors.New("client does not support no-auth")
+		return Request{}, fmt.Errorf("%w (want method %#02x)", ErrNoAcceptableAuth, method)
 	}
 
-	if _, err := conn.Write([]byte{Version5, AuthNone}); err != nil {
-		return "", fmt.Errorf("write auth reply: %w", err)
+	if _, err := conn.Write([]byte{Version5, method}); err != nil {
+		return Request{}, fmt.Errorf("write auth reply: %w", err)
+	}
+	if validate != nil {
+		if err := userPassAuth(conn, validate); err != nil {
+			return Request{}, err
+		}
 	}
 
-	// CONNECT request: VER | CMD | RSV | ATYP | DST.ADDR | DST.PORT
+	// Request: VER | CMD | RSV | ATYP | DST.ADDR | DST.PORT
 	reqHeader := make([]byte, 4)
 	if _, err := io.ReadFull(conn, reqHeader); err != nil {
-		return "", fmt.Errorf("read request header: %w", err)
+		return Request{}, fmt.Errorf("read request header: %w", err)
 	}
 	if reqHeader[0] != Version5 {
-		return "", fmt.Errorf("unsupported SOCKS version in request: %d", reqHeader[0])
+		return Request{}, fmt.Errorf("unsupported SOCKS version in request: %d", reqHeader[0])
 	}
-	if reqHeader[1] != CmdConnect {
+	if reqHeader[1] != CmdConnect && reqHeader[1] != CmdUDPAssociate {
 		_ = SendReply(conn, RepCommandNotSupported, nil)
-		return "", fmt.Errorf("unsupported SOCKS command: %d", reqHeader[1])
+		return Request{}, fmt.Errorf("unsupported SOCKS command: %d", reqHeader[1])
 	}
 
+	target, err := readAddr(conn, reqHeader[3])
+	if errors.Is(err, errAddressType) {
+		_ = SendReply(conn, RepAddressNotSupported, nil)
+	}
+	if err != nil {
+		return Request{}, err
+	}
+	return Request{Cmd: reqHeader[1], Target: target}, nil
+}
+
+// readAddr reads a DST.ADDR of type atyp and the DST.PORT after it
+// from r and returns them as host:port.
+func readAddr(r io.Reader, atyp byte) (string, error) {
 	var host string
-	switch reqHeader[3] {
+	switch atyp {
 	case AddrIPv4:
 		addr := make([]byte, 4)
-		if _, err := io.ReadFull(conn, addr); err != nil {
+		if _, err := io.ReadFull(r, addr); err != nil {
 			return "", fmt.Errorf("read IPv4: %w", err)
 		}
 		host = net.IP(addr).String()
 	case AddrIPv6:
 		addr := make([]byte, 16)
-		if _, err := io.ReadFull(conn, addr); err != nil {
+		if _, err := io.ReadFull(r, addr); err != nil {
 			return "", fmt.Errorf("read IPv6: %w", err)
 		}
 		host = net.IP(addr).String()
 	case AddrDomain:
 		lenBuf := make([]byte, 1)
-		if _, err := io.ReadFull(conn, lenBuf); err != nil {
+		if _, err := io.ReadFull(r, lenBuf); err != nil {
 			return "", fmt.Errorf("read domain length: %w", err)
 		}
 		domain := make([]byte, lenBuf[0])
-		if _, err := io.ReadFull(conn, domain); err != nil {
+		if _, err := io.ReadFull(r, domain); err != nil {
 			return "", fmt.Errorf("read domain: %w", err)
 		}
 		host = string(domain)
 	default:
-		_ = SendReply(conn, RepAddressNotSupported, nil)
-		return "", fmt.Errorf("unsupported address type: %d", reqHeader[3])
+		return "", fmt.Errorf("%w: %d", errAddressType, atyp)
 	}
 
 	portBuf := make([]byte, 2)
-	if _, err := io.ReadFull(conn, portBuf); err != nil {
+	if _, err := io.ReadFull(r, portBuf); err != nil {
 		return "", fmt.Errorf("read port: %w", err)
 	}
 	port := int(binary.BigEndian.Uint16(portBuf))
@@ -125,6 +222,40 @@ func Handshake(conn io.ReadWriter) (string, error) {
 	return net.JoinHostPort(host, strconv.Itoa(port)), nil
 }
 
+// userPassAuth runs the RFC 1929 sub-negotiation:
+// VER | ULEN | UNAME | PLEN | PASSWD, answered with VER | STATUS.
+func userPassAuth(conn io.ReadWriter, validate CredentialValidator) error {
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return fmt.Errorf("read auth request: %w", err)
+	}
+	if header[0] != UserPassVersion {
+		_, _ = conn.Write([]byte{UserPassVersion, UserPassFailure})
+		return fmt.Errorf("unsupported username/password auth version: %d", header[0])
+	}
+	user := make([]byte, header[1])
+	if _, err := io.ReadFull(conn, user); err != nil {
+		return fmt.Errorf("read username: %w", err)
+	}
+	plen := make([]byte, 1)
+	if _, err := io.ReadFull(conn, plen); err != nil {
+		return fmt.Errorf("read password length: %w", err)
+	}
+	pass := make([]byte, plen[0])
+	if _, err := io.ReadFull(conn, pass); err != nil {
+		return fmt.Errorf("read password: %w", err)
+	}
+
+	if !validate(string(user), string(pass)) {
+		_, _ = conn.Write([]byte{UserPassVersion, UserPassFailure})
+		return fmt.Errorf("%w for user %q", ErrAuthFailed, user)
+	}
+	if _, err := conn.Write([]byte{UserPassVersion, UserPassSuccess}); err != nil {
+		return fmt.Errorf("write auth status: %w", err)
+	}
+	return nil
+}
+
 // SendReply sends a SOCKS5 reply to the client.
 func SendReply(conn io.Writer, rep byte, bindAddr *net.TCPAddr) error {
 	var addrBytes []byte
@@ -153,3 +284,35 @@ func SendReply(conn io.Writer, rep byte, bindAddr *net.TCPAddr) error {
 	_, err := conn.Write(reply)
 	return err
 }
+
+// ParseUDPDatagram parses a client's UDP ASSOCIATE datagram:
+// RSV | FRAG | ATYP | DST.ADDR | DST.PORT | DATA. It returns the
+// destination as host:port and the payload, which aliases b.
+// Fragmented datagrams are refused; RFC 1928 lets a server drop them.
+func ParseUDPDatagram(b []byte) (target string, payload []byte, err error) {
+	if len(b) < 4 {
+		return "", nil, errors.New("short UDP datagram")
+	}
+	if b[2] != 0 {
+		return "", nil, errFragment
+	}
+	r := bytes.NewReader(b[4:])
+	target, err = readAddr(r, b[3])
+	if err != nil {
+		return "", nil, err
+	}
+	return target, b[len(b)-r.Len():], nil
+}
+
+// AppendUDPHeader appends the UDP ASSOCIATE header for a datagram from
+// src to b, ready for the payload: RSV | FRAG | ATYP | ADDR | PORT.
+func AppendUDPHeader(b []byte, src netip.AddrPort) []byte {
+	ip := src.Addr().Unmap()
+	atyp := byte(AddrIPv6)
+	if ip.Is4() {
+		atyp = AddrIPv4
+	}
+	b = append(b, 0, 0, 0, atyp)
+	b = append(b, ip.AsSlice()...)
+	return binary.BigEndian.AppendUint16(b, src.Port())
+}
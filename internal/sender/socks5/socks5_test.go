@@ -3,7 +3,10 @@ package socks5
 import (
 	"bytes"
 	"encoding/binary"
+	"errors"
 	"net"
+	"net/netip"
+	"strings"
 	"testing"
 )
 
@@ -73,6 +76,159 @@ func TestHandshakeNoAuth(t *testing.T) {
 	}
 }
 
+func TestHandshakeAuth_UserPass(t *testing.T) {
+	var buf bytes.Buffer
+	// Client offers no-auth and username/password.
+	buf.Write([]byte{0x05, 0x02, 0x00, 0x02})
+	// RFC 1929: version 1, "alice", "s3cret".
+	buf.Write([]byte{0x01, 5})
+	buf.WriteString("alice")
+	buf.WriteByte(6)
+	buf.WriteString("s3cret")
+	buf.Write([]byte{0x05, 0x01, 0x00, 0x01})
+	buf.Write(net.IPv4(10, 0, 0, 5).To4())
+	binary.Write(&buf, binary.BigEndian, uint16(22))
+
+	var resp bytes.Buffer
+	rw := &readWriter{in: &buf, out: &resp}
+
+	target, err := HandshakeAuth(rw, StaticCredentials(map[string]string{"alice": "s3cret"}))
+	if err != nil {
+		t.Fatalf("handshake: %v", err)
+	}
+	if target != "10.0.0.5:22" {
+		t.Errorf("target = %q, want 10.0.0.5:22", target)
+	}
+	if got := resp.Bytes(); !bytes.Equal(got, []byte{0x05, AuthUserPass, UserPassVersion, UserPassSuccess}) {
+		t.Errorf("replies = %x, want 05020100", got)
+	}
+}
+
+func TestHandshakeAuth_WrongPassword(t *testing.T) {
+	var buf bytes.Buffer
+	buf.Write([]byte{0x05, 0x01, 0x02})
+	buf.Write([]byte{0x01, 5})
+	buf.WriteString("alice")
+	buf.WriteByte(5)
+	buf.WriteString("guess")
+
+	var resp bytes.Buffer
+	rw := &readWriter{in: &buf, out: &resp}
+
+	_, err := HandshakeAuth(rw, StaticCredentials(map[string]string{"alice": "s3cret"}))
+	if !errors.Is(err, ErrAuthFailed) {
+		t.Fatalf("err = %v, want ErrAuthFailed", err)
+	}
+	if strings.Contains(err.Error(), "guess") {
+		t.Errorf("error leaks the password: %v", err)
+	}
+	if got := resp.Bytes(); !bytes.Equal(got, []byte{0x05, AuthUserPass, UserPassVersion, UserPassFailure}) {
+		t.Errorf("replies = %x, want 05020101", got)
+	}
+}
+
+func TestHandshakeAuth_ClientOffersOnlyNoAuth(t *testing.T) {
+	var buf bytes.Buffer
+	buf.Write([]byte{0x05, 0x01, 0x00})
+
+	var resp bytes.Buffer
+	rw := &readWriter{in: &buf, out: &resp}
+
+	_, err := HandshakeAuth(rw, StaticCredentials(map[string]string{"alice": "s3cret"}))
+	if !errors.Is(err, ErrNoAcceptableAuth) {
+		t.Fatalf("err = %v, want ErrNoAcceptableAuth", err)
+	}
+	if got := resp.Bytes(); !bytes.Equal(got, []byte{0x05, AuthNoAcceptable}) {
+		t.Errorf("reply = %x, want 05ff", got)
+	}
+}
+
+func TestHandshakeRequest_UDPAssociate(t *testing.T) {
+	var buf bytes.Buffer
+	buf.Write([]byte{0x05, 0x01, 0x00})
+	// UDP ASSOCIATE from an address the client does not know yet.
+	buf.Write([]byte{0x05, CmdUDPAssociate, 0x00, AddrIPv4, 0, 0, 0, 0, 0, 0})
+
+	var resp bytes.Buffer
+	req, err := HandshakeRequest(&readWriter{in: &buf, out: &resp}, nil)
+	if err != nil {
+		t.Fatalf("handshake: %v", err)
+	}
+	if req.Cmd != CmdUDPAssociate || req.Target != "0.0.0.0:0" {
+		t.Errorf("request = %+v, want UDP ASSOCIATE from 0.0.0.0:0", req)
+	}
+}
+
+func TestHandshake_RefusesUDPAssociate(t *testing.T) {
+	var buf bytes.Buffer
+	buf.Write([]byte{0x05, 0x01, 0x00})
+	buf.Write([]byte{0x05, CmdUDPAssociate, 0x00, AddrIPv4, 0, 0, 0, 0, 0, 0})
+
+	var resp bytes.Buffer
+	if _, err := Handshake(&readWriter{in: &buf, out: &resp}); err == nil {
+		t.Fatal("Handshake accepted UDP ASSOCIATE")
+	}
+	if got := resp.Bytes(); len(got) < 4 || got[3] != RepCommandNotSupported {
+		t.Errorf("replies = %x, want a command-not-supported reply", got)
+	}
+}
+
+func TestUDPDatagram(t *testing.T) {
+	// A client datagram for dns.internal:53.
+	b := []byte{0, 0, 0, AddrDomain, 12}
+	b = append(b, "dns.internal"...)
+	b = append(b, 0, 53)
+	b = append(b, "query"...)
+	target, payload, err := ParseUDPDatagram(b)
+	if err != nil {
+		t.Fatalf("ParseUDPDatagram: %v", err)
+	}
+	if target != "dns.internal:53" || string(payload) != "query" {
+		t.Errorf("parsed %q %q, want dns.internal:53 query", target, payload)
+	}
+
+	for _, tc := range []struct {
+		name string
+		b    []byte
+	}{
+		{"short", []byte{0, 0, 0}},
+		{"fragment", []byte{0, 0, 1, AddrIPv4, 10, 0, 0, 1, 0, 53}},
+		{"truncated address", []byte{0, 0, 0, AddrIPv6, 0x20, 0x01}},
+		{"bad address type", []byte{0, 0, 0, 0x09, 1, 2, 3, 4}},
+	} {
+		if _, _, err := ParseUDPDatagram(tc.b); err == nil {
+			t.Errorf("%s: ParseUDPDatagram accepted %x", tc.name, tc.b)
+		}
+	}
+
+	// A reply from an IPv4 source parses back to the same address.
+	hdr := AppendUDPHeader(nil, netip.MustParseAddrPort("10.0.0.53:53"))
+	target, payload, err = ParseUDPDatagram(append(hdr, "answer"...))
+	if err != nil || target != "10.0.0.53:53" || string(payload) != "answer" {
+		t.Errorf("header round trip = %q %q %v, want 10.0.0.53:53 answer", target, payload, err)
+	}
+	if hdr := AppendUDPHeader(nil, netip.MustParseAddrPort("[2001:db8::1]:53")); hdr[3] != AddrIPv6 || len(hdr) != 22 {
+		t.Errorf("IPv6 header = %x, want ATYP 4 and 22 bytes", hdr)
+	}
+}
+
+func TestStaticCredentials(t *testing.T) {
+	v := StaticCredentials(map[string]string{"alice": "s3cret", "bob": ""})
+	for _, tc := range []struct {
+		user, pass string
+		want       bool
+	}{
+		{"alice", "s3cret", true},
+		{"alice", "s3cre", false},
+		{"bob", "", true},
+		{"mallory", "", false},
+	} {
+		if got := v(tc.user, tc.pass); got != tc.want {
+			t.Errorf("validate(%q, %q) = %v, want %v", tc.user, tc.pass, got, tc.want)
+		}
+	}
+}
+
 func TestSendReply(t *testing.T) {
 	var buf bytes.Buffer
 	addr := &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1080}
@@ -92,6 +248,19 @@ func TestSendReply(t *testing.T) {
 	}
 }
 
+func TestSendReply_IPv6(t *testing.T) {
+	var buf bytes.Buffer
+	addr := &net.TCPAddr{IP: net.ParseIP("2001:db8::4"), Port: 51234}
+	if err := SendReply(&buf, RepSuccess, addr); err != nil {
+		t.Fatal(err)
+	}
+	want := append([]byte{Version5, RepSuccess, 0x00, AddrIPv6}, addr.IP.To16()...)
+	want = binary.BigEndian.AppendUint16(want, 51234)
+	if !bytes.Equal(buf.Bytes(), want) {
+		t.Errorf("reply = %x, want %x", buf.Bytes(), want)
+	}
+}
+
 // readWriter combines a Reader and Writer for testing.
 type readWriter struct {
 	in  *bytes.Buffer
@@ -6,13 +6,16 @@ import (
 	"fmt"
 	"log/slog"
 	"net"
+	"net/netip"
 	"time"
 
+	"github.com/philsphicas/aztunnel/internal/allowlist"
 	"github.com/philsphicas/aztunnel/internal/idgen"
 	"github.com/philsphicas/aztunnel/internal/metrics"
 	"github.com/philsphicas/aztunnel/internal/protocol"
 	"github.com/philsphicas/aztunnel/internal/relay"
 	"github.com/philsphicas/aztunnel/internal/sender/socks5"
+	"github.com/philsphicas/aztunnel/internal/tracing"
 )
 
 // SOCKS5Config holds configuration for socks5-proxy mode.
@@ -22,20 +25,52 @@ type SOCKS5Config struct {
 	TokenProvider relay.TokenProvider
 	ClientOptions relay.ClientOptions
 	BindAddress   string // local address:port to listen on
+	Network       string // local listener network: tcp (default), tcp4, or tcp6
 	TCPKeepAlive  time.Duration
 	Logger        *slog.Logger
 	Metrics       *metrics.Metrics // optional; nil disables metrics
+	Tracer        *tracing.Tracer  // optional; nil disables tracing
 	// DialBudget bounds the per-connection relay dial + retry
 	// duration. Zero (the default) uses defaultDialBudget. See
 	// issue #94: without a per-connection bound, retry continues
 	// after the local app has closed its socket, producing ghost
 	// rendezvous when a listener eventually appears.
 	DialBudget time.Duration
+	// EnvelopeTimeout bounds the wait for the listener's response to
+	// the connect envelope. Zero uses defaultEnvelopeTimeout.
+	EnvelopeTimeout time.Duration
 	// Ready, if non-nil, is invoked once after the local bind succeeds
 	// and before the accept loop starts. Tests use this to learn the
 	// chosen bind address (when BindAddress is :0) without having to
 	// open a probe TCP connection. Production callers leave this nil.
 	Ready func(net.Addr)
+	// AllowList optionally restricts the targets SOCKS5 clients may
+	// request, using the listener's --allow syntax. A refused target
+	// gets REP 0x02 (connection not allowed) without a relay dial.
+	// Empty allows everything.
+	AllowList []string
+	// Auth, when non-nil, requires SOCKS5 username/password
+	// authentication (RFC 1929) checked by this validator. Clients
+	// offering only "no auth" are refused with AuthNoAcceptable.
+	Auth socks5.CredentialValidator
+	// BufferSize is the bridge copy buffer size; see
+	// relay.BridgeOptions.BufferSize. Zero uses the default.
+	BufferSize int
+
+	// IdleTimeout closes a bridged connection that has moved no data
+	// for this long; see relay.BridgeOptions.IdleTimeout. Zero
+	// disables it.
+	IdleTimeout time.Duration
+
+	// RateLimit caps each direction of a bridged connection in
+	// bytes/sec; see relay.BridgeOptions.RateLimit. Zero is unlimited.
+	RateLimit int64
+
+	// DataPingInterval is how long a bridged connection's WebSocket
+	// may go without sending before it is pinged; see
+	// relay.BridgeOptions.PingInterval. Zero selects the relay package
+	// default (30s); a negative value disables pings.
+	DataPingInterval time.Duration
 }
 
 // SOCKS5Proxy starts a local SOCKS5 proxy and forwards each connection
@@ -49,9 +84,9 @@ func SOCKS5Proxy(ctx context.Context, cfg SOCKS5Config) error {
 		cfg.TCPKeepAlive = 30 * time.Second
 	}
 
-	ln, err := net.Listen("tcp", cfg.BindAddress)
+	ln, err := listen(cfg.Network, cfg.BindAddress, cfg.Logger)
 	if err != nil {
-		return fmt.Errorf("listen %s: %w", cfg.BindAddress, err)
+		return err
 	}
 	defer ln.Close() //nolint:errcheck // best-effort cleanup
 	cfg.Logger.Info("socks5-proxy listening", "bind", ln.Addr())
@@ -86,7 +121,7 @@ func SOCKS5Proxy(ctx context.Context, cfg SOCKS5Config) error {
 	}
 }
 
-func handleSOCKS5(ctx context.Context, conn net.Conn, cfg SOCKS5Config) error {
+func handleSOCKS5(ctx context.Context, conn net.Conn, cfg SOCKS5Config) (err error) {
 	// Set TCP keepalive.
 	relay.SetTCPKeepAlive(conn, cfg.TCPKeepAlive)
 
@@ -96,7 +131,13 @@ func handleSOCKS5(ctx context.Context, conn net.Conn, cfg SOCKS5Config) error {
 	// Perform SOCKS5 handshake to get the target. No bridge_id is
 	// available yet — the per-bridge ID is minted after the target
 	// is known.
-	target, err := socks5.Handshake(conn)
+	req, err := socks5.HandshakeRequest(conn, cfg.Auth)
+	if errors.Is(err, socks5.ErrNoAcceptableAuth) || errors.Is(err, socks5.ErrAuthFailed) {
+		// The client has its answer; just close.
+		cfg.Logger.Warn("socks5 authentication failed", "error", err, "reason", metrics.SenderRejectAuthFailed)
+		cfg.Metrics.SenderRejection(metrics.ProxySOCKS5, metrics.SenderRejectAuthFailed)
+		return fmt.Errorf("socks5 handshake: %w", err)
+	}
 	if err != nil {
 		_ = socks5.SendReply(conn, socks5.RepGeneralFailure, nil)
 		err = fmt.Errorf("socks5 handshake: %w", err)
@@ -105,45 +146,82 @@ func handleSOCKS5(ctx context.Context, conn net.Conn, cfg SOCKS5Config) error {
 	}
 	_ = conn.SetReadDeadline(time.Time{}) // clear deadline
 
+	if req.Cmd == socks5.CmdUDPAssociate {
+		return handleSOCKS5UDP(ctx, conn, req.Target, cfg)
+	}
+	target := req.Target
+
+	// SOCKS5 replies carry only a status byte, so a policy refusal is
+	// explained in the log (target plus the rules it failed to match)
+	// and counted by reason.
+	if len(cfg.AllowList) > 0 && !allowlist.Allowed(target, cfg.AllowList) {
+		_ = socks5.SendReply(conn, socks5.RepConnectionNotAllowed, nil)
+		cfg.Logger.Warn("socks5 target not allowed", "target", target, "reason", metrics.SenderRejectNotAllowed, "allow", cfg.AllowList)
+		cfg.Metrics.SenderRejection(metrics.ProxySOCKS5, metrics.SenderRejectNotAllowed)
+		return fmt.Errorf("socks5 target %s not allowed", target)
+	}
+
 	// Mint the bridge_id once the target is known so the per-bridge
 	// logger carries both attributes from this point on.
 	bridgeID := idgen.NewBridgeID()
 	logger := cfg.Logger.With("bridge_id", bridgeID)
 	logger.Info("connection requested", "target", target)
 
+	span := cfg.Tracer.Start("aztunnel.sender.socks5", tracing.KindClient, "")
+	defer span.End()
+	span.SetAttr(tracing.AttrTarget, target)
+	span.SetAttr(tracing.AttrBridgeID, bridgeID)
+
+	// Track the connection from here so one that fails before its
+	// bridge still counts.
+	ctx = metrics.WithConnID(ctx, bridgeID)
+	ctx = metrics.WithConnLabels(ctx, connLabels(conn, cfg.Endpoint))
+	ctx = metrics.WithClientAddr(ctx, clientAddr(conn))
+	ctx, tracker := cfg.Metrics.TrackConnection(ctx, "sender", target)
+	defer func() { tracker.Finish(err) }()
+
 	// Per-connection dial budget caps retry duration so a stale
 	// local socket can't keep retrying indefinitely (issue #94).
 	// The bridge below intentionally uses the original ctx, not
 	// dialCtx, so a successful dial isn't torn down by cancelDial.
+	ctx, wire := withWireCounter(ctx, cfg.ClientOptions)
 	dialCtx, cancelDial := context.WithTimeout(ctx, dialBudget(cfg.DialBudget))
+	dialStart := time.Now()
 	ws, err := cfg.Metrics.InstrumentedDial(dialCtx, cfg.Endpoint, cfg.EntityPath, cfg.TokenProvider, cfg.ClientOptions, "sender", logger)
 	cancelDial()
+	span.SetAttr(tracing.AttrDialDuration, time.Since(dialStart))
 	if err != nil {
 		_ = socks5.SendReply(conn, socks5.RepGeneralFailure, nil)
 		logger.Warn("socks5 failed", "error", err)
+		span.SetError(err)
 		return err
 	}
 	defer func() { _ = ws.CloseNow() }()
 
 	// Send envelope and check response.
-	listenerID, err := sendEnvelopeAndCheck(ctx, ws, target, bridgeID)
+	resp, err := sendEnvelopeAndCheck(ctx, ws, target, bridgeID, envelopeMetadata(cfg.ClientOptions, span, conn.RemoteAddr()), cfg.EnvelopeTimeout)
 	if err != nil {
 		// logRejection already emits a contextual WARN with target,
 		// code, and listener_id; do not log "socks5 failed" on top
 		// of it (the doubled WARN obscures rather than clarifies).
-		logRejection(logger, target, listenerID, err)
+		logRejection(logger, target, resp.ListenerID, err)
 		_ = socks5.SendReply(conn, socks5RepForError(err), nil)
-		cfg.Metrics.ConnectionError("sender", metrics.ReasonEnvelopeError)
+		cfg.Metrics.ConnectionError("sender", envelopeReason(err))
+		span.SetAttr(tracing.AttrListenerID, resp.ListenerID)
+		span.SetError(err)
 		return err
 	}
-	logAccept(logger, target, listenerID)
+	logAccept(logger, target, resp.ListenerID)
+	span.SetAttr(tracing.AttrListenerID, resp.ListenerID)
+	logCompression(logger, wire, resp)
 
 	// Tell the SOCKS5 client we're connected.
-	tcpAddr, _ := conn.LocalAddr().(*net.TCPAddr)
-	_ = socks5.SendReply(conn, socks5.RepSuccess, tcpAddr)
+	_ = socks5.SendReply(conn, socks5.RepSuccess, socks5BoundAddr(resp, conn))
 
 	// Bridge data.
-	result, bridgeErr := cfg.Metrics.TrackedBridge(ctx, ws, conn, "sender", target)
+	bctx := relay.WithBridgeLogger(ctx, logger)
+	opts := relay.BridgeOptions{BufferSize: cfg.BufferSize, IdleTimeout: cfg.IdleTimeout, RateLimit: cfg.RateLimit, PingInterval: cfg.DataPingInterval}
+	result, bridgeErr := cfg.Metrics.TrackedBridgeWithOptions(bctx, ws, conn, "sender", target, opts)
 	attrs := []any{
 		"cause", result.EndCause,
 		"tcp_to_ws", result.Stats.TCPToWS,
@@ -158,6 +236,7 @@ func handleSOCKS5(ctx context.Context, conn net.Conn, cfg SOCKS5Config) error {
 	if code, ok := relay.WSCloseCode(bridgeErr); ok {
 		attrs = append(attrs, "close_code", code)
 	}
+	traceBridge(span, result, bridgeErr)
 	if bridgeErr != nil {
 		errAttrs := append([]any{"error", bridgeErr}, attrs...)
 		logger.Warn("socks5 failed", errAttrs...)
@@ -167,21 +246,45 @@ func handleSOCKS5(ctx context.Context, conn net.Conn, cfg SOCKS5Config) error {
 	return bridgeErr
 }
 
-// socks5RepForError maps a listener-side connect failure to the
-// matching SOCKS5 REP byte. Unclassified failures fall through to
-// RepHostUnreachable so the client still sees a non-success REP — the
-// historical default before per-code propagation existed.
+// socks5BoundAddr returns the BND.ADDR and BND.PORT for a success
+// reply: the listener's address on the target connection when the
+// response reports one, so clients that hand it to the target (FTP
+// PORT, some game protocols) get the address the target actually
+// sees. Older listeners do not report it, and then the reply carries
+// the proxy's own accept address as before.
+func socks5BoundAddr(resp protocol.ConnectResponse, conn net.Conn) *net.TCPAddr {
+	if ap, err := netip.ParseAddrPort(resp.LocalAddr); err == nil {
+		return net.TCPAddrFromAddrPort(netip.AddrPortFrom(ap.Addr().Unmap(), ap.Port()))
+	}
+	tcpAddr, _ := conn.LocalAddr().(*net.TCPAddr)
+	return tcpAddr
+}
+
+// socks5RepForError maps a failed envelope exchange to the SOCKS5 REP
+// byte that names the listener's reason, so clients like ssh -D and
+// curl can report it. Timeouts map to RepTTLExpired, the REP clients
+// render as a timeout. A rejection without a code (an older listener
+// or an unclassified dial error) keeps the historical
+// RepHostUnreachable; a failure with no listener answer at all, or a
+// code with no SOCKS5 equivalent, is RepGeneralFailure.
 func socks5RepForError(err error) byte {
 	var ce *connectRejected
-	if errors.As(err, &ce) {
-		switch ce.Code {
-		case protocol.CodeConnectionRefused:
-			return socks5.RepConnectionRefused
-		case protocol.CodeNetworkUnreachable:
-			return socks5.RepNetworkUnreachable
-		case protocol.CodeHostUnreachable, protocol.CodeTimeout:
-			return socks5.RepHostUnreachable
-		}
+	if !errors.As(err, &ce) {
+		return socks5.RepGeneralFailure
+	}
+	switch ce.Code {
+	case protocol.CodeConnectionRefused:
+		return socks5.RepConnectionRefused
+	case protocol.CodeNetworkUnreachable:
+		return socks5.RepNetworkUnreachable
+	case "", protocol.CodeHostUnreachable, protocol.CodeDNSNotFound, protocol.CodeUnknownRoute:
+		return socks5.RepHostUnreachable
+	case protocol.CodeTimeout, protocol.CodeDNSTimeout:
+		return socks5.RepTTLExpired
+	case protocol.CodeNotAllowed:
+		return socks5.RepConnectionNotAllowed
+	case protocol.CodeInvalidTarget:
+		return socks5.RepAddressNotSupported
 	}
-	return socks5.RepHostUnreachable
+	return socks5.RepGeneralFailure
 }
@@ -0,0 +1,192 @@
+package sender
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/philsphicas/aztunnel/internal/metrics"
+	"github.com/philsphicas/aztunnel/internal/protocol"
+	"github.com/philsphicas/aztunnel/internal/sender/socks5"
+)
+
+func TestHandleSOCKS5_AllowListRejects(t *testing.T) {
+	local, peer := tcpPairForBudget(t)
+	defer local.Close()
+	defer peer.Close()
+
+	var logs bytes.Buffer
+	m := metrics.New()
+	cfg := SOCKS5Config{
+		// No relay endpoint: a rejected target must never dial.
+		Logger:    slog.New(slog.NewTextHandler(&logs, nil)),
+		Metrics:   m,
+		AllowList: []string{"192.168.0.0/16:*"},
+	}
+	errCh := make(chan error, 1)
+	go func() { errCh <- handleSOCKS5(context.Background(), local, cfg) }()
+
+	_ = peer.SetDeadline(time.Now().Add(5 * time.Second))
+	// Greeting (no-auth), then CONNECT 10.0.0.5:22.
+	if _, err := peer.Write([]byte{0x05, 0x01, 0x00}); err != nil {
+		t.Fatalf("write greeting: %v", err)
+	}
+	auth := make([]byte, 2)
+	if _, err := io.ReadFull(peer, auth); err != nil {
+		t.Fatalf("read auth reply: %v", err)
+	}
+	if _, err := peer.Write([]byte{0x05, 0x01, 0x00, 0x01, 10, 0, 0, 5, 0, 22}); err != nil {
+		t.Fatalf("write request: %v", err)
+	}
+	reply := make([]byte, 10)
+	if _, err := io.ReadFull(peer, reply); err != nil {
+		t.Fatalf("read reply: %v", err)
+	}
+	if reply[1] != socks5.RepConnectionNotAllowed {
+		t.Errorf("REP = %#x, want %#x", reply[1], socks5.RepConnectionNotAllowed)
+	}
+
+	select {
+	case err := <-errCh:
+		if err == nil || !strings.Contains(err.Error(), "not allowed") {
+			t.Errorf("handleSOCKS5 err = %v, want not allowed", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("handleSOCKS5 did not return")
+	}
+
+	out := logs.String()
+	for _, want := range []string{"socks5 target not allowed", "target=10.0.0.5:22", "reason=not_allowed", "192.168.0.0/16:*"} {
+		if !strings.Contains(out, want) {
+			t.Errorf("log missing %q: %s", want, out)
+		}
+	}
+
+	if got := senderRejections(t, m, metrics.ProxySOCKS5, metrics.SenderRejectNotAllowed); got != 1 {
+		t.Errorf("sender_rejections_total{proxy=socks5,reason=not_allowed} = %v, want 1", got)
+	}
+}
+
+// senderRejections returns aztunnel_sender_rejections_total for proxy
+// and reason, or 0 if it was never recorded.
+func senderRejections(t *testing.T, m *metrics.Metrics, proxy, reason string) float64 {
+	t.Helper()
+	fams, err := m.Registry.Gather()
+	if err != nil {
+		t.Fatalf("gather: %v", err)
+	}
+	for _, f := range fams {
+		if f.GetName() != "aztunnel_sender_rejections_total" {
+			continue
+		}
+		for _, mt := range f.GetMetric() {
+			labels := map[string]string{}
+			for _, l := range mt.GetLabel() {
+				labels[l.GetName()] = l.GetValue()
+			}
+			if labels["proxy"] == proxy && labels["reason"] == reason {
+				return mt.GetCounter().GetValue()
+			}
+		}
+	}
+	return 0
+}
+
+func TestHandleSOCKS5_AuthRequired(t *testing.T) {
+	local, peer := tcpPairForBudget(t)
+	defer local.Close()
+	defer peer.Close()
+
+	m := metrics.New()
+	cfg := SOCKS5Config{
+		Logger:  slog.New(slog.NewTextHandler(io.Discard, nil)),
+		Metrics: m,
+		Auth:    socks5.StaticCredentials(map[string]string{"alice": "s3cret"}),
+	}
+	errCh := make(chan error, 1)
+	go func() { errCh <- handleSOCKS5(context.Background(), local, cfg) }()
+
+	_ = peer.SetDeadline(time.Now().Add(5 * time.Second))
+	// Offer only no-auth: the proxy must refuse the method and close
+	// without a CONNECT reply.
+	if _, err := peer.Write([]byte{0x05, 0x01, 0x00}); err != nil {
+		t.Fatalf("write greeting: %v", err)
+	}
+	select {
+	case err := <-errCh:
+		if !errors.Is(err, socks5.ErrNoAcceptableAuth) {
+			t.Errorf("handleSOCKS5 err = %v, want ErrNoAcceptableAuth", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("handleSOCKS5 did not return")
+	}
+	// SOCKS5Proxy closes the connection once handleSOCKS5 returns.
+	_ = local.Close()
+	reply, err := io.ReadAll(peer)
+	if err != nil {
+		t.Fatalf("read reply: %v", err)
+	}
+	if !bytes.Equal(reply, []byte{0x05, socks5.AuthNoAcceptable}) {
+		t.Errorf("reply = %x, want only 05ff", reply)
+	}
+}
+
+func TestSOCKS5RepForError(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		err  error
+		want byte
+	}{
+		{"refused", &connectRejected{Code: protocol.CodeConnectionRefused}, socks5.RepConnectionRefused},
+		{"network unreachable", &connectRejected{Code: protocol.CodeNetworkUnreachable}, socks5.RepNetworkUnreachable},
+		{"host unreachable", &connectRejected{Code: protocol.CodeHostUnreachable}, socks5.RepHostUnreachable},
+		{"dns not found", &connectRejected{Code: protocol.CodeDNSNotFound}, socks5.RepHostUnreachable},
+		{"unknown route", &connectRejected{Code: protocol.CodeUnknownRoute}, socks5.RepHostUnreachable},
+		{"timeout", &connectRejected{Code: protocol.CodeTimeout}, socks5.RepTTLExpired},
+		{"dns timeout", &connectRejected{Code: protocol.CodeDNSTimeout}, socks5.RepTTLExpired},
+		{"not allowed", &connectRejected{Code: protocol.CodeNotAllowed}, socks5.RepConnectionNotAllowed},
+		{"invalid target", &connectRejected{Code: protocol.CodeInvalidTarget}, socks5.RepAddressNotSupported},
+		{"no code", &connectRejected{Message: "connection failed"}, socks5.RepHostUnreachable},
+		{"unmapped code", &connectRejected{Code: protocol.CodeQuiescing}, socks5.RepGeneralFailure},
+		{"wrapped", fmt.Errorf("envelope: %w", &connectRejected{Code: protocol.CodeConnectionRefused}), socks5.RepConnectionRefused},
+		{"no listener answer", errors.New("read response: EOF"), socks5.RepGeneralFailure},
+	} {
+		if got := socks5RepForError(tc.err); got != tc.want {
+			t.Errorf("%s: REP = %#x, want %#x", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestSOCKS5BoundAddr(t *testing.T) {
+	local, peer := tcpPairForBudget(t)
+	defer local.Close()
+	defer peer.Close()
+
+	for _, tc := range []struct {
+		name, localAddr string
+		want            string
+		wantATYP        byte
+	}{
+		{"ipv4", "10.0.0.4:51234", "10.0.0.4:51234", socks5.AddrIPv4},
+		{"ipv6", "[2001:db8::4]:51234", "[2001:db8::4]:51234", socks5.AddrIPv6},
+		{"mapped ipv4", "[::ffff:10.0.0.4]:51234", "10.0.0.4:51234", socks5.AddrIPv4},
+		{"older listener", "", local.LocalAddr().String(), socks5.AddrIPv4},
+		{"garbage", "not-an-addr", local.LocalAddr().String(), socks5.AddrIPv4},
+	} {
+		addr := socks5BoundAddr(protocol.ConnectResponse{LocalAddr: tc.localAddr}, local)
+		if addr.String() != tc.want {
+			t.Errorf("%s: bound addr = %s, want %s", tc.name, addr, tc.want)
+		}
+		var reply bytes.Buffer
+		_ = socks5.SendReply(&reply, socks5.RepSuccess, addr)
+		if got := reply.Bytes()[3]; got != tc.wantATYP {
+			t.Errorf("%s: reply ATYP = %d, want %d", tc.name, got, tc.wantATYP)
+		}
+	}
+}
@@ -0,0 +1,226 @@
+package sender
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/netip"
+	"sync/atomic"
+	"time"
+
+	"github.com/coder/websocket"
+	"github.com/philsphicas/aztunnel/internal/allowlist"
+	"github.com/philsphicas/aztunnel/internal/idgen"
+	"github.com/philsphicas/aztunnel/internal/protocol"
+	"github.com/philsphicas/aztunnel/internal/sender/socks5"
+	"github.com/philsphicas/aztunnel/internal/tracing"
+)
+
+// handleSOCKS5UDP serves a UDP ASSOCIATE request on conn, the
+// client's SOCKS5 control connection. It opens a local UDP socket on
+// the address the client reached the proxy at, starts a
+// protocol.ModeUDP session through the relay, and tells the client
+// where to send its datagrams. The association lasts as long as conn,
+// as RFC 1928 requires. from is the request's DST.ADDR:DST.PORT, the
+// address the client will send from; a zero port means "not known
+// yet", and the first datagram from the client's IP fixes it.
+func handleSOCKS5UDP(ctx context.Context, conn net.Conn, from string, cfg SOCKS5Config) error {
+	local, ok := conn.LocalAddr().(*net.TCPAddr)
+	peer, _ := conn.RemoteAddr().(*net.TCPAddr)
+	if !ok || peer == nil {
+		// A unix-socket client has no IP to associate datagrams with.
+		_ = socks5.SendReply(conn, socks5.RepCommandNotSupported, nil)
+		cfg.Logger.Warn("socks5 udp associate needs a TCP client", "bind", conn.LocalAddr())
+		return errors.New("socks5 udp associate needs a TCP client")
+	}
+	pc, err := net.ListenUDP("udp", &net.UDPAddr{IP: local.IP})
+	if err != nil {
+		_ = socks5.SendReply(conn, socks5.RepGeneralFailure, nil)
+		err = fmt.Errorf("socks5 udp socket: %w", err)
+		cfg.Logger.Warn("socks5 failed", "error", err)
+		return err
+	}
+	defer pc.Close() //nolint:errcheck // best-effort cleanup
+
+	bridgeID := idgen.NewBridgeID()
+	logger := cfg.Logger.With("bridge_id", bridgeID)
+	logger.Info("udp association requested", "client", peer)
+
+	span := cfg.Tracer.Start("aztunnel.sender.socks5_udp", tracing.KindClient, "")
+	defer span.End()
+	span.SetAttr(tracing.AttrBridgeID, bridgeID)
+
+	// As in handleSOCKS5, the session uses ctx, not dialCtx.
+	ctx, wire := withWireCounter(ctx, cfg.ClientOptions)
+	dialCtx, cancelDial := context.WithTimeout(ctx, dialBudget(cfg.DialBudget))
+	dialStart := time.Now()
+	ws, err := cfg.Metrics.InstrumentedDial(dialCtx, cfg.Endpoint, cfg.EntityPath, cfg.TokenProvider, cfg.ClientOptions, "sender", logger)
+	cancelDial()
+	span.SetAttr(tracing.AttrDialDuration, time.Since(dialStart))
+	if err != nil {
+		_ = socks5.SendReply(conn, socks5.RepGeneralFailure, nil)
+		logger.Warn("socks5 failed", "error", err)
+		span.SetError(err)
+		return err
+	}
+	defer func() { _ = ws.CloseNow() }()
+
+	env := protocol.ConnectEnvelope{
+		Version:  protocol.CurrentVersion,
+		Mode:     protocol.ModeUDP,
+		Metadata: envelopeMetadata(cfg.ClientOptions, span, peer),
+		BridgeID: bridgeID,
+	}
+	resp, err := sendEnvelope(ctx, ws, env, cfg.EnvelopeTimeout)
+	if err != nil {
+		logRejection(logger, "udp", resp.ListenerID, err)
+		_ = socks5.SendReply(conn, socks5RepForError(err), nil)
+		cfg.Metrics.ConnectionError("sender", envelopeReason(err))
+		span.SetAttr(tracing.AttrListenerID, resp.ListenerID)
+		span.SetError(err)
+		return err
+	}
+	logAccept(logger, "udp", resp.ListenerID)
+	span.SetAttr(tracing.AttrListenerID, resp.ListenerID)
+	logCompression(logger, wire, resp)
+	ws.SetReadLimit(protocol.MaxDatagramFrame)
+
+	udpAddr := pc.LocalAddr().(*net.UDPAddr)
+	if err := socks5.SendReply(conn, socks5.RepSuccess, &net.TCPAddr{IP: udpAddr.IP, Port: udpAddr.Port}); err != nil {
+		err = fmt.Errorf("socks5 reply: %w", err)
+		logger.Warn("socks5 failed", "error", err)
+		span.SetError(err)
+		return err
+	}
+
+	a := &udpAssociation{pc: pc, ws: ws, allow: cfg.AllowList, logger: logger}
+	a.clientIP, _ = netip.AddrFromSlice(peer.IP)
+	a.clientIP = a.clientIP.Unmap()
+	if hint, err := netip.ParseAddrPort(from); err == nil && hint.Port() != 0 {
+		client := netip.AddrPortFrom(a.clientIP, hint.Port())
+		a.client.Store(&client)
+	}
+	a.run(ctx, conn)
+	logger.Debug("udp association ended", "datagrams_out", a.out.Load(), "datagrams_in", a.in.Load(), "dropped", a.dropped.Load())
+	return nil
+}
+
+// udpAssociation relays one SOCKS5 client's datagrams over a ModeUDP
+// WebSocket.
+type udpAssociation struct {
+	pc       *net.UDPConn
+	ws       *websocket.Conn
+	allow    []string
+	logger   *slog.Logger
+	clientIP netip.Addr
+	client   atomic.Pointer[netip.AddrPort] // nil until known
+
+	out, in, dropped atomic.Int64
+}
+
+// run relays datagrams until the control connection closes, the
+// WebSocket ends, or ctx is done.
+func (a *udpAssociation) run(ctx context.Context, control net.Conn) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	stop := context.AfterFunc(ctx, func() {
+		_ = a.pc.Close()
+		_ = control.Close()
+	})
+	defer stop()
+
+	done := make(chan struct{}, 2)
+	go func() {
+		defer func() { done <- struct{}{} }()
+		defer cancel()
+		// The client sends nothing more on the control connection;
+		// it closing ends the association.
+		_, _ = io.Copy(io.Discard, control)
+	}()
+	go func() {
+		defer func() { done <- struct{}{} }()
+		defer cancel()
+		a.fromClient(ctx)
+	}()
+	a.toClient(ctx)
+	cancel()
+	<-done
+	<-done
+}
+
+// fromClient frames each datagram the client sends for the relay.
+// Datagrams from any other host, fragmented ones, and ones the
+// allowlist refuses are dropped.
+func (a *udpAssociation) fromClient(ctx context.Context) {
+	buf := make([]byte, 65535)
+	var frame []byte
+	for {
+		n, from, err := a.pc.ReadFromUDPAddrPort(buf)
+		if err != nil {
+			return
+		}
+		from = netip.AddrPortFrom(from.Addr().Unmap(), from.Port())
+		if from.Addr() != a.clientIP {
+			a.dropped.Add(1)
+			continue
+		}
+		if client := a.client.Load(); client == nil {
+			a.client.Store(&from)
+		} else if *client != from {
+			a.dropped.Add(1)
+			continue
+		}
+		target, payload, err := socks5.ParseUDPDatagram(buf[:n])
+		if err != nil {
+			a.logger.Debug("dropping socks5 datagram", "error", err)
+			a.dropped.Add(1)
+			continue
+		}
+		if len(a.allow) > 0 && !allowlist.Allowed(target, a.allow) {
+			a.logger.Debug("socks5 udp target not allowed", "target", target)
+			a.dropped.Add(1)
+			continue
+		}
+		frame = protocol.AppendDatagram(frame[:0], target, payload)
+		if err := a.ws.Write(ctx, websocket.MessageBinary, frame); err != nil {
+			return
+		}
+		a.out.Add(1)
+	}
+}
+
+// toClient sends each datagram the listener relays back to the client
+// with the SOCKS5 UDP header naming its source.
+func (a *udpAssociation) toClient(ctx context.Context) {
+	var dgram []byte
+	for {
+		typ, frame, err := a.ws.Read(ctx)
+		if err != nil {
+			return
+		}
+		if typ != websocket.MessageBinary {
+			continue
+		}
+		src, payload, err := protocol.ParseDatagram(frame)
+		if err != nil {
+			a.dropped.Add(1)
+			continue
+		}
+		srcAddr, err := netip.ParseAddrPort(src)
+		client := a.client.Load()
+		if err != nil || client == nil {
+			a.dropped.Add(1)
+			continue
+		}
+		dgram = append(socks5.AppendUDPHeader(dgram[:0], srcAddr), payload...)
+		if _, err := a.pc.WriteToUDPAddrPort(dgram, *client); err != nil {
+			a.logger.Debug("udp send to client failed", "error", err)
+			a.dropped.Add(1)
+			continue
+		}
+		a.in.Add(1)
+	}
+}
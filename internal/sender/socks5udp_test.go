@@ -0,0 +1,143 @@
+package sender
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/coder/websocket"
+	"github.com/philsphicas/aztunnel/internal/protocol"
+	"github.com/philsphicas/aztunnel/internal/relay"
+	"github.com/philsphicas/aztunnel/internal/sender/socks5"
+)
+
+func TestHandleSOCKS5_UDPAssociate(t *testing.T) {
+	// The fake listener accepts the UDP session and answers the first
+	// datagram as if from a DNS server.
+	gotFrame := make(chan string, 1)
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ws, err := websocket.Accept(w, r, nil)
+		if err != nil {
+			t.Errorf("server: websocket.Accept: %v", err)
+			return
+		}
+		defer ws.CloseNow()
+		_, data, err := ws.Read(r.Context())
+		if err != nil {
+			t.Errorf("server: read envelope: %v", err)
+			return
+		}
+		var env protocol.ConnectEnvelope
+		if err := json.Unmarshal(data, &env); err != nil || env.Mode != protocol.ModeUDP || env.Target != "" {
+			t.Errorf("server: envelope = %s (%v), want a udp session without target", data, err)
+			return
+		}
+		resp, _ := json.Marshal(protocol.ConnectResponse{Version: protocol.CurrentVersion, OK: true})
+		if err := ws.Write(r.Context(), websocket.MessageText, resp); err != nil {
+			t.Errorf("server: write response: %v", err)
+			return
+		}
+		_, frame, err := ws.Read(r.Context())
+		if err != nil {
+			t.Errorf("server: read datagram: %v", err)
+			return
+		}
+		dst, payload, _ := protocol.ParseDatagram(frame)
+		gotFrame <- dst + " " + string(payload)
+		_ = ws.Write(r.Context(), websocket.MessageBinary, protocol.AppendDatagram(nil, "10.0.0.53:53", []byte("answer")))
+		_, _, _ = ws.Read(r.Context())
+	}))
+	defer srv.Close()
+	u, _ := url.Parse(srv.URL)
+
+	local, peer := tcpPairForBudget(t)
+	defer peer.Close() //nolint:errcheck // best-effort cleanup
+	cfg := SOCKS5Config{
+		Endpoint:      u.Host,
+		EntityPath:    "socks",
+		TokenProvider: budgetTokenProvider{},
+		ClientOptions: relay.ClientOptions{TLSConfig: srv.Client().Transport.(*http.Transport).TLSClientConfig},
+		Logger:        slog.New(slog.NewTextHandler(io.Discard, nil)),
+		DialBudget:    5 * time.Second,
+		AllowList:     []string{"dns.internal:53"},
+	}
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- handleSOCKS5(context.Background(), local, cfg)
+		_ = local.Close()
+	}()
+
+	_ = peer.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := peer.Write([]byte{socks5.Version5, 1, socks5.AuthNone}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadFull(peer, make([]byte, 2)); err != nil {
+		t.Fatalf("read auth reply: %v", err)
+	}
+	if _, err := peer.Write([]byte{socks5.Version5, socks5.CmdUDPAssociate, 0, socks5.AddrIPv4, 0, 0, 0, 0, 0, 0}); err != nil {
+		t.Fatal(err)
+	}
+	reply := make([]byte, 10)
+	if _, err := io.ReadFull(peer, reply); err != nil {
+		t.Fatalf("read reply: %v", err)
+	}
+	if reply[1] != socks5.RepSuccess || reply[3] != socks5.AddrIPv4 {
+		t.Fatalf("reply = %x, want success with an IPv4 relay address", reply)
+	}
+	relayAddr := netip.AddrPortFrom(netip.AddrFrom4([4]byte(reply[4:8])), binary.BigEndian.Uint16(reply[8:]))
+
+	client, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close() //nolint:errcheck // best-effort cleanup
+	_ = client.SetDeadline(time.Now().Add(5 * time.Second))
+
+	// The allowlist drops the first datagram; the second goes through.
+	for _, dst := range []string{"other.internal", "dns.internal"} {
+		dg := append([]byte{0, 0, 0, socks5.AddrDomain, byte(len(dst))}, dst...)
+		dg = append(dg, 0, 53)
+		dg = append(dg, "query"...)
+		if _, err := client.WriteToUDPAddrPort(dg, relayAddr); err != nil {
+			t.Fatal(err)
+		}
+	}
+	select {
+	case got := <-gotFrame:
+		if got != "dns.internal:53 query" {
+			t.Errorf("relay got %q, want dns.internal:53 query", got)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no datagram reached the relay")
+	}
+
+	buf := make([]byte, 1500)
+	n, err := client.Read(buf)
+	if err != nil {
+		t.Fatalf("read answer: %v", err)
+	}
+	src, payload, err := socks5.ParseUDPDatagram(buf[:n])
+	if err != nil || src != "10.0.0.53:53" || string(payload) != "answer" {
+		t.Errorf("answer = %q from %s (%v), want answer from 10.0.0.53:53", payload, src, err)
+	}
+
+	// Closing the control connection ends the association.
+	_ = peer.Close()
+	select {
+	case err := <-errCh:
+		if err != nil {
+			t.Errorf("handleSOCKS5 = %v, want nil", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("association outlived its control connection")
+	}
+}
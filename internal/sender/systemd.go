@@ -0,0 +1,80 @@
+package sender
+
+import (
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"strconv"
+)
+
+// systemdListenFDsStart is the first inherited descriptor under the
+// sd_listen_fds(3) convention (SD_LISTEN_FDS_START). A variable so
+// tests can point it at a descriptor they opened themselves.
+var systemdListenFDsStart = 3
+
+// listen returns the local listener for the sender proxy modes. When
+// AZTUNNEL_SYSTEMD_SOCKET=1 and systemd passed a socket
+// (LISTEN_PID matches this process and LISTEN_FDS >= 1), the first
+// inherited descriptor is wrapped with net.FileListener and
+// bindAddress and network are ignored; this allows on-demand
+// activation and privileged ports without running as root. Otherwise
+// it falls back to net.Listen on bindAddress with network ("tcp",
+// "tcp4", or "tcp6"; empty means "tcp"), or to a Unix domain socket
+// when bindAddress has the form unix:/path (see listenUnix).
+func listen(network, bindAddress string, logger *slog.Logger) (net.Listener, error) {
+	if os.Getenv("AZTUNNEL_SYSTEMD_SOCKET") == "1" {
+		ln, ok, err := systemdListener(logger)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			return ln, nil
+		}
+		logger.Warn("AZTUNNEL_SYSTEMD_SOCKET=1 but no socket was passed; binding directly", "bind", bindAddress)
+	}
+	if path, ok := unixSocketPath(bindAddress); ok {
+		return listenUnix(path)
+	}
+	if network == "" {
+		network = "tcp"
+	}
+	ln, err := net.Listen(network, bindAddress)
+	if err != nil {
+		return nil, fmt.Errorf("listen %s: %w", bindAddress, err)
+	}
+	return ln, nil
+}
+
+// systemdListener wraps the first socket passed by systemd. ok is
+// false when the environment does not describe a socket for this
+// process. The LISTEN_* variables are unset once consumed, as
+// sd_listen_fds(1) does, so child processes do not inherit them.
+func systemdListener(logger *slog.Logger) (ln net.Listener, ok bool, err error) {
+	pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	if err != nil || pid != os.Getpid() {
+		return nil, false, nil
+	}
+	n, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || n < 1 {
+		return nil, false, nil
+	}
+	os.Unsetenv("LISTEN_PID")     //nolint:errcheck // best-effort cleanup
+	os.Unsetenv("LISTEN_FDS")     //nolint:errcheck // best-effort cleanup
+	os.Unsetenv("LISTEN_FDNAMES") //nolint:errcheck // best-effort cleanup
+
+	if n > 1 {
+		logger.Warn("systemd passed multiple sockets; using the first", "listen_fds", n)
+	}
+	f := os.NewFile(uintptr(systemdListenFDsStart), "systemd-socket")
+	if f == nil {
+		return nil, false, fmt.Errorf("systemd socket fd %d is not valid", systemdListenFDsStart)
+	}
+	defer f.Close() //nolint:errcheck // FileListener holds its own dup
+	ln, err = net.FileListener(f)
+	if err != nil {
+		return nil, false, fmt.Errorf("systemd socket fd %d: %w", systemdListenFDsStart, err)
+	}
+	logger.Info("using systemd socket", "fd", systemdListenFDsStart, "bind", ln.Addr())
+	return ln, true, nil
+}
@@ -0,0 +1,111 @@
+//go:build unix
+
+package sender
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"strconv"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// inheritSocket opens a TCP listener and returns a raw duplicate of
+// its descriptor, standing in for the socket systemd would pass.
+func inheritSocket(t *testing.T) (fd int, addr net.Addr) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer ln.Close() //nolint:errcheck // best-effort cleanup
+	f, err := ln.(*net.TCPListener).File()
+	if err != nil {
+		t.Fatalf("File: %v", err)
+	}
+	defer f.Close() //nolint:errcheck // best-effort cleanup
+	fd, err = syscall.Dup(int(f.Fd()))
+	if err != nil {
+		t.Fatalf("dup: %v", err)
+	}
+	return fd, ln.Addr()
+}
+
+func TestPortForward_UsesSystemdSocket(t *testing.T) {
+	fd, addr := inheritSocket(t)
+	orig := systemdListenFDsStart
+	systemdListenFDsStart = fd
+	t.Cleanup(func() { systemdListenFDsStart = orig })
+	t.Setenv("AZTUNNEL_SYSTEMD_SOCKET", "1")
+	t.Setenv("LISTEN_PID", strconv.Itoa(os.Getpid()))
+	t.Setenv("LISTEN_FDS", "1")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ready := make(chan net.Addr, 1)
+	done := make(chan error, 1)
+	go func() {
+		done <- PortForward(ctx, PortForwardConfig{
+			Target: "example:22",
+			// An address we could not bind: proves it was not used.
+			BindAddress: "192.0.2.1:1",
+			Logger:      slog.New(slog.NewTextHandler(io.Discard, nil)),
+			Ready:       func(a net.Addr) { ready <- a },
+		})
+	}()
+
+	select {
+	case got := <-ready:
+		if got.String() != addr.String() {
+			t.Errorf("listening on %s, want inherited %s", got, addr)
+		}
+	case err := <-done:
+		t.Fatalf("PortForward returned early: %v", err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for Ready")
+	}
+	if v, ok := os.LookupEnv("LISTEN_FDS"); ok {
+		t.Errorf("LISTEN_FDS = %q after use, want unset", v)
+	}
+
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("PortForward did not return after cancel")
+	}
+}
+
+func TestListen_SystemdSocketIgnoredWithoutOptIn(t *testing.T) {
+	t.Setenv("AZTUNNEL_SYSTEMD_SOCKET", "")
+	t.Setenv("LISTEN_PID", strconv.Itoa(os.Getpid()))
+	t.Setenv("LISTEN_FDS", "1")
+
+	ln, err := listen("", "127.0.0.1:0", slog.New(slog.NewTextHandler(io.Discard, nil)))
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer ln.Close() //nolint:errcheck // best-effort cleanup
+	if os.Getenv("LISTEN_FDS") != "1" {
+		t.Error("LISTEN_FDS consumed without AZTUNNEL_SYSTEMD_SOCKET=1")
+	}
+}
+
+func TestListen_SystemdSocketOtherPID(t *testing.T) {
+	t.Setenv("AZTUNNEL_SYSTEMD_SOCKET", "1")
+	t.Setenv("LISTEN_PID", strconv.Itoa(os.Getpid()+1))
+	t.Setenv("LISTEN_FDS", "1")
+
+	ln, err := listen("", "127.0.0.1:0", slog.New(slog.NewTextHandler(io.Discard, nil)))
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer ln.Close() //nolint:errcheck // best-effort cleanup
+	if host, _, _ := net.SplitHostPort(ln.Addr().String()); host != "127.0.0.1" {
+		t.Errorf("bound %s, want fallback to 127.0.0.1", ln.Addr())
+	}
+}
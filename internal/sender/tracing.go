@@ -0,0 +1,48 @@
+package sender
+
+import (
+	"net"
+
+	"github.com/philsphicas/aztunnel/internal/protocol"
+	"github.com/philsphicas/aztunnel/internal/relay"
+	"github.com/philsphicas/aztunnel/internal/tracing"
+)
+
+// envelopeMetadata returns the connect envelope Metadata: the
+// compression offer from compressionMetadata, span's traceparent so
+// the listener's span joins this connection's trace, and client's
+// address when it is a TCP client, for a listener's --proxy-protocol.
+// It is nil when there is none of these.
+func envelopeMetadata(opts relay.ClientOptions, span *tracing.Span, client net.Addr) map[string]string {
+	meta := compressionMetadata(opts)
+	set := func(k, v string) {
+		if meta == nil {
+			meta = make(map[string]string, 2)
+		}
+		meta[k] = v
+	}
+	if tp := span.Traceparent(); tp != "" {
+		set(protocol.MetaTraceparent, tp)
+	}
+	if ta, ok := client.(*net.TCPAddr); ok {
+		set(protocol.MetaClientAddr, ta.String())
+	}
+	return meta
+}
+
+// clientAddr returns conn's TCP peer address for the access log, or ""
+// for a client with none, like a unix-socket one.
+func clientAddr(conn net.Conn) string {
+	if ta, ok := conn.RemoteAddr().(*net.TCPAddr); ok {
+		return ta.String()
+	}
+	return ""
+}
+
+// traceBridge records a finished bridge on span.
+func traceBridge(span *tracing.Span, result relay.BridgeResult, err error) {
+	span.SetAttr(tracing.AttrTCPToWS, result.Stats.TCPToWS)
+	span.SetAttr(tracing.AttrWSToTCP, result.Stats.WSToTCP)
+	span.SetAttr(tracing.AttrEndCause, result.EndCause)
+	span.SetError(err)
+}
@@ -0,0 +1,319 @@
+package tracing
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Export tuning. Spans are batched so a busy listener makes one
+// collector request every exportInterval rather than one per
+// connection; a full queue drops spans instead of blocking bridges.
+const (
+	queueSize      = 2048
+	maxBatch       = 512
+	exportInterval = 5 * time.Second
+	exportTimeout  = 10 * time.Second
+)
+
+// Config configures a Tracer.
+type Config struct {
+	// Endpoint is the collector's OTLP/HTTP base URL, for example
+	// http://localhost:4318. Spans are posted to its /v1/traces path
+	// unless the URL already ends in /v1/traces.
+	Endpoint string
+	// ServiceName and ServiceVersion become the service.name and
+	// service.version resource attributes.
+	ServiceName    string
+	ServiceVersion string
+	Logger         *slog.Logger
+	// ExportInterval is how often queued spans are exported. Zero uses
+	// exportInterval.
+	ExportInterval time.Duration
+	// Client sends the export requests. Nil uses a client with
+	// exportTimeout.
+	Client *http.Client
+}
+
+// Tracer creates spans and exports the ended ones in the background.
+type Tracer struct {
+	url      string
+	addr     string // url with any userinfo redacted, for errors
+	resource []attribute
+	client   *http.Client
+	logger   *slog.Logger
+	interval time.Duration
+
+	mu     sync.RWMutex // guards closed against enqueue
+	closed bool
+	queue  chan *Span
+	done   chan struct{}
+}
+
+// New returns a Tracer exporting to cfg.Endpoint and starts its export
+// loop. Call Close to flush the last batch.
+func New(cfg Config) (*Tracer, error) {
+	u, err := url.Parse(cfg.Endpoint)
+	if err != nil {
+		return nil, fmt.Errorf("otel endpoint: %w", err)
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("otel endpoint %q: want http:// or https://host", u.Redacted())
+	}
+	if !strings.HasSuffix(u.Path, "/v1/traces") {
+		u.Path = strings.TrimSuffix(u.Path, "/") + "/v1/traces"
+	}
+	if cfg.Logger == nil {
+		cfg.Logger = slog.Default()
+	}
+	if cfg.Client == nil {
+		cfg.Client = &http.Client{Timeout: exportTimeout}
+	}
+	if cfg.ExportInterval <= 0 {
+		cfg.ExportInterval = exportInterval
+	}
+	t := &Tracer{
+		url:      u.String(),
+		addr:     u.Redacted(),
+		client:   cfg.Client,
+		logger:   cfg.Logger,
+		interval: cfg.ExportInterval,
+		queue:    make(chan *Span, queueSize),
+		done:     make(chan struct{}),
+	}
+	if cfg.ServiceName != "" {
+		t.resource = append(t.resource, attribute{"service.name", cfg.ServiceName})
+	}
+	if cfg.ServiceVersion != "" {
+		t.resource = append(t.resource, attribute{"service.version", cfg.ServiceVersion})
+	}
+	go t.run()
+	return t, nil
+}
+
+// enqueue hands an ended span to the export loop, dropping it when
+// the queue is full or the tracer is closed.
+func (t *Tracer) enqueue(s *Span) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	if t.closed {
+		return
+	}
+	select {
+	case t.queue <- s:
+	default:
+	}
+}
+
+// run batches queued spans and exports them until Close.
+func (t *Tracer) run() {
+	defer close(t.done)
+	tick := time.NewTicker(t.interval)
+	defer tick.Stop()
+	var batch []*Span
+	flush := func() {
+		if len(batch) == 0 {
+			return
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), exportTimeout)
+		defer cancel()
+		if err := t.export(ctx, batch); err != nil {
+			t.logger.Warn("trace export failed", "error", err, "spans", len(batch))
+		}
+		batch = batch[:0]
+	}
+	for {
+		select {
+		case s, ok := <-t.queue:
+			if !ok {
+				flush()
+				return
+			}
+			batch = append(batch, s)
+			if len(batch) >= maxBatch {
+				flush()
+			}
+		case <-tick.C:
+			flush()
+		}
+	}
+}
+
+// Close stops accepting spans and waits, up to ctx, for the queued
+// ones to be exported. It is a no-op on a nil Tracer.
+func (t *Tracer) Close(ctx context.Context) error {
+	if t == nil {
+		return nil
+	}
+	t.mu.Lock()
+	if !t.closed {
+		t.closed = true
+		close(t.queue)
+	}
+	t.mu.Unlock()
+	select {
+	case <-t.done:
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("trace export to %s: %w", t.addr, ctx.Err())
+	}
+}
+
+// export posts batch to the collector as OTLP/HTTP JSON.
+func (t *Tracer) export(ctx context.Context, batch []*Span) error {
+	body, err := json.Marshal(t.encode(batch))
+	if err != nil {
+		return fmt.Errorf("trace export to %s: %w", t.addr, err)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, t.url, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("trace export to %s: %w", t.addr, err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := t.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("trace export to %s: %w", t.addr, redactURLError(err))
+	}
+	defer resp.Body.Close()               //nolint:errcheck // response body
+	_, _ = io.Copy(io.Discard, resp.Body) // let the connection be reused
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("trace export to %s: %s", t.addr, resp.Status)
+	}
+	return nil
+}
+
+// redactURLError strips the request URL, which may carry credentials,
+// from a *url.Error; the caller names the redacted address instead.
+func redactURLError(err error) error {
+	if ue, ok := err.(*url.Error); ok {
+		return ue.Err
+	}
+	return err
+}
+
+// The otlp* types are the subset of the OTLP/JSON trace encoding
+// (opentelemetry-proto v1 ExportTraceServiceRequest, as OTLP 1.x
+// collectors accept it on /v1/traces) aztunnel emits. As that encoding
+// requires, IDs are lowercase hex rather than base64, enums are
+// integers, and 64-bit integers are decimal strings.
+// TestEncode_WireFormat pins the exact output.
+type otlpRequest struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+type otlpResourceSpans struct {
+	Resource   otlpResource     `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpResource struct {
+	Attributes []otlpKeyValue `json:"attributes,omitempty"`
+}
+
+type otlpScopeSpans struct {
+	Scope otlpScope  `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type otlpScope struct {
+	Name string `json:"name"`
+}
+
+type otlpSpan struct {
+	TraceID           string         `json:"traceId"`
+	SpanID            string         `json:"spanId"`
+	ParentSpanID      string         `json:"parentSpanId,omitempty"`
+	Name              string         `json:"name"`
+	Kind              SpanKind       `json:"kind"`
+	StartTimeUnixNano string         `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string         `json:"endTimeUnixNano"`
+	Attributes        []otlpKeyValue `json:"attributes,omitempty"`
+	Status            *otlpStatus    `json:"status,omitempty"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code"` // 2 = STATUS_CODE_ERROR
+	Message string `json:"message,omitempty"`
+}
+
+type otlpKeyValue struct {
+	Key   string       `json:"key"`
+	Value otlpAnyValue `json:"value"`
+}
+
+type otlpAnyValue struct {
+	StringValue *string  `json:"stringValue,omitempty"`
+	BoolValue   *bool    `json:"boolValue,omitempty"`
+	IntValue    *string  `json:"intValue,omitempty"` // int64 is a JSON string in OTLP
+	DoubleValue *float64 `json:"doubleValue,omitempty"`
+}
+
+func (t *Tracer) encode(batch []*Span) otlpRequest {
+	spans := make([]otlpSpan, 0, len(batch))
+	for _, s := range batch {
+		s.mu.Lock()
+		out := otlpSpan{
+			TraceID:           hex.EncodeToString(s.traceID[:]),
+			SpanID:            hex.EncodeToString(s.spanID[:]),
+			Name:              s.name,
+			Kind:              s.kind,
+			StartTimeUnixNano: strconv.FormatInt(s.start.UnixNano(), 10),
+			EndTimeUnixNano:   strconv.FormatInt(s.end.UnixNano(), 10),
+			Attributes:        keyValues(s.attrs),
+		}
+		if s.parentID != ([8]byte{}) {
+			out.ParentSpanID = hex.EncodeToString(s.parentID[:])
+		}
+		if s.errMsg != "" {
+			out.Status = &otlpStatus{Code: 2, Message: s.errMsg}
+		}
+		s.mu.Unlock()
+		spans = append(spans, out)
+	}
+	return otlpRequest{ResourceSpans: []otlpResourceSpans{{
+		Resource:   otlpResource{Attributes: keyValues(t.resource)},
+		ScopeSpans: []otlpScopeSpans{{Scope: otlpScope{Name: "aztunnel"}, Spans: spans}},
+	}}}
+}
+
+func keyValues(attrs []attribute) []otlpKeyValue {
+	kvs := make([]otlpKeyValue, 0, len(attrs))
+	for _, a := range attrs {
+		kvs = append(kvs, otlpKeyValue{Key: a.key, Value: anyValue(a.value)})
+	}
+	return kvs
+}
+
+func anyValue(v any) otlpAnyValue {
+	intValue := func(i int64) otlpAnyValue {
+		s := strconv.FormatInt(i, 10)
+		return otlpAnyValue{IntValue: &s}
+	}
+	switch v := v.(type) {
+	case string:
+		return otlpAnyValue{StringValue: &v}
+	case bool:
+		return otlpAnyValue{BoolValue: &v}
+	case int:
+		return intValue(int64(v))
+	case int64:
+		return intValue(v)
+	case float64:
+		return otlpAnyValue{DoubleValue: &v}
+	case time.Duration:
+		ms := float64(v) / float64(time.Millisecond)
+		return otlpAnyValue{DoubleValue: &ms}
+	}
+	s := fmt.Sprint(v)
+	return otlpAnyValue{StringValue: &s}
+}
@@ -0,0 +1,168 @@
+// Package tracing records OpenTelemetry spans for the connection
+// lifecycle and exports them to an OTLP/HTTP collector. Span context
+// crosses the relay as a W3C traceparent in the connect envelope's
+// Metadata, so a sender span and the listener span it caused share
+// one trace.
+//
+// A nil *Tracer and a nil *Span are valid and record nothing, so
+// callers never check whether tracing is configured.
+//
+// The exporter is a small OTLP/HTTP JSON client rather than the
+// OpenTelemetry SDK: aztunnel records two span kinds with flat
+// attributes, and the SDK's dependency tree would outweigh the rest
+// of the binary's for that.
+package tracing
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Span attribute keys shared by the sender and listener spans.
+const (
+	AttrTarget       = "aztunnel.target"
+	AttrBackend      = "aztunnel.backend"
+	AttrBridgeID     = "aztunnel.bridge_id"
+	AttrListenerID   = "aztunnel.listener_id"
+	AttrDialDuration = "aztunnel.dial.duration_ms"
+	AttrTCPToWS      = "aztunnel.bytes.tcp_to_ws"
+	AttrWSToTCP      = "aztunnel.bytes.ws_to_tcp"
+	AttrEndCause     = "aztunnel.end_cause"
+	AttrCode         = "aztunnel.code"
+)
+
+// SpanKind is the OTLP span kind.
+type SpanKind int
+
+// Span kinds used by aztunnel. The values are OTLP's.
+const (
+	KindServer SpanKind = 2 // the listener's side of a connection
+	KindClient SpanKind = 3 // the sender's side of a connection
+)
+
+// Span is one timed operation. Its methods are safe for concurrent
+// use; calls after End are ignored.
+type Span struct {
+	tracer   *Tracer
+	name     string
+	kind     SpanKind
+	traceID  [16]byte
+	spanID   [8]byte
+	parentID [8]byte // zero for a root span
+	start    time.Time
+
+	mu     sync.Mutex
+	end    time.Time
+	attrs  []attribute
+	errMsg string
+	ended  bool
+}
+
+type attribute struct {
+	key   string
+	value any
+}
+
+// Start begins a span named name. traceparent is the W3C traceparent
+// of the remote parent, or empty to start a new trace. A parent that
+// was not sampled yields a nil span, so the whole trace stays
+// unrecorded.
+func (t *Tracer) Start(name string, kind SpanKind, traceparent string) *Span {
+	if t == nil {
+		return nil
+	}
+	s := &Span{tracer: t, name: name, kind: kind, start: time.Now()}
+	if traceID, parentID, sampled, ok := parseTraceparent(traceparent); ok {
+		if !sampled {
+			return nil
+		}
+		s.traceID, s.parentID = traceID, parentID
+	} else {
+		_, _ = rand.Read(s.traceID[:])
+	}
+	_, _ = rand.Read(s.spanID[:])
+	return s
+}
+
+// Traceparent returns the span's context in W3C traceparent form for
+// a remote child to continue, or "" for a nil span.
+func (s *Span) Traceparent() string {
+	if s == nil {
+		return ""
+	}
+	return "00-" + hex.EncodeToString(s.traceID[:]) + "-" + hex.EncodeToString(s.spanID[:]) + "-01"
+}
+
+// SetAttr records an attribute. Strings, bools, integers, and floats
+// keep their type; a time.Duration becomes milliseconds; anything else
+// is formatted with fmt.Sprint.
+func (s *Span) SetAttr(key string, value any) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.ended {
+		return
+	}
+	s.attrs = append(s.attrs, attribute{key: key, value: value})
+}
+
+// SetError marks the span failed with err's message. A nil err is
+// ignored, so callers can pass a result error unconditionally.
+func (s *Span) SetError(err error) {
+	if s == nil || err == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.ended {
+		return
+	}
+	s.errMsg = err.Error()
+}
+
+// End finishes the span and queues it for export. Only the first call
+// has an effect.
+func (s *Span) End() {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	if s.ended {
+		s.mu.Unlock()
+		return
+	}
+	s.ended = true
+	s.end = time.Now()
+	s.mu.Unlock()
+	s.tracer.enqueue(s)
+}
+
+// parseTraceparent parses a version-00 W3C traceparent
+// (https://www.w3.org/TR/trace-context/). ok is false for an empty or
+// malformed value, including all-zero IDs, which callers treat as "no
+// parent".
+func parseTraceparent(v string) (traceID [16]byte, parentID [8]byte, sampled, ok bool) {
+	parts := strings.Split(v, "-")
+	if len(parts) != 4 || parts[0] != "00" || len(parts[1]) != 32 || len(parts[2]) != 16 || len(parts[3]) != 2 {
+		return traceID, parentID, false, false
+	}
+	if _, err := hex.Decode(traceID[:], []byte(parts[1])); err != nil || strings.ToLower(parts[1]) != parts[1] {
+		return traceID, parentID, false, false
+	}
+	if _, err := hex.Decode(parentID[:], []byte(parts[2])); err != nil || strings.ToLower(parts[2]) != parts[2] {
+		return traceID, parentID, false, false
+	}
+	var flags [1]byte
+	if _, err := hex.Decode(flags[:], []byte(parts[3])); err != nil {
+		return traceID, parentID, false, false
+	}
+	if traceID == ([16]byte{}) || parentID == ([8]byte{}) {
+		return traceID, parentID, false, false
+	}
+	return traceID, parentID, flags[0]&1 == 1, true
+}
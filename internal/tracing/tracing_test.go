@@ -0,0 +1,275 @@
+package tracing
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// collector is a fake OTLP/HTTP receiver that hands each decoded
+// export request to the test.
+type collector struct {
+	srv  *httptest.Server
+	reqs chan otlpRequest
+	path chan string
+}
+
+func newCollector(t *testing.T, status int) *collector {
+	t.Helper()
+	c := &collector{reqs: make(chan otlpRequest, 16), path: make(chan string, 16)}
+	c.srv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		var req otlpRequest
+		if err := json.Unmarshal(body, &req); err != nil {
+			t.Errorf("collector: bad body %q: %v", body, err)
+		}
+		if ct := r.Header.Get("Content-Type"); ct != "application/json" {
+			t.Errorf("Content-Type = %q, want application/json", ct)
+		}
+		c.path <- r.URL.Path
+		c.reqs <- req
+		w.WriteHeader(status)
+	}))
+	t.Cleanup(c.srv.Close)
+	return c
+}
+
+func (c *collector) next(t *testing.T) otlpRequest {
+	t.Helper()
+	select {
+	case req := <-c.reqs:
+		return req
+	case <-time.After(5 * time.Second):
+		t.Fatal("no export received")
+		return otlpRequest{}
+	}
+}
+
+func TestParseTraceparent(t *testing.T) {
+	const valid = "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+	traceID, parentID, sampled, ok := parseTraceparent(valid)
+	if !ok || !sampled {
+		t.Fatalf("parse %q: ok=%v sampled=%v", valid, ok, sampled)
+	}
+	if got := (&Span{traceID: traceID, spanID: parentID}).Traceparent(); got != valid {
+		t.Errorf("round trip = %q, want %q", got, valid)
+	}
+	if _, _, sampled, ok := parseTraceparent(strings.TrimSuffix(valid, "01") + "00"); !ok || sampled {
+		t.Errorf("flags 00: ok=%v sampled=%v, want ok and unsampled", ok, sampled)
+	}
+	for _, bad := range []string{
+		"",
+		"01-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+		"00-4BF92F3577B34DA6A3CE929D0E0E4736-00f067aa0ba902b7-01",
+		"00-00000000000000000000000000000000-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-0000000000000000-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7",
+		"00-4bf92f3577b34da6a3ce929d0e0e473z-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-zz",
+	} {
+		if _, _, _, ok := parseTraceparent(bad); ok {
+			t.Errorf("parseTraceparent(%q) accepted", bad)
+		}
+	}
+}
+
+func TestNilTracerAndSpan(t *testing.T) {
+	var tr *Tracer
+	span := tr.Start("op", KindClient, "")
+	if span != nil {
+		t.Fatalf("nil tracer returned span %v", span)
+	}
+	span.SetAttr(AttrTarget, "x:1")
+	span.SetError(errors.New("boom"))
+	span.End()
+	if tp := span.Traceparent(); tp != "" {
+		t.Errorf("nil span traceparent = %q, want empty", tp)
+	}
+	if err := tr.Close(context.Background()); err != nil {
+		t.Errorf("nil Close: %v", err)
+	}
+}
+
+func TestNew_Endpoint(t *testing.T) {
+	for _, tc := range []struct{ endpoint, want string }{
+		{"http://collector:4318", "http://collector:4318/v1/traces"},
+		{"http://collector:4318/", "http://collector:4318/v1/traces"},
+		{"https://collector/otlp", "https://collector/otlp/v1/traces"},
+		{"https://collector/v1/traces", "https://collector/v1/traces"},
+	} {
+		tr, err := New(Config{Endpoint: tc.endpoint})
+		if err != nil {
+			t.Fatalf("New(%q): %v", tc.endpoint, err)
+		}
+		if tr.url != tc.want {
+			t.Errorf("New(%q) url = %q, want %q", tc.endpoint, tr.url, tc.want)
+		}
+		_ = tr.Close(context.Background())
+	}
+	for _, bad := range []string{"collector:4318", "ftp://collector", "http://"} {
+		if _, err := New(Config{Endpoint: bad}); err == nil {
+			t.Errorf("New(%q) accepted", bad)
+		}
+	}
+}
+
+func TestExport(t *testing.T) {
+	c := newCollector(t, http.StatusOK)
+	tr, err := New(Config{Endpoint: c.srv.URL, ServiceName: "aztunnel", ServiceVersion: "v1.2.3"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	parent := tr.Start("aztunnel.sender.connect", KindClient, "")
+	parent.SetAttr(AttrTarget, "db:5432")
+	parent.SetAttr(AttrTCPToWS, int64(42))
+	parent.SetAttr(AttrDialDuration, 1500*time.Microsecond)
+	parent.End()
+	child := tr.Start("aztunnel.listener.connect", KindServer, parent.Traceparent())
+	child.SetError(errors.New("connection refused"))
+	child.End()
+	child.SetAttr("late", true) // ignored after End
+	if err := tr.Close(context.Background()); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	if path := <-c.path; path != "/v1/traces" {
+		t.Errorf("path = %q, want /v1/traces", path)
+	}
+	req := c.next(t)
+	rs := req.ResourceSpans[0]
+	if len(rs.Resource.Attributes) != 2 || *rs.Resource.Attributes[0].Value.StringValue != "aztunnel" {
+		t.Errorf("resource = %+v, want service.name and service.version", rs.Resource.Attributes)
+	}
+	spans := rs.ScopeSpans[0].Spans
+	if len(spans) != 2 {
+		t.Fatalf("exported %d spans, want 2", len(spans))
+	}
+	p, ch := spans[0], spans[1]
+	if p.Kind != KindClient || p.ParentSpanID != "" || p.Status != nil {
+		t.Errorf("parent span = %+v, want a root client span without error", p)
+	}
+	if ch.TraceID != p.TraceID || ch.ParentSpanID != p.SpanID || ch.Kind != KindServer {
+		t.Errorf("child trace/parent = %s/%s, want %s/%s", ch.TraceID, ch.ParentSpanID, p.TraceID, p.SpanID)
+	}
+	if ch.Status == nil || ch.Status.Code != 2 || ch.Status.Message != "connection refused" {
+		t.Errorf("child status = %+v, want error", ch.Status)
+	}
+	if len(ch.Attributes) != 0 {
+		t.Errorf("child attributes = %+v, want none after End", ch.Attributes)
+	}
+	attrs := map[string]otlpAnyValue{}
+	for _, kv := range p.Attributes {
+		attrs[kv.Key] = kv.Value
+	}
+	if v := attrs[AttrTarget].StringValue; v == nil || *v != "db:5432" {
+		t.Errorf("%s = %v, want db:5432", AttrTarget, v)
+	}
+	if v := attrs[AttrTCPToWS].IntValue; v == nil || *v != "42" {
+		t.Errorf("%s = %v, want \"42\"", AttrTCPToWS, v)
+	}
+	if v := attrs[AttrDialDuration].DoubleValue; v == nil || *v != 1.5 {
+		t.Errorf("%s = %v, want 1.5", AttrDialDuration, v)
+	}
+}
+
+func TestStart_UnsampledParent(t *testing.T) {
+	tr, err := New(Config{Endpoint: "http://127.0.0.1:1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tr.Close(context.Background()) //nolint:errcheck // nothing queued
+	if s := tr.Start("op", KindServer, "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00"); s != nil {
+		t.Errorf("unsampled parent started span %v", s)
+	}
+}
+
+func TestExport_Interval(t *testing.T) {
+	c := newCollector(t, http.StatusOK)
+	tr, err := New(Config{Endpoint: c.srv.URL, ExportInterval: 10 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tr.Close(context.Background()) //nolint:errcheck // already exported
+	tr.Start("op", KindClient, "").End()
+	if spans := c.next(t).ResourceSpans[0].ScopeSpans[0].Spans; len(spans) != 1 {
+		t.Errorf("exported %d spans, want 1", len(spans))
+	}
+}
+
+func TestExport_ErrorRedactsCredentials(t *testing.T) {
+	c := newCollector(t, http.StatusServiceUnavailable)
+	tr, err := New(Config{Endpoint: strings.Replace(c.srv.URL, "http://", "http://user:hunter2@", 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tr.Close(context.Background()) //nolint:errcheck // test exports directly
+	err = tr.export(context.Background(), []*Span{tr.Start("op", KindClient, "")})
+	if err == nil || !strings.Contains(err.Error(), "503") {
+		t.Fatalf("export err = %v, want the 503 status", err)
+	}
+	if strings.Contains(err.Error(), "hunter2") {
+		t.Errorf("export error leaks the password: %v", err)
+	}
+}
+
+// TestEncode_WireFormat pins the OTLP/JSON field names and value
+// encodings a collector decodes, which TestExport cannot catch since
+// it reads the export back through the same types.
+func TestEncode_WireFormat(t *testing.T) {
+	tr := &Tracer{resource: []attribute{{"service.name", "aztunnel"}}}
+	start := time.Unix(1700000000, 0)
+	s := &Span{
+		name:     "aztunnel.listener.connect",
+		kind:     KindServer,
+		traceID:  [16]byte{0x0a, 15: 0x01},
+		spanID:   [8]byte{0x0b, 7: 0x02},
+		parentID: [8]byte{0x0c, 7: 0x03},
+		start:    start,
+		end:      start.Add(1500 * time.Microsecond),
+		attrs: []attribute{
+			{AttrTarget, "db:5432"},
+			{AttrTCPToWS, int64(42)},
+			{AttrDialDuration, 1500 * time.Microsecond},
+			{"ok", true},
+		},
+		errMsg: "connection refused",
+	}
+	got, err := json.Marshal(tr.encode([]*Span{s}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	const want = `{"resourceSpans":[{
+		"resource":{"attributes":[{"key":"service.name","value":{"stringValue":"aztunnel"}}]},
+		"scopeSpans":[{"scope":{"name":"aztunnel"},"spans":[{
+			"traceId":"0a000000000000000000000000000001",
+			"spanId":"0b00000000000002",
+			"parentSpanId":"0c00000000000003",
+			"name":"aztunnel.listener.connect",
+			"kind":2,
+			"startTimeUnixNano":"1700000000000000000",
+			"endTimeUnixNano":"1700000000001500000",
+			"attributes":[
+				{"key":"aztunnel.target","value":{"stringValue":"db:5432"}},
+				{"key":"aztunnel.bytes.tcp_to_ws","value":{"intValue":"42"}},
+				{"key":"aztunnel.dial.duration_ms","value":{"doubleValue":1.5}},
+				{"key":"ok","value":{"boolValue":true}}
+			],
+			"status":{"code":2,"message":"connection refused"}
+		}]}]
+	}]}`
+	var compact bytes.Buffer
+	if err := json.Compact(&compact, []byte(want)); err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != compact.String() {
+		t.Errorf("encoded request:\n%s\nwant:\n%s", got, compact.String())
+	}
+}
@@ -21,7 +21,7 @@ import (
 // effectively trusts every client — the mock is for local dev/CI only.
 const (
 	DefaultSASKeyName = "dev"
-	DefaultSASKey     = "dev-secret-do-not-use-in-prod"
+	DefaultSASKey     = "ZGV2LXNlY3JldC1kby1ub3QtdXNlLWluLXByb2Q=" // base64 of dev-secret-do-not-use-in-prod
 )
 
 // validateSAS verifies the sb-hc-token query parameter on an inbound